@@ -0,0 +1,301 @@
+package benchclient
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxauctionrpc"
+	"github.com/mit-dci/opencx/cxrpc"
+	"golang.org/x/crypto/sha3"
+)
+
+// adminNonce returns the nonce for an admin command. The exchange only accepts a nonce that's more
+// than the one for the admin command before it, so this is the time in nanoseconds.
+func adminNonce() (nonce uint64) {
+	nonce = uint64(time.Now().UnixNano())
+	return
+}
+
+// Sweep calls the sweep rpc command. The client's key has to be the exchange's admin key.
+func (cl *BenchClient) Sweep(asset string, destination string, feeRate uint64) (sweepReply *cxrpc.SweepReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	sweepReply = new(cxrpc.SweepReply)
+	sweepArgs := &cxrpc.SweepArgs{
+		Asset:       asset,
+		Destination: destination,
+		FeeRate:     feeRate,
+		Nonce:       adminNonce(),
+	}
+
+	// create e = hash(m)
+	sha3 := sha3.New256()
+	sha3.Write(sweepArgs.Serialize())
+	e := sha3.Sum(nil)
+
+	// Sign
+	var compactSig []byte
+	if compactSig, err = koblitz.SignCompact(koblitz.S256(), cl.PrivKey, e, false); err != nil {
+		return
+	}
+
+	// set signature in args
+	sweepArgs.Signature = compactSig
+
+	if err = cl.Call("OpencxRPC.Sweep", sweepArgs, sweepReply); err != nil {
+		return
+	}
+
+	return
+}
+
+// GetReserves calls the getreserves rpc command. The client's key has to be the exchange's admin key.
+func (cl *BenchClient) GetReserves() (getReservesReply *cxrpc.GetReservesReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	getReservesReply = new(cxrpc.GetReservesReply)
+	getReservesArgs := &cxrpc.GetReservesArgs{
+		Nonce: adminNonce(),
+	}
+
+	// create e = hash(m)
+	sha3 := sha3.New256()
+	sha3.Write(getReservesArgs.Serialize())
+	e := sha3.Sum(nil)
+
+	// Sign
+	var compactSig []byte
+	if compactSig, err = koblitz.SignCompact(koblitz.S256(), cl.PrivKey, e, false); err != nil {
+		return
+	}
+
+	// set signature in args
+	getReservesArgs.Signature = compactSig
+
+	if err = cl.Call("OpencxRPC.GetReserves", getReservesArgs, getReservesReply); err != nil {
+		return
+	}
+
+	return
+}
+
+// CheckLedger calls the checkledger rpc command. The client's key has to be the exchange's admin key.
+func (cl *BenchClient) CheckLedger() (checkLedgerReply *cxrpc.CheckLedgerReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	checkLedgerReply = new(cxrpc.CheckLedgerReply)
+	checkLedgerArgs := &cxrpc.CheckLedgerArgs{
+		Nonce: adminNonce(),
+	}
+
+	// create e = hash(m)
+	sha3 := sha3.New256()
+	sha3.Write(checkLedgerArgs.Serialize())
+	e := sha3.Sum(nil)
+
+	// Sign
+	var compactSig []byte
+	if compactSig, err = koblitz.SignCompact(koblitz.S256(), cl.PrivKey, e, false); err != nil {
+		return
+	}
+
+	// set signature in args
+	checkLedgerArgs.Signature = compactSig
+
+	if err = cl.Call("OpencxRPC.CheckLedger", checkLedgerArgs, checkLedgerReply); err != nil {
+		return
+	}
+
+	return
+}
+
+// Reconcile calls the reconcile rpc command. The client's key has to be the exchange's admin key.
+func (cl *BenchClient) Reconcile() (reconcileReply *cxrpc.ReconcileReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	reconcileReply = new(cxrpc.ReconcileReply)
+	reconcileArgs := &cxrpc.ReconcileArgs{
+		Nonce: adminNonce(),
+	}
+
+	// create e = hash(m)
+	sha3 := sha3.New256()
+	sha3.Write(reconcileArgs.Serialize())
+	e := sha3.Sum(nil)
+
+	// Sign
+	var compactSig []byte
+	if compactSig, err = koblitz.SignCompact(koblitz.S256(), cl.PrivKey, e, false); err != nil {
+		return
+	}
+
+	// set signature in args
+	reconcileArgs.Signature = compactSig
+
+	if err = cl.Call("OpencxRPC.Reconcile", reconcileArgs, reconcileReply); err != nil {
+		return
+	}
+
+	return
+}
+
+// ResumeWithdrawals calls the resumewithdrawals rpc command. The client's key has to be the
+// exchange's admin key.
+func (cl *BenchClient) ResumeWithdrawals(asset string) (resumeWithdrawalsReply *cxrpc.ResumeWithdrawalsReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	resumeWithdrawalsReply = new(cxrpc.ResumeWithdrawalsReply)
+	resumeWithdrawalsArgs := &cxrpc.ResumeWithdrawalsArgs{
+		Asset: asset,
+		Nonce: adminNonce(),
+	}
+
+	// create e = hash(m)
+	sha3 := sha3.New256()
+	sha3.Write(resumeWithdrawalsArgs.Serialize())
+	e := sha3.Sum(nil)
+
+	// Sign
+	var compactSig []byte
+	if compactSig, err = koblitz.SignCompact(koblitz.S256(), cl.PrivKey, e, false); err != nil {
+		return
+	}
+
+	// set signature in args
+	resumeWithdrawalsArgs.Signature = compactSig
+
+	if err = cl.Call("OpencxRPC.ResumeWithdrawals", resumeWithdrawalsArgs, resumeWithdrawalsReply); err != nil {
+		return
+	}
+
+	return
+}
+
+// Snapshot calls the snapshot rpc command, which returns a snapshot archive of the exchange. The
+// client's key has to be the exchange's admin key.
+func (cl *BenchClient) Snapshot() (snapshotReply *cxrpc.SnapshotReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	snapshotReply = new(cxrpc.SnapshotReply)
+	snapshotArgs := &cxrpc.SnapshotArgs{
+		Nonce: adminNonce(),
+	}
+
+	// create e = hash(m)
+	sha3 := sha3.New256()
+	sha3.Write(snapshotArgs.Serialize())
+	e := sha3.Sum(nil)
+
+	// Sign
+	var compactSig []byte
+	if compactSig, err = koblitz.SignCompact(koblitz.S256(), cl.PrivKey, e, false); err != nil {
+		return
+	}
+
+	// set signature in args
+	snapshotArgs.Signature = compactSig
+
+	if err = cl.Call("OpencxRPC.Snapshot", snapshotArgs, snapshotReply); err != nil {
+		return
+	}
+
+	return
+}
+
+// AuctionSnapshot calls the snapshot rpc command on an auction server, which returns a snapshot
+// archive of the auction server. The client's key has to be the auction server's admin key.
+func (cl *BenchClient) AuctionSnapshot() (snapshotReply *cxauctionrpc.SnapshotReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	snapshotReply = new(cxauctionrpc.SnapshotReply)
+	snapshotArgs := &cxauctionrpc.SnapshotArgs{
+		Nonce: adminNonce(),
+	}
+
+	// create e = hash(m)
+	sha3 := sha3.New256()
+	sha3.Write(snapshotArgs.Serialize())
+	e := sha3.Sum(nil)
+
+	// Sign
+	var compactSig []byte
+	if compactSig, err = koblitz.SignCompact(koblitz.S256(), cl.PrivKey, e, false); err != nil {
+		return
+	}
+
+	// set signature in args
+	snapshotArgs.Signature = compactSig
+
+	if err = cl.Call("OpencxAuctionRPC.Snapshot", snapshotArgs, snapshotReply); err != nil {
+		return
+	}
+
+	return
+}
+
+// RecordRefill calls the recordrefill rpc command, which records that amount of asset was sent
+// from cold storage to the hot wallet in txid. The client's key has to be the exchange's admin key.
+func (cl *BenchClient) RecordRefill(asset string, txid string, amount uint64) (recordRefillReply *cxrpc.RecordRefillReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	recordRefillReply = new(cxrpc.RecordRefillReply)
+	recordRefillArgs := &cxrpc.RecordRefillArgs{
+		Asset:  asset,
+		Txid:   txid,
+		Amount: amount,
+		Nonce:  adminNonce(),
+	}
+
+	// create e = hash(m)
+	sha3 := sha3.New256()
+	sha3.Write(recordRefillArgs.Serialize())
+	e := sha3.Sum(nil)
+
+	// Sign
+	var compactSig []byte
+	if compactSig, err = koblitz.SignCompact(koblitz.S256(), cl.PrivKey, e, false); err != nil {
+		return
+	}
+
+	// set signature in args
+	recordRefillArgs.Signature = compactSig
+
+	if err = cl.Call("OpencxRPC.RecordRefill", recordRefillArgs, recordRefillReply); err != nil {
+		return
+	}
+
+	return
+}
@@ -2,6 +2,7 @@ package benchclient
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/opencx/cxrpc"
@@ -9,8 +10,18 @@ import (
 	"golang.org/x/crypto/sha3"
 )
 
-// GetBalance calls the getbalance rpc command
+// GetBalance calls the getbalance rpc command, the balance is the sum of every sub-account
 func (cl *BenchClient) GetBalance(asset string) (getBalanceReply *cxrpc.GetBalanceReply, err error) {
+	return cl.getBalance(asset, nil)
+}
+
+// GetSubAccountBalance calls the getbalance rpc command for a single sub-account
+func (cl *BenchClient) GetSubAccountBalance(asset string, subAccount uint32) (getBalanceReply *cxrpc.GetBalanceReply, err error) {
+	return cl.getBalance(asset, &subAccount)
+}
+
+// getBalance calls the getbalance rpc command, with an optional sub-account
+func (cl *BenchClient) getBalance(asset string, subAccount *uint32) (getBalanceReply *cxrpc.GetBalanceReply, err error) {
 
 	if cl.PrivKey == nil {
 		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
@@ -19,7 +30,8 @@ func (cl *BenchClient) GetBalance(asset string) (getBalanceReply *cxrpc.GetBalan
 
 	getBalanceReply = new(cxrpc.GetBalanceReply)
 	getBalanceArgs := &cxrpc.GetBalanceArgs{
-		Asset: asset,
+		Asset:      asset,
+		SubAccount: subAccount,
 	}
 
 	// create e = hash(m)
@@ -71,6 +83,37 @@ func (cl *BenchClient) GetDepositAddress(asset string) (getDepositAddressReply *
 	return
 }
 
+// GetDeposits calls the getdeposits rpc command
+func (cl *BenchClient) GetDeposits(asset string) (getDepositsReply *cxrpc.GetDepositsReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	getDepositsReply = new(cxrpc.GetDepositsReply)
+	getDepositsArgs := &cxrpc.GetDepositsArgs{
+		Asset: asset,
+	}
+
+	// create e = hash(m)
+	sha3 := sha3.New256()
+	sha3.Write([]byte(asset))
+	e := sha3.Sum(nil)
+
+	// Sign
+	compactSig, err := koblitz.SignCompact(koblitz.S256(), cl.PrivKey, e, false)
+
+	// set signature in args
+	getDepositsArgs.Signature = compactSig
+
+	if err = cl.Call("OpencxRPC.GetDeposits", getDepositsArgs, getDepositsReply); err != nil {
+		return
+	}
+
+	return
+}
+
 // GetAllBalances get the balance for every token
 func (cl *BenchClient) GetAllBalances() (balances map[string]uint64, err error) {
 
@@ -85,17 +128,17 @@ func (cl *BenchClient) GetAllBalances() (balances map[string]uint64, err error)
 		return
 	}
 
-	balances["regtest"] = reply.Amount
+	balances["regtest"] = reply.Available
 
 	if reply, err = cl.GetBalance("vtcreg"); err != nil {
 		return
 	}
-	balances["vtcreg"] = reply.Amount
+	balances["vtcreg"] = reply.Available
 
 	if reply, err = cl.GetBalance("litereg"); err != nil {
 		return
 	}
-	balances["litereg"] = reply.Amount
+	balances["litereg"] = reply.Available
 
 	return
 }
@@ -180,3 +223,158 @@ func (cl *BenchClient) WithdrawLightning(amount uint64, asset match.Asset) (with
 
 	return
 }
+
+// Transfer calls the transfer rpc command, moving amount of asset from the client's sub-account to
+// the main account for the pubkey. The nonce has to be more than the nonce of the client's last
+// transfer.
+func (cl *BenchClient) Transfer(to *koblitz.PublicKey, amount uint64, asset match.Asset, nonce uint64) (transferReply *cxrpc.TransferReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	transfer := &match.Transfer{
+		FromSubAccount: cl.SubAccount,
+		Asset:          asset,
+		Amount:         amount,
+		Nonce:          nonce,
+	}
+	copy(transfer.From[:], cl.PrivKey.PubKey().SerializeCompressed())
+	copy(transfer.To[:], to.SerializeCompressed())
+
+	return cl.signAndTransfer(transfer)
+}
+
+// SubAccountTransfer calls the transfer rpc command, moving amount of asset between two of the
+// client's own sub-accounts. The nonce has to be more than the nonce of the client's last transfer.
+func (cl *BenchClient) SubAccountTransfer(fromSubAccount uint32, toSubAccount uint32, amount uint64, asset match.Asset, nonce uint64) (transferReply *cxrpc.TransferReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	transfer := &match.Transfer{
+		FromSubAccount: fromSubAccount,
+		ToSubAccount:   toSubAccount,
+		Asset:          asset,
+		Amount:         amount,
+		Nonce:          nonce,
+	}
+	copy(transfer.From[:], cl.PrivKey.PubKey().SerializeCompressed())
+	transfer.To = transfer.From
+
+	return cl.signAndTransfer(transfer)
+}
+
+// signAndTransfer signs a transfer with the client's key and calls the transfer rpc command
+func (cl *BenchClient) signAndTransfer(transfer *match.Transfer) (transferReply *cxrpc.TransferReply, err error) {
+
+	transferReply = new(cxrpc.TransferReply)
+	transferArgs := &cxrpc.TransferArgs{
+		Transfer: transfer,
+	}
+
+	// create e = hash(m)
+	sha3 := sha3.New256()
+	sha3.Write(transferArgs.Transfer.Serialize())
+	e := sha3.Sum(nil)
+
+	// Sign
+	var compactSig []byte
+	if compactSig, err = koblitz.SignCompact(koblitz.S256(), cl.PrivKey, e, false); err != nil {
+		return
+	}
+
+	// set signature in args
+	transferArgs.Signature = compactSig
+
+	if err = cl.Call("OpencxRPC.Transfer", transferArgs, transferReply); err != nil {
+		return
+	}
+
+	return
+}
+
+// GetAccountStatement calls the getaccountstatement rpc command
+func (cl *BenchClient) GetAccountStatement(asset string, from time.Time, to time.Time) (getAccountStatementReply *cxrpc.GetAccountStatementReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	getAccountStatementReply = new(cxrpc.GetAccountStatementReply)
+	getAccountStatementArgs := &cxrpc.GetAccountStatementArgs{
+		Asset: asset,
+		From:  from.Unix(),
+		To:    to.Unix(),
+	}
+
+	// create e = hash(m)
+	sha3 := sha3.New256()
+	sha3.Write(getAccountStatementArgs.Serialize())
+	e := sha3.Sum(nil)
+
+	// Sign
+	var compactSig []byte
+	if compactSig, err = koblitz.SignCompact(koblitz.S256(), cl.PrivKey, e, false); err != nil {
+		return
+	}
+
+	// set signature in args
+	getAccountStatementArgs.Signature = compactSig
+
+	if err = cl.Call("OpencxRPC.GetAccountStatement", getAccountStatementArgs, getAccountStatementReply); err != nil {
+		return
+	}
+
+	return
+}
+
+// GetLiabilityProof calls the getliabilityproof rpc command
+func (cl *BenchClient) GetLiabilityProof(asset string) (getLiabilityProofReply *cxrpc.GetLiabilityProofReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	getLiabilityProofReply = new(cxrpc.GetLiabilityProofReply)
+	getLiabilityProofArgs := &cxrpc.GetLiabilityProofArgs{
+		Asset: asset,
+	}
+
+	// create e = hash(m)
+	sha3 := sha3.New256()
+	sha3.Write([]byte(asset))
+	e := sha3.Sum(nil)
+
+	// Sign
+	var compactSig []byte
+	if compactSig, err = koblitz.SignCompact(koblitz.S256(), cl.PrivKey, e, false); err != nil {
+		return
+	}
+
+	// set signature in args
+	getLiabilityProofArgs.Signature = compactSig
+
+	if err = cl.Call("OpencxRPC.GetLiabilityProof", getLiabilityProofArgs, getLiabilityProofReply); err != nil {
+		return
+	}
+
+	return
+}
+
+// GetLiabilitySnapshots gets every liability snapshot the exchange has published
+func (cl *BenchClient) GetLiabilitySnapshots() (getLiabilitySnapshotsReply *cxrpc.GetLiabilitySnapshotsReply, err error) {
+	getLiabilitySnapshotsReply = new(cxrpc.GetLiabilitySnapshotsReply)
+	getLiabilitySnapshotsArgs := new(cxrpc.GetLiabilitySnapshotsArgs)
+
+	if err = cl.Call("OpencxRPC.GetLiabilitySnapshots", getLiabilitySnapshotsArgs, getLiabilitySnapshotsReply); err != nil {
+		return
+	}
+
+	return
+}
@@ -11,6 +11,10 @@ type BenchClient struct {
 	port      uint16
 	RPCClient cxrpc.OpencxClient
 	PrivKey   *koblitz.PrivateKey
+	// SubAccount is the sub-account that orders are placed from and transfers are sent from
+	SubAccount uint32
+	// Swap makes orders swap orders, which are settled over lightning channels instead of balances
+	Swap bool
 }
 
 // SetupBenchClient creates a new BenchClient for use as an RPC Client
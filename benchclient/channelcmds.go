@@ -3,7 +3,9 @@ package benchclient
 import (
 	"fmt"
 
+	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/opencx/cxrpc"
+	"golang.org/x/crypto/sha3"
 )
 
 // GetLitConnection gets the lit con to pass in to lit. Maybe do this more automatically later on
@@ -35,3 +37,39 @@ func (cl *BenchClient) WithdrawToLightningNode() (withdrawToLightningNodeReply *
 
 	return
 }
+
+// GetSwaps gets the atomic swaps for the client's swap orders, by signing the getOrdersString
+func (cl *BenchClient) GetSwaps() (getSwapsReply *cxrpc.GetSwapsReply, err error) {
+
+	if cl.PrivKey == nil {
+		err = fmt.Errorf("Private key nonexistent, set or specify private key so the client can sign commands")
+		return
+	}
+
+	getOrdersStringReply := new(cxrpc.GetOrdersStringReply)
+	if err = cl.Call("OpencxRPC.GetOrdersString", &cxrpc.GetOrdersStringArgs{}, getOrdersStringReply); err != nil {
+		return
+	}
+
+	// create e = hash(m)
+	sha3 := sha3.New256()
+	sha3.Write([]byte(getOrdersStringReply.GetOrdersString))
+	e := sha3.Sum(nil)
+
+	// Sign
+	var compactSig []byte
+	if compactSig, err = koblitz.SignCompact(koblitz.S256(), cl.PrivKey, e, false); err != nil {
+		return
+	}
+
+	getSwapsReply = new(cxrpc.GetSwapsReply)
+	getSwapsArgs := &cxrpc.GetSwapsArgs{
+		Signature: compactSig,
+	}
+
+	if err = cl.Call("OpencxRPC.GetSwaps", getSwapsArgs, getSwapsReply); err != nil {
+		return
+	}
+
+	return
+}
@@ -48,6 +48,8 @@ func (cl *BenchClient) OrderAsync(pubkey *koblitz.PublicKey, side match.Side, pa
 		var newOrder match.LimitOrder
 
 		copy(newOrder.Pubkey[:], pubkey.SerializeCompressed())
+		newOrder.SubAccount = cl.SubAccount
+		newOrder.Swap = cl.Swap
 		newOrder.Side = side
 
 		// get the trading pair string from the shell input - third parameter
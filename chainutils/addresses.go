@@ -0,0 +1,129 @@
+package chainutils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mit-dci/lit/bech32"
+	"github.com/mit-dci/lit/btcutil"
+	"github.com/mit-dci/lit/btcutil/base58"
+	"github.com/mit-dci/lit/btcutil/txscript"
+	"github.com/mit-dci/lit/coinparam"
+)
+
+// AddressType is the kind of address that we give out to users for deposits
+type AddressType uint8
+
+const (
+	// P2PKHAddress is a legacy base58 pay to pubkey hash address
+	P2PKHAddress AddressType = iota
+	// P2WPKHAddress is a native segwit bech32 pay to witness pubkey hash address
+	P2WPKHAddress
+	// P2SHP2WPKHAddress is a pay to witness pubkey hash address wrapped in pay to script hash
+	P2SHP2WPKHAddress
+)
+
+// String returns the name of the address type, the same way ScriptType would name the output script
+func (at AddressType) String() string {
+	switch at {
+	case P2PKHAddress:
+		return "P2PKH"
+	case P2WPKHAddress:
+		return "P2WPKH"
+	case P2SHP2WPKHAddress:
+		return "P2SH-P2WPKH"
+	}
+	return "UNKNOWN"
+}
+
+// AddressTypeFromString parses an address type, case insensitive. Works with the output of String.
+func AddressTypeFromString(str string) (at AddressType, err error) {
+	switch strings.ToUpper(str) {
+	case "P2PKH":
+		at = P2PKHAddress
+	case "P2WPKH":
+		at = P2WPKHAddress
+	case "P2SH-P2WPKH":
+		at = P2SHP2WPKHAddress
+	default:
+		err = fmt.Errorf("Unknown address type %s, must be one of P2PKH, P2WPKH, P2SH-P2WPKH", str)
+	}
+	return
+}
+
+// P2SHP2WPKHRedeemScript returns the redeem script for a pubkey hash wrapped in P2SH, which is just
+// the P2WPKH output script.
+func P2SHP2WPKHRedeemScript(pkh [20]byte) (redeemScript []byte) {
+	redeemScript = append([]byte{0x00, 0x14}, pkh[:]...)
+	return
+}
+
+// AddressFromPKH encodes a pubkey hash as an address of the given type for the coin.
+func AddressFromPKH(pkh [20]byte, addrType AddressType, param *coinparam.Params) (addr string, err error) {
+	switch addrType {
+	case P2PKHAddress:
+		addr = base58.CheckEncode(pkh[:], param.PubKeyHashAddrID)
+	case P2WPKHAddress:
+		if param.Bech32Prefix == "" {
+			err = fmt.Errorf("Coin %s does not support bech32 addresses", param.Name)
+			return
+		}
+		if addr, err = bech32.SegWitV0Encode(param.Bech32Prefix, pkh[:]); err != nil {
+			err = fmt.Errorf("Error encoding bech32 address for AddressFromPKH: %s", err)
+			return
+		}
+	case P2SHP2WPKHAddress:
+		scriptHash := btcutil.Hash160(P2SHP2WPKHRedeemScript(pkh))
+		addr = base58.CheckEncode(scriptHash, param.ScriptHashAddrID)
+	default:
+		err = fmt.Errorf("Unknown address type %d for AddressFromPKH", addrType)
+	}
+	return
+}
+
+// AddressFromScript returns the address an output script pays to, if the script is one that we would
+// give out as a deposit address (P2PKH, P2WPKH, or P2SH). Other script types return an empty address.
+func AddressFromScript(pkScript []byte, param *coinparam.Params) (addr string, err error) {
+	scriptType, data := ScriptType(pkScript)
+	switch scriptType {
+	case "P2PKH":
+		addr = base58.CheckEncode(data, param.PubKeyHashAddrID)
+	case "P2WPKH":
+		if param.Bech32Prefix == "" {
+			return
+		}
+		if addr, err = bech32.SegWitV0Encode(param.Bech32Prefix, data); err != nil {
+			err = fmt.Errorf("Error encoding bech32 address for AddressFromScript: %s", err)
+			return
+		}
+	case "P2SH":
+		addr = base58.CheckEncode(data, param.ScriptHashAddrID)
+	}
+	return
+}
+
+// ScriptFromAddress returns the output script that pays to an address. Both base58 and bech32
+// addresses are supported.
+func ScriptFromAddress(addr string, param *coinparam.Params) (pkScript []byte, err error) {
+	if param.Bech32Prefix != "" {
+		if hrp, hrpErr := bech32.GetHRP(addr); hrpErr == nil && hrp == param.Bech32Prefix {
+			if pkScript, err = bech32.SegWitAddressDecode(addr); err != nil {
+				err = fmt.Errorf("Error decoding bech32 address for ScriptFromAddress: %s", err)
+				return
+			}
+			return
+		}
+	}
+
+	var decoded btcutil.Address
+	if decoded, err = btcutil.DecodeAddress(addr, param); err != nil {
+		err = fmt.Errorf("Error decoding address for ScriptFromAddress: %s", err)
+		return
+	}
+
+	if pkScript, err = txscript.PayToAddrScript(decoded); err != nil {
+		err = fmt.Errorf("Error creating script from address for ScriptFromAddress: %s", err)
+		return
+	}
+	return
+}
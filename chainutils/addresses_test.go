@@ -0,0 +1,28 @@
+package chainutils
+
+import (
+	"testing"
+)
+
+func TestAddressTypeFromString(t *testing.T) {
+	var err error
+
+	for _, addrType := range []AddressType{P2PKHAddress, P2WPKHAddress, P2SHP2WPKHAddress} {
+		var parsed AddressType
+		if parsed, err = AddressTypeFromString(addrType.String()); err != nil {
+			t.Errorf("Error parsing address type %s: %s", addrType.String(), err)
+			return
+		}
+		if parsed != addrType {
+			t.Errorf("Parsed address type %s should have been %s", parsed.String(), addrType.String())
+			return
+		}
+	}
+
+	if _, err = AddressTypeFromString("P2TR"); err == nil {
+		t.Errorf("Parsing an unknown address type should fail")
+		return
+	}
+
+	return
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"os"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/mit-dci/lit/coinparam"
+	util "github.com/mit-dci/opencx/chainutils"
+	"github.com/mit-dci/opencx/cxdb/cxdbkv"
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+	"github.com/mit-dci/opencx/cxdb/cxdbsql"
+	"github.com/mit-dci/opencx/cxserver"
+	"github.com/mit-dci/opencx/logging"
+	"github.com/mit-dci/opencx/match"
+)
+
+type cxbackupConfig struct {
+	ArchiveFile string `long:"archive" required:"true" description:"File to write the snapshot archive to when backing up, or read it from when restoring"`
+	Restore     bool   `long:"restore" description:"Restore the archive into the backend instead of backing the backend up"`
+
+	// where the exchange's data is
+	Backend string   `long:"backend" description:"Backend to back up or restore into: sql or kv. To run an archive in memory, start opencxd with --memory --restore"`
+	DBFile  string   `long:"dbfile" description:"Data file for the kv backend"`
+	Coins   []string `long:"coin" description:"Name of a coin the exchange runs, can be given more than once. Only needed when backing up, a restore uses the coins in the archive"`
+	HomeDir string   `long:"dir" description:"Root directory of opencxd, where transfers are kept. Transfers are left out of a backup without it"`
+}
+
+var (
+	defaultBackend = "sql"
+)
+
+func main() {
+	var err error
+
+	conf := cxbackupConfig{
+		Backend: defaultBackend,
+	}
+	parser := flags.NewParser(&conf, flags.Default)
+	if _, err = parser.Parse(); err != nil {
+		os.Exit(1)
+	}
+
+	if conf.Restore {
+		restore(&conf)
+		return
+	}
+	backup(&conf)
+	return
+}
+
+// backup takes a snapshot of the backend and writes it to the archive file. opencxd should not be
+// running, otherwise use the snapshot admin command to get a consistent snapshot.
+func backup(conf *cxbackupConfig) {
+	var err error
+
+	var coinList []*coinparam.Params
+	for _, name := range conf.Coins {
+		var coin *coinparam.Params
+		if coin, err = util.GetParamFromName(name); err != nil {
+			logging.Fatalf("Error getting coin %s: %s", name, err)
+		}
+		coinList = append(coinList, coin)
+	}
+	if len(coinList) == 0 {
+		logging.Fatalf("Specify the coins the exchange runs with --coin")
+	}
+
+	var pairList []*match.Pair
+	if pairList, err = match.GenerateAssetPairs(coinList); err != nil {
+		logging.Fatalf("Could not generate asset pairs from coin list: %s", err)
+	}
+
+	stores := createStores(conf, pairList, coinList)
+
+	var snap *cxdbsnapshot.Snapshot
+	if snap, err = cxdbsnapshot.Take(stores); err != nil {
+		logging.Fatalf("Error taking snapshot: %s", err)
+	}
+	if conf.HomeDir != "" {
+		server := transferServer(conf)
+		if err = server.LoadTransfers(); err != nil {
+			logging.Fatalf("Error loading transfers: %s", err)
+		}
+		snap.Transfers = server.SnapshotTransfers()
+	}
+
+	var archiveFile *os.File
+	if archiveFile, err = os.OpenFile(conf.ArchiveFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+		logging.Fatalf("Error creating archive file: %s", err)
+	}
+	defer archiveFile.Close()
+
+	if err = cxdbsnapshot.WriteArchive(archiveFile, snap); err != nil {
+		logging.Fatalf("Error writing archive: %s", err)
+	}
+
+	printSummary(snap)
+	return
+}
+
+// restore reads the archive file and restores it into the backend, which has to be empty, then
+// checks that the backend has everything in the archive
+func restore(conf *cxbackupConfig) {
+	var err error
+
+	var archiveFile *os.File
+	if archiveFile, err = os.Open(conf.ArchiveFile); err != nil {
+		logging.Fatalf("Error opening archive file: %s", err)
+	}
+	defer archiveFile.Close()
+
+	var snap *cxdbsnapshot.Snapshot
+	if snap, err = cxdbsnapshot.ReadArchive(archiveFile); err != nil {
+		logging.Fatalf("Error reading archive: %s", err)
+	}
+
+	var coinList []*coinparam.Params
+	for _, asset := range snap.Assets {
+		var coin *coinparam.Params
+		if coin, err = util.GetParamFromName(asset.Coin); err != nil {
+			logging.Fatalf("Error getting coin %s from archive: %s", asset.Coin, err)
+		}
+		coinList = append(coinList, coin)
+	}
+
+	// the pairs come from the archive rather than the coins, since the assets are sorted by name
+	// and a pair generated from them could be the other way around
+	var pairList []*match.Pair
+	for _, market := range snap.Markets {
+		pair := market.Pair
+		pairList = append(pairList, &pair)
+	}
+
+	stores := createStores(conf, pairList, coinList)
+
+	if len(snap.Transfers) != 0 && conf.HomeDir == "" {
+		logging.Fatalf("The archive has transfers, specify the opencxd root directory to restore them into with --dir")
+	}
+
+	if err = cxdbsnapshot.Restore(stores, snap); err != nil {
+		logging.Fatalf("Error restoring snapshot: %s", err)
+	}
+	if err = cxdbsnapshot.Verify(stores, snap); err != nil {
+		logging.Fatalf("Error verifying restored snapshot: %s", err)
+	}
+	if conf.HomeDir != "" {
+		if err = transferServer(conf).RestoreTransfers(snap.Transfers); err != nil {
+			logging.Fatalf("Error restoring transfers: %s", err)
+		}
+	}
+
+	printSummary(snap)
+	return
+}
+
+// transferServer creates a server with nothing but the root directory, to read and write the
+// transfers kept there
+func transferServer(conf *cxbackupConfig) (server *cxserver.OpencxServer) {
+	var err error
+	if server, err = cxserver.InitServer(nil, nil, nil, nil, nil, conf.HomeDir); err != nil {
+		logging.Fatalf("Error creating server for transfers: %s", err)
+	}
+	return
+}
+
+// createStores creates every store the snapshot reads or restores for the backend
+func createStores(conf *cxbackupConfig, pairList []*match.Pair, coinList []*coinparam.Params) (stores *cxdbsnapshot.Stores) {
+	var err error
+
+	switch conf.Backend {
+	case "memory":
+		logging.Fatalf("The memory backend only lasts as long as opencxd, use the snapshot admin command to back it up, or start opencxd with --memory --restore to restore into it")
+	case "kv":
+		if conf.DBFile == "" {
+			logging.Fatalf("Specify the data file for the kv backend with --dbfile")
+		}
+		// The handle stays open until cxbackup exits
+		var kvDB *cxdbkv.DB
+		if kvDB, err = cxdbkv.OpenDB(conf.DBFile); err != nil {
+			break
+		}
+		stores, err = cxdbkv.CreateSnapshotStores(kvDB, pairList, coinList)
+	case "sql":
+		stores, err = cxdbsql.CreateSnapshotStores(pairList, coinList)
+	default:
+		logging.Fatalf("Unknown backend %s, use sql or kv", conf.Backend)
+	}
+	if err != nil {
+		logging.Fatalf("Error creating %s stores: %s", conf.Backend, err)
+	}
+
+	return
+}
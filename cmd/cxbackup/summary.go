@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+)
+
+// printSummary prints how much of the exchange is in a snapshot
+func printSummary(snap *cxdbsnapshot.Snapshot) {
+	fmt.Printf("Snapshot version %d taken at %s\n", snap.Version, snap.Time.UTC().Format(time.RFC3339))
+	for _, market := range snap.Markets {
+		var auctionOrders int
+		for _, auction := range market.Auctions {
+			auctionOrders += len(auction.Orders)
+		}
+		fmt.Printf("%s: %d limit orders, %d auctions with %d auction orders, %d archived orders\n", market.Pair.String(), len(market.LimitOrders), len(market.Auctions), auctionOrders, len(market.ArchivedLimitOrders)+len(market.ArchivedAuctionOrders))
+	}
+	for _, asset := range snap.Assets {
+		fmt.Printf("%s: %d balances, %d ledger entries, %d deposit users, %d deposits\n", asset.Coin, len(asset.Balances), len(asset.Ledger), len(asset.DepositUsers), len(asset.Deposits))
+	}
+	fmt.Printf("%d transfers\n", len(snap.Transfers))
+	return
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/crypto/provisions"
+	"github.com/mit-dci/opencx/logging"
+	"github.com/mit-dci/zksigma"
+)
+
+type cxprovisionsConfig struct {
+	// the anonymity set and the proof
+	AnonSetFile string `long:"anonset" required:"true" description:"File with the anonymity set, one hex compressed pubkey and balance per line"`
+	ProofFile   string `long:"proof" required:"true" description:"File to write the proof to when proving, or read it from when verifying"`
+
+	// only for proving
+	KeyFile string `long:"keys" description:"File with the exchange's private keys, one hex key per line. If this is set a proof is created, otherwise the proof is verified"`
+
+	// only for verifying, if the exchange opens the asset commitment
+	Assets   uint64 `long:"assets" description:"Total assets the asset commitment should open to"`
+	Blinding string `long:"blinding" description:"Hex blinding factor that opens the asset commitment"`
+}
+
+func main() {
+	var err error
+
+	var conf cxprovisionsConfig
+	parser := flags.NewParser(&conf, flags.Default)
+	if _, err = parser.Parse(); err != nil {
+		os.Exit(1)
+	}
+
+	curve := koblitz.S256()
+	var anonSet []*provisions.AnonSetEntry
+	if anonSet, err = provisions.ReadAnonSetFile(curve, conf.AnonSetFile); err != nil {
+		logging.Fatalf("Error reading anonymity set: %s", err)
+	}
+
+	if conf.KeyFile != "" {
+		prove(&conf, curve, anonSet)
+		return
+	}
+	verify(&conf, curve, anonSet)
+	return
+}
+
+// prove creates a proof of assets over the anonymity set and writes it to the proof file
+func prove(conf *cxprovisionsConfig, curve *koblitz.KoblitzCurve, anonSet []*provisions.AnonSetEntry) {
+	var err error
+
+	var machine *provisions.AssetsProofMachine
+	if machine, err = provisions.NewAssetsProofMachine(curve); err != nil {
+		logging.Fatalf("Error creating assets proof machine: %s", err)
+	}
+	machine.AddAnonSet(anonSet)
+
+	var privkeys []*ecdsa.PrivateKey
+	if privkeys, err = provisions.ReadPrivKeysFile(curve, conf.KeyFile); err != nil {
+		logging.Fatalf("Error reading private keys: %s", err)
+	}
+	for _, privkey := range privkeys {
+		machine.AddPrivKey(privkey)
+	}
+
+	var proof *provisions.AssetsProof
+	if proof, err = machine.Prove(); err != nil {
+		logging.Fatalf("Error proving assets: %s", err)
+	}
+
+	if err = ioutil.WriteFile(conf.ProofFile, proof.Serialize(), 0644); err != nil {
+		logging.Fatalf("Error writing proof: %s", err)
+	}
+
+	var assetCommitment *zksigma.ECPoint
+	if assetCommitment, err = machine.CalculateAssetCommitment(); err != nil {
+		logging.Fatalf("Error calculating asset commitment: %s", err)
+	}
+
+	var totalAssets uint64
+	var blinding *big.Int
+	if totalAssets, blinding, err = machine.AssetOpening(); err != nil {
+		logging.Fatalf("Error opening asset commitment: %s", err)
+	}
+
+	fmt.Printf("Proved assets over %d keys\n", len(anonSet))
+	fmt.Printf("Asset commitment: %x\n", assetCommitment.Bytes())
+	fmt.Printf("Total assets: %d\n", totalAssets)
+	fmt.Printf("Blinding factor (keep this private unless publishing total assets): %x\n", blinding)
+	return
+}
+
+// verify reads a proof of assets from the proof file and verifies it against the anonymity set
+func verify(conf *cxprovisionsConfig, curve *koblitz.KoblitzCurve, anonSet []*provisions.AnonSetEntry) {
+	var err error
+
+	var proofBytes []byte
+	if proofBytes, err = ioutil.ReadFile(conf.ProofFile); err != nil {
+		logging.Fatalf("Error reading proof: %s", err)
+	}
+
+	proof := new(provisions.AssetsProof)
+	if err = proof.Deserialize(curve, proofBytes); err != nil {
+		logging.Fatalf("Error deserializing proof: %s", err)
+	}
+
+	var assetCommitment *zksigma.ECPoint
+	if assetCommitment, err = provisions.VerifyAssetsProof(curve, anonSet, proof); err != nil {
+		logging.Fatalf("Proof of assets is invalid: %s", err)
+	}
+	fmt.Printf("Proof of assets over %d keys is valid\n", len(anonSet))
+	fmt.Printf("Asset commitment: %x\n", assetCommitment.Bytes())
+
+	if conf.Blinding == "" {
+		return
+	}
+
+	blinding, ok := new(big.Int).SetString(conf.Blinding, 16)
+	if !ok {
+		logging.Fatalf("Blinding factor must be hex")
+	}
+	if err = provisions.VerifyAssetOpening(curve, assetCommitment, conf.Assets, blinding); err != nil {
+		logging.Fatalf("Asset commitment opening is invalid: %s", err)
+	}
+	fmt.Printf("Asset commitment opens to %d\n", conf.Assets)
+	return
+}
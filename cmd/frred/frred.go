@@ -1,10 +1,13 @@
 package main
 
 import (
+	"encoding/hex"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/lit/crypto/koblitz"
@@ -13,7 +16,9 @@ import (
 	"github.com/mit-dci/opencx/cxauctionrpc"
 	"github.com/mit-dci/opencx/cxauctionserver"
 	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/cxdb/cxdbkv"
 	"github.com/mit-dci/opencx/cxdb/cxdbsql"
+	"github.com/mit-dci/opencx/cxrest"
 	"github.com/mit-dci/opencx/logging"
 	"github.com/mit-dci/opencx/match"
 )
@@ -29,6 +34,9 @@ type frredConfig struct {
 	Rpcport uint16 `short:"p" long:"rpcport" description:"Set RPC port to connect to"`
 	Rpchost string `long:"rpchost" description:"Set RPC host to listen to"`
 
+	// the REST gateway is only started if this is set
+	Restport uint16 `long:"restport" description:"Set port to serve the HTTP/JSON REST gateway on, on the RPC host"`
+
 	// logging and debug parameters
 	LogLevel []bool `short:"v" description:"Set verbosity level to verbose (-v), very verbose (-vv) or very very verbose (-vvv)"`
 
@@ -67,6 +75,16 @@ type frredConfig struct {
 	// Auction server options
 	AuctionTime  uint64 `long:"auctiontime" description:"Time it should take to generate a timelock puzzle protected order"`
 	MaxBatchSize uint64 `long:"maxbatchsize" description:"Maximum number of orders that can go in a batch"`
+
+	// how long to keep filled, cancelled, and rejected orders, and how often to prune the ones that are older
+	OrderRetention       uint64 `long:"orderretention" description:"How long to keep filled, cancelled, and rejected orders in the order archive, in hours. 0 keeps them forever"`
+	ArchivePruneInterval uint64 `long:"archivepruneinterval" description:"How often to prune orders older than the retention from the order archive, in seconds"`
+
+	// where to store orders, balances, and puzzles
+	DBBackend string `long:"dbbackend" description:"Storage backend to use: sql for the SQL server, or kv for a single data file in the root frred directory"`
+
+	// who can call admin commands
+	AdminPubkey string `long:"adminpubkey" description:"Hex pubkey allowed to call admin commands like snapshot. Defaults to the auction server's own key"`
 }
 
 var (
@@ -90,6 +108,13 @@ var (
 	// default auction options
 	defaultAuctionTime  = uint64(30000)
 	defaultMaxBatchSize = uint64(1000)
+
+	// default archive options
+	defaultArchivePruneInterval = uint64(3600)
+
+	// default storage options
+	defaultDBBackend  = "sql"
+	defaultDBFilename = "frred.db"
 )
 
 // newConfigParser returns a new command line flags parser.
@@ -113,11 +138,19 @@ func main() {
 		LightningSupport: defaultLightningSupport,
 		AuctionTime:      defaultAuctionTime,
 		MaxBatchSize:     defaultMaxBatchSize,
+		DBBackend:        defaultDBBackend,
+
+		ArchivePruneInterval: defaultArchivePruneInterval,
 	}
 
 	// Check and load config params
 	key := opencxSetup(&conf)
 
+	// A ticker can't tick every 0 seconds, so pruning needs a real interval
+	if conf.OrderRetention > 0 && conf.ArchivePruneInterval == 0 {
+		logging.Fatalf("The archive prune interval has to be more than 0 seconds to keep orders for %d hours", conf.OrderRetention)
+	}
+
 	// Generate the coin list based on the parameters we know
 	coinList := generateCoinList(&conf)
 
@@ -126,27 +159,71 @@ func main() {
 		logging.Fatalf("Could not generate asset pairs from coin list: %s", err)
 	}
 
+	// The kv backend keeps everything in one data file, so every store shares one handle
+	var kvDB *cxdbkv.DB
+	switch conf.DBBackend {
+	case "sql":
+	case "kv":
+		if kvDB, err = cxdbkv.OpenDB(filepath.Join(conf.FrredHomeDir, defaultDBFilename)); err != nil {
+			logging.Fatalf("Error opening data file: %s", err)
+		}
+		defer kvDB.Close()
+	default:
+		logging.Fatalf("Unknown storage backend %s, use sql or kv", conf.DBBackend)
+	}
+
 	// Create in memory matching engine
 	var mengines map[match.Pair]match.AuctionEngine
-	if mengines, err = cxdbsql.CreateAuctionEngineMap(pairList); err != nil {
+	if kvDB != nil {
+		mengines, err = cxdbkv.CreateAuctionEngineMap(kvDB, pairList)
+	} else {
+		mengines, err = cxdbsql.CreateAuctionEngineMap(pairList)
+	}
+	if err != nil {
 		logging.Fatalf("Error creating auction engines for pairs: %s", err)
 	}
 
 	var setEngines map[*coinparam.Params]match.SettlementEngine
-	if setEngines, err = cxdbsql.CreateSettlementEngineMap(coinList); err != nil {
+	if kvDB != nil {
+		setEngines, err = cxdbkv.CreateSettlementEngineMap(kvDB, coinList)
+	} else {
+		setEngines, err = cxdbsql.CreateSettlementEngineMap(coinList)
+	}
+	if err != nil {
 		logging.Fatalf("Error creating settlement engine map: %s", err)
 	}
 
 	var auctionBooks map[match.Pair]match.AuctionOrderbook
-	if auctionBooks, err = cxdbsql.CreateAuctionOrderbookMap(pairList); err != nil {
+	if kvDB != nil {
+		auctionBooks, err = cxdbkv.CreateAuctionOrderbookMap(kvDB, pairList)
+	} else {
+		auctionBooks, err = cxdbsql.CreateAuctionOrderbookMap(pairList)
+	}
+	if err != nil {
 		logging.Fatalf("Error creating auction orderbook map: %s", err)
 	}
 
 	var puzzleStores map[match.Pair]cxdb.PuzzleStore
-	if puzzleStores, err = cxdbsql.CreatePuzzleStoreMap(pairList); err != nil {
+	if kvDB != nil {
+		puzzleStores, err = cxdbkv.CreatePuzzleStoreMap(kvDB, pairList)
+	} else {
+		puzzleStores, err = cxdbsql.CreatePuzzleStoreMap(pairList)
+	}
+	if err != nil {
 		logging.Fatalf("Error creating puzzle store map: %s", err)
 	}
 
+	// the ledger is written by the settlement engines, the server only reads it for snapshots
+	var ledgerStores map[*coinparam.Params]cxdb.LedgerStore
+	if kvDB != nil {
+		ledgerStores, err = cxdbkv.CreateLedgerStoreMap(kvDB, coinList)
+	} else {
+		ledgerStores, err = cxdbsql.CreateLedgerStoreMap(coinList)
+	}
+	if err != nil {
+		logging.Fatalf("Error creating ledger store map: %s", err)
+	}
+
 	var batchers map[match.Pair]match.AuctionBatcher
 	if batchers, err = cxauctionserver.CreateAuctionBatcherMap(pairList, conf.MaxBatchSize); err != nil {
 		logging.Fatalf("Error creating batcher map: %s", err)
@@ -157,6 +234,41 @@ func main() {
 	if frredServer, err = cxauctionserver.InitServer(setEngines, mengines, auctionBooks, puzzleStores, batchers, 100, conf.AuctionTime); err != nil {
 		logging.Fatalf("Error initializing server: \n%s", err)
 	}
+	frredServer.SetLedgerStores(ledgerStores)
+	frredServer.SetRootDir(conf.FrredHomeDir)
+
+	var adminPubkey *koblitz.PublicKey
+	if conf.AdminPubkey != "" {
+		var adminPubkeyBytes []byte
+		if adminPubkeyBytes, err = hex.DecodeString(conf.AdminPubkey); err != nil {
+			logging.Fatalf("Error decoding admin pubkey: %s", err)
+		}
+		if adminPubkey, err = koblitz.ParsePubKey(adminPubkeyBytes, koblitz.S256()); err != nil {
+			logging.Fatalf("Error parsing admin pubkey: %s", err)
+		}
+	} else {
+		_, adminPubkey = koblitz.PrivKeyFromBytes(koblitz.S256(), key[:])
+	}
+	frredServer.SetAdminPubkey(adminPubkey)
+	if err = frredServer.LoadAdminNonce(); err != nil {
+		logging.Fatalf("Error loading admin nonce: %s", err)
+	}
+
+	// settle every auction in one transaction across the coins
+	var batchEngine match.BatchSettlementEngine
+	if kvDB != nil {
+		batchEngine, err = cxdbkv.CreateBatchSettlementEngine(kvDB, coinList)
+	} else {
+		batchEngine, err = cxdbsql.CreateBatchSettlementEngine(coinList)
+	}
+	if err != nil {
+		logging.Fatalf("Error creating batch settlement engine: %s", err)
+	}
+	frredServer.SetBatchSettlementEngine(batchEngine)
+
+	if conf.OrderRetention > 0 {
+		frredServer.StartArchivePruning(time.Duration(conf.OrderRetention)*time.Hour, time.Duration(conf.ArchivePruneInterval)*time.Second)
+	}
 
 	if err = frredServer.StartClockRandomAuction(); err != nil {
 		logging.Fatalf("Error starting clock: %s", err)
@@ -168,6 +280,16 @@ func main() {
 		logging.Fatalf("Error creating rpc caller for server: %s", err)
 	}
 
+	var restGateway *cxrest.Gateway
+	if conf.Restport != 0 {
+		if restGateway, err = cxrest.NewGateway("frred", &cxauctionrpc.OpencxAuctionRPC{Server: frredServer}); err != nil {
+			logging.Fatalf("Error creating REST gateway for server: %s", err)
+		}
+		if err = restGateway.Listen(conf.Rpchost, conf.Restport); err != nil {
+			logging.Fatalf("Error listening for REST gateway for server: %s", err)
+		}
+	}
+
 	// SIGINT and SIGTERM and SIGQUIT handler for CTRL-c, KILL, CTRL-/, etc.
 	go func() {
 		logging.Infof("Notifying signals")
@@ -179,6 +301,12 @@ func main() {
 			signal := <-sigs
 			logging.Infof("Received %s signal, Stopping server gracefully...", signal.String())
 
+			if restGateway != nil {
+				if err = restGateway.Stop(); err != nil {
+					logging.Errorf("Error stopping REST gateway: %s", err)
+				}
+			}
+
 			// send off button to off button
 			if err = rpcListener.KillServerNoWait(); err != nil {
 				logging.Fatalf("Error killing server: %s", err)
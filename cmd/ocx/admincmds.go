@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/opencx/cxauctionrpc"
+	"github.com/mit-dci/opencx/cxrpc"
+	"github.com/mit-dci/opencx/logging"
+)
+
+var sweepCommand = &Command{
+	Format: fmt.Sprintf("%s%s%s%s%s\n", lnutil.Red("sweep"), lnutil.ReqColor("asset"), lnutil.ReqColor("destaddress"), lnutil.ReqColor("feerate"), lnutil.ReqColor("outfile")),
+	Description: fmt.Sprintf("%s\n%s\n%s\n",
+		"Build an unsigned transaction sweeping all credited deposits of asset to destaddress, paying feerate satoshis per vbyte.",
+		"The unsigned transaction and the derivation path of every input are written to outfile as JSON, to be signed offline.",
+		"This is an admin command, your key must be the exchange's admin key.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Build an unsigned sweep of deposits to cold storage. Admin only."),
+}
+
+// Sweep builds an unsigned sweep transaction and writes it to a file
+func (cl *ocxClient) Sweep(args []string) (err error) {
+	if err = cl.UnlockKey(); err != nil {
+		logging.Fatalf("Could not unlock key! Fatal!")
+	}
+
+	asset := args[0]
+	destination := args[1]
+
+	var feeRate uint64
+	if feeRate, err = strconv.ParseUint(args[2], 10, 64); err != nil {
+		return
+	}
+	outfile := args[3]
+
+	var sweepReply *cxrpc.SweepReply
+	if sweepReply, err = cl.RPCClient.Sweep(asset, destination, feeRate); err != nil {
+		return
+	}
+
+	var sweepBytes []byte
+	if sweepBytes, err = json.MarshalIndent(sweepReply.Sweep, "", "  "); err != nil {
+		return
+	}
+
+	if err = ioutil.WriteFile(outfile, sweepBytes, 0600); err != nil {
+		return
+	}
+
+	logging.Infof("Wrote unsigned sweep of %d inputs for %d %s (fee %d) to %s\n", len(sweepReply.Sweep.Inputs), sweepReply.Sweep.Amount, asset, sweepReply.Sweep.Fee, outfile)
+	return
+}
+
+var getReservesCommand = &Command{
+	Format: fmt.Sprintf("%s\n", lnutil.Red("getreserves")),
+	Description: fmt.Sprintf("%s\n%s\n%s\n",
+		"Show how much of each asset is in the hot wallet and in cold storage, compared to the total of all user balances.",
+		"Also lists every sweep from the hot wallet to cold storage and every refill back.",
+		"This is an admin command, your key must be the exchange's admin key.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Show hot and cold reserves against user liabilities. Admin only."),
+}
+
+// GetReserves prints the hot and cold reserves for every asset, and the sweep history
+func (cl *ocxClient) GetReserves(args []string) (err error) {
+	if err = cl.UnlockKey(); err != nil {
+		logging.Fatalf("Could not unlock key! Fatal!")
+	}
+
+	var getReservesReply *cxrpc.GetReservesReply
+	if getReservesReply, err = cl.RPCClient.GetReserves(); err != nil {
+		return
+	}
+
+	for _, reserve := range getReservesReply.Reserves {
+		logging.Infof("%s: hot %d, cold %d, total %d, liabilities %d\n", reserve.Coin, reserve.HotBalance, reserve.ColdBalance, reserve.HotBalance+reserve.ColdBalance, reserve.Liabilities)
+	}
+	for _, sweep := range getReservesReply.Sweeps {
+		if sweep.Refill {
+			logging.Infof("Refilled %d %s from cold storage at %s in %s\n", sweep.Amount, sweep.Coin, sweep.Time.String(), sweep.Txid)
+			continue
+		}
+		logging.Infof("Swept %d %s to %s at %s in %s\n", sweep.Amount, sweep.Coin, sweep.Destination, sweep.Time.String(), sweep.Txid)
+	}
+	return
+}
+
+var checkLedgerCommand = &Command{
+	Format: fmt.Sprintf("%s\n", lnutil.Red("checkledger")),
+	Description: fmt.Sprintf("%s\n%s\n",
+		"Recompute every balance from the ledger and show the accounts whose balance doesn't match.",
+		"This is an admin command, your key must be the exchange's admin key.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Check balances against the ledger. Admin only."),
+}
+
+// CheckLedger prints every balance that doesn't match the ledger
+func (cl *ocxClient) CheckLedger(args []string) (err error) {
+	if err = cl.UnlockKey(); err != nil {
+		logging.Fatalf("Could not unlock key! Fatal!")
+	}
+
+	var checkLedgerReply *cxrpc.CheckLedgerReply
+	if checkLedgerReply, err = cl.RPCClient.CheckLedger(); err != nil {
+		return
+	}
+
+	if len(checkLedgerReply.Mismatches) == 0 {
+		logging.Infof("Every balance matches the ledger\n")
+		return
+	}
+	for _, mismatch := range checkLedgerReply.Mismatches {
+		logging.Infof("%s\n", mismatch.String())
+	}
+	return
+}
+
+var reconcileCommand = &Command{
+	Format: fmt.Sprintf("%s\n", lnutil.Red("reconcile")),
+	Description: fmt.Sprintf("%s\n%s\n%s\n",
+		"Compare what the wallet of every asset holds with what the exchange owes, and show every report so far.",
+		"Withdrawals of an asset are halted if its shortfall is over the threshold.",
+		"This is an admin command, your key must be the exchange's admin key.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Reconcile wallets against balances. Admin only."),
+}
+
+// Reconcile reconciles every wallet and prints the reports
+func (cl *ocxClient) Reconcile(args []string) (err error) {
+	if err = cl.UnlockKey(); err != nil {
+		logging.Fatalf("Could not unlock key! Fatal!")
+	}
+
+	var reconcileReply *cxrpc.ReconcileReply
+	if reconcileReply, err = cl.RPCClient.Reconcile(); err != nil {
+		return
+	}
+
+	for _, report := range reconcileReply.History {
+		logging.Infof("%s\n", report.String())
+	}
+	for _, report := range reconcileReply.Reports {
+		if report.WithdrawalsHalted {
+			logging.Infof("%s withdrawals are halted\n", report.Coin)
+		}
+	}
+	return
+}
+
+var resumeWithdrawalsCommand = &Command{
+	Format: fmt.Sprintf("%s%s\n", lnutil.Red("resumewithdrawals"), lnutil.ReqColor("asset")),
+	Description: fmt.Sprintf("%s\n%s\n",
+		"Let withdrawals of asset go through again after reconciliation halted them.",
+		"This is an admin command, your key must be the exchange's admin key.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Resume halted withdrawals. Admin only."),
+}
+
+// ResumeWithdrawals resumes withdrawals of an asset
+func (cl *ocxClient) ResumeWithdrawals(args []string) (err error) {
+	if err = cl.UnlockKey(); err != nil {
+		logging.Fatalf("Could not unlock key! Fatal!")
+	}
+
+	asset := args[0]
+	if _, err = cl.RPCClient.ResumeWithdrawals(asset); err != nil {
+		return
+	}
+
+	logging.Infof("Resumed %s withdrawals\n", asset)
+	return
+}
+
+var snapshotCommand = &Command{
+	Format: fmt.Sprintf("%s%s\n", lnutil.Red("snapshot"), lnutil.ReqColor("outfile")),
+	Description: fmt.Sprintf("%s\n%s\n%s\n",
+		"Take a consistent snapshot of the exchange's orderbooks, balances, and deposits, and write the archive to outfile.",
+		"The archive can be restored with cxbackup, or by starting opencxd with --restore.",
+		"This is an admin command, your key must be the exchange's admin key.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Write a snapshot archive of the exchange. Admin only."),
+}
+
+// Snapshot gets a snapshot archive from the exchange and writes it to a file
+func (cl *ocxClient) Snapshot(args []string) (err error) {
+	if err = cl.UnlockKey(); err != nil {
+		logging.Fatalf("Could not unlock key! Fatal!")
+	}
+
+	outfile := args[0]
+
+	var snapshotReply *cxrpc.SnapshotReply
+	if snapshotReply, err = cl.RPCClient.Snapshot(); err != nil {
+		return
+	}
+
+	if err = ioutil.WriteFile(outfile, snapshotReply.Archive, 0600); err != nil {
+		return
+	}
+
+	logging.Infof("Wrote %d byte snapshot archive to %s\n", len(snapshotReply.Archive), outfile)
+	return
+}
+
+var auctionSnapshotCommand = &Command{
+	Format: fmt.Sprintf("%s%s\n", lnutil.Red("auctionsnapshot"), lnutil.ReqColor("outfile")),
+	Description: fmt.Sprintf("%s\n%s\n%s\n",
+		"Take a consistent snapshot of the auction server's orderbooks, puzzles, balances, and ledger, and write the archive to outfile.",
+		"The archive can be restored with cxbackup.",
+		"This is an admin command, your key must be the auction server's admin key.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Write a snapshot archive of the auction server. Admin only."),
+}
+
+// AuctionSnapshot gets a snapshot archive from the auction server and writes it to a file
+func (cl *ocxClient) AuctionSnapshot(args []string) (err error) {
+	if err = cl.UnlockKey(); err != nil {
+		logging.Fatalf("Could not unlock key! Fatal!")
+	}
+
+	outfile := args[0]
+
+	var snapshotReply *cxauctionrpc.SnapshotReply
+	if snapshotReply, err = cl.RPCClient.AuctionSnapshot(); err != nil {
+		return
+	}
+
+	if err = ioutil.WriteFile(outfile, snapshotReply.Archive, 0600); err != nil {
+		return
+	}
+
+	logging.Infof("Wrote %d byte snapshot archive to %s\n", len(snapshotReply.Archive), outfile)
+	return
+}
+
+var recordRefillCommand = &Command{
+	Format: fmt.Sprintf("%s%s%s%s\n", lnutil.Red("recordrefill"), lnutil.ReqColor("asset"), lnutil.ReqColor("txid"), lnutil.ReqColor("amount")),
+	Description: fmt.Sprintf("%s\n%s\n%s\n",
+		"Record that amount of asset was sent from cold storage to the hot wallet in txid.",
+		"The amount comes off the cold balance, so reserves and reconciliation don't count it twice.",
+		"This is an admin command, your key must be the exchange's admin key.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Record a refill of the hot wallet from cold storage. Admin only."),
+}
+
+// RecordRefill records a refill of the hot wallet from cold storage
+func (cl *ocxClient) RecordRefill(args []string) (err error) {
+	if err = cl.UnlockKey(); err != nil {
+		logging.Fatalf("Could not unlock key! Fatal!")
+	}
+
+	asset := args[0]
+	txid := args[1]
+
+	var amount uint64
+	if amount, err = strconv.ParseUint(args[2], 10, 64); err != nil {
+		return
+	}
+
+	if _, err = cl.RPCClient.RecordRefill(asset, txid, amount); err != nil {
+		return
+	}
+
+	logging.Infof("Recorded refill of %d %s from cold storage in %s\n", amount, asset, txid)
+	return
+}
@@ -1,21 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
 	"fmt"
 	"math"
+	"os"
 	"strconv"
+	"time"
 
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/lit/lnutil"
 
+	util "github.com/mit-dci/opencx/chainutils"
+	"github.com/mit-dci/opencx/crypto/liabilities"
 	"github.com/mit-dci/opencx/cxrpc"
 	"github.com/mit-dci/opencx/logging"
 	"github.com/mit-dci/opencx/match"
 )
 
 var getBalanceCommand = &Command{
-	Format: fmt.Sprintf("%s%s\n", lnutil.Red("getbalance"), lnutil.ReqColor("asset")),
-	Description: fmt.Sprintf("%s\n",
-		"Get your balance of asset. You must be registered.",
+	Format: fmt.Sprintf("%s%s%s\n", lnutil.Red("getbalance"), lnutil.ReqColor("asset"), lnutil.OptColor("subaccount")),
+	Description: fmt.Sprintf("%s\n%s\n",
+		"Get your balance of asset, split into what is available and what is locked up in open orders. You must be registered.",
+		"If a sub-account is given, only the balance of that sub-account is shown, otherwise it's the sum of all of them.",
 	),
 	ShortDescription: fmt.Sprintf("%s\n", "Get your balance of asset. You must be registered to run this command."),
 }
@@ -28,11 +38,22 @@ func (cl *ocxClient) GetBalance(args []string) (err error) {
 	asset := args[0]
 
 	var balanceReply *cxrpc.GetBalanceReply
-	if balanceReply, err = cl.RPCClient.GetBalance(asset); err != nil {
+	if len(args) > 1 {
+		var subAccount uint64
+		if subAccount, err = strconv.ParseUint(args[1], 10, 32); err != nil {
+			return
+		}
+		if balanceReply, err = cl.RPCClient.GetSubAccountBalance(asset, uint32(subAccount)); err != nil {
+			return
+		}
+	} else if balanceReply, err = cl.RPCClient.GetBalance(asset); err != nil {
 		return
 	}
 
-	logging.Infof("Balance for token %s: %f %s\n", asset, float64(balanceReply.Amount)/math.Pow10(8), asset)
+	logging.Infof("Balance for token %s: %f total, %f available, %f in orders\n", asset, float64(balanceReply.Total)/math.Pow10(8), float64(balanceReply.Available)/math.Pow10(8), float64(balanceReply.InOrders)/math.Pow10(8))
+	if balanceReply.Lag.Pending > 0 {
+		logging.Infof("The balance may be %d updates behind, the oldest from %s ago\n", balanceReply.Lag.Pending, balanceReply.Lag.Behind)
+	}
 	return
 }
 
@@ -61,6 +82,201 @@ func (cl *ocxClient) GetDepositAddress(args []string) (err error) {
 	return
 }
 
+var getDepositsCommand = &Command{
+	Format: fmt.Sprintf("%s%s\n", lnutil.Red("deposits"), lnutil.ReqColor("asset")),
+	Description: fmt.Sprintf("%s\n%s\n",
+		"Show your pending deposits of asset, and how many confirmations they have so far.",
+		"Also shows every deposit of asset that has already been credited.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Show your pending and credited deposits of asset."),
+}
+
+func (cl *ocxClient) GetDeposits(args []string) (err error) {
+	if err = cl.UnlockKey(); err != nil {
+		logging.Fatalf("Could not unlock key! Fatal!")
+	}
+
+	asset := args[0]
+
+	var getDepositsReply *cxrpc.GetDepositsReply
+	if getDepositsReply, err = cl.RPCClient.GetDeposits(asset); err != nil {
+		return
+	}
+
+	logging.Infof("Pending deposits for token %s:\n", asset)
+	for _, deposit := range getDepositsReply.Pending {
+		logging.Infof("txid: %s amount: %f %s confirmations: %d/%d\n", deposit.Txid, float64(deposit.Amount)/math.Pow10(8), asset, deposit.Confirmations, deposit.ConfirmationsRequired)
+	}
+
+	logging.Infof("Credited deposits for token %s:\n", asset)
+	for _, deposit := range getDepositsReply.History {
+		logging.Infof("txid: %s amount: %f %s height: %d\n", deposit.Txid, float64(deposit.Amount)/math.Pow10(8), asset, deposit.BlockHeightReceived)
+	}
+
+	return
+}
+
+var getStatementCommand = &Command{
+	Format: fmt.Sprintf("%s%s%s%s%s\n", lnutil.Red("statement"), lnutil.ReqColor("asset"), lnutil.ReqColor("from"), lnutil.ReqColor("to"), lnutil.OptColor("csvfile")),
+	Description: fmt.Sprintf("%s\n%s\n%s\n",
+		"Show every change to your balance of asset from the start of the from date up to the start of the to date.",
+		"Dates are in the form YYYY-MM-DD, in UTC. Each entry has the reason the balance changed, and the txid or order it changed for.",
+		"If csvfile is specified, the statement is also written to csvfile.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Show your account statement for asset between two dates."),
+}
+
+// statementDateFormat is the format of the dates passed to the statement command
+const statementDateFormat = "2006-01-02"
+
+// GetStatement prints the account statement for an asset, and writes it to a csv file if one is
+// given
+func (cl *ocxClient) GetStatement(args []string) (err error) {
+	if err = cl.UnlockKey(); err != nil {
+		logging.Fatalf("Could not unlock key! Fatal!")
+	}
+
+	asset := args[0]
+
+	var from time.Time
+	if from, err = time.Parse(statementDateFormat, args[1]); err != nil {
+		err = fmt.Errorf("Error parsing from date, use YYYY-MM-DD: %s", err)
+		return
+	}
+
+	var to time.Time
+	if to, err = time.Parse(statementDateFormat, args[2]); err != nil {
+		err = fmt.Errorf("Error parsing to date, use YYYY-MM-DD: %s", err)
+		return
+	}
+
+	var getStatementReply *cxrpc.GetAccountStatementReply
+	if getStatementReply, err = cl.RPCClient.GetAccountStatement(asset, from, to); err != nil {
+		return
+	}
+	statement := getStatementReply.Statement
+
+	logging.Infof("Statement for token %s from %s to %s\n", asset, args[1], args[2])
+	logging.Infof("Opening balance: %f %s\n", float64(statement.OpeningBalance)/math.Pow10(8), asset)
+	for _, entry := range statement.Entries {
+		logging.Infof("%s %s %f %s for %s %s\n", entry.Time.UTC().Format(time.RFC3339), entry.Type.String(), float64(entry.Amount)/math.Pow10(8), asset, entry.Reason, entry.Reference)
+	}
+	logging.Infof("Closing balance: %f %s\n", float64(statement.ClosingBalance)/math.Pow10(8), asset)
+
+	if len(args) == 4 {
+		if err = writeStatementCSV(args[3], statement); err != nil {
+			err = fmt.Errorf("Error writing statement csv: %s", err)
+			return
+		}
+		logging.Infof("Wrote statement to %s\n", args[3])
+	}
+
+	return
+}
+
+// writeStatementCSV writes every entry of a statement to a csv file, with the opening and closing
+// balance as the first and last rows
+func writeStatementCSV(filename string, statement *match.AccountStatement) (err error) {
+	var csvFile *os.File
+	if csvFile, err = os.Create(filename); err != nil {
+		return
+	}
+	defer csvFile.Close()
+
+	writer := csv.NewWriter(csvFile)
+	records := [][]string{
+		{"time", "type", "amount", "reason", "reference"},
+		{statement.From.UTC().Format(time.RFC3339), "opening", strconv.FormatUint(statement.OpeningBalance, 10), "", ""},
+	}
+	for _, entry := range statement.Entries {
+		records = append(records, []string{entry.Time.UTC().Format(time.RFC3339), entry.Type.String(), strconv.FormatUint(entry.Amount, 10), string(entry.Reason), entry.Reference})
+	}
+	records = append(records, []string{statement.To.UTC().Format(time.RFC3339), "closing", strconv.FormatUint(statement.ClosingBalance, 10), "", ""})
+
+	if err = writer.WriteAll(records); err != nil {
+		return
+	}
+	return
+}
+
+var verifyLiabilitiesCommand = &Command{
+	Format: fmt.Sprintf("%s%s%s\n", lnutil.Red("verifyliabilities"), lnutil.ReqColor("asset"), lnutil.OptColor("exchangepubkey")),
+	Description: fmt.Sprintf("%s\n%s\n%s\n",
+		"Check that your balance of asset is counted in what the exchange says it owes its users.",
+		"This gets a proof from the exchange's latest signed liability snapshot and checks it locally, without trusting the exchange.",
+		"If exchangepubkey is specified (hex), the snapshot must be signed by it.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Verify that your balance of asset is included in the exchange's liabilities."),
+}
+
+// VerifyLiabilities gets a liability proof for an asset and verifies it against the signed snapshot
+func (cl *ocxClient) VerifyLiabilities(args []string) (err error) {
+	if err = cl.UnlockKey(); err != nil {
+		logging.Fatalf("Could not unlock key! Fatal!")
+	}
+
+	assetName := args[0]
+
+	var param *coinparam.Params
+	if param, err = util.GetParamFromName(assetName); err != nil {
+		return
+	}
+
+	var asset match.Asset
+	if asset, err = match.AssetFromCoinParam(param); err != nil {
+		return
+	}
+
+	var proofReply *cxrpc.GetLiabilityProofReply
+	if proofReply, err = cl.RPCClient.GetLiabilityProof(assetName); err != nil {
+		return
+	}
+	proof := proofReply.Proof
+	snapshot := proofReply.Snapshot
+
+	var signer *koblitz.PublicKey
+	if signer, err = snapshot.Signer(); err != nil {
+		return
+	}
+
+	if len(args) == 2 {
+		var exchangePubkeyBytes []byte
+		if exchangePubkeyBytes, err = hex.DecodeString(args[1]); err != nil {
+			err = fmt.Errorf("Error decoding exchange pubkey: %s", err)
+			return
+		}
+		if !bytes.Equal(signer.SerializeCompressed(), exchangePubkeyBytes) {
+			err = fmt.Errorf("Snapshot %d was signed by %x, not the exchange pubkey %s", snapshot.ID, signer.SerializeCompressed(), args[1])
+			return
+		}
+	}
+
+	if proof.Leaf.Asset != asset {
+		err = fmt.Errorf("Asked for a %s proof but got a proof for %s", asset, proof.Leaf.Asset)
+		return
+	}
+
+	if !bytes.Equal(proof.Leaf.Pubkey[:], cl.RPCClient.PrivKey.PubKey().SerializeCompressed()) {
+		err = fmt.Errorf("Proof is for pubkey %x, not your pubkey", proof.Leaf.Pubkey)
+		return
+	}
+
+	var root liabilities.Node
+	if root, err = snapshot.RootForAsset(asset); err != nil {
+		return
+	}
+
+	if err = proof.Verify(root); err != nil {
+		err = fmt.Errorf("Proof does not verify, your balance may not be counted: %s", err)
+		return
+	}
+
+	logging.Infof("Snapshot %d taken at %s, signed by %x\n", snapshot.ID, snapshot.Time.String(), signer.SerializeCompressed())
+	logging.Infof("Total %s liabilities: %f\n", assetName, float64(root.Sum)/math.Pow10(8))
+	logging.Infof("Your balance of %f %s is included in the total\n", float64(proof.Leaf.Balance)/math.Pow10(8), assetName)
+	return
+}
+
 var getAllBalancesCommand = &Command{
 	Format: fmt.Sprintf("%s\n", lnutil.Red("getallbalances")),
 	Description: fmt.Sprintf("%s\n",
@@ -154,3 +370,104 @@ func (cl *ocxClient) LitWithdraw(args []string) (err error) {
 	logging.Infof("Withdraw transaction ID: %s\n", withdrawReply.Txid)
 	return
 }
+
+var transferCommand = &Command{
+	Format: fmt.Sprintf("%s%s%s%s%s\n", lnutil.Red("transfer"), lnutil.ReqColor("amount"), lnutil.ReqColor("asset"), lnutil.ReqColor("topubkey"), lnutil.OptColor("nonce")),
+	Description: fmt.Sprintf("%s\n%s\n%s\n",
+		"Transfer amount of asset from your account to the account for topubkey, without going on chain.",
+		"The nonce has to be more than the nonce of your last transfer, it defaults to the current time in nanoseconds.",
+		"The exchange may limit how much each account can transfer in a day.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Transfer amount of asset to another account on the exchange."),
+}
+
+func (cl *ocxClient) Transfer(args []string) (err error) {
+	if err = cl.UnlockKey(); err != nil {
+		logging.Fatalf("Could not unlock key! Fatal!")
+	}
+
+	var amount uint64
+	if amount, err = strconv.ParseUint(args[0], 10, 64); err != nil {
+		return
+	}
+
+	var asset match.Asset
+	if asset, err = match.AssetFromString(args[1]); err != nil {
+		return
+	}
+
+	var toPubkeyBytes []byte
+	if toPubkeyBytes, err = hex.DecodeString(args[2]); err != nil {
+		err = fmt.Errorf("Error decoding pubkey to transfer to: %s", err)
+		return
+	}
+
+	var toPubkey *koblitz.PublicKey
+	if toPubkey, err = koblitz.ParsePubKey(toPubkeyBytes, koblitz.S256()); err != nil {
+		err = fmt.Errorf("Error parsing pubkey to transfer to: %s", err)
+		return
+	}
+
+	nonce := uint64(time.Now().UnixNano())
+	if len(args) > 3 {
+		if nonce, err = strconv.ParseUint(args[3], 10, 64); err != nil {
+			return
+		}
+	}
+
+	if _, err = cl.RPCClient.Transfer(toPubkey, amount, asset, nonce); err != nil {
+		return
+	}
+
+	logging.Infof("Transferred %d %s to %x with nonce %d\n", amount, asset, toPubkeyBytes, nonce)
+	return
+}
+
+var subTransferCommand = &Command{
+	Format: fmt.Sprintf("%s%s%s%s%s%s\n", lnutil.Red("subtransfer"), lnutil.ReqColor("amount"), lnutil.ReqColor("asset"), lnutil.ReqColor("fromsubaccount"), lnutil.ReqColor("tosubaccount"), lnutil.OptColor("nonce")),
+	Description: fmt.Sprintf("%s\n%s\n",
+		"Transfer amount of asset between two of your own sub-accounts. Sub-account 0 is your main account.",
+		"These transfers are free and don't count towards the daily transfer limit. The nonce defaults to the current time in nanoseconds.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Transfer amount of asset between two of your sub-accounts."),
+}
+
+func (cl *ocxClient) SubTransfer(args []string) (err error) {
+	if err = cl.UnlockKey(); err != nil {
+		logging.Fatalf("Could not unlock key! Fatal!")
+	}
+
+	var amount uint64
+	if amount, err = strconv.ParseUint(args[0], 10, 64); err != nil {
+		return
+	}
+
+	var asset match.Asset
+	if asset, err = match.AssetFromString(args[1]); err != nil {
+		return
+	}
+
+	var fromSubAccount uint64
+	if fromSubAccount, err = strconv.ParseUint(args[2], 10, 32); err != nil {
+		return
+	}
+
+	var toSubAccount uint64
+	if toSubAccount, err = strconv.ParseUint(args[3], 10, 32); err != nil {
+		return
+	}
+
+	nonce := uint64(time.Now().UnixNano())
+	if len(args) > 4 {
+		if nonce, err = strconv.ParseUint(args[4], 10, 64); err != nil {
+			return
+		}
+	}
+
+	if _, err = cl.RPCClient.SubAccountTransfer(uint32(fromSubAccount), uint32(toSubAccount), amount, asset, nonce); err != nil {
+		return
+	}
+
+	logging.Infof("Transferred %d %s from sub-account %d to sub-account %d with nonce %d\n", amount, asset, fromSubAccount, toSubAccount, nonce)
+	return
+}
@@ -29,3 +29,31 @@ func (cl *ocxClient) GetLitConnection(args []string) (err error) {
 	}
 	return
 }
+
+var getSwapsCommand = &Command{
+	Format: fmt.Sprintf("%s\n", lnutil.Red("getswaps")),
+	Description: fmt.Sprintf("%s\n%s\n%s\n",
+		"Get the atomic swaps for your swap orders, which you place with --swap.",
+		"For each swap the exchange offers you an HTLC for what you receive. Offer the exchange HTLCs locked with the same hash for what you pay, with a locktime before the exchange's.",
+		"When the exchange claims your HTLCs you learn the preimage, which you use to claim theirs.",
+	),
+	ShortDescription: fmt.Sprintf("%s\n", "Get the atomic swaps for your swap orders."),
+}
+
+func (cl *ocxClient) GetSwaps(args []string) (err error) {
+	var getSwapsReply *cxrpc.GetSwapsReply
+	if getSwapsReply, err = cl.RPCClient.GetSwaps(); err != nil {
+		return
+	}
+
+	if len(getSwapsReply.Swaps) == 0 {
+		logging.Infof("No swaps")
+		return
+	}
+
+	for _, swap := range getSwapsReply.Swaps {
+		logging.Infof("Swap for order %x: pay %d %s, receive %d %s", swap.Instruction.OrderID, swap.Instruction.PayAmount, swap.Instruction.PayAsset, swap.Instruction.ReceiveAmount, swap.Instruction.ReceiveAsset)
+		logging.Infof("\tHash: %x, locktime: %d, paid: %d, state: %s", swap.RHash, swap.Locktime, swap.Received, swap.State.String())
+	}
+	return
+}
@@ -50,6 +50,12 @@ type ocxConfig struct {
 	// decryption - maybe use memguard and allow things to be piped in.
 	KeyPassword string `long:"keypass" description:"Password for encrypted private key file"`
 
+	// sub-account that orders are placed from and transfers are sent from
+	SubAccount uint32 `long:"subaccount" description:"Sub-account to place orders and send transfers from, 0 is the main account"`
+
+	// whether orders are settled by atomic swaps over lightning instead of balances on the exchange
+	Swap bool `long:"swap" description:"Place swap orders, which are settled by atomic swaps over your lightning channels with the exchange"`
+
 	// logging and debug parameters
 	LogLevel []bool `short:"v" description:"Set verbosity level to verbose (-v), very verbose (-vv) or very very verbose (-vvv)"`
 
@@ -115,6 +121,8 @@ func main() {
 
 	client.KeyPath = filepath.Join(conf.KeyFileName)
 	client.RPCClient = new(benchclient.BenchClient)
+	client.RPCClient.SubAccount = conf.SubAccount
+	client.RPCClient.Swap = conf.Swap
 	if !conf.AuthenticatedRPC {
 		if err = client.RPCClient.SetupBenchClient(conf.Rpchost, conf.Rpcport); err != nil {
 			logging.Fatalf("Error setting up OpenCX RPC Client: \n%s", err)
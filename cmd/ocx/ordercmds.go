@@ -142,6 +142,9 @@ func (cl *ocxClient) ViewOrderbook(args []string) (err error) {
 
 	// actually print out table stored in buffer
 	logging.Infof("\n%s\n", buf.String())
+	if viewOrderbookReply.Lag.Pending > 0 {
+		logging.Infof("The orderbook may be %d updates behind, the oldest from %s ago\n", viewOrderbookReply.Lag.Pending, viewOrderbookReply.Lag.Behind)
+	}
 	return
 }
 
@@ -59,8 +59,8 @@ func (cl *ocxClient) parseCommands(commands []string) error {
 		if getHelpForCommand(getBalanceCommand, args) {
 			return nil
 		}
-		if len(args) != 1 {
-			return fmt.Errorf("Must specify token to get balance for token")
+		if len(args) != 1 && len(args) != 2 {
+			return fmt.Errorf("Must specify token to get balance for token, and optionally a sub-account")
 		}
 
 		if err := cl.GetBalance(args); err != nil {
@@ -91,6 +91,42 @@ func (cl *ocxClient) parseCommands(commands []string) error {
 			return fmt.Errorf("Error getting deposit address: \n%s", err)
 		}
 	}
+	if cmd == "deposits" {
+		if getHelpForCommand(getDepositsCommand, args) {
+			return nil
+		}
+		if len(args) != 1 {
+			return fmt.Errorf("Must specify asset to get deposits for asset")
+		}
+
+		if err := cl.GetDeposits(args); err != nil {
+			return fmt.Errorf("Error getting deposits: \n%s", err)
+		}
+	}
+	if cmd == "verifyliabilities" {
+		if getHelpForCommand(verifyLiabilitiesCommand, args) {
+			return nil
+		}
+		if len(args) != 1 && len(args) != 2 {
+			return fmt.Errorf("Must specify asset, and optionally the exchange pubkey")
+		}
+
+		if err := cl.VerifyLiabilities(args); err != nil {
+			return fmt.Errorf("Error verifying liabilities: \n%s", err)
+		}
+	}
+	if cmd == "statement" {
+		if getHelpForCommand(getStatementCommand, args) {
+			return nil
+		}
+		if len(args) != 3 && len(args) != 4 {
+			return fmt.Errorf("Must specify asset, from date, and to date, and optionally a csv file")
+		}
+
+		if err := cl.GetStatement(args); err != nil {
+			return fmt.Errorf("Error getting statement: \n%s", err)
+		}
+	}
 	if cmd == "placeorder" {
 		if getHelpForCommand(placeOrderCommand, args) {
 			return nil
@@ -151,6 +187,30 @@ func (cl *ocxClient) parseCommands(commands []string) error {
 			return fmt.Errorf("Error calling withdraw command: \n%s", err)
 		}
 	}
+	if cmd == "transfer" {
+		if getHelpForCommand(transferCommand, args) {
+			return nil
+		}
+		if len(args) != 3 && len(args) != 4 {
+			return fmt.Errorf("Must specify 3 or 4 arguments: amount coin topubkey [nonce]")
+		}
+
+		if err := cl.Transfer(args); err != nil {
+			return fmt.Errorf("Error calling transfer command: \n%s", err)
+		}
+	}
+	if cmd == "subtransfer" {
+		if getHelpForCommand(subTransferCommand, args) {
+			return nil
+		}
+		if len(args) != 4 && len(args) != 5 {
+			return fmt.Errorf("Must specify 4 or 5 arguments: amount coin fromsubaccount tosubaccount [nonce]")
+		}
+
+		if err := cl.SubTransfer(args); err != nil {
+			return fmt.Errorf("Error calling subtransfer command: \n%s", err)
+		}
+	}
 	if cmd == "cancelorder" {
 		if getHelpForCommand(cancelOrderCommand, args) {
 			return nil
@@ -187,6 +247,18 @@ func (cl *ocxClient) parseCommands(commands []string) error {
 			return fmt.Errorf("Error getting lit connection: \n%s", err)
 		}
 	}
+	if cmd == "getswaps" {
+		if getHelpForCommand(getSwapsCommand, args) {
+			return nil
+		}
+		if len(args) != 0 {
+			return fmt.Errorf("Don't specify arguments please")
+		}
+
+		if err := cl.GetSwaps(args); err != nil {
+			return fmt.Errorf("Error getting swaps: \n%s", err)
+		}
+	}
 	if cmd == "placeauctionorder" {
 		if getHelpForCommand(placeAuctionOrderCommand, args) {
 			return nil
@@ -199,6 +271,102 @@ func (cl *ocxClient) parseCommands(commands []string) error {
 			return fmt.Errorf("Error placing auction order: \n%s", err)
 		}
 	}
+	if cmd == "sweep" {
+		if getHelpForCommand(sweepCommand, args) {
+			return nil
+		}
+		if len(args) != 4 {
+			return fmt.Errorf("Must specify 4 arguments: asset destaddress feerate outfile")
+		}
+
+		if err := cl.Sweep(args); err != nil {
+			return fmt.Errorf("Error building sweep: \n%s", err)
+		}
+	}
+	if cmd == "getreserves" {
+		if getHelpForCommand(getReservesCommand, args) {
+			return nil
+		}
+		if len(args) != 0 {
+			return fmt.Errorf("Don't specify arguments please")
+		}
+
+		if err := cl.GetReserves(args); err != nil {
+			return fmt.Errorf("Error getting reserves: \n%s", err)
+		}
+	}
+	if cmd == "checkledger" {
+		if getHelpForCommand(checkLedgerCommand, args) {
+			return nil
+		}
+		if len(args) != 0 {
+			return fmt.Errorf("Don't specify arguments please")
+		}
+
+		if err := cl.CheckLedger(args); err != nil {
+			return fmt.Errorf("Error checking ledger: \n%s", err)
+		}
+	}
+	if cmd == "reconcile" {
+		if getHelpForCommand(reconcileCommand, args) {
+			return nil
+		}
+		if len(args) != 0 {
+			return fmt.Errorf("Don't specify arguments please")
+		}
+
+		if err := cl.Reconcile(args); err != nil {
+			return fmt.Errorf("Error reconciling: \n%s", err)
+		}
+	}
+	if cmd == "resumewithdrawals" {
+		if getHelpForCommand(resumeWithdrawalsCommand, args) {
+			return nil
+		}
+		if len(args) != 1 {
+			return fmt.Errorf("Must specify 1 argument: asset")
+		}
+
+		if err := cl.ResumeWithdrawals(args); err != nil {
+			return fmt.Errorf("Error resuming withdrawals: \n%s", err)
+		}
+	}
+	if cmd == "recordrefill" {
+		if getHelpForCommand(recordRefillCommand, args) {
+			return nil
+		}
+		if len(args) != 3 {
+			return fmt.Errorf("Must specify 3 arguments: asset txid amount")
+		}
+
+		if err := cl.RecordRefill(args); err != nil {
+			return fmt.Errorf("Error recording refill: \n%s", err)
+		}
+	}
+	if cmd == "snapshot" {
+		if getHelpForCommand(snapshotCommand, args) {
+			return nil
+		}
+		if len(args) != 1 {
+			return fmt.Errorf("Must specify 1 argument: outfile")
+		}
+
+		if err := cl.Snapshot(args); err != nil {
+			return fmt.Errorf("Error taking snapshot: \n%s", err)
+		}
+	}
+	if cmd == "auctionsnapshot" {
+		if getHelpForCommand(auctionSnapshotCommand, args) {
+			return nil
+		}
+		if len(args) != 1 {
+			return fmt.Errorf("Must specify 1 argument: outfile")
+		}
+
+		if err := cl.AuctionSnapshot(args); err != nil {
+			return fmt.Errorf("Error taking auction snapshot: \n%s", err)
+		}
+	}
 	return nil
 }
 
@@ -212,7 +380,7 @@ func (cl *ocxClient) Help(textArgs []string) error {
 	if len(textArgs) == 0 {
 
 		fmt.Fprintf(color.Output, lnutil.Header("Commands:\n"))
-		listofCommands := []*Command{helpCommand, registerCommand, getBalanceCommand, getDepositAddressCommand, getAllBalancesCommand, withdrawCommand, litWithdrawCommand, getLitConnectionCommand, placeOrderCommand, getPriceCommand, viewOrderbookCommand, cancelOrderCommand, getPairsCommand, placeAuctionOrderCommand}
+		listofCommands := []*Command{helpCommand, registerCommand, getBalanceCommand, getDepositAddressCommand, getDepositsCommand, getStatementCommand, verifyLiabilitiesCommand, getAllBalancesCommand, withdrawCommand, litWithdrawCommand, transferCommand, subTransferCommand, getLitConnectionCommand, getSwapsCommand, placeOrderCommand, getPriceCommand, viewOrderbookCommand, cancelOrderCommand, getPairsCommand, placeAuctionOrderCommand, sweepCommand, getReservesCommand, checkLedgerCommand, reconcileCommand, resumeWithdrawalsCommand, snapshotCommand, auctionSnapshotCommand, recordRefillCommand}
 		printHelp(listofCommands)
 		return nil
 	}
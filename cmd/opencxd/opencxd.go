@@ -4,7 +4,11 @@ import (
 	"encoding/hex"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/lit/crypto/koblitz"
@@ -12,10 +16,14 @@ import (
 	flags "github.com/jessevdk/go-flags"
 	util "github.com/mit-dci/opencx/chainutils"
 	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/cxdb/cxdbkv"
 	"github.com/mit-dci/opencx/cxdb/cxdbmemory"
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
 	"github.com/mit-dci/opencx/cxdb/cxdbsql"
+	"github.com/mit-dci/opencx/cxrest"
 	"github.com/mit-dci/opencx/cxrpc"
 	"github.com/mit-dci/opencx/cxserver"
+	"github.com/mit-dci/opencx/cxws"
 	"github.com/mit-dci/opencx/logging"
 	"github.com/mit-dci/opencx/match"
 )
@@ -31,6 +39,11 @@ type opencxConfig struct {
 	Rpcport uint16 `short:"p" long:"rpcport" description:"Set RPC port to connect to"`
 	Rpchost string `long:"rpchost" description:"Set RPC host to listen to"`
 
+	// the REST gateway is only started if this is set
+	Restport uint16 `long:"restport" description:"Set port to serve the HTTP/JSON REST gateway on, on the RPC host"`
+	// the websocket server is only started if this is set
+	Wsport uint16 `long:"wsport" description:"Set port to serve the websocket market data and trading API on, on the RPC host"`
+
 	// logging and debug parameters
 	LogLevel []bool `short:"v" description:"Set verbosity level to verbose (-v), very verbose (-vv) or very very verbose (-vvv)"`
 
@@ -73,19 +86,63 @@ type opencxConfig struct {
 
 	// support lightning or not to support lightning?
 	LightningSupport bool `long:"lightning" description:"Whether or not to support lightning on the exchange"`
+
+	// what kind of deposit addresses to give out
+	DepositAddrType string `long:"depositaddrtype" description:"Type of deposit address to give out for every coin: P2PKH, P2WPKH, or P2SH-P2WPKH"`
+
+	// watch-only deposit keys, so deposits go to cold storage
+	DepositXpubs []string `long:"depositxpub" description:"Derive deposit addresses for a coin from an extended public key instead of the hot wallet. Formatted as coinname:xpub, can be specified once per coin"`
+
+	// how much to keep in the hot wallets
+	HotWalletPolicies []string `long:"hotwalletpolicy" description:"Sweep the hot wallet for a coin to cold storage when it goes over the ceiling, and alert when it goes under the floor. Formatted as coinname:ceiling:floor:coldaddress, can be specified once per coin"`
+	HotWalletInterval uint64   `long:"hotwalletinterval" description:"How often to check hot wallet balances against their policies, in seconds"`
+
+	// how often users get a new snapshot to check their balances against
+	LiabilityInterval uint64 `long:"liabilityinterval" description:"How often to publish a signed liability snapshot that users can verify their balances against, in seconds"`
+
+	// how often to reconcile wallets against balances, and when to halt withdrawals
+	ReconcileInterval uint64   `long:"reconcileinterval" description:"How often to reconcile what the wallets hold against what the exchange owes, in seconds"`
+	HaltThresholds    []string `long:"haltthreshold" description:"Halt withdrawals of a coin when reconciliation finds a shortfall over the threshold. Formatted as coinname:threshold, can be specified once per coin"`
+
+	// how long to keep filled and cancelled orders, and how often to prune the ones that are older
+	OrderRetention       uint64 `long:"orderretention" description:"How long to keep filled and cancelled orders in the order archive, in hours. 0 keeps them forever"`
+	ArchivePruneInterval uint64 `long:"archivepruneinterval" description:"How often to prune orders older than the retention from the order archive, in seconds"`
+
+	// how much each account can transfer to other accounts in a day
+	TransferLimits []string `long:"transferlimit" description:"The most of a coin each account can transfer to other accounts in a day. Formatted as coinname:limit, can be specified once per coin"`
+
+	// who can call admin commands
+	AdminPubkey string `long:"adminpubkey" description:"Hex pubkey allowed to call admin commands like sweep. Defaults to the exchange's own key"`
+
+	// where to store orders, balances, and deposits
+	DBBackend string `long:"dbbackend" description:"Storage backend to use: sql for the SQL server, or kv for a single data file in the root opencxd directory"`
+	Memory    bool   `long:"memory" description:"Keep everything in memory instead of a storage backend, for development. Nothing is saved when opencxd stops"`
+
+	// a snapshot archive to start from
+	Restore string `long:"restore" description:"Snapshot archive to restore the orderbooks, order archives, balances, ledger, deposits, and transfers from before starting. The storage backend has to be empty"`
+
+	// whether reads of the orderbooks and balances can be behind writes
+	SyncReads bool `long:"syncreads" description:"Update the orderbooks and balances before every write returns, instead of in the background. Reads are never behind, but have to wait on matching"`
 }
 
 var (
 	defaultHomeDir = os.Getenv("HOME")
 
 	// used as defaults before putting into parser
-	defaultOpencxHomeDirName = defaultHomeDir + "/.opencx/opencxd/"
-	defaultRpcport           = uint16(12345)
-	defaultRpchost           = "localhost"
-	defaultMaxPeers          = uint16(64)
-	defaultMinPeerPort       = uint16(25565)
-	defaultLithost           = "localhost"
-	defaultLitport           = uint16(12346)
+	defaultOpencxHomeDirName    = defaultHomeDir + "/.opencx/opencxd/"
+	defaultRpcport              = uint16(12345)
+	defaultRpchost              = "localhost"
+	defaultMaxPeers             = uint16(64)
+	defaultMinPeerPort          = uint16(25565)
+	defaultLithost              = "localhost"
+	defaultLitport              = uint16(12346)
+	defaultDepositAddrType      = "P2PKH"
+	defaultHotWalletInterval    = uint64(600)
+	defaultLiabilityInterval    = uint64(3600)
+	defaultReconcileInterval    = uint64(600)
+	defaultArchivePruneInterval = uint64(3600)
+	defaultDBBackend            = "sql"
+	defaultDBFilename           = "opencx.db"
 
 	// Yes we want to use noise-rpc
 	defaultAuthenticatedRPC = true
@@ -113,11 +170,23 @@ func main() {
 		Litport:          defaultLitport,
 		AuthenticatedRPC: defaultAuthenticatedRPC,
 		LightningSupport: defaultLightningSupport,
+		DepositAddrType:  defaultDepositAddrType,
+
+		HotWalletInterval:    defaultHotWalletInterval,
+		LiabilityInterval:    defaultLiabilityInterval,
+		ReconcileInterval:    defaultReconcileInterval,
+		ArchivePruneInterval: defaultArchivePruneInterval,
+		DBBackend:            defaultDBBackend,
 	}
 
 	// Check and load config params
 	key := opencxSetup(&conf)
 
+	// A ticker can't tick every 0 seconds, so pruning needs a real interval
+	if conf.OrderRetention > 0 && conf.ArchivePruneInterval == 0 {
+		logging.Fatalf("The archive prune interval has to be more than 0 seconds to keep orders for %d hours", conf.OrderRetention)
+	}
+
 	// Generate the coin list based on the parameters we know
 	coinList := generateCoinList(&conf)
 
@@ -126,9 +195,32 @@ func main() {
 		logging.Fatalf("Could not generate asset pairs from coin list: %s", err)
 	}
 
+	// The kv backend keeps everything in one data file, so every store shares one handle
+	var kvDB *cxdbkv.DB
+	switch {
+	case conf.Memory:
+		logging.Warnf("Running with --memory, nothing will be saved when opencxd stops")
+	case conf.DBBackend == "sql":
+	case conf.DBBackend == "kv":
+		logging.Infof("Opening data file...")
+		if kvDB, err = cxdbkv.OpenDB(filepath.Join(conf.OpencxHomeDir, defaultDBFilename)); err != nil {
+			logging.Fatalf("Error opening data file for opencxd: %s", err)
+		}
+		defer kvDB.Close()
+	default:
+		logging.Fatalf("Unknown storage backend %s, use sql or kv", conf.DBBackend)
+	}
+
 	logging.Infof("Creating limit engines...")
 	var mengines map[match.Pair]match.LimitEngine
-	if mengines, err = cxdbsql.CreateLimitEngineMap(pairList); err != nil {
+	if conf.Memory {
+		mengines, err = cxdbmemory.CreateLimitEngineMap(pairList)
+	} else if kvDB != nil {
+		mengines, err = cxdbkv.CreateLimitEngineMap(kvDB, pairList)
+	} else {
+		mengines, err = cxdbsql.CreateLimitEngineMap(pairList)
+	}
+	if err != nil {
 		logging.Fatalf("Error creating limit engine map with coinlist for opencxd: %s", err)
 	}
 
@@ -156,7 +248,14 @@ func main() {
 		}
 	} else {
 		logging.Infof("Creating settlement engines...")
-		if setEngines, err = cxdbsql.CreateSettlementEngineMap(coinList); err != nil {
+		if conf.Memory {
+			setEngines, err = cxdbmemory.CreateSettlementEngineMap(coinList)
+		} else if kvDB != nil {
+			setEngines, err = cxdbkv.CreateSettlementEngineMap(kvDB, coinList)
+		} else {
+			setEngines, err = cxdbsql.CreateSettlementEngineMap(coinList)
+		}
+		if err != nil {
 			logging.Fatalf("Error creating settlement engine map for opencxd: %s", err)
 		}
 	}
@@ -166,31 +265,113 @@ func main() {
 
 	logging.Infof("Creating limit orderbooks...")
 	var limBooks map[match.Pair]match.LimitOrderbook
-	if limBooks, err = cxdbsql.CreateLimitOrderbookMap(pairList); err != nil {
+	if conf.Memory {
+		limBooks, err = cxdbmemory.CreateLimitOrderbookMap(pairList)
+	} else if kvDB != nil {
+		limBooks, err = cxdbkv.CreateLimitOrderbookMap(kvDB, pairList)
+	} else {
+		limBooks, err = cxdbsql.CreateLimitOrderbookMap(pairList)
+	}
+	if err != nil {
 		logging.Fatalf("Error creating limit orderbook map for opencxd: %s", err)
 	}
 
 	logging.Infof("Creating deposit stores...")
 	var depositStores map[*coinparam.Params]cxdb.DepositStore
-	if depositStores, err = cxdbsql.CreateDepositStoreMap(coinList); err != nil {
+	if conf.Memory {
+		depositStores, err = cxdbmemory.CreateDepositStoreMap(coinList)
+	} else if kvDB != nil {
+		depositStores, err = cxdbkv.CreateDepositStoreMap(kvDB, coinList)
+	} else {
+		depositStores, err = cxdbsql.CreateDepositStoreMap(coinList)
+	}
+	if err != nil {
 		logging.Fatalf("Error creating deposit store map for opencxd: %s", err)
 	}
 
 	logging.Infof("Creating settlement stores...")
 	var setStores map[*coinparam.Params]cxdb.SettlementStore
-	if setStores, err = cxdbsql.CreateSettlementStoreMap(coinList); err != nil {
+	if conf.Memory {
+		setStores, err = cxdbmemory.CreateSettlementStoreMap(coinList)
+	} else if kvDB != nil {
+		setStores, err = cxdbkv.CreateSettlementStoreMap(kvDB, coinList)
+	} else {
+		setStores, err = cxdbsql.CreateSettlementStoreMap(coinList)
+	}
+	if err != nil {
 		logging.Fatalf("Error creating settlement store map for opencxd: %s", err)
 	}
 
+	// The pinky swear engines don't keep a ledger, every other settlement engine does
+	var ledgerStores map[*coinparam.Params]cxdb.LedgerStore
+	if len(conf.Whitelist) == 0 {
+		logging.Infof("Creating ledger stores...")
+		if conf.Memory {
+			ledgerStores, err = cxdbmemory.CreateLedgerStoreMap(setEngines)
+		} else if kvDB != nil {
+			ledgerStores, err = cxdbkv.CreateLedgerStoreMap(kvDB, coinList)
+		} else {
+			ledgerStores, err = cxdbsql.CreateLedgerStoreMap(coinList)
+		}
+		if err != nil {
+			logging.Fatalf("Error creating ledger store map for opencxd: %s", err)
+		}
+	}
+
+	var restoredSnap *cxdbsnapshot.Snapshot
+	if conf.Restore != "" {
+		logging.Infof("Restoring snapshot archive %s...", conf.Restore)
+		stores := &cxdbsnapshot.Stores{
+			LimitEngines:      mengines,
+			LimitOrderbooks:   limBooks,
+			SettlementEngines: setEngines,
+			SettlementStores:  setStores,
+			DepositStores:     depositStores,
+			LedgerStores:      ledgerStores,
+		}
+		if restoredSnap, err = restoreArchive(conf.Restore, stores); err != nil {
+			logging.Fatalf("Error restoring snapshot archive for opencxd: %s", err)
+		}
+	}
+
 	// Anyways, here's where we set the server
 	var ocxServer *cxserver.OpencxServer
 	if ocxServer, err = cxserver.InitServer(setEngines, mengines, limBooks, depositStores, setStores, conf.OpencxHomeDir); err != nil {
 		logging.Fatalf("Error initializing server for opencxd: %s", err)
 	}
 
+	if ledgerStores != nil {
+		ocxServer.SetLedgerStores(ledgerStores)
+
+		// settle every match in one transaction across the coins
+		logging.Infof("Creating batch settlement engine...")
+		var batchEngine match.BatchSettlementEngine
+		if conf.Memory {
+			batchEngine, err = cxdbmemory.CreateBatchSettlementEngine(setEngines)
+		} else if kvDB != nil {
+			batchEngine, err = cxdbkv.CreateBatchSettlementEngine(kvDB, coinList)
+		} else {
+			batchEngine, err = cxdbsql.CreateBatchSettlementEngine(coinList)
+		}
+		if err != nil {
+			logging.Fatalf("Error creating batch settlement engine for opencxd: %s", err)
+		}
+		ocxServer.SetBatchSettlementEngine(batchEngine)
+	}
+
+	if !conf.SyncReads {
+		ocxServer.StartProjection()
+	}
+
+	var depositAddrType util.AddressType
+	if depositAddrType, err = util.AddressTypeFromString(conf.DepositAddrType); err != nil {
+		logging.Fatalf("Error parsing deposit address type for opencxd: %s", err)
+	}
+
 	// For debugging but also it looks nice
 	for _, coin := range coinList {
 		logging.Infof("Coin supported: %s", coin.Name)
+		ocxServer.SetDepositAddressType(coin, depositAddrType)
 	}
 
 	// Check that the private key exists and if it does, load it
@@ -198,6 +379,38 @@ func main() {
 		logging.Fatalf("Error setting up server keys: \n%s", err)
 	}
 
+	for _, coinXpub := range conf.DepositXpubs {
+		coinAndXpub := strings.SplitN(coinXpub, ":", 2)
+		if len(coinAndXpub) != 2 {
+			logging.Fatalf("Deposit xpub %s must be formatted as coinname:xpub", coinXpub)
+		}
+		var xpubCoin *coinparam.Params
+		if xpubCoin, err = util.GetParamFromName(coinAndXpub[0]); err != nil {
+			logging.Fatalf("Error getting coin for deposit xpub: %s", err)
+		}
+		if err = ocxServer.SetDepositXpub(xpubCoin, coinAndXpub[1]); err != nil {
+			logging.Fatalf("Error setting deposit xpub: %s", err)
+		}
+		logging.Infof("Deriving %s deposit addresses from xpub", xpubCoin.Name)
+	}
+
+	var adminPubkey *koblitz.PublicKey
+	if conf.AdminPubkey != "" {
+		var adminPubkeyBytes []byte
+		if adminPubkeyBytes, err = hex.DecodeString(conf.AdminPubkey); err != nil {
+			logging.Fatalf("Error decoding admin pubkey: %s", err)
+		}
+		if adminPubkey, err = koblitz.ParsePubKey(adminPubkeyBytes, koblitz.S256()); err != nil {
+			logging.Fatalf("Error parsing admin pubkey: %s", err)
+		}
+	} else {
+		_, adminPubkey = koblitz.PrivKeyFromBytes(koblitz.S256(), key[:])
+	}
+	ocxServer.SetAdminPubkey(adminPubkey)
+	if err = ocxServer.LoadAdminNonce(); err != nil {
+		logging.Fatalf("Error loading admin nonce: %s", err)
+	}
+
 	// Generate the host param list
 	// the host params are all of the coinparams / coins we support
 	// this coinparam list is generated from the configuration file with generateHostParams
@@ -209,6 +422,100 @@ func main() {
 		return
 	}
 
+	// reconciliation needs the sweep history even if we aren't sweeping anymore
+	if err = ocxServer.LoadHotColdSweeps(); err != nil {
+		logging.Fatalf("Error loading hot wallet sweep history: %s", err)
+	}
+
+	if len(conf.HotWalletPolicies) != 0 {
+		for _, policyStr := range conf.HotWalletPolicies {
+			policyFields := strings.SplitN(policyStr, ":", 4)
+			if len(policyFields) != 4 {
+				logging.Fatalf("Hot wallet policy %s must be formatted as coinname:ceiling:floor:coldaddress", policyStr)
+			}
+			var policyCoin *coinparam.Params
+			if policyCoin, err = util.GetParamFromName(policyFields[0]); err != nil {
+				logging.Fatalf("Error getting coin for hot wallet policy: %s", err)
+			}
+			policy := &cxserver.HotWalletPolicy{ColdDestination: policyFields[3]}
+			if policy.Ceiling, err = strconv.ParseUint(policyFields[1], 10, 64); err != nil {
+				logging.Fatalf("Error parsing hot wallet ceiling: %s", err)
+			}
+			if policy.Floor, err = strconv.ParseUint(policyFields[2], 10, 64); err != nil {
+				logging.Fatalf("Error parsing hot wallet floor: %s", err)
+			}
+			if err = ocxServer.SetHotWalletPolicy(policyCoin, policy); err != nil {
+				logging.Fatalf("Error setting hot wallet policy: %s", err)
+			}
+			logging.Infof("Keeping between %d and %d %s in the hot wallet", policy.Floor, policy.Ceiling, policyCoin.Name)
+		}
+
+		ocxServer.StartHotWalletMonitor(time.Duration(conf.HotWalletInterval) * time.Second)
+	}
+
+	if err = ocxServer.LoadLiabilitySnapshots(); err != nil {
+		logging.Fatalf("Error loading liability snapshots: %s", err)
+	}
+	ocxServer.StartLiabilitySnapshots(time.Duration(conf.LiabilityInterval) * time.Second)
+
+	for _, thresholdStr := range conf.HaltThresholds {
+		thresholdFields := strings.SplitN(thresholdStr, ":", 2)
+		if len(thresholdFields) != 2 {
+			logging.Fatalf("Halt threshold %s must be formatted as coinname:threshold", thresholdStr)
+		}
+		var thresholdCoin *coinparam.Params
+		if thresholdCoin, err = util.GetParamFromName(thresholdFields[0]); err != nil {
+			logging.Fatalf("Error getting coin for halt threshold: %s", err)
+		}
+		var threshold uint64
+		if threshold, err = strconv.ParseUint(thresholdFields[1], 10, 64); err != nil {
+			logging.Fatalf("Error parsing halt threshold: %s", err)
+		}
+		ocxServer.SetReconcileThreshold(thresholdCoin, threshold)
+		logging.Infof("Halting %s withdrawals if the shortfall goes over %d", thresholdCoin.Name, threshold)
+	}
+
+	if err = ocxServer.LoadReconciliationReports(); err != nil {
+		logging.Fatalf("Error loading reconciliation reports: %s", err)
+	}
+	ocxServer.StartReconciliation(time.Duration(conf.ReconcileInterval) * time.Second)
+
+	if conf.OrderRetention > 0 {
+		ocxServer.StartArchivePruning(time.Duration(conf.OrderRetention)*time.Hour, time.Duration(conf.ArchivePruneInterval)*time.Second)
+	}
+
+	for _, limitStr := range conf.TransferLimits {
+		limitFields := strings.SplitN(limitStr, ":", 2)
+		if len(limitFields) != 2 {
+			logging.Fatalf("Transfer limit %s must be formatted as coinname:limit", limitStr)
+		}
+		var limitCoin *coinparam.Params
+		if limitCoin, err = util.GetParamFromName(limitFields[0]); err != nil {
+			logging.Fatalf("Error getting coin for transfer limit: %s", err)
+		}
+		var limit uint64
+		if limit, err = strconv.ParseUint(limitFields[1], 10, 64); err != nil {
+			logging.Fatalf("Error parsing transfer limit: %s", err)
+		}
+		ocxServer.SetTransferLimit(limitCoin, limit)
+		logging.Infof("Limiting %s transfers to %d per account per day", limitCoin.Name, limit)
+	}
+
+	// transfers are kept in the root directory rather than the storage backend
+	if restoredSnap != nil {
+		if err = ocxServer.RestoreTransfers(restoredSnap.Transfers); err != nil {
+			logging.Fatalf("Error restoring transfers for opencxd: %s", err)
+		}
+	}
+
+	if err = ocxServer.LoadTransfers(); err != nil {
+		logging.Fatalf("Error loading transfers: %s", err)
+	}
+
+	if err = ocxServer.LoadSwaps(); err != nil {
+		logging.Fatalf("Error loading swaps: %s", err)
+	}
+
 	if conf.LightningSupport {
 		// start the lit node for the exchange
 		if err = ocxServer.SetupLitNode(key, "lit", "http://hubris.media.mit.edu:46580", "", ""); err != nil {
@@ -228,6 +535,10 @@ func main() {
 		ocxServer.ExchangeNode.Events.RegisterHandler("qln.chanupdate.push", ocxServer.GetPushHandler())
 		logging.Infof("done registering push handler")
 
+		logging.Infof("registering swap HTLC handler")
+		ocxServer.ExchangeNode.Events.RegisterHandler("qln.chanupdate.sigrev", ocxServer.GetSwapHTLCHandler())
+		logging.Infof("done registering swap HTLC handler")
+
 		// Waited until the wallets are started, time to link them!
 		if err = ocxServer.LinkAllWallets(); err != nil {
 			logging.Fatalf("Could not link wallets: \n%s", err)
@@ -253,6 +564,24 @@ func main() {
 		logging.Fatalf("Error creating rpc caller for server: %s", err)
 	}
 
+	var restGateway *cxrest.Gateway
+	if conf.Restport != 0 {
+		if restGateway, err = cxrest.NewGateway("opencxd", &cxrpc.OpencxRPC{Server: ocxServer}); err != nil {
+			logging.Fatalf("Error creating REST gateway for server: %s", err)
+		}
+		if err = restGateway.Listen(conf.Rpchost, conf.Restport); err != nil {
+			logging.Fatalf("Error listening for REST gateway for server: %s", err)
+		}
+	}
+
+	var wsServer *cxws.WebSocketServer
+	if conf.Wsport != 0 {
+		wsServer = cxws.NewWebSocketServer(ocxServer)
+		if err = wsServer.Listen(conf.Rpchost, conf.Wsport); err != nil {
+			logging.Fatalf("Error listening for websocket server for server: %s", err)
+		}
+	}
+
 	// SIGINT and SIGTERM and SIGQUIT handler for CTRL-c, KILL, CTRL-/, etc.
 	go func() {
 		logging.Infof("Notifying signals")
@@ -264,6 +593,18 @@ func main() {
 			signal := <-sigs
 			logging.Infof("Received %s signal, Stopping server gracefully...", signal.String())
 
+			if restGateway != nil {
+				if err = restGateway.Stop(); err != nil {
+					logging.Errorf("Error stopping REST gateway: %s", err)
+				}
+			}
+
+			if wsServer != nil {
+				if err = wsServer.Stop(); err != nil {
+					logging.Errorf("Error stopping websocket server: %s", err)
+				}
+			}
+
 			// stop rpc listener
 			if err = rpcListener.Stop(); err != nil {
 				logging.Fatalf("Error killing server: %s", err)
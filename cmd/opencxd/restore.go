@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+)
+
+// restoreArchive reads a snapshot archive and restores it into the stores opencxd is about to run
+// with. Auctions are not restored, since opencxd does not run auctions. Without ledger stores, the
+// ledger in the snapshot is not restored either. The snapshot is returned so the transfers in it can
+// be restored once the server is created.
+func restoreArchive(archivePath string, stores *cxdbsnapshot.Stores) (snap *cxdbsnapshot.Snapshot, err error) {
+	var archiveFile *os.File
+	if archiveFile, err = os.Open(archivePath); err != nil {
+		err = fmt.Errorf("Error opening archive for restoreArchive: %s", err)
+		return
+	}
+	defer archiveFile.Close()
+
+	if snap, err = cxdbsnapshot.ReadArchive(archiveFile); err != nil {
+		err = fmt.Errorf("Error reading archive for restoreArchive: %s", err)
+		return
+	}
+
+	if err = cxdbsnapshot.Restore(stores, snap); err != nil {
+		snap = nil
+		err = fmt.Errorf("Error restoring snapshot for restoreArchive: %s", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,101 @@
+package liabilities
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/match"
+	"golang.org/x/crypto/sha3"
+)
+
+// AssetRoot is the root of the merkle sum tree for one asset
+type AssetRoot struct {
+	Asset match.Asset `json:"asset"`
+	Root  Node        `json:"root"`
+}
+
+// Snapshot is the set of roots the exchange publishes for a point in time, signed by the exchange.
+type Snapshot struct {
+	ID        uint64       `json:"id"`
+	Time      time.Time    `json:"time"`
+	Roots     []*AssetRoot `json:"roots"`
+	Signature []byte       `json:"signature"`
+}
+
+// NewSnapshot creates an unsigned snapshot from a tree for every asset. Roots are ordered by asset
+// so the serialization is always the same.
+func NewSnapshot(id uint64, snapshotTime time.Time, trees []*Tree) (snapshot *Snapshot) {
+	snapshot = &Snapshot{
+		ID:   id,
+		Time: snapshotTime,
+	}
+	for _, tree := range trees {
+		snapshot.Roots = append(snapshot.Roots, &AssetRoot{
+			Asset: tree.Asset,
+			Root:  tree.Root(),
+		})
+	}
+	sort.Slice(snapshot.Roots, func(i, j int) bool {
+		return snapshot.Roots[i].Asset < snapshot.Roots[j].Asset
+	})
+	return
+}
+
+// Serialize serializes everything in the snapshot except the signature, which is what gets signed
+func (s *Snapshot) Serialize() (buf []byte) {
+	var intBytes [8]byte
+	binary.BigEndian.PutUint64(intBytes[:], s.ID)
+	buf = append(buf, intBytes[:]...)
+	binary.BigEndian.PutUint64(intBytes[:], uint64(s.Time.Unix()))
+	buf = append(buf, intBytes[:]...)
+	for _, assetRoot := range s.Roots {
+		buf = append(buf, byte(assetRoot.Asset))
+		buf = append(buf, assetRoot.Root.Hash[:]...)
+		binary.BigEndian.PutUint64(intBytes[:], assetRoot.Root.Sum)
+		buf = append(buf, intBytes[:]...)
+	}
+	return
+}
+
+// Sign signs the snapshot with the exchange's key
+func (s *Snapshot) Sign(privkey *koblitz.PrivateKey) (err error) {
+	// e = h(snapshot)
+	sha3 := sha3.New256()
+	sha3.Write(s.Serialize())
+	e := sha3.Sum(nil)
+
+	if s.Signature, err = koblitz.SignCompact(koblitz.S256(), privkey, e, false); err != nil {
+		err = fmt.Errorf("Error signing snapshot: %s", err)
+		return
+	}
+	return
+}
+
+// Signer recovers the pubkey that signed the snapshot, which should be the exchange's pubkey
+func (s *Snapshot) Signer() (pubkey *koblitz.PublicKey, err error) {
+	// e = h(snapshot)
+	sha3 := sha3.New256()
+	sha3.Write(s.Serialize())
+	e := sha3.Sum(nil)
+
+	if pubkey, _, err = koblitz.RecoverCompact(koblitz.S256(), s.Signature, e); err != nil {
+		err = fmt.Errorf("Error, invalid signature for snapshot: %s", err)
+		return
+	}
+	return
+}
+
+// RootForAsset returns the root of the tree for an asset
+func (s *Snapshot) RootForAsset(asset match.Asset) (root Node, err error) {
+	for _, assetRoot := range s.Roots {
+		if assetRoot.Asset == asset {
+			root = assetRoot.Root
+			return
+		}
+	}
+	err = fmt.Errorf("Snapshot %d has no root for %s", s.ID, asset)
+	return
+}
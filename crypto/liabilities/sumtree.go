@@ -0,0 +1,201 @@
+package liabilities
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/mit-dci/opencx/match"
+	"golang.org/x/crypto/sha3"
+)
+
+// Node is a node in the merkle sum tree. The sum of a node is the sum of every balance under it, and
+// the hash commits to the sums of both children as well as their hashes, so a node can't claim a
+// smaller sum than its children add up to.
+type Node struct {
+	Hash [32]byte `json:"hash"`
+	Sum  uint64   `json:"sum"`
+}
+
+// Leaf is a single user's balance of an asset. The nonce is random for every snapshot, so the hash
+// of a leaf given out in someone else's proof doesn't reveal which pubkey or balance it is for.
+type Leaf struct {
+	Pubkey  [33]byte    `json:"pubkey"`
+	Asset   match.Asset `json:"asset"`
+	Balance uint64      `json:"balance"`
+	Nonce   [32]byte    `json:"nonce"`
+}
+
+// Node returns the tree node for the leaf
+func (l *Leaf) Node() (node Node) {
+	var balanceBytes [8]byte
+	binary.BigEndian.PutUint64(balanceBytes[:], l.Balance)
+
+	hasher := sha3.New256()
+	hasher.Write([]byte("leaf"))
+	hasher.Write(l.Pubkey[:])
+	hasher.Write([]byte{byte(l.Asset)})
+	hasher.Write(balanceBytes[:])
+	hasher.Write(l.Nonce[:])
+	copy(node.Hash[:], hasher.Sum(nil))
+	node.Sum = l.Balance
+	return
+}
+
+// parentNode combines two children into their parent, returning an error if the sum overflows
+func parentNode(left Node, right Node) (parent Node, err error) {
+	if left.Sum+right.Sum < left.Sum {
+		err = fmt.Errorf("Sum of %d and %d overflows", left.Sum, right.Sum)
+		return
+	}
+
+	var sumBytes [8]byte
+	hasher := sha3.New256()
+	hasher.Write([]byte("node"))
+	hasher.Write(left.Hash[:])
+	binary.BigEndian.PutUint64(sumBytes[:], left.Sum)
+	hasher.Write(sumBytes[:])
+	hasher.Write(right.Hash[:])
+	binary.BigEndian.PutUint64(sumBytes[:], right.Sum)
+	hasher.Write(sumBytes[:])
+	copy(parent.Hash[:], hasher.Sum(nil))
+	parent.Sum = left.Sum + right.Sum
+	return
+}
+
+// Tree is a merkle sum tree over every user's balance of a single asset. The root sum is what the
+// exchange owes its users in that asset.
+type Tree struct {
+	Asset match.Asset
+	// levels[0] are the leaf nodes, and the last level is just the root
+	levels [][]Node
+	leaves []*Leaf
+	// index of each pubkey's leaf
+	index map[[33]byte]int
+}
+
+// NewTree builds a merkle sum tree for an asset from a map of pubkey to balance. Leaves are ordered
+// by pubkey and each one gets a fresh random nonce.
+func NewTree(asset match.Asset, balances map[[33]byte]uint64) (tree *Tree, err error) {
+	tree = &Tree{
+		Asset: asset,
+		index: make(map[[33]byte]int),
+	}
+
+	for pubkey, balance := range balances {
+		leaf := &Leaf{
+			Pubkey:  pubkey,
+			Asset:   asset,
+			Balance: balance,
+		}
+		if _, err = rand.Read(leaf.Nonce[:]); err != nil {
+			err = fmt.Errorf("Error getting random nonce for leaf for NewTree: %s", err)
+			return
+		}
+		tree.leaves = append(tree.leaves, leaf)
+	}
+	sort.Slice(tree.leaves, func(i, j int) bool {
+		return bytes.Compare(tree.leaves[i].Pubkey[:], tree.leaves[j].Pubkey[:]) < 0
+	})
+
+	var currLevel []Node
+	for i, leaf := range tree.leaves {
+		tree.index[leaf.Pubkey] = i
+		currLevel = append(currLevel, leaf.Node())
+	}
+	// an empty tree still has a root, it just sums to zero
+	if len(currLevel) == 0 {
+		currLevel = append(currLevel, Node{})
+	}
+	tree.levels = append(tree.levels, currLevel)
+
+	for len(currLevel) > 1 {
+		// pad odd levels with an empty node so every node has a sibling
+		if len(currLevel)%2 == 1 {
+			currLevel = append(currLevel, Node{})
+			tree.levels[len(tree.levels)-1] = currLevel
+		}
+		var nextLevel []Node
+		var parent Node
+		for i := 0; i < len(currLevel); i += 2 {
+			if parent, err = parentNode(currLevel[i], currLevel[i+1]); err != nil {
+				err = fmt.Errorf("Error building parent node for NewTree: %s", err)
+				return
+			}
+			nextLevel = append(nextLevel, parent)
+		}
+		tree.levels = append(tree.levels, nextLevel)
+		currLevel = nextLevel
+	}
+
+	return
+}
+
+// Root returns the root of the tree
+func (t *Tree) Root() (root Node) {
+	root = t.levels[len(t.levels)-1][0]
+	return
+}
+
+// ProofStep is one sibling on the path from a leaf to the root
+type ProofStep struct {
+	Sibling Node `json:"sibling"`
+	// SiblingOnLeft is true if the sibling is the left child of the parent
+	SiblingOnLeft bool `json:"siblingonleft"`
+}
+
+// Proof is a proof that a leaf is included in a merkle sum tree
+type Proof struct {
+	Leaf Leaf        `json:"leaf"`
+	Path []ProofStep `json:"path"`
+}
+
+// Prove creates an inclusion proof for a pubkey's leaf
+func (t *Tree) Prove(pubkey [33]byte) (proof *Proof, err error) {
+	var idx int
+	var ok bool
+	if idx, ok = t.index[pubkey]; !ok {
+		err = fmt.Errorf("Pubkey %x has no %s balance in the tree", pubkey, t.Asset)
+		return
+	}
+
+	proof = &Proof{
+		Leaf: *t.leaves[idx],
+	}
+	// every level but the root has a sibling on the path
+	for _, level := range t.levels[:len(t.levels)-1] {
+		siblingIdx := idx ^ 1
+		proof.Path = append(proof.Path, ProofStep{
+			Sibling:       level[siblingIdx],
+			SiblingOnLeft: siblingIdx < idx,
+		})
+		idx /= 2
+	}
+
+	return
+}
+
+// Verify checks that the proof leads to the root. This also makes sure no sibling on the path has a
+// sum that overflows, since that would let the exchange hide liabilities.
+func (p *Proof) Verify(root Node) (err error) {
+	currNode := p.Leaf.Node()
+	for i, step := range p.Path {
+		if step.SiblingOnLeft {
+			currNode, err = parentNode(step.Sibling, currNode)
+		} else {
+			currNode, err = parentNode(currNode, step.Sibling)
+		}
+		if err != nil {
+			err = fmt.Errorf("Error computing node at level %d of proof: %s", i+1, err)
+			return
+		}
+	}
+
+	if currNode != root {
+		err = fmt.Errorf("Proof leads to root %x with sum %d, but the published root is %x with sum %d", currNode.Hash, currNode.Sum, root.Hash, root.Sum)
+		return
+	}
+	return
+}
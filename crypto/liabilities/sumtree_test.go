@@ -0,0 +1,151 @@
+package liabilities
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/match"
+)
+
+// testBalances creates n pubkeys with balances 1 through n
+func testBalances(t *testing.T, n int) (balances map[[33]byte]uint64) {
+	balances = make(map[[33]byte]uint64)
+	for i := 0; i < n; i++ {
+		privkey, err := koblitz.NewPrivateKey(koblitz.S256())
+		if err != nil {
+			t.Fatalf("Error creating private key: %s", err)
+		}
+		var pubkey [33]byte
+		copy(pubkey[:], privkey.PubKey().SerializeCompressed())
+		balances[pubkey] = uint64(i + 1)
+	}
+	return
+}
+
+func TestSumTreeProofs(t *testing.T) {
+	var err error
+
+	for _, n := range []int{0, 1, 2, 3, 7, 16} {
+		balances := testBalances(t, n)
+
+		var tree *Tree
+		if tree, err = NewTree(match.BTCTest, balances); err != nil {
+			t.Errorf("Error creating tree with %d leaves: %s", n, err)
+			return
+		}
+
+		if expectedSum := uint64(n * (n + 1) / 2); tree.Root().Sum != expectedSum {
+			t.Errorf("Tree with %d leaves should sum to %d, got %d", n, expectedSum, tree.Root().Sum)
+			return
+		}
+
+		for pubkey, balance := range balances {
+			var proof *Proof
+			if proof, err = tree.Prove(pubkey); err != nil {
+				t.Errorf("Error proving leaf in tree with %d leaves: %s", n, err)
+				return
+			}
+			if proof.Leaf.Balance != balance {
+				t.Errorf("Proof should be for balance %d, got %d", balance, proof.Leaf.Balance)
+				return
+			}
+			if err = proof.Verify(tree.Root()); err != nil {
+				t.Errorf("Error verifying proof in tree with %d leaves: %s", n, err)
+				return
+			}
+
+			// A proof with a lower balance than the one committed to should fail
+			proof.Leaf.Balance--
+			if err = proof.Verify(tree.Root()); err == nil {
+				t.Errorf("Proof with a changed balance should not verify")
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func TestSumTreeHiddenSibling(t *testing.T) {
+	var err error
+
+	balances := testBalances(t, 4)
+	var tree *Tree
+	if tree, err = NewTree(match.BTCTest, balances); err != nil {
+		t.Errorf("Error creating tree: %s", err)
+		return
+	}
+
+	for pubkey := range balances {
+		var proof *Proof
+		if proof, err = tree.Prove(pubkey); err != nil {
+			t.Errorf("Error proving leaf: %s", err)
+			return
+		}
+
+		// If the exchange gives a sibling a lower sum, the root changes so the proof fails
+		proof.Path[0].Sibling.Sum = 0
+		if err = proof.Verify(tree.Root()); err == nil {
+			t.Errorf("Proof with a lowered sibling sum should not verify")
+			return
+		}
+	}
+
+	return
+}
+
+func TestSnapshotSignature(t *testing.T) {
+	var err error
+
+	var btcTree, ltcTree *Tree
+	if btcTree, err = NewTree(match.BTCTest, testBalances(t, 3)); err != nil {
+		t.Errorf("Error creating btc tree: %s", err)
+		return
+	}
+	if ltcTree, err = NewTree(match.LTCTest, testBalances(t, 5)); err != nil {
+		t.Errorf("Error creating ltc tree: %s", err)
+		return
+	}
+
+	var exchangeKey *koblitz.PrivateKey
+	if exchangeKey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating exchange key: %s", err)
+		return
+	}
+
+	snapshot := NewSnapshot(1, time.Now(), []*Tree{ltcTree, btcTree})
+	if err = snapshot.Sign(exchangeKey); err != nil {
+		t.Errorf("Error signing snapshot: %s", err)
+		return
+	}
+
+	var signer *koblitz.PublicKey
+	if signer, err = snapshot.Signer(); err != nil {
+		t.Errorf("Error recovering signer: %s", err)
+		return
+	}
+	if !signer.IsEqual(exchangeKey.PubKey()) {
+		t.Errorf("Snapshot signer should be the exchange key")
+		return
+	}
+
+	var root Node
+	if root, err = snapshot.RootForAsset(match.LTCTest); err != nil {
+		t.Errorf("Error getting ltc root: %s", err)
+		return
+	}
+	if root != ltcTree.Root() {
+		t.Errorf("Snapshot ltc root should be the ltc tree root")
+		return
+	}
+
+	// Changing a root after signing should change the signer
+	snapshot.Roots[0].Root.Sum++
+	if signer, err = snapshot.Signer(); err == nil && signer.IsEqual(exchangeKey.PubKey()) {
+		t.Errorf("Changed snapshot should not be signed by the exchange key")
+		return
+	}
+
+	return
+}
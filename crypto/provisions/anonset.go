@@ -0,0 +1,154 @@
+package provisions
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+)
+
+// AnonSetEntry is a public key in the anonymity set and its balance, which would normally come from
+// the UTXO set
+type AnonSetEntry struct {
+	PubKey  *ecdsa.PublicKey
+	Balance uint64
+}
+
+// SortAnonSet returns a copy of the anonymity set sorted by compressed pubkey, which is the order
+// keys are in the proof
+func SortAnonSet(anonSet []*AnonSetEntry) (sortedSet []*AnonSetEntry) {
+	sortedSet = make([]*AnonSetEntry, len(anonSet))
+	copy(sortedSet, anonSet)
+	sort.Slice(sortedSet, func(i, j int) bool {
+		iBytes, jBytes := compressPubKey(sortedSet[i].PubKey), compressPubKey(sortedSet[j].PubKey)
+		return bytes.Compare(iBytes[:], jBytes[:]) < 0
+	})
+	return
+}
+
+// ReadAnonSet reads an anonymity set, one "<hex compressed pubkey> <balance>" per line. Blank
+// lines and lines starting with # are skipped.
+func ReadAnonSet(curve *koblitz.KoblitzCurve, r io.Reader) (anonSet []*AnonSetEntry, err error) {
+	seen := make(map[[33]byte]bool)
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			err = fmt.Errorf("Line %d should be a pubkey and a balance", lineNum)
+			return
+		}
+
+		var pubkeyBytes []byte
+		if pubkeyBytes, err = hex.DecodeString(fields[0]); err != nil {
+			err = fmt.Errorf("Error decoding pubkey on line %d: %s", lineNum, err)
+			return
+		}
+
+		var pubkey *koblitz.PublicKey
+		if pubkey, err = koblitz.ParsePubKey(pubkeyBytes, curve); err != nil {
+			err = fmt.Errorf("Error parsing pubkey on line %d: %s", lineNum, err)
+			return
+		}
+
+		entry := &AnonSetEntry{PubKey: (*ecdsa.PublicKey)(pubkey)}
+		if entry.Balance, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			err = fmt.Errorf("Error parsing balance on line %d: %s", lineNum, err)
+			return
+		}
+
+		compressed := compressPubKey(entry.PubKey)
+		if seen[compressed] {
+			err = fmt.Errorf("Pubkey on line %d is already in the anonymity set", lineNum)
+			return
+		}
+		seen[compressed] = true
+
+		anonSet = append(anonSet, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		err = fmt.Errorf("Error reading anonymity set: %s", err)
+		return
+	}
+	return
+}
+
+// ReadAnonSetFile reads an anonymity set from a file
+func ReadAnonSetFile(curve *koblitz.KoblitzCurve, filename string) (anonSet []*AnonSetEntry, err error) {
+	var anonSetFile *os.File
+	if anonSetFile, err = os.Open(filename); err != nil {
+		err = fmt.Errorf("Error opening anonymity set file: %s", err)
+		return
+	}
+	defer anonSetFile.Close()
+
+	anonSet, err = ReadAnonSet(curve, anonSetFile)
+	return
+}
+
+// WriteAnonSet writes an anonymity set in the format ReadAnonSet reads
+func WriteAnonSet(w io.Writer, anonSet []*AnonSetEntry) (err error) {
+	for _, entry := range anonSet {
+		if _, err = fmt.Fprintf(w, "%x %d\n", compressPubKey(entry.PubKey), entry.Balance); err != nil {
+			err = fmt.Errorf("Error writing anonymity set: %s", err)
+			return
+		}
+	}
+	return
+}
+
+// ReadPrivKeys reads the exchange's private keys, one hex private key per line. Blank lines and
+// lines starting with # are skipped.
+func ReadPrivKeys(curve *koblitz.KoblitzCurve, r io.Reader) (privkeys []*ecdsa.PrivateKey, err error) {
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var privkeyBytes []byte
+		if privkeyBytes, err = hex.DecodeString(line); err != nil {
+			err = fmt.Errorf("Error decoding private key on line %d: %s", lineNum, err)
+			return
+		}
+
+		if len(privkeyBytes) != 32 {
+			err = fmt.Errorf("Private key on line %d should be 32 bytes, got %d", lineNum, len(privkeyBytes))
+			return
+		}
+
+		privkey, _ := koblitz.PrivKeyFromBytes(curve, privkeyBytes)
+		privkeys = append(privkeys, (*ecdsa.PrivateKey)(privkey))
+	}
+	if err = scanner.Err(); err != nil {
+		err = fmt.Errorf("Error reading private keys: %s", err)
+		return
+	}
+	return
+}
+
+// ReadPrivKeysFile reads the exchange's private keys from a file
+func ReadPrivKeysFile(curve *koblitz.KoblitzCurve, filename string) (privkeys []*ecdsa.PrivateKey, err error) {
+	var privkeyFile *os.File
+	if privkeyFile, err = os.Open(filename); err != nil {
+		err = fmt.Errorf("Error opening private key file: %s", err)
+		return
+	}
+	defer privkeyFile.Close()
+
+	privkeys, err = ReadPrivKeys(curve, privkeyFile)
+	return
+}
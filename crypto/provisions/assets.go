@@ -1,13 +1,15 @@
 package provisions
 
 import (
+	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"fmt"
 	"math/big"
+	"sort"
 	"sync"
 
+	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/zksigma"
 )
 
@@ -15,38 +17,85 @@ import (
 // used to compute individual balance commitments, as well as calculate things like
 // responses to challenges
 type BalProofMachine struct {
-	u1 *big.Int
-	u2 *big.Int
-	u3 *big.Int
-	u4 *big.Int
-	ci *big.Int
-	ti *big.Int
-	xi *big.Int
+	curve *koblitz.KoblitzCurve
+	g     zksigma.ECPoint
+	h     zksigma.ECPoint
+	u1    *big.Int
+	u2    *big.Int
+	u3    *big.Int
+	u4    *big.Int
+	ci    *big.Int
+	si    bool
+	vi    *big.Int
+	ti    *big.Int
+	xi    *big.Int
+
+	// These are public, y_i and bal(y_i) in the paper
+	pubkey  zksigma.ECPoint
+	balance uint64
+}
+
+// randomScalar picks a random nonzero scalar less than the order
+func randomScalar(order *big.Int) (k *big.Int, err error) {
+	for k == nil || k.Sign() == 0 {
+		if k, err = rand.Int(rand.Reader, order); err != nil {
+			return
+		}
+	}
+	return
 }
 
 // NewBalProofMachine creates a new balance proof machine
-func NewBalProofMachine(curve elliptic.Curve) (machine *BalProofMachine, err error) {
-	order := curve.Params().P
-	if machine.u1, err = rand.Int(rand.Reader, order); err != nil {
+func NewBalProofMachine(curve *koblitz.KoblitzCurve) (machine *BalProofMachine, err error) {
+	machine = &BalProofMachine{
+		curve: curve,
+		g:     generatorG(curve),
+		h:     GeneratorH(curve),
+		xi:    big.NewInt(0),
+	}
+
+	order := curve.Params().N
+	if machine.u1, err = randomScalar(order); err != nil {
 		err = fmt.Errorf("Error getting random u_1 for balance proof machine: %s", err)
 		return
 	}
 
-	if machine.u2, err = rand.Int(rand.Reader, order); err != nil {
+	if machine.u2, err = randomScalar(order); err != nil {
 		err = fmt.Errorf("Error getting random u_2 for balance proof machine: %s", err)
 		return
 	}
 
-	if machine.u3, err = rand.Int(rand.Reader, order); err != nil {
+	if machine.u3, err = randomScalar(order); err != nil {
 		err = fmt.Errorf("Error getting random u_3 for balance proof machine: %s", err)
 		return
 	}
 
-	if machine.u4, err = rand.Int(rand.Reader, order); err != nil {
+	if machine.u4, err = randomScalar(order); err != nil {
 		err = fmt.Errorf("Error getting random u_4 for balance proof machine: %s", err)
 		return
 	}
 
+	if machine.vi, err = randomScalar(order); err != nil {
+		err = fmt.Errorf("Error getting random v_i for balance proof machine: %s", err)
+		return
+	}
+
+	if machine.ti, err = randomScalar(order); err != nil {
+		err = fmt.Errorf("Error getting random t_i for balance proof machine: %s", err)
+		return
+	}
+
+	return
+}
+
+// SetBalance sets the public key and its balance for this iteration
+func (machine *BalProofMachine) SetBalance(pubkey *ecdsa.PublicKey, balance uint64) (err error) {
+	if pubkey == nil {
+		err = fmt.Errorf("Public key cannot be nil")
+		return
+	}
+	machine.pubkey = zksigma.ECPoint{X: pubkey.X, Y: pubkey.Y}
+	machine.balance = balance
 	return
 }
 
@@ -60,63 +109,203 @@ func (machine *BalProofMachine) SetChallenge(ci *big.Int) (err error) {
 	return
 }
 
-// SetPrivKey sets the private key for this iteration
+// SetPrivKey sets the private key for this iteration, which means s_i = 1
 func (machine *BalProofMachine) SetPrivKey(privkey *ecdsa.PrivateKey) (err error) {
 	if privkey == nil {
 		err = fmt.Errorf("Private key cannot be nil")
 		return
 	}
 	machine.xi = privkey.D
+	machine.si = true
+	return
+}
+
+// Commit computes the commitments p_i and l_i, as well as the first message of the sigma protocol
+// a_1, a_2, and a_3. The public key and balance must be set.
+func (machine *BalProofMachine) Commit() (proof *BalanceProof, err error) {
+	if machine.pubkey.X == nil {
+		err = fmt.Errorf("Cannot commit to a balance if the public key has not been set")
+		return
+	}
+
+	s := big.NewInt(0)
+	if machine.si {
+		s.SetInt64(1)
+	}
+
+	// b_i = g^bal(y_i)
+	b := mult(machine.curve, machine.g, new(big.Int).SetUint64(machine.balance))
+
+	proof = &BalanceProof{
+		PubKey:  machine.pubkey,
+		Balance: machine.balance,
+		// p_i = b_i^s_i h^v_i
+		P: commit(machine.curve, b, s, machine.h, machine.vi),
+		// l_i = y_i^s_i h^t_i
+		L: commit(machine.curve, machine.pubkey, s, machine.h, machine.ti),
+		// a_1 = b_i^u_1 h^u_2
+		A1: commit(machine.curve, b, machine.u1, machine.h, machine.u2),
+		// a_2 = y_i^u_1 h^u_3
+		A2: commit(machine.curve, machine.pubkey, machine.u1, machine.h, machine.u3),
+		// a_3 = g^u_4 h^u_3
+		A3: commit(machine.curve, machine.g, machine.u4, machine.h, machine.u3),
+	}
+
 	return
 }
 
-// SResponse generates the response r_(s_i) with the balance proof machine and si (s_i). The challenge must be set.
-func (machine *BalProofMachine) SResponse(si bool) (rs *big.Int, err error) {
+// response computes u + c*k mod the order. The challenge must be set.
+func (machine *BalProofMachine) response(u *big.Int, k *big.Int) (r *big.Int, err error) {
 	if machine.ci == nil {
 		err = fmt.Errorf("Cannot generate a response to a challenge if the challenge has not been set")
 		return
 	}
 
-	if si {
-		rs = new(big.Int).Add(machine.u1, machine.ci)
-	} else {
-		rs = new(big.Int).Set(machine.u1)
+	r = new(big.Int).Mul(machine.ci, k)
+	r.Add(r, u)
+	r.Mod(r, machine.curve.Params().N)
+	return
+}
+
+// SResponse generates the response r_(s_i) with the balance proof machine. The challenge must be set.
+func (machine *BalProofMachine) SResponse() (rs *big.Int, err error) {
+	s := big.NewInt(0)
+	if machine.si {
+		s.SetInt64(1)
 	}
+	rs, err = machine.response(machine.u1, s)
+	return
+}
+
+// VResponse generates the response r_(v_i) with the balance proof machine. The challenge must be set.
+func (machine *BalProofMachine) VResponse() (rv *big.Int, err error) {
+	rv, err = machine.response(machine.u2, machine.vi)
+	return
+}
+
+// TResponse generates the response r_(t_i) with the balance proof machine. The challenge must be set.
+func (machine *BalProofMachine) TResponse() (rt *big.Int, err error) {
+	rt, err = machine.response(machine.u3, machine.ti)
+	return
+}
+
+// XResponse generates the response r_(x_i) with the balance proof machine, where x_i is zero if we
+// don't own the key. The challenge must be set.
+func (machine *BalProofMachine) XResponse() (rx *big.Int, err error) {
+	xhat := big.NewInt(0)
+	if machine.si {
+		xhat.Set(machine.xi)
+	}
+	rx, err = machine.response(machine.u4, xhat)
+	return
+}
 
+// Respond fills in all of the responses in the balance proof. The challenge must be set.
+func (machine *BalProofMachine) Respond(proof *BalanceProof) (err error) {
+	if proof.RS, err = machine.SResponse(); err != nil {
+		err = fmt.Errorf("Error getting s response: %s", err)
+		return
+	}
+	if proof.RV, err = machine.VResponse(); err != nil {
+		err = fmt.Errorf("Error getting v response: %s", err)
+		return
+	}
+	if proof.RT, err = machine.TResponse(); err != nil {
+		err = fmt.Errorf("Error getting t response: %s", err)
+		return
+	}
+	if proof.RX, err = machine.XResponse(); err != nil {
+		err = fmt.Errorf("Error getting x response: %s", err)
+		return
+	}
 	return
 }
 
 // AssetsProofMachine is the state machine that is used to create a privacy preserving proof of assets
 type AssetsProofMachine struct {
-	curve elliptic.Curve
-	// This is the anonymity set PK in the paper, !(privkey == nil) => s_i = 0
+	curve *koblitz.KoblitzCurve
+	// This is the anonymity set PK in the paper, !(privkey == nil) => s_i = 1
 	// We don't use a privkey set because we are going to want to index by pubkey a lot
 	PubKeyAnonSet    map[*ecdsa.PublicKey]*ecdsa.PrivateKey
 	pkAnonSetMutex   *sync.Mutex
 	BalanceRetreiver func(pubkey *ecdsa.PublicKey) (balance uint64, err error)
+
+	// balances are the balances added with the anonymity set, by compressed pubkey
+	balances map[[33]byte]uint64
+
+	// These are set once we prove, so the exchange can open the asset commitment
+	totalAssets uint64
+	blinding    *big.Int
+	proof       *AssetsProof
 }
 
 // NewAssetsProofMachine creates a new state machine for the asset proof. TODO: Use the anonymity set choosing from
 // the paper to initialize
-func NewAssetsProofMachine(curve elliptic.Curve) (machine *AssetsProofMachine, err error) {
+func NewAssetsProofMachine(curve *koblitz.KoblitzCurve) (machine *AssetsProofMachine, err error) {
 
 	machine = &AssetsProofMachine{
-		curve:            curve,
-		PubKeyAnonSet:    make(map[*ecdsa.PublicKey]*ecdsa.PrivateKey),
-		pkAnonSetMutex:   new(sync.Mutex),
-		BalanceRetreiver: bal,
+		curve:          curve,
+		PubKeyAnonSet:  make(map[*ecdsa.PublicKey]*ecdsa.PrivateKey),
+		pkAnonSetMutex: new(sync.Mutex),
+		balances:       make(map[[33]byte]uint64),
 	}
+	machine.BalanceRetreiver = machine.bal
 
 	return
 }
 
-// bal is supposed to find the balance of a pubkey. I'm going to assume that all addresses have 10 bitcoin (1000000000)
-// in them for now. TODO: Make bal() work in a production environment
-func bal(pubkey *ecdsa.PublicKey) (bal uint64, err error) {
+// compressPubKey returns the compressed serialization of a pubkey, which is how we index pubkeys
+func compressPubKey(pubkey *ecdsa.PublicKey) (compressed [33]byte) {
+	copy(compressed[:], (*koblitz.PublicKey)(pubkey).SerializeCompressed())
+	return
+}
 
-	// all pubkeys have 10 btc -- we measure in satoshis
-	bal = 1000000000
+// bal finds the balance of a pubkey from the balances that were added with the anonymity set
+func (machine *AssetsProofMachine) bal(pubkey *ecdsa.PublicKey) (bal uint64, err error) {
+	var ok bool
+	if bal, ok = machine.balances[compressPubKey(pubkey)]; !ok {
+		err = fmt.Errorf("No balance known for pubkey %x", compressPubKey(pubkey))
+		return
+	}
+	return
+}
+
+// findPubKey finds the pubkey in the anonymity set with the same compressed serialization. This
+// assumes pkAnonSetMutex is held.
+func (machine *AssetsProofMachine) findPubKey(compressed [33]byte) (pubkey *ecdsa.PublicKey) {
+	for pub := range machine.PubKeyAnonSet {
+		if compressPubKey(pub) == compressed {
+			pubkey = pub
+			return
+		}
+	}
+	return
+}
 
+// AddAnonSet adds public keys and their balances to the anonymity set
+func (machine *AssetsProofMachine) AddAnonSet(anonSet []*AnonSetEntry) {
+	machine.pkAnonSetMutex.Lock()
+	for _, entry := range anonSet {
+		compressed := compressPubKey(entry.PubKey)
+		machine.balances[compressed] = entry.Balance
+		if machine.findPubKey(compressed) == nil {
+			machine.PubKeyAnonSet[entry.PubKey] = nil
+		}
+	}
+	machine.pkAnonSetMutex.Unlock()
+	return
+}
+
+// AddPrivKey marks a key in the anonymity set as owned by the exchange, adding it to the set if
+// it isn't in there already
+func (machine *AssetsProofMachine) AddPrivKey(privkey *ecdsa.PrivateKey) {
+	machine.pkAnonSetMutex.Lock()
+	pubkey := machine.findPubKey(compressPubKey(&privkey.PublicKey))
+	if pubkey == nil {
+		pubkey = &privkey.PublicKey
+	}
+	machine.PubKeyAnonSet[pubkey] = privkey
+	machine.pkAnonSetMutex.Unlock()
 	return
 }
 
@@ -134,6 +323,11 @@ func (machine *AssetsProofMachine) calculateAssets() (totalAssets uint64, err er
 				err = fmt.Errorf("Error getting balance of pubkey while calulating assets: %s", err)
 				return
 			}
+			if totalAssets+currBal < totalAssets {
+				machine.pkAnonSetMutex.Unlock()
+				err = fmt.Errorf("Total assets overflow while calculating assets")
+				return
+			}
 			totalAssets += currBal
 		}
 		// otherwise don't add anything
@@ -144,10 +338,113 @@ func (machine *AssetsProofMachine) calculateAssets() (totalAssets uint64, err er
 	return
 }
 
-// CalculateAssetCommitment calculates the commitment to the Z_Assets to Assets
-// Are we sure on returning an ECPoint?
+// Prove creates a non-interactive proof of assets over the anonymity set. The challenge is the hash
+// of every commitment, so the proof can be checked by anyone with just the anonymity set.
+func (machine *AssetsProofMachine) Prove() (proof *AssetsProof, err error) {
+
+	var totalAssets uint64
+	if totalAssets, err = machine.calculateAssets(); err != nil {
+		err = fmt.Errorf("Error calculating assets for Prove: %s", err)
+		return
+	}
+
+	machine.pkAnonSetMutex.Lock()
+	// sort the anonymity set so the proof doesn't depend on map order
+	var pubkeys []*ecdsa.PublicKey
+	for pub := range machine.PubKeyAnonSet {
+		pubkeys = append(pubkeys, pub)
+	}
+	sort.Slice(pubkeys, func(i, j int) bool {
+		iBytes, jBytes := compressPubKey(pubkeys[i]), compressPubKey(pubkeys[j])
+		return bytes.Compare(iBytes[:], jBytes[:]) < 0
+	})
+
+	proof = new(AssetsProof)
+	blinding := big.NewInt(0)
+	var balMachines []*BalProofMachine
+	for _, pub := range pubkeys {
+		var currBal uint64
+		if currBal, err = machine.BalanceRetreiver(pub); err != nil {
+			err = fmt.Errorf("Error getting balance of pubkey for Prove: %s", err)
+			machine.pkAnonSetMutex.Unlock()
+			return
+		}
+
+		var balMachine *BalProofMachine
+		if balMachine, err = NewBalProofMachine(machine.curve); err != nil {
+			err = fmt.Errorf("Error creating balance proof machine for Prove: %s", err)
+			machine.pkAnonSetMutex.Unlock()
+			return
+		}
+
+		if err = balMachine.SetBalance(pub, currBal); err != nil {
+			err = fmt.Errorf("Error setting balance for Prove: %s", err)
+			machine.pkAnonSetMutex.Unlock()
+			return
+		}
+
+		if priv := machine.PubKeyAnonSet[pub]; priv != nil {
+			if err = balMachine.SetPrivKey(priv); err != nil {
+				err = fmt.Errorf("Error setting private key for Prove: %s", err)
+				machine.pkAnonSetMutex.Unlock()
+				return
+			}
+		}
+
+		var balProof *BalanceProof
+		if balProof, err = balMachine.Commit(); err != nil {
+			err = fmt.Errorf("Error committing to balance for Prove: %s", err)
+			machine.pkAnonSetMutex.Unlock()
+			return
+		}
+
+		blinding.Add(blinding, balMachine.vi)
+		balMachines = append(balMachines, balMachine)
+		proof.Balances = append(proof.Balances, balProof)
+	}
+	machine.pkAnonSetMutex.Unlock()
+
+	challenge := proof.challenge(machine.curve)
+	for i, balMachine := range balMachines {
+		if err = balMachine.SetChallenge(challenge); err != nil {
+			err = fmt.Errorf("Error setting challenge for Prove: %s", err)
+			return
+		}
+
+		if err = balMachine.Respond(proof.Balances[i]); err != nil {
+			err = fmt.Errorf("Error responding to challenge for Prove: %s", err)
+			return
+		}
+	}
+
+	machine.totalAssets = totalAssets
+	machine.blinding = blinding.Mod(blinding, machine.curve.Params().N)
+	machine.proof = proof
+
+	return
+}
+
+// CalculateAssetCommitment calculates the commitment Z_Assets = g^Assets h^(sum of v_i) to Assets,
+// from the latest proof.
 func (machine *AssetsProofMachine) CalculateAssetCommitment() (assetCommitment *zksigma.ECPoint, err error) {
+	if machine.proof == nil {
+		err = fmt.Errorf("Cannot calculate asset commitment before proving")
+		return
+	}
+
+	assetCommitment = machine.proof.AssetCommitment(machine.curve)
+	return
+}
+
+// AssetOpening returns the total assets and blinding factor that open the asset commitment from the
+// latest proof. These should only be revealed if the exchange wants to publish its total assets.
+func (machine *AssetsProofMachine) AssetOpening() (totalAssets uint64, blinding *big.Int, err error) {
+	if machine.proof == nil {
+		err = fmt.Errorf("Cannot open asset commitment before proving")
+		return
+	}
 
-	// TODO
+	totalAssets = machine.totalAssets
+	blinding = new(big.Int).Set(machine.blinding)
 	return
 }
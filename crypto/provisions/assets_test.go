@@ -0,0 +1,266 @@
+package provisions
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/zksigma"
+)
+
+// testAnonSet creates an anonymity set of n keys with balances 1000 through n*1000, and returns the
+// private keys of the first owned keys
+func testAnonSet(t *testing.T, n int, owned int) (anonSet []*AnonSetEntry, privkeys []*ecdsa.PrivateKey, ownedAssets uint64) {
+	for i := 0; i < n; i++ {
+		privkey, err := koblitz.NewPrivateKey(koblitz.S256())
+		if err != nil {
+			t.Fatalf("Error creating private key: %s", err)
+		}
+		entry := &AnonSetEntry{
+			PubKey:  &privkey.ToECDSA().PublicKey,
+			Balance: uint64(i+1) * 1000,
+		}
+		anonSet = append(anonSet, entry)
+		if i < owned {
+			privkeys = append(privkeys, privkey.ToECDSA())
+			ownedAssets += entry.Balance
+		}
+	}
+	return
+}
+
+// proveAssets creates a proof over the anonymity set with the private keys
+func proveAssets(t *testing.T, anonSet []*AnonSetEntry, privkeys []*ecdsa.PrivateKey) (machine *AssetsProofMachine, proof *AssetsProof) {
+	var err error
+	if machine, err = NewAssetsProofMachine(koblitz.S256()); err != nil {
+		t.Fatalf("Error creating assets proof machine: %s", err)
+	}
+	machine.AddAnonSet(anonSet)
+	for _, privkey := range privkeys {
+		machine.AddPrivKey(privkey)
+	}
+	if proof, err = machine.Prove(); err != nil {
+		t.Fatalf("Error proving assets: %s", err)
+	}
+	return
+}
+
+func TestProveAndVerifyAssets(t *testing.T) {
+	var err error
+	curve := koblitz.S256()
+
+	for _, test := range []struct{ n, owned int }{{1, 0}, {1, 1}, {4, 2}, {8, 8}} {
+		anonSet, privkeys, ownedAssets := testAnonSet(t, test.n, test.owned)
+		machine, proof := proveAssets(t, anonSet, privkeys)
+
+		var assetCommitment *zksigma.ECPoint
+		if assetCommitment, err = VerifyAssetsProof(curve, anonSet, proof); err != nil {
+			t.Errorf("Error verifying proof with %d of %d keys owned: %s", test.owned, test.n, err)
+			return
+		}
+
+		var machineCommitment *zksigma.ECPoint
+		if machineCommitment, err = machine.CalculateAssetCommitment(); err != nil {
+			t.Errorf("Error calculating asset commitment: %s", err)
+			return
+		}
+		if !pointsEqual(*assetCommitment, *machineCommitment) {
+			t.Errorf("Verified asset commitment should be the same as the prover's")
+			return
+		}
+
+		var totalAssets uint64
+		var blinding *big.Int
+		if totalAssets, blinding, err = machine.AssetOpening(); err != nil {
+			t.Errorf("Error opening asset commitment: %s", err)
+			return
+		}
+		if totalAssets != ownedAssets {
+			t.Errorf("Total assets should be %d, got %d", ownedAssets, totalAssets)
+			return
+		}
+		if err = VerifyAssetOpening(curve, assetCommitment, totalAssets, blinding); err != nil {
+			t.Errorf("Error verifying asset opening: %s", err)
+			return
+		}
+		if err = VerifyAssetOpening(curve, assetCommitment, totalAssets+1, blinding); err == nil {
+			t.Errorf("Asset commitment should not open to more assets than owned")
+			return
+		}
+	}
+}
+
+func TestAssetsProofSerialization(t *testing.T) {
+	var err error
+	curve := koblitz.S256()
+
+	anonSet, privkeys, _ := testAnonSet(t, 5, 3)
+	_, proof := proveAssets(t, anonSet, privkeys)
+
+	proofBytes := proof.Serialize()
+	deserialized := new(AssetsProof)
+	if err = deserialized.Deserialize(curve, proofBytes); err != nil {
+		t.Errorf("Error deserializing proof: %s", err)
+		return
+	}
+	if !bytes.Equal(deserialized.Serialize(), proofBytes) {
+		t.Errorf("Deserialized proof should serialize to the same bytes")
+		return
+	}
+	if _, err = VerifyAssetsProof(curve, anonSet, deserialized); err != nil {
+		t.Errorf("Error verifying deserialized proof: %s", err)
+		return
+	}
+
+	if err = deserialized.Deserialize(curve, proofBytes[:len(proofBytes)-1]); err == nil {
+		t.Errorf("Deserializing a truncated proof should fail")
+		return
+	}
+}
+
+func TestAssetsProofRejectsTampering(t *testing.T) {
+	var err error
+	curve := koblitz.S256()
+
+	anonSet, privkeys, _ := testAnonSet(t, 4, 2)
+	_, proof := proveAssets(t, anonSet, privkeys)
+	proofBytes := proof.Serialize()
+
+	tampers := map[string]func(tampered *AssetsProof){
+		"balance":  func(tampered *AssetsProof) { tampered.Balances[0].Balance++ },
+		"response": func(tampered *AssetsProof) { tampered.Balances[1].RS.Add(tampered.Balances[1].RS, big.NewInt(1)) },
+		"commitment": func(tampered *AssetsProof) {
+			tampered.Balances[2].P = add(curve, tampered.Balances[2].P, generatorG(curve))
+		},
+		"missing key": func(tampered *AssetsProof) { tampered.Balances = tampered.Balances[1:] },
+	}
+	for name, tamper := range tampers {
+		tampered := new(AssetsProof)
+		if err = tampered.Deserialize(curve, proofBytes); err != nil {
+			t.Errorf("Error deserializing proof: %s", err)
+			return
+		}
+		tamper(tampered)
+		if _, err = VerifyAssetsProof(curve, anonSet, tampered); err == nil {
+			t.Errorf("Proof with tampered %s should not verify", name)
+			return
+		}
+	}
+
+	// The anonymity set the verifier sees from the chain should have to match too
+	anonSet[3] = &AnonSetEntry{PubKey: anonSet[3].PubKey, Balance: anonSet[3].Balance + 1}
+	if _, err = VerifyAssetsProof(curve, anonSet, proof); err == nil {
+		t.Errorf("Proof should not verify against a different anonymity set")
+		return
+	}
+}
+
+func TestAssetsProofNeedsPrivKey(t *testing.T) {
+	var err error
+	curve := koblitz.S256()
+
+	anonSet, _, _ := testAnonSet(t, 1, 0)
+	wrongKey, err := koblitz.NewPrivateKey(curve)
+	if err != nil {
+		t.Fatalf("Error creating private key: %s", err)
+	}
+
+	// Claim the balance with a private key that isn't for the pubkey
+	var balMachine *BalProofMachine
+	if balMachine, err = NewBalProofMachine(curve); err != nil {
+		t.Errorf("Error creating balance proof machine: %s", err)
+		return
+	}
+	if err = balMachine.SetBalance(anonSet[0].PubKey, anonSet[0].Balance); err != nil {
+		t.Errorf("Error setting balance: %s", err)
+		return
+	}
+	if err = balMachine.SetPrivKey(wrongKey.ToECDSA()); err != nil {
+		t.Errorf("Error setting private key: %s", err)
+		return
+	}
+
+	var balProof *BalanceProof
+	if balProof, err = balMachine.Commit(); err != nil {
+		t.Errorf("Error committing to balance: %s", err)
+		return
+	}
+	proof := &AssetsProof{Balances: []*BalanceProof{balProof}}
+	if err = balMachine.SetChallenge(proof.challenge(curve)); err != nil {
+		t.Errorf("Error setting challenge: %s", err)
+		return
+	}
+	if err = balMachine.Respond(balProof); err != nil {
+		t.Errorf("Error responding to challenge: %s", err)
+		return
+	}
+
+	if _, err = VerifyAssetsProof(curve, anonSet, proof); err == nil {
+		t.Errorf("Proof claiming a balance without the private key should not verify")
+		return
+	}
+}
+
+func TestReadAnonSet(t *testing.T) {
+	var err error
+	curve := koblitz.S256()
+
+	anonSet, privkeys, _ := testAnonSet(t, 3, 2)
+
+	var anonSetBuf bytes.Buffer
+	anonSetBuf.WriteString("# pubkey balance\n\n")
+	if err = WriteAnonSet(&anonSetBuf, anonSet); err != nil {
+		t.Errorf("Error writing anonymity set: %s", err)
+		return
+	}
+
+	var readSet []*AnonSetEntry
+	if readSet, err = ReadAnonSet(curve, &anonSetBuf); err != nil {
+		t.Errorf("Error reading anonymity set: %s", err)
+		return
+	}
+	if len(readSet) != len(anonSet) {
+		t.Errorf("Read anonymity set should have %d keys, got %d", len(anonSet), len(readSet))
+		return
+	}
+	for i, entry := range readSet {
+		if compressPubKey(entry.PubKey) != compressPubKey(anonSet[i].PubKey) || entry.Balance != anonSet[i].Balance {
+			t.Errorf("Read anonymity set entry %d does not match", i)
+			return
+		}
+	}
+
+	var privkeyBuf bytes.Buffer
+	for _, privkey := range privkeys {
+		fmt.Fprintf(&privkeyBuf, "%x\n", (*koblitz.PrivateKey)(privkey).Serialize())
+	}
+	var readKeys []*ecdsa.PrivateKey
+	if readKeys, err = ReadPrivKeys(curve, &privkeyBuf); err != nil {
+		t.Errorf("Error reading private keys: %s", err)
+		return
+	}
+
+	// A proof from keys read from files should verify
+	_, proof := proveAssets(t, readSet, readKeys)
+	if _, err = VerifyAssetsProof(curve, readSet, proof); err != nil {
+		t.Errorf("Error verifying proof from read keys: %s", err)
+		return
+	}
+
+	for _, badSet := range []string{"02abcd 100\n", "nothex 100\n", fmt.Sprintf("%x\n", compressPubKey(anonSet[0].PubKey)), fmt.Sprintf("%x -1\n", compressPubKey(anonSet[0].PubKey))} {
+		if _, err = ReadAnonSet(curve, strings.NewReader(badSet)); err == nil {
+			t.Errorf("Reading bad anonymity set %q should fail", badSet)
+			return
+		}
+	}
+
+	duplicate := fmt.Sprintf("%x 1\n%x 2\n", compressPubKey(anonSet[0].PubKey), compressPubKey(anonSet[0].PubKey))
+	if _, err = ReadAnonSet(curve, strings.NewReader(duplicate)); err == nil {
+		t.Errorf("Reading an anonymity set with a duplicate pubkey should fail")
+		return
+	}
+}
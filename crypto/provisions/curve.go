@@ -0,0 +1,158 @@
+package provisions
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/zksigma"
+)
+
+// hGeneratorSeed is hashed to find the second generator h. Nobody knows log_g(h) since h is found by
+// hashing to the curve.
+const hGeneratorSeed = "opencx provisions generator h"
+
+// pointLength is the length of a serialized point. The point at infinity is serialized as all zeros.
+const pointLength = 33
+
+// scalarLength is the length of a serialized scalar
+const scalarLength = 32
+
+// GeneratorH finds the second generator h for the curve, by hashing a seed with a counter until the
+// hash is the x coordinate of a point on the curve.
+func GeneratorH(curve *koblitz.KoblitzCurve) (h zksigma.ECPoint) {
+	params := curve.Params()
+	for counter := uint32(0); ; counter++ {
+		var counterBytes [4]byte
+		binary.BigEndian.PutUint32(counterBytes[:], counter)
+		hash := sha256.Sum256(append([]byte(hGeneratorSeed), counterBytes[:]...))
+
+		x := new(big.Int).SetBytes(hash[:])
+		if x.Cmp(params.P) >= 0 {
+			continue
+		}
+
+		// y^2 = x^3 + b
+		ySquared := new(big.Int).Exp(x, big.NewInt(3), params.P)
+		ySquared.Add(ySquared, params.B)
+		ySquared.Mod(ySquared, params.P)
+
+		y := new(big.Int).ModSqrt(ySquared, params.P)
+		if y == nil {
+			continue
+		}
+		// always pick the even y so h is the same everywhere
+		if y.Bit(0) == 1 {
+			y.Sub(params.P, y)
+		}
+
+		h = zksigma.ECPoint{X: x, Y: y}
+		return
+	}
+}
+
+// generatorG returns the base point g of the curve
+func generatorG(curve *koblitz.KoblitzCurve) (g zksigma.ECPoint) {
+	g = zksigma.ECPoint{X: curve.Params().Gx, Y: curve.Params().Gy}
+	return
+}
+
+// infinity returns the point at infinity, which we represent as (0, 0)
+func infinity() (point zksigma.ECPoint) {
+	point = zksigma.ECPoint{X: big.NewInt(0), Y: big.NewInt(0)}
+	return
+}
+
+// isInfinity returns whether or not the point is the point at infinity
+func isInfinity(point zksigma.ECPoint) (inf bool) {
+	inf = point.X.Sign() == 0 && point.Y.Sign() == 0
+	return
+}
+
+// pointsEqual returns whether or not two points are equal
+func pointsEqual(p1 zksigma.ECPoint, p2 zksigma.ECPoint) (equal bool) {
+	equal = p1.X.Cmp(p2.X) == 0 && p1.Y.Cmp(p2.Y) == 0
+	return
+}
+
+// mult multiplies a point by a scalar
+func mult(curve *koblitz.KoblitzCurve, point zksigma.ECPoint, k *big.Int) (res zksigma.ECPoint) {
+	k = new(big.Int).Mod(k, curve.Params().N)
+	if isInfinity(point) || k.Sign() == 0 {
+		res = infinity()
+		return
+	}
+	x, y := curve.ScalarMult(point.X, point.Y, k.Bytes())
+	res = zksigma.ECPoint{X: x, Y: y}
+	return
+}
+
+// add adds two points
+func add(curve *koblitz.KoblitzCurve, p1 zksigma.ECPoint, p2 zksigma.ECPoint) (res zksigma.ECPoint) {
+	if isInfinity(p1) {
+		res = p2
+		return
+	}
+	if isInfinity(p2) {
+		res = p1
+		return
+	}
+	x, y := curve.Add(p1.X, p1.Y, p2.X, p2.Y)
+	res = zksigma.ECPoint{X: x, Y: y}
+	return
+}
+
+// commit computes a^x h^y, or x*a + y*h since we write the group additively
+func commit(curve *koblitz.KoblitzCurve, a zksigma.ECPoint, x *big.Int, h zksigma.ECPoint, y *big.Int) (res zksigma.ECPoint) {
+	res = add(curve, mult(curve, a, x), mult(curve, h, y))
+	return
+}
+
+// serializePoint serializes a point in compressed form
+func serializePoint(curve *koblitz.KoblitzCurve, point zksigma.ECPoint) (pointBytes []byte) {
+	if isInfinity(point) {
+		pointBytes = make([]byte, pointLength)
+		return
+	}
+	pubkey := &koblitz.PublicKey{Curve: curve, X: point.X, Y: point.Y}
+	pointBytes = pubkey.SerializeCompressed()
+	return
+}
+
+// deserializePoint parses a compressed point, making sure it's on the curve
+func deserializePoint(curve *koblitz.KoblitzCurve, pointBytes []byte) (point zksigma.ECPoint, err error) {
+	if len(pointBytes) != pointLength {
+		err = fmt.Errorf("Point must be %d bytes, got %d", pointLength, len(pointBytes))
+		return
+	}
+
+	allZero := true
+	for _, b := range pointBytes {
+		if b != 0 {
+			allZero = false
+			break
+		}
+	}
+	if allZero {
+		point = infinity()
+		return
+	}
+
+	var pubkey *koblitz.PublicKey
+	if pubkey, err = koblitz.ParsePubKey(pointBytes, curve); err != nil {
+		err = fmt.Errorf("Error parsing point: %s", err)
+		return
+	}
+	point = zksigma.ECPoint{X: pubkey.X, Y: pubkey.Y}
+	return
+}
+
+// serializeScalar serializes a scalar as a fixed length big endian number
+func serializeScalar(k *big.Int) (scalarBytes []byte) {
+	scalarBytes = make([]byte, scalarLength)
+	kBytes := k.Bytes()
+	copy(scalarBytes[scalarLength-len(kBytes):], kBytes)
+	return
+}
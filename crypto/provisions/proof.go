@@ -0,0 +1,206 @@
+package provisions
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/zksigma"
+)
+
+// challengeSeed is the domain separator for the challenge hash
+const challengeSeed = "opencx provisions challenge"
+
+// balanceProofLength is the length of a serialized balance proof: the pubkey, the balance, five
+// points, and four scalars
+const balanceProofLength = 6*pointLength + 8 + 4*scalarLength
+
+// BalanceProof is the proof for a single key in the anonymity set. It proves that P commits to
+// either the balance of the key or zero, and that the exchange knows the private key if it's the
+// balance, without saying which.
+type BalanceProof struct {
+	// PubKey and Balance are y_i and bal(y_i) in the paper
+	PubKey  zksigma.ECPoint
+	Balance uint64
+	// P and L are the commitments p_i and l_i
+	P zksigma.ECPoint
+	L zksigma.ECPoint
+	// A1, A2, and A3 are the first message of the sigma protocol
+	A1 zksigma.ECPoint
+	A2 zksigma.ECPoint
+	A3 zksigma.ECPoint
+	// RS, RV, RT, and RX are the responses to the challenge
+	RS *big.Int
+	RV *big.Int
+	RT *big.Int
+	RX *big.Int
+}
+
+// AssetsProof is a non-interactive proof of assets over an anonymity set
+type AssetsProof struct {
+	Balances []*BalanceProof
+}
+
+// challenge computes the challenge by hashing the generators and every commitment in the proof
+func (proof *AssetsProof) challenge(curve *koblitz.KoblitzCurve) (c *big.Int) {
+	hasher := sha256.New()
+	hasher.Write([]byte(challengeSeed))
+	hasher.Write(serializePoint(curve, generatorG(curve)))
+	hasher.Write(serializePoint(curve, GeneratorH(curve)))
+	for _, balProof := range proof.Balances {
+		hasher.Write(serializePoint(curve, balProof.PubKey))
+		var balanceBytes [8]byte
+		binary.BigEndian.PutUint64(balanceBytes[:], balProof.Balance)
+		hasher.Write(balanceBytes[:])
+		hasher.Write(serializePoint(curve, balProof.P))
+		hasher.Write(serializePoint(curve, balProof.L))
+		hasher.Write(serializePoint(curve, balProof.A1))
+		hasher.Write(serializePoint(curve, balProof.A2))
+		hasher.Write(serializePoint(curve, balProof.A3))
+	}
+	c = new(big.Int).SetBytes(hasher.Sum(nil))
+	c.Mod(c, curve.Params().N)
+	return
+}
+
+// AssetCommitment computes Z_Assets, the sum of every p_i in the proof
+func (proof *AssetsProof) AssetCommitment(curve *koblitz.KoblitzCurve) (assetCommitment *zksigma.ECPoint) {
+	sum := infinity()
+	for _, balProof := range proof.Balances {
+		sum = add(curve, sum, balProof.P)
+	}
+	assetCommitment = &sum
+	return
+}
+
+// Serialize serializes the proof
+func (proof *AssetsProof) Serialize() (buf []byte) {
+	curve := koblitz.S256()
+	var countBytes [4]byte
+	binary.BigEndian.PutUint32(countBytes[:], uint32(len(proof.Balances)))
+	buf = append(buf, countBytes[:]...)
+	for _, balProof := range proof.Balances {
+		buf = append(buf, serializePoint(curve, balProof.PubKey)...)
+		var balanceBytes [8]byte
+		binary.BigEndian.PutUint64(balanceBytes[:], balProof.Balance)
+		buf = append(buf, balanceBytes[:]...)
+		for _, point := range []zksigma.ECPoint{balProof.P, balProof.L, balProof.A1, balProof.A2, balProof.A3} {
+			buf = append(buf, serializePoint(curve, point)...)
+		}
+		for _, scalar := range []*big.Int{balProof.RS, balProof.RV, balProof.RT, balProof.RX} {
+			buf = append(buf, serializeScalar(scalar)...)
+		}
+	}
+	return
+}
+
+// Deserialize deserializes a proof, checking that every point is on the curve
+func (proof *AssetsProof) Deserialize(curve *koblitz.KoblitzCurve, buf []byte) (err error) {
+	if len(buf) < 4 {
+		err = fmt.Errorf("Proof too short to deserialize")
+		return
+	}
+	count := binary.BigEndian.Uint32(buf[:4])
+	buf = buf[4:]
+	if uint64(len(buf)) != uint64(count)*balanceProofLength {
+		err = fmt.Errorf("Proof with %d balances should be %d bytes, got %d", count, uint64(count)*balanceProofLength+4, len(buf)+4)
+		return
+	}
+
+	proof.Balances = make([]*BalanceProof, count)
+	for i := range proof.Balances {
+		balProof := new(BalanceProof)
+		if balProof.PubKey, err = deserializePoint(curve, buf[:pointLength]); err != nil {
+			err = fmt.Errorf("Error deserializing pubkey %d: %s", i, err)
+			return
+		}
+		buf = buf[pointLength:]
+		balProof.Balance = binary.BigEndian.Uint64(buf[:8])
+		buf = buf[8:]
+		for _, point := range []*zksigma.ECPoint{&balProof.P, &balProof.L, &balProof.A1, &balProof.A2, &balProof.A3} {
+			if *point, err = deserializePoint(curve, buf[:pointLength]); err != nil {
+				err = fmt.Errorf("Error deserializing commitment for pubkey %d: %s", i, err)
+				return
+			}
+			buf = buf[pointLength:]
+		}
+		for _, scalar := range []**big.Int{&balProof.RS, &balProof.RV, &balProof.RT, &balProof.RX} {
+			*scalar = new(big.Int).SetBytes(buf[:scalarLength])
+			if (*scalar).Cmp(curve.Params().N) >= 0 {
+				err = fmt.Errorf("Response for pubkey %d is not less than the curve order", i)
+				return
+			}
+			buf = buf[scalarLength:]
+		}
+		proof.Balances[i] = balProof
+	}
+	return
+}
+
+// VerifyAssetsProof verifies a proof of assets against the anonymity set, which the verifier should
+// get from the chain. The proof has to cover exactly the anonymity set, in order of compressed
+// pubkey. If the proof is valid, the asset commitment is returned.
+func VerifyAssetsProof(curve *koblitz.KoblitzCurve, anonSet []*AnonSetEntry, proof *AssetsProof) (assetCommitment *zksigma.ECPoint, err error) {
+	sortedSet := SortAnonSet(anonSet)
+	if len(sortedSet) != len(proof.Balances) {
+		err = fmt.Errorf("Proof has %d balances but the anonymity set has %d keys", len(proof.Balances), len(sortedSet))
+		return
+	}
+
+	g := generatorG(curve)
+	h := GeneratorH(curve)
+	c := proof.challenge(curve)
+	for i, balProof := range proof.Balances {
+		entry := sortedSet[i]
+		expectedPubKey := compressPubKey(entry.PubKey)
+		if !bytes.Equal(serializePoint(curve, balProof.PubKey), expectedPubKey[:]) {
+			err = fmt.Errorf("Balance %d in proof is for pubkey %x, expected %x", i, serializePoint(curve, balProof.PubKey), expectedPubKey)
+			return
+		}
+		if balProof.Balance != entry.Balance {
+			err = fmt.Errorf("Balance %d in proof is %d, but pubkey %x has %d", i, balProof.Balance, expectedPubKey, entry.Balance)
+			return
+		}
+		if balProof.RS == nil || balProof.RV == nil || balProof.RT == nil || balProof.RX == nil {
+			err = fmt.Errorf("Balance %d in proof is missing responses", i)
+			return
+		}
+
+		b := mult(curve, g, new(big.Int).SetUint64(balProof.Balance))
+
+		// b_i^r_s h^r_v == p_i^c a_1
+		if !pointsEqual(commit(curve, b, balProof.RS, h, balProof.RV), add(curve, mult(curve, balProof.P, c), balProof.A1)) {
+			err = fmt.Errorf("Balance commitment check failed for pubkey %x", expectedPubKey)
+			return
+		}
+
+		// y_i^r_s h^r_t == l_i^c a_2
+		if !pointsEqual(commit(curve, balProof.PubKey, balProof.RS, h, balProof.RT), add(curve, mult(curve, balProof.L, c), balProof.A2)) {
+			err = fmt.Errorf("Key commitment check failed for pubkey %x", expectedPubKey)
+			return
+		}
+
+		// g^r_x h^r_t == l_i^c a_3
+		if !pointsEqual(commit(curve, g, balProof.RX, h, balProof.RT), add(curve, mult(curve, balProof.L, c), balProof.A3)) {
+			err = fmt.Errorf("Private key knowledge check failed for pubkey %x", expectedPubKey)
+			return
+		}
+	}
+
+	assetCommitment = proof.AssetCommitment(curve)
+	return
+}
+
+// VerifyAssetOpening checks that the asset commitment opens to the total assets with the blinding
+// factor
+func VerifyAssetOpening(curve *koblitz.KoblitzCurve, assetCommitment *zksigma.ECPoint, totalAssets uint64, blinding *big.Int) (err error) {
+	expected := commit(curve, generatorG(curve), new(big.Int).SetUint64(totalAssets), GeneratorH(curve), blinding)
+	if !pointsEqual(*assetCommitment, expected) {
+		err = fmt.Errorf("Asset commitment does not open to %d", totalAssets)
+		return
+	}
+	return
+}
@@ -0,0 +1,96 @@
+package cxauctionrpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+	"golang.org/x/crypto/sha3"
+)
+
+// AdminMethods returns the names of the RPC methods that only the admin can call
+func (cl *OpencxAuctionRPC) AdminMethods() (methods []string) {
+	methods = []string{"Snapshot"}
+	return
+}
+
+// appendAdminNonce appends the nonce of an admin command to what gets signed for it
+func appendAdminNonce(buf []byte, nonce uint64) (newBuf []byte) {
+	var nonceBytes [8]byte
+	binary.BigEndian.PutUint64(nonceBytes[:], nonce)
+	newBuf = append(buf, nonceBytes[:]...)
+	return
+}
+
+// verifyAdminSignature recovers the pubkey that signed e and makes sure it is the admin pubkey, then
+// makes sure the nonce signed with the command hasn't been used, so the command can't be replayed
+func (cl *OpencxAuctionRPC) verifyAdminSignature(sig []byte, e []byte, nonce uint64) (err error) {
+	var pubkey *koblitz.PublicKey
+	if pubkey, _, err = koblitz.RecoverCompact(koblitz.S256(), sig, e); err != nil {
+		err = fmt.Errorf("Error, invalid signature for admin command: %s", err)
+		return
+	}
+
+	if !cl.Server.IsAdmin(pubkey) {
+		err = fmt.Errorf("Error, pubkey %x is not allowed to call admin commands", pubkey.SerializeCompressed())
+		return
+	}
+
+	if err = cl.Server.UseAdminNonce(nonce); err != nil {
+		err = fmt.Errorf("Error using nonce for admin command: %s", err)
+		return
+	}
+	return
+}
+
+// SnapshotArgs holds the args for Snapshot
+type SnapshotArgs struct {
+	// Nonce has to be more than the nonce of every admin command before it
+	Nonce     uint64
+	Signature []byte
+}
+
+// Serialize returns what gets signed for Snapshot. The only argument is the nonce, so it's a fixed
+// string and the nonce. The string is different from the one opencxd signs, so a signed snapshot
+// command for one server can't be sent to the other.
+func (sa *SnapshotArgs) Serialize() (buf []byte) {
+	buf = appendAdminNonce([]byte("opencx-auctionsnapshot"), sa.Nonce)
+	return
+}
+
+// SnapshotReply holds the reply for Snapshot
+type SnapshotReply struct {
+	Archive []byte
+}
+
+// Snapshot is the RPC Interface for Snapshot. The reply is a snapshot archive of the auction
+// server that cxbackup can restore from. This is an admin command.
+func (cl *OpencxAuctionRPC) Snapshot(args SnapshotArgs, reply *SnapshotReply) (err error) {
+
+	// e = h("opencx-auctionsnapshot" + nonce)
+	sha3 := sha3.New256()
+	sha3.Write(args.Serialize())
+	e := sha3.Sum(nil)
+
+	if err = cl.verifyAdminSignature(args.Signature, e, args.Nonce); err != nil {
+		err = fmt.Errorf("Error verifying signature for Snapshot RPC command: %s", err)
+		return
+	}
+
+	var snap *cxdbsnapshot.Snapshot
+	if snap, err = cl.Server.TakeSnapshot(); err != nil {
+		err = fmt.Errorf("Error taking snapshot for Snapshot RPC command: %s", err)
+		return
+	}
+
+	var archiveBuf bytes.Buffer
+	if err = cxdbsnapshot.WriteArchive(&archiveBuf, snap); err != nil {
+		err = fmt.Errorf("Error writing archive for Snapshot RPC command: %s", err)
+		return
+	}
+	reply.Archive = archiveBuf.Bytes()
+
+	return
+}
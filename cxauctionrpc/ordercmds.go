@@ -3,8 +3,10 @@ package cxauctionrpc
 import (
 	"fmt"
 
+	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/opencx/logging"
 	"github.com/mit-dci/opencx/match"
+	"golang.org/x/crypto/sha3"
 )
 
 // SubmitPuzzledOrderArgs holds the args for the submitpuzzledorder command
@@ -36,3 +38,119 @@ func (cl *OpencxAuctionRPC) SubmitPuzzledOrder(args SubmitPuzzledOrderArgs, repl
 
 	return
 }
+
+// GetOrderArgs holds the args for the GetOrder command. If IncludeHistory is set, orders that were
+// filled, cancelled, or rejected are looked up in the order archive.
+type GetOrderArgs struct {
+	OrderID        string
+	Signature      []byte
+	IncludeHistory bool
+}
+
+// GetOrderReply holds the reply for the GetOrder command. Order is set if the order is still in
+// the orderbook, and Archived is set if it was filled, cancelled, or rejected.
+type GetOrderReply struct {
+	Order    *match.AuctionOrderIDPair
+	Archived *match.ArchivedAuctionOrder
+}
+
+// GetOrder gets an order based on orderID
+func (cl *OpencxAuctionRPC) GetOrder(args GetOrderArgs, reply *GetOrderReply) (err error) {
+	// hash order id.
+	sha3 := sha3.New256()
+	sha3.Write([]byte(args.OrderID))
+	e := sha3.Sum(nil)
+
+	var sigPubKey *koblitz.PublicKey
+	if sigPubKey, _, err = koblitz.RecoverCompact(koblitz.S256(), args.Signature, e); err != nil {
+		err = fmt.Errorf("Error verifying getorder, invalid signature: \n%s", err)
+		return
+	}
+
+	var unmarshalledOrderID *match.OrderID = new(match.OrderID)
+	if err = unmarshalledOrderID.UnmarshalText([]byte(args.OrderID)); err != nil {
+		err = fmt.Errorf("Could not unmarshal order ID for GetOrder command: %s", err)
+		return
+	}
+
+	var order *match.AuctionOrder
+	if reply.Order, err = cl.Server.GetOrder(unmarshalledOrderID); err == nil {
+		order = reply.Order.Order
+	} else if !args.IncludeHistory {
+		err = fmt.Errorf("Error getting order from server for GetOrder RPC command: %s", err)
+		return
+	} else {
+		reply.Order = nil
+		if reply.Archived, err = cl.Server.GetArchivedOrder(unmarshalledOrderID); err != nil {
+			err = fmt.Errorf("Error getting order from server or archive for GetOrder RPC command: %s", err)
+			return
+		}
+		order = reply.Archived.Order.Order
+	}
+
+	// try to parse the order pubkey into koblitz
+	var orderPubKey *koblitz.PublicKey
+	if orderPubKey, err = koblitz.ParsePubKey(order.Pubkey[:], koblitz.S256()); err != nil {
+		err = fmt.Errorf("Public Key failed parsing check for GetOrder RPC command: %s", err)
+		return
+	}
+
+	if !sigPubKey.IsEqual(orderPubKey) {
+		reply.Order = nil
+		reply.Archived = nil
+		err = fmt.Errorf("Pubkey used with signature not equal to the one passed")
+		return
+	}
+
+	return
+}
+
+// GetOrdersForPubkeyArgs holds the args for the GetOrdersForPubkey command. If IncludeHistory is
+// set, the orders that were filled, cancelled, or rejected are returned too.
+type GetOrdersForPubkeyArgs struct {
+	Signature      []byte
+	IncludeHistory bool
+}
+
+// GetOrdersForPubkeyReply holds the reply for the GetOrdersForPubkey command. Archived is the
+// orders that were filled, cancelled, or rejected, in the order they were closed.
+type GetOrdersForPubkeyReply struct {
+	Orders   []*match.AuctionOrderIDPair
+	Archived []*match.ArchivedAuctionOrder
+}
+
+// GetOrdersForPubkey gets the orders for the pubkey which has signed the getOrdersString
+func (cl *OpencxAuctionRPC) GetOrdersForPubkey(args GetOrdersForPubkeyArgs, reply *GetOrdersForPubkeyReply) (err error) {
+	var pubkey *koblitz.PublicKey
+	if pubkey, err = cl.Server.GetOrdersStringVerify(args.Signature); err != nil {
+		return
+	}
+
+	if reply.Orders, err = cl.Server.GetOrdersForPubkey(pubkey); err != nil {
+		return
+	}
+
+	if args.IncludeHistory {
+		if reply.Archived, err = cl.Server.GetArchivedOrdersForPubkey(pubkey); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// GetOrdersStringArgs holds the args for the GetOrdersString command
+type GetOrdersStringArgs struct {
+	// empty
+}
+
+// GetOrdersStringReply holds the reply for the GetOrdersString command
+type GetOrdersStringReply struct {
+	GetOrdersString string
+}
+
+// GetOrdersString returns the string that a client signs to get their orders
+func (cl *OpencxAuctionRPC) GetOrdersString(args GetOrdersStringArgs, reply *GetOrdersStringReply) (err error) {
+	reply.GetOrdersString = cl.Server.GetOrdersString()
+	return
+}
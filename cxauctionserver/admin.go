@@ -0,0 +1,100 @@
+package cxauctionserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+)
+
+// adminNonceFileName is the file in the root directory that keeps the nonce of the last admin
+// command
+const adminNonceFileName = "adminnonce"
+
+// SetRootDir sets the directory the nonce of the last admin command is kept in
+func (s *OpencxAuctionServer) SetRootDir(rootDir string) {
+	s.adminMtx.Lock()
+	s.RootDir = rootDir
+	s.adminMtx.Unlock()
+	return
+}
+
+// SetAdminPubkey sets the pubkey that is allowed to call admin commands, like taking a snapshot
+func (s *OpencxAuctionServer) SetAdminPubkey(pubkey *koblitz.PublicKey) {
+	s.adminMtx.Lock()
+	s.adminPubkey = pubkey
+	s.adminMtx.Unlock()
+	return
+}
+
+// IsAdmin returns true if the pubkey is allowed to call admin commands. If no admin pubkey is set,
+// nobody is.
+func (s *OpencxAuctionServer) IsAdmin(pubkey *koblitz.PublicKey) (isAdmin bool) {
+	s.adminMtx.Lock()
+	isAdmin = s.adminPubkey != nil && s.adminPubkey.IsEqual(pubkey)
+	s.adminMtx.Unlock()
+	return
+}
+
+// UseAdminNonce makes sure the nonce signed with an admin command is more than the nonce of every
+// admin command before it, so a signed command can't be replayed, then saves it as the last nonce.
+// This should be called before the command is run, so a command whose nonce couldn't be saved
+// isn't run.
+func (s *OpencxAuctionServer) UseAdminNonce(nonce uint64) (err error) {
+	s.adminMtx.Lock()
+	defer s.adminMtx.Unlock()
+
+	if nonce <= s.adminNonce {
+		err = fmt.Errorf("Admin command nonce %d must be more than the last nonce %d", nonce, s.adminNonce)
+		return
+	}
+
+	if s.RootDir != "" {
+		// write the new nonce next to the old one and then replace it, so a crash can't leave
+		// the file without a nonce
+		tempFileName := filepath.Join(s.RootDir, adminNonceFileName+".tmp")
+		if err = ioutil.WriteFile(tempFileName, []byte(strconv.FormatUint(nonce, 10)), 0600); err != nil {
+			err = fmt.Errorf("Error writing admin nonce file for UseAdminNonce: %s", err)
+			return
+		}
+		if err = os.Rename(tempFileName, filepath.Join(s.RootDir, adminNonceFileName)); err != nil {
+			err = fmt.Errorf("Error replacing admin nonce file for UseAdminNonce: %s", err)
+			return
+		}
+	}
+
+	s.adminNonce = nonce
+	return
+}
+
+// LoadAdminNonce loads the nonce of the last admin command from the root directory, so admin
+// commands from before a restart can't be replayed.
+func (s *OpencxAuctionServer) LoadAdminNonce() (err error) {
+	s.adminMtx.Lock()
+	defer s.adminMtx.Unlock()
+
+	if s.RootDir == "" {
+		return
+	}
+
+	var nonceBytes []byte
+	if nonceBytes, err = ioutil.ReadFile(filepath.Join(s.RootDir, adminNonceFileName)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	var nonce uint64
+	if nonce, err = strconv.ParseUint(strings.TrimSpace(string(nonceBytes)), 10, 64); err != nil {
+		err = fmt.Errorf("Error parsing admin nonce file for LoadAdminNonce: %s", err)
+		return
+	}
+
+	s.adminNonce = nonce
+	return
+}
@@ -0,0 +1,56 @@
+package cxauctionserver
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUseAdminNonce(t *testing.T) {
+	var err error
+
+	var rootDir string
+	if rootDir, err = ioutil.TempDir("", "auctionadmin"); err != nil {
+		t.Errorf("Error creating temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(rootDir)
+
+	var s *OpencxAuctionServer
+	if s, err = initTestServer(); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+	s.SetRootDir(rootDir)
+
+	if err = s.UseAdminNonce(5); err != nil {
+		t.Errorf("Error using first admin nonce: %s", err)
+		return
+	}
+	if err = s.UseAdminNonce(5); err == nil {
+		t.Errorf("Using the same admin nonce twice should fail")
+		return
+	}
+
+	// The nonce is still used after a restart
+	var restarted *OpencxAuctionServer
+	if restarted, err = initTestServer(); err != nil {
+		t.Errorf("Error initializing restarted server: %s", err)
+		return
+	}
+	restarted.SetRootDir(rootDir)
+	if err = restarted.LoadAdminNonce(); err != nil {
+		t.Errorf("Error loading admin nonce: %s", err)
+		return
+	}
+	if err = restarted.UseAdminNonce(5); err == nil {
+		t.Errorf("Using an admin nonce from before a restart should fail")
+		return
+	}
+	if err = restarted.UseAdminNonce(6); err != nil {
+		t.Errorf("Error using admin nonce after restart: %s", err)
+		return
+	}
+
+	return
+}
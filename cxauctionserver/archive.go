@@ -0,0 +1,156 @@
+package cxauctionserver
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/logging"
+	"github.com/mit-dci/opencx/match"
+	"golang.org/x/crypto/sha3"
+)
+
+// archiveRejected archives the orders in a batch that were rejected, so the users who sent them
+// can see what happened to them. Results that don't have an order, or are for a pair we don't have
+// an orderbook for, can't be archived and are skipped. This assumes the db lock is held.
+func (s *OpencxAuctionServer) archiveRejected(rejected []*match.OrderPuzzleResult) (err error) {
+	for _, result := range rejected {
+		if result == nil || result.Auction == nil {
+			continue
+		}
+
+		var book match.AuctionOrderbook
+		var ok bool
+		if book, ok = s.Orderbooks[result.Auction.TradingPair]; !ok {
+			logging.Warnf("Could not find orderbook for pair %s to archive rejected order", result.Auction.TradingPair.String())
+			continue
+		}
+
+		// The order ID is the same hash the auction engines use for orders they place
+		sha := sha3.New256()
+		sha.Write(result.Auction.SerializeSignable())
+		rejectedPair := &match.AuctionOrderIDPair{
+			Order: result.Auction,
+		}
+		copy(rejectedPair.OrderID[:], sha.Sum(nil))
+		// The price is only used for the archive, and the order may have been rejected for its price
+		rejectedPair.Price, _ = result.Auction.Price()
+
+		if err = book.UpdateBookReject(rejectedPair); err != nil {
+			err = fmt.Errorf("Error archiving rejected order %x: %s", rejectedPair.OrderID[:], err)
+			return
+		}
+	}
+	return
+}
+
+// GetOrder gets an order that is still in the orderbook of whichever pair has it
+func (s *OpencxAuctionServer) GetOrder(orderID *match.OrderID) (order *match.AuctionOrderIDPair, err error) {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+
+	// The orderbooks error when they don't have an order, so we check every one of them before
+	// giving up
+	for _, book := range s.Orderbooks {
+		if order, err = book.GetOrder(orderID); err == nil && order != nil {
+			return
+		}
+	}
+
+	order = nil
+	err = fmt.Errorf("Could not find order with that order ID")
+	return
+}
+
+// GetOrdersForPubkey gets the orders for a pubkey that are still in the orderbooks
+func (s *OpencxAuctionServer) GetOrdersForPubkey(pubkey *koblitz.PublicKey) (orders []*match.AuctionOrderIDPair, err error) {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+
+	for pair, book := range s.Orderbooks {
+		var bookOrders map[float64][]*match.AuctionOrderIDPair
+		if bookOrders, err = book.GetOrdersForPubkey(pubkey); err != nil {
+			err = fmt.Errorf("Error getting orders for %s for GetOrdersForPubkey: %s", pair.String(), err)
+			return
+		}
+		for _, priceOrders := range bookOrders {
+			orders = append(orders, priceOrders...)
+		}
+	}
+	return
+}
+
+// GetArchivedOrder gets an order that was filled, cancelled, or rejected from the archive of
+// whichever orderbook has it
+func (s *OpencxAuctionServer) GetArchivedOrder(orderID *match.OrderID) (archived *match.ArchivedAuctionOrder, err error) {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+
+	for _, book := range s.Orderbooks {
+		if archived, err = book.GetArchivedOrder(orderID); err == nil && archived != nil {
+			return
+		}
+	}
+
+	archived = nil
+	err = fmt.Errorf("Could not find archived order with that order ID")
+	return
+}
+
+// GetArchivedOrdersForPubkey gets the orders for a pubkey that were filled, cancelled, or
+// rejected, in the order they were closed.
+func (s *OpencxAuctionServer) GetArchivedOrdersForPubkey(pubkey *koblitz.PublicKey) (archived []*match.ArchivedAuctionOrder, err error) {
+	s.dbLock.Lock()
+	for pair, book := range s.Orderbooks {
+		var bookArchived []*match.ArchivedAuctionOrder
+		if bookArchived, err = book.GetArchivedOrdersForPubkey(pubkey); err != nil {
+			err = fmt.Errorf("Error getting archived orders for %s for GetArchivedOrdersForPubkey: %s", pair.String(), err)
+			s.dbLock.Unlock()
+			return
+		}
+		archived = append(archived, bookArchived...)
+	}
+	s.dbLock.Unlock()
+
+	sort.SliceStable(archived, func(i, j int) bool {
+		return archived[i].ClosedAt.Before(archived[j].ClosedAt)
+	})
+	return
+}
+
+// PruneOrderArchive deletes the archived orders in every orderbook that were closed before the
+// cutoff, and returns how many were deleted.
+func (s *OpencxAuctionServer) PruneOrderArchive(before time.Time) (pruned uint64, err error) {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+
+	for pair, book := range s.Orderbooks {
+		var bookPruned uint64
+		if bookPruned, err = book.PruneArchive(before); err != nil {
+			err = fmt.Errorf("Error pruning archive for %s for PruneOrderArchive: %s", pair.String(), err)
+			return
+		}
+		pruned += bookPruned
+	}
+	return
+}
+
+// StartArchivePruning prunes the orders that were closed more than retention ago from the archive
+// once every interval, until the server goes away.
+func (s *OpencxAuctionServer) StartArchivePruning(retention time.Duration, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			pruned, err := s.PruneOrderArchive(time.Now().Add(-retention))
+			if err != nil {
+				logging.Errorf("Error pruning order archive: %s", err)
+				continue
+			}
+			if pruned > 0 {
+				logging.Infof("Pruned %d orders from the order archive", pruned)
+			}
+		}
+	}()
+	return
+}
@@ -0,0 +1,83 @@
+package cxauctionserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/match"
+)
+
+func TestArchivedOrders(t *testing.T) {
+	var err error
+
+	var s *OpencxAuctionServer
+	if s, err = initTestServer(); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+
+	var pubkey *koblitz.PublicKey
+	if pubkey, err = koblitz.ParsePubKey(testAuctionOrder.Pubkey[:], koblitz.S256()); err != nil {
+		t.Errorf("Error parsing test order pubkey: %s", err)
+		return
+	}
+
+	placed := &match.AuctionOrderIDPair{
+		OrderID: match.OrderID{0x01},
+		Order:   testAuctionOrder,
+	}
+	book := s.Orderbooks[testAuctionOrder.TradingPair]
+	if err = book.UpdateBookPlace(placed); err != nil {
+		t.Errorf("Error placing order: %s", err)
+		return
+	}
+
+	var order *match.AuctionOrderIDPair
+	if order, err = s.GetOrder(&placed.OrderID); err != nil || order.OrderID != placed.OrderID {
+		t.Errorf("Expected to get the placed order, got error %v", err)
+		return
+	}
+	var orders []*match.AuctionOrderIDPair
+	if orders, err = s.GetOrdersForPubkey(pubkey); err != nil || len(orders) != 1 {
+		t.Errorf("Expected 1 order for the pubkey, got %d with error %v", len(orders), err)
+		return
+	}
+
+	if err = book.UpdateBookCancel(&match.CancelledOrder{OrderID: &placed.OrderID}); err != nil {
+		t.Errorf("Error cancelling order: %s", err)
+		return
+	}
+
+	if _, err = s.GetOrder(&placed.OrderID); err == nil {
+		t.Errorf("A cancelled order should not be in the orderbook")
+		return
+	}
+	var archived *match.ArchivedAuctionOrder
+	if archived, err = s.GetArchivedOrder(&placed.OrderID); err != nil || archived.Order.OrderID != placed.OrderID {
+		t.Errorf("Expected to get the cancelled order from the archive, got error %v", err)
+		return
+	}
+	var archivedOrders []*match.ArchivedAuctionOrder
+	if archivedOrders, err = s.GetArchivedOrdersForPubkey(pubkey); err != nil || len(archivedOrders) != 1 {
+		t.Errorf("Expected 1 archived order for the pubkey, got %d with error %v", len(archivedOrders), err)
+		return
+	}
+
+	// Orders closed after the cutoff are kept
+	var pruned uint64
+	if pruned, err = s.PruneOrderArchive(time.Now().Add(-time.Hour)); err != nil || pruned != 0 {
+		t.Errorf("Expected to prune nothing closed before an hour ago, pruned %d with error %v", pruned, err)
+		return
+	}
+	if pruned, err = s.PruneOrderArchive(time.Now().Add(time.Hour)); err != nil || pruned != 1 {
+		t.Errorf("Expected to prune the cancelled order, pruned %d with error %v", pruned, err)
+		return
+	}
+	if _, err = s.GetArchivedOrder(&placed.OrderID); err == nil {
+		t.Errorf("A pruned order should not be in the archive")
+		return
+	}
+
+	return
+}
@@ -7,30 +7,47 @@ import (
 	"time"
 
 	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/opencx/cxdb"
 	"github.com/mit-dci/opencx/cxdb/cxdbmemory"
 	"github.com/mit-dci/opencx/cxdb/cxdbsql"
 	"github.com/mit-dci/opencx/logging"
 	"github.com/mit-dci/opencx/match"
+	"golang.org/x/crypto/sha3"
 	"golang.org/x/text/number"
 )
 
 // OpencxAuctionServer is what will hopefully help handle and manage the auction logic, rpc, and db
 type OpencxAuctionServer struct {
 	SettlementEngines map[*coinparam.Params]match.SettlementEngine
-	MatchingEngines   map[match.Pair]match.AuctionEngine
-	Orderbooks        map[match.Pair]match.AuctionOrderbook
-	PuzzleEngines     map[match.Pair]cxdb.PuzzleStore
-	OrderBatchers     map[match.Pair]match.AuctionBatcher
-	dbLock            *sync.Mutex
-	orderChannel      chan *match.OrderPuzzleResult
-	orderChanMap      map[[32]byte]chan *match.OrderPuzzleResult
+	// BatchSettlementEngine applies every settlement execution from an auction at once
+	BatchSettlementEngine match.BatchSettlementEngine
+	MatchingEngines       map[match.Pair]match.AuctionEngine
+	Orderbooks            map[match.Pair]match.AuctionOrderbook
+	PuzzleEngines         map[match.Pair]cxdb.PuzzleStore
+	OrderBatchers         map[match.Pair]match.AuctionBatcher
+	LedgerStores          map[*coinparam.Params]cxdb.LedgerStore
+	dbLock                *sync.Mutex
+	orderChannel          chan *match.OrderPuzzleResult
+	orderChanMap          map[[32]byte]chan *match.OrderPuzzleResult
 
 	// auction params -- we'll store them in here for now
 	t uint64
 
 	// clock off button
 	clockOffButton chan bool
+
+	// what users sign to get their orders
+	getOrdersString string
+
+	// RootDir is where the nonce of the last admin command is kept. If it's empty the nonce is only
+	// kept in memory.
+	RootDir string
+
+	// who can call admin commands, and the nonce of the last admin command
+	adminPubkey *koblitz.PublicKey
+	adminNonce  uint64
+	adminMtx    *sync.Mutex
 }
 
 // InitServerMemoryDefault initializes an auction server with in memory auction engines, settlement engines,
@@ -73,10 +90,17 @@ func InitServerMemoryDefault(coinList []*coinparam.Params, orderChanSize uint64,
 		return
 	}
 
+	var batchEngine match.BatchSettlementEngine
+	if batchEngine, err = cxdbmemory.CreateBatchSettlementEngine(setEngines); err != nil {
+		err = fmt.Errorf("Error creating batch settlement engine for InitServerMemoryDefault: %s", err)
+		return
+	}
+
 	if server, err = InitServer(setEngines, mengines, aucBooks, pzEngines, batchers, orderChanSize, standardAuctionTime); err != nil {
 		err = fmt.Errorf("Error initializing server for InitServerMemoryDefault: %s", err)
 		return
 	}
+	server.SetBatchSettlementEngine(batchEngine)
 	return
 }
 
@@ -120,10 +144,17 @@ func InitServerSQLDefault(coinList []*coinparam.Params, orderChanSize uint64, st
 		return
 	}
 
+	var batchEngine match.BatchSettlementEngine
+	if batchEngine, err = cxdbsql.CreateBatchSettlementEngine(coinList); err != nil {
+		err = fmt.Errorf("Error creating batch settlement engine for InitServerSQLDefault: %s", err)
+		return
+	}
+
 	if server, err = InitServer(setEngines, mengines, aucBooks, pzEngines, batchers, orderChanSize, standardAuctionTime); err != nil {
 		err = fmt.Errorf("Error initializing server for createFullServer: %s", err)
 		return
 	}
+	server.SetBatchSettlementEngine(batchEngine)
 	return
 }
 
@@ -140,11 +171,38 @@ func InitServer(setEngines map[*coinparam.Params]match.SettlementEngine, matchEn
 		orderChanMap:      make(map[[32]byte]chan *match.OrderPuzzleResult),
 		t:                 standardAuctionTime,
 		clockOffButton:    make(chan bool, 1),
+		getOrdersString:   "opencx-getorders",
+		LedgerStores:      make(map[*coinparam.Params]cxdb.LedgerStore),
+		adminMtx:          new(sync.Mutex),
+	}
+
+	// By default settle batches by checking and applying on each settlement engine. Engines that
+	// keep balances should have a real batch engine set with SetBatchSettlementEngine.
+	if server.BatchSettlementEngine, err = match.NewCheckedBatchEngineFromCoins(setEngines); err != nil {
+		err = fmt.Errorf("Error creating batch settlement engine for InitServer: %s", err)
+		return
 	}
 
 	return
 }
 
+// SetBatchSettlementEngine sets the engine that applies the settlement executions from each auction
+// together, so a trade is settled for every asset or none of them.
+func (s *OpencxAuctionServer) SetBatchSettlementEngine(batchEngine match.BatchSettlementEngine) {
+	s.dbLock.Lock()
+	s.BatchSettlementEngine = batchEngine
+	s.dbLock.Unlock()
+	return
+}
+
+// SetLedgerStores sets the ledger stores that snapshots read the ledger, and balances, from
+func (s *OpencxAuctionServer) SetLedgerStores(ledgerStores map[*coinparam.Params]cxdb.LedgerStore) {
+	s.dbLock.Lock()
+	s.LedgerStores = ledgerStores
+	s.dbLock.Unlock()
+	return
+}
+
 // StartAuctionWithID starts an auction for a certain pair with a specific ID
 func (s *OpencxAuctionServer) StartAuctionWithID(pair *match.Pair, auctionID [32]byte) (err error) {
 	logging.Infof("Starting an auction with auction time %d", s.t)
@@ -317,3 +375,25 @@ func (s *OpencxAuctionServer) CurrentAuctionTime() (currentAuctionTime uint64, e
 	currentAuctionTime = s.t
 	return
 }
+
+// GetOrdersString gets the string a user signs to get their orders
+func (s *OpencxAuctionServer) GetOrdersString() (getOrderStr string) {
+	getOrderStr = s.getOrdersString
+	return
+}
+
+// GetOrdersStringVerify verifies a signature for the getOrdersString, and returns the pubkey that
+// signed it
+func (s *OpencxAuctionServer) GetOrdersStringVerify(sig []byte) (pubkey *koblitz.PublicKey, err error) {
+	// e = h(getOrders)
+	sha3 := sha3.New256()
+	sha3.Write([]byte(s.GetOrdersString()))
+	e := sha3.Sum(nil)
+
+	if pubkey, _, err = koblitz.RecoverCompact(koblitz.S256(), sig, e); err != nil {
+		err = fmt.Errorf("Error verifying getOrders string, invalid signature: \n%s", err)
+		return
+	}
+
+	return
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 
 	"github.com/btcsuite/golangcrypto/sha3"
-	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/opencx/crypto/rsw"
 	"github.com/mit-dci/opencx/crypto/timelockencoders"
@@ -246,6 +245,12 @@ func (s *OpencxAuctionServer) PlaceBatch(batch *match.AuctionBatch) (err error)
 
 	logging.Infof("Got a batch result for %x! \n\tValid orders: %d\n\tInvalid orders: %d", batchRes.OriginalBatch, len(batchRes.AcceptedResults), len(batchRes.RejectedResults))
 
+	if err = s.archiveRejected(batchRes.RejectedResults); err != nil {
+		err = fmt.Errorf("Error archiving rejected orders for PlaceBatch: %s", err)
+		s.dbLock.Unlock()
+		return
+	}
+
 	var auctionIDList map[match.AuctionID]bool = make(map[match.AuctionID]bool)
 	for _, acceptedOrder := range batchRes.AcceptedResults {
 		if acceptedOrder.Err != nil {
@@ -454,41 +459,11 @@ func (s *OpencxAuctionServer) runMatching(auctionID *match.AuctionID, pair *matc
 		}
 	}
 
-	var setCoinParam *coinparam.Params
-	var setEngine match.SettlementEngine
-	for _, settlementExec := range setExecs {
-		// get coin param for debited
-		if setCoinParam, err = settlementExec.Asset.CoinParamFromAsset(); err != nil {
-			err = fmt.Errorf("Error getting coin param for runMatching: %s", err)
-			s.dbLock.Unlock()
-			return
-		}
-
-		if setEngine, ok = s.SettlementEngines[setCoinParam]; !ok {
-			err = fmt.Errorf("Error getting correct settlement engine for runMatching")
-			s.dbLock.Unlock()
-			return
-		}
-
-		var settleValid bool
-		if settleValid, err = setEngine.CheckValid(settlementExec); err != nil {
-			err = fmt.Errorf("Error checking valid for runMatching: %s", err)
-			return
-		}
-
-		if settleValid {
-
-			if _, err = setEngine.ApplySettlementExecution(settlementExec); err != nil {
-				err = fmt.Errorf("Error applyin settlement execution for runMatching: %s", err)
-				s.dbLock.Unlock()
-				return
-			}
-
-		} else {
-			err = fmt.Errorf("Settlement invalid for some reason, maybe run matching again to see if anything changes")
-			return
-		}
-
+	// Settle the whole auction at once, so no trade is left settled for one asset but not the other
+	if _, err = s.BatchSettlementEngine.ApplySettlementBatch(setExecs); err != nil {
+		err = fmt.Errorf("Error applying settlement executions for runMatching: %s", err)
+		s.dbLock.Unlock()
+		return
 	}
 
 	s.dbLock.Unlock()
@@ -0,0 +1,31 @@
+package cxauctionserver
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+)
+
+// TakeSnapshot takes a consistent snapshot of the auction orderbooks, order archives, puzzles,
+// balances, and ledger. The db lock is held the whole time, so no orders or auction results can be
+// written while the snapshot is taken. Balances are summed from the ledger, since the auction
+// server only keeps them in its settlement engines.
+func (s *OpencxAuctionServer) TakeSnapshot() (snap *cxdbsnapshot.Snapshot, err error) {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+
+	stores := &cxdbsnapshot.Stores{
+		AuctionEngines:    s.MatchingEngines,
+		AuctionOrderbooks: s.Orderbooks,
+		PuzzleStores:      s.PuzzleEngines,
+		SettlementEngines: s.SettlementEngines,
+		LedgerStores:      s.LedgerStores,
+	}
+
+	if snap, err = cxdbsnapshot.Take(stores); err != nil {
+		err = fmt.Errorf("Error taking snapshot for TakeSnapshot: %s", err)
+		return
+	}
+
+	return
+}
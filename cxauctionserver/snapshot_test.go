@@ -0,0 +1,51 @@
+package cxauctionserver
+
+import (
+	"testing"
+
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+)
+
+func TestTakeSnapshot(t *testing.T) {
+	var err error
+
+	var s *OpencxAuctionServer
+	if s, err = initTestServer(); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+
+	if err = s.StartAuctionWithID(&testEncryptedOrder.IntendedPair, testEncryptedOrder.IntendedAuction); err != nil {
+		t.Errorf("Error starting auction: %s", err)
+		return
+	}
+	if err = s.PlacePuzzledOrder(testEncryptedOrder); err != nil {
+		t.Errorf("Error placing puzzled order: %s", err)
+		return
+	}
+
+	var snap *cxdbsnapshot.Snapshot
+	if snap, err = s.TakeSnapshot(); err != nil {
+		t.Errorf("Error taking snapshot: %s", err)
+		return
+	}
+
+	// the puzzle should be in the snapshot under its auction
+	var numPuzzles int
+	for _, market := range snap.Markets {
+		if market.Pair != testEncryptedOrder.IntendedPair {
+			continue
+		}
+		for _, auction := range market.Auctions {
+			if auction.AuctionID == testEncryptedOrder.IntendedAuction {
+				numPuzzles += len(auction.Puzzles)
+			}
+		}
+	}
+	if numPuzzles != 1 {
+		t.Errorf("Snapshot should have 1 puzzle for the auction, has %d", numPuzzles)
+		return
+	}
+
+	return
+}
@@ -288,6 +288,13 @@ func createFullServer(coinList []*coinparam.Params, serverhost string, serverpor
 		return
 	}
 
+	var batchEngine match.BatchSettlementEngine
+	if batchEngine, err = cxdbsql.CreateBatchSettlementEngine(coinList); err != nil {
+		err = fmt.Errorf("Error creating batch settlement engine for createFullServer: %s", err)
+		return
+	}
+	ocxServer.SetBatchSettlementEngine(batchEngine)
+
 	logging.Infof("Starting RPC Listen process.")
 	key := new([32]byte)
 	copy(key[:], privkey.Serialize())
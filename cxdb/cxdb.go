@@ -1,6 +1,8 @@
 package cxdb
 
 import (
+	"time"
+
 	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/opencx/match"
 )
@@ -9,8 +11,39 @@ import (
 type SettlementStore interface {
 	// UpdateBalances updates the balances from the settlement executions
 	UpdateBalances(settlementExecs []*match.SettlementResult) (err error)
-	// GetBalance gets the balance for a pubkey and an asset.
-	GetBalance(pubkey *koblitz.PublicKey) (balance uint64, err error)
+	// GetBalance gets the available balance for a pubkey and an asset. If the sub-account is
+	// nil, this is the balance of every sub-account of the pubkey added together.
+	GetBalance(pubkey *koblitz.PublicKey, subAccount *uint32) (balance uint64, err error)
+	// GetHeldBalance gets the balance for a pubkey and an asset that is locked up in open orders.
+	// If the sub-account is nil, this is the held balance of every sub-account added together.
+	GetHeldBalance(pubkey *koblitz.PublicKey, subAccount *uint32) (held uint64, err error)
+	// GetTotalBalance gets the sum of every user's available and held balance, which is what the
+	// exchange owes its users
+	GetTotalBalance() (total uint64, err error)
+	// GetAllBalances gets every user's available and held balance added together, by pubkey
+	GetAllBalances() (balances map[[33]byte]uint64, err error)
+	// GetAccountBalances gets the available and held balance of every sub-account of every pubkey
+	GetAccountBalances() (balances []*match.AccountBalance, err error)
+}
+
+// LedgerStore reads the ledger that every applied settlement execution is written to.
+type LedgerStore interface {
+	// GetAccountStatement gets the ledger entries for a pubkey and an asset from the from time up to
+	// the to time, along with the opening and closing balance.
+	GetAccountStatement(pubkey *koblitz.PublicKey, from time.Time, to time.Time) (statement *match.AccountStatement, err error)
+	// CheckConsistency recomputes every balance from the ledger and returns the accounts whose
+	// balance doesn't match.
+	CheckConsistency() (mismatches []*match.LedgerMismatch, err error)
+	// GetFeeBalance gets the total of the fees the exchange has collected
+	GetFeeBalance() (fees uint64, err error)
+	// GetTransferNonces gets the nonce of the last transfer from each pubkey, from the ledger entries
+	// for the senders of transfers
+	GetTransferNonces() (nonces map[[33]byte]uint64, err error)
+	// GetLedger gets every entry in the ledger, in the order they were written
+	GetLedger() (entries []*match.LedgerEntry, err error)
+	// ReplaceLedger replaces every entry in the ledger with the entries given, keeping their IDs.
+	// This is for restoring a snapshot, after the balances have been restored.
+	ReplaceLedger(entries []*match.LedgerEntry) (err error)
 }
 
 type DepositStore interface {
@@ -18,6 +51,20 @@ type DepositStore interface {
 	RegisterUser(pubkey *koblitz.PublicKey, address string) (err error)
 	// UpdateDeposits updates the deposits when a block comes in
 	UpdateDeposits(deposits []match.Deposit, blockheight uint64) (depositExecs []*match.SettlementExecution, err error)
+	// RollbackDeposits removes the pending deposits that were received in the orphaned blocks.
+	// Deposits that were already credited are returned as credit executions that reverse them.
+	RollbackDeposits(orphanedBlockHashes []string) (reorgExecs []*match.SettlementExecution, err error)
+	// GetPendingDeposits gets the deposits for a pubkey that have been received but not yet credited
+	GetPendingDeposits(pubkey *koblitz.PublicKey) (pending []*match.Deposit, err error)
+	// GetDepositHistory gets the deposits for a pubkey that have been credited
+	GetDepositHistory(pubkey *koblitz.PublicKey) (history []*match.Deposit, err error)
+	// GetDepositIndex gets the index used to derive deposit addresses for a pubkey, assigning the
+	// next unused index if the pubkey does not have one yet.
+	GetDepositIndex(pubkey *koblitz.PublicKey) (index uint32, err error)
+	// GetSweepableDeposits gets all credited deposits whose outputs have not been swept yet
+	GetSweepableDeposits() (deposits []*match.Deposit, err error)
+	// MarkDepositsSwept marks the outputs of the given deposits as swept
+	MarkDepositsSwept(deposits []*match.Deposit) (err error)
 	// GetDepositAddressMap gets a map of the deposit addresses we own to pubkeys
 	GetDepositAddressMap() (depAddrMap map[string]*koblitz.PublicKey, err error)
 	// GetDepositAddress gets the deposit address for a pubkey and an asset.
@@ -32,4 +79,6 @@ type PuzzleStore interface {
 	ViewAuctionPuzzleBook(auctionID *match.AuctionID) (puzzles []*match.EncryptedAuctionOrder, err error)
 	// PlaceAuctionPuzzle puts an encrypted auction order in the datastore.
 	PlaceAuctionPuzzle(puzzledOrder *match.EncryptedAuctionOrder) (err error)
+	// ViewAuctionIDs returns the ID of every auction that has puzzles in the store
+	ViewAuctionIDs() (auctionIDs []*match.AuctionID, err error)
 }
@@ -0,0 +1,233 @@
+package cxdbkv
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/mit-dci/opencx/match"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/sha3"
+)
+
+// KVAuctionEngine is an auction matching engine that keeps its orders in the data file
+type KVAuctionEngine struct {
+	db *DB
+
+	// this pair
+	pair *match.Pair
+}
+
+// CreateAuctionEngine creates an auction matching engine for a pair that keeps its orders in db
+func CreateAuctionEngine(db *DB, pair *match.Pair) (engine match.AuctionEngine, err error) {
+	if err = db.createBuckets([]byte(pair.String()), auctionEngineBucket); err != nil {
+		err = fmt.Errorf("Error creating buckets for CreateAuctionEngine: %s", err)
+		return
+	}
+
+	engine = &KVAuctionEngine{
+		db:   db,
+		pair: pair,
+	}
+	return
+}
+
+// PlaceAuctionOrder places an order for a specific auction ID.
+// This assumes that the auction order is valid and is for the same pair as the matching engine
+func (ae *KVAuctionEngine) PlaceAuctionOrder(order *match.AuctionOrder, auctionID *match.AuctionID) (idRes *match.AuctionOrderIDPair, err error) {
+	var price float64
+	if price, err = order.Price(); err != nil {
+		err = fmt.Errorf("Error getting price from order while placing order: %s", err)
+		return
+	}
+
+	// hash order so we can use that as a key
+	sha := sha3.New256()
+	sha.Write(order.SerializeSignable())
+
+	aoid := &match.AuctionOrderIDPair{
+		Order: order,
+		Price: price,
+	}
+	copy(aoid.OrderID[:], sha.Sum(nil))
+
+	if err = ae.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, auctionEngineBucket, []byte(ae.pair.String())); err != nil {
+			return
+		}
+		err = putAuctionOrder(orders, aoid)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error placing order for PlaceAuctionOrder: %s", err)
+		return
+	}
+
+	idRes = aoid
+	return
+}
+
+// CancelAuctionOrder cancels an auction order, this assumes that the auction order actually exists
+func (ae *KVAuctionEngine) CancelAuctionOrder(orderID *match.OrderID) (cancelled *match.CancelledOrder, cancelSettlement *match.SettlementExecution, err error) {
+	var cancelledOrder *match.AuctionOrderIDPair
+	if err = ae.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, auctionEngineBucket, []byte(ae.pair.String())); err != nil {
+			return
+		}
+		if cancelledOrder, err = getAuctionOrder(orders, orderID); err != nil {
+			return
+		}
+		err = orders.Delete(orderID[:])
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error cancelling order for CancelAuctionOrder: %s", err)
+		return
+	}
+
+	cancelled = &match.CancelledOrder{
+		OrderID: orderID,
+	}
+	var debitAsset match.Asset
+	if cancelledOrder.Order.Side == match.Buy {
+		debitAsset = ae.pair.AssetHave
+	} else {
+		debitAsset = ae.pair.AssetWant
+	}
+	cancelSettlement = &match.SettlementExecution{
+		Pubkey:    cancelledOrder.Order.Pubkey,
+		Amount:    cancelledOrder.Order.AmountHave,
+		Type:      match.Debit,
+		Asset:     debitAsset,
+		Reason:    match.ReasonCancelRefund,
+		Reference: hex.EncodeToString(orderID[:]),
+	}
+
+	return
+}
+
+// MatchAuctionOrders calculates a single clearing price to execute orders at, and executes at that price.
+func (ae *KVAuctionEngine) MatchAuctionOrders(auctionID *match.AuctionID) (orderExecs []*match.OrderExecution, settlementExecs []*match.SettlementExecution, err error) {
+	if err = ae.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, auctionEngineBucket, []byte(ae.pair.String())); err != nil {
+			return
+		}
+
+		var allOrders []*match.AuctionOrderIDPair
+		if allOrders, err = getAuctionOrders(orders); err != nil {
+			return
+		}
+
+		book := make(map[float64][]*match.AuctionOrderIDPair)
+		for _, aoid := range allOrders {
+			if aoid.Order.AuctionID == *auctionID {
+				book[aoid.Price] = append(book[aoid.Price], aoid)
+			}
+		}
+
+		if orderExecs, settlementExecs, err = match.MatchClearingAlgorithm(book); err != nil {
+			err = fmt.Errorf("Error running clearing matching algorithm: %s", err)
+			return
+		}
+
+		for _, orderExec := range orderExecs {
+			if err = updateAuctionOrder(orders, orderExec); err != nil {
+				return
+			}
+		}
+		return
+	}); err != nil {
+		orderExecs = nil
+		settlementExecs = nil
+		err = fmt.Errorf("Error matching auction for MatchAuctionOrders: %s", err)
+		return
+	}
+
+	return
+}
+
+// putAuctionOrder writes an order to a bucket of auction orders, keyed by order ID
+func putAuctionOrder(orders *bolt.Bucket, aoid *match.AuctionOrderIDPair) (err error) {
+	var orderBytes []byte
+	if orderBytes, err = encodeValue(aoid); err != nil {
+		err = fmt.Errorf("Error encoding order: %s", err)
+		return
+	}
+	if err = orders.Put(aoid.OrderID[:], orderBytes); err != nil {
+		err = fmt.Errorf("Error putting order: %s", err)
+		return
+	}
+	return
+}
+
+// getAuctionOrder reads an order from a bucket of auction orders
+func getAuctionOrder(orders *bolt.Bucket, orderID *match.OrderID) (aoid *match.AuctionOrderIDPair, err error) {
+	var orderBytes []byte
+	if orderBytes = orders.Get(orderID[:]); orderBytes == nil {
+		err = fmt.Errorf("Order %x does not exist", orderID[:])
+		return
+	}
+	aoid = new(match.AuctionOrderIDPair)
+	if err = decodeValue(orderBytes, aoid); err != nil {
+		err = fmt.Errorf("Error decoding order %x: %s", orderID[:], err)
+		return
+	}
+	return
+}
+
+// getAuctionOrders reads every order from a bucket of auction orders
+func getAuctionOrders(orders *bolt.Bucket) (book []*match.AuctionOrderIDPair, err error) {
+	err = orders.ForEach(func(k, v []byte) (err error) {
+		aoid := new(match.AuctionOrderIDPair)
+		if err = decodeValue(v, aoid); err != nil {
+			err = fmt.Errorf("Error decoding order %x: %s", k, err)
+			return
+		}
+		book = append(book, aoid)
+		return
+	})
+	return
+}
+
+// updateAuctionOrder deletes the order in the execution if it was filled, and updates its amounts
+// if it was not.
+func updateAuctionOrder(orders *bolt.Bucket, orderExec *match.OrderExecution) (err error) {
+	if orderExec.Filled {
+		if orders.Get(orderExec.OrderID[:]) == nil {
+			err = fmt.Errorf("Filled order %x does not exist", orderExec.OrderID[:])
+			return
+		}
+		if err = orders.Delete(orderExec.OrderID[:]); err != nil {
+			err = fmt.Errorf("Error deleting filled order: %s", err)
+			return
+		}
+		return
+	}
+
+	var aoid *match.AuctionOrderIDPair
+	if aoid, err = getAuctionOrder(orders, &orderExec.OrderID); err != nil {
+		return
+	}
+	aoid.Order.AmountHave = orderExec.NewAmountHave
+	aoid.Order.AmountWant = orderExec.NewAmountWant
+	if err = putAuctionOrder(orders, aoid); err != nil {
+		return
+	}
+	return
+}
+
+// CreateAuctionEngineMap creates a map of pair to auction engine, given a list of pairs.
+func CreateAuctionEngineMap(db *DB, pairList []*match.Pair) (aucMap map[match.Pair]match.AuctionEngine, err error) {
+
+	aucMap = make(map[match.Pair]match.AuctionEngine)
+	var curAucEng match.AuctionEngine
+	for _, pair := range pairList {
+		if curAucEng, err = CreateAuctionEngine(db, pair); err != nil {
+			err = fmt.Errorf("Error creating single auction engine while creating auction engine map: %s", err)
+			return
+		}
+		aucMap[*pair] = curAucEng
+	}
+
+	return
+}
@@ -0,0 +1,406 @@
+package cxdbkv
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/match"
+	bolt "go.etcd.io/bbolt"
+)
+
+// KVAuctionOrderbook is the read-only copy of an auction orderbook, kept in the data file
+type KVAuctionOrderbook struct {
+	db *DB
+
+	// this pair
+	pair *match.Pair
+}
+
+// CreateAuctionOrderbook creates an auction orderbook for a pair that keeps its orders in db
+func CreateAuctionOrderbook(db *DB, pair *match.Pair) (book match.AuctionOrderbook, err error) {
+	if err = db.createBuckets([]byte(pair.String()), auctionOrderbookBucket, auctionArchiveBucket, auctionFillsBucket); err != nil {
+		err = fmt.Errorf("Error creating buckets for CreateAuctionOrderbook: %s", err)
+		return
+	}
+
+	book = &KVAuctionOrderbook{
+		db:   db,
+		pair: pair,
+	}
+	return
+}
+
+// UpdateBookExec takes in an order execution and updates the orderbook.
+func (ao *KVAuctionOrderbook) UpdateBookExec(exec *match.OrderExecution) (err error) {
+	if err = ao.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, auctionOrderbookBucket, []byte(ao.pair.String())); err != nil {
+			return
+		}
+		var aoid *match.AuctionOrderIDPair
+		if aoid, err = getAuctionOrder(orders, &exec.OrderID); err != nil {
+			return
+		}
+		now := time.Now()
+		var fills *bolt.Bucket
+		if fills, err = bucket(tx, auctionFillsBucket, []byte(ao.pair.String())); err != nil {
+			return
+		}
+		if err = addFill(fills, &exec.OrderID, match.NewOrderFill(aoid.Order.AmountWant, aoid.Order.AmountHave, exec, now)); err != nil {
+			return
+		}
+		if exec.Filled {
+			// the last fill took everything that was left
+			aoid.Order.AmountWant = 0
+			aoid.Order.AmountHave = 0
+			if err = ao.archiveOrder(tx, aoid, match.OrderFilled, now); err != nil {
+				return
+			}
+		}
+		err = updateAuctionOrder(orders, exec)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error updating book for UpdateBookExec: %s", err)
+		return
+	}
+	return
+}
+
+// UpdateBookCancel takes in an order cancellation and updates the orderbook.
+func (ao *KVAuctionOrderbook) UpdateBookCancel(cancel *match.CancelledOrder) (err error) {
+	if err = ao.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, auctionOrderbookBucket, []byte(ao.pair.String())); err != nil {
+			return
+		}
+		if orders.Get(cancel.OrderID[:]) == nil {
+			err = fmt.Errorf("Order %x is not in the orderbook", cancel.OrderID[:])
+			return
+		}
+		var aoid *match.AuctionOrderIDPair
+		if aoid, err = getAuctionOrder(orders, cancel.OrderID); err != nil {
+			return
+		}
+		var fills *bolt.Bucket
+		if fills, err = bucket(tx, auctionFillsBucket, []byte(ao.pair.String())); err != nil {
+			return
+		}
+		var orderFills []*match.OrderFill
+		if orderFills, err = getFills(fills, cancel.OrderID); err != nil {
+			return
+		}
+		if err = ao.archiveOrder(tx, aoid, match.CancelStatus(orderFills), time.Now()); err != nil {
+			return
+		}
+		err = orders.Delete(cancel.OrderID[:])
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error updating book for UpdateBookCancel: %s", err)
+		return
+	}
+	return
+}
+
+// UpdateBookReject archives an order as rejected, taking it out of the orderbook if it's there.
+func (ao *KVAuctionOrderbook) UpdateBookReject(auctionIDPair *match.AuctionOrderIDPair) (err error) {
+	if err = ao.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, auctionOrderbookBucket, []byte(ao.pair.String())); err != nil {
+			return
+		}
+		// copy the order so we don't change the caller's when archiving it
+		aoid := &match.AuctionOrderIDPair{
+			OrderID: auctionIDPair.OrderID,
+			Price:   auctionIDPair.Price,
+			Order:   new(match.AuctionOrder),
+		}
+		*aoid.Order = *auctionIDPair.Order
+		if err = ao.archiveOrder(tx, aoid, match.OrderRejected, time.Now()); err != nil {
+			return
+		}
+		err = orders.Delete(auctionIDPair.OrderID[:])
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error updating book for UpdateBookReject: %s", err)
+		return
+	}
+	return
+}
+
+// archiveOrder moves the fills for an order to the archive, along with the order as it was
+// placed. This does not take it out of the orderbook, and changes the amounts of aoid.
+func (ao *KVAuctionOrderbook) archiveOrder(tx *bolt.Tx, aoid *match.AuctionOrderIDPair, status match.OrderStatus, closedAt time.Time) (err error) {
+	var fills, archive *bolt.Bucket
+	if fills, err = bucket(tx, auctionFillsBucket, []byte(ao.pair.String())); err != nil {
+		return
+	}
+	if archive, err = bucket(tx, auctionArchiveBucket, []byte(ao.pair.String())); err != nil {
+		return
+	}
+
+	archived := &match.ArchivedAuctionOrder{
+		Order:    aoid,
+		Status:   status,
+		ClosedAt: closedAt,
+	}
+	if archived.Fills, err = takeFills(fills, &aoid.OrderID); err != nil {
+		return
+	}
+
+	filledWant, filledHave := match.FilledAmounts(archived.Fills)
+	aoid.Order.AmountWant += filledWant
+	aoid.Order.AmountHave += filledHave
+	err = putArchived(archive, &aoid.OrderID, archived)
+	return
+}
+
+// UpdateBookPlace takes in an order and ID, and adds the order to the orderbook.
+func (ao *KVAuctionOrderbook) UpdateBookPlace(auctionIDPair *match.AuctionOrderIDPair) (err error) {
+	if err = ao.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, auctionOrderbookBucket, []byte(ao.pair.String())); err != nil {
+			return
+		}
+		err = putAuctionOrder(orders, auctionIDPair)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error updating book for UpdateBookPlace: %s", err)
+		return
+	}
+	return
+}
+
+// GetOrder gets an order from an OrderID
+func (ao *KVAuctionOrderbook) GetOrder(orderID *match.OrderID) (aucOrder *match.AuctionOrderIDPair, err error) {
+	if err = ao.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, auctionOrderbookBucket, []byte(ao.pair.String())); err != nil {
+			return
+		}
+		aucOrder, err = getAuctionOrder(orders, orderID)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error getting order for GetOrder: %s", err)
+		return
+	}
+	return
+}
+
+// CalculatePrice returns the calculated price for an auction based on the orderbook. This is
+// based on the midpoint of the spread.
+func (ao *KVAuctionOrderbook) CalculatePrice(auctionID *match.AuctionID) (price float64, err error) {
+	var orders []*match.AuctionOrderIDPair
+	if orders, err = ao.getOrders(); err != nil {
+		err = fmt.Errorf("Error getting orders for auction CalculatePrice: %s", err)
+		return
+	}
+
+	var maxSell float64
+	var minBuy float64
+	var seenBuy bool
+	for _, aoid := range orders {
+		if aoid.Order.AuctionID != *auctionID {
+			continue
+		}
+		if aoid.Order.Side == match.Sell {
+			if aoid.Price > maxSell {
+				maxSell = aoid.Price
+			}
+		} else if !seenBuy || aoid.Price < minBuy {
+			minBuy = aoid.Price
+			seenBuy = true
+		}
+	}
+
+	price = (minBuy + maxSell) / 2
+	return
+}
+
+// GetOrdersForPubkey gets orders for a specific pubkey.
+func (ao *KVAuctionOrderbook) GetOrdersForPubkey(pubkey *koblitz.PublicKey) (orders map[float64][]*match.AuctionOrderIDPair, err error) {
+	var allOrders []*match.AuctionOrderIDPair
+	if allOrders, err = ao.getOrders(); err != nil {
+		err = fmt.Errorf("Error getting orders for GetOrdersForPubkey: %s", err)
+		return
+	}
+
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	orders = make(map[float64][]*match.AuctionOrderIDPair)
+	for _, aoid := range allOrders {
+		if aoid.Order.Pubkey == pubkeyBytes {
+			orders[aoid.Price] = append(orders[aoid.Price], aoid)
+		}
+	}
+	return
+}
+
+// ViewAuctionOrderBook returns the whole orderbook as a map of price to orders
+func (ao *KVAuctionOrderbook) ViewAuctionOrderBook() (book map[float64][]*match.AuctionOrderIDPair, err error) {
+	var orders []*match.AuctionOrderIDPair
+	if orders, err = ao.getOrders(); err != nil {
+		err = fmt.Errorf("Error getting orders for ViewAuctionOrderBook: %s", err)
+		return
+	}
+
+	book = make(map[float64][]*match.AuctionOrderIDPair)
+	for _, aoid := range orders {
+		book[aoid.Price] = append(book[aoid.Price], aoid)
+	}
+	return
+}
+
+// GetArchivedOrder gets an order that is no longer in the orderbook
+func (ao *KVAuctionOrderbook) GetArchivedOrder(orderID *match.OrderID) (archived *match.ArchivedAuctionOrder, err error) {
+	if err = ao.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var archive *bolt.Bucket
+		if archive, err = bucket(tx, auctionArchiveBucket, []byte(ao.pair.String())); err != nil {
+			return
+		}
+		var archivedBytes []byte
+		if archivedBytes = archive.Get(orderID[:]); archivedBytes == nil {
+			err = fmt.Errorf("Order %x is not in the archive", orderID[:])
+			return
+		}
+		archived = new(match.ArchivedAuctionOrder)
+		err = decodeValue(archivedBytes, archived)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error getting archived order for GetArchivedOrder: %s", err)
+		return
+	}
+	return
+}
+
+// GetArchivedOrdersForPubkey gets the orders for a pubkey that are no longer in the orderbook, in
+// the order they were closed.
+func (ao *KVAuctionOrderbook) GetArchivedOrdersForPubkey(pubkey *koblitz.PublicKey) (archived []*match.ArchivedAuctionOrder, err error) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	if err = ao.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var archive *bolt.Bucket
+		if archive, err = bucket(tx, auctionArchiveBucket, []byte(ao.pair.String())); err != nil {
+			return
+		}
+		err = archive.ForEach(func(k, v []byte) (err error) {
+			arc := new(match.ArchivedAuctionOrder)
+			if err = decodeValue(v, arc); err != nil {
+				err = fmt.Errorf("Error decoding archived order %x: %s", k, err)
+				return
+			}
+			if arc.Order.Order.Pubkey == pubkeyBytes {
+				archived = append(archived, arc)
+			}
+			return
+		})
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error getting archived orders for GetArchivedOrdersForPubkey: %s", err)
+		return
+	}
+
+	sort.SliceStable(archived, func(i, j int) bool {
+		return archived[i].ClosedAt.Before(archived[j].ClosedAt)
+	})
+	return
+}
+
+// ViewArchive gets every order that is no longer in the orderbook, in the order they were closed
+func (ao *KVAuctionOrderbook) ViewArchive() (archived []*match.ArchivedAuctionOrder, err error) {
+	if err = ao.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var archive *bolt.Bucket
+		if archive, err = bucket(tx, auctionArchiveBucket, []byte(ao.pair.String())); err != nil {
+			return
+		}
+		err = archive.ForEach(func(k, v []byte) (err error) {
+			arc := new(match.ArchivedAuctionOrder)
+			if err = decodeValue(v, arc); err != nil {
+				err = fmt.Errorf("Error decoding archived order %x: %s", k, err)
+				return
+			}
+			archived = append(archived, arc)
+			return
+		})
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error getting archived orders for ViewArchive: %s", err)
+		return
+	}
+
+	sort.SliceStable(archived, func(i, j int) bool {
+		return archived[i].ClosedAt.Before(archived[j].ClosedAt)
+	})
+	return
+}
+
+// RestoreArchivedOrder puts an order into the archive as it was archived
+func (ao *KVAuctionOrderbook) RestoreArchivedOrder(archived *match.ArchivedAuctionOrder) (err error) {
+	if err = ao.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var archive *bolt.Bucket
+		if archive, err = bucket(tx, auctionArchiveBucket, []byte(ao.pair.String())); err != nil {
+			return
+		}
+		err = putArchived(archive, &archived.Order.OrderID, archived)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error putting archived order for RestoreArchivedOrder: %s", err)
+		return
+	}
+	return
+}
+
+// PruneArchive deletes the archived orders that were closed before the cutoff
+func (ao *KVAuctionOrderbook) PruneArchive(before time.Time) (pruned uint64, err error) {
+	if err = ao.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var archive *bolt.Bucket
+		if archive, err = bucket(tx, auctionArchiveBucket, []byte(ao.pair.String())); err != nil {
+			return
+		}
+		pruned, err = pruneArchived(archive, before, func(v []byte) (closedAt time.Time, err error) {
+			arc := new(match.ArchivedAuctionOrder)
+			if err = decodeValue(v, arc); err != nil {
+				return
+			}
+			closedAt = arc.ClosedAt
+			return
+		})
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error pruning archive for PruneArchive: %s", err)
+		return
+	}
+	return
+}
+
+// getOrders gets every order in the orderbook
+func (ao *KVAuctionOrderbook) getOrders() (orders []*match.AuctionOrderIDPair, err error) {
+	err = ao.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var orderBucket *bolt.Bucket
+		if orderBucket, err = bucket(tx, auctionOrderbookBucket, []byte(ao.pair.String())); err != nil {
+			return
+		}
+		orders, err = getAuctionOrders(orderBucket)
+		return
+	})
+	return
+}
+
+// CreateAuctionOrderbookMap creates a map of pair to auction orderbook, given a list of pairs.
+func CreateAuctionOrderbookMap(db *DB, pairList []*match.Pair) (aucMap map[match.Pair]match.AuctionOrderbook, err error) {
+
+	aucMap = make(map[match.Pair]match.AuctionOrderbook)
+	var curAucBook match.AuctionOrderbook
+	for _, pair := range pairList {
+		if curAucBook, err = CreateAuctionOrderbook(db, pair); err != nil {
+			err = fmt.Errorf("Error creating single auction orderbook while creating auction orderbook map: %s", err)
+			return
+		}
+		aucMap[*pair] = curAucBook
+	}
+
+	return
+}
@@ -0,0 +1,188 @@
+package cxdbkv
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/cxdb/cxdbmemory"
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+	"github.com/mit-dci/opencx/cxdb/cxdbtest"
+	"github.com/mit-dci/opencx/match"
+)
+
+// conformanceDBs opens a new data file for every scenario in the conformance suite, so the
+// scenarios don't see each other's orders. The returned func closes them all and removes them.
+func conformanceDBs(t *testing.T) (newDB func() (db *DB, err error), cleanup func()) {
+	dir, removeDir := createTestDir(t)
+	var dbs []*DB
+	newDB = func() (db *DB, err error) {
+		if db, err = OpenDB(filepath.Join(dir, fmt.Sprintf("conformance%d.db", len(dbs)))); err != nil {
+			return
+		}
+		dbs = append(dbs, db)
+		return
+	}
+	cleanup = func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+		removeDir()
+	}
+	return
+}
+
+func TestLimitEngineConformance(t *testing.T) {
+	newDB, cleanup := conformanceDBs(t)
+	defer cleanup()
+
+	cxdbtest.RunLimitEngineTests(t, func(pair *match.Pair) (engine match.LimitEngine, err error) {
+		var db *DB
+		if db, err = newDB(); err != nil {
+			return
+		}
+		engine, err = CreateLimitEngine(db, pair)
+		return
+	})
+}
+
+func TestSettlementEngineConformance(t *testing.T) {
+	newDB, cleanup := conformanceDBs(t)
+	defer cleanup()
+
+	cxdbtest.RunSettlementEngineTests(t, func(coin *coinparam.Params) (engine match.SettlementEngine, err error) {
+		var db *DB
+		if db, err = newDB(); err != nil {
+			return
+		}
+		engine, err = CreateSettlementEngine(db, coin)
+		return
+	})
+}
+
+func TestSettlementStoreConformance(t *testing.T) {
+	newDB, cleanup := conformanceDBs(t)
+	defer cleanup()
+
+	cxdbtest.RunSettlementStoreTests(t, func(coin *coinparam.Params) (store cxdb.SettlementStore, err error) {
+		var db *DB
+		if db, err = newDB(); err != nil {
+			return
+		}
+		store, err = CreateSettlementStore(db, coin)
+		return
+	})
+}
+
+func TestLedgerStoreConformance(t *testing.T) {
+	newDB, cleanup := conformanceDBs(t)
+	defer cleanup()
+
+	cxdbtest.RunLedgerStoreTests(t, func(coin *coinparam.Params) (engine match.SettlementEngine, store cxdb.LedgerStore, err error) {
+		var db *DB
+		if db, err = newDB(); err != nil {
+			return
+		}
+		if engine, err = CreateSettlementEngine(db, coin); err != nil {
+			return
+		}
+		store, err = CreateLedgerStore(db, coin)
+		return
+	})
+}
+
+func TestLimitOrderbookConformance(t *testing.T) {
+	newDB, cleanup := conformanceDBs(t)
+	defer cleanup()
+
+	cxdbtest.RunLimitOrderbookTests(t, func(pair *match.Pair) (book match.LimitOrderbook, err error) {
+		var db *DB
+		if db, err = newDB(); err != nil {
+			return
+		}
+		book, err = CreateLimitOrderbook(db, pair)
+		return
+	})
+}
+
+func TestAuctionEngineConformance(t *testing.T) {
+	newDB, cleanup := conformanceDBs(t)
+	defer cleanup()
+
+	cxdbtest.RunAuctionEngineTests(t, func(pair *match.Pair) (engine match.AuctionEngine, err error) {
+		var db *DB
+		if db, err = newDB(); err != nil {
+			return
+		}
+		engine, err = CreateAuctionEngine(db, pair)
+		return
+	})
+}
+
+func TestAuctionOrderbookConformance(t *testing.T) {
+	newDB, cleanup := conformanceDBs(t)
+	defer cleanup()
+
+	cxdbtest.RunAuctionOrderbookTests(t, func(pair *match.Pair) (book match.AuctionOrderbook, err error) {
+		var db *DB
+		if db, err = newDB(); err != nil {
+			return
+		}
+		book, err = CreateAuctionOrderbook(db, pair)
+		return
+	})
+}
+
+func TestDepositStoreConformance(t *testing.T) {
+	newDB, cleanup := conformanceDBs(t)
+	defer cleanup()
+
+	cxdbtest.RunDepositStoreTests(t, func(coin *coinparam.Params) (store cxdb.DepositStore, err error) {
+		var db *DB
+		if db, err = newDB(); err != nil {
+			return
+		}
+		store, err = CreateDepositStore(db, coin)
+		return
+	})
+}
+
+func TestPuzzleStoreConformance(t *testing.T) {
+	newDB, cleanup := conformanceDBs(t)
+	defer cleanup()
+
+	cxdbtest.RunPuzzleStoreTests(t, func(pair *match.Pair) (store cxdb.PuzzleStore, err error) {
+		var db *DB
+		if db, err = newDB(); err != nil {
+			return
+		}
+		store, err = CreatePuzzleStore(db, pair)
+		return
+	})
+}
+
+func TestSnapshotConformance(t *testing.T) {
+	newDB, cleanup := conformanceDBs(t)
+	defer cleanup()
+
+	createStores := func(pairList []*match.Pair, coinList []*coinparam.Params) (stores *cxdbsnapshot.Stores, err error) {
+		var db *DB
+		if db, err = newDB(); err != nil {
+			return
+		}
+		stores, err = CreateSnapshotStores(db, pairList, coinList)
+		return
+	}
+
+	t.Run("MemoryToKV", func(t *testing.T) {
+		cxdbtest.RunSnapshotTests(t, cxdbmemory.CreateSnapshotStores, createStores)
+	})
+	t.Run("KVToMemory", func(t *testing.T) {
+		cxdbtest.RunSnapshotTests(t, createStores, cxdbmemory.CreateSnapshotStores)
+	})
+	t.Run("KVToKV", func(t *testing.T) {
+		cxdbtest.RunSnapshotTests(t, createStores, createStores)
+	})
+}
@@ -0,0 +1,132 @@
+package cxdbkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The top level buckets. Every store keeps one bucket per pair or coin inside of its top level
+// bucket, so one data file can hold everything the exchange stores.
+var (
+	limitEngineBucket      = []byte("limitengine")
+	limitOrderbookBucket   = []byte("limitorderbook")
+	auctionEngineBucket    = []byte("auctionengine")
+	auctionOrderbookBucket = []byte("auctionorderbook")
+	limitArchiveBucket     = []byte("limitorderarchive")
+	limitFillsBucket       = []byte("limitorderfills")
+	auctionArchiveBucket   = []byte("auctionorderarchive")
+	auctionFillsBucket     = []byte("auctionorderfills")
+	balanceBucket          = []byte("balances")
+	readOnlyBalanceBucket  = []byte("balances_readonly")
+	ledgerBucket           = []byte("ledger")
+	depositBucket          = []byte("deposits")
+	depositAddrBucket      = []byte("depositaddrs")
+	depositIndexBucket     = []byte("depositindex")
+	puzzleBucket           = []byte("puzzles")
+)
+
+// DB is a handle to the data file. Bolt only lets one process open the file at a time, so every
+// store created from the same DB shares this handle.
+type DB struct {
+	handle *bolt.DB
+}
+
+// OpenDB opens the data file at path, creating it if it does not exist.
+func OpenDB(path string) (db *DB, err error) {
+	var handle *bolt.DB
+	if handle, err = bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second}); err != nil {
+		err = fmt.Errorf("Error opening data file for OpenDB: %s", err)
+		return
+	}
+	db = &DB{
+		handle: handle,
+	}
+	return
+}
+
+// Close closes the data file
+func (db *DB) Close() (err error) {
+	if err = db.handle.Close(); err != nil {
+		err = fmt.Errorf("Error closing data file for Close: %s", err)
+		return
+	}
+	return
+}
+
+// createBuckets creates the bucket named name inside of each of the top level buckets
+func (db *DB) createBuckets(name []byte, topBuckets ...[]byte) (err error) {
+	if err = db.handle.Update(func(tx *bolt.Tx) (err error) {
+		for _, topName := range topBuckets {
+			var top *bolt.Bucket
+			if top, err = tx.CreateBucketIfNotExists(topName); err != nil {
+				err = fmt.Errorf("Error creating %s bucket: %s", topName, err)
+				return
+			}
+			if _, err = top.CreateBucketIfNotExists(name); err != nil {
+				err = fmt.Errorf("Error creating %s bucket in %s: %s", name, topName, err)
+				return
+			}
+		}
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error creating buckets for createBuckets: %s", err)
+		return
+	}
+	return
+}
+
+// bucket gets the bucket named name from inside of the top level bucket
+func bucket(tx *bolt.Tx, topName []byte, name []byte) (b *bolt.Bucket, err error) {
+	var top *bolt.Bucket
+	if top = tx.Bucket(topName); top == nil {
+		err = fmt.Errorf("Bucket %s does not exist", topName)
+		return
+	}
+	if b = top.Bucket(name); b == nil {
+		err = fmt.Errorf("Bucket %s does not exist in %s", name, topName)
+		return
+	}
+	return
+}
+
+// sequenceKey turns a bucket sequence number into a key that sorts in the order it was made
+func sequenceKey(seq uint64) (key []byte) {
+	key = make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return
+}
+
+// accountKey is the key for the balance of a pubkey and sub-account. All of the sub-accounts of a
+// pubkey share the pubkey as a prefix.
+func accountKey(pubkey [33]byte, subAccount uint32) (key []byte) {
+	key = make([]byte, 37)
+	copy(key, pubkey[:])
+	binary.BigEndian.PutUint32(key[33:], subAccount)
+	return
+}
+
+// encodeValue encodes a value to be stored. We use gob since it's compact, json would write the
+// fixed size pubkeys and hashes out as arrays of numbers.
+func encodeValue(value interface{}) (valueBytes []byte, err error) {
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(value); err != nil {
+		err = fmt.Errorf("Error encoding value: %s", err)
+		return
+	}
+	valueBytes = buf.Bytes()
+	return
+}
+
+// decodeValue decodes a stored value into value
+func decodeValue(valueBytes []byte, value interface{}) (err error) {
+	if err = gob.NewDecoder(bytes.NewReader(valueBytes)).Decode(value); err != nil {
+		err = fmt.Errorf("Error decoding value: %s", err)
+		return
+	}
+	return
+}
@@ -0,0 +1,40 @@
+package cxdbkv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/match"
+)
+
+var testPair = match.Pair{AssetWant: match.BTCReg, AssetHave: match.LTCReg}
+
+// testCoins are the coins for the assets in the test pair
+func testCoins() (coins []*coinparam.Params) {
+	coins = []*coinparam.Params{&coinparam.RegressionNetParams, &coinparam.LiteRegNetParams}
+	return
+}
+
+// createTestDir creates a temporary directory for a test data file, the returned func removes it
+func createTestDir(t *testing.T) (dir string, cleanup func()) {
+	var err error
+	if dir, err = ioutil.TempDir("", "cxdbkv"); err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	cleanup = func() {
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+// openTestDB opens the test data file in dir
+func openTestDB(t *testing.T, dir string) (db *DB) {
+	var err error
+	if db, err = OpenDB(filepath.Join(dir, "test.db")); err != nil {
+		t.Fatalf("Error opening test db: %s", err)
+	}
+	return
+}
@@ -0,0 +1,466 @@
+package cxdbkv
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+	bolt "go.etcd.io/bbolt"
+)
+
+// KVDepositStore keeps the deposit addresses, deposit address indexes, and deposits for a coin in
+// the data file.
+type KVDepositStore struct {
+	db *DB
+
+	// this coin
+	coin *coinparam.Params
+}
+
+// depositRecord is how a deposit is stored. Deposits are kept after they are credited so they can
+// be reversed if there is a reorg deeper than the number of confirmations.
+type depositRecord struct {
+	Pubkey                []byte
+	ExpectedConfirmHeight uint64
+	DepositHeight         uint64
+	Amount                uint64
+	Txid                  string
+	Vout                  uint32
+	Address               string
+	BlockHash             string
+	Credited              bool
+	Swept                 bool
+}
+
+// CreateDepositStore creates a deposit store for a coin that keeps its deposits in db
+func CreateDepositStore(db *DB, coin *coinparam.Params) (store cxdb.DepositStore, err error) {
+	if err = db.createBuckets([]byte(coin.Name), depositBucket, depositAddrBucket, depositIndexBucket); err != nil {
+		err = fmt.Errorf("Error creating buckets for CreateDepositStore: %s", err)
+		return
+	}
+
+	store = &KVDepositStore{
+		db:   db,
+		coin: coin,
+	}
+	return
+}
+
+// UpdateDeposits adds the deposits, and returns the debits for every deposit that has reached its
+// expected confirm height and has not been credited yet.
+func (ds *KVDepositStore) UpdateDeposits(deposits []match.Deposit, blockheight uint64) (depositExecs []*match.SettlementExecution, err error) {
+
+	var depositAsset match.Asset
+	if depositAsset, err = match.AssetFromCoinParam(ds.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param for UpdateDeposits: %s", err)
+		return
+	}
+
+	if err = ds.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var depBucket *bolt.Bucket
+		if depBucket, err = bucket(tx, depositBucket, []byte(ds.coin.Name)); err != nil {
+			return
+		}
+
+		for _, deposit := range deposits {
+			record := &depositRecord{
+				Pubkey:                deposit.Pubkey.SerializeCompressed(),
+				ExpectedConfirmHeight: deposit.CreditHeight(),
+				DepositHeight:         deposit.BlockHeightReceived,
+				Amount:                deposit.Amount,
+				Txid:                  deposit.Txid,
+				Vout:                  deposit.Vout,
+				Address:               deposit.Address,
+				BlockHash:             deposit.BlockHash,
+			}
+			var seq uint64
+			if seq, err = depBucket.NextSequence(); err != nil {
+				err = fmt.Errorf("Error getting next deposit sequence: %s", err)
+				return
+			}
+			if err = putDepositRecord(depBucket, sequenceKey(seq), record); err != nil {
+				return
+			}
+		}
+
+		// Now credit the ones that have reached their expected confirm height
+		var creditedKeys [][]byte
+		var creditedRecords []*depositRecord
+		if err = forEachDepositRecord(depBucket, func(k []byte, record *depositRecord) (err error) {
+			if record.Credited || record.ExpectedConfirmHeight > blockheight {
+				return
+			}
+			currSettlement := &match.SettlementExecution{
+				Amount:    record.Amount,
+				Asset:     depositAsset,
+				Type:      match.Debit,
+				Reason:    match.ReasonDeposit,
+				Reference: record.Txid,
+			}
+			copy(currSettlement.Pubkey[:], record.Pubkey)
+			depositExecs = append(depositExecs, currSettlement)
+
+			record.Credited = true
+			creditedKeys = append(creditedKeys, k)
+			creditedRecords = append(creditedRecords, record)
+			return
+		}); err != nil {
+			return
+		}
+
+		// Mark them as credited so they are never credited twice
+		for i, k := range creditedKeys {
+			if err = putDepositRecord(depBucket, k, creditedRecords[i]); err != nil {
+				return
+			}
+		}
+		return
+	}); err != nil {
+		depositExecs = nil
+		err = fmt.Errorf("Error updating deposits for UpdateDeposits: %s", err)
+		return
+	}
+
+	return
+}
+
+// RollbackDeposits removes the deposits that were received in the orphaned blocks. Deposits
+// that were already credited are returned as credit executions that reverse them.
+func (ds *KVDepositStore) RollbackDeposits(orphanedBlockHashes []string) (reorgExecs []*match.SettlementExecution, err error) {
+
+	if len(orphanedBlockHashes) == 0 {
+		return
+	}
+
+	var depositAsset match.Asset
+	if depositAsset, err = match.AssetFromCoinParam(ds.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param for RollbackDeposits: %s", err)
+		return
+	}
+
+	orphaned := make(map[string]bool)
+	for _, hash := range orphanedBlockHashes {
+		orphaned[hash] = true
+	}
+
+	if err = ds.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var depBucket *bolt.Bucket
+		if depBucket, err = bucket(tx, depositBucket, []byte(ds.coin.Name)); err != nil {
+			return
+		}
+
+		var orphanedKeys [][]byte
+		if err = forEachDepositRecord(depBucket, func(k []byte, record *depositRecord) (err error) {
+			if !orphaned[record.BlockHash] {
+				return
+			}
+			orphanedKeys = append(orphanedKeys, k)
+			if !record.Credited {
+				return
+			}
+			currSettlement := &match.SettlementExecution{
+				Amount:    record.Amount,
+				Asset:     depositAsset,
+				Type:      match.Credit,
+				Reason:    match.ReasonDepositReorg,
+				Reference: record.Txid,
+			}
+			copy(currSettlement.Pubkey[:], record.Pubkey)
+			reorgExecs = append(reorgExecs, currSettlement)
+			return
+		}); err != nil {
+			return
+		}
+
+		// Now delete all deposits from the orphaned blocks, credited or not
+		for _, k := range orphanedKeys {
+			if err = depBucket.Delete(k); err != nil {
+				err = fmt.Errorf("Error deleting orphaned deposit: %s", err)
+				return
+			}
+		}
+		return
+	}); err != nil {
+		reorgExecs = nil
+		err = fmt.Errorf("Error rolling back deposits for RollbackDeposits: %s", err)
+		return
+	}
+
+	return
+}
+
+// GetPendingDeposits gets the deposits for a pubkey that have been received but not yet credited
+func (ds *KVDepositStore) GetPendingDeposits(pubkey *koblitz.PublicKey) (pending []*match.Deposit, err error) {
+	if pending, err = ds.getDepositsForPubkey(pubkey, false); err != nil {
+		err = fmt.Errorf("Error getting uncredited deposits for GetPendingDeposits: %s", err)
+		return
+	}
+	return
+}
+
+// GetDepositHistory gets the deposits for a pubkey that have been credited
+func (ds *KVDepositStore) GetDepositHistory(pubkey *koblitz.PublicKey) (history []*match.Deposit, err error) {
+	if history, err = ds.getDepositsForPubkey(pubkey, true); err != nil {
+		err = fmt.Errorf("Error getting credited deposits for GetDepositHistory: %s", err)
+		return
+	}
+	return
+}
+
+// getDepositsForPubkey gets either the credited or uncredited deposits for a pubkey, in the order
+// they were received
+func (ds *KVDepositStore) getDepositsForPubkey(pubkey *koblitz.PublicKey, credited bool) (deposits []*match.Deposit, err error) {
+	pubkeyString := string(pubkey.SerializeCompressed())
+	var records []*depositRecord
+	if records, err = ds.getDepositRecords(func(record *depositRecord) bool {
+		return string(record.Pubkey) == pubkeyString && record.Credited == credited
+	}); err != nil {
+		err = fmt.Errorf("Error getting deposit records for getDepositsForPubkey: %s", err)
+		return
+	}
+
+	for _, record := range records {
+		currDeposit := ds.depositFromRecord(record)
+		currDeposit.Pubkey = pubkey
+		deposits = append(deposits, currDeposit)
+	}
+	return
+}
+
+// GetDepositIndex gets the index used to derive deposit addresses for a pubkey, assigning the next
+// unused index if the pubkey does not have one yet.
+func (ds *KVDepositStore) GetDepositIndex(pubkey *koblitz.PublicKey) (index uint32, err error) {
+	if err = ds.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var indexes *bolt.Bucket
+		if indexes, err = bucket(tx, depositIndexBucket, []byte(ds.coin.Name)); err != nil {
+			return
+		}
+
+		var indexBytes []byte
+		if indexBytes = indexes.Get(pubkey.SerializeCompressed()); indexBytes != nil {
+			index = binary.BigEndian.Uint32(indexBytes)
+			return
+		}
+
+		// The pubkey doesn't have an index, so give it the next one
+		var seq uint64
+		if seq, err = indexes.NextSequence(); err != nil {
+			err = fmt.Errorf("Error getting next deposit index: %s", err)
+			return
+		}
+		index = uint32(seq - 1)
+		indexBytes = make([]byte, 4)
+		binary.BigEndian.PutUint32(indexBytes, index)
+		err = indexes.Put(pubkey.SerializeCompressed(), indexBytes)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error getting deposit index for GetDepositIndex: %s", err)
+		return
+	}
+	return
+}
+
+// GetSweepableDeposits gets all credited deposits whose outputs have not been swept yet
+func (ds *KVDepositStore) GetSweepableDeposits() (deposits []*match.Deposit, err error) {
+	var records []*depositRecord
+	if records, err = ds.getDepositRecords(func(record *depositRecord) bool {
+		return record.Credited && !record.Swept
+	}); err != nil {
+		err = fmt.Errorf("Error getting deposit records for GetSweepableDeposits: %s", err)
+		return
+	}
+
+	for _, record := range records {
+		currDeposit := ds.depositFromRecord(record)
+		if currDeposit.Pubkey, err = koblitz.ParsePubKey(record.Pubkey, koblitz.S256()); err != nil {
+			deposits = nil
+			err = fmt.Errorf("Error parsing pubkey for GetSweepableDeposits: %s", err)
+			return
+		}
+		deposits = append(deposits, currDeposit)
+	}
+	return
+}
+
+// MarkDepositsSwept marks the outputs of the given deposits as swept
+func (ds *KVDepositStore) MarkDepositsSwept(deposits []*match.Deposit) (err error) {
+	swept := make(map[string]bool)
+	for _, deposit := range deposits {
+		swept[fmt.Sprintf("%s:%d", deposit.Txid, deposit.Vout)] = true
+	}
+
+	if err = ds.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var depBucket *bolt.Bucket
+		if depBucket, err = bucket(tx, depositBucket, []byte(ds.coin.Name)); err != nil {
+			return
+		}
+		var sweptKeys [][]byte
+		var sweptRecords []*depositRecord
+		if err = forEachDepositRecord(depBucket, func(k []byte, record *depositRecord) (err error) {
+			if swept[fmt.Sprintf("%s:%d", record.Txid, record.Vout)] {
+				record.Swept = true
+				sweptKeys = append(sweptKeys, k)
+				sweptRecords = append(sweptRecords, record)
+			}
+			return
+		}); err != nil {
+			return
+		}
+
+		for i, k := range sweptKeys {
+			if err = putDepositRecord(depBucket, k, sweptRecords[i]); err != nil {
+				return
+			}
+		}
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error marking deposits swept for MarkDepositsSwept: %s", err)
+		return
+	}
+	return
+}
+
+// GetDepositAddressMap gets a map of the deposit addresses we own to pubkeys
+func (ds *KVDepositStore) GetDepositAddressMap() (depAddrMap map[string]*koblitz.PublicKey, err error) {
+	depAddrMap = make(map[string]*koblitz.PublicKey)
+	if err = ds.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var addrs *bolt.Bucket
+		if addrs, err = bucket(tx, depositAddrBucket, []byte(ds.coin.Name)); err != nil {
+			return
+		}
+		err = addrs.ForEach(func(k, v []byte) (err error) {
+			if depAddrMap[string(v)], err = koblitz.ParsePubKey(k, koblitz.S256()); err != nil {
+				err = fmt.Errorf("Error parsing pubkey: %s", err)
+				return
+			}
+			return
+		})
+		return
+	}); err != nil {
+		depAddrMap = nil
+		err = fmt.Errorf("Error getting deposit addresses for GetDepositAddressMap: %s", err)
+		return
+	}
+	return
+}
+
+// GetDepositAddress gets the deposit address for a pubkey and an asset.
+func (ds *KVDepositStore) GetDepositAddress(pubkey *koblitz.PublicKey) (addr string, err error) {
+	if err = ds.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var addrs *bolt.Bucket
+		if addrs, err = bucket(tx, depositAddrBucket, []byte(ds.coin.Name)); err != nil {
+			return
+		}
+		var addrBytes []byte
+		if addrBytes = addrs.Get(pubkey.SerializeCompressed()); addrBytes == nil {
+			err = fmt.Errorf("No deposit address for pubkey %x", pubkey.SerializeCompressed())
+			return
+		}
+		addr = string(addrBytes)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error getting deposit address for GetDepositAddress: %s", err)
+		return
+	}
+	return
+}
+
+// RegisterUser takes in a pubkey, and an address for the pubkey, and puts the deposit address as the
+// value for the user's pubkey key
+func (ds *KVDepositStore) RegisterUser(pubkey *koblitz.PublicKey, address string) (err error) {
+	if err = ds.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var addrs *bolt.Bucket
+		if addrs, err = bucket(tx, depositAddrBucket, []byte(ds.coin.Name)); err != nil {
+			return
+		}
+		err = addrs.Put(pubkey.SerializeCompressed(), []byte(address))
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error registering user for RegisterUser: %s", err)
+		return
+	}
+	return
+}
+
+// getDepositRecords gets every deposit record that keep returns true for, in the order they were
+// received
+func (ds *KVDepositStore) getDepositRecords(keep func(record *depositRecord) bool) (records []*depositRecord, err error) {
+	err = ds.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var depBucket *bolt.Bucket
+		if depBucket, err = bucket(tx, depositBucket, []byte(ds.coin.Name)); err != nil {
+			return
+		}
+		err = forEachDepositRecord(depBucket, func(k []byte, record *depositRecord) (err error) {
+			if keep(record) {
+				records = append(records, record)
+			}
+			return
+		})
+		return
+	})
+	return
+}
+
+// depositFromRecord turns a deposit record into a deposit, without the pubkey
+func (ds *KVDepositStore) depositFromRecord(record *depositRecord) (deposit *match.Deposit) {
+	deposit = &match.Deposit{
+		Address:             record.Address,
+		Amount:              record.Amount,
+		Txid:                record.Txid,
+		Vout:                record.Vout,
+		CoinType:            ds.coin,
+		BlockHeightReceived: record.DepositHeight,
+		BlockHash:           record.BlockHash,
+		Confirmations:       record.ExpectedConfirmHeight - record.DepositHeight,
+	}
+	return
+}
+
+// putDepositRecord writes a deposit record at key
+func putDepositRecord(depBucket *bolt.Bucket, key []byte, record *depositRecord) (err error) {
+	var recordBytes []byte
+	if recordBytes, err = encodeValue(record); err != nil {
+		err = fmt.Errorf("Error encoding deposit: %s", err)
+		return
+	}
+	if err = depBucket.Put(key, recordBytes); err != nil {
+		err = fmt.Errorf("Error putting deposit: %s", err)
+		return
+	}
+	return
+}
+
+// forEachDepositRecord calls fn on every deposit record in the order they were received. Bolt does
+// not allow writing to the bucket while iterating, so the key passed to fn is a copy that can be
+// written to afterwards.
+func forEachDepositRecord(depBucket *bolt.Bucket, fn func(k []byte, record *depositRecord) error) (err error) {
+	err = depBucket.ForEach(func(k, v []byte) (err error) {
+		record := new(depositRecord)
+		if err = decodeValue(v, record); err != nil {
+			err = fmt.Errorf("Error decoding deposit %x: %s", k, err)
+			return
+		}
+		err = fn(append([]byte{}, k...), record)
+		return
+	})
+	return
+}
+
+// CreateDepositStoreMap creates a map of coin to deposit store, given a list of coins.
+func CreateDepositStoreMap(db *DB, coinList []*coinparam.Params) (depositMap map[*coinparam.Params]cxdb.DepositStore, err error) {
+
+	depositMap = make(map[*coinparam.Params]cxdb.DepositStore)
+	var curDepositStore cxdb.DepositStore
+	for _, coin := range coinList {
+		if curDepositStore, err = CreateDepositStore(db, coin); err != nil {
+			err = fmt.Errorf("Error creating single deposit store while creating deposit store map: %s", err)
+			return
+		}
+		depositMap[coin] = curDepositStore
+	}
+
+	return
+}
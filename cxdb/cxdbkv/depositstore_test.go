@@ -0,0 +1,107 @@
+package cxdbkv
+
+import (
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// testDepositAt creates a 1BTC test deposit received in the block with the given hash and height
+func testDepositAt(t *testing.T, blockHash string, height uint64) (deposit match.Deposit) {
+	var err error
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Fatalf("Error creating private key for test deposit: %s", err)
+	}
+	deposit = match.Deposit{
+		Pubkey:              privkey.PubKey(),
+		Address:             "testaddress",
+		Amount:              uint64(100000000),
+		Txid:                blockHash + "txid",
+		CoinType:            &coinparam.RegressionNetParams,
+		BlockHeightReceived: height,
+		BlockHash:           blockHash,
+		Confirmations:       6,
+	}
+	return
+}
+
+func TestDepositReorg(t *testing.T) {
+	var err error
+
+	dir, cleanup := createTestDir(t)
+	defer cleanup()
+
+	db := openTestDB(t, dir)
+	defer db.Close()
+
+	var store cxdb.DepositStore
+	if store, err = CreateDepositStore(db, &coinparam.RegressionNetParams); err != nil {
+		t.Errorf("Error creating deposit store for TestDepositReorg: %s", err)
+		return
+	}
+
+	// one deposit that will be credited then reorged, and one that stays in the main chain
+	creditedDeposit := testDepositAt(t, "orphanA", 100)
+	safeDeposit := testDepositAt(t, "mainB", 103)
+
+	if _, err = store.UpdateDeposits([]match.Deposit{creditedDeposit, safeDeposit}, 103); err != nil {
+		t.Errorf("Error updating deposits for TestDepositReorg: %s", err)
+		return
+	}
+
+	var execs []*match.SettlementExecution
+	if execs, err = store.UpdateDeposits([]match.Deposit{}, 106); err != nil {
+		t.Errorf("Error updating deposits for TestDepositReorg: %s", err)
+		return
+	}
+	if len(execs) != 1 || execs[0].Type != match.Debit || execs[0].Reference != creditedDeposit.Txid {
+		t.Errorf("Expected only the first deposit to be credited at height 106, got %d execs", len(execs))
+		return
+	}
+
+	// Seeing the same height again should not credit twice
+	if execs, err = store.UpdateDeposits([]match.Deposit{}, 106); err != nil {
+		t.Errorf("Error updating deposits for TestDepositReorg: %s", err)
+		return
+	}
+	if len(execs) != 0 {
+		t.Errorf("Deposit should not be credited twice, got %d execs", len(execs))
+		return
+	}
+
+	var reorgExecs []*match.SettlementExecution
+	if reorgExecs, err = store.RollbackDeposits([]string{"orphanA"}); err != nil {
+		t.Errorf("Error rolling back deposits for TestDepositReorg: %s", err)
+		return
+	}
+	if len(reorgExecs) != 1 || reorgExecs[0].Type != match.Credit || reorgExecs[0].Amount != creditedDeposit.Amount {
+		t.Errorf("Expected 1 reorg exec reversing the credited deposit, got %d", len(reorgExecs))
+		return
+	}
+
+	var history []*match.Deposit
+	if history, err = store.GetDepositHistory(creditedDeposit.Pubkey); err != nil {
+		t.Errorf("Error getting deposit history for TestDepositReorg: %s", err)
+		return
+	}
+	if len(history) != 0 {
+		t.Errorf("Reorged deposit should not be in the history, got %d deposits", len(history))
+		return
+	}
+
+	var pending []*match.Deposit
+	if pending, err = store.GetPendingDeposits(safeDeposit.Pubkey); err != nil {
+		t.Errorf("Error getting pending deposits for TestDepositReorg: %s", err)
+		return
+	}
+	if len(pending) != 1 || pending[0].Confirmations != safeDeposit.Confirmations {
+		t.Errorf("Main chain deposit should still be pending with %d confirmations, got %d deposits", safeDeposit.Confirmations, len(pending))
+		return
+	}
+
+	return
+}
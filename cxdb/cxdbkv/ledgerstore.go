@@ -0,0 +1,317 @@
+package cxdbkv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The KVLedgerStore reads the ledger that the KVSettlementEngine writes to, and compares it to the
+// balances the settlement engine keeps.
+type KVLedgerStore struct {
+	db *DB
+
+	// this coin
+	coin *coinparam.Params
+}
+
+// ledgerTotalAccount is the account a mismatch is reported for if the whole ledger doesn't sum to
+// zero
+const ledgerTotalAccount = "total"
+
+// CreateLedgerStore creates a ledger store for a coin whose ledger is in db
+func CreateLedgerStore(db *DB, coin *coinparam.Params) (store cxdb.LedgerStore, err error) {
+	if err = db.createBuckets([]byte(coin.Name), balanceBucket, ledgerBucket); err != nil {
+		err = fmt.Errorf("Error creating buckets for CreateLedgerStore: %s", err)
+		return
+	}
+
+	store = &KVLedgerStore{
+		db:   db,
+		coin: coin,
+	}
+	return
+}
+
+// GetAccountStatement gets every ledger entry for the pubkey between from and to, with the balance
+// before and after them.
+func (ls *KVLedgerStore) GetAccountStatement(pubkey *koblitz.PublicKey, from time.Time, to time.Time) (statement *match.AccountStatement, err error) {
+	if to.Before(from) {
+		err = fmt.Errorf("Statement end %s is before the start %s", to, from)
+		return
+	}
+
+	var statementAsset match.Asset
+	if statementAsset, err = match.AssetFromCoinParam(ls.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param for GetAccountStatement: %s", err)
+		return
+	}
+
+	statement = &match.AccountStatement{
+		Asset: statementAsset,
+		From:  from,
+		To:    to,
+	}
+	copy(statement.Pubkey[:], pubkey.SerializeCompressed())
+
+	account := fmt.Sprintf("%x", pubkey.SerializeCompressed())
+	var openingBalance int64
+	var closingBalance int64
+	if err = ls.forEachEntry(func(entry *match.LedgerEntry) (err error) {
+		if entry.Account != account || !entry.Time.Before(to) {
+			return
+		}
+		if entry.Time.Before(from) {
+			openingBalance += signedAmount(entry)
+			return
+		}
+		closingBalance += signedAmount(entry)
+		statement.Entries = append(statement.Entries, entry)
+		return
+	}); err != nil {
+		statement = nil
+		err = fmt.Errorf("Error reading ledger for GetAccountStatement: %s", err)
+		return
+	}
+
+	statement.OpeningBalance = uint64(openingBalance)
+	statement.ClosingBalance = uint64(openingBalance + closingBalance)
+	return
+}
+
+// CheckConsistency recomputes every user's balance from the ledger and compares it to the balance
+// in the settlement engine. It also makes sure the whole ledger sums to zero.
+func (ls *KVLedgerStore) CheckConsistency() (mismatches []*match.LedgerMismatch, err error) {
+
+	var ledgerAsset match.Asset
+	if ledgerAsset, err = match.AssetFromCoinParam(ls.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param for CheckConsistency: %s", err)
+		return
+	}
+
+	// The exchange accounts don't have a balance anywhere else, so we only compare users
+	var ledgerTotal int64
+	ledgerBalances := make(map[string]int64)
+	if err = ls.forEachEntry(func(entry *match.LedgerEntry) (err error) {
+		ledgerTotal += signedAmount(entry)
+		if !strings.HasPrefix(entry.Account, match.ExchangeAccountPrefix) {
+			ledgerBalances[entry.Account] += signedAmount(entry)
+		}
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error reading ledger for CheckConsistency: %s", err)
+		return
+	}
+
+	if ledgerTotal != 0 {
+		mismatches = append(mismatches, &match.LedgerMismatch{
+			Account:       ledgerTotalAccount,
+			Asset:         ledgerAsset,
+			LedgerBalance: ledgerTotal,
+		})
+	}
+
+	if err = ls.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var balances *bolt.Bucket
+		if balances, err = bucket(tx, balanceBucket, []byte(ls.coin.Name)); err != nil {
+			return
+		}
+		err = balances.ForEach(func(k, v []byte) (err error) {
+			acct := match.Account{SubAccount: binary.BigEndian.Uint32(k[33:])}
+			copy(acct.Pubkey[:], k[:33])
+			account := acct.String()
+			amount := int64(binary.BigEndian.Uint64(v))
+			if ledgerBalances[account] != amount {
+				mismatches = append(mismatches, &match.LedgerMismatch{
+					Account:       account,
+					Asset:         ledgerAsset,
+					Balance:       amount,
+					LedgerBalance: ledgerBalances[account],
+				})
+			}
+			delete(ledgerBalances, account)
+			return
+		})
+		return
+	}); err != nil {
+		mismatches = nil
+		err = fmt.Errorf("Error reading balances for CheckConsistency: %s", err)
+		return
+	}
+
+	// anything left has entries in the ledger but no balance at all
+	for account, amount := range ledgerBalances {
+		if amount != 0 {
+			mismatches = append(mismatches, &match.LedgerMismatch{
+				Account:       account,
+				Asset:         ledgerAsset,
+				LedgerBalance: amount,
+			})
+		}
+	}
+
+	return
+}
+
+// GetFeeBalance gets the total of the fees the exchange has collected, which is the balance of the
+// exchange's fee account in the ledger.
+func (ls *KVLedgerStore) GetFeeBalance() (fees uint64, err error) {
+	feeAccount := match.ReasonFee.CounterAccount()
+	var feeBalance int64
+	if err = ls.forEachEntry(func(entry *match.LedgerEntry) (err error) {
+		if entry.Account == feeAccount {
+			feeBalance += signedAmount(entry)
+		}
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error reading ledger for GetFeeBalance: %s", err)
+		return
+	}
+
+	// fees are taken from users, so the exchange side of those entries is positive
+	if feeBalance > 0 {
+		fees = uint64(feeBalance)
+	}
+	return
+}
+
+// GetTransferNonces gets the nonce of the last transfer from each pubkey, from the ledger entries
+// for the senders of transfers
+func (ls *KVLedgerStore) GetTransferNonces() (nonces map[[33]byte]uint64, err error) {
+	nonces = make(map[[33]byte]uint64)
+	if err = ls.forEachEntry(func(entry *match.LedgerEntry) (err error) {
+		// the sender's side of a transfer is the credit to a user's account
+		if entry.Reason != match.ReasonTransfer || entry.Type != match.Credit {
+			return
+		}
+		nonce, ok := match.TransferNonceFromReference(entry.Reference)
+		if !ok {
+			return
+		}
+		var account match.Account
+		if account, err = match.ParseAccount(entry.Account); err != nil {
+			err = fmt.Errorf("Error parsing transfer sender: %s", err)
+			return
+		}
+		if nonce > nonces[account.Pubkey] {
+			nonces[account.Pubkey] = nonce
+		}
+		return
+	}); err != nil {
+		nonces = nil
+		err = fmt.Errorf("Error reading ledger for GetTransferNonces: %s", err)
+		return
+	}
+	return
+}
+
+// GetLedger gets every entry in the ledger, in the order they were written
+func (ls *KVLedgerStore) GetLedger() (entries []*match.LedgerEntry, err error) {
+	if err = ls.forEachEntry(func(entry *match.LedgerEntry) (err error) {
+		entries = append(entries, entry)
+		return
+	}); err != nil {
+		entries = nil
+		err = fmt.Errorf("Error reading ledger for GetLedger: %s", err)
+		return
+	}
+	return
+}
+
+// ReplaceLedger replaces every entry in the ledger with the entries given, keeping their IDs. The
+// next entry written gets the ID after the last one given.
+func (ls *KVLedgerStore) ReplaceLedger(entries []*match.LedgerEntry) (err error) {
+	if err = ls.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var top *bolt.Bucket
+		if top = tx.Bucket(ledgerBucket); top == nil {
+			err = fmt.Errorf("Bucket %s does not exist", ledgerBucket)
+			return
+		}
+		if err = top.DeleteBucket([]byte(ls.coin.Name)); err != nil {
+			err = fmt.Errorf("Error deleting ledger: %s", err)
+			return
+		}
+		var ledger *bolt.Bucket
+		if ledger, err = top.CreateBucket([]byte(ls.coin.Name)); err != nil {
+			err = fmt.Errorf("Error creating ledger: %s", err)
+			return
+		}
+
+		var lastID uint64
+		for _, entry := range entries {
+			if entry.ID <= lastID {
+				err = fmt.Errorf("Ledger entry %d is not after entry %d", entry.ID, lastID)
+				return
+			}
+			lastID = entry.ID
+			var entryBytes []byte
+			if entryBytes, err = encodeValue(entry); err != nil {
+				err = fmt.Errorf("Error encoding ledger entry: %s", err)
+				return
+			}
+			if err = ledger.Put(sequenceKey(entry.ID), entryBytes); err != nil {
+				err = fmt.Errorf("Error putting ledger entry: %s", err)
+				return
+			}
+		}
+		err = ledger.SetSequence(lastID)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error replacing ledger for ReplaceLedger: %s", err)
+		return
+	}
+	return
+}
+
+// forEachEntry calls fn on every entry in the ledger, in the order they were written
+func (ls *KVLedgerStore) forEachEntry(fn func(entry *match.LedgerEntry) error) (err error) {
+	err = ls.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var ledger *bolt.Bucket
+		if ledger, err = bucket(tx, ledgerBucket, []byte(ls.coin.Name)); err != nil {
+			return
+		}
+		err = ledger.ForEach(func(k, v []byte) (err error) {
+			entry := new(match.LedgerEntry)
+			if err = decodeValue(v, entry); err != nil {
+				err = fmt.Errorf("Error decoding ledger entry %x: %s", k, err)
+				return
+			}
+			err = fn(entry)
+			return
+		})
+		return
+	})
+	return
+}
+
+// signedAmount is the amount of the entry, negative if it is a credit
+func signedAmount(entry *match.LedgerEntry) (amount int64) {
+	amount = int64(entry.Amount)
+	if entry.Type == match.Credit {
+		amount = -amount
+	}
+	return
+}
+
+// CreateLedgerStoreMap creates a map of coin to ledger store, given a list of coins.
+func CreateLedgerStoreMap(db *DB, coins []*coinparam.Params) (ledgerMap map[*coinparam.Params]cxdb.LedgerStore, err error) {
+
+	ledgerMap = make(map[*coinparam.Params]cxdb.LedgerStore)
+	var curLedgerStore cxdb.LedgerStore
+	for _, coin := range coins {
+		if curLedgerStore, err = CreateLedgerStore(db, coin); err != nil {
+			err = fmt.Errorf("Error creating single ledger store while creating ledger store map: %s", err)
+			return
+		}
+		ledgerMap[coin] = curLedgerStore
+	}
+
+	return
+}
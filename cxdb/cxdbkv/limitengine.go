@@ -0,0 +1,334 @@
+package cxdbkv
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mit-dci/opencx/match"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/sha3"
+)
+
+// KVLimitEngine is a limit matching engine that keeps its orders in the data file
+type KVLimitEngine struct {
+	db *DB
+
+	// this pair
+	pair *match.Pair
+}
+
+// CreateLimitEngine creates a limit matching engine for a pair that keeps its orders in db
+func CreateLimitEngine(db *DB, pair *match.Pair) (engine match.LimitEngine, err error) {
+	if err = db.createBuckets([]byte(pair.String()), limitEngineBucket); err != nil {
+		err = fmt.Errorf("Error creating buckets for CreateLimitEngine: %s", err)
+		return
+	}
+
+	engine = &KVLimitEngine{
+		db:   db,
+		pair: pair,
+	}
+	return
+}
+
+// PlaceLimitOrder places an order in the limit matching engine.
+// This assumes that the order is valid and is for the same pair as the matching engine
+func (le *KVLimitEngine) PlaceLimitOrder(order *match.LimitOrder) (idRes *match.LimitOrderIDPair, err error) {
+	if order == nil {
+		err = fmt.Errorf("Cannot place nil order, please enter valid input")
+		return
+	}
+
+	var orderBytes []byte
+	if orderBytes, err = encodeValue(order); err != nil {
+		err = fmt.Errorf("Error encoding while placing order: %s", err)
+		return
+	}
+
+	var price float64
+	if price, err = order.Price(); err != nil {
+		err = fmt.Errorf("Error getting price from order while placing order: %s", err)
+		return
+	}
+
+	if price == float64(0) {
+		err = fmt.Errorf("Placing 0-valued order is not allowed")
+		return
+	}
+
+	loid := &match.LimitOrderIDPair{
+		OrderID:   new(match.OrderID),
+		Order:     order,
+		Price:     price,
+		Timestamp: time.Now(),
+	}
+
+	if err = le.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, limitEngineBucket, []byte(le.pair.String())); err != nil {
+			return
+		}
+
+		// Orders are keyed by ID, so the same order placed twice still needs a different ID. The
+		// ID is the hash of the order, the placement time, and how many orders came before it.
+		var seq uint64
+		if seq, err = orders.NextSequence(); err != nil {
+			err = fmt.Errorf("Error getting next order sequence: %s", err)
+			return
+		}
+		hasher := sha3.New256()
+		hasher.Write(orderBytes)
+		hasher.Write(sequenceKey(uint64(loid.Timestamp.UnixNano())))
+		hasher.Write(sequenceKey(seq))
+		if err = loid.OrderID.UnmarshalBinary(hasher.Sum(nil)); err != nil {
+			err = fmt.Errorf("Could not unmarshal order ID: %s", err)
+			return
+		}
+
+		err = putLimitOrder(orders, loid)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error placing order for PlaceLimitOrder: %s", err)
+		return
+	}
+
+	idRes = loid
+	return
+}
+
+// CancelLimitOrder cancels a limit order, this assumes that the limit order actually exists
+func (le *KVLimitEngine) CancelLimitOrder(orderID *match.OrderID) (cancelled *match.CancelledOrder, cancelSettlement *match.SettlementExecution, err error) {
+	var cancelledOrder *match.LimitOrderIDPair
+	if err = le.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, limitEngineBucket, []byte(le.pair.String())); err != nil {
+			return
+		}
+		if cancelledOrder, err = getLimitOrder(orders, orderID); err != nil {
+			return
+		}
+		err = orders.Delete(orderID[:])
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error cancelling order for CancelLimitOrder: %s", err)
+		return
+	}
+
+	cancelled = &match.CancelledOrder{
+		OrderID: orderID,
+	}
+
+	// swap orders don't hold anything on the exchange, so there's nothing to give back
+	if cancelledOrder.Order.Swap {
+		return
+	}
+
+	var debitAsset match.Asset
+	if cancelledOrder.Order.Side == match.Buy {
+		debitAsset = le.pair.AssetHave
+	} else {
+		debitAsset = le.pair.AssetWant
+	}
+	cancelSettlement = &match.SettlementExecution{
+		Pubkey:     cancelledOrder.Order.Pubkey,
+		SubAccount: cancelledOrder.Order.SubAccount,
+		Amount:     cancelledOrder.Order.AmountHave,
+		Type:       match.Debit,
+		Asset:      debitAsset,
+		Reason:     match.ReasonCancelRefund,
+		Reference:  hex.EncodeToString(orderID[:]),
+	}
+
+	return
+}
+
+// RestoreLimitOrder puts an order back into the engine with the ID and timestamp it was placed with
+func (le *KVLimitEngine) RestoreLimitOrder(loid *match.LimitOrderIDPair) (err error) {
+	if err = le.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, limitEngineBucket, []byte(le.pair.String())); err != nil {
+			return
+		}
+		if orders.Get(loid.OrderID[:]) != nil {
+			err = fmt.Errorf("Order %x is already in the engine", loid.OrderID[:])
+			return
+		}
+		err = putLimitOrder(orders, loid)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error restoring order for RestoreLimitOrder: %s", err)
+		return
+	}
+	return
+}
+
+// MatchLimitOrders matches limit orders based on price/time priority
+func (le *KVLimitEngine) MatchLimitOrders() (orderExecs []*match.OrderExecution, settlementExecs []*match.SettlementExecution, swaps []*match.SwapInstruction, err error) {
+	if err = le.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, limitEngineBucket, []byte(le.pair.String())); err != nil {
+			return
+		}
+
+		var book []*match.LimitOrderIDPair
+		if book, err = getLimitOrders(orders); err != nil {
+			return
+		}
+
+		// Find the max sell price and the min buy price, if either side is empty there's nothing
+		// to match
+		var sellOrders []*match.LimitOrderIDPair
+		var buyOrders []*match.LimitOrderIDPair
+		var maxSell float64
+		var minBuy float64
+		for _, lp := range book {
+			if lp.Order.Side == match.Sell {
+				if len(sellOrders) == 0 || lp.Price > maxSell {
+					maxSell = lp.Price
+				}
+				sellOrders = append(sellOrders, lp)
+			} else {
+				if len(buyOrders) == 0 || lp.Price < minBuy {
+					minBuy = lp.Price
+				}
+				buyOrders = append(buyOrders, lp)
+			}
+		}
+		if len(sellOrders) == 0 || len(buyOrders) == 0 || minBuy > maxSell {
+			return
+		}
+
+		// the sell orders that can match are sorted by price descending and time ascending, and the
+		// buy orders by price ascending and time ascending, so the best prices match first and
+		// within the best price the earliest orders match first.
+		sellOrders = filterLimitOrders(sellOrders, func(lp *match.LimitOrderIDPair) bool { return lp.Price >= minBuy })
+		sort.SliceStable(sellOrders, func(i, j int) bool {
+			if sellOrders[i].Price != sellOrders[j].Price {
+				return sellOrders[i].Price > sellOrders[j].Price
+			}
+			return sellOrders[i].Timestamp.Before(sellOrders[j].Timestamp)
+		})
+		buyOrders = filterLimitOrders(buyOrders, func(lp *match.LimitOrderIDPair) bool { return lp.Price <= maxSell })
+		sort.SliceStable(buyOrders, func(i, j int) bool {
+			if buyOrders[i].Price != buyOrders[j].Price {
+				return buyOrders[i].Price < buyOrders[j].Price
+			}
+			return buyOrders[i].Timestamp.Before(buyOrders[j].Timestamp)
+		})
+
+		if orderExecs, settlementExecs, swaps, err = match.MatchPrioritizedOrders(buyOrders, sellOrders); err != nil {
+			err = fmt.Errorf("Error matching prioritized orders: %s", err)
+			return
+		}
+
+		// Update the matching engine with the new state
+		for _, orderExec := range orderExecs {
+			if err = updateLimitOrder(orders, orderExec); err != nil {
+				return
+			}
+		}
+		return
+	}); err != nil {
+		orderExecs = nil
+		settlementExecs = nil
+		swaps = nil
+		err = fmt.Errorf("Error matching orders for MatchLimitOrders: %s", err)
+		return
+	}
+
+	return
+}
+
+// filterLimitOrders returns the orders that keep returns true for
+func filterLimitOrders(orders []*match.LimitOrderIDPair, keep func(*match.LimitOrderIDPair) bool) (filtered []*match.LimitOrderIDPair) {
+	for _, lp := range orders {
+		if keep(lp) {
+			filtered = append(filtered, lp)
+		}
+	}
+	return
+}
+
+// putLimitOrder writes an order to a bucket of limit orders, keyed by order ID
+func putLimitOrder(orders *bolt.Bucket, lp *match.LimitOrderIDPair) (err error) {
+	var orderBytes []byte
+	if orderBytes, err = encodeValue(lp); err != nil {
+		err = fmt.Errorf("Error encoding order: %s", err)
+		return
+	}
+	if err = orders.Put(lp.OrderID[:], orderBytes); err != nil {
+		err = fmt.Errorf("Error putting order: %s", err)
+		return
+	}
+	return
+}
+
+// getLimitOrder reads an order from a bucket of limit orders
+func getLimitOrder(orders *bolt.Bucket, orderID *match.OrderID) (lp *match.LimitOrderIDPair, err error) {
+	var orderBytes []byte
+	if orderBytes = orders.Get(orderID[:]); orderBytes == nil {
+		err = fmt.Errorf("Order %x does not exist", orderID[:])
+		return
+	}
+	lp = new(match.LimitOrderIDPair)
+	if err = decodeValue(orderBytes, lp); err != nil {
+		err = fmt.Errorf("Error decoding order %x: %s", orderID[:], err)
+		return
+	}
+	return
+}
+
+// getLimitOrders reads every order from a bucket of limit orders
+func getLimitOrders(orders *bolt.Bucket) (book []*match.LimitOrderIDPair, err error) {
+	err = orders.ForEach(func(k, v []byte) (err error) {
+		lp := new(match.LimitOrderIDPair)
+		if err = decodeValue(v, lp); err != nil {
+			err = fmt.Errorf("Error decoding order %x: %s", k, err)
+			return
+		}
+		book = append(book, lp)
+		return
+	})
+	return
+}
+
+// updateLimitOrder deletes the order in the execution if it was filled, and updates its amounts
+// if it was not.
+func updateLimitOrder(orders *bolt.Bucket, orderExec *match.OrderExecution) (err error) {
+	if orderExec.Filled {
+		if err = orders.Delete(orderExec.OrderID[:]); err != nil {
+			err = fmt.Errorf("Error deleting filled order: %s", err)
+			return
+		}
+		return
+	}
+
+	var lp *match.LimitOrderIDPair
+	if lp, err = getLimitOrder(orders, &orderExec.OrderID); err != nil {
+		return
+	}
+	lp.Order.AmountHave = orderExec.NewAmountHave
+	lp.Order.AmountWant = orderExec.NewAmountWant
+	if err = putLimitOrder(orders, lp); err != nil {
+		return
+	}
+	return
+}
+
+// CreateLimitEngineMap creates a map of pair to limit engine, given a list of pairs.
+func CreateLimitEngineMap(db *DB, pairList []*match.Pair) (limMap map[match.Pair]match.LimitEngine, err error) {
+
+	limMap = make(map[match.Pair]match.LimitEngine)
+	var curLimEng match.LimitEngine
+	for _, pair := range pairList {
+		if curLimEng, err = CreateLimitEngine(db, pair); err != nil {
+			err = fmt.Errorf("Error creating single limit engine while creating limit engine map: %s", err)
+			return
+		}
+		limMap[*pair] = curLimEng
+	}
+
+	return
+}
@@ -0,0 +1,96 @@
+package cxdbkv
+
+import (
+	"testing"
+
+	"github.com/mit-dci/opencx/match"
+)
+
+func TestLimitOrdersSurviveReopen(t *testing.T) {
+	var err error
+
+	dir, cleanup := createTestDir(t)
+	defer cleanup()
+
+	db := openTestDB(t, dir)
+	var engine match.LimitEngine
+	if engine, err = CreateLimitEngine(db, &testPair); err != nil {
+		t.Errorf("Error creating limit engine: %s", err)
+		return
+	}
+
+	// Two identical orders should still get different IDs
+	order := &match.LimitOrder{
+		Side:        match.Buy,
+		TradingPair: testPair,
+		AmountHave:  1000,
+		AmountWant:  1000,
+	}
+	order.Pubkey[0] = 0x02
+	var firstID *match.LimitOrderIDPair
+	if firstID, err = engine.PlaceLimitOrder(order); err != nil {
+		t.Errorf("Error placing first order: %s", err)
+		return
+	}
+	var secondID *match.LimitOrderIDPair
+	if secondID, err = engine.PlaceLimitOrder(order); err != nil {
+		t.Errorf("Error placing second order: %s", err)
+		return
+	}
+	if *firstID.OrderID == *secondID.OrderID {
+		t.Errorf("Identical orders should not have the same ID %x", firstID.OrderID[:])
+		return
+	}
+
+	if err = db.Close(); err != nil {
+		t.Errorf("Error closing db: %s", err)
+		return
+	}
+
+	// The orders should still be there after reopening, and match a sell that comes in after
+	db = openTestDB(t, dir)
+	defer db.Close()
+	if engine, err = CreateLimitEngine(db, &testPair); err != nil {
+		t.Errorf("Error creating limit engine after reopening: %s", err)
+		return
+	}
+
+	sellOrder := &match.LimitOrder{
+		Side:        match.Sell,
+		TradingPair: testPair,
+		AmountHave:  1000,
+		AmountWant:  1000,
+	}
+	sellOrder.Pubkey[0] = 0x03
+	if _, err = engine.PlaceLimitOrder(sellOrder); err != nil {
+		t.Errorf("Error placing sell order: %s", err)
+		return
+	}
+
+	var orderExecs []*match.OrderExecution
+	if orderExecs, _, _, err = engine.MatchLimitOrders(); err != nil {
+		t.Errorf("Error matching orders: %s", err)
+		return
+	}
+	if len(orderExecs) != 2 {
+		t.Errorf("Expected the sell and one buy to execute, got %d order executions", len(orderExecs))
+		return
+	}
+
+	// The buy that was placed first should have matched, so the second one is left to cancel
+	var cancelSettlement *match.SettlementExecution
+	if _, cancelSettlement, err = engine.CancelLimitOrder(secondID.OrderID); err != nil {
+		t.Errorf("Error cancelling the second buy order: %s", err)
+		return
+	}
+	if cancelSettlement.Amount != order.AmountHave || cancelSettlement.Asset != testPair.AssetHave || cancelSettlement.Type != match.Debit {
+		t.Errorf("Cancelling should give back %d %s, got %s", order.AmountHave, testPair.AssetHave, cancelSettlement)
+		return
+	}
+	if _, _, err = engine.CancelLimitOrder(firstID.OrderID); err == nil {
+		t.Errorf("Cancelling the filled first order should fail")
+		return
+	}
+
+	return
+}
@@ -0,0 +1,388 @@
+package cxdbkv
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/match"
+	bolt "go.etcd.io/bbolt"
+)
+
+// KVLimitOrderbook is the read-only copy of a limit orderbook, kept in the data file
+type KVLimitOrderbook struct {
+	db *DB
+
+	// this pair
+	pair *match.Pair
+}
+
+// CreateLimitOrderbook creates a limit orderbook for a pair that keeps its orders in db
+func CreateLimitOrderbook(db *DB, pair *match.Pair) (book match.LimitOrderbook, err error) {
+	if err = db.createBuckets([]byte(pair.String()), limitOrderbookBucket, limitArchiveBucket, limitFillsBucket); err != nil {
+		err = fmt.Errorf("Error creating buckets for CreateLimitOrderbook: %s", err)
+		return
+	}
+
+	book = &KVLimitOrderbook{
+		db:   db,
+		pair: pair,
+	}
+	return
+}
+
+// UpdateBookExec takes in an order execution and updates the orderbook.
+func (lo *KVLimitOrderbook) UpdateBookExec(orderExec *match.OrderExecution) (err error) {
+	if err = lo.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, limitOrderbookBucket, []byte(lo.pair.String())); err != nil {
+			return
+		}
+		if orders.Get(orderExec.OrderID[:]) != nil {
+			var lp *match.LimitOrderIDPair
+			if lp, err = getLimitOrder(orders, &orderExec.OrderID); err != nil {
+				return
+			}
+			now := time.Now()
+			var fills *bolt.Bucket
+			if fills, err = bucket(tx, limitFillsBucket, []byte(lo.pair.String())); err != nil {
+				return
+			}
+			if err = addFill(fills, &orderExec.OrderID, match.NewOrderFill(lp.Order.AmountWant, lp.Order.AmountHave, orderExec, now)); err != nil {
+				return
+			}
+			if orderExec.Filled {
+				// the last fill took everything that was left
+				lp.Order.AmountWant = 0
+				lp.Order.AmountHave = 0
+				if err = lo.archiveOrder(tx, lp, match.OrderFilled, now); err != nil {
+					return
+				}
+			}
+		}
+		err = updateLimitOrder(orders, orderExec)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error updating book for UpdateBookExec: %s", err)
+		return
+	}
+	return
+}
+
+// UpdateBookCancel takes in an order cancellation and updates the orderbook.
+func (lo *KVLimitOrderbook) UpdateBookCancel(cancel *match.CancelledOrder) (err error) {
+	if err = lo.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, limitOrderbookBucket, []byte(lo.pair.String())); err != nil {
+			return
+		}
+		if orders.Get(cancel.OrderID[:]) == nil {
+			err = fmt.Errorf("Order %x is not in the orderbook", cancel.OrderID[:])
+			return
+		}
+		var lp *match.LimitOrderIDPair
+		if lp, err = getLimitOrder(orders, cancel.OrderID); err != nil {
+			return
+		}
+		var fills *bolt.Bucket
+		if fills, err = bucket(tx, limitFillsBucket, []byte(lo.pair.String())); err != nil {
+			return
+		}
+		var orderFills []*match.OrderFill
+		if orderFills, err = getFills(fills, cancel.OrderID); err != nil {
+			return
+		}
+		if err = lo.archiveOrder(tx, lp, match.CancelStatus(orderFills), time.Now()); err != nil {
+			return
+		}
+		err = orders.Delete(cancel.OrderID[:])
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error updating book for UpdateBookCancel: %s", err)
+		return
+	}
+	return
+}
+
+// archiveOrder moves the fills for an order to the archive, along with the order as it was
+// placed. This does not take it out of the orderbook, and changes the amounts of lp.
+func (lo *KVLimitOrderbook) archiveOrder(tx *bolt.Tx, lp *match.LimitOrderIDPair, status match.OrderStatus, closedAt time.Time) (err error) {
+	var fills, archive *bolt.Bucket
+	if fills, err = bucket(tx, limitFillsBucket, []byte(lo.pair.String())); err != nil {
+		return
+	}
+	if archive, err = bucket(tx, limitArchiveBucket, []byte(lo.pair.String())); err != nil {
+		return
+	}
+
+	archived := &match.ArchivedLimitOrder{
+		Order:    lp,
+		Status:   status,
+		ClosedAt: closedAt,
+	}
+	if archived.Fills, err = takeFills(fills, lp.OrderID); err != nil {
+		return
+	}
+
+	filledWant, filledHave := match.FilledAmounts(archived.Fills)
+	lp.Order.AmountWant += filledWant
+	lp.Order.AmountHave += filledHave
+	err = putArchived(archive, lp.OrderID, archived)
+	return
+}
+
+// UpdateBookPlace takes in an order, ID, timestamp, and adds the order to the orderbook.
+func (lo *KVLimitOrderbook) UpdateBookPlace(limitIDPair *match.LimitOrderIDPair) (err error) {
+	if err = lo.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, limitOrderbookBucket, []byte(lo.pair.String())); err != nil {
+			return
+		}
+		err = putLimitOrder(orders, limitIDPair)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error updating book for UpdateBookPlace: %s", err)
+		return
+	}
+	return
+}
+
+// GetOrder gets an order from an OrderID
+func (lo *KVLimitOrderbook) GetOrder(orderID *match.OrderID) (limOrder *match.LimitOrderIDPair, err error) {
+	if err = lo.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var orders *bolt.Bucket
+		if orders, err = bucket(tx, limitOrderbookBucket, []byte(lo.pair.String())); err != nil {
+			return
+		}
+		limOrder, err = getLimitOrder(orders, orderID)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error getting order for GetOrder: %s", err)
+		return
+	}
+	return
+}
+
+// CalculatePrice returns the calculated price based on the orderbook. This is based on the midpoint of the spread.
+func (lo *KVLimitOrderbook) CalculatePrice() (price float64, err error) {
+	var book []*match.LimitOrderIDPair
+	if book, err = lo.getOrders(); err != nil {
+		err = fmt.Errorf("Error getting orders for limit CalculatePrice: %s", err)
+		return
+	}
+
+	var maxSell float64
+	var minBuy float64
+	var seenBuy bool
+	for _, lp := range book {
+		if lp.Order.Side == match.Sell {
+			if lp.Price > maxSell {
+				maxSell = lp.Price
+			}
+		} else if !seenBuy || lp.Price < minBuy {
+			minBuy = lp.Price
+			seenBuy = true
+		}
+	}
+
+	price = (minBuy + maxSell) / 2
+	return
+}
+
+// GetOrdersForPubkey gets orders for a specific pubkey. If the sub-account is not nil, only orders
+// from that sub-account are returned.
+func (lo *KVLimitOrderbook) GetOrdersForPubkey(pubkey *koblitz.PublicKey, subAccount *uint32) (orders map[float64][]*match.LimitOrderIDPair, err error) {
+	var book []*match.LimitOrderIDPair
+	if book, err = lo.getOrders(); err != nil {
+		err = fmt.Errorf("Error getting orders for GetOrdersForPubkey: %s", err)
+		return
+	}
+
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	orders = make(map[float64][]*match.LimitOrderIDPair)
+	for _, lp := range book {
+		if lp.Order.Pubkey != pubkeyBytes {
+			continue
+		}
+		if subAccount != nil && lp.Order.SubAccount != *subAccount {
+			continue
+		}
+		orders[lp.Price] = append(orders[lp.Price], lp)
+	}
+	return
+}
+
+// ViewLimitOrderBook returns the whole orderbook as a map of price to orders
+func (lo *KVLimitOrderbook) ViewLimitOrderBook() (book map[float64][]*match.LimitOrderIDPair, err error) {
+	var orders []*match.LimitOrderIDPair
+	if orders, err = lo.getOrders(); err != nil {
+		err = fmt.Errorf("Error getting orders for ViewLimitOrderBook: %s", err)
+		return
+	}
+
+	book = make(map[float64][]*match.LimitOrderIDPair)
+	for _, lp := range orders {
+		book[lp.Price] = append(book[lp.Price], lp)
+	}
+	return
+}
+
+// GetArchivedOrder gets an order that is no longer in the orderbook
+func (lo *KVLimitOrderbook) GetArchivedOrder(orderID *match.OrderID) (archived *match.ArchivedLimitOrder, err error) {
+	if err = lo.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var archive *bolt.Bucket
+		if archive, err = bucket(tx, limitArchiveBucket, []byte(lo.pair.String())); err != nil {
+			return
+		}
+		var archivedBytes []byte
+		if archivedBytes = archive.Get(orderID[:]); archivedBytes == nil {
+			err = fmt.Errorf("Order %x is not in the archive", orderID[:])
+			return
+		}
+		archived = new(match.ArchivedLimitOrder)
+		err = decodeValue(archivedBytes, archived)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error getting archived order for GetArchivedOrder: %s", err)
+		return
+	}
+	return
+}
+
+// GetArchivedOrdersForPubkey gets the orders for a pubkey that are no longer in the orderbook, in
+// the order they were closed. If the sub-account is not nil, only orders from that sub-account are
+// returned.
+func (lo *KVLimitOrderbook) GetArchivedOrdersForPubkey(pubkey *koblitz.PublicKey, subAccount *uint32) (archived []*match.ArchivedLimitOrder, err error) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	if err = lo.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var archive *bolt.Bucket
+		if archive, err = bucket(tx, limitArchiveBucket, []byte(lo.pair.String())); err != nil {
+			return
+		}
+		err = archive.ForEach(func(k, v []byte) (err error) {
+			arc := new(match.ArchivedLimitOrder)
+			if err = decodeValue(v, arc); err != nil {
+				err = fmt.Errorf("Error decoding archived order %x: %s", k, err)
+				return
+			}
+			if arc.Order.Order.Pubkey != pubkeyBytes {
+				return
+			}
+			if subAccount != nil && arc.Order.Order.SubAccount != *subAccount {
+				return
+			}
+			archived = append(archived, arc)
+			return
+		})
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error getting archived orders for GetArchivedOrdersForPubkey: %s", err)
+		return
+	}
+
+	sort.SliceStable(archived, func(i, j int) bool {
+		return archived[i].ClosedAt.Before(archived[j].ClosedAt)
+	})
+	return
+}
+
+// ViewArchive gets every order that is no longer in the orderbook, in the order they were closed
+func (lo *KVLimitOrderbook) ViewArchive() (archived []*match.ArchivedLimitOrder, err error) {
+	if err = lo.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var archive *bolt.Bucket
+		if archive, err = bucket(tx, limitArchiveBucket, []byte(lo.pair.String())); err != nil {
+			return
+		}
+		err = archive.ForEach(func(k, v []byte) (err error) {
+			arc := new(match.ArchivedLimitOrder)
+			if err = decodeValue(v, arc); err != nil {
+				err = fmt.Errorf("Error decoding archived order %x: %s", k, err)
+				return
+			}
+			archived = append(archived, arc)
+			return
+		})
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error getting archived orders for ViewArchive: %s", err)
+		return
+	}
+
+	sort.SliceStable(archived, func(i, j int) bool {
+		return archived[i].ClosedAt.Before(archived[j].ClosedAt)
+	})
+	return
+}
+
+// RestoreArchivedOrder puts an order into the archive as it was archived
+func (lo *KVLimitOrderbook) RestoreArchivedOrder(archived *match.ArchivedLimitOrder) (err error) {
+	if err = lo.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var archive *bolt.Bucket
+		if archive, err = bucket(tx, limitArchiveBucket, []byte(lo.pair.String())); err != nil {
+			return
+		}
+		err = putArchived(archive, archived.Order.OrderID, archived)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error putting archived order for RestoreArchivedOrder: %s", err)
+		return
+	}
+	return
+}
+
+// PruneArchive deletes the archived orders that were closed before the cutoff
+func (lo *KVLimitOrderbook) PruneArchive(before time.Time) (pruned uint64, err error) {
+	if err = lo.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var archive *bolt.Bucket
+		if archive, err = bucket(tx, limitArchiveBucket, []byte(lo.pair.String())); err != nil {
+			return
+		}
+		pruned, err = pruneArchived(archive, before, func(v []byte) (closedAt time.Time, err error) {
+			arc := new(match.ArchivedLimitOrder)
+			if err = decodeValue(v, arc); err != nil {
+				return
+			}
+			closedAt = arc.ClosedAt
+			return
+		})
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error pruning archive for PruneArchive: %s", err)
+		return
+	}
+	return
+}
+
+// getOrders gets every order in the orderbook
+func (lo *KVLimitOrderbook) getOrders() (orders []*match.LimitOrderIDPair, err error) {
+	err = lo.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var orderBucket *bolt.Bucket
+		if orderBucket, err = bucket(tx, limitOrderbookBucket, []byte(lo.pair.String())); err != nil {
+			return
+		}
+		orders, err = getLimitOrders(orderBucket)
+		return
+	})
+	return
+}
+
+// CreateLimitOrderbookMap creates a map of pair to limit orderbook, given a list of pairs.
+func CreateLimitOrderbookMap(db *DB, pairList []*match.Pair) (orderbookMap map[match.Pair]match.LimitOrderbook, err error) {
+
+	orderbookMap = make(map[match.Pair]match.LimitOrderbook)
+	var curLimBook match.LimitOrderbook
+	for _, pair := range pairList {
+		if curLimBook, err = CreateLimitOrderbook(db, pair); err != nil {
+			err = fmt.Errorf("Error creating single limit orderbook while creating limit orderbook map: %s", err)
+			return
+		}
+		orderbookMap[*pair] = curLimBook
+	}
+
+	return
+}
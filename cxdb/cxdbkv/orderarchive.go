@@ -0,0 +1,96 @@
+package cxdbkv
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/opencx/match"
+	bolt "go.etcd.io/bbolt"
+)
+
+// addFill adds a fill to the fills kept for an order, which are kept until the order is archived
+func addFill(fillBucket *bolt.Bucket, orderID *match.OrderID, fill *match.OrderFill) (err error) {
+	var fills []*match.OrderFill
+	if fills, err = getFills(fillBucket, orderID); err != nil {
+		return
+	}
+	fills = append(fills, fill)
+
+	var fillBytes []byte
+	if fillBytes, err = encodeValue(fills); err != nil {
+		err = fmt.Errorf("Error encoding fills: %s", err)
+		return
+	}
+	if err = fillBucket.Put(orderID[:], fillBytes); err != nil {
+		err = fmt.Errorf("Error putting fills: %s", err)
+		return
+	}
+	return
+}
+
+// getFills reads the fills kept for an order
+func getFills(fillBucket *bolt.Bucket, orderID *match.OrderID) (fills []*match.OrderFill, err error) {
+	var fillBytes []byte
+	if fillBytes = fillBucket.Get(orderID[:]); fillBytes == nil {
+		return
+	}
+	if err = decodeValue(fillBytes, &fills); err != nil {
+		err = fmt.Errorf("Error decoding fills for order %x: %s", orderID[:], err)
+		return
+	}
+	return
+}
+
+// takeFills reads and deletes the fills kept for an order
+func takeFills(fillBucket *bolt.Bucket, orderID *match.OrderID) (fills []*match.OrderFill, err error) {
+	if fills, err = getFills(fillBucket, orderID); err != nil {
+		return
+	}
+	if err = fillBucket.Delete(orderID[:]); err != nil {
+		err = fmt.Errorf("Error deleting fills: %s", err)
+		return
+	}
+	return
+}
+
+// putArchived writes an archived order to a bucket of archived orders, keyed by order ID
+func putArchived(archive *bolt.Bucket, orderID *match.OrderID, archived interface{}) (err error) {
+	var archivedBytes []byte
+	if archivedBytes, err = encodeValue(archived); err != nil {
+		err = fmt.Errorf("Error encoding archived order: %s", err)
+		return
+	}
+	if err = archive.Put(orderID[:], archivedBytes); err != nil {
+		err = fmt.Errorf("Error putting archived order: %s", err)
+		return
+	}
+	return
+}
+
+// pruneArchived deletes the archived orders for which closedAt returns a time before the cutoff.
+// closedAt decodes the archived order it's given.
+func pruneArchived(archive *bolt.Bucket, before time.Time, closedAt func(v []byte) (time.Time, error)) (pruned uint64, err error) {
+	var prunedKeys [][]byte
+	if err = archive.ForEach(func(k, v []byte) (err error) {
+		var closed time.Time
+		if closed, err = closedAt(v); err != nil {
+			err = fmt.Errorf("Error decoding archived order %x: %s", k, err)
+			return
+		}
+		if closed.Before(before) {
+			prunedKeys = append(prunedKeys, append([]byte(nil), k...))
+		}
+		return
+	}); err != nil {
+		return
+	}
+
+	for _, k := range prunedKeys {
+		if err = archive.Delete(k); err != nil {
+			err = fmt.Errorf("Error deleting archived order %x: %s", k, err)
+			return
+		}
+		pruned++
+	}
+	return
+}
@@ -0,0 +1,131 @@
+package cxdbkv
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+	bolt "go.etcd.io/bbolt"
+)
+
+// KVPuzzleStore keeps the encrypted auction orders for a pair in the data file. Puzzles are keyed
+// by the auction they are for, followed by the order they were placed in.
+type KVPuzzleStore struct {
+	db *DB
+
+	// this pair
+	pair *match.Pair
+}
+
+// CreatePuzzleStore creates a puzzle store for a pair that keeps its puzzles in db
+func CreatePuzzleStore(db *DB, pair *match.Pair) (store cxdb.PuzzleStore, err error) {
+	if err = db.createBuckets([]byte(pair.String()), puzzleBucket); err != nil {
+		err = fmt.Errorf("Error creating buckets for CreatePuzzleStore: %s", err)
+		return
+	}
+
+	store = &KVPuzzleStore{
+		db:   db,
+		pair: pair,
+	}
+	return
+}
+
+// ViewAuctionPuzzleBook takes in an auction ID, and returns encrypted auction orders, and puzzles.
+func (kp *KVPuzzleStore) ViewAuctionPuzzleBook(auctionID *match.AuctionID) (puzzles []*match.EncryptedAuctionOrder, err error) {
+	if err = kp.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var puzzleBook *bolt.Bucket
+		if puzzleBook, err = bucket(tx, puzzleBucket, []byte(kp.pair.String())); err != nil {
+			return
+		}
+
+		c := puzzleBook.Cursor()
+		for k, v := c.Seek(auctionID[:]); k != nil && bytes.HasPrefix(k, auctionID[:]); k, v = c.Next() {
+			currPuzzle := new(match.EncryptedAuctionOrder)
+			if err = currPuzzle.Deserialize(v); err != nil {
+				err = fmt.Errorf("Error deserializing puzzle: %s", err)
+				return
+			}
+			puzzles = append(puzzles, currPuzzle)
+		}
+		return
+	}); err != nil {
+		puzzles = nil
+		err = fmt.Errorf("Error getting puzzles for ViewAuctionPuzzleBook: %s", err)
+		return
+	}
+	return
+}
+
+// PlaceAuctionPuzzle puts an encrypted auction order in the datastore.
+func (kp *KVPuzzleStore) PlaceAuctionPuzzle(puzzledOrder *match.EncryptedAuctionOrder) (err error) {
+	var pzOrderBytes []byte
+	if pzOrderBytes, err = puzzledOrder.Serialize(); err != nil {
+		err = fmt.Errorf("Error serializing puzzle for PlaceAuctionPuzzle: %s", err)
+		return
+	}
+
+	if err = kp.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var puzzleBook *bolt.Bucket
+		if puzzleBook, err = bucket(tx, puzzleBucket, []byte(kp.pair.String())); err != nil {
+			return
+		}
+
+		var seq uint64
+		if seq, err = puzzleBook.NextSequence(); err != nil {
+			err = fmt.Errorf("Error getting next puzzle sequence: %s", err)
+			return
+		}
+		key := append(append([]byte{}, puzzledOrder.IntendedAuction[:]...), sequenceKey(seq)...)
+		err = puzzleBook.Put(key, pzOrderBytes)
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error placing puzzle for PlaceAuctionPuzzle: %s", err)
+		return
+	}
+	return
+}
+
+// ViewAuctionIDs returns the ID of every auction that has puzzles in the store
+func (kp *KVPuzzleStore) ViewAuctionIDs() (auctionIDs []*match.AuctionID, err error) {
+	if err = kp.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var puzzleBook *bolt.Bucket
+		if puzzleBook, err = bucket(tx, puzzleBucket, []byte(kp.pair.String())); err != nil {
+			return
+		}
+
+		// keys are sorted, so every puzzle for an auction is next to the others
+		err = puzzleBook.ForEach(func(k, v []byte) (err error) {
+			if len(auctionIDs) != 0 && bytes.HasPrefix(k, auctionIDs[len(auctionIDs)-1][:]) {
+				return
+			}
+			currID := new(match.AuctionID)
+			copy(currID[:], k)
+			auctionIDs = append(auctionIDs, currID)
+			return
+		})
+		return
+	}); err != nil {
+		auctionIDs = nil
+		err = fmt.Errorf("Error getting auction IDs for ViewAuctionIDs: %s", err)
+		return
+	}
+	return
+}
+
+// CreatePuzzleStoreMap creates a map of pair to puzzle store, given a list of pairs.
+func CreatePuzzleStoreMap(db *DB, pairList []*match.Pair) (pzMap map[match.Pair]cxdb.PuzzleStore, err error) {
+
+	pzMap = make(map[match.Pair]cxdb.PuzzleStore)
+	var curPzStore cxdb.PuzzleStore
+	for _, pair := range pairList {
+		if curPzStore, err = CreatePuzzleStore(db, pair); err != nil {
+			err = fmt.Errorf("Error creating single puzzle store while creating puzzle store map: %s", err)
+			return
+		}
+		pzMap[*pair] = curPzStore
+	}
+
+	return
+}
@@ -0,0 +1,273 @@
+package cxdbkv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/match"
+	bolt "go.etcd.io/bbolt"
+)
+
+// KVSettlementEngine keeps the balances for a coin in the data file, and writes every settlement
+// execution to the ledger for that coin.
+type KVSettlementEngine struct {
+	db *DB
+
+	// this coin
+	coin *coinparam.Params
+}
+
+// KVBatchSettlementEngine applies batches of settlement executions across the settlement engines
+// for many coins in one transaction.
+type KVBatchSettlementEngine struct {
+	db *DB
+
+	// the engines for each asset
+	engines map[match.Asset]*KVSettlementEngine
+}
+
+// CreateSettlementEngine creates a settlement engine for a coin that keeps its balances in db
+func CreateSettlementEngine(db *DB, coin *coinparam.Params) (engine match.SettlementEngine, err error) {
+	if engine, err = createSettlementEngineStruct(db, coin); err != nil {
+		err = fmt.Errorf("Error creating settlement engine struct for CreateSettlementEngine: %s", err)
+		return
+	}
+	return
+}
+
+// createSettlementEngineStruct creates a settlement engine for a coin, but instead of returning an
+// interface, it returns a struct.
+func createSettlementEngineStruct(db *DB, coin *coinparam.Params) (se *KVSettlementEngine, err error) {
+	if err = db.createBuckets([]byte(coin.Name), balanceBucket, ledgerBucket); err != nil {
+		err = fmt.Errorf("Error creating buckets for settlement engine: %s", err)
+		return
+	}
+
+	se = &KVSettlementEngine{
+		db:   db,
+		coin: coin,
+	}
+	return
+}
+
+// ApplySettlementExecution applies the settlementExecution, this assumes that the settlement execution is
+// valid
+func (se *KVSettlementEngine) ApplySettlementExecution(setExec *match.SettlementExecution) (setRes *match.SettlementResult, err error) {
+	if err = se.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		setRes, err = se.applyExecutionTx(tx, setExec)
+		return
+	}); err != nil {
+		setRes = nil
+		err = fmt.Errorf("Error while applying settlement exec: \n%s", err)
+		return
+	}
+	return
+}
+
+// applyExecutionTx applies the settlement execution in a transaction, writing the new balance and the
+// ledger entries. A credit bigger than the balance is an error.
+func (se *KVSettlementEngine) applyExecutionTx(tx *bolt.Tx, setExec *match.SettlementExecution) (setRes *match.SettlementResult, err error) {
+	var balances *bolt.Bucket
+	if balances, err = bucket(tx, balanceBucket, []byte(se.coin.Name)); err != nil {
+		return
+	}
+
+	key := accountKey(setExec.Pubkey, setExec.SubAccount)
+	curBal := getBalance(balances, key)
+
+	var newBal uint64
+	if setExec.Type == match.Debit {
+		newBal = curBal + setExec.Amount
+	} else if setExec.Type == match.Credit {
+		if setExec.Amount > curBal {
+			err = fmt.Errorf("Credit of %d is more than the balance of %d", setExec.Amount, curBal)
+			return
+		}
+		newBal = curBal - setExec.Amount
+	}
+
+	balBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(balBytes, newBal)
+	if err = balances.Put(key, balBytes); err != nil {
+		err = fmt.Errorf("Error putting new balance for applyExecutionTx: %s", err)
+		return
+	}
+
+	if err = se.writeLedgerEntries(tx, setExec); err != nil {
+		err = fmt.Errorf("Error writing ledger entries for applyExecutionTx: %s", err)
+		return
+	}
+
+	setRes = &match.SettlementResult{
+		NewBal:         newBal,
+		SuccessfulExec: setExec,
+	}
+
+	return
+}
+
+// writeLedgerEntries writes the settlement execution to the ledger as two entries that sum to zero,
+// one for the user and one for the exchange account that the reason says is on the other side.
+// The entries are written in the same transaction as the balance update.
+func (se *KVSettlementEngine) writeLedgerEntries(tx *bolt.Tx, setExec *match.SettlementExecution) (err error) {
+	// there's nothing to record if nothing moved
+	if setExec.Amount == 0 {
+		return
+	}
+
+	var ledger *bolt.Bucket
+	if ledger, err = bucket(tx, ledgerBucket, []byte(se.coin.Name)); err != nil {
+		return
+	}
+
+	exchangeType := match.Credit
+	if setExec.Type == match.Credit {
+		exchangeType = match.Debit
+	}
+
+	entryTime := time.Now()
+	entries := []*match.LedgerEntry{
+		&match.LedgerEntry{
+			Time:      entryTime,
+			Account:   setExec.Account().String(),
+			Asset:     setExec.Asset,
+			Amount:    setExec.Amount,
+			Type:      setExec.Type,
+			Reason:    setExec.Reason,
+			Reference: setExec.Reference,
+		},
+		&match.LedgerEntry{
+			Time:      entryTime,
+			Account:   setExec.Reason.CounterAccount(),
+			Asset:     setExec.Asset,
+			Amount:    setExec.Amount,
+			Type:      exchangeType,
+			Reason:    setExec.Reason,
+			Reference: setExec.Reference,
+		},
+	}
+	for _, entry := range entries {
+		if entry.ID, err = ledger.NextSequence(); err != nil {
+			err = fmt.Errorf("Error getting next ledger entry ID: %s", err)
+			return
+		}
+		var entryBytes []byte
+		if entryBytes, err = encodeValue(entry); err != nil {
+			err = fmt.Errorf("Error encoding ledger entry: %s", err)
+			return
+		}
+		if err = ledger.Put(sequenceKey(entry.ID), entryBytes); err != nil {
+			err = fmt.Errorf("Error putting ledger entry: %s", err)
+			return
+		}
+	}
+
+	return
+}
+
+// CheckValid returns true if the settlement execution would be valid
+func (se *KVSettlementEngine) CheckValid(setExec *match.SettlementExecution) (valid bool, err error) {
+	if setExec.Type == match.Debit {
+		// No settlement will be an invalid debit
+		valid = true
+		return
+	}
+
+	if err = se.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var balances *bolt.Bucket
+		if balances, err = bucket(tx, balanceBucket, []byte(se.coin.Name)); err != nil {
+			return
+		}
+		valid = setExec.Amount <= getBalance(balances, accountKey(setExec.Pubkey, setExec.SubAccount))
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error while checking settlement exec: \n%s", err)
+		return
+	}
+	return
+}
+
+// getBalance gets the balance stored at key, which is zero if nothing is stored there
+func getBalance(balances *bolt.Bucket, key []byte) (balance uint64) {
+	var balBytes []byte
+	if balBytes = balances.Get(key); len(balBytes) < 8 {
+		return
+	}
+	balance = binary.BigEndian.Uint64(balBytes)
+	return
+}
+
+// CreateSettlementEngineMap creates a map of coin to settlement engine, given a list of coins.
+func CreateSettlementEngineMap(db *DB, coins []*coinparam.Params) (setMap map[*coinparam.Params]match.SettlementEngine, err error) {
+
+	setMap = make(map[*coinparam.Params]match.SettlementEngine)
+	var curSetEng match.SettlementEngine
+	for _, coin := range coins {
+		if curSetEng, err = CreateSettlementEngine(db, coin); err != nil {
+			err = fmt.Errorf("Error creating single settlement engine while creating settlement engine map: %s", err)
+			return
+		}
+		setMap[coin] = curSetEng
+	}
+
+	return
+}
+
+// CreateBatchSettlementEngine creates a batch settlement engine for a list of coins, whose balances
+// are the same ones that the settlement engines for those coins in db use.
+func CreateBatchSettlementEngine(db *DB, coins []*coinparam.Params) (engine match.BatchSettlementEngine, err error) {
+
+	be := &KVBatchSettlementEngine{
+		db:      db,
+		engines: make(map[match.Asset]*KVSettlementEngine),
+	}
+
+	for _, coin := range coins {
+		var asset match.Asset
+		if asset, err = match.AssetFromCoinParam(coin); err != nil {
+			err = fmt.Errorf("Error getting asset from coin param for CreateBatchSettlementEngine: %s", err)
+			return
+		}
+
+		var se *KVSettlementEngine
+		if se, err = createSettlementEngineStruct(db, coin); err != nil {
+			err = fmt.Errorf("Error creating settlement engine for batch settlement engine: %s", err)
+			return
+		}
+		be.engines[asset] = se
+	}
+
+	engine = be
+	return
+}
+
+// ApplySettlementBatch applies every settlement execution in order in one transaction across the
+// balances and ledgers of every coin. If any execution fails, nothing is applied.
+func (be *KVBatchSettlementEngine) ApplySettlementBatch(setExecs []*match.SettlementExecution) (setRes []*match.SettlementResult, err error) {
+
+	for _, setExec := range setExecs {
+		if _, ok := be.engines[setExec.Asset]; !ok {
+			err = fmt.Errorf("No settlement engine for %s in ApplySettlementBatch", setExec.Asset)
+			return
+		}
+	}
+
+	if err = be.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		for _, setExec := range setExecs {
+			var currRes *match.SettlementResult
+			if currRes, err = be.engines[setExec.Asset].applyExecutionTx(tx, setExec); err != nil {
+				return
+			}
+			setRes = append(setRes, currRes)
+		}
+		return
+	}); err != nil {
+		setRes = nil
+		err = fmt.Errorf("Error while applying settlement batch, rejecting the whole batch: \n%s", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,149 @@
+package cxdbkv
+
+import (
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+func TestBatchSettlementAllOrNothing(t *testing.T) {
+	var err error
+
+	dir, cleanup := createTestDir(t)
+	defer cleanup()
+
+	db := openTestDB(t, dir)
+	defer db.Close()
+
+	var setEngines map[*coinparam.Params]match.SettlementEngine
+	if setEngines, err = CreateSettlementEngineMap(db, testCoins()); err != nil {
+		t.Errorf("Error creating settlement engine map: %s", err)
+		return
+	}
+
+	var batchEngine match.BatchSettlementEngine
+	if batchEngine, err = CreateBatchSettlementEngine(db, testCoins()); err != nil {
+		t.Errorf("Error creating batch settlement engine: %s", err)
+		return
+	}
+
+	var ledgerStores map[*coinparam.Params]cxdb.LedgerStore
+	if ledgerStores, err = CreateLedgerStoreMap(db, testCoins()); err != nil {
+		t.Errorf("Error creating ledger store map: %s", err)
+		return
+	}
+
+	alice := [33]byte{0x02, 0x01}
+	bob := [33]byte{0x02, 0x02}
+
+	funding := []*match.SettlementExecution{
+		&match.SettlementExecution{Pubkey: alice, Amount: 1000, Asset: match.BTCReg, Type: match.Debit, Reason: match.ReasonDeposit},
+		&match.SettlementExecution{Pubkey: bob, Amount: 500, Asset: match.LTCReg, Type: match.Debit, Reason: match.ReasonDeposit},
+	}
+	if _, err = batchEngine.ApplySettlementBatch(funding); err != nil {
+		t.Errorf("Error applying funding batch: %s", err)
+		return
+	}
+
+	// Bob's side of the trade is more than he has, so alice shouldn't be paid or charged either
+	badTrade := []*match.SettlementExecution{
+		&match.SettlementExecution{Pubkey: alice, Amount: 400, Asset: match.BTCReg, Type: match.Credit, Reason: match.ReasonFill},
+		&match.SettlementExecution{Pubkey: bob, Amount: 400, Asset: match.BTCReg, Type: match.Debit, Reason: match.ReasonFill},
+		&match.SettlementExecution{Pubkey: bob, Amount: 600, Asset: match.LTCReg, Type: match.Credit, Reason: match.ReasonFill},
+		&match.SettlementExecution{Pubkey: alice, Amount: 600, Asset: match.LTCReg, Type: match.Debit, Reason: match.ReasonFill},
+	}
+	if _, err = batchEngine.ApplySettlementBatch(badTrade); err == nil {
+		t.Errorf("Batch with a credit bigger than the balance should have been rejected")
+		return
+	}
+
+	var valid bool
+	aliceSpend := &match.SettlementExecution{Pubkey: alice, Amount: 1000, Asset: match.BTCReg, Type: match.Credit}
+	if valid, err = setEngines[&coinparam.RegressionNetParams].CheckValid(aliceSpend); err != nil {
+		t.Errorf("Error checking alice spend: %s", err)
+		return
+	}
+	if !valid {
+		t.Errorf("Rejected batch should have left alice with her whole balance")
+		return
+	}
+
+	// Nothing from the rejected batch should be in the ledger either
+	for coin, ledgerStore := range ledgerStores {
+		var mismatches []*match.LedgerMismatch
+		if mismatches, err = ledgerStore.CheckConsistency(); err != nil {
+			t.Errorf("Error checking ledger consistency for %s: %s", coin.Name, err)
+			return
+		}
+		if len(mismatches) != 0 {
+			t.Errorf("Ledger for %s should match the balances, got %d mismatches, first: %s", coin.Name, len(mismatches), mismatches[0])
+			return
+		}
+	}
+
+	return
+}
+
+func TestLedgerTransferNonces(t *testing.T) {
+	var err error
+
+	dir, cleanup := createTestDir(t)
+	defer cleanup()
+
+	db := openTestDB(t, dir)
+	defer db.Close()
+
+	coin := &coinparam.RegressionNetParams
+	var batchEngine match.BatchSettlementEngine
+	if batchEngine, err = CreateBatchSettlementEngine(db, []*coinparam.Params{coin}); err != nil {
+		t.Errorf("Error creating batch settlement engine: %s", err)
+		return
+	}
+
+	var ledgerStore cxdb.LedgerStore
+	if ledgerStore, err = CreateLedgerStore(db, coin); err != nil {
+		t.Errorf("Error creating ledger store: %s", err)
+		return
+	}
+
+	alice := [33]byte{0x02, 0x01}
+	bob := [33]byte{0x02, 0x02}
+	funding := []*match.SettlementExecution{
+		&match.SettlementExecution{Pubkey: alice, SubAccount: 2, Amount: 1000, Asset: match.BTCReg, Type: match.Debit, Reason: match.ReasonDeposit},
+	}
+	if _, err = batchEngine.ApplySettlementBatch(funding); err != nil {
+		t.Errorf("Error applying funding batch: %s", err)
+		return
+	}
+
+	// the nonce of a transfer that was rejected shouldn't be stored
+	transfers := []*match.Transfer{
+		&match.Transfer{From: alice, FromSubAccount: 2, To: bob, Asset: match.BTCReg, Amount: 300, Nonce: 5},
+		&match.Transfer{From: alice, FromSubAccount: 2, To: bob, Asset: match.BTCReg, Amount: 300, Nonce: 3},
+		&match.Transfer{From: alice, FromSubAccount: 2, To: bob, Asset: match.BTCReg, Amount: 3000, Nonce: 9},
+	}
+	for i, transfer := range transfers {
+		batch := []*match.SettlementExecution{
+			&match.SettlementExecution{Pubkey: alice, SubAccount: 2, Amount: transfer.Amount, Asset: match.BTCReg, Type: match.Credit, Reason: match.ReasonTransfer, Reference: transfer.SenderReference()},
+			&match.SettlementExecution{Pubkey: bob, Amount: transfer.Amount, Asset: match.BTCReg, Type: match.Debit, Reason: match.ReasonTransfer, Reference: transfer.FromAccount().String()},
+		}
+		if _, err = batchEngine.ApplySettlementBatch(batch); (err == nil) != (i < 2) {
+			t.Errorf("Unexpected result applying transfer %d: %v", i, err)
+			return
+		}
+	}
+
+	var nonces map[[33]byte]uint64
+	if nonces, err = ledgerStore.GetTransferNonces(); err != nil {
+		t.Errorf("Error getting transfer nonces: %s", err)
+		return
+	}
+	if len(nonces) != 1 || nonces[alice] != 5 {
+		t.Errorf("Expected the last nonce for alice to be 5 and no nonce for bob, got %v", nonces)
+		return
+	}
+
+	return
+}
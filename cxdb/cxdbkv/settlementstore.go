@@ -0,0 +1,184 @@
+package cxdbkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+	bolt "go.etcd.io/bbolt"
+)
+
+// KVSettlementStore is the read-only copy of the balances for a coin, kept in the data file. Each
+// account stores its balance followed by its held balance.
+type KVSettlementStore struct {
+	db *DB
+
+	// this coin
+	coin *coinparam.Params
+}
+
+// CreateSettlementStore creates a settlement store for a coin that keeps its balances in db
+func CreateSettlementStore(db *DB, coin *coinparam.Params) (store cxdb.SettlementStore, err error) {
+	if err = db.createBuckets([]byte(coin.Name), readOnlyBalanceBucket); err != nil {
+		err = fmt.Errorf("Error creating buckets for CreateSettlementStore: %s", err)
+		return
+	}
+
+	store = &KVSettlementStore{
+		db:   db,
+		coin: coin,
+	}
+	return
+}
+
+// UpdateBalances updates the balances from the settlement executions
+func (ss *KVSettlementStore) UpdateBalances(settlementResults []*match.SettlementResult) (err error) {
+	if err = ss.db.handle.Update(func(tx *bolt.Tx) (err error) {
+		var balances *bolt.Bucket
+		if balances, err = bucket(tx, readOnlyBalanceBucket, []byte(ss.coin.Name)); err != nil {
+			return
+		}
+		for _, setResult := range settlementResults {
+			balBytes := make([]byte, 16)
+			binary.BigEndian.PutUint64(balBytes[:8], setResult.NewBal)
+			binary.BigEndian.PutUint64(balBytes[8:], setResult.NewHeld)
+			if err = balances.Put(accountKey(setResult.SuccessfulExec.Pubkey, setResult.SuccessfulExec.SubAccount), balBytes); err != nil {
+				err = fmt.Errorf("Error putting balance: %s", err)
+				return
+			}
+		}
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error updating balances for UpdateBalances: %s", err)
+		return
+	}
+	return
+}
+
+// GetBalance gets the balance for a pubkey. If the sub-account is nil, the balances of all of the
+// sub-accounts are added up.
+func (ss *KVSettlementStore) GetBalance(pubkey *koblitz.PublicKey, subAccount *uint32) (balance uint64, err error) {
+	if balance, _, err = ss.getBalances(pubkey, subAccount); err != nil {
+		err = fmt.Errorf("Error getting balances for GetBalance: %s", err)
+		return
+	}
+	return
+}
+
+// GetHeldBalance gets the balance held in orders for a pubkey. If the sub-account is nil, the held
+// balances of all of the sub-accounts are added up.
+func (ss *KVSettlementStore) GetHeldBalance(pubkey *koblitz.PublicKey, subAccount *uint32) (held uint64, err error) {
+	if _, held, err = ss.getBalances(pubkey, subAccount); err != nil {
+		err = fmt.Errorf("Error getting balances for GetHeldBalance: %s", err)
+		return
+	}
+	return
+}
+
+// getBalances adds up the balance and held balance for every sub-account of the pubkey, or just
+// the one sub-account if it is not nil.
+func (ss *KVSettlementStore) getBalances(pubkey *koblitz.PublicKey, subAccount *uint32) (balance uint64, held uint64, err error) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	err = ss.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var balances *bolt.Bucket
+		if balances, err = bucket(tx, readOnlyBalanceBucket, []byte(ss.coin.Name)); err != nil {
+			return
+		}
+
+		prefix := pubkeyBytes[:]
+		if subAccount != nil {
+			prefix = accountKey(pubkeyBytes, *subAccount)
+		}
+		c := balances.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			balance += binary.BigEndian.Uint64(v[:8])
+			held += binary.BigEndian.Uint64(v[8:])
+		}
+		return
+	})
+	return
+}
+
+// GetTotalBalance gets the total balance of every account, including what is held in orders
+func (ss *KVSettlementStore) GetTotalBalance() (total uint64, err error) {
+	var balances map[[33]byte]uint64
+	if balances, err = ss.GetAllBalances(); err != nil {
+		err = fmt.Errorf("Error getting all balances for GetTotalBalance: %s", err)
+		return
+	}
+	for _, balance := range balances {
+		total += balance
+	}
+	return
+}
+
+// GetAllBalances gets the balance of every pubkey, including what is held in orders and what is in
+// every sub-account.
+func (ss *KVSettlementStore) GetAllBalances() (balances map[[33]byte]uint64, err error) {
+	balances = make(map[[33]byte]uint64)
+	if err = ss.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var balBucket *bolt.Bucket
+		if balBucket, err = bucket(tx, readOnlyBalanceBucket, []byte(ss.coin.Name)); err != nil {
+			return
+		}
+		err = balBucket.ForEach(func(k, v []byte) (err error) {
+			var pubkey [33]byte
+			copy(pubkey[:], k[:33])
+			balances[pubkey] += binary.BigEndian.Uint64(v[:8]) + binary.BigEndian.Uint64(v[8:])
+			return
+		})
+		return
+	}); err != nil {
+		err = fmt.Errorf("Error getting balances for GetAllBalances: %s", err)
+		return
+	}
+	return
+}
+
+// GetAccountBalances gets the available and held balance of every sub-account of every pubkey
+func (ss *KVSettlementStore) GetAccountBalances() (balances []*match.AccountBalance, err error) {
+	if err = ss.db.handle.View(func(tx *bolt.Tx) (err error) {
+		var balBucket *bolt.Bucket
+		if balBucket, err = bucket(tx, readOnlyBalanceBucket, []byte(ss.coin.Name)); err != nil {
+			return
+		}
+		err = balBucket.ForEach(func(k, v []byte) (err error) {
+			currBal := &match.AccountBalance{
+				Balance: binary.BigEndian.Uint64(v[:8]),
+				Held:    binary.BigEndian.Uint64(v[8:]),
+			}
+			copy(currBal.Account.Pubkey[:], k[:33])
+			currBal.Account.SubAccount = binary.BigEndian.Uint32(k[33:])
+			balances = append(balances, currBal)
+			return
+		})
+		return
+	}); err != nil {
+		balances = nil
+		err = fmt.Errorf("Error getting balances for GetAccountBalances: %s", err)
+		return
+	}
+	return
+}
+
+// CreateSettlementStoreMap creates a map of coin to settlement store, given a list of coins.
+func CreateSettlementStoreMap(db *DB, coins []*coinparam.Params) (setMap map[*coinparam.Params]cxdb.SettlementStore, err error) {
+
+	setMap = make(map[*coinparam.Params]cxdb.SettlementStore)
+	var curSetStore cxdb.SettlementStore
+	for _, coin := range coins {
+		if curSetStore, err = CreateSettlementStore(db, coin); err != nil {
+			err = fmt.Errorf("Error creating single settlement store while creating settlement store map: %s", err)
+			return
+		}
+		setMap[coin] = curSetStore
+	}
+
+	return
+}
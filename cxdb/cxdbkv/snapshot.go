@@ -0,0 +1,52 @@
+package cxdbkv
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+	"github.com/mit-dci/opencx/match"
+)
+
+// CreateSnapshotStores creates every store a snapshot is taken from or restored into, for a list of
+// pairs and coins, all in one data file.
+func CreateSnapshotStores(db *DB, pairList []*match.Pair, coinList []*coinparam.Params) (stores *cxdbsnapshot.Stores, err error) {
+	stores = new(cxdbsnapshot.Stores)
+	if stores.LimitEngines, err = CreateLimitEngineMap(db, pairList); err != nil {
+		err = fmt.Errorf("Error creating limit engines for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.LimitOrderbooks, err = CreateLimitOrderbookMap(db, pairList); err != nil {
+		err = fmt.Errorf("Error creating limit orderbooks for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.AuctionEngines, err = CreateAuctionEngineMap(db, pairList); err != nil {
+		err = fmt.Errorf("Error creating auction engines for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.AuctionOrderbooks, err = CreateAuctionOrderbookMap(db, pairList); err != nil {
+		err = fmt.Errorf("Error creating auction orderbooks for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.PuzzleStores, err = CreatePuzzleStoreMap(db, pairList); err != nil {
+		err = fmt.Errorf("Error creating puzzle stores for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.SettlementEngines, err = CreateSettlementEngineMap(db, coinList); err != nil {
+		err = fmt.Errorf("Error creating settlement engines for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.SettlementStores, err = CreateSettlementStoreMap(db, coinList); err != nil {
+		err = fmt.Errorf("Error creating settlement stores for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.DepositStores, err = CreateDepositStoreMap(db, coinList); err != nil {
+		err = fmt.Errorf("Error creating deposit stores for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.LedgerStores, err = CreateLedgerStoreMap(db, coinList); err != nil {
+		err = fmt.Errorf("Error creating ledger stores for CreateSnapshotStores: %s", err)
+		return
+	}
+	return
+}
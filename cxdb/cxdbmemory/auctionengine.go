@@ -1,141 +1,155 @@
 package cxdbmemory
 
 import (
+	"encoding/hex"
 	"fmt"
 	"sync"
 
-	"github.com/mit-dci/opencx/logging"
 	"github.com/mit-dci/opencx/match"
 	"golang.org/x/crypto/sha3"
 )
 
+// MemoryAuctionEngine is an auction matching engine that keeps its orders in memory
 type MemoryAuctionEngine struct {
-	orders     map[match.AuctionID]map[float64][]*match.AuctionOrderIDPair
-	auctionMtx *sync.Mutex
-	pair       *match.Pair
-}
+	orders    map[match.OrderID]*match.AuctionOrderIDPair
+	ordersMtx *sync.Mutex
 
-// PlaceAuctionOrder should place an order for a specific auction ID, and produce a response output.
-// This response output should be used in case the matching engine dies, and this can be replayed to build the state.
-// This method assumes that the auction order is valid, and has the same pair as all of the other orders that have been placed for this matching engine.
-func (me *MemoryAuctionEngine) PlaceAuctionOrder(order *match.AuctionOrder, auctionID *match.AuctionID) (idRes *match.AuctionOrderIDPair, err error) {
-	me.auctionMtx.Lock()
+	// this pair
+	pair *match.Pair
+}
 
-	idCopy := *auctionID
+// CreateAuctionEngine creates an auction matching engine for a pair
+func CreateAuctionEngine(pair *match.Pair) (engine match.AuctionEngine, err error) {
+	engine = &MemoryAuctionEngine{
+		orders:    make(map[match.OrderID]*match.AuctionOrderIDPair),
+		ordersMtx: new(sync.Mutex),
+		pair:      pair,
+	}
+	return
+}
 
-	// First get the price of the order, if this errors then that's really bad
-	var pr float64
-	if pr, err = order.Price(); err != nil {
-		err = fmt.Errorf("Critical error when placing order for matching engine: %s", err)
-		me.auctionMtx.Unlock()
+// PlaceAuctionOrder places an order for a specific auction ID.
+// This assumes that the auction order is valid and is for the same pair as the matching engine
+func (me *MemoryAuctionEngine) PlaceAuctionOrder(order *match.AuctionOrder, auctionID *match.AuctionID) (idRes *match.AuctionOrderIDPair, err error) {
+	var price float64
+	if price, err = order.Price(); err != nil {
+		err = fmt.Errorf("Error getting price from order while placing order: %s", err)
 		return
 	}
 
-	// Now create an ID. If this errors then that's really bad
-	var id [32]byte
-	hasher := sha3.New256()
-	hasher.Write(order.SerializeSignable())
-	copy(id[:], hasher.Sum(nil))
+	// hash order so we can use that as the ID
+	sha := sha3.New256()
+	sha.Write(order.SerializeSignable())
 
-	idRes = &match.AuctionOrderIDPair{
-		OrderID: id,
-		Order:   order,
+	aoid := &match.AuctionOrderIDPair{
+		Order: order,
+		Price: price,
 	}
+	copy(aoid.OrderID[:], sha.Sum(nil))
 
-	// We assume that the order has been properly validated when it goes in to the auction orderbook
-	var ok bool
-	// If the map for the auction isn't there, create it
-	if _, ok = me.orders[idCopy]; !ok {
+	me.ordersMtx.Lock()
+	me.orders[aoid.OrderID] = copyAuctionOrder(aoid)
+	me.ordersMtx.Unlock()
 
-		// Since we assume the order is valid, place it in the auction
-		me.orders[idCopy] = map[float64][]*match.AuctionOrderIDPair{
-			pr: []*match.AuctionOrderIDPair{
-				idRes,
-			},
-		}
-		return
-	}
+	idRes = aoid
+	return
+}
 
-	// if the map for the auction is there but the price index isn't, create it
-	if _, ok = me.orders[idCopy][pr]; !ok {
-		me.orders[idCopy][pr] = []*match.AuctionOrderIDPair{
-			idRes,
-		}
+// CancelAuctionOrder cancels an auction order, this assumes that the auction order actually exists
+func (me *MemoryAuctionEngine) CancelAuctionOrder(orderID *match.OrderID) (cancelled *match.CancelledOrder, cancelSettlement *match.SettlementExecution, err error) {
+	me.ordersMtx.Lock()
+	cancelledOrder, ok := me.orders[*orderID]
+	if !ok {
+		me.ordersMtx.Unlock()
+		err = fmt.Errorf("Order %x does not exist, cannot cancel", orderID[:])
 		return
 	}
+	delete(me.orders, *orderID)
+	me.ordersMtx.Unlock()
 
-	// if both are fine then awesome
-	me.orders[idCopy][pr] = append(me.orders[idCopy][pr], idRes)
-
-	me.auctionMtx.Unlock()
+	cancelled = &match.CancelledOrder{
+		OrderID: orderID,
+	}
+	var debitAsset match.Asset
+	if cancelledOrder.Order.Side == match.Buy {
+		debitAsset = me.pair.AssetHave
+	} else {
+		debitAsset = me.pair.AssetWant
+	}
+	cancelSettlement = &match.SettlementExecution{
+		Pubkey:    cancelledOrder.Order.Pubkey,
+		Amount:    cancelledOrder.Order.AmountHave,
+		Type:      match.Debit,
+		Asset:     debitAsset,
+		Reason:    match.ReasonCancelRefund,
+		Reference: hex.EncodeToString(orderID[:]),
+	}
 	return
 }
 
-// CancelAuctionOrder should cancel an order for a specific order ID, and produce a response output.
-// This response output should be used in case the matching engine dies, and this can be replayed to build the state.
-func (me *MemoryAuctionEngine) CancelAuctionOrder(id *match.OrderID) (cancelled *match.CancelledOrder, cancelSettlement *match.SettlementExecution, err error) {
-	me.auctionMtx.Lock()
-	// Go through the maps and, since we don't have an order ID => order index just delete em all
-	var deletedOrder *match.AuctionOrderIDPair
-	for _, orderMap := range me.orders {
-		for pr, orderIDPairList := range orderMap {
-			var deletedIdx int
-			var deleted bool
-			for idx, orderIDPair := range orderIDPairList {
-				if orderIDPair.OrderID == *id {
-					deletedOrder = orderIDPair
-					deleted = true
-					deletedIdx = idx
-				}
-			}
-
-			// If deleted remove from thing
-			if deleted {
-				oidLen := len(orderIDPairList)
-				orderIDPairList[oidLen-1], orderIDPairList[deletedIdx] = orderIDPairList[deletedIdx], orderIDPairList[oidLen-1]
-				orderMap[pr] = orderIDPairList[:oidLen-1]
-			}
+// MatchAuctionOrders calculates a single clearing price to execute orders at, and executes at that price.
+func (me *MemoryAuctionEngine) MatchAuctionOrders(auctionID *match.AuctionID) (orderExecs []*match.OrderExecution, settlementExecs []*match.SettlementExecution, err error) {
+	me.ordersMtx.Lock()
+	defer me.ordersMtx.Unlock()
+
+	book := make(map[float64][]*match.AuctionOrderIDPair)
+	for _, aoid := range me.orders {
+		if aoid.Order.AuctionID == *auctionID {
+			book[aoid.Price] = append(book[aoid.Price], copyAuctionOrder(aoid))
 		}
 	}
-	// Get side from string rip
-	var orderSide *match.Side
-	orderSide = new(match.Side)
-	// because we just init the pointer we can get the value and set
-	*orderSide = deletedOrder.Order.Side
 
-	var debitAsset match.Asset
-	if *orderSide == match.Buy {
-		debitAsset = me.pair.AssetHave
-	} else {
-		debitAsset = me.pair.AssetWant
+	if orderExecs, settlementExecs, err = match.MatchClearingAlgorithm(book); err != nil {
+		orderExecs = nil
+		settlementExecs = nil
+		err = fmt.Errorf("Error running clearing matching algorithm for MatchAuctionOrders: %s", err)
+		return
 	}
-	cancelled = &match.CancelledOrder{
-		OrderID: id,
+
+	// Update the matching engine with the new state
+	for _, orderExec := range orderExecs {
+		updateAuctionOrder(me.orders, orderExec)
 	}
+	return
+}
 
-	cancelSettlement = &match.SettlementExecution{
-		Pubkey: deletedOrder.Order.Pubkey,
-		Amount: deletedOrder.Order.AmountHave,
-		Asset:  debitAsset,
-		Type:   match.Debit,
+// updateAuctionOrder deletes the order in the execution if it was filled, and updates its amounts
+// if it was not.
+func updateAuctionOrder(orders map[match.OrderID]*match.AuctionOrderIDPair, orderExec *match.OrderExecution) {
+	if orderExec.Filled {
+		delete(orders, orderExec.OrderID)
+		return
+	}
+	if aoid, ok := orders[orderExec.OrderID]; ok {
+		aoid.Order.AmountHave = orderExec.NewAmountHave
+		aoid.Order.AmountWant = orderExec.NewAmountWant
 	}
-	me.auctionMtx.Unlock()
 	return
 }
 
-// MatchAuctionOrders matches the auction orders for a specific auction ID
-func (me *MemoryAuctionEngine) MatchAuctionOrders(auctionID *match.AuctionID) (orderExecs []*match.OrderExecution, settlementExecs []*match.SettlementExecution, err error) {
-	// TODO
-	logging.Fatalf("UNIMPLEMENTED!")
+// copyAuctionOrder copies an order and its ID, so the engine and the orderbook never share an
+// order with each other or with whoever placed it.
+func copyAuctionOrder(aoid *match.AuctionOrderIDPair) (aoidCopy *match.AuctionOrderIDPair) {
+	aoidCopy = &match.AuctionOrderIDPair{
+		OrderID: aoid.OrderID,
+		Price:   aoid.Price,
+		Order:   new(match.AuctionOrder),
+	}
+	*aoidCopy.Order = *aoid.Order
 	return
 }
 
-func CreateAuctionEngineMap(pairList []*match.Pair) (mengines map[match.Pair]match.AuctionEngine, err error) {
-	mengines = make(map[match.Pair]match.AuctionEngine)
+// CreateAuctionEngineMap creates a map of pair to auction engine, given a list of pairs.
+func CreateAuctionEngineMap(pairList []*match.Pair) (aucMap map[match.Pair]match.AuctionEngine, err error) {
 
-	// We just create a new struct because that's all we really need, we satisfy the interface
+	aucMap = make(map[match.Pair]match.AuctionEngine)
+	var curAucEng match.AuctionEngine
 	for _, pair := range pairList {
-		mengines[*pair] = new(MemoryAuctionEngine)
+		if curAucEng, err = CreateAuctionEngine(pair); err != nil {
+			err = fmt.Errorf("Error creating single auction engine while creating auction engine map: %s", err)
+			return
+		}
+		aucMap[*pair] = curAucEng
 	}
 
 	return
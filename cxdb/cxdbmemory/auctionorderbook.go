@@ -2,15 +2,20 @@ package cxdbmemory
 
 import (
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/mit-dci/lit/crypto/koblitz"
-	"github.com/mit-dci/opencx/logging"
 	"github.com/mit-dci/opencx/match"
 )
 
-// MemoryAuctionOrderbook is the representation of a auction orderbook for SQL
+// MemoryAuctionOrderbook is the read-only copy of an auction orderbook, kept in memory
 type MemoryAuctionOrderbook struct {
-	// TODO: implement this
+	orders    map[match.OrderID]*match.AuctionOrderIDPair
+	fills     map[match.OrderID][]*match.OrderFill
+	archive   map[match.OrderID]*match.ArchivedAuctionOrder
+	ordersMtx *sync.Mutex
 
 	// this pair
 	pair *match.Pair
@@ -18,61 +23,232 @@ type MemoryAuctionOrderbook struct {
 
 // CreateAuctionOrderbook creates a auction orderbook based on a pair
 func CreateAuctionOrderbook(pair *match.Pair) (book match.AuctionOrderbook, err error) {
-	// Set values for auction engine
-	mo := &MemoryAuctionOrderbook{
-		pair: pair,
+	book = &MemoryAuctionOrderbook{
+		orders:    make(map[match.OrderID]*match.AuctionOrderIDPair),
+		fills:     make(map[match.OrderID][]*match.OrderFill),
+		archive:   make(map[match.OrderID]*match.ArchivedAuctionOrder),
+		ordersMtx: new(sync.Mutex),
+		pair:      pair,
 	}
-	// We can connect, now set return
-	book = mo
 	return
 }
 
 // UpdateBookExec takes in an order execution and updates the orderbook.
 func (mo *MemoryAuctionOrderbook) UpdateBookExec(exec *match.OrderExecution) (err error) {
-	// TODO: Implement
-	logging.Fatalf("UNIMPLEMENTED!")
+	mo.ordersMtx.Lock()
+	defer mo.ordersMtx.Unlock()
+	aoid, ok := mo.orders[exec.OrderID]
+	if !ok {
+		err = fmt.Errorf("Order %x is not in the orderbook", exec.OrderID[:])
+		return
+	}
+	now := time.Now()
+	fill := match.NewOrderFill(aoid.Order.AmountWant, aoid.Order.AmountHave, exec, now)
+	mo.fills[exec.OrderID] = append(mo.fills[exec.OrderID], fill)
+	if exec.Filled {
+		// the last fill took everything that was left
+		filled := copyAuctionOrder(aoid)
+		filled.Order.AmountWant = 0
+		filled.Order.AmountHave = 0
+		mo.archiveOrder(filled, match.OrderFilled, now)
+	}
+	updateAuctionOrder(mo.orders, exec)
 	return
 }
 
 // UpdateBookCancel takes in an order cancellation and updates the orderbook.
 func (mo *MemoryAuctionOrderbook) UpdateBookCancel(cancel *match.CancelledOrder) (err error) {
-	// TODO: Implement
-	logging.Fatalf("UNIMPLEMENTED!")
+	mo.ordersMtx.Lock()
+	defer mo.ordersMtx.Unlock()
+	aoid, ok := mo.orders[*cancel.OrderID]
+	if !ok {
+		err = fmt.Errorf("Order %x is not in the orderbook", cancel.OrderID[:])
+		return
+	}
+	mo.archiveOrder(aoid, match.CancelStatus(mo.fills[*cancel.OrderID]), time.Now())
+	delete(mo.orders, *cancel.OrderID)
+	return
+}
+
+// UpdateBookReject archives an order as rejected, taking it out of the orderbook if it's there.
+func (mo *MemoryAuctionOrderbook) UpdateBookReject(auctionIDPair *match.AuctionOrderIDPair) (err error) {
+	mo.ordersMtx.Lock()
+	defer mo.ordersMtx.Unlock()
+	mo.archiveOrder(auctionIDPair, match.OrderRejected, time.Now())
+	delete(mo.orders, auctionIDPair.OrderID)
+	return
+}
+
+// archiveOrder moves the fills for an order to the archive, along with the order as it was
+// placed. This does not take it out of the orderbook.
+func (mo *MemoryAuctionOrderbook) archiveOrder(aoid *match.AuctionOrderIDPair, status match.OrderStatus, closedAt time.Time) {
+	fills := mo.fills[aoid.OrderID]
+	delete(mo.fills, aoid.OrderID)
+
+	original := copyAuctionOrder(aoid)
+	filledWant, filledHave := match.FilledAmounts(fills)
+	original.Order.AmountWant += filledWant
+	original.Order.AmountHave += filledHave
+	mo.archive[aoid.OrderID] = &match.ArchivedAuctionOrder{
+		Order:    original,
+		Status:   status,
+		Fills:    fills,
+		ClosedAt: closedAt,
+	}
 	return
 }
 
 // UpdateBookPlace takes in an order, ID, auction ID, and adds the order to the orderbook.
 func (mo *MemoryAuctionOrderbook) UpdateBookPlace(auctionIDPair *match.AuctionOrderIDPair) (err error) {
-	// TODO: Implement
-	logging.Fatalf("UNIMPLEMENTED!")
+	mo.ordersMtx.Lock()
+	mo.orders[auctionIDPair.OrderID] = copyAuctionOrder(auctionIDPair)
+	mo.ordersMtx.Unlock()
 	return
 }
 
 // GetOrder gets an order from an OrderID
 func (mo *MemoryAuctionOrderbook) GetOrder(orderID *match.OrderID) (aucOrder *match.AuctionOrderIDPair, err error) {
-	// TODO: Implement
-	logging.Fatalf("UNIMPLEMENTED!")
+	mo.ordersMtx.Lock()
+	defer mo.ordersMtx.Unlock()
+	aoid, ok := mo.orders[*orderID]
+	if !ok {
+		err = fmt.Errorf("Order %x does not exist", orderID[:])
+		return
+	}
+	aucOrder = copyAuctionOrder(aoid)
 	return
 }
 
-// CalculatePrice takes in a pair and returns the calculated price based on the orderbook.
+// CalculatePrice returns the calculated price for an auction based on the orderbook. This is
+// based on the midpoint of the spread.
 func (mo *MemoryAuctionOrderbook) CalculatePrice(auctionID *match.AuctionID) (price float64, err error) {
-	// TODO: Implement
-	logging.Fatalf("UNIMPLEMENTED!")
+	mo.ordersMtx.Lock()
+	defer mo.ordersMtx.Unlock()
+
+	var maxSell float64
+	var minBuy float64
+	var seenBuy bool
+	for _, aoid := range mo.orders {
+		if aoid.Order.AuctionID != *auctionID {
+			continue
+		}
+		if aoid.Order.Side == match.Sell {
+			if aoid.Price > maxSell {
+				maxSell = aoid.Price
+			}
+		} else if !seenBuy || aoid.Price < minBuy {
+			minBuy = aoid.Price
+			seenBuy = true
+		}
+	}
+
+	price = (minBuy + maxSell) / 2
 	return
 }
 
 // GetOrdersForPubkey gets orders for a specific pubkey.
 func (mo *MemoryAuctionOrderbook) GetOrdersForPubkey(pubkey *koblitz.PublicKey) (orders map[float64][]*match.AuctionOrderIDPair, err error) {
-	// TODO: Implement
-	logging.Fatalf("UNIMPLEMENTED!")
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	orders = make(map[float64][]*match.AuctionOrderIDPair)
+	mo.ordersMtx.Lock()
+	for _, aoid := range mo.orders {
+		if aoid.Order.Pubkey == pubkeyBytes {
+			orders[aoid.Price] = append(orders[aoid.Price], copyAuctionOrder(aoid))
+		}
+	}
+	mo.ordersMtx.Unlock()
 	return
 }
 
-// ViewAuctionOrderbook takes in a trading pair and returns the orderbook as a map
+// ViewAuctionOrderBook returns the whole orderbook as a map of price to orders
 func (mo *MemoryAuctionOrderbook) ViewAuctionOrderBook() (book map[float64][]*match.AuctionOrderIDPair, err error) {
-	// TODO: Implement
-	logging.Fatalf("UNIMPLEMENTED!")
+	book = make(map[float64][]*match.AuctionOrderIDPair)
+	mo.ordersMtx.Lock()
+	for _, aoid := range mo.orders {
+		book[aoid.Price] = append(book[aoid.Price], copyAuctionOrder(aoid))
+	}
+	mo.ordersMtx.Unlock()
+	return
+}
+
+// GetArchivedOrder gets an order that is no longer in the orderbook
+func (mo *MemoryAuctionOrderbook) GetArchivedOrder(orderID *match.OrderID) (archived *match.ArchivedAuctionOrder, err error) {
+	mo.ordersMtx.Lock()
+	defer mo.ordersMtx.Unlock()
+	arc, ok := mo.archive[*orderID]
+	if !ok {
+		err = fmt.Errorf("Order %x is not in the archive", orderID[:])
+		return
+	}
+	archived = copyArchivedAuctionOrder(arc)
+	return
+}
+
+// GetArchivedOrdersForPubkey gets the orders for a pubkey that are no longer in the orderbook, in
+// the order they were closed.
+func (mo *MemoryAuctionOrderbook) GetArchivedOrdersForPubkey(pubkey *koblitz.PublicKey) (archived []*match.ArchivedAuctionOrder, err error) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	mo.ordersMtx.Lock()
+	for _, arc := range mo.archive {
+		if arc.Order.Order.Pubkey == pubkeyBytes {
+			archived = append(archived, copyArchivedAuctionOrder(arc))
+		}
+	}
+	mo.ordersMtx.Unlock()
+
+	sort.SliceStable(archived, func(i, j int) bool {
+		return archived[i].ClosedAt.Before(archived[j].ClosedAt)
+	})
+	return
+}
+
+// ViewArchive gets every order that is no longer in the orderbook, in the order they were closed
+func (mo *MemoryAuctionOrderbook) ViewArchive() (archived []*match.ArchivedAuctionOrder, err error) {
+	mo.ordersMtx.Lock()
+	for _, arc := range mo.archive {
+		archived = append(archived, copyArchivedAuctionOrder(arc))
+	}
+	mo.ordersMtx.Unlock()
+
+	sort.SliceStable(archived, func(i, j int) bool {
+		return archived[i].ClosedAt.Before(archived[j].ClosedAt)
+	})
+	return
+}
+
+// RestoreArchivedOrder puts an order into the archive as it was archived
+func (mo *MemoryAuctionOrderbook) RestoreArchivedOrder(archived *match.ArchivedAuctionOrder) (err error) {
+	mo.ordersMtx.Lock()
+	mo.archive[archived.Order.OrderID] = copyArchivedAuctionOrder(archived)
+	mo.ordersMtx.Unlock()
+	return
+}
+
+// PruneArchive deletes the archived orders that were closed before the cutoff
+func (mo *MemoryAuctionOrderbook) PruneArchive(before time.Time) (pruned uint64, err error) {
+	mo.ordersMtx.Lock()
+	for orderID, arc := range mo.archive {
+		if arc.ClosedAt.Before(before) {
+			delete(mo.archive, orderID)
+			pruned++
+		}
+	}
+	mo.ordersMtx.Unlock()
+	return
+}
+
+// copyArchivedAuctionOrder copies an archived order and its fills
+func copyArchivedAuctionOrder(arc *match.ArchivedAuctionOrder) (arcCopy *match.ArchivedAuctionOrder) {
+	arcCopy = &match.ArchivedAuctionOrder{
+		Order:    copyAuctionOrder(arc.Order),
+		Status:   arc.Status,
+		ClosedAt: arc.ClosedAt,
+		Fills:    copyOrderFills(arc.Fills),
+	}
 	return
 }
 
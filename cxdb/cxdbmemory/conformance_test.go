@@ -0,0 +1,56 @@
+package cxdbmemory
+
+import (
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/cxdb/cxdbtest"
+	"github.com/mit-dci/opencx/match"
+)
+
+func TestLimitEngineConformance(t *testing.T) {
+	cxdbtest.RunLimitEngineTests(t, CreateLimitEngine)
+}
+
+func TestSettlementEngineConformance(t *testing.T) {
+	cxdbtest.RunSettlementEngineTests(t, CreateSettlementEngine)
+}
+
+func TestSettlementStoreConformance(t *testing.T) {
+	cxdbtest.RunSettlementStoreTests(t, CreateSettlementStore)
+}
+
+func TestLimitOrderbookConformance(t *testing.T) {
+	cxdbtest.RunLimitOrderbookTests(t, CreateLimitOrderbook)
+}
+
+func TestAuctionEngineConformance(t *testing.T) {
+	cxdbtest.RunAuctionEngineTests(t, CreateAuctionEngine)
+}
+
+func TestAuctionOrderbookConformance(t *testing.T) {
+	cxdbtest.RunAuctionOrderbookTests(t, CreateAuctionOrderbook)
+}
+
+func TestDepositStoreConformance(t *testing.T) {
+	cxdbtest.RunDepositStoreTests(t, CreateDepositStore)
+}
+
+func TestPuzzleStoreConformance(t *testing.T) {
+	cxdbtest.RunPuzzleStoreTests(t, CreatePuzzleStore)
+}
+
+func TestSnapshotConformance(t *testing.T) {
+	cxdbtest.RunSnapshotTests(t, CreateSnapshotStores, CreateSnapshotStores)
+}
+
+func TestLedgerStoreConformance(t *testing.T) {
+	cxdbtest.RunLedgerStoreTests(t, func(coin *coinparam.Params) (engine match.SettlementEngine, store cxdb.LedgerStore, err error) {
+		if engine, err = CreateSettlementEngine(coin); err != nil {
+			return
+		}
+		store, err = CreateLedgerStore(coin, engine)
+		return
+	})
+}
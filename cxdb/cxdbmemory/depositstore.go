@@ -0,0 +1,246 @@
+package cxdbmemory
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// memPendingDeposit is a deposit we've seen, as well as the height at which it should be credited
+// and whether or not it has been credited yet.
+type memPendingDeposit struct {
+	deposit         match.Deposit
+	expectedConfirm uint64
+	credited        bool
+	swept           bool
+}
+
+// MemoryDepositStore is a deposit store representation for an in memory database
+type MemoryDepositStore struct {
+	// map of deposit address to pubkey
+	depositAddrs map[string]*koblitz.PublicKey
+	// deposits we've seen, credited or not
+	pendingDeposits []*memPendingDeposit
+	// map of pubkey to the index used to derive its deposit address
+	depositIndexes map[[33]byte]uint32
+	depositMtx     *sync.Mutex
+
+	// this coin
+	coin *coinparam.Params
+}
+
+// CreateDepositStore creates a deposit store for a specific coin.
+func CreateDepositStore(coin *coinparam.Params) (store cxdb.DepositStore, err error) {
+	// Set values
+	md := &MemoryDepositStore{
+		depositAddrs:   make(map[string]*koblitz.PublicKey),
+		depositIndexes: make(map[[33]byte]uint32),
+		depositMtx:     new(sync.Mutex),
+		coin:           coin,
+	}
+	// Now we actually set the store
+	store = md
+	return
+}
+
+// RegisterUser takes in a pubkey, and an address for the pubkey
+func (md *MemoryDepositStore) RegisterUser(pubkey *koblitz.PublicKey, address string) (err error) {
+	md.depositMtx.Lock()
+	md.depositAddrs[address] = pubkey
+	md.depositMtx.Unlock()
+	return
+}
+
+// UpdateDeposits updates the deposits when a block comes in, and returns execs for deposits that are
+// now confirmed
+func (md *MemoryDepositStore) UpdateDeposits(deposits []match.Deposit, blockheight uint64) (depositExecs []*match.SettlementExecution, err error) {
+
+	var depositAsset match.Asset
+	if depositAsset, err = match.AssetFromCoinParam(md.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param for UpdateDeposits: %s", err)
+		return
+	}
+
+	md.depositMtx.Lock()
+	for _, deposit := range deposits {
+		md.pendingDeposits = append(md.pendingDeposits, &memPendingDeposit{
+			deposit:         deposit,
+			expectedConfirm: deposit.CreditHeight(),
+		})
+	}
+
+	for _, pending := range md.pendingDeposits {
+		if !pending.credited && pending.expectedConfirm <= blockheight {
+			// A confirmed deposit is a debit for the deposit store's asset
+			currSettlement := &match.SettlementExecution{
+				Amount:    pending.deposit.Amount,
+				Asset:     depositAsset,
+				Type:      match.Debit,
+				Reason:    match.ReasonDeposit,
+				Reference: pending.deposit.Txid,
+			}
+			copy(currSettlement.Pubkey[:], pending.deposit.Pubkey.SerializeCompressed())
+			depositExecs = append(depositExecs, currSettlement)
+			pending.credited = true
+		}
+	}
+	md.depositMtx.Unlock()
+	return
+}
+
+// RollbackDeposits removes the pending deposits that were received in the orphaned blocks. Deposits
+// that were already credited are returned as credit executions that reverse them.
+func (md *MemoryDepositStore) RollbackDeposits(orphanedBlockHashes []string) (reorgExecs []*match.SettlementExecution, err error) {
+
+	var depositAsset match.Asset
+	if depositAsset, err = match.AssetFromCoinParam(md.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param for RollbackDeposits: %s", err)
+		return
+	}
+
+	orphaned := make(map[string]bool)
+	for _, hash := range orphanedBlockHashes {
+		orphaned[hash] = true
+	}
+
+	md.depositMtx.Lock()
+	var remaining []*memPendingDeposit
+	for _, pending := range md.pendingDeposits {
+		if !orphaned[pending.deposit.BlockHash] {
+			remaining = append(remaining, pending)
+			continue
+		}
+		if pending.credited {
+			// A reorged deposit that was credited is a credit for the deposit store's asset
+			currSettlement := &match.SettlementExecution{
+				Amount:    pending.deposit.Amount,
+				Asset:     depositAsset,
+				Type:      match.Credit,
+				Reason:    match.ReasonDepositReorg,
+				Reference: pending.deposit.Txid,
+			}
+			copy(currSettlement.Pubkey[:], pending.deposit.Pubkey.SerializeCompressed())
+			reorgExecs = append(reorgExecs, currSettlement)
+		}
+	}
+	md.pendingDeposits = remaining
+	md.depositMtx.Unlock()
+	return
+}
+
+// GetPendingDeposits gets the deposits for a pubkey that have been received but not yet credited
+func (md *MemoryDepositStore) GetPendingDeposits(pubkey *koblitz.PublicKey) (pending []*match.Deposit, err error) {
+	pending = md.getDepositsForPubkey(pubkey, false)
+	return
+}
+
+// GetDepositHistory gets the deposits for a pubkey that have been credited
+func (md *MemoryDepositStore) GetDepositHistory(pubkey *koblitz.PublicKey) (history []*match.Deposit, err error) {
+	history = md.getDepositsForPubkey(pubkey, true)
+	return
+}
+
+// getDepositsForPubkey gets either the credited or uncredited deposits for a pubkey, in the order
+// they were received
+func (md *MemoryDepositStore) getDepositsForPubkey(pubkey *koblitz.PublicKey, credited bool) (deposits []*match.Deposit) {
+	md.depositMtx.Lock()
+	for _, pending := range md.pendingDeposits {
+		if pending.credited == credited && pending.deposit.Pubkey.IsEqual(pubkey) {
+			currDeposit := new(match.Deposit)
+			*currDeposit = pending.deposit
+			deposits = append(deposits, currDeposit)
+		}
+	}
+	md.depositMtx.Unlock()
+	return
+}
+
+// GetDepositIndex gets the index used to derive deposit addresses for a pubkey, assigning the next
+// unused index if the pubkey does not have one yet.
+func (md *MemoryDepositStore) GetDepositIndex(pubkey *koblitz.PublicKey) (index uint32, err error) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	md.depositMtx.Lock()
+	var ok bool
+	if index, ok = md.depositIndexes[pubkeyBytes]; !ok {
+		index = uint32(len(md.depositIndexes))
+		md.depositIndexes[pubkeyBytes] = index
+	}
+	md.depositMtx.Unlock()
+	return
+}
+
+// GetSweepableDeposits gets all credited deposits whose outputs have not been swept yet
+func (md *MemoryDepositStore) GetSweepableDeposits() (deposits []*match.Deposit, err error) {
+	md.depositMtx.Lock()
+	for _, pending := range md.pendingDeposits {
+		if pending.credited && !pending.swept {
+			currDeposit := new(match.Deposit)
+			*currDeposit = pending.deposit
+			deposits = append(deposits, currDeposit)
+		}
+	}
+	md.depositMtx.Unlock()
+	return
+}
+
+// MarkDepositsSwept marks the outputs of the given deposits as swept
+func (md *MemoryDepositStore) MarkDepositsSwept(deposits []*match.Deposit) (err error) {
+	md.depositMtx.Lock()
+	for _, deposit := range deposits {
+		for _, pending := range md.pendingDeposits {
+			if pending.deposit.Txid == deposit.Txid && pending.deposit.Vout == deposit.Vout {
+				pending.swept = true
+			}
+		}
+	}
+	md.depositMtx.Unlock()
+	return
+}
+
+// GetDepositAddressMap gets a map of the deposit addresses we own to pubkeys
+func (md *MemoryDepositStore) GetDepositAddressMap() (depAddrMap map[string]*koblitz.PublicKey, err error) {
+	depAddrMap = make(map[string]*koblitz.PublicKey)
+	md.depositMtx.Lock()
+	for addr, pubkey := range md.depositAddrs {
+		depAddrMap[addr] = pubkey
+	}
+	md.depositMtx.Unlock()
+	return
+}
+
+// GetDepositAddress gets the deposit address for a pubkey and an asset.
+func (md *MemoryDepositStore) GetDepositAddress(pubkey *koblitz.PublicKey) (addr string, err error) {
+	md.depositMtx.Lock()
+	for currAddr, currPubkey := range md.depositAddrs {
+		if currPubkey.IsEqual(pubkey) {
+			addr = currAddr
+			md.depositMtx.Unlock()
+			return
+		}
+	}
+	md.depositMtx.Unlock()
+	err = fmt.Errorf("Could not find deposit address for pubkey %x", pubkey.SerializeCompressed())
+	return
+}
+
+// CreateDepositStoreMap creates a map of coin to deposit store, given a list of coins.
+func CreateDepositStoreMap(coins []*coinparam.Params) (depMap map[*coinparam.Params]cxdb.DepositStore, err error) {
+
+	depMap = make(map[*coinparam.Params]cxdb.DepositStore)
+	var curDepStore cxdb.DepositStore
+	for _, coin := range coins {
+		if curDepStore, err = CreateDepositStore(coin); err != nil {
+			err = fmt.Errorf("Error creating single deposit store while creating deposit store map: %s", err)
+			return
+		}
+		depMap[coin] = curDepStore
+	}
+
+	return
+}
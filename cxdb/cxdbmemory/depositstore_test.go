@@ -0,0 +1,204 @@
+package cxdbmemory
+
+import (
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// testDepositAt creates a 1BTC test deposit received in the block with the given hash and height
+func testDepositAt(t *testing.T, blockHash string, height uint64) (deposit match.Deposit) {
+	var err error
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Fatalf("Error creating private key for test deposit: %s", err)
+	}
+	deposit = match.Deposit{
+		Pubkey:              privkey.PubKey(),
+		Address:             "testaddress",
+		Amount:              uint64(100000000),
+		Txid:                "testtxid",
+		CoinType:            &coinparam.BitcoinParams,
+		BlockHeightReceived: height,
+		BlockHash:           blockHash,
+		Confirmations:       6,
+	}
+	return
+}
+
+func TestDepositCreditedOnce(t *testing.T) {
+	var err error
+
+	var store cxdb.DepositStore
+	if store, err = CreateDepositStore(&coinparam.BitcoinParams); err != nil {
+		t.Errorf("Error creating deposit store for TestDepositCreditedOnce: %s", err)
+		return
+	}
+
+	deposit := testDepositAt(t, "blockA", 100)
+	var execs []*match.SettlementExecution
+	if execs, err = store.UpdateDeposits([]match.Deposit{deposit}, 100); err != nil {
+		t.Errorf("Error updating deposits for TestDepositCreditedOnce: %s", err)
+		return
+	}
+	if len(execs) != 0 {
+		t.Errorf("Deposit should not be credited before confirmations, got %d execs", len(execs))
+		return
+	}
+
+	// Skip past the confirm height, it should still be credited
+	if execs, err = store.UpdateDeposits([]match.Deposit{}, 107); err != nil {
+		t.Errorf("Error updating deposits for TestDepositCreditedOnce: %s", err)
+		return
+	}
+	if len(execs) != 1 || execs[0].Type != match.Debit || execs[0].Amount != deposit.Amount {
+		t.Errorf("Deposit should have been credited exactly once at confirm height, got %d execs", len(execs))
+		return
+	}
+
+	// Seeing the same height again (like after a reorg) should not credit twice
+	if execs, err = store.UpdateDeposits([]match.Deposit{}, 107); err != nil {
+		t.Errorf("Error updating deposits for TestDepositCreditedOnce: %s", err)
+		return
+	}
+	if len(execs) != 0 {
+		t.Errorf("Deposit should not be credited twice, got %d execs", len(execs))
+		return
+	}
+
+	return
+}
+
+func TestDepositReorg(t *testing.T) {
+	var err error
+
+	var store cxdb.DepositStore
+	if store, err = CreateDepositStore(&coinparam.BitcoinParams); err != nil {
+		t.Errorf("Error creating deposit store for TestDepositReorg: %s", err)
+		return
+	}
+
+	// one deposit that will be credited then reorged, one that is reorged while pending, and one
+	// that stays in the main chain
+	creditedDeposit := testDepositAt(t, "orphanA", 100)
+	pendingDeposit := testDepositAt(t, "orphanB", 104)
+	safeDeposit := testDepositAt(t, "mainC", 101)
+
+	if _, err = store.UpdateDeposits([]match.Deposit{creditedDeposit}, 100); err != nil {
+		t.Errorf("Error updating deposits for TestDepositReorg: %s", err)
+		return
+	}
+	if _, err = store.UpdateDeposits([]match.Deposit{safeDeposit}, 101); err != nil {
+		t.Errorf("Error updating deposits for TestDepositReorg: %s", err)
+		return
+	}
+	if _, err = store.UpdateDeposits([]match.Deposit{pendingDeposit}, 104); err != nil {
+		t.Errorf("Error updating deposits for TestDepositReorg: %s", err)
+		return
+	}
+
+	var execs []*match.SettlementExecution
+	if execs, err = store.UpdateDeposits([]match.Deposit{}, 106); err != nil {
+		t.Errorf("Error updating deposits for TestDepositReorg: %s", err)
+		return
+	}
+	if len(execs) != 1 {
+		t.Errorf("Expected 1 deposit to be credited at height 106, got %d", len(execs))
+		return
+	}
+
+	var reorgExecs []*match.SettlementExecution
+	if reorgExecs, err = store.RollbackDeposits([]string{"orphanA", "orphanB"}); err != nil {
+		t.Errorf("Error rolling back deposits for TestDepositReorg: %s", err)
+		return
+	}
+
+	// only the credited deposit should be reversed
+	if len(reorgExecs) != 1 {
+		t.Errorf("Expected 1 reorg exec, got %d", len(reorgExecs))
+		return
+	}
+	var expectedPubkey [33]byte
+	copy(expectedPubkey[:], creditedDeposit.Pubkey.SerializeCompressed())
+	if reorgExecs[0].Type != match.Credit || reorgExecs[0].Amount != creditedDeposit.Amount || reorgExecs[0].Pubkey != expectedPubkey {
+		t.Errorf("Reorg exec should reverse the credited deposit, got %s", reorgExecs[0].String())
+		return
+	}
+
+	// The deposit that stayed in the main chain should be credited, the pending one should never be
+	if execs, err = store.UpdateDeposits([]match.Deposit{}, 110); err != nil {
+		t.Errorf("Error updating deposits for TestDepositReorg: %s", err)
+		return
+	}
+	copy(expectedPubkey[:], safeDeposit.Pubkey.SerializeCompressed())
+	if len(execs) != 1 || execs[0].Pubkey != expectedPubkey {
+		t.Errorf("Expected only the main chain deposit to be credited after reorg, got %d execs", len(execs))
+		return
+	}
+
+	return
+}
+
+func TestPendingDepositsAndHistory(t *testing.T) {
+	var err error
+
+	var store cxdb.DepositStore
+	if store, err = CreateDepositStore(&coinparam.BitcoinParams); err != nil {
+		t.Errorf("Error creating deposit store for TestPendingDepositsAndHistory: %s", err)
+		return
+	}
+
+	firstDeposit := testDepositAt(t, "blockA", 100)
+	secondDeposit := testDepositAt(t, "blockB", 103)
+	// same user for both
+	secondDeposit.Pubkey = firstDeposit.Pubkey
+
+	if _, err = store.UpdateDeposits([]match.Deposit{firstDeposit}, 100); err != nil {
+		t.Errorf("Error updating deposits for TestPendingDepositsAndHistory: %s", err)
+		return
+	}
+	if _, err = store.UpdateDeposits([]match.Deposit{secondDeposit}, 103); err != nil {
+		t.Errorf("Error updating deposits for TestPendingDepositsAndHistory: %s", err)
+		return
+	}
+
+	var pending []*match.Deposit
+	if pending, err = store.GetPendingDeposits(firstDeposit.Pubkey); err != nil {
+		t.Errorf("Error getting pending deposits for TestPendingDepositsAndHistory: %s", err)
+		return
+	}
+	if len(pending) != 2 {
+		t.Errorf("Expected 2 pending deposits, got %d", len(pending))
+		return
+	}
+
+	// the first one should be credited now
+	if _, err = store.UpdateDeposits([]match.Deposit{}, 106); err != nil {
+		t.Errorf("Error updating deposits for TestPendingDepositsAndHistory: %s", err)
+		return
+	}
+
+	if pending, err = store.GetPendingDeposits(firstDeposit.Pubkey); err != nil {
+		t.Errorf("Error getting pending deposits for TestPendingDepositsAndHistory: %s", err)
+		return
+	}
+	if len(pending) != 1 || pending[0].BlockHeightReceived != 103 || pending[0].Confirmations != 6 {
+		t.Errorf("Expected only the second deposit to be pending, got %d pending", len(pending))
+		return
+	}
+
+	var history []*match.Deposit
+	if history, err = store.GetDepositHistory(firstDeposit.Pubkey); err != nil {
+		t.Errorf("Error getting deposit history for TestPendingDepositsAndHistory: %s", err)
+		return
+	}
+	if len(history) != 1 || history[0].BlockHeightReceived != 100 || history[0].Txid != firstDeposit.Txid {
+		t.Errorf("Expected only the first deposit in history, got %d deposits", len(history))
+		return
+	}
+
+	return
+}
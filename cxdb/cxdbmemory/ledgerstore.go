@@ -0,0 +1,254 @@
+package cxdbmemory
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// MemoryLedgerStore reads the ledger that a MemorySettlementEngine writes to, and compares it to the
+// balances the settlement engine keeps.
+type MemoryLedgerStore struct {
+	engine *MemorySettlementEngine
+
+	// this coin
+	coin *coinparam.Params
+}
+
+// ledgerTotalAccount is the account a mismatch is reported for if the whole ledger doesn't sum to
+// zero
+const ledgerTotalAccount = "total"
+
+// CreateLedgerStore creates a ledger store for the ledger of a memory settlement engine, like the
+// one CreateSettlementEngine makes.
+func CreateLedgerStore(coin *coinparam.Params, setEngine match.SettlementEngine) (store cxdb.LedgerStore, err error) {
+	var memEngine *MemorySettlementEngine
+	var ok bool
+	if memEngine, ok = setEngine.(*MemorySettlementEngine); !ok {
+		err = fmt.Errorf("Settlement engine for %s is not a memory settlement engine", coin.Name)
+		return
+	}
+
+	store = &MemoryLedgerStore{
+		engine: memEngine,
+		coin:   coin,
+	}
+	return
+}
+
+// GetAccountStatement gets every ledger entry for the pubkey between from and to, with the balance
+// before and after them.
+func (ls *MemoryLedgerStore) GetAccountStatement(pubkey *koblitz.PublicKey, from time.Time, to time.Time) (statement *match.AccountStatement, err error) {
+	if to.Before(from) {
+		err = fmt.Errorf("Statement end %s is before the start %s", to, from)
+		return
+	}
+
+	var statementAsset match.Asset
+	if statementAsset, err = match.AssetFromCoinParam(ls.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param for GetAccountStatement: %s", err)
+		return
+	}
+
+	statement = &match.AccountStatement{
+		Asset: statementAsset,
+		From:  from,
+		To:    to,
+	}
+	copy(statement.Pubkey[:], pubkey.SerializeCompressed())
+
+	account := fmt.Sprintf("%x", pubkey.SerializeCompressed())
+	var openingBalance int64
+	var closingBalance int64
+	for _, entry := range ls.copyLedger() {
+		if entry.Account != account || !entry.Time.Before(to) {
+			continue
+		}
+		if entry.Time.Before(from) {
+			openingBalance += signedAmount(entry)
+			continue
+		}
+		closingBalance += signedAmount(entry)
+		statement.Entries = append(statement.Entries, entry)
+	}
+
+	statement.OpeningBalance = uint64(openingBalance)
+	statement.ClosingBalance = uint64(openingBalance + closingBalance)
+	return
+}
+
+// CheckConsistency recomputes every user's balance from the ledger and compares it to the balance
+// in the settlement engine. It also makes sure the whole ledger sums to zero.
+func (ls *MemoryLedgerStore) CheckConsistency() (mismatches []*match.LedgerMismatch, err error) {
+
+	var ledgerAsset match.Asset
+	if ledgerAsset, err = match.AssetFromCoinParam(ls.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param for CheckConsistency: %s", err)
+		return
+	}
+
+	// read the ledger and balances under the same lock, so they're from the same point in time
+	ls.engine.balancesMtx.Lock()
+	var ledgerTotal int64
+	ledgerBalances := make(map[string]int64)
+	for _, entry := range ls.engine.ledger {
+		ledgerTotal += signedAmount(entry)
+		// The exchange accounts don't have a balance anywhere else, so we only compare users
+		if !strings.HasPrefix(entry.Account, match.ExchangeAccountPrefix) {
+			ledgerBalances[entry.Account] += signedAmount(entry)
+		}
+	}
+	balances := make(map[string]int64)
+	for acct, amount := range ls.engine.balances {
+		balances[acct.String()] = int64(amount)
+	}
+	ls.engine.balancesMtx.Unlock()
+
+	if ledgerTotal != 0 {
+		mismatches = append(mismatches, &match.LedgerMismatch{
+			Account:       ledgerTotalAccount,
+			Asset:         ledgerAsset,
+			LedgerBalance: ledgerTotal,
+		})
+	}
+
+	for account, amount := range balances {
+		if ledgerBalances[account] != amount {
+			mismatches = append(mismatches, &match.LedgerMismatch{
+				Account:       account,
+				Asset:         ledgerAsset,
+				Balance:       amount,
+				LedgerBalance: ledgerBalances[account],
+			})
+		}
+		delete(ledgerBalances, account)
+	}
+
+	// anything left has entries in the ledger but no balance at all
+	for account, amount := range ledgerBalances {
+		if amount != 0 {
+			mismatches = append(mismatches, &match.LedgerMismatch{
+				Account:       account,
+				Asset:         ledgerAsset,
+				LedgerBalance: amount,
+			})
+		}
+	}
+
+	return
+}
+
+// GetFeeBalance gets the total of the fees the exchange has collected, which is the balance of the
+// exchange's fee account in the ledger.
+func (ls *MemoryLedgerStore) GetFeeBalance() (fees uint64, err error) {
+	feeAccount := match.ReasonFee.CounterAccount()
+	var feeBalance int64
+	for _, entry := range ls.copyLedger() {
+		if entry.Account == feeAccount {
+			feeBalance += signedAmount(entry)
+		}
+	}
+
+	// fees are taken from users, so the exchange side of those entries is positive
+	if feeBalance > 0 {
+		fees = uint64(feeBalance)
+	}
+	return
+}
+
+// GetTransferNonces gets the nonce of the last transfer from each pubkey, from the ledger entries
+// for the senders of transfers
+func (ls *MemoryLedgerStore) GetTransferNonces() (nonces map[[33]byte]uint64, err error) {
+	nonces = make(map[[33]byte]uint64)
+	for _, entry := range ls.copyLedger() {
+		// the sender's side of a transfer is the credit to a user's account
+		if entry.Reason != match.ReasonTransfer || entry.Type != match.Credit {
+			continue
+		}
+		nonce, ok := match.TransferNonceFromReference(entry.Reference)
+		if !ok {
+			continue
+		}
+		var account match.Account
+		if account, err = match.ParseAccount(entry.Account); err != nil {
+			nonces = nil
+			err = fmt.Errorf("Error parsing transfer sender for GetTransferNonces: %s", err)
+			return
+		}
+		if nonce > nonces[account.Pubkey] {
+			nonces[account.Pubkey] = nonce
+		}
+	}
+	return
+}
+
+// GetLedger gets every entry in the ledger, in the order they were written
+func (ls *MemoryLedgerStore) GetLedger() (entries []*match.LedgerEntry, err error) {
+	entries = ls.copyLedger()
+	return
+}
+
+// ReplaceLedger replaces every entry in the ledger with the entries given, keeping their IDs. The
+// next entry written gets the ID after the last one given.
+func (ls *MemoryLedgerStore) ReplaceLedger(entries []*match.LedgerEntry) (err error) {
+	var lastID uint64
+	var ledger []*match.LedgerEntry
+	for _, entry := range entries {
+		if entry.ID <= lastID {
+			err = fmt.Errorf("Ledger entry %d is not after entry %d for ReplaceLedger", entry.ID, lastID)
+			return
+		}
+		lastID = entry.ID
+		entryCopy := *entry
+		ledger = append(ledger, &entryCopy)
+	}
+
+	ls.engine.balancesMtx.Lock()
+	ls.engine.ledger = ledger
+	ls.engine.lastLedgerID = lastID
+	ls.engine.balancesMtx.Unlock()
+	return
+}
+
+// copyLedger copies every entry in the ledger, so they can be read without holding the lock or
+// changed without changing the ledger
+func (ls *MemoryLedgerStore) copyLedger() (entries []*match.LedgerEntry) {
+	ls.engine.balancesMtx.Lock()
+	for _, entry := range ls.engine.ledger {
+		entryCopy := *entry
+		entries = append(entries, &entryCopy)
+	}
+	ls.engine.balancesMtx.Unlock()
+	return
+}
+
+// signedAmount is the amount of the entry, negative if it is a credit
+func signedAmount(entry *match.LedgerEntry) (amount int64) {
+	amount = int64(entry.Amount)
+	if entry.Type == match.Credit {
+		amount = -amount
+	}
+	return
+}
+
+// CreateLedgerStoreMap creates a map of coin to ledger store for a map of memory settlement engines,
+// like the one CreateSettlementEngineMap makes.
+func CreateLedgerStoreMap(setEngines map[*coinparam.Params]match.SettlementEngine) (ledgerMap map[*coinparam.Params]cxdb.LedgerStore, err error) {
+
+	ledgerMap = make(map[*coinparam.Params]cxdb.LedgerStore)
+	var curLedgerStore cxdb.LedgerStore
+	for coin, setEngine := range setEngines {
+		if curLedgerStore, err = CreateLedgerStore(coin, setEngine); err != nil {
+			err = fmt.Errorf("Error creating single ledger store while creating ledger store map: %s", err)
+			return
+		}
+		ledgerMap[coin] = curLedgerStore
+	}
+
+	return
+}
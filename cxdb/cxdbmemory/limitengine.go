@@ -0,0 +1,245 @@
+package cxdbmemory
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencx/match"
+	"golang.org/x/crypto/sha3"
+)
+
+// MemoryLimitEngine is a limit matching engine that keeps its orders in memory
+type MemoryLimitEngine struct {
+	orders    map[match.OrderID]*match.LimitOrderIDPair
+	ordersMtx *sync.Mutex
+
+	// how many orders have been placed, so the same order placed twice still gets a different ID
+	placed uint64
+
+	// this pair
+	pair *match.Pair
+}
+
+// CreateLimitEngine creates a limit matching engine for a pair
+func CreateLimitEngine(pair *match.Pair) (engine match.LimitEngine, err error) {
+	engine = &MemoryLimitEngine{
+		orders:    make(map[match.OrderID]*match.LimitOrderIDPair),
+		ordersMtx: new(sync.Mutex),
+		pair:      pair,
+	}
+	return
+}
+
+// PlaceLimitOrder places an order in the limit matching engine.
+// This assumes that the order is valid and is for the same pair as the matching engine
+func (me *MemoryLimitEngine) PlaceLimitOrder(order *match.LimitOrder) (idRes *match.LimitOrderIDPair, err error) {
+	if order == nil {
+		err = fmt.Errorf("Cannot place nil order, please enter valid input")
+		return
+	}
+
+	var price float64
+	if price, err = order.Price(); err != nil {
+		err = fmt.Errorf("Error getting price from order while placing order: %s", err)
+		return
+	}
+
+	if price == float64(0) {
+		err = fmt.Errorf("Placing 0-valued order is not allowed")
+		return
+	}
+
+	loid := &match.LimitOrderIDPair{
+		OrderID:   new(match.OrderID),
+		Order:     order,
+		Price:     price,
+		Timestamp: time.Now(),
+	}
+
+	me.ordersMtx.Lock()
+	defer me.ordersMtx.Unlock()
+
+	// The ID is the hash of the order, the placement time, and how many orders came before it.
+	hasher := sha3.New256()
+	hasher.Write(order.Pubkey[:])
+	binary.Write(hasher, binary.BigEndian, []uint64{uint64(order.SubAccount), order.AmountHave, order.AmountWant, uint64(loid.Timestamp.UnixNano()), me.placed})
+	binary.Write(hasher, binary.BigEndian, []bool{bool(order.Side), order.Swap})
+	me.placed++
+	if err = loid.OrderID.UnmarshalBinary(hasher.Sum(nil)); err != nil {
+		err = fmt.Errorf("Could not unmarshal order ID for PlaceLimitOrder: %s", err)
+		return
+	}
+
+	me.orders[*loid.OrderID] = copyLimitOrder(loid)
+	idRes = loid
+	return
+}
+
+// CancelLimitOrder cancels a limit order, this assumes that the limit order actually exists
+func (me *MemoryLimitEngine) CancelLimitOrder(orderID *match.OrderID) (cancelled *match.CancelledOrder, cancelSettlement *match.SettlementExecution, err error) {
+	me.ordersMtx.Lock()
+	cancelledOrder, ok := me.orders[*orderID]
+	if !ok {
+		me.ordersMtx.Unlock()
+		err = fmt.Errorf("Order %x does not exist, cannot cancel", orderID[:])
+		return
+	}
+	delete(me.orders, *orderID)
+	me.ordersMtx.Unlock()
+
+	cancelled = &match.CancelledOrder{
+		OrderID: orderID,
+	}
+
+	// swap orders don't hold anything on the exchange, so there's nothing to give back
+	if cancelledOrder.Order.Swap {
+		return
+	}
+
+	var debitAsset match.Asset
+	if cancelledOrder.Order.Side == match.Buy {
+		debitAsset = me.pair.AssetHave
+	} else {
+		debitAsset = me.pair.AssetWant
+	}
+	cancelSettlement = &match.SettlementExecution{
+		Pubkey:     cancelledOrder.Order.Pubkey,
+		SubAccount: cancelledOrder.Order.SubAccount,
+		Amount:     cancelledOrder.Order.AmountHave,
+		Type:       match.Debit,
+		Asset:      debitAsset,
+		Reason:     match.ReasonCancelRefund,
+		Reference:  hex.EncodeToString(orderID[:]),
+	}
+	return
+}
+
+// RestoreLimitOrder puts an order back into the engine with the ID and timestamp it was placed with
+func (me *MemoryLimitEngine) RestoreLimitOrder(loid *match.LimitOrderIDPair) (err error) {
+	me.ordersMtx.Lock()
+	defer me.ordersMtx.Unlock()
+	if _, ok := me.orders[*loid.OrderID]; ok {
+		err = fmt.Errorf("Order %x is already in the engine, cannot restore", loid.OrderID[:])
+		return
+	}
+	me.orders[*loid.OrderID] = copyLimitOrder(loid)
+	return
+}
+
+// MatchLimitOrders matches limit orders based on price/time priority
+func (me *MemoryLimitEngine) MatchLimitOrders() (orderExecs []*match.OrderExecution, settlementExecs []*match.SettlementExecution, swaps []*match.SwapInstruction, err error) {
+	me.ordersMtx.Lock()
+	defer me.ordersMtx.Unlock()
+
+	// Find the max sell price and the min buy price, if either side is empty there's nothing to match
+	var sellOrders []*match.LimitOrderIDPair
+	var buyOrders []*match.LimitOrderIDPair
+	var maxSell float64
+	var minBuy float64
+	for _, lp := range me.orders {
+		if lp.Order.Side == match.Sell {
+			if len(sellOrders) == 0 || lp.Price > maxSell {
+				maxSell = lp.Price
+			}
+			sellOrders = append(sellOrders, copyLimitOrder(lp))
+		} else {
+			if len(buyOrders) == 0 || lp.Price < minBuy {
+				minBuy = lp.Price
+			}
+			buyOrders = append(buyOrders, copyLimitOrder(lp))
+		}
+	}
+	if len(sellOrders) == 0 || len(buyOrders) == 0 || minBuy > maxSell {
+		return
+	}
+
+	// the sell orders that can match are sorted by price descending and time ascending, and the buy
+	// orders by price ascending and time ascending, so the best prices match first and within the
+	// best price the earliest orders match first.
+	sellOrders = filterLimitOrders(sellOrders, func(lp *match.LimitOrderIDPair) bool { return lp.Price >= minBuy })
+	sort.SliceStable(sellOrders, func(i, j int) bool {
+		if sellOrders[i].Price != sellOrders[j].Price {
+			return sellOrders[i].Price > sellOrders[j].Price
+		}
+		return sellOrders[i].Timestamp.Before(sellOrders[j].Timestamp)
+	})
+	buyOrders = filterLimitOrders(buyOrders, func(lp *match.LimitOrderIDPair) bool { return lp.Price <= maxSell })
+	sort.SliceStable(buyOrders, func(i, j int) bool {
+		if buyOrders[i].Price != buyOrders[j].Price {
+			return buyOrders[i].Price < buyOrders[j].Price
+		}
+		return buyOrders[i].Timestamp.Before(buyOrders[j].Timestamp)
+	})
+
+	if orderExecs, settlementExecs, swaps, err = match.MatchPrioritizedOrders(buyOrders, sellOrders); err != nil {
+		orderExecs = nil
+		settlementExecs = nil
+		swaps = nil
+		err = fmt.Errorf("Error matching prioritized orders for MatchLimitOrders: %s", err)
+		return
+	}
+
+	// Update the matching engine with the new state
+	for _, orderExec := range orderExecs {
+		updateLimitOrder(me.orders, orderExec)
+	}
+	return
+}
+
+// filterLimitOrders returns the orders that keep returns true for
+func filterLimitOrders(orders []*match.LimitOrderIDPair, keep func(*match.LimitOrderIDPair) bool) (filtered []*match.LimitOrderIDPair) {
+	for _, lp := range orders {
+		if keep(lp) {
+			filtered = append(filtered, lp)
+		}
+	}
+	return
+}
+
+// updateLimitOrder deletes the order in the execution if it was filled, and updates its amounts
+// if it was not.
+func updateLimitOrder(orders map[match.OrderID]*match.LimitOrderIDPair, orderExec *match.OrderExecution) {
+	if orderExec.Filled {
+		delete(orders, orderExec.OrderID)
+		return
+	}
+	if lp, ok := orders[orderExec.OrderID]; ok {
+		lp.Order.AmountHave = orderExec.NewAmountHave
+		lp.Order.AmountWant = orderExec.NewAmountWant
+	}
+	return
+}
+
+// copyLimitOrder copies an order and its ID, so the engine and the orderbook never share an order
+// with each other or with whoever placed it.
+func copyLimitOrder(lp *match.LimitOrderIDPair) (lpCopy *match.LimitOrderIDPair) {
+	lpCopy = &match.LimitOrderIDPair{
+		Timestamp: lp.Timestamp,
+		Price:     lp.Price,
+		OrderID:   new(match.OrderID),
+		Order:     new(match.LimitOrder),
+	}
+	*lpCopy.OrderID = *lp.OrderID
+	*lpCopy.Order = *lp.Order
+	return
+}
+
+// CreateLimitEngineMap creates a map of pair to limit engine, given a list of pairs.
+func CreateLimitEngineMap(pairList []*match.Pair) (limMap map[match.Pair]match.LimitEngine, err error) {
+
+	limMap = make(map[match.Pair]match.LimitEngine)
+	var curLimEng match.LimitEngine
+	for _, pair := range pairList {
+		if curLimEng, err = CreateLimitEngine(pair); err != nil {
+			err = fmt.Errorf("Error creating single limit engine while creating limit engine map: %s", err)
+			return
+		}
+		limMap[*pair] = curLimEng
+	}
+
+	return
+}
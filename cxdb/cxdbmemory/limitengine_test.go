@@ -0,0 +1,112 @@
+package cxdbmemory
+
+import (
+	"testing"
+
+	"github.com/mit-dci/opencx/match"
+)
+
+var testPair = match.Pair{AssetWant: match.BTCReg, AssetHave: match.LTCReg}
+
+func TestMemoryLimitEngineMatchAndCancel(t *testing.T) {
+	var err error
+
+	var engine match.LimitEngine
+	if engine, err = CreateLimitEngine(&testPair); err != nil {
+		t.Errorf("Error creating limit engine: %s", err)
+		return
+	}
+	var book match.LimitOrderbook
+	if book, err = CreateLimitOrderbook(&testPair); err != nil {
+		t.Errorf("Error creating limit orderbook: %s", err)
+		return
+	}
+
+	// Two identical orders should still get different IDs
+	order := &match.LimitOrder{
+		Side:        match.Buy,
+		TradingPair: testPair,
+		AmountHave:  1000,
+		AmountWant:  1000,
+	}
+	order.Pubkey[0] = 0x02
+	var firstID *match.LimitOrderIDPair
+	if firstID, err = engine.PlaceLimitOrder(order); err != nil {
+		t.Errorf("Error placing first order: %s", err)
+		return
+	}
+	var secondID *match.LimitOrderIDPair
+	if secondID, err = engine.PlaceLimitOrder(order); err != nil {
+		t.Errorf("Error placing second order: %s", err)
+		return
+	}
+	if *firstID.OrderID == *secondID.OrderID {
+		t.Errorf("Identical orders should not have the same ID %x", firstID.OrderID[:])
+		return
+	}
+	for _, placed := range []*match.LimitOrderIDPair{firstID, secondID} {
+		if err = book.UpdateBookPlace(placed); err != nil {
+			t.Errorf("Error placing order in book: %s", err)
+			return
+		}
+	}
+
+	sellOrder := &match.LimitOrder{
+		Side:        match.Sell,
+		TradingPair: testPair,
+		AmountHave:  1000,
+		AmountWant:  1000,
+	}
+	sellOrder.Pubkey[0] = 0x03
+	if _, err = engine.PlaceLimitOrder(sellOrder); err != nil {
+		t.Errorf("Error placing sell order: %s", err)
+		return
+	}
+
+	var orderExecs []*match.OrderExecution
+	if orderExecs, _, _, err = engine.MatchLimitOrders(); err != nil {
+		t.Errorf("Error matching orders: %s", err)
+		return
+	}
+	if len(orderExecs) != 2 {
+		t.Errorf("Expected the sell and one buy to execute, got %d order executions", len(orderExecs))
+		return
+	}
+	for _, orderExec := range orderExecs {
+		if err = book.UpdateBookExec(orderExec); err != nil {
+			t.Errorf("Error updating book with execution: %s", err)
+			return
+		}
+	}
+
+	// The buy that was placed first should have matched, so only the second one is left in the book
+	if _, err = book.GetOrder(firstID.OrderID); err == nil {
+		t.Errorf("The filled first order should not be in the book")
+		return
+	}
+	var bookOrder *match.LimitOrderIDPair
+	if bookOrder, err = book.GetOrder(secondID.OrderID); err != nil {
+		t.Errorf("Error getting second order from book: %s", err)
+		return
+	}
+	if bookOrder.Order.AmountHave != order.AmountHave {
+		t.Errorf("Second order should be untouched, has %d instead of %d", bookOrder.Order.AmountHave, order.AmountHave)
+		return
+	}
+
+	var cancelSettlement *match.SettlementExecution
+	if _, cancelSettlement, err = engine.CancelLimitOrder(secondID.OrderID); err != nil {
+		t.Errorf("Error cancelling the second buy order: %s", err)
+		return
+	}
+	if cancelSettlement.Amount != order.AmountHave || cancelSettlement.Asset != testPair.AssetHave || cancelSettlement.Type != match.Debit {
+		t.Errorf("Cancelling should give back %d %s, got %s", order.AmountHave, testPair.AssetHave, cancelSettlement)
+		return
+	}
+	if _, _, err = engine.CancelLimitOrder(firstID.OrderID); err == nil {
+		t.Errorf("Cancelling the filled first order should fail")
+		return
+	}
+
+	return
+}
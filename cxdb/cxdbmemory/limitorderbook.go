@@ -0,0 +1,274 @@
+package cxdbmemory
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/match"
+)
+
+// MemoryLimitOrderbook is the read-only copy of a limit orderbook, kept in memory
+type MemoryLimitOrderbook struct {
+	orders    map[match.OrderID]*match.LimitOrderIDPair
+	fills     map[match.OrderID][]*match.OrderFill
+	archive   map[match.OrderID]*match.ArchivedLimitOrder
+	ordersMtx *sync.Mutex
+
+	// this pair
+	pair *match.Pair
+}
+
+// CreateLimitOrderbook creates a limit orderbook for a pair
+func CreateLimitOrderbook(pair *match.Pair) (book match.LimitOrderbook, err error) {
+	book = &MemoryLimitOrderbook{
+		orders:    make(map[match.OrderID]*match.LimitOrderIDPair),
+		fills:     make(map[match.OrderID][]*match.OrderFill),
+		archive:   make(map[match.OrderID]*match.ArchivedLimitOrder),
+		ordersMtx: new(sync.Mutex),
+		pair:      pair,
+	}
+	return
+}
+
+// UpdateBookExec takes in an order execution and updates the orderbook.
+func (mo *MemoryLimitOrderbook) UpdateBookExec(orderExec *match.OrderExecution) (err error) {
+	mo.ordersMtx.Lock()
+	defer mo.ordersMtx.Unlock()
+	lp, ok := mo.orders[orderExec.OrderID]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	fill := match.NewOrderFill(lp.Order.AmountWant, lp.Order.AmountHave, orderExec, now)
+	mo.fills[orderExec.OrderID] = append(mo.fills[orderExec.OrderID], fill)
+	if orderExec.Filled {
+		// the last fill took everything that was left
+		filled := copyLimitOrder(lp)
+		filled.Order.AmountWant = 0
+		filled.Order.AmountHave = 0
+		mo.archiveOrder(filled, match.OrderFilled, now)
+	}
+	updateLimitOrder(mo.orders, orderExec)
+	return
+}
+
+// UpdateBookCancel takes in an order cancellation and updates the orderbook.
+func (mo *MemoryLimitOrderbook) UpdateBookCancel(cancel *match.CancelledOrder) (err error) {
+	mo.ordersMtx.Lock()
+	defer mo.ordersMtx.Unlock()
+	lp, ok := mo.orders[*cancel.OrderID]
+	if !ok {
+		err = fmt.Errorf("Order %x is not in the orderbook", cancel.OrderID[:])
+		return
+	}
+	mo.archiveOrder(lp, match.CancelStatus(mo.fills[*cancel.OrderID]), time.Now())
+	delete(mo.orders, *cancel.OrderID)
+	return
+}
+
+// archiveOrder moves the fills for an order to the archive, along with the order as it was
+// placed. This does not take it out of the orderbook.
+func (mo *MemoryLimitOrderbook) archiveOrder(lp *match.LimitOrderIDPair, status match.OrderStatus, closedAt time.Time) {
+	fills := mo.fills[*lp.OrderID]
+	delete(mo.fills, *lp.OrderID)
+
+	original := copyLimitOrder(lp)
+	filledWant, filledHave := match.FilledAmounts(fills)
+	original.Order.AmountWant += filledWant
+	original.Order.AmountHave += filledHave
+	mo.archive[*lp.OrderID] = &match.ArchivedLimitOrder{
+		Order:    original,
+		Status:   status,
+		Fills:    fills,
+		ClosedAt: closedAt,
+	}
+	return
+}
+
+// UpdateBookPlace takes in an order, ID, timestamp, and adds the order to the orderbook.
+func (mo *MemoryLimitOrderbook) UpdateBookPlace(limitIDPair *match.LimitOrderIDPair) (err error) {
+	mo.ordersMtx.Lock()
+	mo.orders[*limitIDPair.OrderID] = copyLimitOrder(limitIDPair)
+	mo.ordersMtx.Unlock()
+	return
+}
+
+// GetOrder gets an order from an OrderID
+func (mo *MemoryLimitOrderbook) GetOrder(orderID *match.OrderID) (limOrder *match.LimitOrderIDPair, err error) {
+	mo.ordersMtx.Lock()
+	defer mo.ordersMtx.Unlock()
+	lp, ok := mo.orders[*orderID]
+	if !ok {
+		err = fmt.Errorf("Order %x does not exist", orderID[:])
+		return
+	}
+	limOrder = copyLimitOrder(lp)
+	return
+}
+
+// CalculatePrice returns the calculated price based on the orderbook. This is based on the midpoint of the spread.
+func (mo *MemoryLimitOrderbook) CalculatePrice() (price float64, err error) {
+	mo.ordersMtx.Lock()
+	defer mo.ordersMtx.Unlock()
+
+	var maxSell float64
+	var minBuy float64
+	var seenBuy bool
+	for _, lp := range mo.orders {
+		if lp.Order.Side == match.Sell {
+			if lp.Price > maxSell {
+				maxSell = lp.Price
+			}
+		} else if !seenBuy || lp.Price < minBuy {
+			minBuy = lp.Price
+			seenBuy = true
+		}
+	}
+
+	price = (minBuy + maxSell) / 2
+	return
+}
+
+// GetOrdersForPubkey gets orders for a specific pubkey. If the sub-account is not nil, only orders
+// from that sub-account are returned.
+func (mo *MemoryLimitOrderbook) GetOrdersForPubkey(pubkey *koblitz.PublicKey, subAccount *uint32) (orders map[float64][]*match.LimitOrderIDPair, err error) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	orders = make(map[float64][]*match.LimitOrderIDPair)
+	mo.ordersMtx.Lock()
+	for _, lp := range mo.orders {
+		if lp.Order.Pubkey != pubkeyBytes {
+			continue
+		}
+		if subAccount != nil && lp.Order.SubAccount != *subAccount {
+			continue
+		}
+		orders[lp.Price] = append(orders[lp.Price], copyLimitOrder(lp))
+	}
+	mo.ordersMtx.Unlock()
+	return
+}
+
+// ViewLimitOrderBook returns the whole orderbook as a map of price to orders
+func (mo *MemoryLimitOrderbook) ViewLimitOrderBook() (book map[float64][]*match.LimitOrderIDPair, err error) {
+	book = make(map[float64][]*match.LimitOrderIDPair)
+	mo.ordersMtx.Lock()
+	for _, lp := range mo.orders {
+		book[lp.Price] = append(book[lp.Price], copyLimitOrder(lp))
+	}
+	mo.ordersMtx.Unlock()
+	return
+}
+
+// GetArchivedOrder gets an order that is no longer in the orderbook
+func (mo *MemoryLimitOrderbook) GetArchivedOrder(orderID *match.OrderID) (archived *match.ArchivedLimitOrder, err error) {
+	mo.ordersMtx.Lock()
+	defer mo.ordersMtx.Unlock()
+	arc, ok := mo.archive[*orderID]
+	if !ok {
+		err = fmt.Errorf("Order %x is not in the archive", orderID[:])
+		return
+	}
+	archived = copyArchivedLimitOrder(arc)
+	return
+}
+
+// GetArchivedOrdersForPubkey gets the orders for a pubkey that are no longer in the orderbook, in
+// the order they were closed. If the sub-account is not nil, only orders from that sub-account are
+// returned.
+func (mo *MemoryLimitOrderbook) GetArchivedOrdersForPubkey(pubkey *koblitz.PublicKey, subAccount *uint32) (archived []*match.ArchivedLimitOrder, err error) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	mo.ordersMtx.Lock()
+	for _, arc := range mo.archive {
+		if arc.Order.Order.Pubkey != pubkeyBytes {
+			continue
+		}
+		if subAccount != nil && arc.Order.Order.SubAccount != *subAccount {
+			continue
+		}
+		archived = append(archived, copyArchivedLimitOrder(arc))
+	}
+	mo.ordersMtx.Unlock()
+
+	sort.SliceStable(archived, func(i, j int) bool {
+		return archived[i].ClosedAt.Before(archived[j].ClosedAt)
+	})
+	return
+}
+
+// ViewArchive gets every order that is no longer in the orderbook, in the order they were closed
+func (mo *MemoryLimitOrderbook) ViewArchive() (archived []*match.ArchivedLimitOrder, err error) {
+	mo.ordersMtx.Lock()
+	for _, arc := range mo.archive {
+		archived = append(archived, copyArchivedLimitOrder(arc))
+	}
+	mo.ordersMtx.Unlock()
+
+	sort.SliceStable(archived, func(i, j int) bool {
+		return archived[i].ClosedAt.Before(archived[j].ClosedAt)
+	})
+	return
+}
+
+// RestoreArchivedOrder puts an order into the archive as it was archived
+func (mo *MemoryLimitOrderbook) RestoreArchivedOrder(archived *match.ArchivedLimitOrder) (err error) {
+	mo.ordersMtx.Lock()
+	mo.archive[*archived.Order.OrderID] = copyArchivedLimitOrder(archived)
+	mo.ordersMtx.Unlock()
+	return
+}
+
+// PruneArchive deletes the archived orders that were closed before the cutoff
+func (mo *MemoryLimitOrderbook) PruneArchive(before time.Time) (pruned uint64, err error) {
+	mo.ordersMtx.Lock()
+	for orderID, arc := range mo.archive {
+		if arc.ClosedAt.Before(before) {
+			delete(mo.archive, orderID)
+			pruned++
+		}
+	}
+	mo.ordersMtx.Unlock()
+	return
+}
+
+// copyArchivedLimitOrder copies an archived order and its fills
+func copyArchivedLimitOrder(arc *match.ArchivedLimitOrder) (arcCopy *match.ArchivedLimitOrder) {
+	arcCopy = &match.ArchivedLimitOrder{
+		Order:    copyLimitOrder(arc.Order),
+		Status:   arc.Status,
+		ClosedAt: arc.ClosedAt,
+		Fills:    copyOrderFills(arc.Fills),
+	}
+	return
+}
+
+// copyOrderFills copies a list of fills
+func copyOrderFills(fills []*match.OrderFill) (fillsCopy []*match.OrderFill) {
+	for _, fill := range fills {
+		fillCopy := *fill
+		fillsCopy = append(fillsCopy, &fillCopy)
+	}
+	return
+}
+
+// CreateLimitOrderbookMap creates a map of pair to limit orderbook, given a list of pairs.
+func CreateLimitOrderbookMap(pairList []*match.Pair) (orderbookMap map[match.Pair]match.LimitOrderbook, err error) {
+
+	orderbookMap = make(map[match.Pair]match.LimitOrderbook)
+	var curLimBook match.LimitOrderbook
+	for _, pair := range pairList {
+		if curLimBook, err = CreateLimitOrderbook(pair); err != nil {
+			err = fmt.Errorf("Error creating single limit orderbook while creating limit orderbook map: %s", err)
+			return
+		}
+		orderbookMap[*pair] = curLimBook
+	}
+
+	return
+}
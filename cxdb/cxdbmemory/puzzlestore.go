@@ -37,9 +37,7 @@ func CreatePuzzleStore(pair *match.Pair) (store cxdb.PuzzleStore, err error) {
 // what was submitted.
 func (mp *MemoryPuzzleStore) ViewAuctionPuzzleBook(auctionID *match.AuctionID) (puzzles []*match.EncryptedAuctionOrder, err error) {
 	mp.puzzleMtx.Lock()
-	for _, pzList := range mp.puzzles {
-		puzzles = append(puzzles, pzList...)
-	}
+	puzzles = append(puzzles, mp.puzzles[*auctionID]...)
 	mp.puzzleMtx.Unlock()
 	return
 }
@@ -52,6 +50,18 @@ func (mp *MemoryPuzzleStore) PlaceAuctionPuzzle(puzzledOrder *match.EncryptedAuc
 	return
 }
 
+// ViewAuctionIDs returns the ID of every auction that has puzzles in the store
+func (mp *MemoryPuzzleStore) ViewAuctionIDs() (auctionIDs []*match.AuctionID, err error) {
+	mp.puzzleMtx.Lock()
+	for auctionID := range mp.puzzles {
+		currID := new(match.AuctionID)
+		*currID = auctionID
+		auctionIDs = append(auctionIDs, currID)
+	}
+	mp.puzzleMtx.Unlock()
+	return
+}
+
 // CreatePuzzleStoreMap creates a map of pair to pair list, given a list of pairs.
 func CreatePuzzleStoreMap(pairList []*match.Pair) (pzMap map[match.Pair]cxdb.PuzzleStore, err error) {
 
@@ -2,17 +2,24 @@ package cxdbmemory
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/opencx/match"
 )
 
 type MemorySettlementEngine struct {
-	// Balances
-	balances    map[[33]byte]uint64
+	// Balances for every sub-account of every pubkey
+	balances    map[match.Account]uint64
 	balancesMtx *sync.Mutex
 
+	// ledger is every applied settlement execution, written under the balances lock so it always
+	// matches the balances. lastLedgerID is the ID of the last entry written.
+	ledger       []*match.LedgerEntry
+	lastLedgerID uint64
+
 	// this coin
 	coin *coinparam.Params
 }
@@ -22,7 +29,7 @@ func CreateSettlementEngine(coin *coinparam.Params) (engine match.SettlementEngi
 
 	// Set values
 	me := &MemorySettlementEngine{
-		balances:    make(map[[33]byte]uint64),
+		balances:    make(map[match.Account]uint64),
 		balancesMtx: new(sync.Mutex),
 		coin:        coin,
 	}
@@ -39,7 +46,7 @@ func (me *MemorySettlementEngine) ApplySettlementExecution(setExec *match.Settle
 	me.balancesMtx.Lock()
 	var curBal uint64
 	var ok bool
-	if curBal, ok = me.balances[setExec.Pubkey]; !ok && setExec.Type == match.Credit {
+	if curBal, ok = me.balances[setExec.Account()]; !ok && setExec.Type == match.Credit {
 		err = fmt.Errorf("Trying to apply settlement execution credit to order with no balance")
 		me.balancesMtx.Unlock()
 		return
@@ -49,10 +56,16 @@ func (me *MemorySettlementEngine) ApplySettlementExecution(setExec *match.Settle
 	if setExec.Type == match.Debit {
 		newBal = curBal + setExec.Amount
 	} else if setExec.Type == match.Credit {
+		if setExec.Amount > curBal {
+			err = fmt.Errorf("Credit of %d is more than the balance of %d", setExec.Amount, curBal)
+			me.balancesMtx.Unlock()
+			return
+		}
 		newBal = curBal - setExec.Amount
 	}
 
-	me.balances[setExec.Pubkey] = newBal
+	me.balances[setExec.Account()] = newBal
+	me.writeLedgerEntries(setExec)
 	me.balancesMtx.Unlock()
 	// Finally set return value
 	setRes = &match.SettlementResult{
@@ -63,6 +76,49 @@ func (me *MemorySettlementEngine) ApplySettlementExecution(setExec *match.Settle
 	return
 }
 
+// writeLedgerEntries writes the settlement execution to the ledger as two entries that sum to zero,
+// one for the user and one for the exchange account that the reason says is on the other side.
+// The balances lock should be held, so the entries are written with the balance update.
+func (me *MemorySettlementEngine) writeLedgerEntries(setExec *match.SettlementExecution) {
+	// there's nothing to record if nothing moved
+	if setExec.Amount == 0 {
+		return
+	}
+
+	exchangeType := match.Credit
+	if setExec.Type == match.Credit {
+		exchangeType = match.Debit
+	}
+
+	entryTime := time.Now()
+	entries := []*match.LedgerEntry{
+		&match.LedgerEntry{
+			Time:      entryTime,
+			Account:   setExec.Account().String(),
+			Asset:     setExec.Asset,
+			Amount:    setExec.Amount,
+			Type:      setExec.Type,
+			Reason:    setExec.Reason,
+			Reference: setExec.Reference,
+		},
+		&match.LedgerEntry{
+			Time:      entryTime,
+			Account:   setExec.Reason.CounterAccount(),
+			Asset:     setExec.Asset,
+			Amount:    setExec.Amount,
+			Type:      exchangeType,
+			Reason:    setExec.Reason,
+			Reference: setExec.Reference,
+		},
+	}
+	for _, entry := range entries {
+		me.lastLedgerID++
+		entry.ID = me.lastLedgerID
+		me.ledger = append(me.ledger, entry)
+	}
+	return
+}
+
 // CheckValid returns true if the settlement execution would be valid
 func (me *MemorySettlementEngine) CheckValid(setExec *match.SettlementExecution) (valid bool, err error) {
 	if setExec.Type == match.Debit {
@@ -71,9 +127,9 @@ func (me *MemorySettlementEngine) CheckValid(setExec *match.SettlementExecution)
 		return
 	}
 	me.balancesMtx.Lock()
-	curBal := me.balances[setExec.Pubkey]
+	curBal := me.balances[setExec.Account()]
 	me.balancesMtx.Unlock()
-	valid = setExec.Amount > curBal
+	valid = setExec.Amount <= curBal
 	return
 }
 
@@ -92,3 +148,105 @@ func CreateSettlementEngineMap(coins []*coinparam.Params) (setMap map[*coinparam
 
 	return
 }
+
+// MemoryBatchSettlementEngine applies batches of settlement executions to memory settlement engines
+type MemoryBatchSettlementEngine struct {
+	engines map[match.Asset]*MemorySettlementEngine
+
+	// the engines are always locked in this order, so two batches can't deadlock
+	lockOrder []match.Asset
+}
+
+// CreateBatchSettlementEngine creates a batch settlement engine for a map of memory settlement
+// engines, like the one CreateSettlementEngineMap makes.
+func CreateBatchSettlementEngine(setEngines map[*coinparam.Params]match.SettlementEngine) (engine match.BatchSettlementEngine, err error) {
+
+	mb := &MemoryBatchSettlementEngine{
+		engines: make(map[match.Asset]*MemorySettlementEngine),
+	}
+	for coin, setEngine := range setEngines {
+		var asset match.Asset
+		if asset, err = match.AssetFromCoinParam(coin); err != nil {
+			err = fmt.Errorf("Error getting asset from coin param for CreateBatchSettlementEngine: %s", err)
+			return
+		}
+
+		var memEngine *MemorySettlementEngine
+		var ok bool
+		if memEngine, ok = setEngine.(*MemorySettlementEngine); !ok {
+			err = fmt.Errorf("Settlement engine for %s is not a memory settlement engine", coin.Name)
+			return
+		}
+
+		mb.engines[asset] = memEngine
+		mb.lockOrder = append(mb.lockOrder, asset)
+	}
+	sort.Slice(mb.lockOrder, func(i, j int) bool { return mb.lockOrder[i] < mb.lockOrder[j] })
+
+	engine = mb
+	return
+}
+
+// ApplySettlementBatch applies every settlement execution in order, or none of them if any credit is
+// more than the balance at that point in the batch.
+func (mb *MemoryBatchSettlementEngine) ApplySettlementBatch(setExecs []*match.SettlementExecution) (setRes []*match.SettlementResult, err error) {
+
+	for _, setExec := range setExecs {
+		if _, ok := mb.engines[setExec.Asset]; !ok {
+			err = fmt.Errorf("No settlement engine for %s in ApplySettlementBatch", setExec.Asset)
+			return
+		}
+	}
+
+	for _, asset := range mb.lockOrder {
+		mb.engines[asset].balancesMtx.Lock()
+	}
+	defer func() {
+		for _, asset := range mb.lockOrder {
+			mb.engines[asset].balancesMtx.Unlock()
+		}
+	}()
+
+	// work out every new balance before touching any of them
+	newBalances := make(map[match.Asset]map[match.Account]uint64)
+	for _, setExec := range setExecs {
+		if _, ok := newBalances[setExec.Asset]; !ok {
+			newBalances[setExec.Asset] = make(map[match.Account]uint64)
+		}
+
+		var curBal uint64
+		var ok bool
+		if curBal, ok = newBalances[setExec.Asset][setExec.Account()]; !ok {
+			curBal = mb.engines[setExec.Asset].balances[setExec.Account()]
+		}
+
+		var newBal uint64
+		if setExec.Type == match.Debit {
+			newBal = curBal + setExec.Amount
+		} else if setExec.Type == match.Credit {
+			if setExec.Amount > curBal {
+				err = fmt.Errorf("Credit of %d %s is more than the balance of %d, rejecting the whole batch", setExec.Amount, setExec.Asset, curBal)
+				setRes = nil
+				return
+			}
+			newBal = curBal - setExec.Amount
+		}
+
+		newBalances[setExec.Asset][setExec.Account()] = newBal
+		setRes = append(setRes, &match.SettlementResult{
+			NewBal:         newBal,
+			SuccessfulExec: setExec,
+		})
+	}
+
+	for asset, assetBalances := range newBalances {
+		for account, newBal := range assetBalances {
+			mb.engines[asset].balances[account] = newBal
+		}
+	}
+	for _, setExec := range setExecs {
+		mb.engines[setExec.Asset].writeLedgerEntries(setExec)
+	}
+
+	return
+}
@@ -0,0 +1,111 @@
+package cxdbmemory
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/match"
+)
+
+func TestBatchSettlementAllOrNothing(t *testing.T) {
+	var err error
+
+	coins := []*coinparam.Params{&coinparam.BitcoinParams, &coinparam.LiteCoinTestNet4Params}
+	var setEngines map[*coinparam.Params]match.SettlementEngine
+	if setEngines, err = CreateSettlementEngineMap(coins); err != nil {
+		t.Errorf("Error creating settlement engine map: %s", err)
+		return
+	}
+
+	var batchEngine match.BatchSettlementEngine
+	if batchEngine, err = CreateBatchSettlementEngine(setEngines); err != nil {
+		t.Errorf("Error creating batch settlement engine: %s", err)
+		return
+	}
+
+	var ltc match.Asset
+	if ltc, err = match.AssetFromCoinParam(&coinparam.LiteCoinTestNet4Params); err != nil {
+		t.Errorf("Error getting asset for litecoin: %s", err)
+		return
+	}
+
+	alice := [33]byte{0x02, 0x01}
+	bob := [33]byte{0x02, 0x02}
+
+	// Both users start with some of one asset
+	funding := []*match.SettlementExecution{
+		&match.SettlementExecution{Pubkey: alice, Amount: 1000, Asset: btc, Type: match.Debit},
+		&match.SettlementExecution{Pubkey: bob, Amount: 500, Asset: ltc, Type: match.Debit},
+	}
+	if _, err = batchEngine.ApplySettlementBatch(funding); err != nil {
+		t.Errorf("Error applying funding batch: %s", err)
+		return
+	}
+
+	// Bob's side of the trade is more than he has, so alice shouldn't be paid or charged either
+	badTrade := []*match.SettlementExecution{
+		&match.SettlementExecution{Pubkey: alice, Amount: 400, Asset: btc, Type: match.Credit},
+		&match.SettlementExecution{Pubkey: bob, Amount: 400, Asset: btc, Type: match.Debit},
+		&match.SettlementExecution{Pubkey: bob, Amount: 600, Asset: ltc, Type: match.Credit},
+		&match.SettlementExecution{Pubkey: alice, Amount: 600, Asset: ltc, Type: match.Debit},
+	}
+	if _, err = batchEngine.ApplySettlementBatch(badTrade); err == nil {
+		t.Errorf("Batch with a credit bigger than the balance should have been rejected")
+		return
+	}
+
+	expected := map[match.Asset]map[[33]byte]uint64{
+		btc: {alice: 1000, bob: 0},
+		ltc: {alice: 0, bob: 500},
+	}
+	if err = checkBalances(setEngines, expected); err != nil {
+		t.Errorf("Rejected batch changed balances: %s", err)
+		return
+	}
+
+	goodTrade := []*match.SettlementExecution{
+		&match.SettlementExecution{Pubkey: alice, Amount: 400, Asset: btc, Type: match.Credit},
+		&match.SettlementExecution{Pubkey: bob, Amount: 400, Asset: btc, Type: match.Debit},
+		&match.SettlementExecution{Pubkey: bob, Amount: 500, Asset: ltc, Type: match.Credit},
+		&match.SettlementExecution{Pubkey: alice, Amount: 500, Asset: ltc, Type: match.Debit},
+	}
+	var setRes []*match.SettlementResult
+	if setRes, err = batchEngine.ApplySettlementBatch(goodTrade); err != nil {
+		t.Errorf("Error applying valid batch: %s", err)
+		return
+	}
+	if len(setRes) != len(goodTrade) {
+		t.Errorf("Expected %d settlement results, got %d", len(goodTrade), len(setRes))
+		return
+	}
+
+	expected = map[match.Asset]map[[33]byte]uint64{
+		btc: {alice: 600, bob: 400},
+		ltc: {alice: 500, bob: 0},
+	}
+	if err = checkBalances(setEngines, expected); err != nil {
+		t.Errorf("Valid batch applied wrong balances: %s", err)
+		return
+	}
+
+	return
+}
+
+// checkBalances checks that the memory settlement engines have the expected balances
+func checkBalances(setEngines map[*coinparam.Params]match.SettlementEngine, expected map[match.Asset]map[[33]byte]uint64) (err error) {
+	for coin, setEngine := range setEngines {
+		var asset match.Asset
+		if asset, err = match.AssetFromCoinParam(coin); err != nil {
+			return
+		}
+		memEngine := setEngine.(*MemorySettlementEngine)
+		for pubkey, expectedBal := range expected[asset] {
+			if bal := memEngine.balances[match.Account{Pubkey: pubkey}]; bal != expectedBal {
+				err = fmt.Errorf("%x should have %d %s but has %d", pubkey, expectedBal, asset, bal)
+				return
+			}
+		}
+	}
+	return
+}
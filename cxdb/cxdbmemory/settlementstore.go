@@ -0,0 +1,146 @@
+package cxdbmemory
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// memBalance is the available and held balance of one sub-account
+type memBalance struct {
+	balance uint64
+	held    uint64
+}
+
+// MemorySettlementStore is the read-only copy of the balances for a coin, kept in memory
+type MemorySettlementStore struct {
+	// Balances for every sub-account of every pubkey
+	balances    map[match.Account]*memBalance
+	balancesMtx *sync.Mutex
+
+	// this coin
+	coin *coinparam.Params
+}
+
+// CreateSettlementStore creates a settlement store for a specific coin.
+func CreateSettlementStore(coin *coinparam.Params) (store cxdb.SettlementStore, err error) {
+	// Set values
+	ms := &MemorySettlementStore{
+		balances:    make(map[match.Account]*memBalance),
+		balancesMtx: new(sync.Mutex),
+		coin:        coin,
+	}
+	// Now we actually set the store
+	store = ms
+	return
+}
+
+// UpdateBalances updates the balances from the settlement executions
+func (ms *MemorySettlementStore) UpdateBalances(settlementResults []*match.SettlementResult) (err error) {
+	ms.balancesMtx.Lock()
+	for _, setResult := range settlementResults {
+		ms.balances[setResult.SuccessfulExec.Account()] = &memBalance{
+			balance: setResult.NewBal,
+			held:    setResult.NewHeld,
+		}
+	}
+	ms.balancesMtx.Unlock()
+	return
+}
+
+// GetBalance gets the available balance for a pubkey and an asset. If the sub-account is nil, this
+// is the balance of every sub-account added together.
+func (ms *MemorySettlementStore) GetBalance(pubkey *koblitz.PublicKey, subAccount *uint32) (balance uint64, err error) {
+	if balance, _, err = ms.getBalances(pubkey, subAccount); err != nil {
+		err = fmt.Errorf("Error getting balances for GetBalance: %s", err)
+		return
+	}
+	return
+}
+
+// GetHeldBalance gets the balance for a pubkey and an asset that is locked up in open orders. If the
+// sub-account is nil, this is the held balance of every sub-account added together.
+func (ms *MemorySettlementStore) GetHeldBalance(pubkey *koblitz.PublicKey, subAccount *uint32) (held uint64, err error) {
+	if _, held, err = ms.getBalances(pubkey, subAccount); err != nil {
+		err = fmt.Errorf("Error getting balances for GetHeldBalance: %s", err)
+		return
+	}
+	return
+}
+
+// getBalances adds up the balance and held balance for every sub-account of the pubkey, or just the
+// one sub-account if it is not nil.
+func (ms *MemorySettlementStore) getBalances(pubkey *koblitz.PublicKey, subAccount *uint32) (balance uint64, held uint64, err error) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	ms.balancesMtx.Lock()
+	for account, bal := range ms.balances {
+		if account.Pubkey != pubkeyBytes {
+			continue
+		}
+		if subAccount != nil && account.SubAccount != *subAccount {
+			continue
+		}
+		balance += bal.balance
+		held += bal.held
+	}
+	ms.balancesMtx.Unlock()
+	return
+}
+
+// GetTotalBalance gets the sum of every user's available and held balance, which is what the
+// exchange owes its users
+func (ms *MemorySettlementStore) GetTotalBalance() (total uint64, err error) {
+	ms.balancesMtx.Lock()
+	for _, bal := range ms.balances {
+		total += bal.balance + bal.held
+	}
+	ms.balancesMtx.Unlock()
+	return
+}
+
+// GetAllBalances gets every user's available and held balance added together, by pubkey
+func (ms *MemorySettlementStore) GetAllBalances() (balances map[[33]byte]uint64, err error) {
+	balances = make(map[[33]byte]uint64)
+	ms.balancesMtx.Lock()
+	for account, bal := range ms.balances {
+		balances[account.Pubkey] += bal.balance + bal.held
+	}
+	ms.balancesMtx.Unlock()
+	return
+}
+
+// GetAccountBalances gets the available and held balance of every sub-account of every pubkey
+func (ms *MemorySettlementStore) GetAccountBalances() (balances []*match.AccountBalance, err error) {
+	ms.balancesMtx.Lock()
+	for account, bal := range ms.balances {
+		balances = append(balances, &match.AccountBalance{
+			Account: account,
+			Balance: bal.balance,
+			Held:    bal.held,
+		})
+	}
+	ms.balancesMtx.Unlock()
+	return
+}
+
+// CreateSettlementStoreMap creates a map of coin to settlement store, given a list of coins.
+func CreateSettlementStoreMap(coins []*coinparam.Params) (setMap map[*coinparam.Params]cxdb.SettlementStore, err error) {
+
+	setMap = make(map[*coinparam.Params]cxdb.SettlementStore)
+	var curSetStore cxdb.SettlementStore
+	for _, coin := range coins {
+		if curSetStore, err = CreateSettlementStore(coin); err != nil {
+			err = fmt.Errorf("Error creating single settlement store while creating settlement store map: %s", err)
+			return
+		}
+		setMap[coin] = curSetStore
+	}
+
+	return
+}
@@ -0,0 +1,79 @@
+package cxdbmemory
+
+import (
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+func TestMemorySettlementStoreSubAccounts(t *testing.T) {
+	var err error
+
+	var store cxdb.SettlementStore
+	if store, err = CreateSettlementStore(&coinparam.BitcoinParams); err != nil {
+		t.Errorf("Error creating settlement store: %s", err)
+		return
+	}
+
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key: %s", err)
+		return
+	}
+	pubkey := privkey.PubKey()
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	results := []*match.SettlementResult{
+		&match.SettlementResult{
+			NewBal:         100,
+			NewHeld:        10,
+			SuccessfulExec: &match.SettlementExecution{Pubkey: pubkeyBytes, SubAccount: 0, Asset: btc},
+		},
+		&match.SettlementResult{
+			NewBal:         200,
+			NewHeld:        20,
+			SuccessfulExec: &match.SettlementExecution{Pubkey: pubkeyBytes, SubAccount: 1, Asset: btc},
+		},
+	}
+	if err = store.UpdateBalances(results); err != nil {
+		t.Errorf("Error updating balances: %s", err)
+		return
+	}
+
+	subAccount := uint32(1)
+	var balance uint64
+	if balance, err = store.GetBalance(pubkey, &subAccount); err != nil {
+		t.Errorf("Error getting sub-account balance: %s", err)
+		return
+	}
+	if balance != 200 {
+		t.Errorf("Expected sub-account balance of 200, got %d", balance)
+		return
+	}
+
+	var held uint64
+	if held, err = store.GetHeldBalance(pubkey, nil); err != nil {
+		t.Errorf("Error getting held balance: %s", err)
+		return
+	}
+	if held != 30 {
+		t.Errorf("Expected held balance of 30 across sub-accounts, got %d", held)
+		return
+	}
+
+	var total uint64
+	if total, err = store.GetTotalBalance(); err != nil {
+		t.Errorf("Error getting total balance: %s", err)
+		return
+	}
+	if total != 330 {
+		t.Errorf("Expected total balance of 330, got %d", total)
+		return
+	}
+
+	return
+}
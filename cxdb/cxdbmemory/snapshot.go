@@ -0,0 +1,52 @@
+package cxdbmemory
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+	"github.com/mit-dci/opencx/match"
+)
+
+// CreateSnapshotStores creates every store a snapshot is taken from or restored into, for a list of
+// pairs and coins.
+func CreateSnapshotStores(pairList []*match.Pair, coinList []*coinparam.Params) (stores *cxdbsnapshot.Stores, err error) {
+	stores = new(cxdbsnapshot.Stores)
+	if stores.LimitEngines, err = CreateLimitEngineMap(pairList); err != nil {
+		err = fmt.Errorf("Error creating limit engines for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.LimitOrderbooks, err = CreateLimitOrderbookMap(pairList); err != nil {
+		err = fmt.Errorf("Error creating limit orderbooks for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.AuctionEngines, err = CreateAuctionEngineMap(pairList); err != nil {
+		err = fmt.Errorf("Error creating auction engines for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.AuctionOrderbooks, err = CreateAuctionOrderbookMap(pairList); err != nil {
+		err = fmt.Errorf("Error creating auction orderbooks for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.PuzzleStores, err = CreatePuzzleStoreMap(pairList); err != nil {
+		err = fmt.Errorf("Error creating puzzle stores for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.SettlementEngines, err = CreateSettlementEngineMap(coinList); err != nil {
+		err = fmt.Errorf("Error creating settlement engines for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.LedgerStores, err = CreateLedgerStoreMap(stores.SettlementEngines); err != nil {
+		err = fmt.Errorf("Error creating ledger stores for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.SettlementStores, err = CreateSettlementStoreMap(coinList); err != nil {
+		err = fmt.Errorf("Error creating settlement stores for CreateSnapshotStores: %s", err)
+		return
+	}
+	if stores.DepositStores, err = CreateDepositStoreMap(coinList); err != nil {
+		err = fmt.Errorf("Error creating deposit stores for CreateSnapshotStores: %s", err)
+		return
+	}
+	return
+}
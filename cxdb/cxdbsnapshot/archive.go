@@ -0,0 +1,79 @@
+package cxdbsnapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// archive is how a snapshot is written out. The snapshot is gob encoded on its own first, so the
+// checksum can be checked before anything is decoded from it.
+type archive struct {
+	Version  uint32
+	Checksum [sha256.Size]byte
+	Snapshot []byte
+}
+
+// WriteArchive writes a snapshot to w as a versioned, checksummed, compressed archive
+func WriteArchive(w io.Writer, snap *Snapshot) (err error) {
+	var snapBuf bytes.Buffer
+	if err = gob.NewEncoder(&snapBuf).Encode(snap); err != nil {
+		err = fmt.Errorf("Error encoding snapshot for WriteArchive: %s", err)
+		return
+	}
+
+	arc := &archive{
+		Version:  snap.Version,
+		Checksum: sha256.Sum256(snapBuf.Bytes()),
+		Snapshot: snapBuf.Bytes(),
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	if err = gob.NewEncoder(gzipWriter).Encode(arc); err != nil {
+		err = fmt.Errorf("Error encoding archive for WriteArchive: %s", err)
+		return
+	}
+	if err = gzipWriter.Close(); err != nil {
+		err = fmt.Errorf("Error compressing archive for WriteArchive: %s", err)
+		return
+	}
+	return
+}
+
+// ReadArchive reads a snapshot from an archive written by WriteArchive. The archive has to be the
+// version this package takes, and match its checksum.
+func ReadArchive(r io.Reader) (snap *Snapshot, err error) {
+	var gzipReader *gzip.Reader
+	if gzipReader, err = gzip.NewReader(r); err != nil {
+		err = fmt.Errorf("Error decompressing archive for ReadArchive: %s", err)
+		return
+	}
+	defer gzipReader.Close()
+
+	arc := new(archive)
+	if err = gob.NewDecoder(gzipReader).Decode(arc); err != nil {
+		err = fmt.Errorf("Error decoding archive for ReadArchive: %s", err)
+		return
+	}
+
+	if arc.Version != SnapshotVersion {
+		err = fmt.Errorf("Archive is version %d, only version %d can be read", arc.Version, SnapshotVersion)
+		return
+	}
+
+	if sha256.Sum256(arc.Snapshot) != arc.Checksum {
+		err = fmt.Errorf("Archive checksum does not match, the archive is corrupted")
+		return
+	}
+
+	snap = new(Snapshot)
+	if err = gob.NewDecoder(bytes.NewReader(arc.Snapshot)).Decode(snap); err != nil {
+		snap = nil
+		err = fmt.Errorf("Error decoding snapshot for ReadArchive: %s", err)
+		return
+	}
+	return
+}
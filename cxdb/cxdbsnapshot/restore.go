@@ -0,0 +1,431 @@
+package cxdbsnapshot
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/match"
+)
+
+// restoreReference is the reference on the settlement executions that put balances back, so they
+// can be told apart in the ledger
+const restoreReference = "snapshot"
+
+// Restore restores a snapshot into the stores. Every store that is restored into has to be empty,
+// so a snapshot is never restored on top of another one. A part of the snapshot without stores to
+// restore it into is an error, rather than being left out, so a snapshot with a ledger can't be
+// restored into stores without ledger stores.
+func Restore(stores *Stores, snap *Snapshot) (err error) {
+	if snap.Version != SnapshotVersion {
+		err = fmt.Errorf("Snapshot is version %d, only version %d can be restored", snap.Version, SnapshotVersion)
+		return
+	}
+
+	if err = stores.checkEmpty(); err != nil {
+		err = fmt.Errorf("Error, can only restore into empty stores for Restore: %s", err)
+		return
+	}
+
+	// this is checked before anything is restored, so nothing is restored without the ledger
+	for _, asset := range snap.Assets {
+		if len(asset.Ledger) == 0 {
+			continue
+		}
+		var coin *coinparam.Params
+		if coin, err = stores.coinFromName(asset.Coin); err != nil {
+			err = fmt.Errorf("Error restoring %s for Restore: %s", asset.Coin, err)
+			return
+		}
+		if stores.ledgerStore(coin) == nil {
+			err = fmt.Errorf("Error, no ledger store to restore %d %s ledger entries into for Restore", len(asset.Ledger), asset.Coin)
+			return
+		}
+	}
+
+	for _, market := range snap.Markets {
+		if err = stores.restoreMarket(market); err != nil {
+			err = fmt.Errorf("Error restoring %s for Restore: %s", market.Pair.String(), err)
+			return
+		}
+	}
+
+	for _, asset := range snap.Assets {
+		var coin *coinparam.Params
+		if coin, err = stores.coinFromName(asset.Coin); err != nil {
+			err = fmt.Errorf("Error restoring %s for Restore: %s", asset.Coin, err)
+			return
+		}
+		if err = stores.restoreAsset(coin, asset); err != nil {
+			err = fmt.Errorf("Error restoring %s for Restore: %s", asset.Coin, err)
+			return
+		}
+	}
+	return
+}
+
+// checkEmpty returns an error if any of the stores has orders, archived orders, puzzles, balances,
+// ledger entries, or deposit addresses in it
+func (s *Stores) checkEmpty() (err error) {
+	for pair, book := range s.LimitOrderbooks {
+		var limitBook map[float64][]*match.LimitOrderIDPair
+		if limitBook, err = book.ViewLimitOrderBook(); err != nil {
+			err = fmt.Errorf("Error viewing %s limit orderbook: %s", pair.String(), err)
+			return
+		}
+		if len(limitBook) != 0 {
+			err = fmt.Errorf("The %s limit orderbook has orders in it", pair.String())
+			return
+		}
+		var archived []*match.ArchivedLimitOrder
+		if archived, err = book.ViewArchive(); err != nil {
+			err = fmt.Errorf("Error viewing %s limit order archive: %s", pair.String(), err)
+			return
+		}
+		if len(archived) != 0 {
+			err = fmt.Errorf("The %s limit order archive has orders in it", pair.String())
+			return
+		}
+	}
+	for pair, book := range s.AuctionOrderbooks {
+		var auctionBook map[float64][]*match.AuctionOrderIDPair
+		if auctionBook, err = book.ViewAuctionOrderBook(); err != nil {
+			err = fmt.Errorf("Error viewing %s auction orderbook: %s", pair.String(), err)
+			return
+		}
+		if len(auctionBook) != 0 {
+			err = fmt.Errorf("The %s auction orderbook has orders in it", pair.String())
+			return
+		}
+		var archived []*match.ArchivedAuctionOrder
+		if archived, err = book.ViewArchive(); err != nil {
+			err = fmt.Errorf("Error viewing %s auction order archive: %s", pair.String(), err)
+			return
+		}
+		if len(archived) != 0 {
+			err = fmt.Errorf("The %s auction order archive has orders in it", pair.String())
+			return
+		}
+	}
+	for pair, puzzleStore := range s.PuzzleStores {
+		var auctionIDs []*match.AuctionID
+		if auctionIDs, err = puzzleStore.ViewAuctionIDs(); err != nil {
+			err = fmt.Errorf("Error viewing %s auction IDs: %s", pair.String(), err)
+			return
+		}
+		if len(auctionIDs) != 0 {
+			err = fmt.Errorf("The %s puzzle store has puzzles in it", pair.String())
+			return
+		}
+	}
+	for coin, store := range s.SettlementStores {
+		var balances []*match.AccountBalance
+		if balances, err = store.GetAccountBalances(); err != nil {
+			err = fmt.Errorf("Error getting %s balances: %s", coin.Name, err)
+			return
+		}
+		if len(balances) != 0 {
+			err = fmt.Errorf("The %s settlement store has balances in it", coin.Name)
+			return
+		}
+	}
+	for coin, store := range s.LedgerStores {
+		var entries []*match.LedgerEntry
+		if entries, err = store.GetLedger(); err != nil {
+			err = fmt.Errorf("Error getting %s ledger: %s", coin.Name, err)
+			return
+		}
+		if len(entries) != 0 {
+			err = fmt.Errorf("The %s ledger has entries in it", coin.Name)
+			return
+		}
+	}
+	for coin, store := range s.DepositStores {
+		var depAddrMap map[string]*koblitz.PublicKey
+		if depAddrMap, err = store.GetDepositAddressMap(); err != nil {
+			err = fmt.Errorf("Error getting %s deposit addresses: %s", coin.Name, err)
+			return
+		}
+		if len(depAddrMap) != 0 {
+			err = fmt.Errorf("The %s deposit store has deposit addresses in it", coin.Name)
+			return
+		}
+	}
+	return
+}
+
+// restoreMarket puts the open orders, auctions and archived orders for a pair back
+func (s *Stores) restoreMarket(market *MarketSnapshot) (err error) {
+	if len(market.LimitOrders) != 0 {
+		engine, ok := s.LimitEngines[market.Pair]
+		if !ok {
+			err = fmt.Errorf("No limit engine to restore %d orders into", len(market.LimitOrders))
+			return
+		}
+		book, ok := s.LimitOrderbooks[market.Pair]
+		if !ok {
+			err = fmt.Errorf("No limit orderbook to restore %d orders into", len(market.LimitOrders))
+			return
+		}
+		for _, order := range market.LimitOrders {
+			if err = engine.RestoreLimitOrder(order); err != nil {
+				err = fmt.Errorf("Error restoring order %x into limit engine: %s", order.OrderID[:], err)
+				return
+			}
+			if err = book.UpdateBookPlace(order); err != nil {
+				err = fmt.Errorf("Error restoring order %x into limit orderbook: %s", order.OrderID[:], err)
+				return
+			}
+		}
+	}
+
+	for _, auction := range market.Auctions {
+		if err = s.restoreAuction(market.Pair, auction); err != nil {
+			err = fmt.Errorf("Error restoring auction %x: %s", auction.AuctionID[:], err)
+			return
+		}
+	}
+
+	if len(market.ArchivedLimitOrders) != 0 {
+		book, ok := s.LimitOrderbooks[market.Pair]
+		if !ok {
+			err = fmt.Errorf("No limit orderbook to restore %d archived orders into", len(market.ArchivedLimitOrders))
+			return
+		}
+		for _, archived := range market.ArchivedLimitOrders {
+			if err = book.RestoreArchivedOrder(archived); err != nil {
+				err = fmt.Errorf("Error restoring archived order %x into limit orderbook: %s", archived.Order.OrderID[:], err)
+				return
+			}
+		}
+	}
+
+	if len(market.ArchivedAuctionOrders) != 0 {
+		book, ok := s.AuctionOrderbooks[market.Pair]
+		if !ok {
+			err = fmt.Errorf("No auction orderbook to restore %d archived orders into", len(market.ArchivedAuctionOrders))
+			return
+		}
+		for _, archived := range market.ArchivedAuctionOrders {
+			if err = book.RestoreArchivedOrder(archived); err != nil {
+				err = fmt.Errorf("Error restoring archived order %x into auction orderbook: %s", archived.Order.OrderID[:], err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// restoreAuction puts the puzzles and orders for an auction back
+func (s *Stores) restoreAuction(pair match.Pair, auction *AuctionSnapshot) (err error) {
+	if len(auction.Puzzles) != 0 {
+		puzzleStore, ok := s.PuzzleStores[pair]
+		if !ok {
+			err = fmt.Errorf("No puzzle store to restore %d puzzles into", len(auction.Puzzles))
+			return
+		}
+		for _, puzzleBytes := range auction.Puzzles {
+			puzzle := new(match.EncryptedAuctionOrder)
+			if err = puzzle.Deserialize(puzzleBytes); err != nil {
+				err = fmt.Errorf("Error deserializing puzzle: %s", err)
+				return
+			}
+			if err = puzzleStore.PlaceAuctionPuzzle(puzzle); err != nil {
+				err = fmt.Errorf("Error restoring puzzle: %s", err)
+				return
+			}
+		}
+	}
+
+	if len(auction.Orders) == 0 {
+		return
+	}
+	engine, ok := s.AuctionEngines[pair]
+	if !ok {
+		err = fmt.Errorf("No auction engine to restore %d orders into", len(auction.Orders))
+		return
+	}
+	book, ok := s.AuctionOrderbooks[pair]
+	if !ok {
+		err = fmt.Errorf("No auction orderbook to restore %d orders into", len(auction.Orders))
+		return
+	}
+	for _, order := range auction.Orders {
+		// auction order IDs are the hash of the order, so placing it again gives it the same ID
+		var placed *match.AuctionOrderIDPair
+		if placed, err = engine.PlaceAuctionOrder(order.Order, &auction.AuctionID); err != nil {
+			err = fmt.Errorf("Error restoring order %x into auction engine: %s", order.OrderID[:], err)
+			return
+		}
+		if placed.OrderID != order.OrderID {
+			err = fmt.Errorf("Restored order %x got a different ID %x", order.OrderID[:], placed.OrderID[:])
+			return
+		}
+		if err = book.UpdateBookPlace(order); err != nil {
+			err = fmt.Errorf("Error restoring order %x into auction orderbook: %s", order.OrderID[:], err)
+			return
+		}
+	}
+	return
+}
+
+// restoreAsset puts the balances, ledger and deposit state for a coin back
+func (s *Stores) restoreAsset(coin *coinparam.Params, asset *AssetSnapshot) (err error) {
+	var assetForCoin match.Asset
+	if assetForCoin, err = match.AssetFromCoinParam(coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param: %s", err)
+		return
+	}
+
+	if len(asset.Balances) != 0 {
+		// the auction server doesn't keep settlement stores, only engines
+		store := s.settlementStore(coin)
+		engine := s.settlementEngine(coin)
+		if store == nil && engine == nil {
+			err = fmt.Errorf("No settlement store or engine to restore %d balances into", len(asset.Balances))
+			return
+		}
+
+		var setResults []*match.SettlementResult
+		for _, bal := range asset.Balances {
+			// Held balances are locked up in the open orders that were just restored, so only the
+			// available balance goes back into the settlement engine.
+			setRes := &match.SettlementResult{
+				NewBal:  bal.Balance,
+				NewHeld: bal.Held,
+				SuccessfulExec: &match.SettlementExecution{
+					Pubkey:     bal.Account.Pubkey,
+					SubAccount: bal.Account.SubAccount,
+					Amount:     bal.Balance,
+					Asset:      assetForCoin,
+					Type:       match.Debit,
+					Reason:     match.ReasonRestore,
+					Reference:  restoreReference,
+				},
+			}
+			if engine != nil && bal.Balance != 0 {
+				var engineRes *match.SettlementResult
+				if engineRes, err = engine.ApplySettlementExecution(setRes.SuccessfulExec); err != nil {
+					err = fmt.Errorf("Error restoring balance of %s into settlement engine: %s", bal.Account, err)
+					return
+				}
+				if engineRes.NewBal != bal.Balance {
+					err = fmt.Errorf("Restored balance of %s should be %d, settlement engine has %d", bal.Account, bal.Balance, engineRes.NewBal)
+					return
+				}
+			}
+			setResults = append(setResults, setRes)
+		}
+		if store != nil {
+			if err = store.UpdateBalances(setResults); err != nil {
+				err = fmt.Errorf("Error restoring balances into settlement store: %s", err)
+				return
+			}
+		}
+	}
+
+	// Putting the balances back wrote restore entries to the ledger, which are replaced by the
+	// ledger the balances came from. A snapshot without a ledger keeps the restore entries, so the
+	// balances still add up.
+	if store := s.ledgerStore(coin); store != nil && len(asset.Ledger) != 0 {
+		if err = store.ReplaceLedger(asset.Ledger); err != nil {
+			err = fmt.Errorf("Error restoring ledger: %s", err)
+			return
+		}
+	}
+
+	if len(asset.DepositUsers) == 0 && len(asset.Deposits) == 0 {
+		return
+	}
+	store := s.depositStore(coin)
+	if store == nil {
+		err = fmt.Errorf("No deposit store to restore %d deposit users into", len(asset.DepositUsers))
+		return
+	}
+
+	// Users are in index order, so getting their index assigns them the one they had
+	pubkeys := make(map[[33]byte]*koblitz.PublicKey)
+	for _, user := range asset.DepositUsers {
+		var pubkey *koblitz.PublicKey
+		if pubkey, err = koblitz.ParsePubKey(user.Pubkey[:], koblitz.S256()); err != nil {
+			err = fmt.Errorf("Error parsing deposit user pubkey %x: %s", user.Pubkey, err)
+			return
+		}
+		pubkeys[user.Pubkey] = pubkey
+
+		var index uint32
+		if index, err = store.GetDepositIndex(pubkey); err != nil {
+			err = fmt.Errorf("Error restoring deposit index for %x: %s", user.Pubkey, err)
+			return
+		}
+		if index != user.Index {
+			err = fmt.Errorf("Restored deposit index for %x should be %d, got %d", user.Pubkey, user.Index, index)
+			return
+		}
+		for _, addr := range user.Addresses {
+			if err = store.RegisterUser(pubkey, addr); err != nil {
+				err = fmt.Errorf("Error restoring deposit address %s for %x: %s", addr, user.Pubkey, err)
+				return
+			}
+		}
+	}
+
+	// Credited deposits are credited again when they're restored, but the balances they went to
+	// were already restored, so the executions are thrown away.
+	var credited []match.Deposit
+	var swept []*match.Deposit
+	var pending []match.Deposit
+	var creditHeight uint64
+	for _, record := range asset.Deposits {
+		pubkey, ok := pubkeys[record.Pubkey]
+		if !ok {
+			err = fmt.Errorf("Deposit %s:%d is for %x, who has no deposit address", record.Txid, record.Vout, record.Pubkey)
+			return
+		}
+		deposit := match.Deposit{
+			Pubkey:              pubkey,
+			Address:             record.Address,
+			Amount:              record.Amount,
+			Txid:                record.Txid,
+			Vout:                record.Vout,
+			CoinType:            coin,
+			BlockHeightReceived: record.BlockHeightReceived,
+			BlockHash:           record.BlockHash,
+			Confirmations:       record.Confirmations,
+		}
+		if !record.Credited {
+			pending = append(pending, deposit)
+			continue
+		}
+		credited = append(credited, deposit)
+		if record.Swept {
+			currSwept := new(match.Deposit)
+			*currSwept = deposit
+			swept = append(swept, currSwept)
+		}
+		if confirmHeight := record.BlockHeightReceived + record.Confirmations; confirmHeight > creditHeight {
+			creditHeight = confirmHeight
+		}
+	}
+
+	if len(credited) != 0 {
+		if _, err = store.UpdateDeposits(credited, creditHeight); err != nil {
+			err = fmt.Errorf("Error restoring credited deposits: %s", err)
+			return
+		}
+	}
+	if len(swept) != 0 {
+		if err = store.MarkDepositsSwept(swept); err != nil {
+			err = fmt.Errorf("Error restoring swept deposits: %s", err)
+			return
+		}
+	}
+	if len(pending) != 0 {
+		// nothing is confirmed at height 0, so these stay pending until the next block comes in
+		if _, err = store.UpdateDeposits(pending, 0); err != nil {
+			err = fmt.Errorf("Error restoring pending deposits: %s", err)
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,507 @@
+// Package cxdbsnapshot takes snapshots of everything the exchange keeps in its storage backend, and
+// restores them into any backend. Snapshots only go through the interfaces in match and cxdb, so a
+// snapshot of one backend can be restored into another.
+package cxdbsnapshot
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// SnapshotVersion is the version of the snapshots this package takes. Only snapshots with this
+// version can be restored. Version 2 added the order archives, the ledger and transfers.
+const SnapshotVersion = uint32(2)
+
+// Stores is every store a snapshot is taken from or restored into. Any of the maps can be nil, in
+// which case that part of the exchange is left out.
+type Stores struct {
+	LimitEngines      map[match.Pair]match.LimitEngine
+	LimitOrderbooks   map[match.Pair]match.LimitOrderbook
+	AuctionEngines    map[match.Pair]match.AuctionEngine
+	AuctionOrderbooks map[match.Pair]match.AuctionOrderbook
+	PuzzleStores      map[match.Pair]cxdb.PuzzleStore
+	SettlementEngines map[*coinparam.Params]match.SettlementEngine
+	SettlementStores  map[*coinparam.Params]cxdb.SettlementStore
+	DepositStores     map[*coinparam.Params]cxdb.DepositStore
+	LedgerStores      map[*coinparam.Params]cxdb.LedgerStore
+}
+
+// Snapshot is the state of the exchange at one point in time. Transfers are kept by the server
+// rather than in a store, so Take and Restore leave them to the caller.
+type Snapshot struct {
+	Version   uint32
+	Time      time.Time
+	Markets   []*MarketSnapshot
+	Assets    []*AssetSnapshot
+	Transfers []*TransferSnapshot
+}
+
+// MarketSnapshot is the open orders and auctions for one pair, and the orders that have been closed
+type MarketSnapshot struct {
+	Pair                  match.Pair
+	LimitOrders           []*match.LimitOrderIDPair
+	Auctions              []*AuctionSnapshot
+	ArchivedLimitOrders   []*match.ArchivedLimitOrder
+	ArchivedAuctionOrders []*match.ArchivedAuctionOrder
+}
+
+// AuctionSnapshot is an auction's puzzles, and the orders that are in it. Puzzles are kept
+// serialized.
+type AuctionSnapshot struct {
+	AuctionID match.AuctionID
+	Puzzles   [][]byte
+	Orders    []*match.AuctionOrderIDPair
+}
+
+// AssetSnapshot is the balances, ledger and deposit state for one coin
+type AssetSnapshot struct {
+	Coin         string
+	Balances     []*match.AccountBalance
+	Ledger       []*match.LedgerEntry
+	DepositUsers []*DepositUser
+	Deposits     []*DepositRecord
+}
+
+// TransferSnapshot is a transfer between two accounts that was applied, and when it was applied
+type TransferSnapshot struct {
+	Transfer *match.Transfer
+	Time     time.Time
+}
+
+// DepositUser is a pubkey with deposit addresses, and the index its addresses are derived from
+type DepositUser struct {
+	Pubkey    [33]byte
+	Index     uint32
+	Addresses []string
+}
+
+// DepositRecord is a deposit and whether or not it has been credited and swept
+type DepositRecord struct {
+	Pubkey              [33]byte
+	Address             string
+	Amount              uint64
+	Txid                string
+	Vout                uint32
+	BlockHeightReceived uint64
+	BlockHash           string
+	Confirmations       uint64
+	Credited            bool
+	Swept               bool
+}
+
+// Take takes a snapshot of every store. Nothing should change the stores while the snapshot is
+// being taken, so the caller should stop anything that writes to them first.
+func Take(stores *Stores) (snap *Snapshot, err error) {
+	snap = &Snapshot{
+		Version: SnapshotVersion,
+		Time:    time.Now(),
+	}
+
+	for _, pair := range stores.pairs() {
+		var market *MarketSnapshot
+		if market, err = stores.takeMarket(pair); err != nil {
+			snap = nil
+			err = fmt.Errorf("Error taking snapshot of %s for Take: %s", pair.String(), err)
+			return
+		}
+		snap.Markets = append(snap.Markets, market)
+	}
+
+	for _, coin := range stores.coins() {
+		var asset *AssetSnapshot
+		if asset, err = stores.takeAsset(coin); err != nil {
+			snap = nil
+			err = fmt.Errorf("Error taking snapshot of %s for Take: %s", coin.Name, err)
+			return
+		}
+		snap.Assets = append(snap.Assets, asset)
+	}
+	return
+}
+
+// takeMarket takes a snapshot of the orderbooks and puzzle store for a pair
+func (s *Stores) takeMarket(pair match.Pair) (market *MarketSnapshot, err error) {
+	market = &MarketSnapshot{Pair: pair}
+
+	if book, ok := s.LimitOrderbooks[pair]; ok {
+		var limitBook map[float64][]*match.LimitOrderIDPair
+		if limitBook, err = book.ViewLimitOrderBook(); err != nil {
+			err = fmt.Errorf("Error viewing limit orderbook: %s", err)
+			return
+		}
+		for _, orders := range limitBook {
+			market.LimitOrders = append(market.LimitOrders, orders...)
+		}
+		// oldest first, so restoring them places them in the order they came in
+		sort.Slice(market.LimitOrders, func(i, j int) bool {
+			if !market.LimitOrders[i].Timestamp.Equal(market.LimitOrders[j].Timestamp) {
+				return market.LimitOrders[i].Timestamp.Before(market.LimitOrders[j].Timestamp)
+			}
+			return bytes.Compare(market.LimitOrders[i].OrderID[:], market.LimitOrders[j].OrderID[:]) < 0
+		})
+
+		if market.ArchivedLimitOrders, err = book.ViewArchive(); err != nil {
+			err = fmt.Errorf("Error viewing limit order archive: %s", err)
+			return
+		}
+	}
+
+	auctions := make(map[match.AuctionID]*AuctionSnapshot)
+	getAuction := func(auctionID match.AuctionID) (auction *AuctionSnapshot) {
+		if auction = auctions[auctionID]; auction == nil {
+			auction = &AuctionSnapshot{AuctionID: auctionID}
+			auctions[auctionID] = auction
+		}
+		return
+	}
+
+	if puzzleStore, ok := s.PuzzleStores[pair]; ok {
+		var auctionIDs []*match.AuctionID
+		if auctionIDs, err = puzzleStore.ViewAuctionIDs(); err != nil {
+			err = fmt.Errorf("Error viewing auction IDs: %s", err)
+			return
+		}
+		for _, auctionID := range auctionIDs {
+			var puzzles []*match.EncryptedAuctionOrder
+			if puzzles, err = puzzleStore.ViewAuctionPuzzleBook(auctionID); err != nil {
+				err = fmt.Errorf("Error viewing puzzle book for auction %x: %s", auctionID[:], err)
+				return
+			}
+			auction := getAuction(*auctionID)
+			for _, puzzle := range puzzles {
+				var puzzleBytes []byte
+				if puzzleBytes, err = puzzle.Serialize(); err != nil {
+					err = fmt.Errorf("Error serializing puzzle for auction %x: %s", auctionID[:], err)
+					return
+				}
+				auction.Puzzles = append(auction.Puzzles, puzzleBytes)
+			}
+		}
+	}
+
+	if book, ok := s.AuctionOrderbooks[pair]; ok {
+		var auctionBook map[float64][]*match.AuctionOrderIDPair
+		if auctionBook, err = book.ViewAuctionOrderBook(); err != nil {
+			err = fmt.Errorf("Error viewing auction orderbook: %s", err)
+			return
+		}
+		for _, orders := range auctionBook {
+			for _, order := range orders {
+				auction := getAuction(order.Order.AuctionID)
+				auction.Orders = append(auction.Orders, order)
+			}
+		}
+
+		if market.ArchivedAuctionOrders, err = book.ViewArchive(); err != nil {
+			err = fmt.Errorf("Error viewing auction order archive: %s", err)
+			return
+		}
+	}
+
+	for _, auction := range auctions {
+		sort.Slice(auction.Orders, func(i, j int) bool {
+			return bytes.Compare(auction.Orders[i].OrderID[:], auction.Orders[j].OrderID[:]) < 0
+		})
+		market.Auctions = append(market.Auctions, auction)
+	}
+	sort.Slice(market.Auctions, func(i, j int) bool {
+		return bytes.Compare(market.Auctions[i].AuctionID[:], market.Auctions[j].AuctionID[:]) < 0
+	})
+	return
+}
+
+// takeAsset takes a snapshot of the balances, ledger and deposits for a coin
+func (s *Stores) takeAsset(coin *coinparam.Params) (asset *AssetSnapshot, err error) {
+	asset = &AssetSnapshot{Coin: coin.Name}
+
+	ledgerStore := s.ledgerStore(coin)
+	if ledgerStore != nil {
+		if asset.Ledger, err = ledgerStore.GetLedger(); err != nil {
+			err = fmt.Errorf("Error getting ledger: %s", err)
+			return
+		}
+	}
+
+	if store := s.settlementStore(coin); store != nil {
+		if asset.Balances, err = store.GetAccountBalances(); err != nil {
+			err = fmt.Errorf("Error getting account balances: %s", err)
+			return
+		}
+	} else if ledgerStore != nil {
+		// The auction server only keeps balances in its settlement engines, which write the ledger
+		// in the same transaction, so the balances are summed from the ledger instead.
+		if asset.Balances, err = ledgerBalances(asset.Ledger); err != nil {
+			err = fmt.Errorf("Error getting account balances from ledger: %s", err)
+			return
+		}
+	}
+	sort.Slice(asset.Balances, func(i, j int) bool {
+		return accountLess(asset.Balances[i].Account, asset.Balances[j].Account)
+	})
+
+	store := s.depositStore(coin)
+	if store == nil {
+		return
+	}
+
+	var depAddrMap map[string]*koblitz.PublicKey
+	if depAddrMap, err = store.GetDepositAddressMap(); err != nil {
+		err = fmt.Errorf("Error getting deposit addresses: %s", err)
+		return
+	}
+
+	users := make(map[[33]byte]*DepositUser)
+	pubkeys := make(map[[33]byte]*koblitz.PublicKey)
+	for addr, pubkey := range depAddrMap {
+		var pubkeyBytes [33]byte
+		copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+		user, ok := users[pubkeyBytes]
+		if !ok {
+			user = &DepositUser{Pubkey: pubkeyBytes}
+			if user.Index, err = store.GetDepositIndex(pubkey); err != nil {
+				err = fmt.Errorf("Error getting deposit index for %x: %s", pubkeyBytes, err)
+				return
+			}
+			users[pubkeyBytes] = user
+			pubkeys[pubkeyBytes] = pubkey
+		}
+		user.Addresses = append(user.Addresses, addr)
+	}
+
+	var sweepable []*match.Deposit
+	if sweepable, err = store.GetSweepableDeposits(); err != nil {
+		err = fmt.Errorf("Error getting sweepable deposits: %s", err)
+		return
+	}
+	unswept := make(map[string]bool)
+	for _, deposit := range sweepable {
+		unswept[outpointString(deposit)] = true
+	}
+
+	for pubkeyBytes, user := range users {
+		sort.Strings(user.Addresses)
+		asset.DepositUsers = append(asset.DepositUsers, user)
+
+		var pending []*match.Deposit
+		if pending, err = store.GetPendingDeposits(pubkeys[pubkeyBytes]); err != nil {
+			err = fmt.Errorf("Error getting pending deposits for %x: %s", pubkeyBytes, err)
+			return
+		}
+		for _, deposit := range pending {
+			asset.Deposits = append(asset.Deposits, depositRecord(deposit, false, false))
+		}
+
+		var history []*match.Deposit
+		if history, err = store.GetDepositHistory(pubkeys[pubkeyBytes]); err != nil {
+			err = fmt.Errorf("Error getting deposit history for %x: %s", pubkeyBytes, err)
+			return
+		}
+		for _, deposit := range history {
+			asset.Deposits = append(asset.Deposits, depositRecord(deposit, true, !unswept[outpointString(deposit)]))
+		}
+	}
+	sort.Slice(asset.DepositUsers, func(i, j int) bool {
+		return asset.DepositUsers[i].Index < asset.DepositUsers[j].Index
+	})
+	sort.Slice(asset.Deposits, func(i, j int) bool {
+		if asset.Deposits[i].BlockHeightReceived != asset.Deposits[j].BlockHeightReceived {
+			return asset.Deposits[i].BlockHeightReceived < asset.Deposits[j].BlockHeightReceived
+		}
+		if asset.Deposits[i].Txid != asset.Deposits[j].Txid {
+			return asset.Deposits[i].Txid < asset.Deposits[j].Txid
+		}
+		return asset.Deposits[i].Vout < asset.Deposits[j].Vout
+	})
+	return
+}
+
+// ledgerBalances sums the balance of every user account from the ledger. Nothing is held, since
+// held balances are only kept in settlement stores.
+func ledgerBalances(entries []*match.LedgerEntry) (balances []*match.AccountBalance, err error) {
+	sums := make(map[string]int64)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Account, match.ExchangeAccountPrefix) {
+			continue
+		}
+		if entry.Type == match.Credit {
+			sums[entry.Account] -= int64(entry.Amount)
+		} else {
+			sums[entry.Account] += int64(entry.Amount)
+		}
+	}
+
+	for accountString, sum := range sums {
+		if sum < 0 {
+			err = fmt.Errorf("Ledger balance of %s is negative: %d", accountString, sum)
+			return
+		}
+		if sum == 0 {
+			continue
+		}
+		var account match.Account
+		if account, err = match.ParseAccount(accountString); err != nil {
+			err = fmt.Errorf("Error parsing ledger account: %s", err)
+			return
+		}
+		balances = append(balances, &match.AccountBalance{
+			Account: account,
+			Balance: uint64(sum),
+		})
+	}
+	return
+}
+
+// depositRecord creates a deposit record from a deposit
+func depositRecord(deposit *match.Deposit, credited bool, swept bool) (record *DepositRecord) {
+	record = &DepositRecord{
+		Address:             deposit.Address,
+		Amount:              deposit.Amount,
+		Txid:                deposit.Txid,
+		Vout:                deposit.Vout,
+		BlockHeightReceived: deposit.BlockHeightReceived,
+		BlockHash:           deposit.BlockHash,
+		Confirmations:       deposit.Confirmations,
+		Credited:            credited,
+		Swept:               swept,
+	}
+	copy(record.Pubkey[:], deposit.Pubkey.SerializeCompressed())
+	return
+}
+
+// outpointString returns the txid and vout of a deposit, which is unique to the deposit
+func outpointString(deposit *match.Deposit) (outpoint string) {
+	outpoint = fmt.Sprintf("%s:%d", deposit.Txid, deposit.Vout)
+	return
+}
+
+// accountLess sorts accounts by pubkey, then sub-account
+func accountLess(a match.Account, b match.Account) (less bool) {
+	if cmp := bytes.Compare(a.Pubkey[:], b.Pubkey[:]); cmp != 0 {
+		less = cmp < 0
+		return
+	}
+	less = a.SubAccount < b.SubAccount
+	return
+}
+
+// pairs returns every pair that there's a store for, sorted so snapshots are always in the same order
+func (s *Stores) pairs() (pairs []match.Pair) {
+	seen := make(map[match.Pair]bool)
+	addPair := func(pair match.Pair) {
+		if !seen[pair] {
+			seen[pair] = true
+			pairs = append(pairs, pair)
+		}
+	}
+	for pair := range s.LimitEngines {
+		addPair(pair)
+	}
+	for pair := range s.LimitOrderbooks {
+		addPair(pair)
+	}
+	for pair := range s.AuctionEngines {
+		addPair(pair)
+	}
+	for pair := range s.AuctionOrderbooks {
+		addPair(pair)
+	}
+	for pair := range s.PuzzleStores {
+		addPair(pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].String() < pairs[j].String()
+	})
+	return
+}
+
+// coins returns every coin that there's a store for, sorted so snapshots are always in the same order
+func (s *Stores) coins() (coins []*coinparam.Params) {
+	seen := make(map[string]bool)
+	addCoin := func(coin *coinparam.Params) {
+		if !seen[coin.Name] {
+			seen[coin.Name] = true
+			coins = append(coins, coin)
+		}
+	}
+	for coin := range s.SettlementEngines {
+		addCoin(coin)
+	}
+	for coin := range s.SettlementStores {
+		addCoin(coin)
+	}
+	for coin := range s.DepositStores {
+		addCoin(coin)
+	}
+	for coin := range s.LedgerStores {
+		addCoin(coin)
+	}
+	sort.Slice(coins, func(i, j int) bool {
+		return coins[i].Name < coins[j].Name
+	})
+	return
+}
+
+// settlementEngine returns the settlement engine for a coin, or nil if there isn't one. Coins are
+// compared by name, since the params may have been created separately for each map.
+func (s *Stores) settlementEngine(coin *coinparam.Params) (engine match.SettlementEngine) {
+	for currCoin, currEngine := range s.SettlementEngines {
+		if currCoin.Name == coin.Name {
+			engine = currEngine
+			return
+		}
+	}
+	return
+}
+
+// settlementStore returns the settlement store for a coin, or nil if there isn't one
+func (s *Stores) settlementStore(coin *coinparam.Params) (store cxdb.SettlementStore) {
+	for currCoin, currStore := range s.SettlementStores {
+		if currCoin.Name == coin.Name {
+			store = currStore
+			return
+		}
+	}
+	return
+}
+
+// depositStore returns the deposit store for a coin, or nil if there isn't one
+func (s *Stores) depositStore(coin *coinparam.Params) (store cxdb.DepositStore) {
+	for currCoin, currStore := range s.DepositStores {
+		if currCoin.Name == coin.Name {
+			store = currStore
+			return
+		}
+	}
+	return
+}
+
+// ledgerStore returns the ledger store for a coin, or nil if there isn't one
+func (s *Stores) ledgerStore(coin *coinparam.Params) (store cxdb.LedgerStore) {
+	for currCoin, currStore := range s.LedgerStores {
+		if currCoin.Name == coin.Name {
+			store = currStore
+			return
+		}
+	}
+	return
+}
+
+// coinFromName returns the coin with the name out of every coin there's a store for
+func (s *Stores) coinFromName(name string) (coin *coinparam.Params, err error) {
+	for _, currCoin := range s.coins() {
+		if currCoin.Name == name {
+			coin = currCoin
+			return
+		}
+	}
+	err = fmt.Errorf("No stores for coin %s", name)
+	return
+}
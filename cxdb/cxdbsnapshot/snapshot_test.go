@@ -0,0 +1,46 @@
+package cxdbsnapshot
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// Snapshots going between backends are checked by the conformance suite in cxdbtest, this only
+// checks the archive itself.
+func TestArchiveChecks(t *testing.T) {
+	var err error
+
+	snap := &Snapshot{Version: SnapshotVersion, Time: time.Now()}
+	var buf bytes.Buffer
+	if err = WriteArchive(&buf, snap); err != nil {
+		t.Fatalf("Error writing archive: %s", err)
+	}
+
+	var arcBytes []byte
+	if arcBytes, err = ioutil.ReadAll(&buf); err != nil {
+		t.Fatalf("Error reading archive bytes: %s", err)
+	}
+	if _, err = ReadArchive(bytes.NewReader(arcBytes)); err != nil {
+		t.Fatalf("Error reading archive: %s", err)
+	}
+	corrupted := append([]byte{}, arcBytes...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	if _, err = ReadArchive(bytes.NewReader(corrupted)); err == nil {
+		t.Fatalf("Reading a corrupted archive should fail")
+	}
+
+	otherSnap := &Snapshot{Version: SnapshotVersion + 1}
+	buf.Reset()
+	if err = WriteArchive(&buf, otherSnap); err != nil {
+		t.Fatalf("Error writing archive: %s", err)
+	}
+	if _, err = ReadArchive(&buf); err == nil {
+		t.Fatalf("Reading an archive with a different version should fail")
+	}
+	if err = Restore(new(Stores), otherSnap); err == nil {
+		t.Fatalf("Restoring a snapshot with a different version should fail")
+	}
+	return
+}
@@ -0,0 +1,142 @@
+package cxdbsnapshot
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/mit-dci/opencx/match"
+)
+
+// Verify takes a snapshot of the stores and checks that it has the same orders, puzzles, balances,
+// ledger and deposits as snap, so a restore can be checked against the backend it was restored
+// into. Orders are compared by ID, since backends keep times to different precisions. If snap has a
+// ledger the restored ledger has to be the same, but a snapshot without one, like one of pinky
+// swear engines, restores with restore entries instead.
+func Verify(stores *Stores, snap *Snapshot) (err error) {
+	var restored *Snapshot
+	if restored, err = Take(stores); err != nil {
+		err = fmt.Errorf("Error taking snapshot for Verify: %s", err)
+		return
+	}
+
+	restoredMarkets := make(map[match.Pair]*MarketSnapshot)
+	for _, market := range restored.Markets {
+		restoredMarkets[market.Pair] = market
+	}
+	for _, market := range snap.Markets {
+		restoredMarket, found := restoredMarkets[market.Pair]
+		if !found {
+			err = fmt.Errorf("Error, %s was not restored for Verify", market.Pair.String())
+			return
+		}
+		if err = verifyMarket(restoredMarket, market); err != nil {
+			err = fmt.Errorf("Error verifying %s for Verify: %s", market.Pair.String(), err)
+			return
+		}
+	}
+
+	restoredAssets := make(map[string]*AssetSnapshot)
+	for _, asset := range restored.Assets {
+		restoredAssets[asset.Coin] = asset
+	}
+	for _, asset := range snap.Assets {
+		restoredAsset, found := restoredAssets[asset.Coin]
+		if !found {
+			err = fmt.Errorf("Error, %s was not restored for Verify", asset.Coin)
+			return
+		}
+		if err = verifyAsset(restoredAsset, asset); err != nil {
+			err = fmt.Errorf("Error verifying %s for Verify: %s", asset.Coin, err)
+			return
+		}
+	}
+	return
+}
+
+// verifyMarket checks that the restored market has the same open orders, auctions and archived
+// orders as the market in the snapshot
+func verifyMarket(restored *MarketSnapshot, market *MarketSnapshot) (err error) {
+	if len(restored.LimitOrders) != len(market.LimitOrders) {
+		err = fmt.Errorf("Expected %d limit orders, found %d", len(market.LimitOrders), len(restored.LimitOrders))
+		return
+	}
+	restoredLimitOrders := make(map[match.OrderID]bool)
+	for _, order := range restored.LimitOrders {
+		restoredLimitOrders[*order.OrderID] = true
+	}
+	for _, order := range market.LimitOrders {
+		if !restoredLimitOrders[*order.OrderID] {
+			err = fmt.Errorf("Limit order %x was not restored", order.OrderID[:])
+			return
+		}
+	}
+
+	if len(restored.Auctions) != len(market.Auctions) {
+		err = fmt.Errorf("Expected %d auctions, found %d", len(market.Auctions), len(restored.Auctions))
+		return
+	}
+	restoredAuctions := make(map[match.AuctionID]*AuctionSnapshot)
+	for _, auction := range restored.Auctions {
+		restoredAuctions[auction.AuctionID] = auction
+	}
+	for _, auction := range market.Auctions {
+		restoredAuction, found := restoredAuctions[auction.AuctionID]
+		if !found {
+			err = fmt.Errorf("Auction %x was not restored", auction.AuctionID[:])
+			return
+		}
+		if !reflect.DeepEqual(restoredAuction.Puzzles, auction.Puzzles) {
+			err = fmt.Errorf("Puzzles for auction %x were not restored the same", auction.AuctionID[:])
+			return
+		}
+		if len(restoredAuction.Orders) != len(auction.Orders) {
+			err = fmt.Errorf("Expected %d orders in auction %x, found %d", len(auction.Orders), auction.AuctionID[:], len(restoredAuction.Orders))
+			return
+		}
+		restoredAuctionOrders := make(map[match.OrderID]bool)
+		for _, order := range restoredAuction.Orders {
+			restoredAuctionOrders[order.OrderID] = true
+		}
+		for _, order := range auction.Orders {
+			if !restoredAuctionOrders[order.OrderID] {
+				err = fmt.Errorf("Auction order %x was not restored", order.OrderID[:])
+				return
+			}
+		}
+	}
+
+	if len(restored.ArchivedLimitOrders) != len(market.ArchivedLimitOrders) || len(restored.ArchivedAuctionOrders) != len(market.ArchivedAuctionOrders) {
+		err = fmt.Errorf("Expected %d archived limit orders and %d archived auction orders, found %d and %d", len(market.ArchivedLimitOrders), len(market.ArchivedAuctionOrders), len(restored.ArchivedLimitOrders), len(restored.ArchivedAuctionOrders))
+		return
+	}
+	return
+}
+
+// verifyAsset checks that the restored asset has the same balances, ledger and deposits as the
+// asset in the snapshot
+func verifyAsset(restored *AssetSnapshot, asset *AssetSnapshot) (err error) {
+	if !reflect.DeepEqual(restored.Balances, asset.Balances) {
+		err = fmt.Errorf("Balances were not restored the same")
+		return
+	}
+
+	if len(asset.Ledger) != 0 {
+		if len(restored.Ledger) != len(asset.Ledger) {
+			err = fmt.Errorf("Expected %d ledger entries, found %d", len(asset.Ledger), len(restored.Ledger))
+			return
+		}
+		for i, entry := range asset.Ledger {
+			restoredEntry := restored.Ledger[i]
+			if restoredEntry.ID != entry.ID || restoredEntry.Account != entry.Account || restoredEntry.Amount != entry.Amount || restoredEntry.Type != entry.Type || restoredEntry.Reason != entry.Reason || restoredEntry.Reference != entry.Reference {
+				err = fmt.Errorf("Ledger entry %d was not restored the same", entry.ID)
+				return
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(restored.DepositUsers, asset.DepositUsers) || !reflect.DeepEqual(restored.Deposits, asset.Deposits) {
+		err = fmt.Errorf("Deposits were not restored the same")
+		return
+	}
+	return
+}
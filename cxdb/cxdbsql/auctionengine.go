@@ -4,9 +4,7 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
-	"net"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/mit-dci/opencx/logging"
 	"github.com/mit-dci/opencx/match"
 	"golang.org/x/crypto/sha3"
@@ -16,12 +14,8 @@ import (
 type SQLAuctionEngine struct {
 	DBHandler *sql.DB
 
-	// db username and password
-	dbUsername string
-	dbPassword string
-
-	// db host and port
-	dbAddr net.Addr
+	// the sql database we are using
+	dialect sqlDialect
 
 	// auction orderbook schema name
 	auctionOrderSchema string
@@ -35,6 +29,11 @@ const (
 	auctionEngineSchema = "pubkey VARBINARY(66), side TEXT, price DOUBLE(30, 2) UNSIGNED, amountHave BIGINT(64), amountWant BIGINT(64), auctionID VARBINARY(64), nonce VARBINARY(4), sig BLOB, hashedOrder VARBINARY(64), PRIMARY KEY (hashedOrder)"
 )
 
+// The schema versions of the auction orderbook, oldest first
+var auctionEngineMigrations = []migration{
+	baselineMigration(auctionEngineSchema),
+}
+
 // CreateAuctionEngineWithConf creates an auction engine, sets up the connection and tables, and returns the auctionengine interface.
 func CreateAuctionEngineWithConf(pair *match.Pair, conf *dbsqlConfig) (engine match.AuctionEngine, err error) {
 
@@ -54,19 +53,17 @@ func CreateAucEngineStructWithConf(pair *match.Pair, conf *dbsqlConfig) (engine
 	// Set the default conf
 	dbConfigSetup(conf)
 
-	// Resolve new address
-	var addr net.Addr
-	if addr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(conf.DBHost, fmt.Sprintf("%d", conf.DBPort))); err != nil {
-		err = fmt.Errorf("Couldn't resolve db address for createAuctionEngine: %s", err)
+	// Get the dialect for the database we are using
+	var dialect sqlDialect
+	if dialect, err = newDialect(conf); err != nil {
+		err = fmt.Errorf("Couldn't create sql dialect for createAuctionEngine: %s", err)
 		return
 	}
 
 	// Set values
 	ae := &SQLAuctionEngine{
-		dbUsername:         conf.DBUsername,
-		dbPassword:         conf.DBPassword,
+		dialect:            dialect,
 		auctionOrderSchema: conf.AuctionSchemaName,
-		dbAddr:             addr,
 		pair:               pair,
 	}
 
@@ -75,19 +72,12 @@ func CreateAucEngineStructWithConf(pair *match.Pair, conf *dbsqlConfig) (engine
 		return
 	}
 
-	// Now connect to the database and create the schemas / tables
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", ae.dbUsername, ae.dbPassword, ae.dbAddr.Network(), ae.dbAddr.String())
-	if ae.DBHandler, err = sql.Open("mysql", openString); err != nil {
+	// Now connect to the database
+	if ae.DBHandler, err = ae.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for createAuctionEngine: %s", err)
 		return
 	}
 
-	// Make sure we can actually connect
-	if err = ae.DBHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
-		return
-	}
-
 	// now we actually set the return, all checks have passed
 	engine = ae
 	return
@@ -112,9 +102,8 @@ func CreateAuctionEngine(pair *match.Pair) (engine match.AuctionEngine, err erro
 // This assumes the schema name is set
 func (ae *SQLAuctionEngine) setupAuctionOrderbookTables() (err error) {
 
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", ae.dbUsername, ae.dbPassword, ae.dbAddr.Network(), ae.dbAddr.String())
 	var rootHandler *sql.DB
-	if rootHandler, err = sql.Open("mysql", openString); err != nil {
+	if rootHandler, err = ae.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for setup auction tables: %s", err)
 		return
 	}
@@ -122,11 +111,6 @@ func (ae *SQLAuctionEngine) setupAuctionOrderbookTables() (err error) {
 	// when we're done close please
 	defer rootHandler.Close()
 
-	if err = rootHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
-		return
-	}
-
 	// We do this in a transaction because it's more than one operation
 	var tx *sql.Tx
 	if tx, err = rootHandler.Begin(); err != nil {
@@ -143,21 +127,9 @@ func (ae *SQLAuctionEngine) setupAuctionOrderbookTables() (err error) {
 		err = tx.Commit()
 	}()
 
-	// Now create the schema
-	if _, err = tx.Exec("CREATE SCHEMA IF NOT EXISTS " + ae.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error creating schema for setup auction order tables: %s", err)
-		return
-	}
-
-	// use the schema
-	if _, err = tx.Exec("USE " + ae.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Could not use %s schema: %s", ae.auctionOrderSchema, err)
-		return
-	}
-
-	createTableQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", ae.pair.String(), auctionEngineSchema)
-	if _, err = tx.Exec(createTableQuery); err != nil {
-		err = fmt.Errorf("Error creating auction orderbook table: %s", err)
+	// Create the table if it does not exist, and bring it up to the newest schema version
+	if err = migrateTable(tx, ae.dialect, ae.auctionOrderSchema, ae.pair.String(), auctionEngineMigrations); err != nil {
+		err = fmt.Errorf("Error migrating auction orderbook table: %s", err)
 		return
 	}
 	return
@@ -213,15 +185,10 @@ func (ae *SQLAuctionEngine) PlaceAuctionOrder(order *match.AuctionOrder, auction
 		return
 	}()
 
-	if _, err = tx.Exec("USE " + ae.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error while placing solved auction order: %s", err)
-		return
-	}
-
 	logging.Infof("Placing order %s!", order)
 
-	insertOrderQuery := fmt.Sprintf("INSERT INTO %s VALUES ('%x', '%s', %f, %d, %d, '%x', '%x', '%x', '%x');", ae.pair.String(), order.Pubkey, order.Side, price, order.AmountHave, order.AmountWant, order.AuctionID, order.Nonce, order.Signature, hashedOrder)
-	if _, err = tx.Exec(insertOrderQuery); err != nil {
+	insertOrderQuery := fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);", ae.dialect.tableName(ae.auctionOrderSchema, ae.pair.String()))
+	if _, err = tx.Exec(ae.dialect.bind(insertOrderQuery), hexArg(order.Pubkey), order.Side.String(), price, order.AmountHave, order.AmountWant, hexArg(order.AuctionID), hexArg(order.Nonce), hexArg(order.Signature), hexArg(hashedOrder)); err != nil {
 		logging.Errorf("Bad query run: %s", insertOrderQuery)
 		err = fmt.Errorf("Error placing order into db for placeauctionorder: %s", err)
 		return
@@ -262,19 +229,14 @@ func (ae *SQLAuctionEngine) CancelAuctionOrder(orderID *match.OrderID) (cancelle
 		return
 	}()
 
-	if _, err = tx.Exec("USE " + ae.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error while cancelling auction order: %s", err)
-		return
-	}
-
 	var rows *sql.Rows
-	selectOrderQuery := fmt.Sprintf("SELECT pubkey, side, amountHave FROM %s WHERE hashedOrder = '%x';", ae.pair, orderID)
-	if rows, err = tx.Query(selectOrderQuery); err != nil {
+	selectOrderQuery := fmt.Sprintf("SELECT pubkey, side, amountHave FROM %s WHERE hashedOrder = ?;", ae.dialect.tableName(ae.auctionOrderSchema, ae.pair.String()))
+	if rows, err = tx.Query(ae.dialect.bind(selectOrderQuery), hexArg(orderID)); err != nil {
 		err = fmt.Errorf("Error getting order from db for cancelauctionorder: %s", err)
 		return
 	}
 
-	var actualSide *match.Side
+	actualSide := new(match.Side)
 
 	var pkBytes []byte
 	var orderSide string
@@ -292,16 +254,24 @@ func (ae *SQLAuctionEngine) CancelAuctionOrder(orderID *match.OrderID) (cancelle
 			return
 		}
 
-		actualSide = new(match.Side)
 		if err = actualSide.FromString(orderSide); err != nil {
 			err = fmt.Errorf("Error getting side from string for cancelauctionorder: %s", err)
 			return
 		}
 
+	} else {
+		rows.Close()
+		err = fmt.Errorf("Order %x does not exist, cannot cancel", orderID[:])
+		return
 	}
 
-	deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE hashedOrder = '%x';", ae.pair.String(), orderID)
-	if _, err = tx.Exec(deleteOrderQuery); err != nil {
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing rows for cancelauctionorder: %s", err)
+		return
+	}
+
+	deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE hashedOrder = ?;", ae.dialect.tableName(ae.auctionOrderSchema, ae.pair.String()))
+	if _, err = tx.Exec(ae.dialect.bind(deleteOrderQuery), hexArg(orderID)); err != nil {
 		err = fmt.Errorf("Error deleting order for cancel auction order: %s", err)
 		return
 	}
@@ -316,9 +286,11 @@ func (ae *SQLAuctionEngine) CancelAuctionOrder(orderID *match.OrderID) (cancelle
 		debitAsset = ae.pair.AssetWant
 	}
 	cancelSettlement = &match.SettlementExecution{
-		Amount: remainingHave,
-		Type:   match.Debit,
-		Asset:  debitAsset,
+		Amount:    remainingHave,
+		Type:      match.Debit,
+		Asset:     debitAsset,
+		Reason:    match.ReasonCancelRefund,
+		Reference: hex.EncodeToString(orderID[:]),
 	}
 	copy(cancelSettlement.Pubkey[:], pkBytes)
 
@@ -382,14 +354,9 @@ func (ae *SQLAuctionEngine) getOrdersTx(auctionID *match.AuctionID, tx *sql.Tx)
 	}
 
 	orderbook = make(map[float64][]*match.AuctionOrderIDPair)
-	if _, err = tx.Exec("USE " + ae.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using auction schema for viewauctionorderbook: %s", err)
-		return
-	}
-
 	var rows *sql.Rows
-	selectOrderQuery := fmt.Sprintf("SELECT pubkey, side, price, amountHave, amountWant, auctionID, nonce, sig, hashedOrder FROM %s WHERE auctionID = '%x';", ae.pair, auctionID)
-	if rows, err = tx.Query(selectOrderQuery); err != nil {
+	selectOrderQuery := fmt.Sprintf("SELECT pubkey, side, price, amountHave, amountWant, auctionID, nonce, sig, hashedOrder FROM %s WHERE auctionID = ?;", ae.dialect.tableName(ae.auctionOrderSchema, ae.pair.String()))
+	if rows, err = tx.Query(ae.dialect.bind(selectOrderQuery), hexArg(auctionID)); err != nil {
 		err = fmt.Errorf("Error getting orders from db for viewauctionorderbook: %s", err)
 		return
 	}
@@ -415,12 +382,13 @@ func (ae *SQLAuctionEngine) getOrdersTx(auctionID *match.AuctionID, tx *sql.Tx)
 	var sigBytes []byte
 	var hashedOrderBytes []byte
 	var thisPrice float64
+	var sideString string
 
 	for rows.Next() {
 		// scan the things we can into this order
 		thisOrder = new(match.AuctionOrder)
 		thisOrderPair = new(match.AuctionOrderIDPair)
-		if err = rows.Scan(&pkBytes, &thisOrder.Side, &thisPrice, &thisOrder.AmountHave, &thisOrder.AmountWant, &auctionIDBytes, &nonceBytes, &sigBytes, &hashedOrderBytes); err != nil {
+		if err = rows.Scan(&pkBytes, &sideString, &thisPrice, &thisOrder.AmountHave, &thisOrder.AmountWant, &auctionIDBytes, &nonceBytes, &sigBytes, &hashedOrderBytes); err != nil {
 			err = fmt.Errorf("Error scanning into order for viewauctionorderbook: %s", err)
 			return
 		}
@@ -433,10 +401,15 @@ func (ae *SQLAuctionEngine) getOrdersTx(auctionID *match.AuctionID, tx *sql.Tx)
 			}
 		}
 
+		if err = thisOrder.Side.FromString(sideString); err != nil {
+			err = fmt.Errorf("Error getting side from string for viewauctionorderbook: %s", err)
+			return
+		}
+
 		// Copy all of the bytes
 		copy(thisOrder.Pubkey[:], pkBytes)
 		copy(thisOrder.AuctionID[:], auctionIDBytes)
-		copy(thisOrder.Signature[:], sigBytes)
+		thisOrder.Signature = sigBytes
 		copy(thisOrder.Nonce[:], nonceBytes)
 		thisOrder.TradingPair = *ae.pair
 		copy(thisOrderPair.OrderID[:], hashedOrderBytes)
@@ -456,19 +429,13 @@ func (ae *SQLAuctionEngine) processExecutionsTx(execs []*match.OrderExecution, t
 		return
 	}
 
-	// First use the auction schema
-	if _, err = tx.Exec("USE " + ae.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using auction schema to process order execution: %s", err)
-		return
-	}
-
 	for _, exec := range execs {
 		// If the order was filled then delete it. If not then update it.
 		if exec.Filled {
 			// If the order was filled, delete it from the orderbook
-			deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE hashedOrder='%x';", ae.pair.String(), exec.OrderID)
+			deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE hashedOrder=?;", ae.dialect.tableName(ae.auctionOrderSchema, ae.pair.String()))
 			var res sql.Result
-			if res, err = tx.Exec(deleteOrderQuery); err != nil {
+			if res, err = tx.Exec(ae.dialect.bind(deleteOrderQuery), hexArg(exec.OrderID)); err != nil {
 				err = fmt.Errorf("Error deleting order within tx for processorderexecution: %s", err)
 				return
 			}
@@ -483,9 +450,9 @@ func (ae *SQLAuctionEngine) processExecutionsTx(execs []*match.OrderExecution, t
 			}
 		} else {
 			// If the order was not filled, just update the amounts
-			updateOrderQuery := fmt.Sprintf("UPDATE %s SET amountHave=%d, amountWant=%d WHERE hashedOrder='%x';", ae.pair.String(), exec.NewAmountHave, exec.NewAmountWant, exec.OrderID)
+			updateOrderQuery := fmt.Sprintf("UPDATE %s SET amountHave=?, amountWant=? WHERE hashedOrder=?;", ae.dialect.tableName(ae.auctionOrderSchema, ae.pair.String()))
 			var res sql.Result
-			if res, err = tx.Exec(updateOrderQuery); err != nil {
+			if res, err = tx.Exec(ae.dialect.bind(updateOrderQuery), exec.NewAmountHave, exec.NewAmountWant, hexArg(exec.OrderID)); err != nil {
 				err = fmt.Errorf("Error updating order within tx for processorderexecution: %s", err)
 				return
 			}
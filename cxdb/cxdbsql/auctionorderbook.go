@@ -4,7 +4,7 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
-	"net"
+	"time"
 
 	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/opencx/logging"
@@ -15,16 +15,15 @@ import (
 type SQLAuctionOrderbook struct {
 	DBHandler *sql.DB
 
-	// db username and password
-	dbUsername string
-	dbPassword string
-
-	// db host and port
-	dbAddr net.Addr
+	// the sql database we are using
+	dialect sqlDialect
 
 	// orderbook schema name
 	auctionOrderSchema string
 
+	// archive schema name, for orders that are no longer in the orderbook and their fills
+	archiveSchema string
+
 	// this pair
 	pair *match.Pair
 }
@@ -40,22 +39,30 @@ func CreateAuctionOrderbook(pair *match.Pair) (book match.AuctionOrderbook, err
 	conf := new(dbsqlConfig)
 	*conf = *defaultConf
 
+	if book, err = CreateAuctionOrderbookWithConf(pair, conf); err != nil {
+		err = fmt.Errorf("Error creating auction orderbook with conf for CreateAuctionOrderbook: %s", err)
+		return
+	}
+	return
+}
+
+// CreateAuctionOrderbookWithConf creates a auction orderbook based on a pair, using the database in conf
+func CreateAuctionOrderbookWithConf(pair *match.Pair, conf *dbsqlConfig) (book match.AuctionOrderbook, err error) {
 	// set the default conf
 	dbConfigSetup(conf)
 
-	// Resolve new address
-	var addr net.Addr
-	if addr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(conf.DBHost, fmt.Sprintf("%d", conf.DBPort))); err != nil {
-		err = fmt.Errorf("Couldn't resolve db address for CreateAuctionEngine: %s", err)
+	// Get the dialect for the database we are using
+	var dialect sqlDialect
+	if dialect, err = newDialect(conf); err != nil {
+		err = fmt.Errorf("Couldn't create sql dialect for CreateAuctionOrderbookWithConf: %s", err)
 		return
 	}
 
 	// Set values for auction engine
 	ao := &SQLAuctionOrderbook{
-		dbUsername:         conf.DBUsername,
-		dbPassword:         conf.DBPassword,
+		dialect:            dialect,
 		auctionOrderSchema: conf.ReadOnlyAuctionSchemaName,
-		dbAddr:             addr,
+		archiveSchema:      conf.AuctionArchiveSchemaName,
 		pair:               pair,
 	}
 
@@ -64,16 +71,9 @@ func CreateAuctionOrderbook(pair *match.Pair) (book match.AuctionOrderbook, err
 		return
 	}
 
-	// Now connect to the database and create the schemas / tables
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", ao.dbUsername, ao.dbPassword, ao.dbAddr.Network(), ao.dbAddr.String())
-	if ao.DBHandler, err = sql.Open("mysql", openString); err != nil {
-		err = fmt.Errorf("Error opening database for CreateAuctionEngine: %s", err)
-		return
-	}
-
-	// Make sure we can actually connect
-	if err = ao.DBHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
+	// Now connect to the database
+	if ao.DBHandler, err = ao.dialect.open(); err != nil {
+		err = fmt.Errorf("Error opening database for CreateAuctionOrderbookWithConf: %s", err)
 		return
 	}
 
@@ -86,9 +86,8 @@ func CreateAuctionOrderbook(pair *match.Pair) (book match.AuctionOrderbook, err
 // This assumes everything else is set
 func (ao *SQLAuctionOrderbook) setupAuctionOrderbookTables() (err error) {
 
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", ao.dbUsername, ao.dbPassword, ao.dbAddr.Network(), ao.dbAddr.String())
 	var rootHandler *sql.DB
-	if rootHandler, err = sql.Open("mysql", openString); err != nil {
+	if rootHandler, err = ao.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for setup auction orderbook tables: %s", err)
 		return
 	}
@@ -96,11 +95,6 @@ func (ao *SQLAuctionOrderbook) setupAuctionOrderbookTables() (err error) {
 	// when we're done close please
 	defer rootHandler.Close()
 
-	if err = rootHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
-		return
-	}
-
 	// We do this in a transaction because it's more than one operation
 	var tx *sql.Tx
 	if tx, err = rootHandler.Begin(); err != nil {
@@ -117,22 +111,21 @@ func (ao *SQLAuctionOrderbook) setupAuctionOrderbookTables() (err error) {
 		err = tx.Commit()
 	}()
 
-	// Now create the schema
-	if _, err = tx.Exec("CREATE SCHEMA IF NOT EXISTS " + ao.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error creating schema for setup auction order tables: %s", err)
-		return
-	}
-
-	// use the schema
-	if _, err = tx.Exec("USE " + ao.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Could not use %s schema: %s", ao.auctionOrderSchema, err)
-		return
-	}
-
-	createTableQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", ao.pair.String(), auctionEngineSchema)
-	if _, err = tx.Exec(createTableQuery); err != nil {
-		err = fmt.Errorf("Error creating auction orderbook table: %s", err)
-		return
+	// Create the tables if they do not exist, and bring them up to the newest schema version
+	tables := []struct {
+		schemaName string
+		tableName  string
+		migrations []migration
+	}{
+		{ao.auctionOrderSchema, ao.pair.String(), auctionEngineMigrations},
+		{ao.archiveSchema, ao.pair.String(), auctionArchiveMigrations},
+		{ao.archiveSchema, fillsTable(ao.pair), orderFillsMigrations},
+	}
+	for _, table := range tables {
+		if err = migrateTable(tx, ao.dialect, table.schemaName, table.tableName, table.migrations); err != nil {
+			err = fmt.Errorf("Error migrating auction orderbook table: %s", err)
+			return
+		}
 	}
 	return
 }
@@ -155,18 +148,37 @@ func (ao *SQLAuctionOrderbook) UpdateBookExec(exec *match.OrderExecution) (err e
 		err = tx.Commit()
 	}()
 
-	// First use the auction schema
-	if _, err = tx.Exec("USE " + ao.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using auction schema to process order execution: %s", err)
+	// Keep the execution as a fill, and archive the order if it was filled
+	var aoid *match.AuctionOrderIDPair
+	if aoid, err = ao.getOrder(tx, &exec.OrderID); err != nil {
+		err = fmt.Errorf("Error getting order within tx for processorderexecution: %s", err)
+		return
+	}
+	if aoid == nil {
+		err = fmt.Errorf("Order %x is not in the orderbook", exec.OrderID[:])
 		return
 	}
+	now := time.Now()
+	if err = insertFill(tx, ao.dialect, ao.archiveSchema, ao.pair, &exec.OrderID, match.NewOrderFill(aoid.Order.AmountWant, aoid.Order.AmountHave, exec, now)); err != nil {
+		err = fmt.Errorf("Error inserting fill within tx for processorderexecution: %s", err)
+		return
+	}
+	if exec.Filled {
+		// the last fill took everything that was left
+		aoid.Order.AmountWant = 0
+		aoid.Order.AmountHave = 0
+		if err = ao.archiveOrder(tx, aoid, match.OrderFilled, now); err != nil {
+			err = fmt.Errorf("Error archiving order within tx for processorderexecution: %s", err)
+			return
+		}
+	}
 
 	// If the order was filled then delete it. If not then update it.
 	if exec.Filled {
 		// If the order was filled, delete it from the orderbook
-		deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE hashedOrder='%x';", ao.pair.String(), exec.OrderID)
+		deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE hashedOrder=?;", ao.dialect.tableName(ao.auctionOrderSchema, ao.pair.String()))
 		var res sql.Result
-		if res, err = tx.Exec(deleteOrderQuery); err != nil {
+		if res, err = tx.Exec(ao.dialect.bind(deleteOrderQuery), hexArg(exec.OrderID)); err != nil {
 			err = fmt.Errorf("Error deleting order within tx for processorderexecution: %s", err)
 			return
 		}
@@ -182,9 +194,9 @@ func (ao *SQLAuctionOrderbook) UpdateBookExec(exec *match.OrderExecution) (err e
 		}
 	} else {
 		// If the order was not filled, just update the amounts
-		updateOrderQuery := fmt.Sprintf("UPDATE %s SET amountHave=%d, amountWant=%d WHERE hashedOrder='%x';", ao.pair.String(), exec.NewAmountHave, exec.NewAmountWant, exec.OrderID)
+		updateOrderQuery := fmt.Sprintf("UPDATE %s SET amountHave=?, amountWant=? WHERE hashedOrder=?;", ao.dialect.tableName(ao.auctionOrderSchema, ao.pair.String()))
 		var res sql.Result
-		if res, err = tx.Exec(updateOrderQuery); err != nil {
+		if res, err = tx.Exec(ao.dialect.bind(updateOrderQuery), exec.NewAmountHave, exec.NewAmountWant, hexArg(exec.OrderID)); err != nil {
 			err = fmt.Errorf("Error updating order within tx for processorderexecution: %s", err)
 			return
 		}
@@ -220,16 +232,30 @@ func (ao *SQLAuctionOrderbook) UpdateBookCancel(cancel *match.CancelledOrder) (e
 		err = tx.Commit()
 	}()
 
-	// First use the auction schema
-	if _, err = tx.Exec("USE " + ao.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using auction schema for UpdateBookCancel: %s", err)
+	// Archive the order before it's taken out of the orderbook
+	var aoid *match.AuctionOrderIDPair
+	if aoid, err = ao.getOrder(tx, cancel.OrderID); err != nil {
+		err = fmt.Errorf("Error getting order within tx for cancel: %s", err)
+		return
+	}
+	if aoid == nil {
+		err = fmt.Errorf("Order %x is not in the orderbook", cancel.OrderID[:])
+		return
+	}
+	var fills []*match.OrderFill
+	if fills, err = getFills(tx, ao.dialect, ao.archiveSchema, ao.pair, cancel.OrderID); err != nil {
+		err = fmt.Errorf("Error getting fills within tx for cancel: %s", err)
+		return
+	}
+	if err = ao.archiveOrder(tx, aoid, match.CancelStatus(fills), time.Now()); err != nil {
+		err = fmt.Errorf("Error archiving order within tx for cancel: %s", err)
 		return
 	}
 
-	// The order was filled, delete it from the orderbook
-	deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE hashedOrder='%x';", ao.pair.String(), cancel.OrderID)
+	// The order was cancelled, delete it from the orderbook
+	deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE hashedOrder=?;", ao.dialect.tableName(ao.auctionOrderSchema, ao.pair.String()))
 	var res sql.Result
-	if res, err = tx.Exec(deleteOrderQuery); err != nil {
+	if res, err = tx.Exec(ao.dialect.bind(deleteOrderQuery), hexArg(cancel.OrderID)); err != nil {
 		err = fmt.Errorf("Error deleting order within tx for cancel: %s", err)
 		return
 	}
@@ -246,6 +272,54 @@ func (ao *SQLAuctionOrderbook) UpdateBookCancel(cancel *match.CancelledOrder) (e
 	return
 }
 
+// UpdateBookReject archives an order as rejected, taking it out of the orderbook if it's there.
+func (ao *SQLAuctionOrderbook) UpdateBookReject(auctionIDPair *match.AuctionOrderIDPair) (err error) {
+	// Transaction so we're acid
+	var tx *sql.Tx
+	if tx, err = ao.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for UpdateBookReject: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error with UpdateBookReject: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if err = ao.archiveOrder(tx, auctionIDPair, match.OrderRejected, time.Now()); err != nil {
+		err = fmt.Errorf("Error archiving order within tx for UpdateBookReject: %s", err)
+		return
+	}
+
+	deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE hashedOrder=?;", ao.dialect.tableName(ao.auctionOrderSchema, ao.pair.String()))
+	if _, err = tx.Exec(ao.dialect.bind(deleteOrderQuery), hexArg(auctionIDPair.OrderID)); err != nil {
+		err = fmt.Errorf("Error deleting order within tx for UpdateBookReject: %s", err)
+		return
+	}
+	return
+}
+
+// archiveOrder adds an order to the archive with the amounts it was placed with, which are the
+// amounts it has left plus its fills. This does not take it out of the orderbook.
+func (ao *SQLAuctionOrderbook) archiveOrder(tx *sql.Tx, aoid *match.AuctionOrderIDPair, status match.OrderStatus, closedAt time.Time) (err error) {
+	var fills []*match.OrderFill
+	if fills, err = getFills(tx, ao.dialect, ao.archiveSchema, ao.pair, &aoid.OrderID); err != nil {
+		return
+	}
+	filledWant, filledHave := match.FilledAmounts(fills)
+
+	insertArchivedQuery := fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);", ao.dialect.tableName(ao.archiveSchema, ao.pair.String()))
+	if _, err = tx.Exec(ao.dialect.bind(insertArchivedQuery), hexArg(aoid.Order.Pubkey), aoid.Order.Side.String(), aoid.Price, aoid.Order.AmountHave+filledHave, aoid.Order.AmountWant+filledWant, hexArg(aoid.Order.AuctionID), hexArg(aoid.Order.Nonce), hexArg(aoid.Order.Signature), hexArg(aoid.OrderID), string(status), closedAt.UnixNano()); err != nil {
+		err = fmt.Errorf("Error inserting archived order %x: %s", aoid.OrderID[:], err)
+		return
+	}
+	return
+}
+
 // UpdateBookPlace takes in an order, ID, auction ID, and adds the order to the orderbook.
 func (ao *SQLAuctionOrderbook) UpdateBookPlace(auctionIDPair *match.AuctionOrderIDPair) (err error) {
 	// Transaction so we're acid
@@ -264,16 +338,10 @@ func (ao *SQLAuctionOrderbook) UpdateBookPlace(auctionIDPair *match.AuctionOrder
 		err = tx.Commit()
 	}()
 
-	// First use the auction schema
-	if _, err = tx.Exec("USE " + ao.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using auction schema for UpdateBookPlace: %s", err)
-		return
-	}
-
 	logging.Infof("Placing order in orderbook: \n%s", auctionIDPair.Order)
 
-	insertOrderQuery := fmt.Sprintf("INSERT INTO %s VALUES ('%x', '%s', %f, %d, %d, '%x', '%x', '%x', '%x');", ao.pair.String(), auctionIDPair.Order.Pubkey, auctionIDPair.Order.Side, auctionIDPair.Price, auctionIDPair.Order.AmountHave, auctionIDPair.Order.AmountWant, auctionIDPair.Order.AuctionID, auctionIDPair.Order.Nonce, auctionIDPair.Order.Signature, auctionIDPair.OrderID)
-	if _, err = tx.Exec(insertOrderQuery); err != nil {
+	insertOrderQuery := fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);", ao.dialect.tableName(ao.auctionOrderSchema, ao.pair.String()))
+	if _, err = tx.Exec(ao.dialect.bind(insertOrderQuery), hexArg(auctionIDPair.Order.Pubkey), auctionIDPair.Order.Side.String(), auctionIDPair.Price, auctionIDPair.Order.AmountHave, auctionIDPair.Order.AmountWant, hexArg(auctionIDPair.Order.AuctionID), hexArg(auctionIDPair.Order.Nonce), hexArg(auctionIDPair.Order.Signature), hexArg(auctionIDPair.OrderID)); err != nil {
 		err = fmt.Errorf("Error placing order into db for UpdateBookPlace: %s", err)
 		return
 	}
@@ -284,9 +352,6 @@ func (ao *SQLAuctionOrderbook) UpdateBookPlace(auctionIDPair *match.AuctionOrder
 
 // GetOrder gets an order from an OrderID
 func (ao *SQLAuctionOrderbook) GetOrder(orderID *match.OrderID) (aucOrder *match.AuctionOrderIDPair, err error) {
-	aucOrder = new(match.AuctionOrderIDPair)
-	aucOrder.Order = new(match.AuctionOrder)
-
 	// Transaction so we're acid
 	var tx *sql.Tx
 	if tx, err = ao.DBHandler.Begin(); err != nil {
@@ -303,17 +368,27 @@ func (ao *SQLAuctionOrderbook) GetOrder(orderID *match.OrderID) (aucOrder *match
 		err = tx.Commit()
 	}()
 
-	// First use the auction schema
-	if _, err = tx.Exec("USE " + ao.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using auction schema for GetOrder: %s", err)
+	if aucOrder, err = ao.getOrder(tx, orderID); err != nil {
 		return
 	}
+	if aucOrder == nil {
+		err = fmt.Errorf("Order %x does not exist", orderID[:])
+		return
+	}
+	return
+}
+
+// getOrder gets an order from an OrderID within a transaction. If the order is not in the
+// orderbook, the order returned is nil.
+func (ao *SQLAuctionOrderbook) getOrder(tx *sql.Tx, orderID *match.OrderID) (aucOrder *match.AuctionOrderIDPair, err error) {
+	aucOrder = new(match.AuctionOrderIDPair)
+	aucOrder.Order = new(match.AuctionOrder)
 
 	// This is just a modified GetOrdersForPubkey
 	var row *sql.Row
-	selectOrderQuery := fmt.Sprintf("SELECT pubkey, side, price, amountHave, amountWant, auctionID, nonce, sig, hashedOrder FROM %s WHERE hashedOrder='%x';", ao.pair, orderID)
+	selectOrderQuery := fmt.Sprintf("SELECT pubkey, side, price, amountHave, amountWant, auctionID, nonce, sig, hashedOrder FROM %s WHERE hashedOrder=?;", ao.dialect.tableName(ao.auctionOrderSchema, ao.pair.String()))
 	// Remember: errors for this are deferred to scan
-	row = tx.QueryRow(selectOrderQuery)
+	row = tx.QueryRow(ao.dialect.bind(selectOrderQuery), hexArg(orderID))
 
 	// we create these here so we don't take up a ton of memory allocating space for new intermediate arrays
 	var pkBytes []byte
@@ -321,9 +396,14 @@ func (ao *SQLAuctionOrderbook) GetOrder(orderID *match.OrderID) (aucOrder *match
 	var nonceBytes []byte
 	var sigBytes []byte
 	var hashedOrderBytes []byte
+	var sideString string
 
 	// scan the things we can into this order
-	if err = row.Scan(&pkBytes, &aucOrder.Order.Side, &aucOrder.Price, &aucOrder.Order.AmountHave, &aucOrder.Order.AmountWant, &auctionIDBytes, &nonceBytes, &sigBytes, &hashedOrderBytes); err != nil {
+	if err = row.Scan(&pkBytes, &sideString, &aucOrder.Price, &aucOrder.Order.AmountHave, &aucOrder.Order.AmountWant, &auctionIDBytes, &nonceBytes, &sigBytes, &hashedOrderBytes); err == sql.ErrNoRows {
+		aucOrder = nil
+		err = nil
+		return
+	} else if err != nil {
 		err = fmt.Errorf("Error scanning into order for GetOrdersForPubkey: %s", err)
 		return
 	}
@@ -336,6 +416,11 @@ func (ao *SQLAuctionOrderbook) GetOrder(orderID *match.OrderID) (aucOrder *match
 		}
 	}
 
+	if err = aucOrder.Order.Side.FromString(sideString); err != nil {
+		err = fmt.Errorf("Error getting side from string for GetOrder: %s", err)
+		return
+	}
+
 	// we prepared again
 	if err = aucOrder.OrderID.UnmarshalText(hashedOrderBytes); err != nil {
 		err = fmt.Errorf("Error unmarshalling order ID for GetOrdersForPubkey: %s", err)
@@ -345,7 +430,7 @@ func (ao *SQLAuctionOrderbook) GetOrder(orderID *match.OrderID) (aucOrder *match
 	// Copy all of the bytes and values
 	copy(aucOrder.Order.Pubkey[:], pkBytes)
 	copy(aucOrder.Order.AuctionID[:], auctionIDBytes)
-	copy(aucOrder.Order.Signature[:], sigBytes)
+	aucOrder.Order.Signature = sigBytes
 	copy(aucOrder.Order.Nonce[:], nonceBytes)
 	aucOrder.Order.TradingPair = *ao.pair
 
@@ -371,20 +456,15 @@ func (ao *SQLAuctionOrderbook) CalculatePrice(auctionID *match.AuctionID) (price
 		err = tx.Commit()
 	}()
 
-	// First use the auction schema
-	if _, err = tx.Exec("USE " + ao.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using auction schema for CalculatePrice: %s", err)
-		return
-	}
 	sellSide := new(match.Side)
 	buySide := new(match.Side)
 	*sellSide = match.Sell
 	*buySide = match.Buy
 	// First get the max buy price and max sell price
 	var maxSellRow *sql.Row
-	getMaxSellPrice := fmt.Sprintf("SELECT MAX(price) FROM %s WHERE side='%s' AND auctionID='%x';", ao.pair.String(), sellSide.String(), auctionID)
+	getMaxSellPrice := fmt.Sprintf("SELECT MAX(price) FROM %s WHERE side=? AND auctionID=?;", ao.dialect.tableName(ao.auctionOrderSchema, ao.pair.String()))
 	// errors for queryrow are deferred until scan -- this is important, that's why we don't err != nil here
-	maxSellRow = tx.QueryRow(getMaxSellPrice)
+	maxSellRow = tx.QueryRow(ao.dialect.bind(getMaxSellPrice), sellSide.String(), hexArg(auctionID))
 
 	var maxSell float64
 	if err = maxSellRow.Scan(&maxSell); err != nil {
@@ -393,9 +473,9 @@ func (ao *SQLAuctionOrderbook) CalculatePrice(auctionID *match.AuctionID) (price
 	}
 
 	var minBuyRow *sql.Row
-	getminBuyPrice := fmt.Sprintf("SELECT MIN(price) FROM %s WHERE side='%s' AND auctionID='%x';", ao.pair.String(), buySide.String(), auctionID)
+	getminBuyPrice := fmt.Sprintf("SELECT MIN(price) FROM %s WHERE side=? AND auctionID=?;", ao.dialect.tableName(ao.auctionOrderSchema, ao.pair.String()))
 	// errors for queryrow are deferred until scan -- this is important, that's why we don't err != nil here
-	minBuyRow = tx.QueryRow(getminBuyPrice)
+	minBuyRow = tx.QueryRow(ao.dialect.bind(getminBuyPrice), buySide.String(), hexArg(auctionID))
 
 	var minBuy float64
 	if err = minBuyRow.Scan(&minBuy); err != nil {
@@ -428,15 +508,10 @@ func (ao *SQLAuctionOrderbook) GetOrdersForPubkey(pubkey *koblitz.PublicKey) (or
 		err = tx.Commit()
 	}()
 
-	if _, err = tx.Exec("USE " + ao.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using auction schema for GetOrdersForPubkey: %s", err)
-		return
-	}
-
 	// This is just a modified viewauctionorderbook
 	var rows *sql.Rows
-	selectOrderQuery := fmt.Sprintf("SELECT pubkey, side, price, amountHave, amountWant, auctionID, nonce, sig, hashedOrder FROM %s WHERE pubkey='%x';", ao.pair, pubkey.SerializeCompressed())
-	if rows, err = tx.Query(selectOrderQuery); err != nil {
+	selectOrderQuery := fmt.Sprintf("SELECT pubkey, side, price, amountHave, amountWant, auctionID, nonce, sig, hashedOrder FROM %s WHERE pubkey=?;", ao.dialect.tableName(ao.auctionOrderSchema, ao.pair.String()))
+	if rows, err = tx.Query(ao.dialect.bind(selectOrderQuery), hexArg(pubkey.SerializeCompressed())); err != nil {
 		err = fmt.Errorf("Error getting orders from db for GetOrdersForPubkey: %s", err)
 		return
 	}
@@ -452,12 +527,13 @@ func (ao *SQLAuctionOrderbook) GetOrdersForPubkey(pubkey *koblitz.PublicKey) (or
 	var sigBytes []byte
 	var hashedOrderBytes []byte
 	var thisPrice float64
+	var sideString string
 
 	for rows.Next() {
 		// scan the things we can into this order
 		thisOrder = new(match.AuctionOrder)
 		thisOrderPair = new(match.AuctionOrderIDPair)
-		if err = rows.Scan(&pkBytes, &thisOrder.Side, &thisPrice, &thisOrder.AmountHave, &thisOrder.AmountWant, &auctionIDBytes, &nonceBytes, &sigBytes, &hashedOrderBytes); err != nil {
+		if err = rows.Scan(&pkBytes, &sideString, &thisPrice, &thisOrder.AmountHave, &thisOrder.AmountWant, &auctionIDBytes, &nonceBytes, &sigBytes, &hashedOrderBytes); err != nil {
 			err = fmt.Errorf("Error scanning into order for GetOrdersForPubkey: %s", err)
 			return
 		}
@@ -470,6 +546,11 @@ func (ao *SQLAuctionOrderbook) GetOrdersForPubkey(pubkey *koblitz.PublicKey) (or
 			}
 		}
 
+		if err = thisOrder.Side.FromString(sideString); err != nil {
+			err = fmt.Errorf("Error getting side from string for GetOrdersForPubkey: %s", err)
+			return
+		}
+
 		// we prepared again
 		if err = thisOrderPair.OrderID.UnmarshalText(hashedOrderBytes); err != nil {
 			err = fmt.Errorf("Error unmarshalling order ID for GetOrdersForPubkey: %s", err)
@@ -479,7 +560,7 @@ func (ao *SQLAuctionOrderbook) GetOrdersForPubkey(pubkey *koblitz.PublicKey) (or
 		// Copy all of the bytes and values
 		copy(thisOrder.Pubkey[:], pkBytes)
 		copy(thisOrder.AuctionID[:], auctionIDBytes)
-		copy(thisOrder.Signature[:], sigBytes)
+		thisOrder.Signature = sigBytes
 		copy(thisOrder.Nonce[:], nonceBytes)
 		thisOrder.TradingPair = *ao.pair
 		thisOrderPair.Order = thisOrder
@@ -516,13 +597,8 @@ func (ao *SQLAuctionOrderbook) ViewAuctionOrderBook() (book map[float64][]*match
 		err = tx.Commit()
 	}()
 
-	if _, err = tx.Exec("USE " + ao.auctionOrderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using auction schema for viewauctionorderbook: %s", err)
-		return
-	}
-
 	var rows *sql.Rows
-	selectOrderQuery := fmt.Sprintf("SELECT pubkey, side, price, amountHave, amountWant, auctionID, nonce, sig, hashedOrder FROM %s;", ao.pair)
+	selectOrderQuery := fmt.Sprintf("SELECT pubkey, side, price, amountHave, amountWant, auctionID, nonce, sig, hashedOrder FROM %s;", ao.dialect.tableName(ao.auctionOrderSchema, ao.pair.String()))
 	if rows, err = tx.Query(selectOrderQuery); err != nil {
 		err = fmt.Errorf("Error getting orders from db for viewauctionorderbook: %s", err)
 		return
@@ -539,12 +615,13 @@ func (ao *SQLAuctionOrderbook) ViewAuctionOrderBook() (book map[float64][]*match
 	var sigBytes []byte
 	var hashedOrderBytes []byte
 	var thisPrice float64
+	var sideString string
 
 	for rows.Next() {
 		// scan the things we can into this order
 		thisOrder = new(match.AuctionOrder)
 		thisOrderPair = new(match.AuctionOrderIDPair)
-		if err = rows.Scan(&pkBytes, &thisOrder.Side, &thisPrice, &thisOrder.AmountHave, &thisOrder.AmountWant, &auctionIDBytes, &nonceBytes, &sigBytes, &hashedOrderBytes); err != nil {
+		if err = rows.Scan(&pkBytes, &sideString, &thisPrice, &thisOrder.AmountHave, &thisOrder.AmountWant, &auctionIDBytes, &nonceBytes, &sigBytes, &hashedOrderBytes); err != nil {
 			err = fmt.Errorf("Error scanning into order for viewauctionorderbook: %s", err)
 			return
 		}
@@ -557,6 +634,11 @@ func (ao *SQLAuctionOrderbook) ViewAuctionOrderBook() (book map[float64][]*match
 			}
 		}
 
+		if err = thisOrder.Side.FromString(sideString); err != nil {
+			err = fmt.Errorf("Error getting side from string for ViewAuctionOrderBook: %s", err)
+			return
+		}
+
 		// we prepared again
 		if err = thisOrderPair.OrderID.UnmarshalText(hashedOrderBytes); err != nil {
 			err = fmt.Errorf("Error unmarshalling order ID for ViewAuctionOrderBook: %s", err)
@@ -566,7 +648,7 @@ func (ao *SQLAuctionOrderbook) ViewAuctionOrderBook() (book map[float64][]*match
 		// Copy all of the bytes and values
 		copy(thisOrder.Pubkey[:], pkBytes)
 		copy(thisOrder.AuctionID[:], auctionIDBytes)
-		copy(thisOrder.Signature[:], sigBytes)
+		thisOrder.Signature = sigBytes
 		copy(thisOrder.Nonce[:], nonceBytes)
 		thisOrder.TradingPair = *ao.pair
 		thisOrderPair.Order = thisOrder
@@ -582,6 +664,253 @@ func (ao *SQLAuctionOrderbook) ViewAuctionOrderBook() (book map[float64][]*match
 	return
 }
 
+// GetArchivedOrder gets an order that is no longer in the orderbook
+func (ao *SQLAuctionOrderbook) GetArchivedOrder(orderID *match.OrderID) (archived *match.ArchivedAuctionOrder, err error) {
+	// Transaction so we're acid
+	var tx *sql.Tx
+	if tx, err = ao.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for GetArchivedOrder: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error with GetArchivedOrder: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	getArchivedQuery := fmt.Sprintf("SELECT %s FROM %s WHERE hashedOrder=?;", auctionArchiveColumns, ao.dialect.tableName(ao.archiveSchema, ao.pair.String()))
+	if archived, err = ao.scanArchivedOrder(tx.QueryRow(ao.dialect.bind(getArchivedQuery), hexArg(orderID))); err == sql.ErrNoRows {
+		err = fmt.Errorf("Order %x is not in the archive", orderID[:])
+		return
+	} else if err != nil {
+		err = fmt.Errorf("Error scanning archived order for GetArchivedOrder: %s", err)
+		return
+	}
+
+	if archived.Fills, err = getFills(tx, ao.dialect, ao.archiveSchema, ao.pair, orderID); err != nil {
+		err = fmt.Errorf("Error getting fills for GetArchivedOrder: %s", err)
+		return
+	}
+	return
+}
+
+// GetArchivedOrdersForPubkey gets the orders for a pubkey that are no longer in the orderbook, in
+// the order they were closed.
+func (ao *SQLAuctionOrderbook) GetArchivedOrdersForPubkey(pubkey *koblitz.PublicKey) (archived []*match.ArchivedAuctionOrder, err error) {
+	// Transaction so we're acid
+	var tx *sql.Tx
+	if tx, err = ao.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for GetArchivedOrdersForPubkey: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error with GetArchivedOrdersForPubkey: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var rows *sql.Rows
+	getArchivedQuery := fmt.Sprintf("SELECT %s FROM %s WHERE pubkey=? ORDER BY closed;", auctionArchiveColumns, ao.dialect.tableName(ao.archiveSchema, ao.pair.String()))
+	if rows, err = tx.Query(ao.dialect.bind(getArchivedQuery), hexArg(pubkey.SerializeCompressed())); err != nil {
+		err = fmt.Errorf("Error querying archived orders for GetArchivedOrdersForPubkey: %s", err)
+		return
+	}
+
+	for rows.Next() {
+		var arc *match.ArchivedAuctionOrder
+		if arc, err = ao.scanArchivedOrder(rows); err != nil {
+			rows.Close()
+			err = fmt.Errorf("Error scanning archived order for GetArchivedOrdersForPubkey: %s", err)
+			return
+		}
+		archived = append(archived, arc)
+	}
+
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing rows for GetArchivedOrdersForPubkey: %s", err)
+		return
+	}
+
+	// The rows have to be closed before we can query for the fills
+	for _, arc := range archived {
+		if arc.Fills, err = getFills(tx, ao.dialect, ao.archiveSchema, ao.pair, &arc.Order.OrderID); err != nil {
+			err = fmt.Errorf("Error getting fills for GetArchivedOrdersForPubkey: %s", err)
+			return
+		}
+	}
+	return
+}
+
+// ViewArchive gets every order that is no longer in the orderbook, in the order they were closed
+func (ao *SQLAuctionOrderbook) ViewArchive() (archived []*match.ArchivedAuctionOrder, err error) {
+	// Transaction so we're acid
+	var tx *sql.Tx
+	if tx, err = ao.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for ViewArchive: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error with ViewArchive: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var rows *sql.Rows
+	getArchivedQuery := fmt.Sprintf("SELECT %s FROM %s ORDER BY closed;", auctionArchiveColumns, ao.dialect.tableName(ao.archiveSchema, ao.pair.String()))
+	if rows, err = tx.Query(getArchivedQuery); err != nil {
+		err = fmt.Errorf("Error querying archived orders for ViewArchive: %s", err)
+		return
+	}
+
+	for rows.Next() {
+		var arc *match.ArchivedAuctionOrder
+		if arc, err = ao.scanArchivedOrder(rows); err != nil {
+			rows.Close()
+			err = fmt.Errorf("Error scanning archived order for ViewArchive: %s", err)
+			return
+		}
+		archived = append(archived, arc)
+	}
+
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing rows for ViewArchive: %s", err)
+		return
+	}
+
+	// The rows have to be closed before we can query for the fills
+	for _, arc := range archived {
+		if arc.Fills, err = getFills(tx, ao.dialect, ao.archiveSchema, ao.pair, &arc.Order.OrderID); err != nil {
+			err = fmt.Errorf("Error getting fills for ViewArchive: %s", err)
+			return
+		}
+	}
+	return
+}
+
+// RestoreArchivedOrder puts an order into the archive as it was archived, with its fills
+func (ao *SQLAuctionOrderbook) RestoreArchivedOrder(archived *match.ArchivedAuctionOrder) (err error) {
+	// Transaction so we're acid
+	var tx *sql.Tx
+	if tx, err = ao.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for RestoreArchivedOrder: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error with RestoreArchivedOrder: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	aoid := archived.Order
+	for _, fill := range archived.Fills {
+		if err = insertFill(tx, ao.dialect, ao.archiveSchema, ao.pair, &aoid.OrderID, fill); err != nil {
+			err = fmt.Errorf("Error restoring fill for RestoreArchivedOrder: %s", err)
+			return
+		}
+	}
+
+	// The archived amounts are already the ones the order was placed with
+	insertArchivedQuery := fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);", ao.dialect.tableName(ao.archiveSchema, ao.pair.String()))
+	if _, err = tx.Exec(ao.dialect.bind(insertArchivedQuery), hexArg(aoid.Order.Pubkey), aoid.Order.Side.String(), aoid.Price, aoid.Order.AmountHave, aoid.Order.AmountWant, hexArg(aoid.Order.AuctionID), hexArg(aoid.Order.Nonce), hexArg(aoid.Order.Signature), hexArg(aoid.OrderID), string(archived.Status), archived.ClosedAt.UnixNano()); err != nil {
+		err = fmt.Errorf("Error inserting archived order %x for RestoreArchivedOrder: %s", aoid.OrderID[:], err)
+		return
+	}
+	return
+}
+
+// PruneArchive deletes the archived orders that were closed before the cutoff, along with their
+// fills
+func (ao *SQLAuctionOrderbook) PruneArchive(before time.Time) (pruned uint64, err error) {
+	// Transaction so we're acid
+	var tx *sql.Tx
+	if tx, err = ao.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for PruneArchive: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error with PruneArchive: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if pruned, err = pruneArchive(tx, ao.dialect, ao.archiveSchema, ao.pair, "hashedOrder", before); err != nil {
+		err = fmt.Errorf("Error pruning archive for PruneArchive: %s", err)
+		return
+	}
+	return
+}
+
+// auctionArchiveColumns are the columns scanArchivedOrder scans, in order
+const auctionArchiveColumns = "pubkey, side, price, amountHave, amountWant, auctionID, nonce, sig, hashedOrder, status, closed"
+
+// scanArchivedOrder scans a row of auctionArchiveColumns into an archived order, without its
+// fills. Errors from the row, like sql.ErrNoRows, are returned as they are.
+func (ao *SQLAuctionOrderbook) scanArchivedOrder(row interface{ Scan(...interface{}) error }) (archived *match.ArchivedAuctionOrder, err error) {
+	aoid := &match.AuctionOrderIDPair{
+		Order: new(match.AuctionOrder),
+	}
+
+	var pkBytes []byte
+	var auctionIDBytes []byte
+	var nonceBytes []byte
+	var sigBytes []byte
+	var hashedOrderBytes []byte
+	var sideString string
+	var statusString string
+	var closed int64
+	if err = row.Scan(&pkBytes, &sideString, &aoid.Price, &aoid.Order.AmountHave, &aoid.Order.AmountWant, &auctionIDBytes, &nonceBytes, &sigBytes, &hashedOrderBytes, &statusString, &closed); err != nil {
+		return
+	}
+
+	// decode them all weirdly because of the way mysql may store the bytes
+	for _, byteArrayPtr := range []*[]byte{&pkBytes, &auctionIDBytes, &nonceBytes, &sigBytes} {
+		if *byteArrayPtr, err = hex.DecodeString(string(*byteArrayPtr)); err != nil {
+			err = fmt.Errorf("Error decoding bytes for archived order: %s", err)
+			return
+		}
+	}
+	if err = aoid.Order.Side.FromString(sideString); err != nil {
+		err = fmt.Errorf("Error getting side from string for archived order: %s", err)
+		return
+	}
+	if err = aoid.OrderID.UnmarshalText(hashedOrderBytes); err != nil {
+		err = fmt.Errorf("Error unmarshalling order ID for archived order: %s", err)
+		return
+	}
+	copy(aoid.Order.Pubkey[:], pkBytes)
+	copy(aoid.Order.AuctionID[:], auctionIDBytes)
+	copy(aoid.Order.Nonce[:], nonceBytes)
+	aoid.Order.Signature = sigBytes
+	aoid.Order.TradingPair = *ao.pair
+
+	archived = &match.ArchivedAuctionOrder{
+		Order:    aoid,
+		Status:   match.OrderStatus(statusString),
+		ClosedAt: time.Unix(0, closed),
+	}
+	return
+}
+
 // CreateAuctionOrderbookMap creates a map of pair to auction engine, given a list of pairs.
 func CreateAuctionOrderbookMap(pairList []*match.Pair) (aucMap map[match.Pair]match.AuctionOrderbook, err error) {
 
@@ -0,0 +1,165 @@
+package cxdbsql
+
+import (
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/cxdb/cxdbmemory"
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+	"github.com/mit-dci/opencx/cxdb/cxdbtest"
+	"github.com/mit-dci/opencx/match"
+)
+
+// withConformanceContainer creates a tester container for the conformance suite, and runs suite
+// with a func that drops whatever the last scenario left behind, so every scenario starts empty.
+func withConformanceContainer(t *testing.T, suite func(reset func() (err error))) {
+	var err error
+
+	var tc *testerContainer
+	if tc, err = CreateTesterContainer(); err != nil {
+		t.Errorf("Error creating tester container: %s", err)
+		return
+	}
+
+	defer func() {
+		if err = tc.Kill(); err != nil {
+			t.Errorf("Error killing tester container: %s", err)
+			return
+		}
+	}()
+
+	suite(tc.DropDBs)
+	return
+}
+
+func TestLimitEngineConformance(t *testing.T) {
+	withConformanceContainer(t, func(reset func() (err error)) {
+		cxdbtest.RunLimitEngineTests(t, func(pair *match.Pair) (engine match.LimitEngine, err error) {
+			if err = reset(); err != nil {
+				return
+			}
+			engine, err = CreateLimitEngineWithConf(pair, testConfig())
+			return
+		})
+	})
+}
+
+func TestSettlementEngineConformance(t *testing.T) {
+	withConformanceContainer(t, func(reset func() (err error)) {
+		cxdbtest.RunSettlementEngineTests(t, func(coin *coinparam.Params) (engine match.SettlementEngine, err error) {
+			if err = reset(); err != nil {
+				return
+			}
+			engine, err = CreateSettlementEngineStructWithConf(coin, testConfig())
+			return
+		})
+	})
+}
+
+func TestSettlementStoreConformance(t *testing.T) {
+	withConformanceContainer(t, func(reset func() (err error)) {
+		cxdbtest.RunSettlementStoreTests(t, func(coin *coinparam.Params) (store cxdb.SettlementStore, err error) {
+			if err = reset(); err != nil {
+				return
+			}
+			store, err = CreateSettlementStoreWithConf(coin, testConfig())
+			return
+		})
+	})
+}
+
+func TestLedgerStoreConformance(t *testing.T) {
+	withConformanceContainer(t, func(reset func() (err error)) {
+		cxdbtest.RunLedgerStoreTests(t, func(coin *coinparam.Params) (engine match.SettlementEngine, store cxdb.LedgerStore, err error) {
+			if err = reset(); err != nil {
+				return
+			}
+			if engine, err = CreateSettlementEngineStructWithConf(coin, testConfig()); err != nil {
+				return
+			}
+			store, err = CreateLedgerStoreStructWithConf(coin, testConfig())
+			return
+		})
+	})
+}
+
+func TestLimitOrderbookConformance(t *testing.T) {
+	withConformanceContainer(t, func(reset func() (err error)) {
+		cxdbtest.RunLimitOrderbookTests(t, func(pair *match.Pair) (book match.LimitOrderbook, err error) {
+			if err = reset(); err != nil {
+				return
+			}
+			book, err = CreateLimitOrderbookWithConf(pair, testConfig())
+			return
+		})
+	})
+}
+
+func TestAuctionEngineConformance(t *testing.T) {
+	withConformanceContainer(t, func(reset func() (err error)) {
+		cxdbtest.RunAuctionEngineTests(t, func(pair *match.Pair) (engine match.AuctionEngine, err error) {
+			if err = reset(); err != nil {
+				return
+			}
+			engine, err = CreateAuctionEngineWithConf(pair, testConfig())
+			return
+		})
+	})
+}
+
+func TestAuctionOrderbookConformance(t *testing.T) {
+	withConformanceContainer(t, func(reset func() (err error)) {
+		cxdbtest.RunAuctionOrderbookTests(t, func(pair *match.Pair) (book match.AuctionOrderbook, err error) {
+			if err = reset(); err != nil {
+				return
+			}
+			book, err = CreateAuctionOrderbookWithConf(pair, testConfig())
+			return
+		})
+	})
+}
+
+func TestDepositStoreConformance(t *testing.T) {
+	withConformanceContainer(t, func(reset func() (err error)) {
+		cxdbtest.RunDepositStoreTests(t, func(coin *coinparam.Params) (store cxdb.DepositStore, err error) {
+			if err = reset(); err != nil {
+				return
+			}
+			store, err = CreateDepositStoreStructWithConf(coin, testConfig())
+			return
+		})
+	})
+}
+
+func TestPuzzleStoreConformance(t *testing.T) {
+	withConformanceContainer(t, func(reset func() (err error)) {
+		cxdbtest.RunPuzzleStoreTests(t, func(pair *match.Pair) (store cxdb.PuzzleStore, err error) {
+			if err = reset(); err != nil {
+				return
+			}
+			store, err = CreatePuzzleStoreWithConf(pair, testConfig())
+			return
+		})
+	})
+}
+
+func TestSnapshotConformance(t *testing.T) {
+	withConformanceContainer(t, func(reset func() (err error)) {
+		// only one side of each scenario is sql, so resetting when it's created is enough
+		createStores := func(pairList []*match.Pair, coinList []*coinparam.Params) (stores *cxdbsnapshot.Stores, err error) {
+			if err = reset(); err != nil {
+				return
+			}
+			stores, err = CreateSnapshotStoresWithConf(pairList, coinList, testConfig())
+			return
+		}
+
+		t.Run("MemoryToSQL", func(t *testing.T) {
+			cxdbtest.RunSnapshotTests(t, cxdbmemory.CreateSnapshotStores, createStores)
+		})
+		t.Run("SQLToMemory", func(t *testing.T) {
+			cxdbtest.RunSnapshotTests(t, createStores, cxdbmemory.CreateSnapshotStores)
+		})
+	})
+}
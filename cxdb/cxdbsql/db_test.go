@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"net"
+	"os"
 
 	"github.com/mit-dci/lit/coinparam"
 )
@@ -20,15 +21,40 @@ var (
 	testString = "testopencxdb_"
 )
 
+// testDialectEnv is the environment variable that sets which database the tests run against. If
+// it's not set, the tests use SQLite, so they don't need a database server to run.
+const testDialectEnv = "OPENCX_TEST_DBDIALECT"
+
 type testerContainer struct {
 	rootHandler *sql.DB
 }
 
 // CreateTesterContainer creates a struct that contains a SQL *DB, which should be an active SQL database connection that is meant for dropping databases created by the auction engine, creating a test user, and maintains a root connection.
+// For SQLite there are no users, so the connection is to the test database file.
 func CreateTesterContainer() (tc *testerContainer, err error) {
 	tc = new(testerContainer)
+	conf := testConfig()
+
+	if conf.DBDialect != mysqlDialectName {
+		// There's no root user we need for these, the test user just needs to be able to create schemas
+		if err = os.MkdirAll(conf.DBHomeDir, 0700); err != nil {
+			err = fmt.Errorf("Error creating db home dir for testing: %s", err)
+			return
+		}
+		var dialect sqlDialect
+		if dialect, err = newDialect(conf); err != nil {
+			err = fmt.Errorf("Error creating sql dialect for testing: %s", err)
+			return
+		}
+		if tc.rootHandler, err = dialect.open(); err != nil {
+			err = fmt.Errorf("Error opening db for testing: %s", err)
+			return
+		}
+		return
+	}
+
 	var dbAddr net.Addr
-	if dbAddr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(testConfig().DBHost, fmt.Sprintf("%d", testConfig().DBPort))); err != nil {
+	if dbAddr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(conf.DBHost, fmt.Sprintf("%d", conf.DBPort))); err != nil {
 		err = fmt.Errorf("Error resolving conf derived address for killDatabaseFunc: %s", err)
 		return
 	}
@@ -48,7 +74,7 @@ func CreateTesterContainer() (tc *testerContainer, err error) {
 		return
 	}
 
-	if _, err = tc.rootHandler.Exec(fmt.Sprintf("GRANT SELECT, INSERT, UPDATE, CREATE, DROP, DELETE ON *.* TO '%s'@'%s' IDENTIFIED BY '%s';", testConfig().DBUsername, testConfig().DBHost, testConfig().DBPassword)); err != nil {
+	if _, err = tc.rootHandler.Exec(fmt.Sprintf("GRANT SELECT, INSERT, UPDATE, CREATE, DROP, DELETE ON *.* TO '%s'@'%s' IDENTIFIED BY '%s';", conf.DBUsername, conf.DBHost, conf.DBPassword)); err != nil {
 		err = fmt.Errorf("Error creating user for testing: %s", err)
 		return
 	}
@@ -61,12 +87,56 @@ func (tc *testerContainer) DropDBs() (err error) {
 		err = fmt.Errorf("Error, cannot use nil handler, construct container correctly")
 		return
 	}
-	for _, schema := range getSchemasFromConfig(testConfig()) {
-		if schema != "" {
+	conf := testConfig()
+	for _, schema := range getSchemasFromConfig(conf) {
+		if schema == "" {
+			continue
+		}
+		switch conf.DBDialect {
+		case mysqlDialectName:
 			if _, err = tc.rootHandler.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s;", schema)); err != nil {
 				err = fmt.Errorf("Error dropping db for testing: %s", err)
 				return
 			}
+		case postgresDialectName:
+			if _, err = tc.rootHandler.Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE;", schema)); err != nil {
+				err = fmt.Errorf("Error dropping schema for testing: %s", err)
+				return
+			}
+		case sqliteDialectName:
+			if err = tc.dropPrefixedTables(schema); err != nil {
+				err = fmt.Errorf("Error dropping tables for testing: %s", err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// dropPrefixedTables drops every table in the SQLite database for a schema, which are the tables
+// that have the schema as a prefix.
+func (tc *testerContainer) dropPrefixedTables(schema string) (err error) {
+	var rows *sql.Rows
+	if rows, err = tc.rootHandler.Query(fmt.Sprintf("SELECT name FROM sqlite_master WHERE type='table' AND name LIKE '%s\\_%%' ESCAPE '\\';", schema)); err != nil {
+		return
+	}
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			rows.Close()
+			return
+		}
+		tables = append(tables, table)
+	}
+	if err = rows.Close(); err != nil {
+		return
+	}
+
+	for _, table := range tables {
+		if _, err = tc.rootHandler.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s;", table)); err != nil {
+			return
 		}
 	}
 	return
@@ -94,11 +164,15 @@ func (tc *testerContainer) Kill() (err error) {
 }
 
 // KillUser drops the user that should have been created when the testerContainer was created.
+// Only the MySQL tests create a user.
 func (tc *testerContainer) KillUser() (err error) {
 	if tc.rootHandler == nil {
 		err = fmt.Errorf("Error killing user, cannot have nil handler, construct container correctly")
 		return
 	}
+	if testConfig().DBDialect != mysqlDialectName {
+		return
+	}
 	if _, err = tc.rootHandler.Exec(fmt.Sprintf("DROP USER '%s'@'%s';", testingUser, testConfig().DBHost)); err != nil {
 		err = fmt.Errorf("Error dropping user for testing: %s", err)
 		return
@@ -126,21 +200,36 @@ func testConfig() (conf *dbsqlConfig) {
 		// home dir (for test stuff)
 		DBHomeDir: defaultDBHomeDirName + "test/",
 
+		// which database, and where sqlite keeps it
+		DBDialect:  testDialect(),
+		DBFilename: testString + defaultDBFilename,
+
 		// user / pass / net stuff
 		DBUsername: testingUser,
 		DBPassword: testingPass,
 		DBHost:     defaultDBHost,
 		DBPort:     defaultDBPort,
+		DBName:     defaultDBName,
+		DBSSLMode:  defaultDBSSLMode,
 
 		// schemas (test schema names)
 		BalanceSchemaName:        testString + defaultBalanceSchema,
+		LedgerSchemaName:         testString + defaultLedgerSchema,
 		DepositSchemaName:        testString + defaultDepositSchema,
 		PendingDepositSchemaName: testString + defaultPendingDepositSchema,
+		DepositIndexSchemaName:   testString + defaultDepositIndexSchema,
 		PuzzleSchemaName:         testString + defaultPuzzleSchema,
 		AuctionSchemaName:        testString + defaultAuctionSchema,
 		AuctionOrderSchemaName:   testString + defaultAuctionOrderSchema,
 		OrderSchemaName:          testString + defaultOrderSchema,
 		PeerSchemaName:           testString + defaultPeerSchema,
+		OrderArchiveSchemaName:   testString + defaultOrderArchiveSchema,
+		AuctionArchiveSchemaName: testString + defaultAuctionArchiveSchema,
+
+		// read-only schemas (test schema names)
+		ReadOnlyOrderSchemaName:   testString + defaultReadOnlyOrderSchema,
+		ReadOnlyAuctionSchemaName: testString + defaultReadOnlyAuctionSchema,
+		ReadOnlyBalanceSchemaName: testString + defaultReadOnlyBalanceSchema,
 
 		// tables
 		PuzzleTableName:       testString + defaultPuzzleTable,
@@ -150,6 +239,14 @@ func testConfig() (conf *dbsqlConfig) {
 	return
 }
 
+// testDialect is the dialect to run the tests with, which is SQLite unless the environment says otherwise
+func testDialect() (dialect string) {
+	if dialect = os.Getenv(testDialectEnv); dialect == "" {
+		dialect = sqliteDialectName
+	}
+	return
+}
+
 func constCoinParams() (params []*coinparam.Params) {
 	params = []*coinparam.Params{
 		&coinparam.TestNet3Params,
@@ -170,10 +267,14 @@ func getSchemasFromConfig(conf *dbsqlConfig) (schemas []string) {
 		conf.ReadOnlyBalanceSchemaName,
 		conf.ReadOnlyAuctionSchemaName,
 		conf.PendingDepositSchemaName,
+		conf.DepositIndexSchemaName,
 		conf.ReadOnlyOrderSchemaName,
 		conf.DepositSchemaName,
 		conf.BalanceSchemaName,
+		conf.LedgerSchemaName,
 		conf.OrderSchemaName,
 		conf.PeerSchemaName,
+		conf.OrderArchiveSchemaName,
+		conf.AuctionArchiveSchemaName,
 	}
 }
@@ -16,24 +16,34 @@ type dbsqlConfig struct {
 	// database home dir
 	DBHomeDir string `long:"dir" description:"Location of the root directory for the sql db info and config"`
 
+	// which sql database to use
+	DBDialect string `long:"dbdialect" description:"SQL database to use: mysql, postgres, or sqlite"`
+
 	// database info required to establish connection
 	DBUsername string `long:"dbuser" description:"database username"`
 	DBPassword string `long:"dbpassword" description:"database password"`
 	DBHost     string `long:"dbhost" description:"Host for the database connection"`
 	DBPort     uint16 `long:"dbport" description:"Port for the database connection"`
+	DBName     string `long:"dbname" description:"Name of the database to keep the schemas in, for postgres"`
+	DBSSLMode  string `long:"dbsslmode" description:"SSL mode for the database connection, for postgres"`
+	DBFilename string `long:"dbfile" description:"Filename of the database within the db home dir, for sqlite"`
 
 	// database schema names
 	ReadOnlyOrderSchemaName   string `long:"readonlyorderschema" description:"Name of read-only orderbook schema"`
 	ReadOnlyAuctionSchemaName string `long:"readonlyauctionschema" description:"Name of read-only auction schema"`
 	ReadOnlyBalanceSchemaName string `long:"readonlybalanceschema" description:"Name of read-only balance schema"`
 	BalanceSchemaName         string `long:"balanceschema" description:"Name of balance schema"`
+	LedgerSchemaName          string `long:"ledgerschema" description:"Name of balance ledger schema"`
 	DepositSchemaName         string `long:"depositschema" description:"Name of deposit schema"`
 	PendingDepositSchemaName  string `long:"penddepschema" description:"Name of pending deposit schema"`
+	DepositIndexSchemaName    string `long:"depindexschema" description:"Name of deposit address index schema"`
 	PuzzleSchemaName          string `long:"puzzleschema" description:"Name of schema for puzzle orderbooks"`
 	AuctionSchemaName         string `long:"auctionschema" description:"Name of schema for auction ID"`
 	AuctionOrderSchemaName    string `long:"auctionorderschema" description:"Name of schema for auction orderbook"`
 	OrderSchemaName           string `long:"orderschema" description:"Name of schema for limit orderbook"`
 	PeerSchemaName            string `long:"peerschema" description:"Name of schema for peer storage"`
+	OrderArchiveSchemaName    string `long:"orderarchiveschema" description:"Name of schema for filled and cancelled limit orders"`
+	AuctionArchiveSchemaName  string `long:"auctionarchiveschema" description:"Name of schema for filled, cancelled, and rejected auction orders"`
 
 	// database table names
 	PuzzleTableName       string `long:"puzzletable" description:"Name of table for puzzle orderbooks"`
@@ -50,19 +60,27 @@ var (
 	defaultDBHost         = "localhost"
 	defaultDBUser         = "opencx"
 	defaultDBPass         = "testpass"
+	defaultDBDialect      = mysqlDialectName
+	defaultDBName         = "opencx"
+	defaultDBSSLMode      = "disable"
+	defaultDBFilename     = "opencx.sqlite"
 
 	// definitely move this to a config file
 	defaultReadOnlyOrderSchema   = "orders_readonly"
 	defaultReadOnlyAuctionSchema = "auctionorders_readonly"
 	defaultReadOnlyBalanceSchema = "balances_readonly"
 	defaultBalanceSchema         = "balances"
+	defaultLedgerSchema          = "ledger"
 	defaultDepositSchema         = "deposit"
 	defaultPendingDepositSchema  = "pending_deposits"
+	defaultDepositIndexSchema    = "deposit_index"
 	defaultPuzzleSchema          = "puzzle"
 	defaultAuctionSchema         = "auctions"
 	defaultAuctionOrderSchema    = "auctionorder"
 	defaultOrderSchema           = "orders"
 	defaultPeerSchema            = "peers"
+	defaultOrderArchiveSchema    = "orders_archive"
+	defaultAuctionArchiveSchema  = "auctionorders_archive"
 
 	// tables
 	defaultAuctionOrderTable = "auctionorders"
@@ -74,24 +92,34 @@ var (
 		// home dir
 		DBHomeDir: defaultDBHomeDirName,
 
+		// which database
+		DBDialect: defaultDBDialect,
+
 		// user / pass / net stuff
 		DBUsername: defaultDBUser,
 		DBPassword: defaultDBPass,
 		DBHost:     defaultDBHost,
 		DBPort:     defaultDBPort,
+		DBName:     defaultDBName,
+		DBSSLMode:  defaultDBSSLMode,
+		DBFilename: defaultDBFilename,
 
 		// schemas
 		ReadOnlyAuctionSchemaName: defaultReadOnlyAuctionSchema,
 		ReadOnlyOrderSchemaName:   defaultReadOnlyOrderSchema,
 		ReadOnlyBalanceSchemaName: defaultReadOnlyBalanceSchema,
 		BalanceSchemaName:         defaultBalanceSchema,
+		LedgerSchemaName:          defaultLedgerSchema,
 		DepositSchemaName:         defaultDepositSchema,
 		PendingDepositSchemaName:  defaultPendingDepositSchema,
+		DepositIndexSchemaName:    defaultDepositIndexSchema,
 		PuzzleSchemaName:          defaultPuzzleSchema,
 		AuctionSchemaName:         defaultAuctionSchema,
 		AuctionOrderSchemaName:    defaultAuctionOrderSchema,
 		OrderSchemaName:           defaultOrderSchema,
 		PeerSchemaName:            defaultPeerSchema,
+		OrderArchiveSchemaName:    defaultOrderArchiveSchema,
+		AuctionArchiveSchemaName:  defaultAuctionArchiveSchema,
 
 		// tables
 		PuzzleTableName:       defaultPuzzleTable,
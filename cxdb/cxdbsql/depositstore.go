@@ -4,9 +4,7 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
-	"net"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/opencx/cxdb"
@@ -16,12 +14,8 @@ import (
 type SQLDepositStore struct {
 	DBHandler *sql.DB
 
-	// db username and password
-	dbUsername string
-	dbPassword string
-
-	// db host and port
-	dbAddr net.Addr
+	// the sql database we are using
+	dialect sqlDialect
 
 	// deposit addr schema name
 	depositAddrSchemaName string
@@ -29,6 +23,9 @@ type SQLDepositStore struct {
 	// pending deposit schema name
 	pendingDepositSchemaName string
 
+	// deposit address index schema name
+	depositIndexSchemaName string
+
 	// this coin
 	coin *coinparam.Params
 }
@@ -37,6 +34,37 @@ type SQLDepositStore struct {
 const (
 	depositAddrStoreSchema    = "pubkey VARBINARY(66), address VARCHAR(34), CONSTRAINT unique_pubkeys UNIQUE (pubkey, address)"
 	pendingDepositStoreSchema = "pubkey VARBINARY(66), expectedConfirmHeight INT(32) UNSIGNED, depositHeight INT(32) UNSIGNED, amount BIGINT(64), txid TEXT"
+	depositIndexStoreSchema   = "pubkey VARBINARY(66) PRIMARY KEY, idx INT(32) UNSIGNED UNIQUE"
+)
+
+// The schema versions of the deposit store, oldest first
+var (
+	depositAddrStoreMigrations = []migration{
+		baselineMigration(depositAddrStoreSchema),
+		// bech32 addresses are longer than base58 ones
+		modifyColumnMigration(2, "widen addresses for segwit", "address", "VARCHAR(90)"),
+	}
+	pendingDepositStoreMigrations = []migration{
+		baselineMigration(pendingDepositStoreSchema),
+		// deposits from before we kept the block hash can't be rolled back by a reorg, and the
+		// uncredited ones are credited like any other deposit
+		addColumnsMigration(2, "track block hashes", "blockHash VARCHAR(64) DEFAULT ''", "credited BOOLEAN DEFAULT FALSE"),
+		{
+			version:     3,
+			description: "track deposit outputs",
+			queries: func(dialect sqlDialect, schema string, table string) (queries []string) {
+				for _, column := range []string{"vout INT(32) UNSIGNED DEFAULT 0", "address VARCHAR(90) DEFAULT ''", "swept BOOLEAN DEFAULT FALSE"} {
+					queries = append(queries, dialect.addColumnQuery(schema, table, column))
+				}
+				// deposits from before we kept their outputs can't be swept, so they're marked swept
+				queries = append(queries, fmt.Sprintf("UPDATE %s SET swept=TRUE;", dialect.tableName(schema, table)))
+				return
+			},
+		},
+	}
+	depositIndexStoreMigrations = []migration{
+		baselineMigration(depositIndexStoreSchema),
+	}
 )
 
 func CreateDepositStoreStructWithConf(coin *coinparam.Params, conf *dbsqlConfig) (ds *SQLDepositStore, err error) {
@@ -44,22 +72,21 @@ func CreateDepositStoreStructWithConf(coin *coinparam.Params, conf *dbsqlConfig)
 	// set the default conf
 	dbConfigSetup(conf)
 
-	// Resolve new address
-	var addr net.Addr
-	if addr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(conf.DBHost, fmt.Sprintf("%d", conf.DBPort))); err != nil {
-		err = fmt.Errorf("Couldn't resolve db address for CreateDepositStore: %s", err)
+	// Get the dialect for the database we are using
+	var dialect sqlDialect
+	if dialect, err = newDialect(conf); err != nil {
+		err = fmt.Errorf("Couldn't create sql dialect for CreateDepositStore: %s", err)
 		return
 	}
 
 	// Set values for limit engine
 	ds = &SQLDepositStore{
-		dbUsername:               conf.DBUsername,
-		dbPassword:               conf.DBPassword,
+		dialect:                  dialect,
 		depositAddrSchemaName:    conf.DepositSchemaName,
 		pendingDepositSchemaName: conf.PendingDepositSchemaName,
+		depositIndexSchemaName:   conf.DepositIndexSchemaName,
 
-		dbAddr: addr,
-		coin:   coin,
+		coin: coin,
 	}
 
 	if err = ds.setupDepositTables(); err != nil {
@@ -67,19 +94,12 @@ func CreateDepositStoreStructWithConf(coin *coinparam.Params, conf *dbsqlConfig)
 		return
 	}
 
-	// Now connect to the database and create the schemas / tables
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", ds.dbUsername, ds.dbPassword, ds.dbAddr.Network(), ds.dbAddr.String())
-	if ds.DBHandler, err = sql.Open("mysql", openString); err != nil {
+	// Now connect to the database
+	if ds.DBHandler, err = ds.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for CreateDepositStore: %s", err)
 		return
 	}
 
-	// Make sure we can actually connect
-	if err = ds.DBHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running? Did you set the correct username and password in sqldb.conf: %s", err)
-		return
-	}
-
 	return
 }
 
@@ -99,9 +119,8 @@ func CreateDepositStore(coin *coinparam.Params) (store cxdb.DepositStore, err er
 // This assumes everything else is set
 func (ds *SQLDepositStore) setupDepositTables() (err error) {
 
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", ds.dbUsername, ds.dbPassword, ds.dbAddr.Network(), ds.dbAddr.String())
 	var rootHandler *sql.DB
-	if rootHandler, err = sql.Open("mysql", openString); err != nil {
+	if rootHandler, err = ds.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for setup deposit tables: %s", err)
 		return
 	}
@@ -109,11 +128,6 @@ func (ds *SQLDepositStore) setupDepositTables() (err error) {
 	// when we're done close please
 	defer rootHandler.Close()
 
-	if err = rootHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
-		return
-	}
-
 	// We do this in a transaction because it's more than one operation
 	var tx *sql.Tx
 	if tx, err = rootHandler.Begin(); err != nil {
@@ -130,39 +144,21 @@ func (ds *SQLDepositStore) setupDepositTables() (err error) {
 		err = tx.Commit()
 	}()
 
-	// Now create the first schema (keeping track of deposit addresses)
-	if _, err = tx.Exec("CREATE SCHEMA IF NOT EXISTS " + ds.depositAddrSchemaName + ";"); err != nil {
-		err = fmt.Errorf("Error creating schema for setup deposit addr tables: %s", err)
-		return
-	}
-
-	// use the schema
-	if _, err = tx.Exec("USE " + ds.depositAddrSchemaName + ";"); err != nil {
-		err = fmt.Errorf("Could not use %s schema: %s", ds.depositAddrSchemaName, err)
+	// Now create the first table (keeping track of deposit addresses)
+	if err = migrateTable(tx, ds.dialect, ds.depositAddrSchemaName, ds.coin.Name, depositAddrStoreMigrations); err != nil {
+		err = fmt.Errorf("Error migrating deposit addr table: %s", err)
 		return
 	}
 
-	createTableQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", ds.coin.Name, depositAddrStoreSchema)
-	if _, err = tx.Exec(createTableQuery); err != nil {
-		err = fmt.Errorf("Error creating deposit addr table: %s", err)
+	// Now create the other table (keeping track of pending deposits)
+	if err = migrateTable(tx, ds.dialect, ds.pendingDepositSchemaName, ds.coin.Name, pendingDepositStoreMigrations); err != nil {
+		err = fmt.Errorf("Error migrating pending deposit table: %s", err)
 		return
 	}
 
-	// Now create the other schema (keeping track of pending deposits)
-	if _, err = tx.Exec("CREATE SCHEMA IF NOT EXISTS " + ds.pendingDepositSchemaName + ";"); err != nil {
-		err = fmt.Errorf("Error creating schema for setup pending deposit tables: %s", err)
-		return
-	}
-
-	// use the schema
-	if _, err = tx.Exec("USE " + ds.pendingDepositSchemaName + ";"); err != nil {
-		err = fmt.Errorf("Could not use %s schema: %s", ds.pendingDepositSchemaName, err)
-		return
-	}
-
-	createTableQuery = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", ds.coin.Name, pendingDepositStoreSchema)
-	if _, err = tx.Exec(createTableQuery); err != nil {
-		err = fmt.Errorf("Error creating deposit addr table: %s", err)
+	// Now create the last table (keeping track of deposit address indexes)
+	if err = migrateTable(tx, ds.dialect, ds.depositIndexSchemaName, ds.coin.Name, depositIndexStoreMigrations); err != nil {
+		err = fmt.Errorf("Error migrating deposit index table: %s", err)
 		return
 	}
 	return
@@ -209,46 +205,39 @@ func (ds *SQLDepositStore) UpdateDeposits(deposits []match.Deposit, blockheight
 		err = tx.Commit()
 	}()
 
-	// First use the pending deposit schema
-	if _, err = tx.Exec("USE " + ds.pendingDepositSchemaName + ";"); err != nil {
-		err = fmt.Errorf("Error using puzzle schema for UpdateDeposits: %s", err)
-		return
-	}
-
-	// First we insert these deposits
+	// First we insert these deposits, along with the hash of the block they came in so we can roll
+	// them back if that block gets reorged out.
 	for _, deposit := range deposits {
 		txid := []byte(deposit.Txid)
-		expectedConfirm := deposit.BlockHeightReceived + deposit.Confirmations
-		insertDepQuery := fmt.Sprintf("INSERT INTO %s VALUES ('%x', %d, %d, %d, '%x');", ds.coin.Name, deposit.Pubkey.SerializeCompressed(), expectedConfirm, deposit.BlockHeightReceived, deposit.Amount, txid)
-		if _, err = tx.Exec(insertDepQuery); err != nil {
+		expectedConfirm := deposit.CreditHeight()
+		insertDepQuery := fmt.Sprintf("INSERT INTO %s (pubkey, expectedConfirmHeight, depositHeight, amount, txid, vout, address, blockHash) VALUES (?, ?, ?, ?, ?, ?, ?, ?);", ds.dialect.tableName(ds.pendingDepositSchemaName, ds.coin.Name))
+		if _, err = tx.Exec(ds.dialect.bind(insertDepQuery), hexArg(deposit.Pubkey.SerializeCompressed()), expectedConfirm, deposit.BlockHeightReceived, deposit.Amount, hexArg(txid), deposit.Vout, deposit.Address, deposit.BlockHash); err != nil {
 			err = fmt.Errorf("Error inserting deposit for UpdateDeposits: %s", err)
 			return
 		}
 	}
 
-	// There is an issue with the way we do this, if a reorg were to happen, users would be credited
-	// twice because there would be two blocks worth of deposits for some expected confirm heights.
-	// This is why we use non custodial / lightning anyways, if my channel fund was confirmed 15 days ago
-	// I really don't think it will be reorged. So for all intents and purposes this method of taking
-	// money from people should be considered legacy.
-
-	// Now we select the ones where expectedConfirm EQUALS the current height.
+	// Now we select the ones that have reached their expected confirm height but have not been credited
+	// yet. We keep credited deposits around so we can reverse them if there is a reorg deeper than the
+	// number of confirmations.
 	var rows *sql.Rows
-	selectConfirmedQuery := fmt.Sprintf("SELECT pubkey, amount FROM %s WHERE expectedConfirmHeight=%d;", ds.coin.Name, blockheight)
-	if rows, err = tx.Query(selectConfirmedQuery); err != nil {
+	selectConfirmedQuery := fmt.Sprintf("SELECT pubkey, amount, txid FROM %s WHERE expectedConfirmHeight<=? AND credited=FALSE;", ds.dialect.tableName(ds.pendingDepositSchemaName, ds.coin.Name))
+	if rows, err = tx.Query(ds.dialect.bind(selectConfirmedQuery), blockheight); err != nil {
 		err = fmt.Errorf("Error running select confirmed query for UpdateDeposits: %s", err)
 		return
 	}
 
 	var currSettlement *match.SettlementExecution
 	var pubkeyBytes []byte
+	var txidBytes []byte
 	for rows.Next() {
 		// A confirmed deposit is a debit for the deposit store's asset
 		currSettlement = &match.SettlementExecution{
-			Asset: depositAsset,
-			Type:  match.Debit,
+			Asset:  depositAsset,
+			Type:   match.Debit,
+			Reason: match.ReasonDeposit,
 		}
-		if err = rows.Scan(&pubkeyBytes, &currSettlement.Amount); err != nil {
+		if err = rows.Scan(&pubkeyBytes, &currSettlement.Amount, &txidBytes); err != nil {
 			err = fmt.Errorf("Error scanning for confirmed deposit: %s", err)
 			return
 		}
@@ -258,6 +247,12 @@ func (ds *SQLDepositStore) UpdateDeposits(deposits []match.Deposit, blockheight
 			err = fmt.Errorf("Error decoding pubkey bytes string for UpdateDeposits: %s", err)
 			return
 		}
+		// the txid is stored as the hex of the txid string
+		if txidBytes, err = hex.DecodeString(string(txidBytes)); err != nil {
+			err = fmt.Errorf("Error decoding txid bytes string for UpdateDeposits: %s", err)
+			return
+		}
+		currSettlement.Reference = string(txidBytes)
 		copy(currSettlement.Pubkey[:], pubkeyBytes)
 		// Now that the settlement is filled in, let's add it
 		depositExecs = append(depositExecs, currSettlement)
@@ -267,6 +262,308 @@ func (ds *SQLDepositStore) UpdateDeposits(deposits []match.Deposit, blockheight
 		return
 	}
 
+	// Mark them as credited so they are never credited twice
+	markCreditedQuery := fmt.Sprintf("UPDATE %s SET credited=TRUE WHERE expectedConfirmHeight<=? AND credited=FALSE;", ds.dialect.tableName(ds.pendingDepositSchemaName, ds.coin.Name))
+	if _, err = tx.Exec(ds.dialect.bind(markCreditedQuery), blockheight); err != nil {
+		err = fmt.Errorf("Error marking deposits credited for UpdateDeposits: %s", err)
+		return
+	}
+
+	return
+}
+
+// RollbackDeposits removes the pending deposits that were received in the orphaned blocks. Deposits
+// that were already credited are returned as credit executions that reverse them.
+func (ds *SQLDepositStore) RollbackDeposits(orphanedBlockHashes []string) (reorgExecs []*match.SettlementExecution, err error) {
+
+	if len(orphanedBlockHashes) == 0 {
+		return
+	}
+
+	// first get the asset we'll be reversing
+	var depositAsset match.Asset
+	if depositAsset, err = match.AssetFromCoinParam(ds.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param for RollbackDeposits: %s", err)
+		return
+	}
+
+	// ACID
+	var tx *sql.Tx
+	if tx, err = ds.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for RollbackDeposits: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error for RollbackDeposits: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var hashArgs []interface{}
+	for _, hash := range orphanedBlockHashes {
+		hashArgs = append(hashArgs, hash)
+	}
+
+	// Anything that was already credited needs to be reversed
+	var rows *sql.Rows
+	selectCreditedQuery := fmt.Sprintf("SELECT pubkey, amount, txid FROM %s WHERE credited=TRUE AND blockHash IN (%s);", ds.dialect.tableName(ds.pendingDepositSchemaName, ds.coin.Name), placeholderList(len(hashArgs)))
+	if rows, err = tx.Query(ds.dialect.bind(selectCreditedQuery), hashArgs...); err != nil {
+		err = fmt.Errorf("Error running select credited query for RollbackDeposits: %s", err)
+		return
+	}
+
+	var currSettlement *match.SettlementExecution
+	var pubkeyBytes []byte
+	var txidBytes []byte
+	for rows.Next() {
+		// A reorged deposit that was credited is a credit for the deposit store's asset
+		currSettlement = &match.SettlementExecution{
+			Asset:  depositAsset,
+			Type:   match.Credit,
+			Reason: match.ReasonDepositReorg,
+		}
+		if err = rows.Scan(&pubkeyBytes, &currSettlement.Amount, &txidBytes); err != nil {
+			err = fmt.Errorf("Error scanning for credited deposit: %s", err)
+			return
+		}
+
+		if pubkeyBytes, err = hex.DecodeString(string(pubkeyBytes)); err != nil {
+			err = fmt.Errorf("Error decoding pubkey bytes string for RollbackDeposits: %s", err)
+			return
+		}
+		if txidBytes, err = hex.DecodeString(string(txidBytes)); err != nil {
+			err = fmt.Errorf("Error decoding txid bytes string for RollbackDeposits: %s", err)
+			return
+		}
+		currSettlement.Reference = string(txidBytes)
+		copy(currSettlement.Pubkey[:], pubkeyBytes)
+		reorgExecs = append(reorgExecs, currSettlement)
+	}
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing rows for RollbackDeposits: %s", err)
+		return
+	}
+
+	// Now delete all deposits from the orphaned blocks, credited or not
+	deleteOrphanedQuery := fmt.Sprintf("DELETE FROM %s WHERE blockHash IN (%s);", ds.dialect.tableName(ds.pendingDepositSchemaName, ds.coin.Name), placeholderList(len(hashArgs)))
+	if _, err = tx.Exec(ds.dialect.bind(deleteOrphanedQuery), hashArgs...); err != nil {
+		err = fmt.Errorf("Error deleting orphaned deposits for RollbackDeposits: %s", err)
+		return
+	}
+
+	return
+}
+
+// GetPendingDeposits gets the deposits for a pubkey that have been received but not yet credited
+func (ds *SQLDepositStore) GetPendingDeposits(pubkey *koblitz.PublicKey) (pending []*match.Deposit, err error) {
+	if pending, err = ds.getDepositsForPubkey(pubkey, false); err != nil {
+		err = fmt.Errorf("Error getting pending deposits for GetPendingDeposits: %s", err)
+		return
+	}
+	return
+}
+
+// GetDepositHistory gets the deposits for a pubkey that have been credited
+func (ds *SQLDepositStore) GetDepositHistory(pubkey *koblitz.PublicKey) (history []*match.Deposit, err error) {
+	if history, err = ds.getDepositsForPubkey(pubkey, true); err != nil {
+		err = fmt.Errorf("Error getting credited deposits for GetDepositHistory: %s", err)
+		return
+	}
+	return
+}
+
+// getDepositsForPubkey gets either the credited or uncredited deposits for a pubkey, in the order
+// they were received
+func (ds *SQLDepositStore) getDepositsForPubkey(pubkey *koblitz.PublicKey, credited bool) (deposits []*match.Deposit, err error) {
+	// ACID
+	var tx *sql.Tx
+	if tx, err = ds.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for getDepositsForPubkey: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error for getDepositsForPubkey: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var rows *sql.Rows
+	selectDepositsQuery := fmt.Sprintf("SELECT expectedConfirmHeight, depositHeight, amount, txid, vout, address, blockHash FROM %s WHERE pubkey=? AND credited=? ORDER BY depositHeight;", ds.dialect.tableName(ds.pendingDepositSchemaName, ds.coin.Name))
+	if rows, err = tx.Query(ds.dialect.bind(selectDepositsQuery), hexArg(pubkey.SerializeCompressed()), credited); err != nil {
+		err = fmt.Errorf("Error querying deposits for getDepositsForPubkey: %s", err)
+		return
+	}
+
+	var expectedConfirm uint64
+	var txidBytes []byte
+	var currDeposit *match.Deposit
+	for rows.Next() {
+		currDeposit = &match.Deposit{
+			Pubkey:   pubkey,
+			CoinType: ds.coin,
+		}
+		if err = rows.Scan(&expectedConfirm, &currDeposit.BlockHeightReceived, &currDeposit.Amount, &txidBytes, &currDeposit.Vout, &currDeposit.Address, &currDeposit.BlockHash); err != nil {
+			err = fmt.Errorf("Error scanning deposit for getDepositsForPubkey: %s", err)
+			return
+		}
+
+		// the txid is stored as the hex of the txid string
+		if txidBytes, err = hex.DecodeString(string(txidBytes)); err != nil {
+			err = fmt.Errorf("Error decoding txid for getDepositsForPubkey: %s", err)
+			return
+		}
+		currDeposit.Txid = string(txidBytes)
+		// expectedConfirmHeight is what the deposit gets credited at, so it's the CreditHeight
+		currDeposit.Confirmations = expectedConfirm - currDeposit.BlockHeightReceived
+		deposits = append(deposits, currDeposit)
+	}
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing rows for getDepositsForPubkey: %s", err)
+		return
+	}
+	return
+}
+
+// GetDepositIndex gets the index used to derive deposit addresses for a pubkey, assigning the next
+// unused index if the pubkey does not have one yet.
+func (ds *SQLDepositStore) GetDepositIndex(pubkey *koblitz.PublicKey) (index uint32, err error) {
+	// ACID
+	var tx *sql.Tx
+	if tx, err = ds.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for GetDepositIndex: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error for GetDepositIndex: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	selectIndexQuery := fmt.Sprintf("SELECT idx FROM %s WHERE pubkey=?;", ds.dialect.tableName(ds.depositIndexSchemaName, ds.coin.Name))
+	if err = tx.QueryRow(ds.dialect.bind(selectIndexQuery), hexArg(pubkey.SerializeCompressed())).Scan(&index); err == nil {
+		return
+	} else if err != sql.ErrNoRows {
+		err = fmt.Errorf("Error scanning for deposit index for GetDepositIndex: %s", err)
+		return
+	}
+
+	// The pubkey doesn't have an index, so give it the next one
+	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s;", ds.dialect.tableName(ds.depositIndexSchemaName, ds.coin.Name))
+	if err = tx.QueryRow(countQuery).Scan(&index); err != nil {
+		err = fmt.Errorf("Error counting deposit indexes for GetDepositIndex: %s", err)
+		return
+	}
+
+	insertIndexQuery := fmt.Sprintf("INSERT INTO %s VALUES (?, ?);", ds.dialect.tableName(ds.depositIndexSchemaName, ds.coin.Name))
+	if _, err = tx.Exec(ds.dialect.bind(insertIndexQuery), hexArg(pubkey.SerializeCompressed()), index); err != nil {
+		err = fmt.Errorf("Error inserting deposit index for GetDepositIndex: %s", err)
+		return
+	}
+	return
+}
+
+// GetSweepableDeposits gets all credited deposits whose outputs have not been swept yet
+func (ds *SQLDepositStore) GetSweepableDeposits() (deposits []*match.Deposit, err error) {
+	// ACID
+	var tx *sql.Tx
+	if tx, err = ds.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for GetSweepableDeposits: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error for GetSweepableDeposits: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var rows *sql.Rows
+	selectSweepableQuery := fmt.Sprintf("SELECT pubkey, expectedConfirmHeight, depositHeight, amount, txid, vout, address, blockHash FROM %s WHERE credited=TRUE AND swept=FALSE ORDER BY depositHeight;", ds.dialect.tableName(ds.pendingDepositSchemaName, ds.coin.Name))
+	if rows, err = tx.Query(selectSweepableQuery); err != nil {
+		err = fmt.Errorf("Error querying sweepable deposits for GetSweepableDeposits: %s", err)
+		return
+	}
+
+	var expectedConfirm uint64
+	var pubkeyBytes []byte
+	var txidBytes []byte
+	var currDeposit *match.Deposit
+	for rows.Next() {
+		currDeposit = &match.Deposit{
+			CoinType: ds.coin,
+		}
+		if err = rows.Scan(&pubkeyBytes, &expectedConfirm, &currDeposit.BlockHeightReceived, &currDeposit.Amount, &txidBytes, &currDeposit.Vout, &currDeposit.Address, &currDeposit.BlockHash); err != nil {
+			err = fmt.Errorf("Error scanning deposit for GetSweepableDeposits: %s", err)
+			return
+		}
+
+		if pubkeyBytes, err = hex.DecodeString(string(pubkeyBytes)); err != nil {
+			err = fmt.Errorf("Error decoding pubkey for GetSweepableDeposits: %s", err)
+			return
+		}
+
+		if currDeposit.Pubkey, err = koblitz.ParsePubKey(pubkeyBytes, koblitz.S256()); err != nil {
+			err = fmt.Errorf("Error parsing pubkey for GetSweepableDeposits: %s", err)
+			return
+		}
+
+		// the txid is stored as the hex of the txid string
+		if txidBytes, err = hex.DecodeString(string(txidBytes)); err != nil {
+			err = fmt.Errorf("Error decoding txid for GetSweepableDeposits: %s", err)
+			return
+		}
+		currDeposit.Txid = string(txidBytes)
+		// expectedConfirmHeight is what the deposit gets credited at, so it's the CreditHeight
+		currDeposit.Confirmations = expectedConfirm - currDeposit.BlockHeightReceived
+		deposits = append(deposits, currDeposit)
+	}
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing rows for GetSweepableDeposits: %s", err)
+		return
+	}
+	return
+}
+
+// MarkDepositsSwept marks the outputs of the given deposits as swept
+func (ds *SQLDepositStore) MarkDepositsSwept(deposits []*match.Deposit) (err error) {
+	// ACID
+	var tx *sql.Tx
+	if tx, err = ds.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for MarkDepositsSwept: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error for MarkDepositsSwept: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	for _, deposit := range deposits {
+		markSweptQuery := fmt.Sprintf("UPDATE %s SET swept=TRUE WHERE txid=? AND vout=?;", ds.dialect.tableName(ds.pendingDepositSchemaName, ds.coin.Name))
+		if _, err = tx.Exec(ds.dialect.bind(markSweptQuery), hexArg([]byte(deposit.Txid)), deposit.Vout); err != nil {
+			err = fmt.Errorf("Error marking deposit swept for MarkDepositsSwept: %s", err)
+			return
+		}
+	}
 	return
 }
 
@@ -289,14 +586,8 @@ func (ds *SQLDepositStore) GetDepositAddressMap() (depAddrMap map[string]*koblit
 		err = tx.Commit()
 	}()
 
-	// First use the deposit address schema
-	if _, err = tx.Exec("USE " + ds.depositAddrSchemaName + ";"); err != nil {
-		err = fmt.Errorf("Error using puzzle schema for GetDepositAddressMap: %s", err)
-		return
-	}
-
 	var rows *sql.Rows
-	selectAddrQuery := fmt.Sprintf("SELECT pubkey, address FROM %s;", ds.coin.Name)
+	selectAddrQuery := fmt.Sprintf("SELECT pubkey, address FROM %s;", ds.dialect.tableName(ds.depositAddrSchemaName, ds.coin.Name))
 	// errors deferred to scan
 	if rows, err = tx.Query(selectAddrQuery); err != nil {
 		err = fmt.Errorf("Error querying for pubkey address map for GetDepositAddressMap: %s", err)
@@ -347,16 +638,10 @@ func (ds *SQLDepositStore) GetDepositAddress(pubkey *koblitz.PublicKey) (addr st
 		err = tx.Commit()
 	}()
 
-	// First use the deposit address schema
-	if _, err = tx.Exec("USE " + ds.depositAddrSchemaName + ";"); err != nil {
-		err = fmt.Errorf("Error using puzzle schema for GetDepositAddress: %s", err)
-		return
-	}
-
 	var row *sql.Row
-	selectAddrQuery := fmt.Sprintf("SELECT address FROM %s WHERE pubkey='%s';", ds.coin.Name, pubkey.SerializeCompressed())
+	selectAddrQuery := fmt.Sprintf("SELECT address FROM %s WHERE pubkey=?;", ds.dialect.tableName(ds.depositAddrSchemaName, ds.coin.Name))
 	// errors deferred to scan
-	row = tx.QueryRow(selectAddrQuery)
+	row = tx.QueryRow(ds.dialect.bind(selectAddrQuery), hexArg(pubkey.SerializeCompressed()))
 
 	if err = row.Scan(&addr); err != nil {
 		err = fmt.Errorf("Error scanning for address for GetDepositAddress: %s", err)
@@ -385,14 +670,8 @@ func (ds *SQLDepositStore) RegisterUser(pubkey *koblitz.PublicKey, address strin
 		err = tx.Commit()
 	}()
 
-	// First use the deposit address schema
-	if _, err = tx.Exec("USE " + ds.depositAddrSchemaName + ";"); err != nil {
-		err = fmt.Errorf("Error using puzzle schema for RegisterUser: %s", err)
-		return
-	}
-
-	insertUserQuery := fmt.Sprintf("INSERT INTO %s VALUES ('%x', '%s');", ds.coin.Name, pubkey.SerializeCompressed(), address)
-	if _, err = tx.Exec(insertUserQuery); err != nil {
+	insertUserQuery := fmt.Sprintf("INSERT INTO %s VALUES (?, ?);", ds.dialect.tableName(ds.depositAddrSchemaName, ds.coin.Name))
+	if _, err = tx.Exec(ds.dialect.bind(insertUserQuery), hexArg(pubkey.SerializeCompressed()), address); err != nil {
 		err = fmt.Errorf("Error adding user and address for RegisterUser: %s", err)
 		return
 	}
@@ -2,6 +2,10 @@ package cxdbsql
 
 import (
 	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/match"
 )
 
 func TestCreateDepositStoreAllParams(t *testing.T) {
@@ -31,3 +35,205 @@ func TestCreateDepositStoreAllParams(t *testing.T) {
 	}
 
 }
+
+func TestDepositStoreReorg(t *testing.T) {
+	var err error
+
+	var tc *testerContainer
+	if tc, err = CreateTesterContainer(); err != nil {
+		t.Errorf("Error creating tester container: %s", err)
+		return
+	}
+
+	defer func() {
+		if err = tc.Kill(); err != nil {
+			t.Errorf("Error killing tester container: %s", err)
+			return
+		}
+	}()
+
+	var ds *SQLDepositStore
+	if ds, err = CreateDepositStoreStructWithConf(&coinparam.RegressionNetParams, testConfig()); err != nil {
+		t.Errorf("Error creating deposit store for TestDepositStoreReorg: %s", err)
+		return
+	}
+
+	defer func() {
+		if err = ds.DestroyHandler(); err != nil {
+			t.Errorf("Error destroying handler for deposit store: %s", err)
+			return
+		}
+	}()
+
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key for TestDepositStoreReorg: %s", err)
+		return
+	}
+
+	deposit := match.Deposit{
+		Pubkey:              privkey.PubKey(),
+		Amount:              uint64(100000000),
+		Txid:                "testtxid",
+		CoinType:            &coinparam.RegressionNetParams,
+		BlockHeightReceived: 100,
+		BlockHash:           "orphan",
+		Confirmations:       6,
+	}
+
+	if _, err = ds.UpdateDeposits([]match.Deposit{deposit}, 100); err != nil {
+		t.Errorf("Error updating deposits for TestDepositStoreReorg: %s", err)
+		return
+	}
+
+	var execs []*match.SettlementExecution
+	if execs, err = ds.UpdateDeposits([]match.Deposit{}, 106); err != nil {
+		t.Errorf("Error updating deposits for TestDepositStoreReorg: %s", err)
+		return
+	}
+	if len(execs) != 1 {
+		t.Errorf("Expected deposit to be credited at confirm height, got %d execs", len(execs))
+		return
+	}
+
+	// The same height again should not credit again
+	if execs, err = ds.UpdateDeposits([]match.Deposit{}, 106); err != nil {
+		t.Errorf("Error updating deposits for TestDepositStoreReorg: %s", err)
+		return
+	}
+	if len(execs) != 0 {
+		t.Errorf("Deposit should not be credited twice, got %d execs", len(execs))
+		return
+	}
+
+	var reorgExecs []*match.SettlementExecution
+	if reorgExecs, err = ds.RollbackDeposits([]string{"orphan"}); err != nil {
+		t.Errorf("Error rolling back deposits for TestDepositStoreReorg: %s", err)
+		return
+	}
+	if len(reorgExecs) != 1 || reorgExecs[0].Type != match.Credit || reorgExecs[0].Amount != deposit.Amount {
+		t.Errorf("Expected one credit reversing the deposit, got %d execs", len(reorgExecs))
+		return
+	}
+
+	return
+}
+
+func TestDepositStoreConfirmations(t *testing.T) {
+	var err error
+
+	var tc *testerContainer
+	if tc, err = CreateTesterContainer(); err != nil {
+		t.Errorf("Error creating tester container: %s", err)
+		return
+	}
+
+	defer func() {
+		if err = tc.Kill(); err != nil {
+			t.Errorf("Error killing tester container: %s", err)
+			return
+		}
+	}()
+
+	var ds *SQLDepositStore
+	if ds, err = CreateDepositStoreStructWithConf(&coinparam.RegressionNetParams, testConfig()); err != nil {
+		t.Errorf("Error creating deposit store for TestDepositStoreConfirmations: %s", err)
+		return
+	}
+
+	defer func() {
+		if err = ds.DestroyHandler(); err != nil {
+			t.Errorf("Error destroying handler for deposit store: %s", err)
+			return
+		}
+	}()
+
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key for TestDepositStoreConfirmations: %s", err)
+		return
+	}
+
+	deposit := match.Deposit{
+		Pubkey:              privkey.PubKey(),
+		Amount:              uint64(100000000),
+		Txid:                "testtxid",
+		CoinType:            &coinparam.RegressionNetParams,
+		BlockHeightReceived: 100,
+		BlockHash:           "block",
+		Confirmations:       6,
+	}
+
+	// one block before the credit height the deposit is pending, one confirmation short
+	var execs []*match.SettlementExecution
+	if execs, err = ds.UpdateDeposits([]match.Deposit{deposit}, deposit.CreditHeight()-1); err != nil {
+		t.Errorf("Error updating deposits for TestDepositStoreConfirmations: %s", err)
+		return
+	}
+	if len(execs) != 0 {
+		t.Errorf("Deposit should not be credited before its credit height, got %d execs", len(execs))
+		return
+	}
+
+	var pending []*match.Deposit
+	if pending, err = ds.GetPendingDeposits(deposit.Pubkey); err != nil {
+		t.Errorf("Error getting pending deposits for TestDepositStoreConfirmations: %s", err)
+		return
+	}
+	if len(pending) != 1 {
+		t.Errorf("Expected 1 pending deposit, got %d", len(pending))
+		return
+	}
+	if pending[0].Confirmations != deposit.Confirmations || pending[0].CreditHeight() != deposit.CreditHeight() {
+		t.Errorf("Pending deposit should need %d confirmations to be credited at %d, got %d and %d", deposit.Confirmations, deposit.CreditHeight(), pending[0].Confirmations, pending[0].CreditHeight())
+		return
+	}
+	if pending[0].ConfirmationsAt(deposit.CreditHeight()-1) != deposit.Confirmations-1 {
+		t.Errorf("Pending deposit should be one confirmation short, got %d of %d", pending[0].ConfirmationsAt(deposit.CreditHeight()-1), deposit.Confirmations)
+		return
+	}
+
+	var history []*match.Deposit
+	if history, err = ds.GetDepositHistory(deposit.Pubkey); err != nil {
+		t.Errorf("Error getting deposit history for TestDepositStoreConfirmations: %s", err)
+		return
+	}
+	if len(history) != 0 {
+		t.Errorf("Expected no credited deposits before the credit height, got %d", len(history))
+		return
+	}
+
+	// at the credit height it has all of its confirmations and gets credited
+	if execs, err = ds.UpdateDeposits([]match.Deposit{}, deposit.CreditHeight()); err != nil {
+		t.Errorf("Error updating deposits for TestDepositStoreConfirmations: %s", err)
+		return
+	}
+	if len(execs) != 1 {
+		t.Errorf("Deposit should be credited at its credit height, got %d execs", len(execs))
+		return
+	}
+
+	if pending, err = ds.GetPendingDeposits(deposit.Pubkey); err != nil {
+		t.Errorf("Error getting pending deposits for TestDepositStoreConfirmations: %s", err)
+		return
+	}
+	if len(pending) != 0 {
+		t.Errorf("Expected no pending deposits after crediting, got %d", len(pending))
+		return
+	}
+
+	if history, err = ds.GetDepositHistory(deposit.Pubkey); err != nil {
+		t.Errorf("Error getting deposit history for TestDepositStoreConfirmations: %s", err)
+		return
+	}
+	if len(history) != 1 {
+		t.Errorf("Expected 1 credited deposit, got %d", len(history))
+		return
+	}
+	if history[0].Confirmations != deposit.Confirmations || history[0].ConfirmationsAt(deposit.CreditHeight()) != history[0].Confirmations {
+		t.Errorf("Credited deposit should have %d confirmations at its credit height, got %d of %d", deposit.Confirmations, history[0].ConfirmationsAt(deposit.CreditHeight()), history[0].Confirmations)
+		return
+	}
+
+	return
+}
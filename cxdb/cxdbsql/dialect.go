@@ -0,0 +1,312 @@
+package cxdbsql
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The names of the dialects that can be set in the config
+const (
+	mysqlDialectName    = "mysql"
+	postgresDialectName = "postgres"
+	sqliteDialectName   = "sqlite"
+)
+
+// sqlDialect is everything cxdbsql does differently depending on which SQL database it stores
+// things in. The table schemas are written for MySQL, and each dialect turns them into what its
+// database understands.
+type sqlDialect interface {
+	// open opens a connection to the database and makes sure we can actually reach it
+	open() (handler *sql.DB, err error)
+	// tableName is the name to use in queries for a table in one of the store schemas
+	tableName(schema string, table string) (name string)
+	// createTableQueries are the queries that create a table in a store schema if it does not
+	// exist, given the columns for the table in MySQL
+	createTableQueries(schema string, table string, columns string) (queries []string)
+	// addColumnQuery is the query that adds a column to a table, given the column in MySQL
+	addColumnQuery(schema string, table string, column string) (query string)
+	// modifyColumnQueries are the queries that change the type of a column, given the type in
+	// MySQL
+	modifyColumnQueries(schema string, table string, column string, columnType string) (queries []string)
+	// renameTableQuery is the query that renames a table in a store schema
+	renameTableQuery(schema string, from string, to string) (query string)
+	// onConflictUpdate is the clause that makes an insert set the assignments instead, if there
+	// is already a row with the same key columns
+	onConflictUpdate(keyColumns string, assignments string) (clause string)
+	// forUpdate is the clause that locks the selected rows until the transaction is done. Some
+	// databases can't lock the rows an aggregate reads, so those queries need to say so.
+	forUpdate(aggregate bool) (clause string)
+	// bind turns the ? placeholders in a query into the placeholders the database uses
+	bind(query string) (bound string)
+	// resetSequenceQueries are the queries that make the next ID an auto increment column gives
+	// out come after the largest one in the table, after rows were inserted with their IDs
+	resetSequenceQueries(schema string, table string, column string) (queries []string)
+}
+
+// newDialect creates the dialect set in the config, connecting with the user, host, and files
+// set in the config.
+func newDialect(conf *dbsqlConfig) (dialect sqlDialect, err error) {
+	switch conf.DBDialect {
+	case mysqlDialectName:
+		var addr net.Addr
+		if addr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(conf.DBHost, fmt.Sprintf("%d", conf.DBPort))); err != nil {
+			err = fmt.Errorf("Couldn't resolve db address for newDialect: %s", err)
+			return
+		}
+		dialect = &mysqlDialect{
+			openString: fmt.Sprintf("%s:%s@%s(%s)/", conf.DBUsername, conf.DBPassword, addr.Network(), addr.String()),
+		}
+	case postgresDialectName:
+		dialect = &postgresDialect{
+			openString: fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s", conf.DBHost, conf.DBPort, conf.DBUsername, conf.DBPassword, conf.DBName, conf.DBSSLMode),
+		}
+	case sqliteDialectName:
+		// Every handler for the file waits for the others instead of failing, and takes the write
+		// lock when a transaction starts so two transactions can't both read then try to write.
+		dialect = &sqliteDialect{
+			openString: fmt.Sprintf("file:%s?_busy_timeout=10000&_txlock=immediate&_journal_mode=WAL", filepath.Join(conf.DBHomeDir, conf.DBFilename)),
+		}
+	default:
+		err = fmt.Errorf("Unknown sql dialect %s, use %s, %s, or %s", conf.DBDialect, mysqlDialectName, postgresDialectName, sqliteDialectName)
+		return
+	}
+	return
+}
+
+// openAndPing opens a connection with the driver and makes sure we can actually reach the database
+func openAndPing(driverName string, openString string) (handler *sql.DB, err error) {
+	if handler, err = sql.Open(driverName, openString); err != nil {
+		err = fmt.Errorf("Error opening database: %s", err)
+		return
+	}
+
+	if err = handler.Ping(); err != nil {
+		handler.Close()
+		handler = nil
+		err = fmt.Errorf("Could not ping the database, is it running? Did you set the username and password in sqldb.conf: %s", err)
+		return
+	}
+	return
+}
+
+// indexClause matches the index definitions in the MySQL table schemas, which other databases
+// want as separate statements.
+var indexClause = regexp.MustCompile(`,\s*INDEX\s*\((\w+)\)`)
+
+// splitIndexes takes the index definitions out of the MySQL columns, and returns the columns
+// that are left along with the column each index was on.
+func splitIndexes(columns string) (tableColumns string, indexColumns []string) {
+	for _, match := range indexClause.FindAllStringSubmatch(columns, -1) {
+		indexColumns = append(indexColumns, match[1])
+	}
+	tableColumns = indexClause.ReplaceAllString(columns, "")
+	return
+}
+
+// portableColumnTypes turns the MySQL column types in the table schemas into ones that both
+// PostgreSQL and SQLite understand. Binary columns already hold hex, and times are kept as text
+// in sqlTimeFormat, so every driver gives them back the same way MySQL does.
+var portableColumnTypes = []string{
+	"DOUBLE(30, 2) UNSIGNED", "DOUBLE PRECISION",
+	"DOUBLE(30,2) UNSIGNED", "DOUBLE PRECISION",
+	"DOUBLE(32,16) UNSIGNED", "DOUBLE PRECISION",
+	"INT(32) UNSIGNED", "BIGINT",
+	"INT UNSIGNED", "BIGINT",
+	"BIGINT(64)", "BIGINT",
+	"VARBINARY", "VARCHAR",
+	"BLOB", "TEXT",
+	"TIMESTAMP", "VARCHAR(19)",
+}
+
+// mysqlDialect keeps each store schema as its own database, which is what MySQL calls a schema
+type mysqlDialect struct {
+	openString string
+}
+
+func (d *mysqlDialect) open() (handler *sql.DB, err error) {
+	return openAndPing(mysqlDialectName, d.openString)
+}
+
+func (d *mysqlDialect) tableName(schema string, table string) (name string) {
+	return schema + "." + table
+}
+
+func (d *mysqlDialect) createTableQueries(schema string, table string, columns string) (queries []string) {
+	return []string{
+		fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s;", schema),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", d.tableName(schema, table), columns),
+	}
+}
+
+func (d *mysqlDialect) addColumnQuery(schema string, table string, column string) (query string) {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s;", d.tableName(schema, table), column)
+}
+
+func (d *mysqlDialect) modifyColumnQueries(schema string, table string, column string, columnType string) (queries []string) {
+	return []string{fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s;", d.tableName(schema, table), column, columnType)}
+}
+
+func (d *mysqlDialect) renameTableQuery(schema string, from string, to string) (query string) {
+	return fmt.Sprintf("RENAME TABLE %s TO %s;", d.tableName(schema, from), d.tableName(schema, to))
+}
+
+func (d *mysqlDialect) onConflictUpdate(keyColumns string, assignments string) (clause string) {
+	return "ON DUPLICATE KEY UPDATE " + assignments
+}
+
+func (d *mysqlDialect) forUpdate(aggregate bool) (clause string) {
+	return " FOR UPDATE"
+}
+
+func (d *mysqlDialect) bind(query string) (bound string) {
+	return query
+}
+
+// MySQL moves the auto increment past any ID that is inserted
+func (d *mysqlDialect) resetSequenceQueries(schema string, table string, column string) (queries []string) {
+	return
+}
+
+// postgresDialect keeps each store schema as a schema in one database
+type postgresDialect struct {
+	openString string
+}
+
+// postgresColumnTypes are the replacements for MySQL column types in PostgreSQL
+var postgresColumnTypes = strings.NewReplacer(append([]string{
+	"BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY", "BIGSERIAL PRIMARY KEY",
+}, portableColumnTypes...)...)
+
+func (d *postgresDialect) open() (handler *sql.DB, err error) {
+	return openAndPing(postgresDialectName, d.openString)
+}
+
+func (d *postgresDialect) tableName(schema string, table string) (name string) {
+	return schema + "." + table
+}
+
+func (d *postgresDialect) createTableQueries(schema string, table string, columns string) (queries []string) {
+	tableColumns, indexColumns := splitIndexes(columns)
+	queries = []string{
+		fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s;", schema),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", d.tableName(schema, table), postgresColumnTypes.Replace(tableColumns)),
+	}
+	// indexes are always in the same schema as their table, so they can't have a schema in their name
+	for _, column := range indexColumns {
+		queries = append(queries, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s ON %s (%[2]s);", table, column, d.tableName(schema, table)))
+	}
+	return
+}
+
+func (d *postgresDialect) addColumnQuery(schema string, table string, column string) (query string) {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s;", d.tableName(schema, table), postgresColumnTypes.Replace(column))
+}
+
+func (d *postgresDialect) modifyColumnQueries(schema string, table string, column string, columnType string) (queries []string) {
+	return []string{fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s;", d.tableName(schema, table), column, postgresColumnTypes.Replace(columnType))}
+}
+
+// the new name can't have a schema, the table stays in the one it's in
+func (d *postgresDialect) renameTableQuery(schema string, from string, to string) (query string) {
+	return fmt.Sprintf("ALTER TABLE %s RENAME TO %s;", d.tableName(schema, from), to)
+}
+
+func (d *postgresDialect) onConflictUpdate(keyColumns string, assignments string) (clause string) {
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", keyColumns, assignments)
+}
+
+func (d *postgresDialect) forUpdate(aggregate bool) (clause string) {
+	if aggregate {
+		return
+	}
+	return " FOR UPDATE"
+}
+
+// PostgreSQL only moves a serial column's sequence when it gives out an ID, so it has to be set to
+// the largest ID, or left so the next one is 1 if the table is empty
+func (d *postgresDialect) resetSequenceQueries(schema string, table string, column string) (queries []string) {
+	return []string{fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', '%s'), COALESCE(MAX(%[2]s), 1), MAX(%[2]s) IS NOT NULL) FROM %[1]s;", d.tableName(schema, table), column)}
+}
+
+// PostgreSQL numbers its placeholders, so the nth ? becomes $n
+func (d *postgresDialect) bind(query string) (bound string) {
+	var builder strings.Builder
+	var n int
+	for _, char := range query {
+		if char != '?' {
+			builder.WriteRune(char)
+			continue
+		}
+		n++
+		fmt.Fprintf(&builder, "$%d", n)
+	}
+	return builder.String()
+}
+
+// sqliteDialect keeps everything in one file, so the store schemas become prefixes on table names
+type sqliteDialect struct {
+	openString string
+}
+
+// sqliteColumnTypes are the replacements for MySQL column types in SQLite
+var sqliteColumnTypes = strings.NewReplacer(append([]string{
+	"BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY", "INTEGER PRIMARY KEY AUTOINCREMENT",
+}, portableColumnTypes...)...)
+
+func (d *sqliteDialect) open() (handler *sql.DB, err error) {
+	return openAndPing("sqlite3", d.openString)
+}
+
+func (d *sqliteDialect) tableName(schema string, table string) (name string) {
+	return schema + "_" + table
+}
+
+func (d *sqliteDialect) createTableQueries(schema string, table string, columns string) (queries []string) {
+	tableColumns, indexColumns := splitIndexes(columns)
+	queries = []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", d.tableName(schema, table), sqliteColumnTypes.Replace(tableColumns)),
+	}
+	for _, column := range indexColumns {
+		queries = append(queries, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s ON %[1]s (%[2]s);", d.tableName(schema, table), column))
+	}
+	return
+}
+
+func (d *sqliteDialect) addColumnQuery(schema string, table string, column string) (query string) {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s;", d.tableName(schema, table), sqliteColumnTypes.Replace(column))
+}
+
+// SQLite doesn't check the length or type of what goes in a column, so there's nothing to change
+func (d *sqliteDialect) modifyColumnQueries(schema string, table string, column string, columnType string) (queries []string) {
+	return
+}
+
+func (d *sqliteDialect) renameTableQuery(schema string, from string, to string) (query string) {
+	return fmt.Sprintf("ALTER TABLE %s RENAME TO %s;", d.tableName(schema, from), d.tableName(schema, to))
+}
+
+func (d *sqliteDialect) onConflictUpdate(keyColumns string, assignments string) (clause string) {
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", keyColumns, assignments)
+}
+
+// SQLite locks the whole file for a transaction when it starts, so there are no rows to lock
+func (d *sqliteDialect) forUpdate(aggregate bool) (clause string) {
+	return
+}
+
+func (d *sqliteDialect) bind(query string) (bound string) {
+	return query
+}
+
+// SQLite moves the autoincrement past any ID that is inserted
+func (d *sqliteDialect) resetSequenceQueries(schema string, table string, column string) (queries []string) {
+	return
+}
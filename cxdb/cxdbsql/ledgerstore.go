@@ -0,0 +1,546 @@
+package cxdbsql
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// The SQLLedgerStore reads the ledger that the SQLSettlementEngine writes to, and compares it to the
+// balances the settlement engine keeps.
+type SQLLedgerStore struct {
+	DBHandler *sql.DB
+
+	// the sql database we are using
+	dialect sqlDialect
+
+	// ledger schema name
+	ledgerSchema string
+
+	// balance schema name, this is the settlement engine's schema
+	balanceSchema string
+
+	// this coin
+	coin *coinparam.Params
+}
+
+// ledgerTotalAccount is the account a mismatch is reported for if the whole ledger doesn't sum to
+// zero
+const ledgerTotalAccount = "total"
+
+// CreateLedgerStore creates a ledger store for a specific coin.
+func CreateLedgerStore(coin *coinparam.Params) (store cxdb.LedgerStore, err error) {
+
+	conf := new(dbsqlConfig)
+	*conf = *defaultConf
+
+	if store, err = CreateLedgerStoreStructWithConf(coin, conf); err != nil {
+		err = fmt.Errorf("Error creating ledger store struct for CreateLedgerStore: %s", err)
+		return
+	}
+	return
+}
+
+// CreateLedgerStoreStructWithConf creates a ledger store for a specific coin, but instead of
+// returning an interface, it returns a struct.
+func CreateLedgerStoreStructWithConf(coin *coinparam.Params, conf *dbsqlConfig) (ls *SQLLedgerStore, err error) {
+
+	// Set the default conf
+	dbConfigSetup(conf)
+
+	// Get the dialect for the database we are using
+	var dialect sqlDialect
+	if dialect, err = newDialect(conf); err != nil {
+		err = fmt.Errorf("Couldn't create sql dialect for CreateLedgerStore: %s", err)
+		return
+	}
+
+	// Set values
+	ls = &SQLLedgerStore{
+		dialect:       dialect,
+		ledgerSchema:  conf.LedgerSchemaName,
+		balanceSchema: conf.BalanceSchemaName,
+		coin:          coin,
+	}
+
+	if err = ls.setupLedgerStoreTables(); err != nil {
+		err = fmt.Errorf("Error setting up ledger store tables while creating store: %s", err)
+		return
+	}
+
+	// Now connect to the database
+	if ls.DBHandler, err = ls.dialect.open(); err != nil {
+		err = fmt.Errorf("Error opening database for CreateLedgerStore: %s", err)
+		return
+	}
+
+	return
+}
+
+// setupLedgerStoreTables sets up the ledger and balance tables if the settlement engine hasn't
+// already. This assumes the schema names are set
+func (ls *SQLLedgerStore) setupLedgerStoreTables() (err error) {
+
+	var rootHandler *sql.DB
+	if rootHandler, err = ls.dialect.open(); err != nil {
+		err = fmt.Errorf("Error opening database for setup ledger store tables: %s", err)
+		return
+	}
+
+	// when we're done close please
+	defer rootHandler.Close()
+
+	// We do this in a transaction because it's more than one operation
+	var tx *sql.Tx
+	if tx, err = rootHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for setup ledger store tables: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error while creating ledger store tables: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	tables := []struct {
+		schemaName string
+		migrations []migration
+	}{
+		{ls.ledgerSchema, ledgerMigrations},
+		{ls.balanceSchema, settlementEngineMigrations},
+	}
+	for _, table := range tables {
+		if err = migrateTable(tx, ls.dialect, table.schemaName, ls.coin.Name, table.migrations); err != nil {
+			err = fmt.Errorf("Error migrating ledger store table: %s", err)
+			return
+		}
+	}
+	return
+}
+
+// GetAccountStatement gets the ledger entries for a pubkey from the from time up to (but not
+// including) the to time, along with the opening and closing balance.
+func (ls *SQLLedgerStore) GetAccountStatement(pubkey *koblitz.PublicKey, from time.Time, to time.Time) (statement *match.AccountStatement, err error) {
+	if to.Before(from) {
+		err = fmt.Errorf("Statement end %s is before the start %s", to, from)
+		return
+	}
+
+	var statementAsset match.Asset
+	if statementAsset, err = match.AssetFromCoinParam(ls.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param for GetAccountStatement: %s", err)
+		return
+	}
+
+	// Then create transaction
+	var tx *sql.Tx
+	if tx, err = ls.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error beginning transaction while getting account statement: \n%s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error while getting account statement: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	account := fmt.Sprintf("%x", pubkey.SerializeCompressed())
+	var openingBalance int64
+	openingQuery := fmt.Sprintf("SELECT COALESCE(SUM(amount), 0) FROM %s WHERE account=? AND time<?;", ls.dialect.tableName(ls.ledgerSchema, ls.coin.Name))
+	if err = tx.QueryRow(ls.dialect.bind(openingQuery), account, from.UnixNano()).Scan(&openingBalance); err != nil {
+		err = fmt.Errorf("Error scanning opening balance for GetAccountStatement: %s", err)
+		return
+	}
+
+	var rows *sql.Rows
+	entriesQuery := fmt.Sprintf("SELECT entryid, time, amount, reason, reference FROM %s WHERE account=? AND time>=? AND time<? ORDER BY entryid;", ls.dialect.tableName(ls.ledgerSchema, ls.coin.Name))
+	if rows, err = tx.Query(ls.dialect.bind(entriesQuery), account, from.UnixNano(), to.UnixNano()); err != nil {
+		err = fmt.Errorf("Error querying for entries for GetAccountStatement: %s", err)
+		return
+	}
+
+	statement = &match.AccountStatement{
+		Asset:          statementAsset,
+		From:           from,
+		To:             to,
+		OpeningBalance: uint64(openingBalance),
+	}
+	copy(statement.Pubkey[:], pubkey.SerializeCompressed())
+
+	closingBalance := openingBalance
+	var entryTime int64
+	var signedAmount int64
+	var reason string
+	for rows.Next() {
+		currEntry := &match.LedgerEntry{
+			Account: account,
+			Asset:   statementAsset,
+		}
+		if err = rows.Scan(&currEntry.ID, &entryTime, &signedAmount, &reason, &currEntry.Reference); err != nil {
+			err = fmt.Errorf("Error scanning entry for GetAccountStatement: %s", err)
+			return
+		}
+		currEntry.Time = time.Unix(0, entryTime)
+		currEntry.Reason = match.LedgerReason(reason)
+		if signedAmount < 0 {
+			currEntry.Type = match.Credit
+			currEntry.Amount = uint64(-signedAmount)
+		} else {
+			currEntry.Type = match.Debit
+			currEntry.Amount = uint64(signedAmount)
+		}
+		closingBalance += signedAmount
+		statement.Entries = append(statement.Entries, currEntry)
+	}
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing entry rows for GetAccountStatement: %s", err)
+		return
+	}
+
+	statement.ClosingBalance = uint64(closingBalance)
+	return
+}
+
+// CheckConsistency recomputes every user's balance from the ledger and compares it to the balance
+// in the settlement engine. It also makes sure the whole ledger sums to zero.
+func (ls *SQLLedgerStore) CheckConsistency() (mismatches []*match.LedgerMismatch, err error) {
+
+	var ledgerAsset match.Asset
+	if ledgerAsset, err = match.AssetFromCoinParam(ls.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param for CheckConsistency: %s", err)
+		return
+	}
+
+	// Then create transaction
+	var tx *sql.Tx
+	if tx, err = ls.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error beginning transaction while checking ledger consistency: \n%s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error while checking ledger consistency: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var ledgerTotal int64
+	totalQuery := fmt.Sprintf("SELECT COALESCE(SUM(amount), 0) FROM %s;", ls.dialect.tableName(ls.ledgerSchema, ls.coin.Name))
+	if err = tx.QueryRow(totalQuery).Scan(&ledgerTotal); err != nil {
+		err = fmt.Errorf("Error scanning ledger total for CheckConsistency: %s", err)
+		return
+	}
+	if ledgerTotal != 0 {
+		mismatches = append(mismatches, &match.LedgerMismatch{
+			Account:       ledgerTotalAccount,
+			Asset:         ledgerAsset,
+			LedgerBalance: ledgerTotal,
+		})
+	}
+
+	// The exchange accounts don't have a balance anywhere else, so we only compare users
+	ledgerBalances := make(map[string]int64)
+	var rows *sql.Rows
+	ledgerBalQuery := fmt.Sprintf("SELECT account, SUM(amount) FROM %s WHERE account NOT LIKE ? GROUP BY account;", ls.dialect.tableName(ls.ledgerSchema, ls.coin.Name))
+	if rows, err = tx.Query(ls.dialect.bind(ledgerBalQuery), match.ExchangeAccountPrefix+"%"); err != nil {
+		err = fmt.Errorf("Error querying ledger balances for CheckConsistency: %s", err)
+		return
+	}
+
+	var account string
+	var amount int64
+	for rows.Next() {
+		if err = rows.Scan(&account, &amount); err != nil {
+			err = fmt.Errorf("Error scanning ledger balance for CheckConsistency: %s", err)
+			return
+		}
+		ledgerBalances[account] = amount
+	}
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing ledger balance rows for CheckConsistency: %s", err)
+		return
+	}
+
+	balQuery := fmt.Sprintf("SELECT pubkey, subaccount, balance FROM %s;", ls.dialect.tableName(ls.balanceSchema, ls.coin.Name))
+	if rows, err = tx.Query(balQuery); err != nil {
+		err = fmt.Errorf("Error querying balances for CheckConsistency: %s", err)
+		return
+	}
+
+	var pubkeyBytes []byte
+	var subAccount uint32
+	for rows.Next() {
+		if err = rows.Scan(&pubkeyBytes, &subAccount, &amount); err != nil {
+			err = fmt.Errorf("Error scanning balance for CheckConsistency: %s", err)
+			return
+		}
+		// the pubkey is stored as a hex string, which is also how the ledger account starts
+		account = string(pubkeyBytes)
+		if subAccount != 0 {
+			account = fmt.Sprintf("%s/%d", account, subAccount)
+		}
+		if ledgerBalances[account] != amount {
+			mismatches = append(mismatches, &match.LedgerMismatch{
+				Account:       account,
+				Asset:         ledgerAsset,
+				Balance:       amount,
+				LedgerBalance: ledgerBalances[account],
+			})
+		}
+		delete(ledgerBalances, account)
+	}
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing balance rows for CheckConsistency: %s", err)
+		return
+	}
+
+	// anything left has entries in the ledger but no balance at all
+	for account, amount = range ledgerBalances {
+		if amount != 0 {
+			mismatches = append(mismatches, &match.LedgerMismatch{
+				Account:       account,
+				Asset:         ledgerAsset,
+				LedgerBalance: amount,
+			})
+		}
+	}
+
+	return
+}
+
+// CreateLedgerStoreMap creates a map of coin to ledger store, given a list of coins.
+func CreateLedgerStoreMap(coins []*coinparam.Params) (ledgerMap map[*coinparam.Params]cxdb.LedgerStore, err error) {
+
+	ledgerMap = make(map[*coinparam.Params]cxdb.LedgerStore)
+	var curLedgerStore cxdb.LedgerStore
+	for _, coin := range coins {
+		if curLedgerStore, err = CreateLedgerStore(coin); err != nil {
+			err = fmt.Errorf("Error creating single ledger store while creating ledger store map: %s", err)
+			return
+		}
+		ledgerMap[coin] = curLedgerStore
+	}
+
+	return
+}
+
+// GetFeeBalance gets the total of the fees the exchange has collected, which is the balance of the
+// exchange's fee account in the ledger.
+func (ls *SQLLedgerStore) GetFeeBalance() (fees uint64, err error) {
+
+	// Then create transaction
+	var tx *sql.Tx
+	if tx, err = ls.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error beginning transaction while getting fee balance: \n%s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error while getting fee balance: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var feeBalance int64
+	feeQuery := fmt.Sprintf("SELECT COALESCE(SUM(amount), 0) FROM %s WHERE account=?;", ls.dialect.tableName(ls.ledgerSchema, ls.coin.Name))
+	if err = tx.QueryRow(ls.dialect.bind(feeQuery), match.ReasonFee.CounterAccount()).Scan(&feeBalance); err != nil {
+		err = fmt.Errorf("Error scanning fee balance for GetFeeBalance: %s", err)
+		return
+	}
+
+	// fees are taken from users, so the exchange side of those entries is positive
+	if feeBalance > 0 {
+		fees = uint64(feeBalance)
+	}
+	return
+}
+
+// GetTransferNonces gets the nonce of the last transfer from each pubkey, from the ledger entries
+// for the senders of transfers
+func (ls *SQLLedgerStore) GetTransferNonces() (nonces map[[33]byte]uint64, err error) {
+
+	// Then create transaction
+	var tx *sql.Tx
+	if tx, err = ls.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error beginning transaction while getting transfer nonces: \n%s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error while getting transfer nonces: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	// the sender's side of a transfer is the credit to a user's account, which is negative
+	var rows *sql.Rows
+	transferQuery := fmt.Sprintf("SELECT account, reference FROM %s WHERE reason=? AND amount<0;", ls.dialect.tableName(ls.ledgerSchema, ls.coin.Name))
+	if rows, err = tx.Query(ls.dialect.bind(transferQuery), string(match.ReasonTransfer)); err != nil {
+		err = fmt.Errorf("Error querying transfers for GetTransferNonces: %s", err)
+		return
+	}
+	defer rows.Close()
+
+	nonces = make(map[[33]byte]uint64)
+	var accountString, reference string
+	var account match.Account
+	for rows.Next() {
+		if err = rows.Scan(&accountString, &reference); err != nil {
+			err = fmt.Errorf("Error scanning transfer for GetTransferNonces: %s", err)
+			return
+		}
+		nonce, ok := match.TransferNonceFromReference(reference)
+		if !ok {
+			continue
+		}
+		if account, err = match.ParseAccount(accountString); err != nil {
+			err = fmt.Errorf("Error parsing transfer sender for GetTransferNonces: %s", err)
+			return
+		}
+		if nonce > nonces[account.Pubkey] {
+			nonces[account.Pubkey] = nonce
+		}
+	}
+	if err = rows.Err(); err != nil {
+		err = fmt.Errorf("Error reading transfers for GetTransferNonces: %s", err)
+		return
+	}
+	return
+}
+
+// GetLedger gets every entry in the ledger, in the order they were written
+func (ls *SQLLedgerStore) GetLedger() (entries []*match.LedgerEntry, err error) {
+
+	var ledgerAsset match.Asset
+	if ledgerAsset, err = match.AssetFromCoinParam(ls.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param for GetLedger: %s", err)
+		return
+	}
+
+	// Then create transaction
+	var tx *sql.Tx
+	if tx, err = ls.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error beginning transaction while getting ledger: \n%s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error while getting ledger: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var rows *sql.Rows
+	entriesQuery := fmt.Sprintf("SELECT entryid, time, account, amount, reason, reference FROM %s ORDER BY entryid;", ls.dialect.tableName(ls.ledgerSchema, ls.coin.Name))
+	if rows, err = tx.Query(entriesQuery); err != nil {
+		err = fmt.Errorf("Error querying for entries for GetLedger: %s", err)
+		return
+	}
+
+	var entryTime int64
+	var signedAmount int64
+	var reason string
+	for rows.Next() {
+		currEntry := &match.LedgerEntry{
+			Asset: ledgerAsset,
+		}
+		if err = rows.Scan(&currEntry.ID, &entryTime, &currEntry.Account, &signedAmount, &reason, &currEntry.Reference); err != nil {
+			rows.Close()
+			err = fmt.Errorf("Error scanning entry for GetLedger: %s", err)
+			return
+		}
+		currEntry.Time = time.Unix(0, entryTime)
+		currEntry.Reason = match.LedgerReason(reason)
+		if signedAmount < 0 {
+			currEntry.Type = match.Credit
+			currEntry.Amount = uint64(-signedAmount)
+		} else {
+			currEntry.Type = match.Debit
+			currEntry.Amount = uint64(signedAmount)
+		}
+		entries = append(entries, currEntry)
+	}
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing entry rows for GetLedger: %s", err)
+		return
+	}
+	return
+}
+
+// ReplaceLedger replaces every entry in the ledger with the entries given, keeping their IDs. The
+// next entry written gets an ID after the last one given.
+func (ls *SQLLedgerStore) ReplaceLedger(entries []*match.LedgerEntry) (err error) {
+
+	// Then create transaction
+	var tx *sql.Tx
+	if tx, err = ls.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error beginning transaction while replacing ledger: \n%s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error while replacing ledger: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	deleteEntriesQuery := fmt.Sprintf("DELETE FROM %s;", ls.dialect.tableName(ls.ledgerSchema, ls.coin.Name))
+	if _, err = tx.Exec(deleteEntriesQuery); err != nil {
+		err = fmt.Errorf("Error deleting entries for ReplaceLedger: %s", err)
+		return
+	}
+
+	insertEntryQuery := fmt.Sprintf("INSERT INTO %s (entryid, time, account, amount, reason, reference) VALUES (?, ?, ?, ?, ?, ?);", ls.dialect.tableName(ls.ledgerSchema, ls.coin.Name))
+	var lastID uint64
+	for _, entry := range entries {
+		if entry.ID <= lastID {
+			err = fmt.Errorf("Ledger entry %d is not after entry %d", entry.ID, lastID)
+			return
+		}
+		lastID = entry.ID
+		signedAmount := int64(entry.Amount)
+		if entry.Type == match.Credit {
+			signedAmount = -signedAmount
+		}
+		if _, err = tx.Exec(ls.dialect.bind(insertEntryQuery), entry.ID, entry.Time.UnixNano(), entry.Account, signedAmount, string(entry.Reason), entry.Reference); err != nil {
+			err = fmt.Errorf("Error inserting entry %d for ReplaceLedger: %s", entry.ID, err)
+			return
+		}
+	}
+
+	for _, query := range ls.dialect.resetSequenceQueries(ls.ledgerSchema, ls.coin.Name, "entryid") {
+		if _, err = tx.Exec(query); err != nil {
+			err = fmt.Errorf("Error resetting entry IDs for ReplaceLedger: %s", err)
+			return
+		}
+	}
+	return
+}
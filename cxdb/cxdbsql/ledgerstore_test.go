@@ -0,0 +1,279 @@
+package cxdbsql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/match"
+)
+
+func TestLedgerStatementAndConsistency(t *testing.T) {
+	var err error
+
+	var tc *testerContainer
+	if tc, err = CreateTesterContainer(); err != nil {
+		t.Errorf("Error creating tester container: %s", err)
+		return
+	}
+
+	defer func() {
+		if err = tc.Kill(); err != nil {
+			t.Errorf("Error killing tester container: %s", err)
+			return
+		}
+	}()
+
+	coin := &coinparam.RegressionNetParams
+	var se *SQLSettlementEngine
+	if se, err = CreateSettlementEngineStructWithConf(coin, testConfig()); err != nil {
+		t.Errorf("Error creating settlement engine for TestLedgerStatementAndConsistency: %s", err)
+		return
+	}
+
+	var ls *SQLLedgerStore
+	if ls, err = CreateLedgerStoreStructWithConf(coin, testConfig()); err != nil {
+		t.Errorf("Error creating ledger store for TestLedgerStatementAndConsistency: %s", err)
+		return
+	}
+
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key for TestLedgerStatementAndConsistency: %s", err)
+		return
+	}
+
+	var asset match.Asset
+	if asset, err = match.AssetFromCoinParam(coin); err != nil {
+		t.Errorf("Error getting asset for TestLedgerStatementAndConsistency: %s", err)
+		return
+	}
+
+	execs := []*match.SettlementExecution{
+		{Asset: asset, Amount: 100000, Type: match.Debit, Reason: match.ReasonDeposit, Reference: "testtxid"},
+		{Asset: asset, Amount: 30000, Type: match.Credit, Reason: match.ReasonOrder, Reference: "buy regtest/regtest"},
+		{Asset: asset, Amount: 10000, Type: match.Debit, Reason: match.ReasonCancelRefund, Reference: "testorderid"},
+		{Asset: asset, Amount: 500, Type: match.Credit, Reason: match.ReasonFee, Reference: "testorderid"},
+	}
+
+	start := time.Now()
+	for _, exec := range execs {
+		copy(exec.Pubkey[:], privkey.PubKey().SerializeCompressed())
+		if _, err = se.ApplySettlementExecution(exec); err != nil {
+			t.Errorf("Error applying settlement exec for TestLedgerStatementAndConsistency: %s", err)
+			return
+		}
+	}
+
+	var statement *match.AccountStatement
+	if statement, err = ls.GetAccountStatement(privkey.PubKey(), start, time.Now()); err != nil {
+		t.Errorf("Error getting account statement: %s", err)
+		return
+	}
+
+	if len(statement.Entries) != len(execs) {
+		t.Errorf("Expected %d entries in the statement, got %d", len(execs), len(statement.Entries))
+		return
+	}
+	for i, entry := range statement.Entries {
+		if entry.Amount != execs[i].Amount || entry.Type != execs[i].Type || entry.Reason != execs[i].Reason || entry.Reference != execs[i].Reference {
+			t.Errorf("Entry %d doesn't match the execution it was written for: %s", i, entry)
+			return
+		}
+	}
+	if statement.OpeningBalance != 0 || statement.ClosingBalance != 79500 {
+		t.Errorf("Statement should open at 0 and close at 79500, got %d and %d", statement.OpeningBalance, statement.ClosingBalance)
+		return
+	}
+
+	var mismatches []*match.LedgerMismatch
+	if mismatches, err = ls.CheckConsistency(); err != nil {
+		t.Errorf("Error checking consistency: %s", err)
+		return
+	}
+	if len(mismatches) != 0 {
+		t.Errorf("Expected no mismatches, got %s", mismatches[0])
+		return
+	}
+
+	var fees uint64
+	if fees, err = ls.GetFeeBalance(); err != nil {
+		t.Errorf("Error getting fee balance: %s", err)
+		return
+	}
+	if fees != 500 {
+		t.Errorf("Expected a fee balance of 500, got %d", fees)
+		return
+	}
+
+	// Change a balance without going through the settlement engine, which should be caught
+	if _, err = se.DBHandler.Exec("UPDATE " + se.dialect.tableName(testConfig().BalanceSchemaName, coin.Name) + " SET balance=1;"); err != nil {
+		t.Errorf("Error tampering with balance: %s", err)
+		return
+	}
+	if mismatches, err = ls.CheckConsistency(); err != nil {
+		t.Errorf("Error checking consistency: %s", err)
+		return
+	}
+	if len(mismatches) != 1 || mismatches[0].Balance != 1 || mismatches[0].LedgerBalance != 79500 {
+		t.Errorf("Expected one mismatch with balance 1 and ledger balance 79500, got %d mismatches", len(mismatches))
+		return
+	}
+
+	return
+}
+
+func TestLedgerTransferNonces(t *testing.T) {
+	var err error
+
+	var tc *testerContainer
+	if tc, err = CreateTesterContainer(); err != nil {
+		t.Errorf("Error creating tester container: %s", err)
+		return
+	}
+
+	defer func() {
+		if err = tc.Kill(); err != nil {
+			t.Errorf("Error killing tester container: %s", err)
+			return
+		}
+	}()
+
+	coin := &coinparam.RegressionNetParams
+	var be *SQLBatchSettlementEngine
+	if be, err = CreateBatchSettlementEngineStructWithConf([]*coinparam.Params{coin}, testConfig()); err != nil {
+		t.Errorf("Error creating batch settlement engine for TestLedgerTransferNonces: %s", err)
+		return
+	}
+
+	var ls *SQLLedgerStore
+	if ls, err = CreateLedgerStoreStructWithConf(coin, testConfig()); err != nil {
+		t.Errorf("Error creating ledger store for TestLedgerTransferNonces: %s", err)
+		return
+	}
+
+	alice := [33]byte{0x02, 0x01}
+	bob := [33]byte{0x02, 0x02}
+	funding := []*match.SettlementExecution{
+		{Pubkey: alice, SubAccount: 2, Amount: 1000, Asset: match.BTCReg, Type: match.Debit, Reason: match.ReasonDeposit},
+	}
+	if _, err = be.ApplySettlementBatch(funding); err != nil {
+		t.Errorf("Error applying funding batch for TestLedgerTransferNonces: %s", err)
+		return
+	}
+
+	// the nonce of a transfer that was rejected shouldn't be stored
+	transfers := []*match.Transfer{
+		{From: alice, FromSubAccount: 2, To: bob, Asset: match.BTCReg, Amount: 300, Nonce: 5},
+		{From: alice, FromSubAccount: 2, To: bob, Asset: match.BTCReg, Amount: 300, Nonce: 3},
+		{From: alice, FromSubAccount: 2, To: bob, Asset: match.BTCReg, Amount: 3000, Nonce: 9},
+	}
+	for i, transfer := range transfers {
+		batch := []*match.SettlementExecution{
+			{Pubkey: alice, SubAccount: 2, Amount: transfer.Amount, Asset: match.BTCReg, Type: match.Credit, Reason: match.ReasonTransfer, Reference: transfer.SenderReference()},
+			{Pubkey: bob, Amount: transfer.Amount, Asset: match.BTCReg, Type: match.Debit, Reason: match.ReasonTransfer, Reference: transfer.FromAccount().String()},
+		}
+		if _, err = be.ApplySettlementBatch(batch); (err == nil) != (i < 2) {
+			t.Errorf("Unexpected result applying transfer %d for TestLedgerTransferNonces: %v", i, err)
+			return
+		}
+	}
+
+	var nonces map[[33]byte]uint64
+	if nonces, err = ls.GetTransferNonces(); err != nil {
+		t.Errorf("Error getting transfer nonces: %s", err)
+		return
+	}
+	if len(nonces) != 1 || nonces[alice] != 5 {
+		t.Errorf("Expected the last nonce for alice to be 5 and no nonce for bob, got %v", nonces)
+		return
+	}
+
+	return
+}
+
+func TestLedgerReplace(t *testing.T) {
+	var err error
+
+	var tc *testerContainer
+	if tc, err = CreateTesterContainer(); err != nil {
+		t.Errorf("Error creating tester container: %s", err)
+		return
+	}
+
+	defer func() {
+		if err = tc.Kill(); err != nil {
+			t.Errorf("Error killing tester container: %s", err)
+			return
+		}
+	}()
+
+	coin := &coinparam.RegressionNetParams
+	var se *SQLSettlementEngine
+	if se, err = CreateSettlementEngineStructWithConf(coin, testConfig()); err != nil {
+		t.Errorf("Error creating settlement engine for TestLedgerReplace: %s", err)
+		return
+	}
+
+	var ls *SQLLedgerStore
+	if ls, err = CreateLedgerStoreStructWithConf(coin, testConfig()); err != nil {
+		t.Errorf("Error creating ledger store for TestLedgerReplace: %s", err)
+		return
+	}
+
+	alice := [33]byte{0x02, 0x01}
+	deposit := &match.SettlementExecution{Pubkey: alice, Amount: 1000, Asset: match.BTCReg, Type: match.Debit, Reason: match.ReasonDeposit, Reference: "testtxid"}
+	if _, err = se.ApplySettlementExecution(deposit); err != nil {
+		t.Errorf("Error applying deposit for TestLedgerReplace: %s", err)
+		return
+	}
+
+	// the entries from another ledger keep their IDs, even with gaps in them
+	entryTime := time.Unix(0, 1234567890123456789)
+	replacement := []*match.LedgerEntry{
+		{ID: 5, Time: entryTime, Account: "testaccount", Asset: match.BTCReg, Amount: 700, Type: match.Debit, Reason: match.ReasonRestore, Reference: "snapshot"},
+		{ID: 9, Time: entryTime, Account: match.ReasonRestore.CounterAccount(), Asset: match.BTCReg, Amount: 700, Type: match.Credit, Reason: match.ReasonRestore, Reference: "snapshot"},
+	}
+	if err = ls.ReplaceLedger(replacement); err != nil {
+		t.Errorf("Error replacing ledger: %s", err)
+		return
+	}
+
+	var entries []*match.LedgerEntry
+	if entries, err = ls.GetLedger(); err != nil {
+		t.Errorf("Error getting ledger: %s", err)
+		return
+	}
+	if len(entries) != len(replacement) {
+		t.Errorf("Expected %d entries after replacing the ledger, got %d", len(replacement), len(entries))
+		return
+	}
+	for i, entry := range entries {
+		if entry.ID != replacement[i].ID || !entry.Time.Equal(entryTime) || entry.Account != replacement[i].Account || entry.Amount != replacement[i].Amount || entry.Type != replacement[i].Type || entry.Reason != replacement[i].Reason {
+			t.Errorf("Entry %d should be %s, got %s", i, replacement[i], entry)
+			return
+		}
+	}
+
+	// new entries come after the ones that were put back
+	if _, err = se.ApplySettlementExecution(deposit); err != nil {
+		t.Errorf("Error applying deposit after replacing ledger for TestLedgerReplace: %s", err)
+		return
+	}
+	if entries, err = ls.GetLedger(); err != nil {
+		t.Errorf("Error getting ledger after deposit: %s", err)
+		return
+	}
+	if len(entries) != 4 || entries[2].ID <= 9 {
+		t.Errorf("Expected 4 entries with the new ones after entry 9, got %d", len(entries))
+		return
+	}
+
+	if err = ls.ReplaceLedger([]*match.LedgerEntry{replacement[1], replacement[0]}); err == nil {
+		t.Errorf("Replacing the ledger with entries out of order should fail")
+		return
+	}
+
+	return
+}
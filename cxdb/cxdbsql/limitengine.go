@@ -1,15 +1,14 @@
 package cxdbsql
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"net"
 	"strconv"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-
 	"github.com/mit-dci/opencx/logging"
 	"github.com/mit-dci/opencx/match"
 	"golang.org/x/crypto/sha3"
@@ -19,12 +18,8 @@ import (
 type SQLLimitEngine struct {
 	DBHandler *sql.DB
 
-	// db username and password
-	dbUsername string
-	dbPassword string
-
-	// db host and port
-	dbAddr net.Addr
+	// the sql database we are using
+	dialect sqlDialect
 
 	// orderbook schema name
 	orderSchema string
@@ -39,23 +34,28 @@ const (
 	sqlTimeFormat     = "2006-01-02 15:04:05"
 )
 
+// The schema versions of the limit orderbook, oldest first
+var limitEngineMigrations = []migration{
+	baselineMigration(limitEngineSchema),
+	addColumnsMigration(2, "add sub-accounts", "subaccount INT UNSIGNED NOT NULL DEFAULT 0"),
+	addColumnsMigration(3, "add swap orders", "swap BOOLEAN NOT NULL DEFAULT FALSE"),
+}
+
 func CreateLimEngineStructWithConf(pair *match.Pair, conf *dbsqlConfig) (engine *SQLLimitEngine, err error) {
 	// Set the default conf
 	dbConfigSetup(conf)
 
-	// Resolve new address
-	var addr net.Addr
-	if addr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(conf.DBHost, fmt.Sprintf("%d", conf.DBPort))); err != nil {
-		err = fmt.Errorf("Couldn't resolve db address for CreateLimitEngineWithConf: %s", err)
+	// Get the dialect for the database we are using
+	var dialect sqlDialect
+	if dialect, err = newDialect(conf); err != nil {
+		err = fmt.Errorf("Couldn't create sql dialect for CreateLimitEngineWithConf: %s", err)
 		return
 	}
 
 	// Set values
 	le := &SQLLimitEngine{
-		dbUsername:  conf.DBUsername,
-		dbPassword:  conf.DBPassword,
+		dialect:     dialect,
 		orderSchema: conf.OrderSchemaName,
-		dbAddr:      addr,
 		pair:        pair,
 	}
 
@@ -64,19 +64,12 @@ func CreateLimEngineStructWithConf(pair *match.Pair, conf *dbsqlConfig) (engine
 		return
 	}
 
-	// Now connect to the database and create the schemas / tables
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", le.dbUsername, le.dbPassword, le.dbAddr.Network(), le.dbAddr.String())
-	if le.DBHandler, err = sql.Open("mysql", openString); err != nil {
+	// Now connect to the database
+	if le.DBHandler, err = le.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for CreateLimitEngineWithConf: %s", err)
 		return
 	}
 
-	// Make sure we can actually connect
-	if err = le.DBHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running? Did you set the username and password in sqldb.conf: %s", err)
-		return
-	}
-
 	// now we actually set the return, all checks have passed
 	engine = le
 	return
@@ -109,9 +102,8 @@ func CreateLimitEngine(pair *match.Pair) (engine match.LimitEngine, err error) {
 // This assumes everything else is set
 func (le *SQLLimitEngine) setupLimitOrderbookTables() (err error) {
 
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", le.dbUsername, le.dbPassword, le.dbAddr.Network(), le.dbAddr.String())
 	var rootHandler *sql.DB
-	if rootHandler, err = sql.Open("mysql", openString); err != nil {
+	if rootHandler, err = le.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for setup limit tables: %s", err)
 		return
 	}
@@ -119,11 +111,6 @@ func (le *SQLLimitEngine) setupLimitOrderbookTables() (err error) {
 	// when we're done close please
 	defer rootHandler.Close()
 
-	if err = rootHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
-		return
-	}
-
 	// We do this in a transaction because it's more than one operation
 	var tx *sql.Tx
 	if tx, err = rootHandler.Begin(); err != nil {
@@ -140,21 +127,9 @@ func (le *SQLLimitEngine) setupLimitOrderbookTables() (err error) {
 		err = tx.Commit()
 	}()
 
-	// Now create the schema
-	if _, err = tx.Exec("CREATE SCHEMA IF NOT EXISTS " + le.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error creating schema for setup limit order tables: %s", err)
-		return
-	}
-
-	// use the schema
-	if _, err = tx.Exec("USE " + le.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Could not use %s schema: %s", le.orderSchema, err)
-		return
-	}
-
-	createTableQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", le.pair.String(), limitEngineSchema)
-	if _, err = tx.Exec(createTableQuery); err != nil {
-		err = fmt.Errorf("Error creating limit orderbook table: %s", err)
+	// Create the table if it does not exist, and bring it up to the newest schema version
+	if err = migrateTable(tx, le.dialect, le.orderSchema, le.pair.String(), limitEngineMigrations); err != nil {
+		err = fmt.Errorf("Error migrating limit orderbook table: %s", err)
 		return
 	}
 	return
@@ -197,14 +172,21 @@ func (le *SQLLimitEngine) PlaceLimitOrder(order *match.LimitOrder) (idRes *match
 	placementTimeFormatted := placementTime.Format(sqlTimeFormat)
 
 	// Do these first so we don't have to rollback any tx's if they're wrong
-	// hash order so we can use that as a primary key
+	// hash order so we can use that as a primary key. The same order can be placed twice, and other
+	// engines can place orders into the same table, so the placement time and a random nonce are
+	// hashed with it.
+	var nonce [8]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		err = fmt.Errorf("Error reading nonce while placing order: %s", err)
+		return
+	}
 	hasher := sha3.New256()
-	var orderBytes []byte
-	if orderBytes, err = order.Serialize(); err != nil {
+	if err = binary.Write(hasher, binary.BigEndian, order); err != nil {
 		err = fmt.Errorf("Error serializing while placing order: %s", err)
 		return
 	}
-	hasher.Write(orderBytes)
+	binary.Write(hasher, binary.BigEndian, placementTime.UnixNano())
+	hasher.Write(nonce[:])
 	hashedOrder := hasher.Sum(nil)
 
 	// calculate price
@@ -256,18 +238,55 @@ func (le *SQLLimitEngine) PlaceLimitOrder(order *match.LimitOrder) (idRes *match
 		err = tx.Commit()
 	}()
 
-	if _, err = tx.Exec("USE " + le.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using order schema while matching limit orders: %s", err)
+	placeOrderQuery := fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);", le.dialect.tableName(le.orderSchema, le.pair.String()))
+	if _, err = tx.Exec(le.dialect.bind(placeOrderQuery), hexArg(order.Pubkey[:]), hexArg(hashedOrder), order.Side.String(), price, order.AmountHave, order.AmountWant, placementTimeFormatted, order.SubAccount, order.Swap); err != nil {
+		err = fmt.Errorf("Error placing order into db for PlaceLimitOrder: %s", err)
 		return
 	}
 
-	placeOrderQuery := fmt.Sprintf("INSERT INTO %s VALUES ('%x', '%x', '%s', %f, %d, %d, '%s');", le.pair.String(), order.Pubkey[:], hashedOrder, order.Side.String(), price, order.AmountHave, order.AmountWant, placementTimeFormatted)
-	if _, err = tx.Exec(placeOrderQuery); err != nil {
-		err = fmt.Errorf("Error placing order into db for PlaceLimitOrder: %s", err)
+	idRes = loid
+	return
+}
+
+// RestoreLimitOrder puts an order back into the engine with the ID and timestamp it was placed with
+func (le *SQLLimitEngine) RestoreLimitOrder(loid *match.LimitOrderIDPair) (err error) {
+	var tx *sql.Tx
+	if tx, err = le.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error beginning transaction while restoring order: \n%s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error while restoring order: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var rows *sql.Rows
+	existsQuery := fmt.Sprintf("SELECT orderID FROM %s WHERE orderID=?;", le.dialect.tableName(le.orderSchema, le.pair.String()))
+	if rows, err = tx.Query(le.dialect.bind(existsQuery), hexArg(loid.OrderID[:])); err != nil {
+		err = fmt.Errorf("Error checking for order for RestoreLimitOrder: %s", err)
+		return
+	}
+	exists := rows.Next()
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing rows for RestoreLimitOrder: %s", err)
+		return
+	}
+	if exists {
+		err = fmt.Errorf("Order %x is already in the engine", loid.OrderID[:])
+		return
+	}
+
+	restoreOrderQuery := fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);", le.dialect.tableName(le.orderSchema, le.pair.String()))
+	if _, err = tx.Exec(le.dialect.bind(restoreOrderQuery), hexArg(loid.Order.Pubkey[:]), hexArg(loid.OrderID[:]), loid.Order.Side.String(), loid.Price, loid.Order.AmountHave, loid.Order.AmountWant, loid.Timestamp.Format(sqlTimeFormat), loid.Order.SubAccount, loid.Order.Swap); err != nil {
+		err = fmt.Errorf("Error inserting order into db for RestoreLimitOrder: %s", err)
 		return
 	}
 
-	idRes = loid
 	return
 }
 
@@ -290,14 +309,9 @@ func (le *SQLLimitEngine) CancelLimitOrder(orderID *match.OrderID) (cancelled *m
 		return
 	}()
 
-	if _, err = tx.Exec("USE " + le.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using order schema while cancelling limit order: %s", err)
-		return
-	}
-
 	var rows *sql.Rows
-	selectOrderQuery := fmt.Sprintf("SELECT pubkey, side, amountHave FROM %s WHERE orderID = '%x' FOR UPDATE;", le.pair, orderID)
-	if rows, err = tx.Query(selectOrderQuery); err != nil {
+	selectOrderQuery := fmt.Sprintf("SELECT pubkey, side, amountHave, subaccount, swap FROM %s WHERE orderID = ?%s;", le.dialect.tableName(le.orderSchema, le.pair.String()), le.dialect.forUpdate(false))
+	if rows, err = tx.Query(le.dialect.bind(selectOrderQuery), hexArg(orderID)); err != nil {
 		err = fmt.Errorf("Error getting order from db for CancelLimitOrder: %s", err)
 		return
 	}
@@ -307,9 +321,11 @@ func (le *SQLLimitEngine) CancelLimitOrder(orderID *match.OrderID) (cancelled *m
 	var pkBytes []byte
 	var orderSide string
 	var remainingHave uint64
+	var subAccount uint32
+	var swap bool
 	if rows.Next() {
 		// scan the things we can into this order
-		if err = rows.Scan(&pkBytes, &orderSide, &remainingHave); err != nil {
+		if err = rows.Scan(&pkBytes, &orderSide, &remainingHave, &subAccount, &swap); err != nil {
 			err = fmt.Errorf("Error scanning for order for CancelLimitOrder: %s", err)
 			return
 		}
@@ -325,10 +341,19 @@ func (le *SQLLimitEngine) CancelLimitOrder(orderID *match.OrderID) (cancelled *m
 			return
 		}
 
+	} else {
+		rows.Close()
+		err = fmt.Errorf("Order %x does not exist, cannot cancel", orderID[:])
+		return
+	}
+
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing rows for CancelLimitOrder: %s", err)
+		return
 	}
 
-	deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE orderID = '%x';", le.pair.String(), orderID)
-	if _, err = tx.Exec(deleteOrderQuery); err != nil {
+	deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE orderID = ?;", le.dialect.tableName(le.orderSchema, le.pair.String()))
+	if _, err = tx.Exec(le.dialect.bind(deleteOrderQuery), hexArg(orderID)); err != nil {
 		err = fmt.Errorf("Error deleting order for CancelLimitOrder: %s", err)
 		return
 	}
@@ -336,6 +361,12 @@ func (le *SQLLimitEngine) CancelLimitOrder(orderID *match.OrderID) (cancelled *m
 	cancelled = &match.CancelledOrder{
 		OrderID: orderID,
 	}
+
+	// swap orders don't hold anything on the exchange, so there's nothing to give back
+	if swap {
+		return
+	}
+
 	var debitAsset match.Asset
 	if *actualSide == match.Buy {
 		debitAsset = le.pair.AssetHave
@@ -343,9 +374,12 @@ func (le *SQLLimitEngine) CancelLimitOrder(orderID *match.OrderID) (cancelled *m
 		debitAsset = le.pair.AssetWant
 	}
 	cancelSettlement = &match.SettlementExecution{
-		Amount: remainingHave,
-		Type:   match.Debit,
-		Asset:  debitAsset,
+		SubAccount: subAccount,
+		Amount:     remainingHave,
+		Type:       match.Debit,
+		Asset:      debitAsset,
+		Reason:     match.ReasonCancelRefund,
+		Reference:  hex.EncodeToString(orderID[:]),
 	}
 	copy(cancelSettlement.Pubkey[:], pkBytes)
 
@@ -353,7 +387,7 @@ func (le *SQLLimitEngine) CancelLimitOrder(orderID *match.OrderID) (cancelled *m
 }
 
 // MatchLimitOrders matches limit orders based on price/time priority
-func (le *SQLLimitEngine) MatchLimitOrders() (orderExecs []*match.OrderExecution, settlementExecs []*match.SettlementExecution, err error) {
+func (le *SQLLimitEngine) MatchLimitOrders() (orderExecs []*match.OrderExecution, settlementExecs []*match.SettlementExecution, swaps []*match.SwapInstruction, err error) {
 	if le.DBHandler == nil {
 		err = fmt.Errorf("Cannot match orders for nil handler, please recreate engine")
 		return
@@ -375,21 +409,16 @@ func (le *SQLLimitEngine) MatchLimitOrders() (orderExecs []*match.OrderExecution
 		return
 	}()
 
-	if _, err = tx.Exec("USE " + le.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using order schema while matching limit orders: %s", err)
-		return
-	}
-
 	sellSide := new(match.Side)
 	buySide := new(match.Side)
 	*sellSide = match.Sell
 	*buySide = match.Buy
 	// First get the max buy price and max sell price
 	var maxSellRow *sql.Row
-	getMaxSellPrice := fmt.Sprintf("SELECT MAX(price) FROM %s WHERE side='%s' FOR UPDATE;", le.pair.String(), sellSide.String())
+	getMaxSellPrice := fmt.Sprintf("SELECT MAX(price) FROM %s WHERE side=?%s;", le.dialect.tableName(le.orderSchema, le.pair.String()), le.dialect.forUpdate(true))
 	// errors for queryrow are deferred until scan -- this is important, that's why we don't err != nil here
 	logging.Infof("maxsell: %s", sellSide.String())
-	maxSellRow = tx.QueryRow(getMaxSellPrice)
+	maxSellRow = tx.QueryRow(le.dialect.bind(getMaxSellPrice), sellSide.String())
 
 	var maxSell float64
 	var maxSellSqlNullable sql.NullFloat64
@@ -409,9 +438,9 @@ func (le *SQLLimitEngine) MatchLimitOrders() (orderExecs []*match.OrderExecution
 	}
 
 	var minBuyRow *sql.Row
-	getminBuyPrice := fmt.Sprintf("SELECT MIN(price) FROM %s WHERE side='%s' FOR UPDATE;", le.pair.String(), buySide.String())
+	getminBuyPrice := fmt.Sprintf("SELECT MIN(price) FROM %s WHERE side=?%s;", le.dialect.tableName(le.orderSchema, le.pair.String()), le.dialect.forUpdate(true))
 	// errors for queryrow are deferred until scan -- this is important, that's why we don't err != nil here
-	minBuyRow = tx.QueryRow(getminBuyPrice)
+	minBuyRow = tx.QueryRow(le.dialect.bind(getminBuyPrice), buySide.String())
 
 	var minBuy float64
 	var minBuySqlNullable sql.NullFloat64
@@ -441,8 +470,8 @@ func (le *SQLLimitEngine) MatchLimitOrders() (orderExecs []*match.OrderExecution
 	// this means that the sell orders will be sorted by price first, so the best prices will match first,
 	// and within the best price the earliest prices will match first.
 	var sellRows *sql.Rows
-	getSellSideQuery := fmt.Sprintf("SELECT pubkey, price, orderID, amountHave, amountWant, time FROM %s WHERE price>=%f AND side='%s' ORDER BY price DESC, time ASC FOR UPDATE;", le.pair.String(), minBuy, sellSide.String())
-	if sellRows, err = tx.Query(getSellSideQuery); err != nil {
+	getSellSideQuery := fmt.Sprintf("SELECT pubkey, price, orderID, amountHave, amountWant, time, subaccount, swap FROM %s WHERE price>=? AND side=? ORDER BY price DESC, time ASC%s;", le.dialect.tableName(le.orderSchema, le.pair.String()), le.dialect.forUpdate(false))
+	if sellRows, err = tx.Query(le.dialect.bind(getSellSideQuery), minBuy, sellSide.String()); err != nil {
 		err = fmt.Errorf("Error querying for sell orders for MatchLimitOrders: %s", err)
 		return
 	}
@@ -457,7 +486,7 @@ func (le *SQLLimitEngine) MatchLimitOrders() (orderExecs []*match.OrderExecution
 			Order:   new(match.LimitOrder),
 			OrderID: new(match.OrderID),
 		}
-		if err = sellRows.Scan(&pubkeyBytes, &sellOrderIDPair.Price, &orderIDBytes, &sellOrderIDPair.Order.AmountHave, &sellOrderIDPair.Order.AmountWant, &timeString); err != nil {
+		if err = sellRows.Scan(&pubkeyBytes, &sellOrderIDPair.Price, &orderIDBytes, &sellOrderIDPair.Order.AmountHave, &sellOrderIDPair.Order.AmountWant, &timeString, &sellOrderIDPair.Order.SubAccount, &sellOrderIDPair.Order.Swap); err != nil {
 			err = fmt.Errorf("Error scanning sell rows for MatchLimitOrders: %s", err)
 			return
 		}
@@ -494,8 +523,8 @@ func (le *SQLLimitEngine) MatchLimitOrders() (orderExecs []*match.OrderExecution
 	// this means that the buy orders will be sorted by price first, so the best prices will match first,
 	// and within the best price the earliest prices will match first.
 	var buyRows *sql.Rows
-	getBuySideQuery := fmt.Sprintf("SELECT pubkey, price, orderID, amountHave, amountWant, time FROM %s WHERE price<=%f AND side='%s' ORDER BY price ASC, time ASC FOR UPDATE;", le.pair.String(), maxSell, buySide.String())
-	if buyRows, err = tx.Query(getBuySideQuery); err != nil {
+	getBuySideQuery := fmt.Sprintf("SELECT pubkey, price, orderID, amountHave, amountWant, time, subaccount, swap FROM %s WHERE price<=? AND side=? ORDER BY price ASC, time ASC%s;", le.dialect.tableName(le.orderSchema, le.pair.String()), le.dialect.forUpdate(false))
+	if buyRows, err = tx.Query(le.dialect.bind(getBuySideQuery), maxSell, buySide.String()); err != nil {
 		err = fmt.Errorf("Error querying for buy orders for MatchLimitOrders: %s", err)
 		return
 	}
@@ -510,7 +539,7 @@ func (le *SQLLimitEngine) MatchLimitOrders() (orderExecs []*match.OrderExecution
 			Order:   new(match.LimitOrder),
 			OrderID: new(match.OrderID),
 		}
-		if err = buyRows.Scan(&pubkeyBytes, &buyOrderIDPair.Price, &orderIDBytes, &buyOrderIDPair.Order.AmountHave, &buyOrderIDPair.Order.AmountWant, &timeString); err != nil {
+		if err = buyRows.Scan(&pubkeyBytes, &buyOrderIDPair.Price, &orderIDBytes, &buyOrderIDPair.Order.AmountHave, &buyOrderIDPair.Order.AmountWant, &timeString, &buyOrderIDPair.Order.SubAccount, &buyOrderIDPair.Order.Swap); err != nil {
 			err = fmt.Errorf("Error scanning buy rows for MatchLimitOrders: %s", err)
 			return
 		}
@@ -542,7 +571,7 @@ func (le *SQLLimitEngine) MatchLimitOrders() (orderExecs []*match.OrderExecution
 		return
 	}
 
-	if orderExecs, settlementExecs, err = match.MatchPrioritizedOrders(buyOrders, sellOrders); err != nil {
+	if orderExecs, settlementExecs, swaps, err = match.MatchPrioritizedOrders(buyOrders, sellOrders); err != nil {
 		err = fmt.Errorf("Error matching prioritized orders for MatchLimitOrders: %s", err)
 		return
 	}
@@ -550,14 +579,14 @@ func (le *SQLLimitEngine) MatchLimitOrders() (orderExecs []*match.OrderExecution
 	// Update the matching engine with the new state because that's what we do
 	for _, orderExec := range orderExecs {
 		if orderExec.Filled {
-			cancelOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE orderID='%x';", le.pair.String(), orderExec.OrderID)
-			if _, err = tx.Exec(cancelOrderQuery); err != nil {
+			cancelOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE orderID=?;", le.dialect.tableName(le.orderSchema, le.pair.String()))
+			if _, err = tx.Exec(le.dialect.bind(cancelOrderQuery), hexArg(orderExec.OrderID)); err != nil {
 				err = fmt.Errorf("Error deleting filled order for MatchLimitOrders: %s", err)
 				return
 			}
 		} else {
-			updateOrderExecQuery := fmt.Sprintf("UPDATE %s SET amountWant='%d', amountHave='%d' WHERE orderID='%x';", le.pair.String(), orderExec.NewAmountWant, orderExec.NewAmountHave, orderExec.OrderID)
-			if _, err = tx.Exec(updateOrderExecQuery); err != nil {
+			updateOrderExecQuery := fmt.Sprintf("UPDATE %s SET amountWant=?, amountHave=? WHERE orderID=?;", le.dialect.tableName(le.orderSchema, le.pair.String()))
+			if _, err = tx.Exec(le.dialect.bind(updateOrderExecQuery), orderExec.NewAmountWant, orderExec.NewAmountHave, hexArg(orderExec.OrderID)); err != nil {
 				err = fmt.Errorf("Error updating order for order exec for MatchLimitOrders: %s", err)
 				return
 			}
@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
-	"net"
 	"time"
 
 	"github.com/mit-dci/lit/crypto/koblitz"
@@ -15,23 +14,22 @@ import (
 type SQLLimitOrderbook struct {
 	DBHandler *sql.DB
 
-	// db username and password
-	dbUsername string
-	dbPassword string
-
-	// db host and port
-	dbAddr net.Addr
+	// the sql database we are using
+	dialect sqlDialect
 
 	// orderbook schema name
 	orderSchema string
 
+	// archive schema name, for orders that are no longer in the orderbook and their fills
+	archiveSchema string
+
 	// this pair
 	pair *match.Pair
 }
 
 // The schema for the limit orderbook
 const (
-	limitOrderbookSchema = "pubkey VARBINARY(66), orderID VARBINARY(64), side TEXT, price DOUBLE(30,2) UNSIGNED, amountHave BIGINT(64), amountWant BIGINT(64), time TIMESTAMP"
+	limitOrderbookSchema = "pubkey VARBINARY(66), orderID VARBINARY(64), side TEXT, price DOUBLE(30,2) UNSIGNED, amountHave BIGINT(64), amountWant BIGINT(64), time TIMESTAMP, subaccount INT UNSIGNED NOT NULL DEFAULT 0, swap BOOLEAN NOT NULL DEFAULT FALSE"
 )
 
 // CreateLimitOrderbook creates a limit orderbook based on a pair
@@ -40,23 +38,31 @@ func CreateLimitOrderbook(pair *match.Pair) (book match.LimitOrderbook, err erro
 	conf := new(dbsqlConfig)
 	*conf = *defaultConf
 
+	if book, err = CreateLimitOrderbookWithConf(pair, conf); err != nil {
+		err = fmt.Errorf("Error creating limit orderbook with conf for CreateLimitOrderbook: %s", err)
+		return
+	}
+	return
+}
+
+// CreateLimitOrderbookWithConf creates a limit orderbook based on a pair, using the database in conf
+func CreateLimitOrderbookWithConf(pair *match.Pair, conf *dbsqlConfig) (book match.LimitOrderbook, err error) {
 	// set the default conf
 	dbConfigSetup(conf)
 
-	// Resolve new address
-	var addr net.Addr
-	if addr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(conf.DBHost, fmt.Sprintf("%d", conf.DBPort))); err != nil {
-		err = fmt.Errorf("Couldn't resolve db address for CreateLimitEngine: %s", err)
+	// Get the dialect for the database we are using
+	var dialect sqlDialect
+	if dialect, err = newDialect(conf); err != nil {
+		err = fmt.Errorf("Couldn't create sql dialect for CreateLimitOrderbookWithConf: %s", err)
 		return
 	}
 
 	// Set values for limit engine
 	lo := &SQLLimitOrderbook{
-		dbUsername:  conf.DBUsername,
-		dbPassword:  conf.DBPassword,
-		orderSchema: conf.ReadOnlyOrderSchemaName,
-		dbAddr:      addr,
-		pair:        pair,
+		dialect:       dialect,
+		orderSchema:   conf.ReadOnlyOrderSchemaName,
+		archiveSchema: conf.OrderArchiveSchemaName,
+		pair:          pair,
 	}
 
 	if err = lo.setupLimitOrderbookTables(); err != nil {
@@ -64,16 +70,9 @@ func CreateLimitOrderbook(pair *match.Pair) (book match.LimitOrderbook, err erro
 		return
 	}
 
-	// Now connect to the database and create the schemas / tables
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", lo.dbUsername, lo.dbPassword, lo.dbAddr.Network(), lo.dbAddr.String())
-	if lo.DBHandler, err = sql.Open("mysql", openString); err != nil {
-		err = fmt.Errorf("Error opening database for CreateLimitEngine: %s", err)
-		return
-	}
-
-	// Make sure we can actually connect
-	if err = lo.DBHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
+	// Now connect to the database
+	if lo.DBHandler, err = lo.dialect.open(); err != nil {
+		err = fmt.Errorf("Error opening database for CreateLimitOrderbookWithConf: %s", err)
 		return
 	}
 
@@ -86,9 +85,8 @@ func CreateLimitOrderbook(pair *match.Pair) (book match.LimitOrderbook, err erro
 // This assumes everything else is set
 func (lo *SQLLimitOrderbook) setupLimitOrderbookTables() (err error) {
 
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", lo.dbUsername, lo.dbPassword, lo.dbAddr.Network(), lo.dbAddr.String())
 	var rootHandler *sql.DB
-	if rootHandler, err = sql.Open("mysql", openString); err != nil {
+	if rootHandler, err = lo.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for setup limit tables: %s", err)
 		return
 	}
@@ -96,11 +94,6 @@ func (lo *SQLLimitOrderbook) setupLimitOrderbookTables() (err error) {
 	// when we're done close please
 	defer rootHandler.Close()
 
-	if err = rootHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
-		return
-	}
-
 	// We do this in a transaction because it's more than one operation
 	var tx *sql.Tx
 	if tx, err = rootHandler.Begin(); err != nil {
@@ -117,22 +110,21 @@ func (lo *SQLLimitOrderbook) setupLimitOrderbookTables() (err error) {
 		err = tx.Commit()
 	}()
 
-	// Now create the schema
-	if _, err = tx.Exec("CREATE SCHEMA IF NOT EXISTS " + lo.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error creating schema for setup limit order tables: %s", err)
-		return
-	}
-
-	// use the schema
-	if _, err = tx.Exec("USE " + lo.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Could not use %s schema: %s", lo.orderSchema, err)
-		return
-	}
-
-	createTableQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", lo.pair.String(), limitEngineSchema)
-	if _, err = tx.Exec(createTableQuery); err != nil {
-		err = fmt.Errorf("Error creating limit orderbook table: %s", err)
-		return
+	// Create the tables if they do not exist, and bring them up to the newest schema version
+	tables := []struct {
+		schemaName string
+		tableName  string
+		migrations []migration
+	}{
+		{lo.orderSchema, lo.pair.String(), limitEngineMigrations},
+		{lo.archiveSchema, lo.pair.String(), limitArchiveMigrations},
+		{lo.archiveSchema, fillsTable(lo.pair), orderFillsMigrations},
+	}
+	for _, table := range tables {
+		if err = migrateTable(tx, lo.dialect, table.schemaName, table.tableName, table.migrations); err != nil {
+			err = fmt.Errorf("Error migrating limit orderbook table: %s", err)
+			return
+		}
 	}
 	return
 }
@@ -155,18 +147,35 @@ func (lo *SQLLimitOrderbook) UpdateBookExec(orderExec *match.OrderExecution) (er
 		err = tx.Commit()
 	}()
 
-	// First use the limit schema
-	if _, err = tx.Exec("USE " + lo.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using limit schema to UpdateBookExec: %s", err)
+	// Keep the execution as a fill, and archive the order if it was filled
+	var lp *match.LimitOrderIDPair
+	if lp, err = lo.getOrder(tx, &orderExec.OrderID); err != nil {
+		err = fmt.Errorf("Error getting order within tx for UpdateBookExec: %s", err)
 		return
 	}
+	if lp != nil {
+		now := time.Now()
+		if err = insertFill(tx, lo.dialect, lo.archiveSchema, lo.pair, &orderExec.OrderID, match.NewOrderFill(lp.Order.AmountWant, lp.Order.AmountHave, orderExec, now)); err != nil {
+			err = fmt.Errorf("Error inserting fill within tx for UpdateBookExec: %s", err)
+			return
+		}
+		if orderExec.Filled {
+			// the last fill took everything that was left
+			lp.Order.AmountWant = 0
+			lp.Order.AmountHave = 0
+			if err = lo.archiveOrder(tx, lp, match.OrderFilled, now); err != nil {
+				err = fmt.Errorf("Error archiving order within tx for UpdateBookExec: %s", err)
+				return
+			}
+		}
+	}
 
 	// If the order was filled then delete it. If not then update it.
 	if orderExec.Filled {
 		// If the order was filled, delete it from the orderbook
-		deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE orderID='%x';", lo.pair.String(), orderExec.OrderID)
+		deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE orderID=?;", lo.dialect.tableName(lo.orderSchema, lo.pair.String()))
 		// var res sql.Result
-		if _, err = tx.Exec(deleteOrderQuery); err != nil {
+		if _, err = tx.Exec(lo.dialect.bind(deleteOrderQuery), hexArg(orderExec.OrderID)); err != nil {
 			err = fmt.Errorf("Error deleting order within tx for UpdateBookExec: %s", err)
 			return
 		}
@@ -182,9 +191,9 @@ func (lo *SQLLimitOrderbook) UpdateBookExec(orderExec *match.OrderExecution) (er
 		// }
 	} else {
 		// If the order was not filled, just update the amounts
-		updateOrderQuery := fmt.Sprintf("UPDATE %s SET amountHave=%d, amountWant=%d WHERE orderID='%x';", lo.pair.String(), orderExec.NewAmountHave, orderExec.NewAmountWant, orderExec.OrderID)
+		updateOrderQuery := fmt.Sprintf("UPDATE %s SET amountHave=?, amountWant=? WHERE orderID=?;", lo.dialect.tableName(lo.orderSchema, lo.pair.String()))
 		// var res sql.Result
-		if _, err = tx.Exec(updateOrderQuery); err != nil {
+		if _, err = tx.Exec(lo.dialect.bind(updateOrderQuery), orderExec.NewAmountHave, orderExec.NewAmountWant, hexArg(orderExec.OrderID)); err != nil {
 			err = fmt.Errorf("Error updating order within tx for UpdateBookExec: %s", err)
 			return
 		}
@@ -220,16 +229,30 @@ func (lo *SQLLimitOrderbook) UpdateBookCancel(cancel *match.CancelledOrder) (err
 		err = tx.Commit()
 	}()
 
-	// First use the limit schema
-	if _, err = tx.Exec("USE " + lo.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using limit schema for UpdateBookCancel: %s", err)
+	// Archive the order before it's taken out of the orderbook
+	var lp *match.LimitOrderIDPair
+	if lp, err = lo.getOrder(tx, cancel.OrderID); err != nil {
+		err = fmt.Errorf("Error getting order within tx for cancel: %s", err)
+		return
+	}
+	if lp == nil {
+		err = fmt.Errorf("Order %x is not in the orderbook", cancel.OrderID[:])
+		return
+	}
+	var fills []*match.OrderFill
+	if fills, err = getFills(tx, lo.dialect, lo.archiveSchema, lo.pair, cancel.OrderID); err != nil {
+		err = fmt.Errorf("Error getting fills within tx for cancel: %s", err)
+		return
+	}
+	if err = lo.archiveOrder(tx, lp, match.CancelStatus(fills), time.Now()); err != nil {
+		err = fmt.Errorf("Error archiving order within tx for cancel: %s", err)
 		return
 	}
 
-	// The order was filled, delete it from the orderbook
-	deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE orderID='%x';", lo.pair.String(), cancel.OrderID)
+	// The order was cancelled, delete it from the orderbook
+	deleteOrderQuery := fmt.Sprintf("DELETE FROM %s WHERE orderID=?;", lo.dialect.tableName(lo.orderSchema, lo.pair.String()))
 	var res sql.Result
-	if res, err = tx.Exec(deleteOrderQuery); err != nil {
+	if res, err = tx.Exec(lo.dialect.bind(deleteOrderQuery), hexArg(cancel.OrderID)); err != nil {
 		err = fmt.Errorf("Error deleting order within tx for cancel: %s", err)
 		return
 	}
@@ -264,14 +287,8 @@ func (lo *SQLLimitOrderbook) UpdateBookPlace(limitIDPair *match.LimitOrderIDPair
 		err = tx.Commit()
 	}()
 
-	// First use the order schema
-	if _, err = tx.Exec("USE " + lo.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using order schema for UpdateBookPlace: %s", err)
-		return
-	}
-
-	insertOrderQuery := fmt.Sprintf("INSERT INTO %s VALUES ('%x', '%x', '%s', %f, %d, %d, '%s');", lo.pair.String(), limitIDPair.Order.Pubkey, limitIDPair.OrderID[:], limitIDPair.Order.Side.String(), limitIDPair.Price, limitIDPair.Order.AmountHave, limitIDPair.Order.AmountWant, limitIDPair.Timestamp.Format(sqlTimeFormat))
-	if _, err = tx.Exec(insertOrderQuery); err != nil {
+	insertOrderQuery := fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);", lo.dialect.tableName(lo.orderSchema, lo.pair.String()))
+	if _, err = tx.Exec(lo.dialect.bind(insertOrderQuery), hexArg(limitIDPair.Order.Pubkey), hexArg(limitIDPair.OrderID[:]), limitIDPair.Order.Side.String(), limitIDPair.Price, limitIDPair.Order.AmountHave, limitIDPair.Order.AmountWant, limitIDPair.Timestamp.Format(sqlTimeFormat), limitIDPair.Order.SubAccount, limitIDPair.Order.Swap); err != nil {
 		err = fmt.Errorf("Error placing order into db for UpdateBookPlace: %s", err)
 		return
 	}
@@ -282,8 +299,6 @@ func (lo *SQLLimitOrderbook) UpdateBookPlace(limitIDPair *match.LimitOrderIDPair
 
 // GetOrder gets an order from an OrderID
 func (lo *SQLLimitOrderbook) GetOrder(orderID *match.OrderID) (limOrder *match.LimitOrderIDPair, err error) {
-	limOrder = new(match.LimitOrderIDPair)
-	limOrder.Order = new(match.LimitOrder)
 	// Transaction so we're acid
 	var tx *sql.Tx
 	if tx, err = lo.DBHandler.Begin(); err != nil {
@@ -300,14 +315,26 @@ func (lo *SQLLimitOrderbook) GetOrder(orderID *match.OrderID) (limOrder *match.L
 		err = tx.Commit()
 	}()
 
-	if _, err = tx.Exec("USE " + lo.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using order schema for GetOrdersForPubkey: %s", err)
+	if limOrder, err = lo.getOrder(tx, orderID); err != nil {
+		return
+	}
+	if limOrder == nil {
+		err = fmt.Errorf("Order %x does not exist", orderID[:])
 		return
 	}
+	return
+}
+
+// getOrder gets an order from an OrderID within a transaction. If the order is not in the
+// orderbook, the order returned is nil.
+func (lo *SQLLimitOrderbook) getOrder(tx *sql.Tx, orderID *match.OrderID) (limOrder *match.LimitOrderIDPair, err error) {
+	foundOrder := new(match.LimitOrderIDPair)
+	foundOrder.Order = new(match.LimitOrder)
+	foundOrder.OrderID = new(match.OrderID)
 
 	var row *sql.Row
-	getOrdersQuery := fmt.Sprintf("SELECT pubkey, side, price, orderID, amountHave, amountWant, time FROM %s WHERE orderID='%x';", lo.pair.String(), orderID[:])
-	row = tx.QueryRow(getOrdersQuery)
+	getOrdersQuery := fmt.Sprintf("SELECT pubkey, side, price, orderID, amountHave, amountWant, time, subaccount, swap FROM %s WHERE orderID=?;", lo.dialect.tableName(lo.orderSchema, lo.pair.String()))
+	row = tx.QueryRow(lo.dialect.bind(getOrdersQuery), hexArg(orderID[:]))
 
 	// we create these here so we don't take up a ton of memory allocating space for new intermediate arrays
 	var pkBytes []byte
@@ -316,12 +343,15 @@ func (lo *SQLLimitOrderbook) GetOrder(orderID *match.OrderID) (limOrder *match.L
 	var sideString string
 	var timeString string
 	// scan the things we can into this order
-	if err = row.Scan(&pkBytes, &sideString, &thisPrice, &hashedOrderBytes, &limOrder.Order.AmountHave, &limOrder.Order.AmountWant, &timeString); err != nil {
+	if err = row.Scan(&pkBytes, &sideString, &thisPrice, &hashedOrderBytes, &foundOrder.Order.AmountHave, &foundOrder.Order.AmountWant, &timeString, &foundOrder.Order.SubAccount, &foundOrder.Order.Swap); err == sql.ErrNoRows {
+		err = nil
+		return
+	} else if err != nil {
 		err = fmt.Errorf("Error scanning into order for GetOrdersForPubkey: %s", err)
 		return
 	}
 
-	if limOrder.Timestamp, err = time.Parse(sqlTimeFormat, timeString); err != nil {
+	if foundOrder.Timestamp, err = time.Parse(sqlTimeFormat, timeString); err != nil {
 		err = fmt.Errorf("Error parsing timestamp from string for GetOrdersForPubkey: %s", err)
 		return
 	}
@@ -339,16 +369,34 @@ func (lo *SQLLimitOrderbook) GetOrder(orderID *match.OrderID) (limOrder *match.L
 	}
 
 	// we prepared again
-	if err = limOrder.OrderID.UnmarshalText(hashedOrderBytes); err != nil {
+	if err = foundOrder.OrderID.UnmarshalText(hashedOrderBytes); err != nil {
 		err = fmt.Errorf("Error unmarshalling order ID for GetOrdersForPubkey: %s", err)
 		return
 	}
 
 	// Copy all of the bytes and values
-	copy(limOrder.Order.Pubkey[:], pkBytes)
-	limOrder.Order.TradingPair = *lo.pair
-	limOrder.Order.Side = *sideReceiver
-	limOrder.Price = thisPrice
+	copy(foundOrder.Order.Pubkey[:], pkBytes)
+	foundOrder.Order.TradingPair = *lo.pair
+	foundOrder.Order.Side = *sideReceiver
+	foundOrder.Price = thisPrice
+	limOrder = foundOrder
+	return
+}
+
+// archiveOrder adds an order to the archive with the amounts it was placed with, which are the
+// amounts it has left plus its fills. This does not take it out of the orderbook.
+func (lo *SQLLimitOrderbook) archiveOrder(tx *sql.Tx, lp *match.LimitOrderIDPair, status match.OrderStatus, closedAt time.Time) (err error) {
+	var fills []*match.OrderFill
+	if fills, err = getFills(tx, lo.dialect, lo.archiveSchema, lo.pair, lp.OrderID); err != nil {
+		return
+	}
+	filledWant, filledHave := match.FilledAmounts(fills)
+
+	insertArchivedQuery := fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);", lo.dialect.tableName(lo.archiveSchema, lo.pair.String()))
+	if _, err = tx.Exec(lo.dialect.bind(insertArchivedQuery), hexArg(lp.Order.Pubkey), hexArg(lp.OrderID[:]), lp.Order.Side.String(), lp.Price, lp.Order.AmountHave+filledHave, lp.Order.AmountWant+filledWant, lp.Timestamp.Format(sqlTimeFormat), lp.Order.SubAccount, lp.Order.Swap, string(status), closedAt.UnixNano()); err != nil {
+		err = fmt.Errorf("Error inserting archived order %x: %s", lp.OrderID[:], err)
+		return
+	}
 	return
 }
 
@@ -370,21 +418,15 @@ func (lo *SQLLimitOrderbook) CalculatePrice() (price float64, err error) {
 		err = tx.Commit()
 	}()
 
-	// First use the order schema
-	if _, err = tx.Exec("USE " + lo.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using order schema for limit CalculatePrice: %s", err)
-		return
-	}
-
 	sellSide := new(match.Side)
 	buySide := new(match.Side)
 	*sellSide = match.Sell
 	*buySide = match.Buy
 	// First get the max buy price and max sell price
 	var maxSellRow *sql.Row
-	getMaxSellPrice := fmt.Sprintf("SELECT MAX(price) FROM %s WHERE side='%s';", lo.pair.String(), sellSide.String())
+	getMaxSellPrice := fmt.Sprintf("SELECT MAX(price) FROM %s WHERE side=?;", lo.dialect.tableName(lo.orderSchema, lo.pair.String()))
 	// errors for queryrow are deferred until scan -- this is important, that's why we don't err != nil here
-	maxSellRow = tx.QueryRow(getMaxSellPrice)
+	maxSellRow = tx.QueryRow(lo.dialect.bind(getMaxSellPrice), sellSide.String())
 
 	var maxSell float64
 	if err = maxSellRow.Scan(&maxSell); err != nil {
@@ -393,9 +435,9 @@ func (lo *SQLLimitOrderbook) CalculatePrice() (price float64, err error) {
 	}
 
 	var minBuyRow *sql.Row
-	getminBuyPrice := fmt.Sprintf("SELECT MIN(price) FROM %s WHERE side='%s';", lo.pair.String(), buySide.String())
+	getminBuyPrice := fmt.Sprintf("SELECT MIN(price) FROM %s WHERE side=?;", lo.dialect.tableName(lo.orderSchema, lo.pair.String()))
 	// errors for queryrow are deferred until scan -- this is important, that's why we don't err != nil here
-	minBuyRow = tx.QueryRow(getminBuyPrice)
+	minBuyRow = tx.QueryRow(lo.dialect.bind(getminBuyPrice), buySide.String())
 
 	var minBuy float64
 	if err = minBuyRow.Scan(&minBuy); err != nil {
@@ -407,8 +449,9 @@ func (lo *SQLLimitOrderbook) CalculatePrice() (price float64, err error) {
 	return
 }
 
-// GetOrdersForPubkey gets orders for a specific pubkey.
-func (lo *SQLLimitOrderbook) GetOrdersForPubkey(pubkey *koblitz.PublicKey) (orders map[float64][]*match.LimitOrderIDPair, err error) {
+// GetOrdersForPubkey gets orders for a specific pubkey. If the sub-account is not nil, only orders
+// from that sub-account are returned.
+func (lo *SQLLimitOrderbook) GetOrdersForPubkey(pubkey *koblitz.PublicKey, subAccount *uint32) (orders map[float64][]*match.LimitOrderIDPair, err error) {
 	// Make the book!!!!
 	orders = make(map[float64][]*match.LimitOrderIDPair)
 
@@ -428,14 +471,10 @@ func (lo *SQLLimitOrderbook) GetOrdersForPubkey(pubkey *koblitz.PublicKey) (orde
 		err = tx.Commit()
 	}()
 
-	if _, err = tx.Exec("USE " + lo.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using order schema for GetOrdersForPubkey: %s", err)
-		return
-	}
-
 	var rows *sql.Rows
-	getOrdersQuery := fmt.Sprintf("SELECT pubkey, side, price, orderID, amountHave, amountWant, time FROM %s WHERE pubkey='%x';", lo.pair.String(), pubkey.SerializeCompressed())
-	if rows, err = tx.Query(getOrdersQuery); err != nil {
+	condition, conditionArgs := subAccountCondition(subAccount)
+	getOrdersQuery := fmt.Sprintf("SELECT pubkey, side, price, orderID, amountHave, amountWant, time, subaccount, swap FROM %s WHERE pubkey=?%s;", lo.dialect.tableName(lo.orderSchema, lo.pair.String()), condition)
+	if rows, err = tx.Query(lo.dialect.bind(getOrdersQuery), append([]interface{}{hexArg(pubkey.SerializeCompressed())}, conditionArgs...)...); err != nil {
 		err = fmt.Errorf("Error querying for sell orders for GetOrdersForPubkey: %s", err)
 		return
 	}
@@ -454,7 +493,8 @@ func (lo *SQLLimitOrderbook) GetOrdersForPubkey(pubkey *koblitz.PublicKey) (orde
 		// scan the things we can into this order
 		thisOrder = new(match.LimitOrder)
 		thisOrderPair = new(match.LimitOrderIDPair)
-		if err = rows.Scan(&pkBytes, &sideString, &thisPrice, &hashedOrderBytes, &thisOrder.AmountHave, &thisOrder.AmountWant, &timeString); err != nil {
+		thisOrderPair.OrderID = new(match.OrderID)
+		if err = rows.Scan(&pkBytes, &sideString, &thisPrice, &hashedOrderBytes, &thisOrder.AmountHave, &thisOrder.AmountWant, &timeString, &thisOrder.SubAccount, &thisOrder.Swap); err != nil {
 			err = fmt.Errorf("Error scanning into order for GetOrdersForPubkey: %s", err)
 			return
 		}
@@ -520,13 +560,8 @@ func (lo *SQLLimitOrderbook) ViewLimitOrderBook() (book map[float64][]*match.Lim
 		err = tx.Commit()
 	}()
 
-	if _, err = tx.Exec("USE " + lo.orderSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using order schema for ViewOrderBook: %s", err)
-		return
-	}
-
 	var rows *sql.Rows
-	getOrdersQuery := fmt.Sprintf("SELECT pubkey, side, price, orderID, amountHave, amountWant, time FROM %s;", lo.pair.String())
+	getOrdersQuery := fmt.Sprintf("SELECT pubkey, side, price, orderID, amountHave, amountWant, time, subaccount, swap FROM %s;", lo.dialect.tableName(lo.orderSchema, lo.pair.String()))
 	if rows, err = tx.Query(getOrdersQuery); err != nil {
 		err = fmt.Errorf("Error querying for sell orders for ViewOrderBook: %s", err)
 		return
@@ -546,7 +581,8 @@ func (lo *SQLLimitOrderbook) ViewLimitOrderBook() (book map[float64][]*match.Lim
 		// scan the things we can into this order
 		thisOrder = new(match.LimitOrder)
 		thisOrderPair = new(match.LimitOrderIDPair)
-		if err = rows.Scan(&pkBytes, &sideString, &thisPrice, &hashedOrderBytes, &thisOrder.AmountHave, &thisOrder.AmountWant, &timeString); err != nil {
+		thisOrderPair.OrderID = new(match.OrderID)
+		if err = rows.Scan(&pkBytes, &sideString, &thisPrice, &hashedOrderBytes, &thisOrder.AmountHave, &thisOrder.AmountWant, &timeString, &thisOrder.SubAccount, &thisOrder.Swap); err != nil {
 			err = fmt.Errorf("Error scanning into order for ViewOrderBook: %s", err)
 			return
 		}
@@ -591,6 +627,252 @@ func (lo *SQLLimitOrderbook) ViewLimitOrderBook() (book map[float64][]*match.Lim
 	return
 }
 
+// GetArchivedOrder gets an order that is no longer in the orderbook
+func (lo *SQLLimitOrderbook) GetArchivedOrder(orderID *match.OrderID) (archived *match.ArchivedLimitOrder, err error) {
+	// Transaction so we're acid
+	var tx *sql.Tx
+	if tx, err = lo.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for GetArchivedOrder: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error with GetArchivedOrder: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	getArchivedQuery := fmt.Sprintf("SELECT %s FROM %s WHERE orderID=?;", limitArchiveColumns, lo.dialect.tableName(lo.archiveSchema, lo.pair.String()))
+	if archived, err = lo.scanArchivedOrder(tx.QueryRow(lo.dialect.bind(getArchivedQuery), hexArg(orderID[:]))); err == sql.ErrNoRows {
+		err = fmt.Errorf("Order %x is not in the archive", orderID[:])
+		return
+	} else if err != nil {
+		err = fmt.Errorf("Error scanning archived order for GetArchivedOrder: %s", err)
+		return
+	}
+
+	if archived.Fills, err = getFills(tx, lo.dialect, lo.archiveSchema, lo.pair, orderID); err != nil {
+		err = fmt.Errorf("Error getting fills for GetArchivedOrder: %s", err)
+		return
+	}
+	return
+}
+
+// GetArchivedOrdersForPubkey gets the orders for a pubkey that are no longer in the orderbook, in
+// the order they were closed. If the sub-account is not nil, only orders from that sub-account are
+// returned.
+func (lo *SQLLimitOrderbook) GetArchivedOrdersForPubkey(pubkey *koblitz.PublicKey, subAccount *uint32) (archived []*match.ArchivedLimitOrder, err error) {
+	// Transaction so we're acid
+	var tx *sql.Tx
+	if tx, err = lo.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for GetArchivedOrdersForPubkey: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error with GetArchivedOrdersForPubkey: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var rows *sql.Rows
+	condition, conditionArgs := subAccountCondition(subAccount)
+	getArchivedQuery := fmt.Sprintf("SELECT %s FROM %s WHERE pubkey=?%s ORDER BY closed;", limitArchiveColumns, lo.dialect.tableName(lo.archiveSchema, lo.pair.String()), condition)
+	if rows, err = tx.Query(lo.dialect.bind(getArchivedQuery), append([]interface{}{hexArg(pubkey.SerializeCompressed())}, conditionArgs...)...); err != nil {
+		err = fmt.Errorf("Error querying archived orders for GetArchivedOrdersForPubkey: %s", err)
+		return
+	}
+
+	for rows.Next() {
+		var arc *match.ArchivedLimitOrder
+		if arc, err = lo.scanArchivedOrder(rows); err != nil {
+			rows.Close()
+			err = fmt.Errorf("Error scanning archived order for GetArchivedOrdersForPubkey: %s", err)
+			return
+		}
+		archived = append(archived, arc)
+	}
+
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing rows for GetArchivedOrdersForPubkey: %s", err)
+		return
+	}
+
+	// The rows have to be closed before we can query for the fills
+	for _, arc := range archived {
+		if arc.Fills, err = getFills(tx, lo.dialect, lo.archiveSchema, lo.pair, arc.Order.OrderID); err != nil {
+			err = fmt.Errorf("Error getting fills for GetArchivedOrdersForPubkey: %s", err)
+			return
+		}
+	}
+	return
+}
+
+// ViewArchive gets every order that is no longer in the orderbook, in the order they were closed
+func (lo *SQLLimitOrderbook) ViewArchive() (archived []*match.ArchivedLimitOrder, err error) {
+	// Transaction so we're acid
+	var tx *sql.Tx
+	if tx, err = lo.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for ViewArchive: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error with ViewArchive: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var rows *sql.Rows
+	getArchivedQuery := fmt.Sprintf("SELECT %s FROM %s ORDER BY closed;", limitArchiveColumns, lo.dialect.tableName(lo.archiveSchema, lo.pair.String()))
+	if rows, err = tx.Query(getArchivedQuery); err != nil {
+		err = fmt.Errorf("Error querying archived orders for ViewArchive: %s", err)
+		return
+	}
+
+	for rows.Next() {
+		var arc *match.ArchivedLimitOrder
+		if arc, err = lo.scanArchivedOrder(rows); err != nil {
+			rows.Close()
+			err = fmt.Errorf("Error scanning archived order for ViewArchive: %s", err)
+			return
+		}
+		archived = append(archived, arc)
+	}
+
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing rows for ViewArchive: %s", err)
+		return
+	}
+
+	// The rows have to be closed before we can query for the fills
+	for _, arc := range archived {
+		if arc.Fills, err = getFills(tx, lo.dialect, lo.archiveSchema, lo.pair, arc.Order.OrderID); err != nil {
+			err = fmt.Errorf("Error getting fills for ViewArchive: %s", err)
+			return
+		}
+	}
+	return
+}
+
+// RestoreArchivedOrder puts an order into the archive as it was archived, with its fills
+func (lo *SQLLimitOrderbook) RestoreArchivedOrder(archived *match.ArchivedLimitOrder) (err error) {
+	// Transaction so we're acid
+	var tx *sql.Tx
+	if tx, err = lo.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for RestoreArchivedOrder: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error with RestoreArchivedOrder: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	lp := archived.Order
+	for _, fill := range archived.Fills {
+		if err = insertFill(tx, lo.dialect, lo.archiveSchema, lo.pair, lp.OrderID, fill); err != nil {
+			err = fmt.Errorf("Error restoring fill for RestoreArchivedOrder: %s", err)
+			return
+		}
+	}
+
+	// The archived amounts are already the ones the order was placed with
+	insertArchivedQuery := fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);", lo.dialect.tableName(lo.archiveSchema, lo.pair.String()))
+	if _, err = tx.Exec(lo.dialect.bind(insertArchivedQuery), hexArg(lp.Order.Pubkey), hexArg(lp.OrderID[:]), lp.Order.Side.String(), lp.Price, lp.Order.AmountHave, lp.Order.AmountWant, lp.Timestamp.Format(sqlTimeFormat), lp.Order.SubAccount, lp.Order.Swap, string(archived.Status), archived.ClosedAt.UnixNano()); err != nil {
+		err = fmt.Errorf("Error inserting archived order %x for RestoreArchivedOrder: %s", lp.OrderID[:], err)
+		return
+	}
+	return
+}
+
+// PruneArchive deletes the archived orders that were closed before the cutoff, along with their
+// fills
+func (lo *SQLLimitOrderbook) PruneArchive(before time.Time) (pruned uint64, err error) {
+	// Transaction so we're acid
+	var tx *sql.Tx
+	if tx, err = lo.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for PruneArchive: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error with PruneArchive: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if pruned, err = pruneArchive(tx, lo.dialect, lo.archiveSchema, lo.pair, "orderID", before); err != nil {
+		err = fmt.Errorf("Error pruning archive for PruneArchive: %s", err)
+		return
+	}
+	return
+}
+
+// limitArchiveColumns are the columns scanArchivedOrder scans, in order
+const limitArchiveColumns = "pubkey, side, price, orderID, amountHave, amountWant, time, subaccount, swap, status, closed"
+
+// scanArchivedOrder scans a row of limitArchiveColumns into an archived order, without its fills.
+// Errors from the row, like sql.ErrNoRows, are returned as they are.
+func (lo *SQLLimitOrderbook) scanArchivedOrder(row interface{ Scan(...interface{}) error }) (archived *match.ArchivedLimitOrder, err error) {
+	lp := &match.LimitOrderIDPair{
+		OrderID: new(match.OrderID),
+		Order:   new(match.LimitOrder),
+	}
+
+	var pkBytes []byte
+	var hashedOrderBytes []byte
+	var sideString string
+	var timeString string
+	var statusString string
+	var closed int64
+	if err = row.Scan(&pkBytes, &sideString, &lp.Price, &hashedOrderBytes, &lp.Order.AmountHave, &lp.Order.AmountWant, &timeString, &lp.Order.SubAccount, &lp.Order.Swap, &statusString, &closed); err != nil {
+		return
+	}
+
+	if lp.Timestamp, err = time.Parse(sqlTimeFormat, timeString); err != nil {
+		err = fmt.Errorf("Error parsing timestamp for archived order: %s", err)
+		return
+	}
+	if err = lp.Order.Side.FromString(sideString); err != nil {
+		err = fmt.Errorf("Error getting side from string for archived order: %s", err)
+		return
+	}
+	if pkBytes, err = hex.DecodeString(string(pkBytes)); err != nil {
+		err = fmt.Errorf("Error decoding pubkey for archived order: %s", err)
+		return
+	}
+	if err = lp.OrderID.UnmarshalText(hashedOrderBytes); err != nil {
+		err = fmt.Errorf("Error unmarshalling order ID for archived order: %s", err)
+		return
+	}
+	copy(lp.Order.Pubkey[:], pkBytes)
+	lp.Order.TradingPair = *lo.pair
+
+	archived = &match.ArchivedLimitOrder{
+		Order:    lp,
+		Status:   match.OrderStatus(statusString),
+		ClosedAt: time.Unix(0, closed),
+	}
+	return
+}
+
 // CreateLimitOrderbookMap creates a map of pair to deposit store, given a list of pairs.
 func CreateLimitOrderbookMap(pairList []*match.Pair) (orderbookMap map[match.Pair]match.LimitOrderbook, err error) {
 
@@ -0,0 +1,168 @@
+package cxdbsql
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+)
+
+const (
+	// schemaVersionTable is the table in each store schema that records which schema version
+	// every other table in the schema is at
+	schemaVersionTable = "schema_versions"
+
+	// schemaVersionSchema is the columns for the schema version table
+	schemaVersionSchema = "tablename VARCHAR(128) PRIMARY KEY, version INT(32) UNSIGNED"
+)
+
+// migration is one change to the columns of a kind of table. The migrations for a kind of table
+// are kept oldest first, and the version of each is one more than the one before it.
+type migration struct {
+	// version is the schema version a table is at once the migration is done
+	version uint64
+	// description says what the migration changes
+	description string
+	// queries are the queries that do the migration on a table in a store schema
+	queries func(dialect sqlDialect, schema string, table string) (queries []string)
+}
+
+// baselineMigration is the first migration for every kind of table, which creates the table with
+// the columns if it does not exist. The columns have to be the ones the table had before versions
+// were recorded, since tables from then already exist, and for them this only records that
+// they're at the first version. Every change since then is a migration after this one.
+func baselineMigration(columns string) (baseline migration) {
+	baseline = migration{
+		version:     1,
+		description: "baseline",
+		queries: func(dialect sqlDialect, schema string, table string) (queries []string) {
+			return dialect.createTableQueries(schema, table, columns)
+		},
+	}
+	return
+}
+
+// addColumnsMigration is a migration that adds columns to a table. Rows from before the
+// migration get the default for each column, so columns that are scanned into anything other
+// than a nullable type need one.
+func addColumnsMigration(version uint64, description string, columns ...string) (addColumns migration) {
+	addColumns = migration{
+		version:     version,
+		description: description,
+		queries: func(dialect sqlDialect, schema string, table string) (queries []string) {
+			for _, column := range columns {
+				queries = append(queries, dialect.addColumnQuery(schema, table, column))
+			}
+			return
+		},
+	}
+	return
+}
+
+// modifyColumnMigration is a migration that changes the type of a column in a table
+func modifyColumnMigration(version uint64, description string, column string, columnType string) (modifyColumn migration) {
+	modifyColumn = migration{
+		version:     version,
+		description: description,
+		queries: func(dialect sqlDialect, schema string, table string) (queries []string) {
+			return dialect.modifyColumnQueries(schema, table, column, columnType)
+		},
+	}
+	return
+}
+
+// rebuildTableMigration is a migration for changes not every database can make to a table in
+// place, like changing its primary key. It creates a new table with the columns, copies the
+// copyColumns of every row into it, and then replaces the old table with the new one.
+func rebuildTableMigration(version uint64, description string, columns string, copyColumns string) (rebuild migration) {
+	rebuild = migration{
+		version:     version,
+		description: description,
+		queries: func(dialect sqlDialect, schema string, table string) (queries []string) {
+			rebuildTable := table + "_rebuild"
+			queries = dialect.createTableQueries(schema, rebuildTable, columns)
+			queries = append(queries,
+				fmt.Sprintf("INSERT INTO %s (%s) SELECT %[2]s FROM %s;", dialect.tableName(schema, rebuildTable), copyColumns, dialect.tableName(schema, table)),
+				fmt.Sprintf("DROP TABLE %s;", dialect.tableName(schema, table)),
+				dialect.renameTableQuery(schema, rebuildTable, table),
+			)
+			return
+		},
+	}
+	return
+}
+
+// identifierPattern is what schema and table names are allowed to look like. Those are the only
+// things that go into query text rather than being arguments, so they can't be anything else.
+var identifierPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// checkIdentifier returns an error if the name can't be used as a schema or table name
+func checkIdentifier(name string) (err error) {
+	if !identifierPattern.MatchString(name) {
+		err = fmt.Errorf("%q can't be used as a schema or table name, it can only have letters, digits, and underscores", name)
+		return
+	}
+	return
+}
+
+// migrateTable brings a table in a store schema up to the newest of the migrations, doing every
+// migration newer than the version recorded for it in order, and recording each as it's done.
+// If the table is at a version newer than all of the migrations, it was migrated by a newer
+// version of opencx, and we can't use it, so this returns an error without changing anything.
+func migrateTable(tx *sql.Tx, dialect sqlDialect, schema string, table string, migrations []migration) (err error) {
+	if len(migrations) == 0 {
+		err = fmt.Errorf("Error, no migrations for table %s for migrateTable", table)
+		return
+	}
+
+	for _, name := range []string{schema, table} {
+		if err = checkIdentifier(name); err != nil {
+			err = fmt.Errorf("Error checking names for migrateTable: %s", err)
+			return
+		}
+	}
+
+	// Create the schema if the database has them, and the version table
+	for _, createTableQuery := range dialect.createTableQueries(schema, schemaVersionTable, schemaVersionSchema) {
+		if _, err = tx.Exec(createTableQuery); err != nil {
+			err = fmt.Errorf("Error creating schema version table for migrateTable: %s", err)
+			return
+		}
+	}
+
+	// If there's no version recorded then nothing has been done, not even the baseline
+	var currentVersion uint64
+	getVersionQuery := fmt.Sprintf("SELECT version FROM %s WHERE tablename=?;", dialect.tableName(schema, schemaVersionTable))
+	if err = tx.QueryRow(dialect.bind(getVersionQuery), table).Scan(&currentVersion); err == sql.ErrNoRows {
+		currentVersion = 0
+		err = nil
+	} else if err != nil {
+		err = fmt.Errorf("Error getting schema version for migrateTable: %s", err)
+		return
+	}
+
+	if latestVersion := migrations[len(migrations)-1].version; currentVersion > latestVersion {
+		err = fmt.Errorf("Error, table %s is at schema version %d but the newest version we know of is %d, so it was made by a newer version of opencx. Please upgrade", dialect.tableName(schema, table), currentVersion, latestVersion)
+		return
+	}
+
+	setVersionQuery := fmt.Sprintf("INSERT INTO %s (tablename, version) VALUES (?, ?) %s;", dialect.tableName(schema, schemaVersionTable), dialect.onConflictUpdate("tablename", "version=?"))
+	for _, currMigration := range migrations {
+		if currMigration.version <= currentVersion {
+			continue
+		}
+
+		for _, migrationQuery := range currMigration.queries(dialect, schema, table) {
+			if _, err = tx.Exec(migrationQuery); err != nil {
+				err = fmt.Errorf("Error doing migration %d (%s) on %s for migrateTable: %s", currMigration.version, currMigration.description, dialect.tableName(schema, table), err)
+				return
+			}
+		}
+
+		if _, err = tx.Exec(dialect.bind(setVersionQuery), table, currMigration.version, currMigration.version); err != nil {
+			err = fmt.Errorf("Error recording schema version for migrateTable: %s", err)
+			return
+		}
+		currentVersion = currMigration.version
+	}
+	return
+}
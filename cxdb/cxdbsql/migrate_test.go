@@ -0,0 +1,292 @@
+package cxdbsql
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/match"
+)
+
+// migrateInTx runs migrateTable in its own transaction, the way the stores do when they set up
+func migrateInTx(handler *sql.DB, dialect sqlDialect, schema string, table string, migrations []migration) (err error) {
+	var tx *sql.Tx
+	if tx, err = handler.Begin(); err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = migrateTable(tx, dialect, schema, table, migrations)
+	return
+}
+
+func TestMigrateTable(t *testing.T) {
+	var err error
+
+	var tc *testerContainer
+	if tc, err = CreateTesterContainer(); err != nil {
+		t.Errorf("Error creating tester container: %s", err)
+		return
+	}
+
+	defer func() {
+		if err = tc.Kill(); err != nil {
+			t.Errorf("Error killing tester container: %s", err)
+			return
+		}
+	}()
+
+	var dialect sqlDialect
+	if dialect, err = newDialect(testConfig()); err != nil {
+		t.Errorf("Error creating dialect for TestMigrateTable: %s", err)
+		return
+	}
+
+	var handler *sql.DB
+	if handler, err = dialect.open(); err != nil {
+		t.Errorf("Error opening db for TestMigrateTable: %s", err)
+		return
+	}
+	defer handler.Close()
+
+	schema := testConfig().OrderSchemaName
+	table := "migratetest"
+	baseline := baselineMigration("id INT(32) UNSIGNED, name TEXT")
+	addNote := migration{
+		version:     2,
+		description: "add note",
+		queries: func(dialect sqlDialect, schema string, table string) (queries []string) {
+			return []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN note TEXT;", dialect.tableName(schema, table))}
+		},
+	}
+
+	if err = migrateInTx(handler, dialect, schema, table, []migration{baseline}); err != nil {
+		t.Errorf("Error doing baseline migration: %s", err)
+		return
+	}
+	insertQuery := fmt.Sprintf("INSERT INTO %s (id, name) VALUES (?, ?);", dialect.tableName(schema, table))
+	if _, err = handler.Exec(dialect.bind(insertQuery), 1, "before"); err != nil {
+		t.Errorf("Error inserting into baseline table: %s", err)
+		return
+	}
+
+	// Doing the second migration should keep the row, and running them all again should do nothing,
+	// since adding the column twice would fail.
+	for i := 0; i < 2; i++ {
+		if err = migrateInTx(handler, dialect, schema, table, []migration{baseline, addNote}); err != nil {
+			t.Errorf("Error migrating to version 2 (run %d): %s", i, err)
+			return
+		}
+	}
+
+	var note sql.NullString
+	selectQuery := fmt.Sprintf("SELECT note FROM %s WHERE id=? AND name=?;", dialect.tableName(schema, table))
+	if err = handler.QueryRow(dialect.bind(selectQuery), 1, "before").Scan(&note); err != nil {
+		t.Errorf("Error selecting migrated row: %s", err)
+		return
+	}
+	if note.Valid {
+		t.Errorf("Expected no note for a row from before the migration, got %s", note.String)
+		return
+	}
+
+	var version uint64
+	versionQuery := fmt.Sprintf("SELECT version FROM %s WHERE tablename=?;", dialect.tableName(schema, schemaVersionTable))
+	if err = handler.QueryRow(dialect.bind(versionQuery), table).Scan(&version); err != nil {
+		t.Errorf("Error getting recorded version: %s", err)
+		return
+	}
+	if version != 2 {
+		t.Errorf("Expected table to be at version 2, got %d", version)
+		return
+	}
+
+	// Something that only knows about the baseline can't use the table anymore
+	if err = migrateInTx(handler, dialect, schema, table, []migration{baseline}); err == nil {
+		t.Errorf("Migrating a table at a newer version should have failed")
+		return
+	}
+
+	if err = migrateInTx(handler, dialect, schema, "bad; DROP TABLE migratetest", []migration{baseline}); err == nil {
+		t.Errorf("Migrating a table with a bad name should have failed")
+		return
+	}
+	return
+}
+
+// TestMigrateBaselineTables makes tables with the columns opencx had before schema versions were
+// recorded, then makes sure the stores migrate them and can still use the rows in them.
+func TestMigrateBaselineTables(t *testing.T) {
+	var err error
+
+	var tc *testerContainer
+	if tc, err = CreateTesterContainer(); err != nil {
+		t.Errorf("Error creating tester container: %s", err)
+		return
+	}
+
+	defer func() {
+		if err = tc.Kill(); err != nil {
+			t.Errorf("Error killing tester container: %s", err)
+			return
+		}
+	}()
+
+	conf := testConfig()
+	var dialect sqlDialect
+	if dialect, err = newDialect(conf); err != nil {
+		t.Errorf("Error creating dialect for TestMigrateBaselineTables: %s", err)
+		return
+	}
+
+	var handler *sql.DB
+	if handler, err = dialect.open(); err != nil {
+		t.Errorf("Error opening db for TestMigrateBaselineTables: %s", err)
+		return
+	}
+	defer handler.Close()
+
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key for TestMigrateBaselineTables: %s", err)
+		return
+	}
+	var pubkey [33]byte
+	copy(pubkey[:], privkey.PubKey().SerializeCompressed())
+
+	coin := &coinparam.RegressionNetParams
+	pair := &testLimitOrder.TradingPair
+	oldTables := []struct {
+		schema  string
+		table   string
+		columns string
+		insert  string
+		args    []interface{}
+	}{
+		{conf.BalanceSchemaName, coin.Name, settlementEngineSchema, "(pubkey, balance) VALUES (?, ?)", []interface{}{hexArg(pubkey[:]), 1000}},
+		{conf.PendingDepositSchemaName, coin.Name, pendingDepositStoreSchema, "(pubkey, expectedConfirmHeight, depositHeight, amount, txid) VALUES (?, ?, ?, ?, ?)", []interface{}{hexArg(pubkey[:]), 106, 100, 5000, hex.EncodeToString([]byte("oldtxid"))}},
+		{conf.OrderSchemaName, pair.String(), limitEngineSchema, "(pubkey, orderID, side, price, amountHave, amountWant, time) VALUES (?, ?, ?, ?, ?, ?, ?)", []interface{}{hexArg(pubkey[:]), "oldorder", "buy", 1.0, 10, 10, time.Now().UTC().Format(sqlTimeFormat)}},
+	}
+	for _, old := range oldTables {
+		queries := dialect.createTableQueries(old.schema, old.table, old.columns)
+		queries = append(queries, fmt.Sprintf("INSERT INTO %s %s;", dialect.tableName(old.schema, old.table), old.insert))
+		for i, query := range queries {
+			var args []interface{}
+			if i == len(queries)-1 {
+				args = old.args
+			}
+			if _, err = handler.Exec(dialect.bind(query), args...); err != nil {
+				t.Errorf("Error creating baseline table %s: %s", old.table, err)
+				return
+			}
+		}
+	}
+
+	// The old balance is the main account's, and other sub-accounts can have balances now
+	var se *SQLSettlementEngine
+	if se, err = CreateSettlementEngineStructWithConf(coin, testConfig()); err != nil {
+		t.Errorf("Error creating settlement engine on baseline tables: %s", err)
+		return
+	}
+	defer se.DBHandler.Close()
+
+	asset, _ := match.AssetFromCoinParam(coin)
+	for _, subaccount := range []uint32{0, 1} {
+		var setRes *match.SettlementResult
+		if setRes, err = se.ApplySettlementExecution(&match.SettlementExecution{Pubkey: pubkey, SubAccount: subaccount, Amount: 500, Asset: asset, Type: match.Debit}); err != nil {
+			t.Errorf("Error debiting sub-account %d of migrated balance: %s", subaccount, err)
+			return
+		}
+		if expected := 1500 - 1000*uint64(subaccount); setRes.NewBal != expected {
+			t.Errorf("Expected sub-account %d to have %d after debit, got %d", subaccount, expected, setRes.NewBal)
+			return
+		}
+	}
+
+	// The old deposit is still pending, gets credited, and can't be swept since we don't know its output
+	var ds *SQLDepositStore
+	if ds, err = CreateDepositStoreStructWithConf(coin, testConfig()); err != nil {
+		t.Errorf("Error creating deposit store on baseline tables: %s", err)
+		return
+	}
+	defer ds.DestroyHandler()
+
+	var deposits []*match.Deposit
+	if deposits, err = ds.GetPendingDeposits(privkey.PubKey()); err != nil {
+		t.Errorf("Error getting migrated pending deposits: %s", err)
+		return
+	}
+	if len(deposits) != 1 || deposits[0].Amount != 5000 || deposits[0].Txid != "oldtxid" {
+		t.Errorf("Expected the old pending deposit after migrating, got %d deposits", len(deposits))
+		return
+	}
+
+	var execs []*match.SettlementExecution
+	if execs, err = ds.UpdateDeposits([]match.Deposit{}, 106); err != nil {
+		t.Errorf("Error crediting migrated deposit: %s", err)
+		return
+	}
+	if len(execs) != 1 || execs[0].Amount != 5000 {
+		t.Errorf("Expected the old deposit to be credited, got %d execs", len(execs))
+		return
+	}
+
+	if deposits, err = ds.GetSweepableDeposits(); err != nil {
+		t.Errorf("Error getting sweepable deposits after migrating: %s", err)
+		return
+	}
+	if len(deposits) != 0 {
+		t.Errorf("Deposits from before outputs were stored should not be sweepable, got %d", len(deposits))
+		return
+	}
+
+	// The old order is a main account order that isn't a swap
+	var le *SQLLimitEngine
+	if le, err = CreateLimEngineStructWithConf(pair, testConfig()); err != nil {
+		t.Errorf("Error creating limit engine on baseline tables: %s", err)
+		return
+	}
+	defer le.DestroyHandler()
+
+	var subaccount uint32
+	var swap bool
+	selectQuery := fmt.Sprintf("SELECT subaccount, swap FROM %s WHERE orderID=?;", dialect.tableName(conf.OrderSchemaName, pair.String()))
+	if err = handler.QueryRow(dialect.bind(selectQuery), "oldorder").Scan(&subaccount, &swap); err != nil {
+		t.Errorf("Error selecting migrated order: %s", err)
+		return
+	}
+	if subaccount != 0 || swap {
+		t.Errorf("Expected migrated order in sub-account 0 and not a swap, got %d and %t", subaccount, swap)
+		return
+	}
+	return
+}
+
+func TestDialectBind(t *testing.T) {
+	query := "SELECT balance FROM balances WHERE pubkey=? AND subaccount=?;"
+
+	if bound := new(postgresDialect).bind(query); bound != "SELECT balance FROM balances WHERE pubkey=$1 AND subaccount=$2;" {
+		t.Errorf("Postgres bind gave %s", bound)
+		return
+	}
+	if bound := new(mysqlDialect).bind(query); bound != query {
+		t.Errorf("MySQL bind should not change the query, gave %s", bound)
+		return
+	}
+	if bound := new(sqliteDialect).bind(query); bound != query {
+		t.Errorf("SQLite bind should not change the query, gave %s", bound)
+		return
+	}
+	return
+}
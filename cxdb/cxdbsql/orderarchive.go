@@ -0,0 +1,102 @@
+package cxdbsql
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/opencx/match"
+)
+
+// The schemas for the order archives. The archive for a pair has the same columns as its
+// orderbook, with the amounts the order was placed with, and what happened to the order. Fills are
+// kept in their own table for the pair in the same schema, from when the order is first filled.
+// Times are kept as unix nanoseconds like the ledger, so the order things happened in is kept.
+const (
+	limitArchiveSchema   = "pubkey VARBINARY(66), orderID VARBINARY(64), side TEXT, price DOUBLE(30,2) UNSIGNED, amountHave BIGINT(64), amountWant BIGINT(64), time TIMESTAMP, subaccount INT UNSIGNED NOT NULL DEFAULT 0, swap BOOLEAN NOT NULL DEFAULT FALSE, status VARCHAR(32), closed BIGINT(64), PRIMARY KEY (orderID)"
+	auctionArchiveSchema = "pubkey VARBINARY(66), side TEXT, price DOUBLE(30, 2) UNSIGNED, amountHave BIGINT(64), amountWant BIGINT(64), auctionID VARBINARY(64), nonce VARBINARY(4), sig BLOB, hashedOrder VARBINARY(64), status VARCHAR(32), closed BIGINT(64), PRIMARY KEY (hashedOrder)"
+	orderFillsSchema     = "fillid BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY, orderID VARBINARY(64), amountWant BIGINT(64), amountHave BIGINT(64), time BIGINT(64), INDEX (orderID)"
+)
+
+// The schema versions of the order archives, oldest first
+var (
+	limitArchiveMigrations = []migration{
+		baselineMigration(limitArchiveSchema),
+	}
+	auctionArchiveMigrations = []migration{
+		baselineMigration(auctionArchiveSchema),
+	}
+	orderFillsMigrations = []migration{
+		baselineMigration(orderFillsSchema),
+	}
+)
+
+// fillsTable is the name of the table for the fills of orders for a pair, which is in the same
+// schema as the archive for the pair
+func fillsTable(pair *match.Pair) (table string) {
+	return pair.String() + "_fills"
+}
+
+// insertFill adds a fill for an order to the fills table
+func insertFill(tx *sql.Tx, dialect sqlDialect, schema string, pair *match.Pair, orderID *match.OrderID, fill *match.OrderFill) (err error) {
+	insertFillQuery := fmt.Sprintf("INSERT INTO %s (orderID, amountWant, amountHave, time) VALUES (?, ?, ?, ?);", dialect.tableName(schema, fillsTable(pair)))
+	if _, err = tx.Exec(dialect.bind(insertFillQuery), hexArg(orderID), fill.AmountWant, fill.AmountHave, fill.Time.UnixNano()); err != nil {
+		err = fmt.Errorf("Error inserting fill for order %x: %s", orderID[:], err)
+		return
+	}
+	return
+}
+
+// getFills gets the fills for an order from the fills table, in the order they happened
+func getFills(tx *sql.Tx, dialect sqlDialect, schema string, pair *match.Pair, orderID *match.OrderID) (fills []*match.OrderFill, err error) {
+	var rows *sql.Rows
+	getFillsQuery := fmt.Sprintf("SELECT amountWant, amountHave, time FROM %s WHERE orderID=? ORDER BY fillid;", dialect.tableName(schema, fillsTable(pair)))
+	if rows, err = tx.Query(dialect.bind(getFillsQuery), hexArg(orderID)); err != nil {
+		err = fmt.Errorf("Error querying fills for order %x: %s", orderID[:], err)
+		return
+	}
+
+	for rows.Next() {
+		fill := new(match.OrderFill)
+		var fillTime int64
+		if err = rows.Scan(&fill.AmountWant, &fill.AmountHave, &fillTime); err != nil {
+			rows.Close()
+			err = fmt.Errorf("Error scanning fill for order %x: %s", orderID[:], err)
+			return
+		}
+		fill.Time = time.Unix(0, fillTime)
+		fills = append(fills, fill)
+	}
+
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing fill rows: %s", err)
+		return
+	}
+	return
+}
+
+// pruneArchive deletes the orders in the archive for a pair that were closed before the cutoff,
+// along with their fills. idColumn is the column the archive keeps order IDs in.
+func pruneArchive(tx *sql.Tx, dialect sqlDialect, schema string, pair *match.Pair, idColumn string, before time.Time) (pruned uint64, err error) {
+	archiveTable := dialect.tableName(schema, pair.String())
+	deleteFillsQuery := fmt.Sprintf("DELETE FROM %s WHERE orderID IN (SELECT %s FROM %s WHERE closed<?);", dialect.tableName(schema, fillsTable(pair)), idColumn, archiveTable)
+	if _, err = tx.Exec(dialect.bind(deleteFillsQuery), before.UnixNano()); err != nil {
+		err = fmt.Errorf("Error deleting fills of pruned orders: %s", err)
+		return
+	}
+
+	var res sql.Result
+	deleteArchivedQuery := fmt.Sprintf("DELETE FROM %s WHERE closed<?;", archiveTable)
+	if res, err = tx.Exec(dialect.bind(deleteArchivedQuery), before.UnixNano()); err != nil {
+		err = fmt.Errorf("Error deleting pruned orders: %s", err)
+		return
+	}
+
+	var rowsAffected int64
+	if rowsAffected, err = res.RowsAffected(); err != nil {
+		err = fmt.Errorf("Error getting rows affected for pruned orders: %s", err)
+		return
+	}
+	pruned = uint64(rowsAffected)
+	return
+}
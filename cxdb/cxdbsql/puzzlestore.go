@@ -4,9 +4,7 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
-	"net"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/mit-dci/opencx/cxdb"
 	"github.com/mit-dci/opencx/match"
 )
@@ -15,12 +13,8 @@ import (
 type SQLPuzzleStore struct {
 	DBHandler *sql.DB
 
-	// db username
-	dbUsername string
-	dbPassword string
-
-	// db host and port
-	dbAddr net.Addr
+	// the sql database we are using
+	dialect sqlDialect
 
 	// puzzle schema name
 	puzzleSchema string
@@ -36,28 +30,40 @@ const (
 	puzzleStoreSchema = "encodedOrder TEXT, auctionID VARBINARY(64), selected BOOLEAN"
 )
 
+// The schema versions of the puzzle store, oldest first
+var puzzleStoreMigrations = []migration{
+	baselineMigration(puzzleStoreSchema),
+}
+
 // CreatePuzzleStore creates a puzzle store for a specific coin.
 func CreatePuzzleStore(pair *match.Pair) (store cxdb.PuzzleStore, err error) {
 
 	conf := new(dbsqlConfig)
 	*conf = *defaultConf
 
+	if store, err = CreatePuzzleStoreWithConf(pair, conf); err != nil {
+		err = fmt.Errorf("Error creating puzzle store with conf for CreatePuzzleStore: %s", err)
+		return
+	}
+	return
+}
+
+// CreatePuzzleStoreWithConf creates a puzzle store for a specific pair, using the database in conf
+func CreatePuzzleStoreWithConf(pair *match.Pair, conf *dbsqlConfig) (store cxdb.PuzzleStore, err error) {
 	// Set the default conf
 	dbConfigSetup(conf)
 
-	// Resolve new address
-	var addr net.Addr
-	if addr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(conf.DBHost, fmt.Sprintf("%d", conf.DBPort))); err != nil {
-		err = fmt.Errorf("Couldn't resolve db address for CreateSQLPuzzleStore: %s", err)
+	// Get the dialect for the database we are using
+	var dialect sqlDialect
+	if dialect, err = newDialect(conf); err != nil {
+		err = fmt.Errorf("Couldn't create sql dialect for CreateSQLPuzzleStore: %s", err)
 		return
 	}
 
 	// Set values
 	sp := &SQLPuzzleStore{
-		dbUsername:   conf.DBUsername,
-		dbPassword:   conf.DBPassword,
+		dialect:      dialect,
 		puzzleSchema: conf.PuzzleSchemaName,
-		dbAddr:       addr,
 		pair:         pair,
 	}
 
@@ -66,19 +72,12 @@ func CreatePuzzleStore(pair *match.Pair) (store cxdb.PuzzleStore, err error) {
 		return
 	}
 
-	// Now connect to the database and create the schemas / tables
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", sp.dbUsername, sp.dbPassword, sp.dbAddr.Network(), sp.dbAddr.String())
-	if sp.DBHandler, err = sql.Open("mysql", openString); err != nil {
+	// Now connect to the database
+	if sp.DBHandler, err = sp.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for CreateSQLPuzzleStore: %s", err)
 		return
 	}
 
-	// Make sure we can actually connect
-	if err = sp.DBHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
-		return
-	}
-
 	// Now we actually set the engine
 	store = sp
 	return
@@ -106,16 +105,10 @@ func (sp *SQLPuzzleStore) ViewAuctionPuzzleBook(auctionID *match.AuctionID) (puz
 		err = tx.Commit()
 	}()
 
-	// First use the order schema
-	if _, err = tx.Exec("USE " + sp.puzzleSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using puzzle schema for ViewAuctionPuzzleBook: %s", err)
-		return
-	}
-
 	var serializedPuzzle []byte
 	var rows *sql.Rows
-	getPuzzleBookQuery := fmt.Sprintf("SELECT encodedOrder FROM %s WHERE auctionID='%x' AND selected='%t';", sp.pair.String(), auctionID[:], true)
-	if rows, err = tx.Query(getPuzzleBookQuery); err != nil {
+	getPuzzleBookQuery := fmt.Sprintf("SELECT encodedOrder FROM %s WHERE auctionID=? AND selected=?;", sp.dialect.tableName(sp.puzzleSchema, sp.pair.String()))
+	if rows, err = tx.Query(sp.dialect.bind(getPuzzleBookQuery), hexArg(auctionID[:]), true); err != nil {
 		err = fmt.Errorf("Error querying for puzzles for ViewAuctionPuzzleBook: %s", err)
 		return
 	}
@@ -138,7 +131,7 @@ func (sp *SQLPuzzleStore) ViewAuctionPuzzleBook(auctionID *match.AuctionID) (puz
 			err = fmt.Errorf("Error deserializing current puzzle for ViewAuctionPuzzleBook: %s", err)
 			return
 		}
-
+		puzzles = append(puzzles, currPuzzle)
 	}
 	if err = rows.Close(); err != nil {
 		err = fmt.Errorf("Error closing rows for ViewAuctionPuzzleBook: %s", err)
@@ -148,6 +141,55 @@ func (sp *SQLPuzzleStore) ViewAuctionPuzzleBook(auctionID *match.AuctionID) (puz
 	return
 }
 
+// ViewAuctionIDs returns the ID of every auction that has puzzles in the store
+func (sp *SQLPuzzleStore) ViewAuctionIDs() (auctionIDs []*match.AuctionID, err error) {
+	// ACID
+	var tx *sql.Tx
+	if tx, err = sp.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error when beginning transaction for ViewAuctionIDs: %s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error for ViewAuctionIDs: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var auctionIDBytes []byte
+	var rows *sql.Rows
+	getAuctionIDsQuery := fmt.Sprintf("SELECT DISTINCT auctionID FROM %s;", sp.dialect.tableName(sp.puzzleSchema, sp.pair.String()))
+	if rows, err = tx.Query(getAuctionIDsQuery); err != nil {
+		err = fmt.Errorf("Error querying for auction IDs for ViewAuctionIDs: %s", err)
+		return
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(&auctionIDBytes); err != nil {
+			err = fmt.Errorf("Error scanning auction ID for ViewAuctionIDs: %s", err)
+			return
+		}
+
+		if auctionIDBytes, err = hex.DecodeString(string(auctionIDBytes)); err != nil {
+			err = fmt.Errorf("Error decoding hex string auction ID for ViewAuctionIDs: %s", err)
+			return
+		}
+
+		currID := new(match.AuctionID)
+		copy(currID[:], auctionIDBytes)
+		auctionIDs = append(auctionIDs, currID)
+	}
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing rows for ViewAuctionIDs: %s", err)
+		return
+	}
+
+	return
+}
+
 // PlaceAuctionPuzzle puts an encrypted auction order in the datastore.
 func (sp *SQLPuzzleStore) PlaceAuctionPuzzle(puzzledOrder *match.EncryptedAuctionOrder) (err error) {
 	// ACID
@@ -166,12 +208,6 @@ func (sp *SQLPuzzleStore) PlaceAuctionPuzzle(puzzledOrder *match.EncryptedAuctio
 		err = tx.Commit()
 	}()
 
-	// First use the order schema
-	if _, err = tx.Exec("USE " + sp.puzzleSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using puzzle schema for PlaceAuctionPuzzle: %s", err)
-		return
-	}
-
 	var pzOrderBytes []byte
 	if pzOrderBytes, err = puzzledOrder.Serialize(); err != nil {
 		err = fmt.Errorf("Error serializing puzzled order for PlaceAuctionPuzzle: %s", err)
@@ -179,8 +215,8 @@ func (sp *SQLPuzzleStore) PlaceAuctionPuzzle(puzzledOrder *match.EncryptedAuctio
 	}
 
 	defaultSelected := true
-	insertPuzzleQuery := fmt.Sprintf("INSERT INTO %s VALUES ('%x', '%x', %t);", sp.pair.String(), pzOrderBytes, puzzledOrder.IntendedAuction, defaultSelected)
-	if _, err = tx.Exec(insertPuzzleQuery); err != nil {
+	insertPuzzleQuery := fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?);", sp.dialect.tableName(sp.puzzleSchema, sp.pair.String()))
+	if _, err = tx.Exec(sp.dialect.bind(insertPuzzleQuery), hexArg(pzOrderBytes), hexArg(puzzledOrder.IntendedAuction), defaultSelected); err != nil {
 		err = fmt.Errorf("Error placing puzzle into db for PlaceAuctionPuzzle: %s", err)
 		return
 	}
@@ -191,9 +227,8 @@ func (sp *SQLPuzzleStore) PlaceAuctionPuzzle(puzzledOrder *match.EncryptedAuctio
 // This assumes the schema name is set
 func (sp *SQLPuzzleStore) setupPuzzleStoreTables() (err error) {
 
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", sp.dbUsername, sp.dbPassword, sp.dbAddr.Network(), sp.dbAddr.String())
 	var rootHandler *sql.DB
-	if rootHandler, err = sql.Open("mysql", openString); err != nil {
+	if rootHandler, err = sp.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for setup puzzle store tables: %s", err)
 		return
 	}
@@ -201,11 +236,6 @@ func (sp *SQLPuzzleStore) setupPuzzleStoreTables() (err error) {
 	// when we're done close please
 	defer rootHandler.Close()
 
-	if err = rootHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
-		return
-	}
-
 	// We do this in a transaction because it's more than one operation
 	var tx *sql.Tx
 	if tx, err = rootHandler.Begin(); err != nil {
@@ -222,21 +252,9 @@ func (sp *SQLPuzzleStore) setupPuzzleStoreTables() (err error) {
 		err = tx.Commit()
 	}()
 
-	// Now create the schema
-	if _, err = tx.Exec("CREATE SCHEMA IF NOT EXISTS " + sp.puzzleSchema + ";"); err != nil {
-		err = fmt.Errorf("Error creating schema for setup puzzle store tables: %s", err)
-		return
-	}
-
-	// use the schema
-	if _, err = tx.Exec("USE " + sp.puzzleSchema + ";"); err != nil {
-		err = fmt.Errorf("Could not use %s schema: %s", sp.puzzleSchema, err)
-		return
-	}
-
-	createTableQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", sp.pair.String(), puzzleStoreSchema)
-	if _, err = tx.Exec(createTableQuery); err != nil {
-		err = fmt.Errorf("Error creating puzzle store table: %s", err)
+	// Create the table if it does not exist, and bring it up to the newest schema version
+	if err = migrateTable(tx, sp.dialect, sp.puzzleSchema, sp.pair.String(), puzzleStoreMigrations); err != nil {
+		err = fmt.Errorf("Error migrating puzzle store table: %s", err)
 		return
 	}
 	return
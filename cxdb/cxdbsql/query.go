@@ -0,0 +1,31 @@
+package cxdbsql
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Every value in a query goes to the database as an argument, in the place of a ? placeholder that
+// the dialect binds, so database/sql prepares the statement and the value never becomes part of
+// the query text. The only things put into the query text are schema and table names, which
+// migrateTable checks before any of their tables are used.
+
+// hexArg is the argument for a value stored as hex, like pubkeys, order IDs, and transaction IDs.
+// It's formatted the same way these were always stored, so existing rows still match. Pointers,
+// like the *match.OrderID passed to cancels, are formatted as what they point to, since fmt would
+// put an & in front of them.
+func hexArg(value interface{}) (arg string) {
+	if v := reflect.ValueOf(value); v.Kind() == reflect.Ptr && !v.IsNil() {
+		value = v.Elem().Interface()
+	}
+	return fmt.Sprintf("%x", value)
+}
+
+// placeholderList is a list of n placeholders, for queries that check if a value is IN a list
+func placeholderList(n int) (list string) {
+	if n <= 0 {
+		return
+	}
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
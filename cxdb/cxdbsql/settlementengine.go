@@ -3,9 +3,7 @@ package cxdbsql
 import (
 	"database/sql"
 	"fmt"
-	"net"
-
-	_ "github.com/go-sql-driver/mysql"
+	"time"
 
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/opencx/logging"
@@ -15,22 +13,39 @@ import (
 type SQLSettlementEngine struct {
 	DBHandler *sql.DB
 
-	// db username
-	dbUsername string
-	dbPassword string
-
-	// db host and port
-	dbAddr net.Addr
+	// the sql database we are using
+	dialect sqlDialect
 
 	// balance schema name
 	balanceSchema string
 
+	// ledger schema name
+	ledgerSchema string
+
 	// this coin
 	coin *coinparam.Params
 }
 
 const (
+	// settlementEngineSchema is the columns the balance tables were first created with
 	settlementEngineSchema = "pubkey VARBINARY(66), balance BIGINT(64), PRIMARY KEY (pubkey)"
+	// every sub-account of a pubkey has its own balance, sub-account 0 is the main account
+	settlementEngineSubaccountSchema = "pubkey VARBINARY(66), subaccount INT UNSIGNED NOT NULL DEFAULT 0, balance BIGINT(64), PRIMARY KEY (pubkey, subaccount)"
+	// amounts in the ledger are signed, debits are positive and credits are negative. The time is
+	// stored in unix nanoseconds.
+	ledgerSchema = "entryid BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY, time BIGINT(64), account VARCHAR(80), amount BIGINT(64), reason VARCHAR(32), reference TEXT, INDEX (account)"
+)
+
+// The schema versions of the balance and ledger tables, oldest first
+var (
+	settlementEngineMigrations = []migration{
+		baselineMigration(settlementEngineSchema),
+		// the balances from before sub-accounts are the main accounts
+		rebuildTableMigration(2, "add sub-accounts", settlementEngineSubaccountSchema, "pubkey, balance"),
+	}
+	ledgerMigrations = []migration{
+		baselineMigration(ledgerSchema),
+	}
 )
 
 // CreateSettlementEngine creates a settlement engine for a specific coin
@@ -39,22 +54,32 @@ func CreateSettlementEngine(coin *coinparam.Params) (engine match.SettlementEngi
 	conf := new(dbsqlConfig)
 	*conf = *defaultConf
 
+	if engine, err = CreateSettlementEngineStructWithConf(coin, conf); err != nil {
+		err = fmt.Errorf("Error creating settlement engine struct for CreateSettlementEngine: %s", err)
+		return
+	}
+	return
+}
+
+// CreateSettlementEngineStructWithConf creates a settlement engine for a specific coin, but instead of
+// returning an interface, it returns a struct.
+func CreateSettlementEngineStructWithConf(coin *coinparam.Params, conf *dbsqlConfig) (se *SQLSettlementEngine, err error) {
+
 	// Set the default conf
 	dbConfigSetup(conf)
 
-	// Resolve new address
-	var addr net.Addr
-	if addr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(conf.DBHost, fmt.Sprintf("%d", conf.DBPort))); err != nil {
-		err = fmt.Errorf("Couldn't resolve db address for CreateSQLSettlementEngine: %s", err)
+	// Get the dialect for the database we are using
+	var dialect sqlDialect
+	if dialect, err = newDialect(conf); err != nil {
+		err = fmt.Errorf("Couldn't create sql dialect for CreateSQLSettlementEngine: %s", err)
 		return
 	}
 
 	// Set values
-	se := &SQLSettlementEngine{
-		dbUsername:    conf.DBUsername,
-		dbPassword:    conf.DBPassword,
+	se = &SQLSettlementEngine{
+		dialect:       dialect,
 		balanceSchema: conf.BalanceSchemaName,
-		dbAddr:        addr,
+		ledgerSchema:  conf.LedgerSchemaName,
 		coin:          coin,
 	}
 
@@ -63,21 +88,12 @@ func CreateSettlementEngine(coin *coinparam.Params) (engine match.SettlementEngi
 		return
 	}
 
-	// Now connect to the database and create the schemas / tables
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", se.dbUsername, se.dbPassword, se.dbAddr.Network(), se.dbAddr.String())
-	if se.DBHandler, err = sql.Open("mysql", openString); err != nil {
+	// Now connect to the database
+	if se.DBHandler, err = se.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for CreateSQLSettlementEngine: %s", err)
 		return
 	}
 
-	// Make sure we can actually connect
-	if err = se.DBHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
-		return
-	}
-
-	// Now we actually set what we want
-	engine = se
 	return
 }
 
@@ -101,14 +117,20 @@ func (se *SQLSettlementEngine) ApplySettlementExecution(setExec *match.Settlemen
 		err = tx.Commit()
 	}()
 
-	// use balance schema
-	if _, err = tx.Exec("USE " + se.balanceSchema + ";"); err != nil {
+	if setRes, err = se.applyExecutionTx(tx, setExec); err != nil {
 		return
 	}
 
+	return
+}
+
+// applyExecutionTx applies the settlement execution in a transaction, writing the new balance and the
+// ledger entries. A credit bigger than the balance is an error.
+func (se *SQLSettlementEngine) applyExecutionTx(tx *sql.Tx, setExec *match.SettlementExecution) (setRes *match.SettlementResult, err error) {
+
 	var rows *sql.Rows
-	curBalQuery := fmt.Sprintf("SELECT balance FROM %s WHERE pubkey='%x';", se.coin.Name, setExec.Pubkey)
-	if rows, err = tx.Query(curBalQuery); err != nil {
+	curBalQuery := fmt.Sprintf("SELECT balance FROM %s WHERE pubkey=? AND subaccount=?;", se.dialect.tableName(se.balanceSchema, se.coin.Name))
+	if rows, err = tx.Query(se.dialect.bind(curBalQuery), hexArg(setExec.Pubkey), setExec.SubAccount); err != nil {
 		err = fmt.Errorf("Error querying for balance while applying settlement exec: %s", err)
 		return
 	}
@@ -122,7 +144,7 @@ func (se *SQLSettlementEngine) ApplySettlementExecution(setExec *match.Settlemen
 	}
 
 	if err = rows.Close(); err != nil {
-		err = fmt.Errorf("Error closing rows for ApplySettlementExecution: %s", err)
+		err = fmt.Errorf("Error closing rows for applyExecutionTx: %s", err)
 		return
 	}
 
@@ -130,14 +152,23 @@ func (se *SQLSettlementEngine) ApplySettlementExecution(setExec *match.Settlemen
 	if setExec.Type == match.Debit {
 		newBal = curBal + setExec.Amount
 	} else if setExec.Type == match.Credit {
+		if setExec.Amount > curBal {
+			err = fmt.Errorf("Credit of %d is more than the balance of %d", setExec.Amount, curBal)
+			return
+		}
 		newBal = curBal - setExec.Amount
 	}
-	newBalQuery := fmt.Sprintf("INSERT INTO %s (balance, pubkey) VALUES (%d, '%x') ON DUPLICATE KEY UPDATE  balance='%[2]d';", se.coin.Name, newBal, setExec.Pubkey)
-	if _, err = tx.Exec(newBalQuery); err != nil {
+	newBalQuery := fmt.Sprintf("INSERT INTO %s (balance, pubkey, subaccount) VALUES (?, ?, ?) %s;", se.dialect.tableName(se.balanceSchema, se.coin.Name), se.dialect.onConflictUpdate("pubkey, subaccount", "balance=?"))
+	if _, err = tx.Exec(se.dialect.bind(newBalQuery), newBal, hexArg(setExec.Pubkey), setExec.SubAccount, newBal); err != nil {
 		err = fmt.Errorf("Error applying settlement exec new bal query: %s", err)
 		return
 	}
 
+	if err = se.writeLedgerEntries(tx, setExec); err != nil {
+		err = fmt.Errorf("Error writing ledger entries for applyExecutionTx: %s", err)
+		return
+	}
+
 	// Finally set return value
 	setRes = &match.SettlementResult{
 		NewBal:         newBal,
@@ -147,6 +178,33 @@ func (se *SQLSettlementEngine) ApplySettlementExecution(setExec *match.Settlemen
 	return
 }
 
+// writeLedgerEntries writes the settlement execution to the ledger as two entries that sum to zero,
+// one for the user and one for the exchange account that the reason says is on the other side.
+// The entries are written in the same transaction as the balance update.
+func (se *SQLSettlementEngine) writeLedgerEntries(tx *sql.Tx, setExec *match.SettlementExecution) (err error) {
+	// there's nothing to record if nothing moved
+	if setExec.Amount == 0 {
+		return
+	}
+
+	userAmount := int64(setExec.Amount)
+	if setExec.Type == match.Credit {
+		userAmount = -userAmount
+	}
+
+	entryTime := time.Now().UnixNano()
+	insertEntriesQuery := fmt.Sprintf("INSERT INTO %s (time, account, amount, reason, reference) VALUES (?, ?, ?, ?, ?), (?, ?, ?, ?, ?);", se.dialect.tableName(se.ledgerSchema, se.coin.Name))
+	if _, err = tx.Exec(se.dialect.bind(insertEntriesQuery),
+		entryTime, setExec.Account().String(), userAmount, string(setExec.Reason), setExec.Reference,
+		entryTime, setExec.Reason.CounterAccount(), -userAmount, string(setExec.Reason), setExec.Reference,
+	); err != nil {
+		err = fmt.Errorf("Error inserting ledger entries for writeLedgerEntries: %s", err)
+		return
+	}
+
+	return
+}
+
 // CheckValid returns true if the settlement execution would be valid
 func (se *SQLSettlementEngine) CheckValid(setExec *match.SettlementExecution) (valid bool, err error) {
 	if setExec.Type == match.Debit {
@@ -172,25 +230,21 @@ func (se *SQLSettlementEngine) CheckValid(setExec *match.SettlementExecution) (v
 		err = tx.Commit()
 	}()
 
-	// use balance schema
-	if _, err = tx.Exec("USE " + se.balanceSchema + ";"); err != nil {
-		err = fmt.Errorf("Error using balance schema for CheckValid: %s", err)
-		return
-	}
-
 	var row *sql.Row
-	curBalQuery := fmt.Sprintf("SELECT balance FROM %s WHERE pubkey='%x';", setExec.Asset, setExec.Pubkey)
+	curBalQuery := fmt.Sprintf("SELECT balance FROM %s WHERE pubkey=? AND subaccount=?;", se.dialect.tableName(se.balanceSchema, setExec.Asset.String()))
 	// error deferred to scan
-	row = tx.QueryRow(curBalQuery)
+	row = tx.QueryRow(se.dialect.bind(curBalQuery), hexArg(setExec.Pubkey), setExec.SubAccount)
 
+	// An account with no balance yet has nothing to credit
 	var curBal uint64
-	if err = row.Scan(&curBal); err != nil {
+	if err = row.Scan(&curBal); err != nil && err != sql.ErrNoRows {
 		err = fmt.Errorf("Error scanning when checking settlement exec: %s", err)
 		return
 	}
+	err = nil
 
 	logging.Infof("User with %d %s trying to complete action costing %d %[2]s.", curBal, se.coin.Name, setExec.Amount)
-	valid = setExec.Amount < curBal
+	valid = setExec.Amount <= curBal
 	return
 }
 
@@ -198,9 +252,8 @@ func (se *SQLSettlementEngine) CheckValid(setExec *match.SettlementExecution) (v
 // This assumes the schema name is set
 func (se *SQLSettlementEngine) setupSettlementTables() (err error) {
 
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", se.dbUsername, se.dbPassword, se.dbAddr.Network(), se.dbAddr.String())
 	var rootHandler *sql.DB
-	if rootHandler, err = sql.Open("mysql", openString); err != nil {
+	if rootHandler, err = se.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for setup settlement tables: %s", err)
 		return
 	}
@@ -208,11 +261,6 @@ func (se *SQLSettlementEngine) setupSettlementTables() (err error) {
 	// when we're done close please
 	defer rootHandler.Close()
 
-	if err = rootHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
-		return
-	}
-
 	// We do this in a transaction because it's more than one operation
 	var tx *sql.Tx
 	if tx, err = rootHandler.Begin(); err != nil {
@@ -229,21 +277,15 @@ func (se *SQLSettlementEngine) setupSettlementTables() (err error) {
 		err = tx.Commit()
 	}()
 
-	// Now create the schema
-	if _, err = tx.Exec("CREATE SCHEMA IF NOT EXISTS " + se.balanceSchema + ";"); err != nil {
-		err = fmt.Errorf("Error creating schema for setup settlement tables: %s", err)
+	// Create the table if it does not exist, and bring it up to the newest schema version
+	if err = migrateTable(tx, se.dialect, se.balanceSchema, se.coin.Name, settlementEngineMigrations); err != nil {
+		err = fmt.Errorf("Error migrating settlement table: %s", err)
 		return
 	}
 
-	// use the schema
-	if _, err = tx.Exec("USE " + se.balanceSchema + ";"); err != nil {
-		err = fmt.Errorf("Could not use %s schema: %s", se.balanceSchema, err)
-		return
-	}
-
-	createTableQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", se.coin.Name, settlementEngineSchema)
-	if _, err = tx.Exec(createTableQuery); err != nil {
-		err = fmt.Errorf("Error creating settlement table: %s", err)
+	// Now create the ledger table
+	if err = migrateTable(tx, se.dialect, se.ledgerSchema, se.coin.Name, ledgerMigrations); err != nil {
+		err = fmt.Errorf("Error migrating ledger table: %s", err)
 		return
 	}
 	return
@@ -264,3 +306,106 @@ func CreateSettlementEngineMap(coins []*coinparam.Params) (setMap map[*coinparam
 
 	return
 }
+
+// SQLBatchSettlementEngine applies batches of settlement executions for many coins in a single
+// transaction, so either the whole batch is applied or none of it is.
+type SQLBatchSettlementEngine struct {
+	DBHandler *sql.DB
+
+	// the settlement engine for each asset, these are only used for their tables
+	engines map[match.Asset]*SQLSettlementEngine
+}
+
+// CreateBatchSettlementEngine creates a batch settlement engine for a list of coins
+func CreateBatchSettlementEngine(coins []*coinparam.Params) (engine match.BatchSettlementEngine, err error) {
+
+	conf := new(dbsqlConfig)
+	*conf = *defaultConf
+
+	if engine, err = CreateBatchSettlementEngineStructWithConf(coins, conf); err != nil {
+		err = fmt.Errorf("Error creating batch settlement engine struct for CreateBatchSettlementEngine: %s", err)
+		return
+	}
+	return
+}
+
+// CreateBatchSettlementEngineStructWithConf creates a batch settlement engine for a list of coins, but
+// instead of returning an interface, it returns a struct.
+func CreateBatchSettlementEngineStructWithConf(coins []*coinparam.Params, conf *dbsqlConfig) (be *SQLBatchSettlementEngine, err error) {
+
+	// Set the default conf
+	dbConfigSetup(conf)
+
+	be = &SQLBatchSettlementEngine{
+		engines: make(map[match.Asset]*SQLSettlementEngine),
+	}
+
+	for _, coin := range coins {
+		var asset match.Asset
+		if asset, err = match.AssetFromCoinParam(coin); err != nil {
+			err = fmt.Errorf("Error getting asset from coin param for CreateBatchSettlementEngineStructWithConf: %s", err)
+			return
+		}
+
+		var se *SQLSettlementEngine
+		if se, err = CreateSettlementEngineStructWithConf(coin, conf); err != nil {
+			err = fmt.Errorf("Error creating settlement engine for batch settlement engine: %s", err)
+			return
+		}
+		be.engines[asset] = se
+	}
+
+	// Get the dialect for the database we are using
+	var dialect sqlDialect
+	if dialect, err = newDialect(conf); err != nil {
+		err = fmt.Errorf("Couldn't create sql dialect for CreateBatchSettlementEngineStructWithConf: %s", err)
+		return
+	}
+
+	// Now connect to the database
+	if be.DBHandler, err = dialect.open(); err != nil {
+		err = fmt.Errorf("Error opening database for CreateBatchSettlementEngineStructWithConf: %s", err)
+		return
+	}
+
+	return
+}
+
+// ApplySettlementBatch applies every settlement execution in order in one transaction across the
+// balance and ledger schemas of every coin. If any execution fails, nothing is applied.
+func (be *SQLBatchSettlementEngine) ApplySettlementBatch(setExecs []*match.SettlementExecution) (setRes []*match.SettlementResult, err error) {
+
+	for _, setExec := range setExecs {
+		if _, ok := be.engines[setExec.Asset]; !ok {
+			err = fmt.Errorf("No settlement engine for %s in ApplySettlementBatch", setExec.Asset)
+			return
+		}
+	}
+
+	// First create transaction
+	var tx *sql.Tx
+	if tx, err = be.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error beginning transaction while applying settlement batch: \n%s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			setRes = nil
+			err = fmt.Errorf("Error while applying settlement batch, rejecting the whole batch: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	for _, setExec := range setExecs {
+		var currRes *match.SettlementResult
+		if currRes, err = be.engines[setExec.Asset].applyExecutionTx(tx, setExec); err != nil {
+			return
+		}
+		setRes = append(setRes, currRes)
+	}
+
+	return
+}
@@ -2,10 +2,9 @@ package cxdbsql
 
 import (
 	"database/sql"
+	"encoding/hex"
 	"fmt"
-	"net"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/opencx/cxdb"
@@ -20,12 +19,8 @@ import (
 type SQLSettlementStore struct {
 	DBHandler *sql.DB
 
-	// db username
-	dbUsername string
-	dbPassword string
-
-	// db host and port
-	dbAddr net.Addr
+	// the sql database we are using
+	dialect sqlDialect
 
 	// balance schema name
 	balanceReadOnlySchema string
@@ -35,31 +30,47 @@ type SQLSettlementStore struct {
 }
 
 const (
-	settlementStoreSchema = "pubkey VARBINARY(66), balance BIGINT(64), PRIMARY KEY (pubkey)"
+	// settlementStoreSchema is the columns the read-only balance tables were first created with
+	settlementStoreSchema           = "pubkey VARBINARY(66), balance BIGINT(64), PRIMARY KEY (pubkey)"
+	settlementStoreSubaccountSchema = "pubkey VARBINARY(66), subaccount INT UNSIGNED NOT NULL DEFAULT 0, balance BIGINT(64), held BIGINT(64) DEFAULT 0, PRIMARY KEY (pubkey, subaccount)"
 )
 
+// The schema versions of the read-only balance tables, oldest first
+var settlementStoreMigrations = []migration{
+	baselineMigration(settlementStoreSchema),
+	addColumnsMigration(2, "add held balances", "held BIGINT(64) DEFAULT 0"),
+	rebuildTableMigration(3, "add sub-accounts", settlementStoreSubaccountSchema, "pubkey, balance, held"),
+}
+
 // CreateSettlementStore creates a settlement store for a specific coin.
 func CreateSettlementStore(coin *coinparam.Params) (store cxdb.SettlementStore, err error) {
 
 	conf := new(dbsqlConfig)
 	*conf = *defaultConf
 
+	if store, err = CreateSettlementStoreWithConf(coin, conf); err != nil {
+		err = fmt.Errorf("Error creating settlement store with conf for CreateSettlementStore: %s", err)
+		return
+	}
+	return
+}
+
+// CreateSettlementStoreWithConf creates a settlement store for a specific coin, using the database in conf
+func CreateSettlementStoreWithConf(coin *coinparam.Params, conf *dbsqlConfig) (store cxdb.SettlementStore, err error) {
 	// Set the default conf
 	dbConfigSetup(conf)
 
-	// Resolve new address
-	var addr net.Addr
-	if addr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(conf.DBHost, fmt.Sprintf("%d", conf.DBPort))); err != nil {
-		err = fmt.Errorf("Couldn't resolve db address for CreateSQLSettlementStore: %s", err)
+	// Get the dialect for the database we are using
+	var dialect sqlDialect
+	if dialect, err = newDialect(conf); err != nil {
+		err = fmt.Errorf("Couldn't create sql dialect for CreateSQLSettlementStore: %s", err)
 		return
 	}
 
 	// Set values
 	ss := &SQLSettlementStore{
-		dbUsername:            conf.DBUsername,
-		dbPassword:            conf.DBPassword,
+		dialect:               dialect,
 		balanceReadOnlySchema: conf.ReadOnlyBalanceSchemaName,
-		dbAddr:                addr,
 		coin:                  coin,
 	}
 
@@ -68,19 +79,12 @@ func CreateSettlementStore(coin *coinparam.Params) (store cxdb.SettlementStore,
 		return
 	}
 
-	// Now connect to the database and create the schemas / tables
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", ss.dbUsername, ss.dbPassword, ss.dbAddr.Network(), ss.dbAddr.String())
-	if ss.DBHandler, err = sql.Open("mysql", openString); err != nil {
+	// Now connect to the database
+	if ss.DBHandler, err = ss.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for CreateSQLSettlementStore: %s", err)
 		return
 	}
 
-	// Make sure we can actually connect
-	if err = ss.DBHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
-		return
-	}
-
 	// Now we actually set what we want
 	store = ss
 	return
@@ -90,9 +94,8 @@ func CreateSettlementStore(coin *coinparam.Params) (store cxdb.SettlementStore,
 // This assumes the schema name is set
 func (ss *SQLSettlementStore) setupSettlementStoreTables() (err error) {
 
-	openString := fmt.Sprintf("%s:%s@%s(%s)/", ss.dbUsername, ss.dbPassword, ss.dbAddr.Network(), ss.dbAddr.String())
 	var rootHandler *sql.DB
-	if rootHandler, err = sql.Open("mysql", openString); err != nil {
+	if rootHandler, err = ss.dialect.open(); err != nil {
 		err = fmt.Errorf("Error opening database for setup settlement store tables: %s", err)
 		return
 	}
@@ -100,11 +103,6 @@ func (ss *SQLSettlementStore) setupSettlementStoreTables() (err error) {
 	// when we're done close please
 	defer rootHandler.Close()
 
-	if err = rootHandler.Ping(); err != nil {
-		err = fmt.Errorf("Could not ping the database, is it running: %s", err)
-		return
-	}
-
 	// We do this in a transaction because it's more than one operation
 	var tx *sql.Tx
 	if tx, err = rootHandler.Begin(); err != nil {
@@ -121,27 +119,15 @@ func (ss *SQLSettlementStore) setupSettlementStoreTables() (err error) {
 		err = tx.Commit()
 	}()
 
-	// Now create the schema
-	if _, err = tx.Exec("CREATE SCHEMA IF NOT EXISTS " + ss.balanceReadOnlySchema + ";"); err != nil {
-		err = fmt.Errorf("Error creating schema for setup settlement store tables: %s", err)
-		return
-	}
-
-	// use the schema
-	if _, err = tx.Exec("USE " + ss.balanceReadOnlySchema + ";"); err != nil {
-		err = fmt.Errorf("Could not use %s schema: %s", ss.balanceReadOnlySchema, err)
-		return
-	}
-
-	createTableQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s);", ss.coin.Name, settlementStoreSchema)
-	if _, err = tx.Exec(createTableQuery); err != nil {
-		err = fmt.Errorf("Error creating settlement store table: %s", err)
+	// Create the table if it does not exist, and bring it up to the newest schema version
+	if err = migrateTable(tx, ss.dialect, ss.balanceReadOnlySchema, ss.coin.Name, settlementStoreMigrations); err != nil {
+		err = fmt.Errorf("Error migrating settlement store table: %s", err)
 		return
 	}
 	return
 }
 
-// UpdateBalances updates the balances from the settlement executions
+// UpdateBalances updates the available and held balances from the settlement executions
 func (ss *SQLSettlementStore) UpdateBalances(settlementResults []*match.SettlementResult) (err error) {
 	// Now get asset from coin
 	var assetForBal match.Asset
@@ -166,15 +152,9 @@ func (ss *SQLSettlementStore) UpdateBalances(settlementResults []*match.Settleme
 		err = tx.Commit()
 	}()
 
-	// use balance schema
-	if _, err = tx.Exec("USE " + ss.balanceReadOnlySchema + ";"); err != nil {
-		err = fmt.Errorf("Error using balance schema for GetBalance: %s", err)
-		return
-	}
-
 	for _, setResult := range settlementResults {
-		newBalQuery := fmt.Sprintf("INSERT INTO %s (balance, pubkey) VALUES (%d, '%x') ON DUPLICATE KEY UPDATE  balance='%[2]d';", assetForBal, setResult.NewBal, setResult.SuccessfulExec.Pubkey[:])
-		if _, err = tx.Exec(newBalQuery); err != nil {
+		newBalQuery := fmt.Sprintf("INSERT INTO %s (balance, held, pubkey, subaccount) VALUES (?, ?, ?, ?) %s;", ss.dialect.tableName(ss.balanceReadOnlySchema, assetForBal.String()), ss.dialect.onConflictUpdate("pubkey, subaccount", "balance=?, held=?"))
+		if _, err = tx.Exec(ss.dialect.bind(newBalQuery), setResult.NewBal, setResult.NewHeld, hexArg(setResult.SuccessfulExec.Pubkey[:]), setResult.SuccessfulExec.SubAccount, setResult.NewBal, setResult.NewHeld); err != nil {
 			err = fmt.Errorf("Error applying insert for GetBalance: %s", err)
 			return
 		}
@@ -182,8 +162,20 @@ func (ss *SQLSettlementStore) UpdateBalances(settlementResults []*match.Settleme
 	return
 }
 
-// GetBalance gets the balance for a pubkey and an asset.
-func (ss *SQLSettlementStore) GetBalance(pubkey *koblitz.PublicKey) (balance uint64, err error) {
+// subAccountCondition is the condition to add to a query that selects by pubkey, so it only selects
+// one sub-account, along with the arguments for the condition. If the sub-account is nil, every
+// sub-account is selected.
+func subAccountCondition(subAccount *uint32) (condition string, args []interface{}) {
+	if subAccount != nil {
+		condition = " AND subaccount=?"
+		args = []interface{}{*subAccount}
+	}
+	return
+}
+
+// GetBalance gets the available balance for a pubkey and an asset. If the sub-account is nil, this
+// is the balance of every sub-account added together.
+func (ss *SQLSettlementStore) GetBalance(pubkey *koblitz.PublicKey, subAccount *uint32) (balance uint64, err error) {
 	// Get asset from coin
 	var assetForBal match.Asset
 	if assetForBal, err = match.AssetFromCoinParam(ss.coin); err != nil {
@@ -207,19 +199,219 @@ func (ss *SQLSettlementStore) GetBalance(pubkey *koblitz.PublicKey) (balance uin
 		err = tx.Commit()
 	}()
 
-	// use balance schema
-	if _, err = tx.Exec("USE " + ss.balanceReadOnlySchema + ";"); err != nil {
-		err = fmt.Errorf("Error using balance schema for GetBalance: %s", err)
+	var row *sql.Row
+	condition, conditionArgs := subAccountCondition(subAccount)
+	curBalQuery := fmt.Sprintf("SELECT SUM(balance) FROM %s WHERE pubkey=?%s;", ss.dialect.tableName(ss.balanceReadOnlySchema, assetForBal.String()), condition)
+	// errs deferred until scan
+	row = tx.QueryRow(ss.dialect.bind(curBalQuery), append([]interface{}{hexArg(pubkey.SerializeCompressed())}, conditionArgs...)...)
+
+	var sumBalance sql.NullInt64
+	if err = row.Scan(&sumBalance); err != nil {
+		err = fmt.Errorf("Error scanning when getting balance: %s", err)
 		return
 	}
+	if !sumBalance.Valid {
+		err = sql.ErrNoRows
+		return
+	}
+	balance = uint64(sumBalance.Int64)
+
+	return
+}
+
+// GetHeldBalance gets the balance for a pubkey and an asset that is locked up in open orders. If the
+// sub-account is nil, this is the held balance of every sub-account added together.
+func (ss *SQLSettlementStore) GetHeldBalance(pubkey *koblitz.PublicKey, subAccount *uint32) (held uint64, err error) {
+	// Get asset from coin
+	var assetForBal match.Asset
+	if assetForBal, err = match.AssetFromCoinParam(ss.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param: %s", err)
+		return
+	}
+
+	// Then create transaction
+	var tx *sql.Tx
+	if tx, err = ss.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error beginning transaction while getting held balance: \n%s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error while getting held balance: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
 
 	var row *sql.Row
-	curBalQuery := fmt.Sprintf("SELECT balance FROM %s WHERE pubkey='%x';", assetForBal, pubkey.SerializeCompressed())
+	condition, conditionArgs := subAccountCondition(subAccount)
+	heldQuery := fmt.Sprintf("SELECT SUM(held) FROM %s WHERE pubkey=?%s;", ss.dialect.tableName(ss.balanceReadOnlySchema, assetForBal.String()), condition)
 	// errs deferred until scan
-	row = tx.QueryRow(curBalQuery)
+	row = tx.QueryRow(ss.dialect.bind(heldQuery), append([]interface{}{hexArg(pubkey.SerializeCompressed())}, conditionArgs...)...)
 
-	if err = row.Scan(&balance); err != nil {
-		err = fmt.Errorf("Error scanning when getting balance: %s", err)
+	var sumHeld sql.NullInt64
+	if err = row.Scan(&sumHeld); err != nil {
+		err = fmt.Errorf("Error scanning when getting held balance: %s", err)
+		return
+	}
+	if !sumHeld.Valid {
+		err = sql.ErrNoRows
+		return
+	}
+	held = uint64(sumHeld.Int64)
+
+	return
+}
+
+// GetTotalBalance gets the sum of every user's available and held balance for the asset.
+func (ss *SQLSettlementStore) GetTotalBalance() (total uint64, err error) {
+	// Get asset from coin
+	var assetForBal match.Asset
+	if assetForBal, err = match.AssetFromCoinParam(ss.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param: %s", err)
+		return
+	}
+
+	// Then create transaction
+	var tx *sql.Tx
+	if tx, err = ss.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error beginning transaction while getting total balance: \n%s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error while getting total balance: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var row *sql.Row
+	totalBalQuery := fmt.Sprintf("SELECT COALESCE(SUM(balance + held), 0) FROM %s;", ss.dialect.tableName(ss.balanceReadOnlySchema, assetForBal.String()))
+	// errs deferred until scan
+	row = tx.QueryRow(totalBalQuery)
+
+	if err = row.Scan(&total); err != nil {
+		err = fmt.Errorf("Error scanning when getting total balance: %s", err)
+		return
+	}
+
+	return
+}
+
+// GetAllBalances gets every user's available and held balance added together, by pubkey. Every
+// sub-account of a pubkey is added together too.
+func (ss *SQLSettlementStore) GetAllBalances() (balances map[[33]byte]uint64, err error) {
+	// Get asset from coin
+	var assetForBal match.Asset
+	if assetForBal, err = match.AssetFromCoinParam(ss.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param: %s", err)
+		return
+	}
+
+	// Then create transaction
+	var tx *sql.Tx
+	if tx, err = ss.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error beginning transaction while getting all balances: \n%s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error while getting all balances: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var rows *sql.Rows
+	allBalQuery := fmt.Sprintf("SELECT pubkey, SUM(balance + held) FROM %s GROUP BY pubkey;", ss.dialect.tableName(ss.balanceReadOnlySchema, assetForBal.String()))
+	if rows, err = tx.Query(allBalQuery); err != nil {
+		err = fmt.Errorf("Error querying for all balances for GetAllBalances: %s", err)
+		return
+	}
+
+	balances = make(map[[33]byte]uint64)
+	var pubkeyBytes []byte
+	var pubkey [33]byte
+	var balance uint64
+	for rows.Next() {
+		if err = rows.Scan(&pubkeyBytes, &balance); err != nil {
+			err = fmt.Errorf("Error scanning balance for GetAllBalances: %s", err)
+			return
+		}
+
+		// because we really only know that sql will give us a hex string, not actual bytes
+		if pubkeyBytes, err = hex.DecodeString(string(pubkeyBytes)); err != nil {
+			err = fmt.Errorf("Error decoding pubkey bytes string for GetAllBalances: %s", err)
+			return
+		}
+		copy(pubkey[:], pubkeyBytes)
+		balances[pubkey] = balance
+	}
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing rows for GetAllBalances: %s", err)
+		return
+	}
+
+	return
+}
+
+// GetAccountBalances gets the available and held balance of every sub-account of every pubkey
+func (ss *SQLSettlementStore) GetAccountBalances() (balances []*match.AccountBalance, err error) {
+	// Get asset from coin
+	var assetForBal match.Asset
+	if assetForBal, err = match.AssetFromCoinParam(ss.coin); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param: %s", err)
+		return
+	}
+
+	// Then create transaction
+	var tx *sql.Tx
+	if tx, err = ss.DBHandler.Begin(); err != nil {
+		err = fmt.Errorf("Error beginning transaction while getting account balances: \n%s", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("Error while getting account balances: \n%s", err)
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	var rows *sql.Rows
+	accountBalQuery := fmt.Sprintf("SELECT pubkey, subaccount, balance, held FROM %s;", ss.dialect.tableName(ss.balanceReadOnlySchema, assetForBal.String()))
+	if rows, err = tx.Query(accountBalQuery); err != nil {
+		err = fmt.Errorf("Error querying for account balances for GetAccountBalances: %s", err)
+		return
+	}
+
+	var pubkeyBytes []byte
+	for rows.Next() {
+		currBal := new(match.AccountBalance)
+		if err = rows.Scan(&pubkeyBytes, &currBal.Account.SubAccount, &currBal.Balance, &currBal.Held); err != nil {
+			err = fmt.Errorf("Error scanning balance for GetAccountBalances: %s", err)
+			return
+		}
+
+		// because we really only know that sql will give us a hex string, not actual bytes
+		if pubkeyBytes, err = hex.DecodeString(string(pubkeyBytes)); err != nil {
+			err = fmt.Errorf("Error decoding pubkey bytes string for GetAccountBalances: %s", err)
+			return
+		}
+		copy(currBal.Account.Pubkey[:], pubkeyBytes)
+		balances = append(balances, currBal)
+	}
+	if err = rows.Close(); err != nil {
+		err = fmt.Errorf("Error closing rows for GetAccountBalances: %s", err)
 		return
 	}
 
@@ -0,0 +1,85 @@
+package cxdbsql
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+	"github.com/mit-dci/opencx/match"
+)
+
+// CreateSnapshotStores creates every store a snapshot is taken from or restored into, for a list of
+// pairs and coins.
+func CreateSnapshotStores(pairList []*match.Pair, coinList []*coinparam.Params) (stores *cxdbsnapshot.Stores, err error) {
+
+	conf := new(dbsqlConfig)
+	*conf = *defaultConf
+
+	if stores, err = CreateSnapshotStoresWithConf(pairList, coinList, conf); err != nil {
+		err = fmt.Errorf("Error creating snapshot stores with conf for CreateSnapshotStores: %s", err)
+		return
+	}
+
+	return
+}
+
+// CreateSnapshotStoresWithConf creates every store a snapshot is taken from or restored into, for
+// a list of pairs and coins, with a configuration.
+func CreateSnapshotStoresWithConf(pairList []*match.Pair, coinList []*coinparam.Params, conf *dbsqlConfig) (stores *cxdbsnapshot.Stores, err error) {
+	stores = &cxdbsnapshot.Stores{
+		LimitEngines:      make(map[match.Pair]match.LimitEngine),
+		LimitOrderbooks:   make(map[match.Pair]match.LimitOrderbook),
+		AuctionEngines:    make(map[match.Pair]match.AuctionEngine),
+		AuctionOrderbooks: make(map[match.Pair]match.AuctionOrderbook),
+		PuzzleStores:      make(map[match.Pair]cxdb.PuzzleStore),
+		SettlementEngines: make(map[*coinparam.Params]match.SettlementEngine),
+		SettlementStores:  make(map[*coinparam.Params]cxdb.SettlementStore),
+		DepositStores:     make(map[*coinparam.Params]cxdb.DepositStore),
+		LedgerStores:      make(map[*coinparam.Params]cxdb.LedgerStore),
+	}
+
+	for _, pair := range pairList {
+		if stores.LimitEngines[*pair], err = CreateLimitEngineWithConf(pair, conf); err != nil {
+			err = fmt.Errorf("Error creating limit engine for CreateSnapshotStoresWithConf: %s", err)
+			return
+		}
+		if stores.LimitOrderbooks[*pair], err = CreateLimitOrderbookWithConf(pair, conf); err != nil {
+			err = fmt.Errorf("Error creating limit orderbook for CreateSnapshotStoresWithConf: %s", err)
+			return
+		}
+		if stores.AuctionEngines[*pair], err = CreateAuctionEngineWithConf(pair, conf); err != nil {
+			err = fmt.Errorf("Error creating auction engine for CreateSnapshotStoresWithConf: %s", err)
+			return
+		}
+		if stores.AuctionOrderbooks[*pair], err = CreateAuctionOrderbookWithConf(pair, conf); err != nil {
+			err = fmt.Errorf("Error creating auction orderbook for CreateSnapshotStoresWithConf: %s", err)
+			return
+		}
+		if stores.PuzzleStores[*pair], err = CreatePuzzleStoreWithConf(pair, conf); err != nil {
+			err = fmt.Errorf("Error creating puzzle store for CreateSnapshotStoresWithConf: %s", err)
+			return
+		}
+	}
+
+	for _, coin := range coinList {
+		if stores.SettlementEngines[coin], err = CreateSettlementEngineStructWithConf(coin, conf); err != nil {
+			err = fmt.Errorf("Error creating settlement engine for CreateSnapshotStoresWithConf: %s", err)
+			return
+		}
+		if stores.SettlementStores[coin], err = CreateSettlementStoreWithConf(coin, conf); err != nil {
+			err = fmt.Errorf("Error creating settlement store for CreateSnapshotStoresWithConf: %s", err)
+			return
+		}
+		if stores.DepositStores[coin], err = CreateDepositStoreStructWithConf(coin, conf); err != nil {
+			err = fmt.Errorf("Error creating deposit store for CreateSnapshotStoresWithConf: %s", err)
+			return
+		}
+		if stores.LedgerStores[coin], err = CreateLedgerStoreStructWithConf(coin, conf); err != nil {
+			err = fmt.Errorf("Error creating ledger store for CreateSnapshotStoresWithConf: %s", err)
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,209 @@
+package cxdbtest
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/mit-dci/opencx/match"
+)
+
+// AuctionEngineConstructor creates an auction engine for a pair. It's called once for every
+// scenario, and the engine it returns should not have any orders in it.
+type AuctionEngineConstructor func(pair *match.Pair) (engine match.AuctionEngine, err error)
+
+// RunAuctionEngineTests runs every auction engine scenario against the engines that create makes
+func RunAuctionEngineTests(t *testing.T, create AuctionEngineConstructor) {
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, engine match.AuctionEngine)
+	}{
+		{"MatchByAuction", auctionEngineMatchByAuction},
+		{"CancelRefund", auctionEngineCancelRefund},
+		{"Concurrent", auctionEngineConcurrent},
+	}
+	for _, scenario := range scenarios {
+		run := scenario.run
+		t.Run(scenario.name, func(t *testing.T) {
+			var err error
+			var engine match.AuctionEngine
+			if engine, err = create(&testPair); err != nil {
+				t.Fatalf("Error creating auction engine: %s", err)
+			}
+			run(t, engine)
+		})
+	}
+}
+
+// testAuctionOrder creates an auction order for the test pair. Orders that look the same need
+// different nonces, since the nonce is what makes their IDs different.
+func testAuctionOrder(pubkey [33]byte, side match.Side, amountHave uint64, amountWant uint64, auctionID match.AuctionID, nonce uint16) (order *match.AuctionOrder) {
+	order = &match.AuctionOrder{
+		Pubkey:      pubkey,
+		Side:        side,
+		TradingPair: testPair,
+		AmountHave:  amountHave,
+		AmountWant:  amountWant,
+		AuctionID:   auctionID,
+	}
+	binary.BigEndian.PutUint16(order.Nonce[:], nonce)
+	return
+}
+
+// testAuctionID creates an auction ID that starts with b
+func testAuctionID(b byte) (auctionID match.AuctionID) {
+	auctionID[0] = b
+	return
+}
+
+// placeAuctionOrder places an order in the auction it's for
+func placeAuctionOrder(engine match.AuctionEngine, order *match.AuctionOrder) (idRes *match.AuctionOrderIDPair, err error) {
+	auctionID := order.AuctionID
+	if idRes, err = engine.PlaceAuctionOrder(order, &auctionID); err != nil {
+		return
+	}
+	if idRes == nil {
+		err = fmt.Errorf("Placing an order should return the order and its ID")
+		return
+	}
+	return
+}
+
+// auctionEngineMatchByAuction checks that matching an auction only fills the orders in that
+// auction, and that filled orders are gone from the engine
+func auctionEngineMatchByAuction(t *testing.T, engine match.AuctionEngine) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	auctionID := testAuctionID(0x01)
+	otherAuctionID := testAuctionID(0x02)
+
+	var buyRes, sellRes, otherRes *match.AuctionOrderIDPair
+	if buyRes, err = placeAuctionOrder(engine, testAuctionOrder(pubkey, match.Buy, 1000, 1000, auctionID, 0)); err != nil {
+		t.Errorf("Error placing buy order: %s", err)
+		return
+	}
+	if sellRes, err = placeAuctionOrder(engine, testAuctionOrder(pubkey, match.Sell, 1000, 1000, auctionID, 1)); err != nil {
+		t.Errorf("Error placing sell order: %s", err)
+		return
+	}
+	if otherRes, err = placeAuctionOrder(engine, testAuctionOrder(pubkey, match.Buy, 1000, 1000, otherAuctionID, 2)); err != nil {
+		t.Errorf("Error placing order in other auction: %s", err)
+		return
+	}
+
+	var orderExecs []*match.OrderExecution
+	var setExecs []*match.SettlementExecution
+	if orderExecs, setExecs, err = engine.MatchAuctionOrders(&auctionID); err != nil {
+		t.Errorf("Error matching auction: %s", err)
+		return
+	}
+	if len(orderExecs) != 2 {
+		t.Errorf("Expected the 2 orders in the auction to execute, got %d executions", len(orderExecs))
+		return
+	}
+	for _, res := range []*match.AuctionOrderIDPair{buyRes, sellRes} {
+		var exec *match.OrderExecution
+		for _, orderExec := range orderExecs {
+			if orderExec.OrderID == res.OrderID {
+				exec = orderExec
+			}
+		}
+		if exec == nil || !exec.Filled {
+			t.Errorf("%s order %x should have been filled", res.Order.Side, res.OrderID[:])
+			return
+		}
+	}
+	if len(setExecs) != 4 {
+		t.Errorf("Expected a debit and a credit for each filled order, got %d settlement executions", len(setExecs))
+		return
+	}
+
+	// filled orders can't be cancelled, but the order in the other auction is still there
+	if _, _, err = engine.CancelAuctionOrder(&buyRes.OrderID); err == nil {
+		t.Errorf("Cancelling a filled order should fail")
+		return
+	}
+	if _, _, err = engine.CancelAuctionOrder(&otherRes.OrderID); err != nil {
+		t.Errorf("Order in another auction should still be in the engine: %s", err)
+		return
+	}
+	return
+}
+
+// auctionEngineCancelRefund checks that cancelling an order refunds what's left of it, and that
+// it can't be cancelled twice
+func auctionEngineCancelRefund(t *testing.T, engine match.AuctionEngine) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	var buyRes *match.AuctionOrderIDPair
+	if buyRes, err = placeAuctionOrder(engine, testAuctionOrder(pubkey, match.Buy, 1000, 2000, testAuctionID(0x01), 0)); err != nil {
+		t.Errorf("Error placing buy order: %s", err)
+		return
+	}
+
+	var cancelled *match.CancelledOrder
+	var refund *match.SettlementExecution
+	if cancelled, refund, err = engine.CancelAuctionOrder(&buyRes.OrderID); err != nil {
+		t.Errorf("Error cancelling order: %s", err)
+		return
+	}
+	if cancelled == nil || *cancelled.OrderID != buyRes.OrderID {
+		t.Errorf("Cancel should be for order %x", buyRes.OrderID[:])
+		return
+	}
+	if refund == nil {
+		t.Errorf("Cancelling an order should refund it")
+		return
+	}
+	if refund.Pubkey != pubkey || refund.Amount != 1000 || refund.Type != match.Debit || refund.Asset != testPair.AssetHave || refund.Reason != match.ReasonCancelRefund {
+		t.Errorf("Refund should be a debit of 1000 %s to %x, got a %s of %d %s to %x", testPair.AssetHave, pubkey, refund.Type.String(), refund.Amount, refund.Asset, refund.Pubkey)
+		return
+	}
+	if refund.Reference != hex.EncodeToString(buyRes.OrderID[:]) {
+		t.Errorf("Refund should reference order %x, references %s", buyRes.OrderID[:], refund.Reference)
+		return
+	}
+
+	if _, _, err = engine.CancelAuctionOrder(&buyRes.OrderID); err == nil {
+		t.Errorf("Cancelling an order twice should fail")
+		return
+	}
+	return
+}
+
+// auctionEngineConcurrent checks that orders placed at the same time all get different IDs and
+// can all be cancelled
+func auctionEngineConcurrent(t *testing.T, engine match.AuctionEngine) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	results := make([]*match.AuctionOrderIDPair, concurrentCalls)
+	if err = runConcurrently(func(i int) (err error) {
+		results[i], err = placeAuctionOrder(engine, testAuctionOrder(pubkey, match.Buy, 1000, 2000, testAuctionID(0x01), uint16(i)))
+		return
+	}); err != nil {
+		t.Errorf("Error placing orders concurrently: %s", err)
+		return
+	}
+
+	seen := make(map[match.OrderID]bool)
+	for _, res := range results {
+		if seen[res.OrderID] {
+			t.Errorf("Two orders placed concurrently got the same ID %x", res.OrderID[:])
+			return
+		}
+		seen[res.OrderID] = true
+	}
+
+	if err = runConcurrently(func(i int) (err error) {
+		_, _, err = engine.CancelAuctionOrder(&results[i].OrderID)
+		return
+	}); err != nil {
+		t.Errorf("Error cancelling orders concurrently: %s", err)
+		return
+	}
+	return
+}
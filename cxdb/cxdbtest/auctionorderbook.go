@@ -0,0 +1,467 @@
+package cxdbtest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/opencx/match"
+)
+
+// AuctionOrderbookConstructor creates an auction orderbook for a pair. It's called once for every
+// scenario, and the orderbook it returns should not have any orders in it.
+type AuctionOrderbookConstructor func(pair *match.Pair) (book match.AuctionOrderbook, err error)
+
+// RunAuctionOrderbookTests runs every auction orderbook scenario against the orderbooks that
+// create makes
+func RunAuctionOrderbookTests(t *testing.T, create AuctionOrderbookConstructor) {
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, book match.AuctionOrderbook)
+	}{
+		{"PlaceAndGet", auctionOrderbookPlaceAndGet},
+		{"OrdersForPubkey", auctionOrderbookOrdersForPubkey},
+		{"PartialFill", auctionOrderbookPartialFill},
+		{"Cancel", auctionOrderbookCancel},
+		{"CalculatePrice", auctionOrderbookCalculatePrice},
+		{"ArchiveFilled", auctionOrderbookArchiveFilled},
+		{"ArchiveCancelled", auctionOrderbookArchiveCancelled},
+		{"ArchiveRejected", auctionOrderbookArchiveRejected},
+		{"PruneArchive", auctionOrderbookPruneArchive},
+	}
+	for _, scenario := range scenarios {
+		run := scenario.run
+		t.Run(scenario.name, func(t *testing.T) {
+			var err error
+			var book match.AuctionOrderbook
+			if book, err = create(&testPair); err != nil {
+				t.Fatalf("Error creating auction orderbook: %s", err)
+			}
+			run(t, book)
+		})
+	}
+}
+
+// testAuctionIDPair creates an auction order with an ID, like an engine would after placing it
+func testAuctionIDPair(t *testing.T, pubkey [33]byte, side match.Side, amountHave uint64, amountWant uint64, auctionID match.AuctionID) (auctionIDPair *match.AuctionOrderIDPair) {
+	auctionIDPair = &match.AuctionOrderIDPair{
+		OrderID: *testOrderID(t),
+		Order:   testAuctionOrder(pubkey, side, amountHave, amountWant, auctionID, 0),
+		Price:   float64(amountWant) / float64(amountHave),
+	}
+	return
+}
+
+// checkAuctionOrder checks that an order from the book is the same as the one that was placed
+func checkAuctionOrder(actual *match.AuctionOrderIDPair, expected *match.AuctionOrderIDPair) (err error) {
+	if actual.OrderID != expected.OrderID || actual.Price != expected.Price {
+		err = fmt.Errorf("Expected order %x at %f, got order %x at %f", expected.OrderID[:], expected.Price, actual.OrderID[:], actual.Price)
+		return
+	}
+	if actual.Order.Pubkey != expected.Order.Pubkey || actual.Order.Side != expected.Order.Side || actual.Order.AuctionID != expected.Order.AuctionID {
+		err = fmt.Errorf("Order %x should be a %s order from %x in auction %x, got a %s order from %x in auction %x", expected.OrderID[:], expected.Order.Side, expected.Order.Pubkey, expected.Order.AuctionID, actual.Order.Side, actual.Order.Pubkey, actual.Order.AuctionID)
+		return
+	}
+	if actual.Order.AmountHave != expected.Order.AmountHave || actual.Order.AmountWant != expected.Order.AmountWant {
+		err = fmt.Errorf("Order %x should have %d for %d, got %d for %d", expected.OrderID[:], expected.Order.AmountHave, expected.Order.AmountWant, actual.Order.AmountHave, actual.Order.AmountWant)
+		return
+	}
+	return
+}
+
+// countAuctionOrders counts the orders in a map of price to orders
+func countAuctionOrders(orders map[float64][]*match.AuctionOrderIDPair) (count int) {
+	for _, priceLevel := range orders {
+		count += len(priceLevel)
+	}
+	return
+}
+
+// auctionOrderbookPlaceAndGet checks that placed orders can be gotten back by ID, and are in the
+// book at their price
+func auctionOrderbookPlaceAndGet(t *testing.T, book match.AuctionOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	buyOrder := testAuctionIDPair(t, pubkey, match.Buy, 1000, 2000, testAuctionID(0x01))
+	sellOrder := testAuctionIDPair(t, pubkey, match.Sell, 1000, 500, testAuctionID(0x01))
+	for _, order := range []*match.AuctionOrderIDPair{buyOrder, sellOrder} {
+		if err = book.UpdateBookPlace(order); err != nil {
+			t.Errorf("Error placing %s order in book: %s", order.Order.Side, err)
+			return
+		}
+	}
+
+	for _, order := range []*match.AuctionOrderIDPair{buyOrder, sellOrder} {
+		var bookOrder *match.AuctionOrderIDPair
+		if bookOrder, err = book.GetOrder(&order.OrderID); err != nil {
+			t.Errorf("Error getting %s order from book: %s", order.Order.Side, err)
+			return
+		}
+		if err = checkAuctionOrder(bookOrder, order); err != nil {
+			t.Errorf("Wrong order from GetOrder: %s", err)
+			return
+		}
+	}
+
+	var view map[float64][]*match.AuctionOrderIDPair
+	if view, err = book.ViewAuctionOrderBook(); err != nil {
+		t.Errorf("Error viewing orderbook: %s", err)
+		return
+	}
+	if countAuctionOrders(view) != 2 || len(view[buyOrder.Price]) != 1 || len(view[sellOrder.Price]) != 1 {
+		t.Errorf("Orderbook should have one order at %f and one at %f, got %d orders", buyOrder.Price, sellOrder.Price, countAuctionOrders(view))
+		return
+	}
+	if err = checkAuctionOrder(view[sellOrder.Price][0], sellOrder); err != nil {
+		t.Errorf("Wrong order from ViewAuctionOrderBook: %s", err)
+		return
+	}
+
+	if _, err = book.GetOrder(testOrderID(t)); err == nil {
+		t.Errorf("Getting an order that was never placed should fail")
+		return
+	}
+	return
+}
+
+// auctionOrderbookOrdersForPubkey checks that orders can be gotten by pubkey
+func auctionOrderbookOrdersForPubkey(t *testing.T, book match.AuctionOrderbook) {
+	var err error
+
+	pubkey, pubkeyBytes := testPubkey(t)
+	_, otherPubkeyBytes := testPubkey(t)
+	order := testAuctionIDPair(t, pubkeyBytes, match.Buy, 1000, 2000, testAuctionID(0x01))
+	otherOrder := testAuctionIDPair(t, otherPubkeyBytes, match.Buy, 1000, 2000, testAuctionID(0x01))
+	for _, placed := range []*match.AuctionOrderIDPair{order, otherOrder} {
+		if err = book.UpdateBookPlace(placed); err != nil {
+			t.Errorf("Error placing order in book: %s", err)
+			return
+		}
+	}
+
+	var orders map[float64][]*match.AuctionOrderIDPair
+	if orders, err = book.GetOrdersForPubkey(pubkey); err != nil {
+		t.Errorf("Error getting orders for pubkey: %s", err)
+		return
+	}
+	if countAuctionOrders(orders) != 1 || len(orders[order.Price]) != 1 {
+		t.Errorf("Pubkey should have 1 order, got %d", countAuctionOrders(orders))
+		return
+	}
+	if err = checkAuctionOrder(orders[order.Price][0], order); err != nil {
+		t.Errorf("Wrong order for pubkey: %s", err)
+		return
+	}
+	return
+}
+
+// auctionOrderbookPartialFill checks that executions update what's left of an order, and remove
+// it once it's filled
+func auctionOrderbookPartialFill(t *testing.T, book match.AuctionOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	order := testAuctionIDPair(t, pubkey, match.Buy, 1000, 2000, testAuctionID(0x01))
+	if err = book.UpdateBookPlace(order); err != nil {
+		t.Errorf("Error placing order in book: %s", err)
+		return
+	}
+
+	partialExec := &match.OrderExecution{
+		OrderID:       order.OrderID,
+		NewAmountHave: 600,
+		NewAmountWant: 1200,
+	}
+	if err = book.UpdateBookExec(partialExec); err != nil {
+		t.Errorf("Error updating book with partial fill: %s", err)
+		return
+	}
+
+	var bookOrder *match.AuctionOrderIDPair
+	if bookOrder, err = book.GetOrder(&order.OrderID); err != nil {
+		t.Errorf("Error getting partially filled order: %s", err)
+		return
+	}
+	if bookOrder.Order.AmountHave != 600 || bookOrder.Order.AmountWant != 1200 {
+		t.Errorf("Partially filled order should have 600 for 1200 left, has %d for %d", bookOrder.Order.AmountHave, bookOrder.Order.AmountWant)
+		return
+	}
+
+	fillExec := &match.OrderExecution{
+		OrderID: order.OrderID,
+		Filled:  true,
+	}
+	if err = book.UpdateBookExec(fillExec); err != nil {
+		t.Errorf("Error updating book with fill: %s", err)
+		return
+	}
+	if _, err = book.GetOrder(&order.OrderID); err == nil {
+		t.Errorf("Filled order should not be in the book")
+		return
+	}
+	return
+}
+
+// auctionOrderbookCancel checks that cancelled orders are removed, and can't be cancelled twice
+func auctionOrderbookCancel(t *testing.T, book match.AuctionOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	order := testAuctionIDPair(t, pubkey, match.Sell, 1000, 500, testAuctionID(0x01))
+	if err = book.UpdateBookPlace(order); err != nil {
+		t.Errorf("Error placing order in book: %s", err)
+		return
+	}
+
+	cancel := &match.CancelledOrder{OrderID: &order.OrderID}
+	if err = book.UpdateBookCancel(cancel); err != nil {
+		t.Errorf("Error cancelling order: %s", err)
+		return
+	}
+	if _, err = book.GetOrder(&order.OrderID); err == nil {
+		t.Errorf("Cancelled order should not be in the book")
+		return
+	}
+	if err = book.UpdateBookCancel(cancel); err == nil {
+		t.Errorf("Cancelling an order twice should fail")
+		return
+	}
+	return
+}
+
+// auctionOrderbookCalculatePrice checks that the price of an auction is the midpoint between its
+// highest sell and its lowest buy, and that other auctions don't change it
+func auctionOrderbookCalculatePrice(t *testing.T, book match.AuctionOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	auctionID := testAuctionID(0x01)
+	orders := []*match.AuctionOrderIDPair{
+		testAuctionIDPair(t, pubkey, match.Buy, 1000, 1000, auctionID),
+		testAuctionIDPair(t, pubkey, match.Buy, 1000, 2000, auctionID),
+		testAuctionIDPair(t, pubkey, match.Sell, 1000, 3000, auctionID),
+		testAuctionIDPair(t, pubkey, match.Sell, 1000, 4000, auctionID),
+		testAuctionIDPair(t, pubkey, match.Sell, 1000, 10000, testAuctionID(0x02)),
+	}
+	for _, order := range orders {
+		if err = book.UpdateBookPlace(order); err != nil {
+			t.Errorf("Error placing order in book: %s", err)
+			return
+		}
+	}
+
+	var price float64
+	if price, err = book.CalculatePrice(&auctionID); err != nil {
+		t.Errorf("Error calculating price: %s", err)
+		return
+	}
+	if price != 2.5 {
+		t.Errorf("Price should be halfway between the lowest buy of 1 and the highest sell of 4, got %f", price)
+		return
+	}
+	return
+}
+
+// checkArchivedAuctionOrder checks that an archived order is the order that was placed, with the
+// status it should have
+func checkArchivedAuctionOrder(archived *match.ArchivedAuctionOrder, placed *match.AuctionOrderIDPair, status match.OrderStatus) (err error) {
+	if err = checkAuctionOrder(archived.Order, placed); err != nil {
+		err = fmt.Errorf("Archived order should be the order as it was placed: %s", err)
+		return
+	}
+	if archived.Status != status {
+		err = fmt.Errorf("Order %x should be archived as %s, was archived as %s", placed.OrderID[:], status, archived.Status)
+		return
+	}
+	if archived.ClosedAt.IsZero() {
+		err = fmt.Errorf("Order %x was archived without the time it was closed", placed.OrderID[:])
+		return
+	}
+	return
+}
+
+// auctionOrderbookArchiveFilled checks that filled orders are archived as they were placed, along
+// with every fill, and can be gotten by pubkey
+func auctionOrderbookArchiveFilled(t *testing.T, book match.AuctionOrderbook) {
+	var err error
+
+	pubkey, pubkeyBytes := testPubkey(t)
+	order := testAuctionIDPair(t, pubkeyBytes, match.Buy, 1000, 2000, testAuctionID(0x01))
+	if err = book.UpdateBookPlace(order); err != nil {
+		t.Errorf("Error placing order in book: %s", err)
+		return
+	}
+
+	execs := []*match.OrderExecution{
+		{OrderID: order.OrderID, NewAmountHave: 600, NewAmountWant: 1200},
+		{OrderID: order.OrderID, Filled: true},
+	}
+	for _, exec := range execs {
+		if err = book.UpdateBookExec(exec); err != nil {
+			t.Errorf("Error updating book with execution: %s", err)
+			return
+		}
+	}
+
+	var archived *match.ArchivedAuctionOrder
+	if archived, err = book.GetArchivedOrder(&order.OrderID); err != nil {
+		t.Errorf("Error getting filled order from archive: %s", err)
+		return
+	}
+	if err = checkArchivedAuctionOrder(archived, order, match.OrderFilled); err != nil {
+		t.Errorf("Wrong filled order: %s", err)
+		return
+	}
+	if err = checkFills(archived.Fills, []uint64{800, 1200}, []uint64{400, 600}); err != nil {
+		t.Errorf("Wrong fills for filled order: %s", err)
+		return
+	}
+
+	var forPubkey []*match.ArchivedAuctionOrder
+	if forPubkey, err = book.GetArchivedOrdersForPubkey(pubkey); err != nil {
+		t.Errorf("Error getting archived orders for pubkey: %s", err)
+		return
+	}
+	if len(forPubkey) != 1 {
+		t.Errorf("Pubkey should have 1 archived order, got %d", len(forPubkey))
+		return
+	}
+	if err = checkArchivedAuctionOrder(forPubkey[0], order, match.OrderFilled); err != nil {
+		t.Errorf("Wrong archived order for pubkey: %s", err)
+		return
+	}
+	return
+}
+
+// auctionOrderbookArchiveCancelled checks that cancelled orders are archived, as partially filled
+// if they had been
+func auctionOrderbookArchiveCancelled(t *testing.T, book match.AuctionOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	cancelledOrder := testAuctionIDPair(t, pubkey, match.Sell, 1000, 500, testAuctionID(0x01))
+	partialOrder := testAuctionIDPair(t, pubkey, match.Sell, 1000, 500, testAuctionID(0x01))
+	for _, order := range []*match.AuctionOrderIDPair{cancelledOrder, partialOrder} {
+		if err = book.UpdateBookPlace(order); err != nil {
+			t.Errorf("Error placing order in book: %s", err)
+			return
+		}
+	}
+
+	partialExec := &match.OrderExecution{
+		OrderID:       partialOrder.OrderID,
+		NewAmountHave: 250,
+		NewAmountWant: 125,
+	}
+	if err = book.UpdateBookExec(partialExec); err != nil {
+		t.Errorf("Error updating book with partial fill: %s", err)
+		return
+	}
+
+	for _, order := range []*match.AuctionOrderIDPair{cancelledOrder, partialOrder} {
+		if err = book.UpdateBookCancel(&match.CancelledOrder{OrderID: &order.OrderID}); err != nil {
+			t.Errorf("Error cancelling order: %s", err)
+			return
+		}
+	}
+
+	var archived *match.ArchivedAuctionOrder
+	if archived, err = book.GetArchivedOrder(&cancelledOrder.OrderID); err != nil {
+		t.Errorf("Error getting cancelled order from archive: %s", err)
+		return
+	}
+	if err = checkArchivedAuctionOrder(archived, cancelledOrder, match.OrderCancelled); err != nil {
+		t.Errorf("Wrong cancelled order: %s", err)
+		return
+	}
+
+	if archived, err = book.GetArchivedOrder(&partialOrder.OrderID); err != nil {
+		t.Errorf("Error getting partially filled order from archive: %s", err)
+		return
+	}
+	if err = checkArchivedAuctionOrder(archived, partialOrder, match.OrderPartiallyFilledCancelled); err != nil {
+		t.Errorf("Wrong partially filled order: %s", err)
+		return
+	}
+	if err = checkFills(archived.Fills, []uint64{375}, []uint64{750}); err != nil {
+		t.Errorf("Wrong fills for partially filled order: %s", err)
+		return
+	}
+	return
+}
+
+// auctionOrderbookArchiveRejected checks that rejected orders are archived whether or not they
+// were in the book, and are taken out of the book if they were
+func auctionOrderbookArchiveRejected(t *testing.T, book match.AuctionOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	placedOrder := testAuctionIDPair(t, pubkey, match.Buy, 1000, 2000, testAuctionID(0x01))
+	unplacedOrder := testAuctionIDPair(t, pubkey, match.Buy, 1000, 2000, testAuctionID(0x01))
+	if err = book.UpdateBookPlace(placedOrder); err != nil {
+		t.Errorf("Error placing order in book: %s", err)
+		return
+	}
+
+	for _, order := range []*match.AuctionOrderIDPair{placedOrder, unplacedOrder} {
+		if err = book.UpdateBookReject(order); err != nil {
+			t.Errorf("Error rejecting order: %s", err)
+			return
+		}
+		var archived *match.ArchivedAuctionOrder
+		if archived, err = book.GetArchivedOrder(&order.OrderID); err != nil {
+			t.Errorf("Error getting rejected order from archive: %s", err)
+			return
+		}
+		if err = checkArchivedAuctionOrder(archived, order, match.OrderRejected); err != nil {
+			t.Errorf("Wrong rejected order: %s", err)
+			return
+		}
+	}
+
+	if _, err = book.GetOrder(&placedOrder.OrderID); err == nil {
+		t.Errorf("Rejected order should not be in the book")
+		return
+	}
+	return
+}
+
+// auctionOrderbookPruneArchive checks that pruning only deletes the orders closed before the cutoff
+func auctionOrderbookPruneArchive(t *testing.T, book match.AuctionOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	oldOrder := testAuctionIDPair(t, pubkey, match.Buy, 1000, 2000, testAuctionID(0x01))
+	newOrder := testAuctionIDPair(t, pubkey, match.Buy, 1000, 2000, testAuctionID(0x01))
+	if err = book.UpdateBookReject(oldOrder); err != nil {
+		t.Errorf("Error rejecting order: %s", err)
+		return
+	}
+	time.Sleep(time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond)
+	if err = book.UpdateBookReject(newOrder); err != nil {
+		t.Errorf("Error rejecting order: %s", err)
+		return
+	}
+
+	var pruned uint64
+	if pruned, err = book.PruneArchive(cutoff); err != nil {
+		t.Errorf("Error pruning archive: %s", err)
+		return
+	}
+	if pruned != 1 {
+		t.Errorf("Pruning should delete the 1 order closed before the cutoff, deleted %d", pruned)
+		return
+	}
+	if _, err = book.GetArchivedOrder(&oldOrder.OrderID); err == nil {
+		t.Errorf("Order closed before the cutoff should be pruned")
+		return
+	}
+	if _, err = book.GetArchivedOrder(&newOrder.OrderID); err != nil {
+		t.Errorf("Order closed after the cutoff should still be archived: %s", err)
+		return
+	}
+	return
+}
@@ -0,0 +1,53 @@
+// Package cxdbtest is a conformance suite for the storage interfaces in match and cxdb. Every
+// backend passes in constructors for its implementations, and the same scenarios run against each
+// one, so the backends behave the same way no matter which one the exchange is run with.
+package cxdbtest
+
+import (
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/match"
+)
+
+var (
+	// testPair is the pair that every engine, orderbook, and puzzle store is created for
+	testPair = match.Pair{AssetWant: match.BTCReg, AssetHave: match.LTCReg}
+	// testCoin is the coin that every settlement engine and deposit store is created for
+	testCoin = &coinparam.RegressionNetParams
+	// testAsset is the asset for testCoin
+	testAsset = match.BTCReg
+)
+
+// concurrentCalls is how many goroutines the concurrency scenarios call an implementation from at once
+const concurrentCalls = 16
+
+// testPubkey creates a new pubkey, returning it along with its compressed bytes
+func testPubkey(t *testing.T) (pubkey *koblitz.PublicKey, pubkeyBytes [33]byte) {
+	var err error
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Fatalf("Error creating private key for test pubkey: %s", err)
+	}
+	pubkey = privkey.PubKey()
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+	return
+}
+
+// runConcurrently calls call from concurrentCalls goroutines at once, and returns the first error
+// any of them returned
+func runConcurrently(call func(i int) (err error)) (err error) {
+	errChan := make(chan error, concurrentCalls)
+	for i := 0; i < concurrentCalls; i++ {
+		go func(i int) {
+			errChan <- call(i)
+		}(i)
+	}
+	for i := 0; i < concurrentCalls; i++ {
+		if callErr := <-errChan; callErr != nil && err == nil {
+			err = callErr
+		}
+	}
+	return
+}
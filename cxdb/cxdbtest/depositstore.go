@@ -0,0 +1,357 @@
+package cxdbtest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// DepositStoreConstructor creates a deposit store for a coin. It's called once for every scenario,
+// and the store it returns should not have any users or deposits in it.
+type DepositStoreConstructor func(coin *coinparam.Params) (store cxdb.DepositStore, err error)
+
+// RunDepositStoreTests runs every deposit store scenario against the stores that create makes
+func RunDepositStoreTests(t *testing.T, create DepositStoreConstructor) {
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, store cxdb.DepositStore)
+	}{
+		{"Addresses", depositStoreAddresses},
+		{"DepositIndex", depositStoreDepositIndex},
+		{"CreditedOnce", depositStoreCreditedOnce},
+		{"PendingAndHistory", depositStorePendingAndHistory},
+		{"Rollback", depositStoreRollback},
+		{"Sweep", depositStoreSweep},
+	}
+	for _, scenario := range scenarios {
+		run := scenario.run
+		t.Run(scenario.name, func(t *testing.T) {
+			var err error
+			var store cxdb.DepositStore
+			if store, err = create(testCoin); err != nil {
+				t.Fatalf("Error creating deposit store: %s", err)
+			}
+			run(t, store)
+		})
+	}
+}
+
+// testDeposit creates a deposit to pubkey received in the block with the given hash and height,
+// that needs 6 confirmations. The vout makes it a different output from the other test deposits.
+func testDeposit(pubkey *koblitz.PublicKey, blockHash string, height uint64, vout uint32) (deposit match.Deposit) {
+	deposit = match.Deposit{
+		Pubkey:              pubkey,
+		Address:             "testaddress",
+		Amount:              100000000,
+		Txid:                fmt.Sprintf("%064x", height),
+		Vout:                vout,
+		CoinType:            testCoin,
+		BlockHeightReceived: height,
+		BlockHash:           blockHash,
+		Confirmations:       6,
+	}
+	return
+}
+
+// pubkeyBytes gets the 33 byte compressed pubkey that executions use
+func pubkeyBytes(pubkey *koblitz.PublicKey) (pkBytes [33]byte) {
+	copy(pkBytes[:], pubkey.SerializeCompressed())
+	return
+}
+
+// depositStoreAddresses checks that registered addresses can be looked up in both directions
+func depositStoreAddresses(t *testing.T, store cxdb.DepositStore) {
+	var err error
+
+	pubkey, _ := testPubkey(t)
+	otherPubkey, _ := testPubkey(t)
+	unregistered, _ := testPubkey(t)
+	if err = store.RegisterUser(pubkey, "addressone"); err != nil {
+		t.Errorf("Error registering user: %s", err)
+		return
+	}
+	if err = store.RegisterUser(otherPubkey, "addresstwo"); err != nil {
+		t.Errorf("Error registering other user: %s", err)
+		return
+	}
+
+	var addr string
+	if addr, err = store.GetDepositAddress(pubkey); err != nil {
+		t.Errorf("Error getting deposit address: %s", err)
+		return
+	}
+	if addr != "addressone" {
+		t.Errorf("Deposit address should be addressone, got %s", addr)
+		return
+	}
+
+	var addrMap map[string]*koblitz.PublicKey
+	if addrMap, err = store.GetDepositAddressMap(); err != nil {
+		t.Errorf("Error getting deposit address map: %s", err)
+		return
+	}
+	if len(addrMap) != 2 || addrMap["addressone"] == nil || addrMap["addresstwo"] == nil {
+		t.Errorf("Address map should have both registered addresses, has %d", len(addrMap))
+		return
+	}
+	if !addrMap["addressone"].IsEqual(pubkey) || !addrMap["addresstwo"].IsEqual(otherPubkey) {
+		t.Errorf("Address map has the wrong pubkeys for the registered addresses")
+		return
+	}
+
+	if _, err = store.GetDepositAddress(unregistered); err == nil {
+		t.Errorf("Getting the address of a pubkey that was never registered should fail")
+		return
+	}
+	return
+}
+
+// depositStoreDepositIndex checks that every pubkey gets its own index, and keeps it
+func depositStoreDepositIndex(t *testing.T, store cxdb.DepositStore) {
+	var err error
+
+	pubkey, _ := testPubkey(t)
+	otherPubkey, _ := testPubkey(t)
+
+	var first, second, again uint32
+	if first, err = store.GetDepositIndex(pubkey); err != nil {
+		t.Errorf("Error getting deposit index: %s", err)
+		return
+	}
+	if second, err = store.GetDepositIndex(otherPubkey); err != nil {
+		t.Errorf("Error getting deposit index for other pubkey: %s", err)
+		return
+	}
+	if again, err = store.GetDepositIndex(pubkey); err != nil {
+		t.Errorf("Error getting deposit index again: %s", err)
+		return
+	}
+	if first == second {
+		t.Errorf("Two pubkeys should not share deposit index %d", first)
+		return
+	}
+	if first != again {
+		t.Errorf("Pubkey should keep deposit index %d, got %d", first, again)
+		return
+	}
+	return
+}
+
+// depositStoreCreditedOnce checks that a deposit is credited once it has enough confirmations, and
+// only once
+func depositStoreCreditedOnce(t *testing.T, store cxdb.DepositStore) {
+	var err error
+
+	pubkey, _ := testPubkey(t)
+	deposit := testDeposit(pubkey, "blockA", 100, 0)
+
+	var execs []*match.SettlementExecution
+	if execs, err = store.UpdateDeposits([]match.Deposit{deposit}, 100); err != nil {
+		t.Errorf("Error updating deposits: %s", err)
+		return
+	}
+	if len(execs) != 0 {
+		t.Errorf("Deposit should not be credited before confirmations, got %d execs", len(execs))
+		return
+	}
+
+	// Skip past the confirm height, it should still be credited
+	if execs, err = store.UpdateDeposits([]match.Deposit{}, 107); err != nil {
+		t.Errorf("Error updating deposits: %s", err)
+		return
+	}
+	if len(execs) != 1 {
+		t.Errorf("Deposit should have been credited at confirm height, got %d execs", len(execs))
+		return
+	}
+	if execs[0].Type != match.Debit || execs[0].Amount != deposit.Amount || execs[0].Pubkey != pubkeyBytes(pubkey) {
+		t.Errorf("Deposit should be a debit of %d to %x, got %s", deposit.Amount, pubkeyBytes(pubkey), execs[0])
+		return
+	}
+
+	// Seeing the same height again (like after a reorg) should not credit twice
+	if execs, err = store.UpdateDeposits([]match.Deposit{}, 107); err != nil {
+		t.Errorf("Error updating deposits: %s", err)
+		return
+	}
+	if len(execs) != 0 {
+		t.Errorf("Deposit should not be credited twice, got %d execs", len(execs))
+		return
+	}
+	return
+}
+
+// depositStorePendingAndHistory checks that deposits move from pending to history when they're
+// credited
+func depositStorePendingAndHistory(t *testing.T, store cxdb.DepositStore) {
+	var err error
+
+	pubkey, _ := testPubkey(t)
+	firstDeposit := testDeposit(pubkey, "blockA", 100, 0)
+	secondDeposit := testDeposit(pubkey, "blockB", 103, 0)
+	if _, err = store.UpdateDeposits([]match.Deposit{firstDeposit}, 100); err != nil {
+		t.Errorf("Error updating deposits: %s", err)
+		return
+	}
+	if _, err = store.UpdateDeposits([]match.Deposit{secondDeposit}, 103); err != nil {
+		t.Errorf("Error updating deposits: %s", err)
+		return
+	}
+
+	var pending []*match.Deposit
+	if pending, err = store.GetPendingDeposits(pubkey); err != nil {
+		t.Errorf("Error getting pending deposits: %s", err)
+		return
+	}
+	if len(pending) != 2 {
+		t.Errorf("Expected 2 pending deposits, got %d", len(pending))
+		return
+	}
+
+	// the first one should be credited now
+	if _, err = store.UpdateDeposits([]match.Deposit{}, 106); err != nil {
+		t.Errorf("Error updating deposits: %s", err)
+		return
+	}
+
+	if pending, err = store.GetPendingDeposits(pubkey); err != nil {
+		t.Errorf("Error getting pending deposits: %s", err)
+		return
+	}
+	if len(pending) != 1 || pending[0].BlockHeightReceived != 103 || pending[0].Amount != secondDeposit.Amount {
+		t.Errorf("Expected only the second deposit to be pending, got %d pending", len(pending))
+		return
+	}
+
+	var history []*match.Deposit
+	if history, err = store.GetDepositHistory(pubkey); err != nil {
+		t.Errorf("Error getting deposit history: %s", err)
+		return
+	}
+	if len(history) != 1 || history[0].BlockHeightReceived != 100 || history[0].Txid != firstDeposit.Txid {
+		t.Errorf("Expected only the first deposit in history, got %d deposits", len(history))
+		return
+	}
+	return
+}
+
+// depositStoreRollback checks that rolling back blocks drops their pending deposits and reverses
+// the ones that were already credited
+func depositStoreRollback(t *testing.T, store cxdb.DepositStore) {
+	var err error
+
+	// one deposit that will be credited then reorged, one that is reorged while pending, and one
+	// that stays in the main chain
+	creditedPubkey, _ := testPubkey(t)
+	pendingPubkey, _ := testPubkey(t)
+	safePubkey, _ := testPubkey(t)
+	creditedDeposit := testDeposit(creditedPubkey, "orphanA", 100, 0)
+	safeDeposit := testDeposit(safePubkey, "mainC", 101, 0)
+	pendingDeposit := testDeposit(pendingPubkey, "orphanB", 104, 0)
+	for _, deposit := range []match.Deposit{creditedDeposit, safeDeposit, pendingDeposit} {
+		if _, err = store.UpdateDeposits([]match.Deposit{deposit}, deposit.BlockHeightReceived); err != nil {
+			t.Errorf("Error updating deposits: %s", err)
+			return
+		}
+	}
+
+	var execs []*match.SettlementExecution
+	if execs, err = store.UpdateDeposits([]match.Deposit{}, 106); err != nil {
+		t.Errorf("Error updating deposits: %s", err)
+		return
+	}
+	if len(execs) != 1 {
+		t.Errorf("Expected 1 deposit to be credited at height 106, got %d", len(execs))
+		return
+	}
+
+	var reorgExecs []*match.SettlementExecution
+	if reorgExecs, err = store.RollbackDeposits([]string{"orphanA", "orphanB"}); err != nil {
+		t.Errorf("Error rolling back deposits: %s", err)
+		return
+	}
+
+	// only the credited deposit should be reversed
+	if len(reorgExecs) != 1 {
+		t.Errorf("Expected 1 reorg exec, got %d", len(reorgExecs))
+		return
+	}
+	if reorgExecs[0].Type != match.Credit || reorgExecs[0].Amount != creditedDeposit.Amount || reorgExecs[0].Pubkey != pubkeyBytes(creditedPubkey) {
+		t.Errorf("Reorg exec should reverse the credited deposit, got %s", reorgExecs[0])
+		return
+	}
+
+	var pending []*match.Deposit
+	if pending, err = store.GetPendingDeposits(pendingPubkey); err != nil {
+		t.Errorf("Error getting pending deposits: %s", err)
+		return
+	}
+	if len(pending) != 0 {
+		t.Errorf("Deposit in an orphaned block should not be pending, got %d pending", len(pending))
+		return
+	}
+
+	// The deposit that stayed in the main chain should be credited, the pending one should never be
+	if execs, err = store.UpdateDeposits([]match.Deposit{}, 110); err != nil {
+		t.Errorf("Error updating deposits: %s", err)
+		return
+	}
+	if len(execs) != 1 || execs[0].Pubkey != pubkeyBytes(safePubkey) {
+		t.Errorf("Expected only the main chain deposit to be credited after reorg, got %d execs", len(execs))
+		return
+	}
+	return
+}
+
+// depositStoreSweep checks that credited deposits can be swept, and are only swept once
+func depositStoreSweep(t *testing.T, store cxdb.DepositStore) {
+	var err error
+
+	pubkey, _ := testPubkey(t)
+	creditedDeposit := testDeposit(pubkey, "blockA", 100, 0)
+	otherCreditedDeposit := testDeposit(pubkey, "blockA", 100, 1)
+	pendingDeposit := testDeposit(pubkey, "blockB", 105, 0)
+	if _, err = store.UpdateDeposits([]match.Deposit{creditedDeposit, otherCreditedDeposit}, 100); err != nil {
+		t.Errorf("Error updating deposits: %s", err)
+		return
+	}
+	if _, err = store.UpdateDeposits([]match.Deposit{pendingDeposit}, 106); err != nil {
+		t.Errorf("Error updating deposits: %s", err)
+		return
+	}
+
+	var sweepable []*match.Deposit
+	if sweepable, err = store.GetSweepableDeposits(); err != nil {
+		t.Errorf("Error getting sweepable deposits: %s", err)
+		return
+	}
+	if len(sweepable) != 2 {
+		t.Errorf("Expected the 2 credited deposits to be sweepable, got %d", len(sweepable))
+		return
+	}
+	for _, deposit := range sweepable {
+		if deposit.Txid != creditedDeposit.Txid || deposit.Amount != creditedDeposit.Amount {
+			t.Errorf("Sweepable deposit %s:%d should be one of the credited deposits", deposit.Txid, deposit.Vout)
+			return
+		}
+	}
+
+	if err = store.MarkDepositsSwept(sweepable[:1]); err != nil {
+		t.Errorf("Error marking deposit swept: %s", err)
+		return
+	}
+	var left []*match.Deposit
+	if left, err = store.GetSweepableDeposits(); err != nil {
+		t.Errorf("Error getting sweepable deposits after sweep: %s", err)
+		return
+	}
+	if len(left) != 1 || left[0].Vout == sweepable[0].Vout {
+		t.Errorf("Only the deposit that wasn't swept should be left, got %d", len(left))
+		return
+	}
+	return
+}
@@ -0,0 +1,183 @@
+package cxdbtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// LedgerStoreConstructor creates a settlement engine for a coin, and a ledger store for the ledger
+// that engine writes to. It's called once for every scenario, and the ledger it returns should be
+// empty.
+type LedgerStoreConstructor func(coin *coinparam.Params) (engine match.SettlementEngine, store cxdb.LedgerStore, err error)
+
+// RunLedgerStoreTests runs every ledger store scenario against the engines and ledger stores that
+// create makes
+func RunLedgerStoreTests(t *testing.T, create LedgerStoreConstructor) {
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, engine match.SettlementEngine, store cxdb.LedgerStore)
+	}{
+		{"StatementAndConsistency", ledgerStoreStatementAndConsistency},
+		{"TransferNonces", ledgerStoreTransferNonces},
+		{"Replace", ledgerStoreReplace},
+	}
+	for _, scenario := range scenarios {
+		run := scenario.run
+		t.Run(scenario.name, func(t *testing.T) {
+			var err error
+			var engine match.SettlementEngine
+			var store cxdb.LedgerStore
+			if engine, store, err = create(testCoin); err != nil {
+				t.Fatalf("Error creating ledger store: %s", err)
+			}
+			run(t, engine, store)
+		})
+	}
+}
+
+// ledgerStoreStatementAndConsistency checks that every applied execution is in the statement, that
+// a rejected one isn't, and that the ledger matches the balances
+func ledgerStoreStatementAndConsistency(t *testing.T, engine match.SettlementEngine, store cxdb.LedgerStore) {
+	var err error
+
+	pubkey, pubkeyBytes := testPubkey(t)
+	execs := []*match.SettlementExecution{
+		{Pubkey: pubkeyBytes, Asset: testAsset, Amount: 100000, Type: match.Debit, Reason: match.ReasonDeposit, Reference: "testtxid"},
+		{Pubkey: pubkeyBytes, Asset: testAsset, Amount: 30000, Type: match.Credit, Reason: match.ReasonOrder, Reference: "testorderid"},
+		{Pubkey: pubkeyBytes, Asset: testAsset, Amount: 10000, Type: match.Debit, Reason: match.ReasonCancelRefund, Reference: "testorderid"},
+		{Pubkey: pubkeyBytes, Asset: testAsset, Amount: 500, Type: match.Credit, Reason: match.ReasonFee, Reference: "testorderid"},
+	}
+
+	start := time.Now()
+	for _, setExec := range execs {
+		if _, err = engine.ApplySettlementExecution(setExec); err != nil {
+			t.Fatalf("Error applying %s: %s", setExec, err)
+		}
+	}
+	overdraw := &match.SettlementExecution{Pubkey: pubkeyBytes, Asset: testAsset, Amount: 1000000, Type: match.Credit, Reason: match.ReasonWithdrawal}
+	if _, err = engine.ApplySettlementExecution(overdraw); err == nil {
+		t.Fatalf("Applying a credit bigger than the balance should fail")
+	}
+
+	var statement *match.AccountStatement
+	if statement, err = store.GetAccountStatement(pubkey, start, time.Now()); err != nil {
+		t.Fatalf("Error getting account statement: %s", err)
+	}
+	if len(statement.Entries) != len(execs) {
+		t.Fatalf("Expected %d entries in the statement, got %d", len(execs), len(statement.Entries))
+	}
+	for i, entry := range statement.Entries {
+		if entry.Amount != execs[i].Amount || entry.Type != execs[i].Type || entry.Reason != execs[i].Reason || entry.Reference != execs[i].Reference {
+			t.Fatalf("Entry %d doesn't match the execution it was written for: %s", i, entry)
+		}
+	}
+	if statement.OpeningBalance != 0 || statement.ClosingBalance != 79500 {
+		t.Fatalf("Statement should open at 0 and close at 79500, got %d and %d", statement.OpeningBalance, statement.ClosingBalance)
+	}
+
+	var mismatches []*match.LedgerMismatch
+	if mismatches, err = store.CheckConsistency(); err != nil {
+		t.Fatalf("Error checking consistency: %s", err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("Expected no mismatches, got %s", mismatches[0])
+	}
+
+	var fees uint64
+	if fees, err = store.GetFeeBalance(); err != nil {
+		t.Fatalf("Error getting fee balance: %s", err)
+	}
+	if fees != 500 {
+		t.Fatalf("Expected a fee balance of 500, got %d", fees)
+	}
+	return
+}
+
+// ledgerStoreTransferNonces checks that the nonce of the last transfer from each sender comes back
+// from the ledger, and that the nonce of a rejected transfer doesn't
+func ledgerStoreTransferNonces(t *testing.T, engine match.SettlementEngine, store cxdb.LedgerStore) {
+	var err error
+
+	_, alice := testPubkey(t)
+	_, bob := testPubkey(t)
+	funding := &match.SettlementExecution{Pubkey: alice, SubAccount: 2, Amount: 1000, Asset: testAsset, Type: match.Debit, Reason: match.ReasonDeposit}
+	if _, err = engine.ApplySettlementExecution(funding); err != nil {
+		t.Fatalf("Error applying funding: %s", err)
+	}
+
+	transfers := []*match.Transfer{
+		{From: alice, FromSubAccount: 2, To: bob, Asset: testAsset, Amount: 300, Nonce: 5},
+		{From: alice, FromSubAccount: 2, To: bob, Asset: testAsset, Amount: 300, Nonce: 3},
+		{From: alice, FromSubAccount: 2, To: bob, Asset: testAsset, Amount: 3000, Nonce: 9},
+	}
+	for i, transfer := range transfers {
+		sent := &match.SettlementExecution{Pubkey: alice, SubAccount: 2, Amount: transfer.Amount, Asset: testAsset, Type: match.Credit, Reason: match.ReasonTransfer, Reference: transfer.SenderReference()}
+		if _, err = engine.ApplySettlementExecution(sent); (err == nil) != (i < 2) {
+			t.Fatalf("Unexpected result applying transfer %d: %v", i, err)
+		}
+	}
+
+	var nonces map[[33]byte]uint64
+	if nonces, err = store.GetTransferNonces(); err != nil {
+		t.Fatalf("Error getting transfer nonces: %s", err)
+	}
+	if len(nonces) != 1 || nonces[alice] != 5 {
+		t.Fatalf("Expected the last nonce for alice to be 5 and no nonce for bob, got %v", nonces)
+	}
+	return
+}
+
+// ledgerStoreReplace checks that a replaced ledger keeps the IDs it was given, that new entries
+// come after them, and that entries out of order are rejected
+func ledgerStoreReplace(t *testing.T, engine match.SettlementEngine, store cxdb.LedgerStore) {
+	var err error
+
+	_, alice := testPubkey(t)
+	deposit := &match.SettlementExecution{Pubkey: alice, Amount: 1000, Asset: testAsset, Type: match.Debit, Reason: match.ReasonDeposit, Reference: "testtxid"}
+	if _, err = engine.ApplySettlementExecution(deposit); err != nil {
+		t.Fatalf("Error applying deposit: %s", err)
+	}
+
+	// the entries from another ledger keep their IDs, even with gaps in them
+	entryTime := time.Unix(0, 1234567890123456789)
+	replacement := []*match.LedgerEntry{
+		{ID: 5, Time: entryTime, Account: "testaccount", Asset: testAsset, Amount: 700, Type: match.Debit, Reason: match.ReasonRestore, Reference: "snapshot"},
+		{ID: 9, Time: entryTime, Account: match.ReasonRestore.CounterAccount(), Asset: testAsset, Amount: 700, Type: match.Credit, Reason: match.ReasonRestore, Reference: "snapshot"},
+	}
+	if err = store.ReplaceLedger(replacement); err != nil {
+		t.Fatalf("Error replacing ledger: %s", err)
+	}
+
+	var entries []*match.LedgerEntry
+	if entries, err = store.GetLedger(); err != nil {
+		t.Fatalf("Error getting ledger: %s", err)
+	}
+	if len(entries) != len(replacement) {
+		t.Fatalf("Expected %d entries after replacing the ledger, got %d", len(replacement), len(entries))
+	}
+	for i, entry := range entries {
+		if entry.ID != replacement[i].ID || !entry.Time.Equal(entryTime) || entry.Account != replacement[i].Account || entry.Amount != replacement[i].Amount || entry.Type != replacement[i].Type || entry.Reason != replacement[i].Reason {
+			t.Fatalf("Entry %d should be %s, got %s", i, replacement[i], entry)
+		}
+	}
+
+	// new entries come after the ones that were put back
+	if _, err = engine.ApplySettlementExecution(deposit); err != nil {
+		t.Fatalf("Error applying deposit after replacing ledger: %s", err)
+	}
+	if entries, err = store.GetLedger(); err != nil {
+		t.Fatalf("Error getting ledger after deposit: %s", err)
+	}
+	if len(entries) != 4 || entries[2].ID <= 9 {
+		t.Fatalf("Expected 4 entries with the new ones after entry 9, got %d", len(entries))
+	}
+
+	if err = store.ReplaceLedger([]*match.LedgerEntry{replacement[1], replacement[0]}); err == nil {
+		t.Fatalf("Replacing the ledger with entries out of order should fail")
+	}
+	return
+}
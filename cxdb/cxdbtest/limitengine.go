@@ -0,0 +1,408 @@
+package cxdbtest
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/opencx/match"
+)
+
+// LimitEngineConstructor creates a limit engine for a pair. It's called once for every scenario,
+// and the engine it returns should not have any orders in it.
+type LimitEngineConstructor func(pair *match.Pair) (engine match.LimitEngine, err error)
+
+// RunLimitEngineTests runs every limit engine scenario against the engines that create makes
+func RunLimitEngineTests(t *testing.T, create LimitEngineConstructor) {
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, engine match.LimitEngine)
+	}{
+		{"Place", limitEnginePlace},
+		{"NoCross", limitEngineNoCross},
+		{"PartialFill", limitEnginePartialFill},
+		{"CancelRefund", limitEngineCancelRefund},
+		{"CancelSwap", limitEngineCancelSwap},
+		{"Restore", limitEngineRestore},
+		{"Concurrent", limitEngineConcurrent},
+	}
+	for _, scenario := range scenarios {
+		run := scenario.run
+		t.Run(scenario.name, func(t *testing.T) {
+			var err error
+			var engine match.LimitEngine
+			if engine, err = create(&testPair); err != nil {
+				t.Fatalf("Error creating limit engine: %s", err)
+			}
+			run(t, engine)
+		})
+	}
+}
+
+// testLimitOrder creates a limit order for the test pair
+func testLimitOrder(pubkey [33]byte, side match.Side, amountHave uint64, amountWant uint64) (order *match.LimitOrder) {
+	order = &match.LimitOrder{
+		Pubkey:      pubkey,
+		Side:        side,
+		TradingPair: testPair,
+		AmountHave:  amountHave,
+		AmountWant:  amountWant,
+	}
+	return
+}
+
+// findOrderExec finds the execution for an order ID, returning nil if there isn't one
+func findOrderExec(orderExecs []*match.OrderExecution, orderID *match.OrderID) (orderExec *match.OrderExecution) {
+	for _, exec := range orderExecs {
+		if exec.OrderID == *orderID {
+			orderExec = exec
+			return
+		}
+	}
+	return
+}
+
+// checkCancelRefund checks that a cancel settlement gives back what was left of an order
+func checkCancelRefund(cancelSettlement *match.SettlementExecution, orderID *match.OrderID, order *match.LimitOrder, amountLeft uint64) (err error) {
+	refundAsset := testPair.AssetWant
+	if order.Side == match.Buy {
+		refundAsset = testPair.AssetHave
+	}
+	if cancelSettlement == nil {
+		err = fmt.Errorf("Cancelling a %s order should give back %d %s, got no settlement", order.Side, amountLeft, refundAsset)
+		return
+	}
+	if cancelSettlement.Pubkey != order.Pubkey || cancelSettlement.SubAccount != order.SubAccount {
+		err = fmt.Errorf("Cancel settlement should go to %x sub-account %d, went to %s", order.Pubkey, order.SubAccount, cancelSettlement.Account())
+		return
+	}
+	if cancelSettlement.Amount != amountLeft || cancelSettlement.Asset != refundAsset || cancelSettlement.Type != match.Debit {
+		err = fmt.Errorf("Cancelling a %s order should give back %d %s, got %s", order.Side, amountLeft, refundAsset, cancelSettlement)
+		return
+	}
+	if cancelSettlement.Reason != match.ReasonCancelRefund || cancelSettlement.Reference != hex.EncodeToString(orderID[:]) {
+		err = fmt.Errorf("Cancel settlement should be a refund referencing %x, was %s referencing %s", orderID[:], cancelSettlement.Reason, cancelSettlement.Reference)
+		return
+	}
+	return
+}
+
+// limitEnginePlace checks that placed orders get an ID and a price, and that identical orders
+// get different IDs
+func limitEnginePlace(t *testing.T, engine match.LimitEngine) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	order := testLimitOrder(pubkey, match.Buy, 1000, 2000)
+
+	var firstID *match.LimitOrderIDPair
+	if firstID, err = engine.PlaceLimitOrder(order); err != nil {
+		t.Errorf("Error placing first order: %s", err)
+		return
+	}
+	if firstID.OrderID == nil {
+		t.Errorf("Placed order should have an order ID")
+		return
+	}
+	if firstID.Price != 2 {
+		t.Errorf("Placed order should have a price of 2, got %f", firstID.Price)
+		return
+	}
+
+	var secondID *match.LimitOrderIDPair
+	if secondID, err = engine.PlaceLimitOrder(order); err != nil {
+		t.Errorf("Error placing second order: %s", err)
+		return
+	}
+	if *firstID.OrderID == *secondID.OrderID {
+		t.Errorf("Identical orders should not have the same ID %x", firstID.OrderID[:])
+		return
+	}
+
+	if _, err = engine.PlaceLimitOrder(testLimitOrder(pubkey, match.Buy, 1000, 0)); err == nil {
+		t.Errorf("Placing an order that wants nothing should fail")
+		return
+	}
+	return
+}
+
+// limitEngineRestore checks that a restored order keeps its ID and its place in line, and that an
+// order can't be restored twice
+func limitEngineRestore(t *testing.T, engine match.LimitEngine) {
+	var err error
+
+	_, buyer := testPubkey(t)
+	_, seller := testPubkey(t)
+	restored := &match.LimitOrderIDPair{
+		OrderID:   testOrderID(t),
+		Order:     testLimitOrder(seller, match.Sell, 1000, 1000),
+		Price:     1,
+		Timestamp: time.Now().Add(-time.Hour),
+	}
+	if err = engine.RestoreLimitOrder(restored); err != nil {
+		t.Errorf("Error restoring order: %s", err)
+		return
+	}
+	if err = engine.RestoreLimitOrder(restored); err == nil {
+		t.Errorf("Restoring the same order twice should fail")
+		return
+	}
+
+	// the restored order was placed first, so it should fill before a newer order at the same price
+	var newerID *match.LimitOrderIDPair
+	if newerID, err = engine.PlaceLimitOrder(testLimitOrder(seller, match.Sell, 1000, 1000)); err != nil {
+		t.Errorf("Error placing newer sell order: %s", err)
+		return
+	}
+	if _, err = engine.PlaceLimitOrder(testLimitOrder(buyer, match.Buy, 1000, 1000)); err != nil {
+		t.Errorf("Error placing buy order: %s", err)
+		return
+	}
+
+	var orderExecs []*match.OrderExecution
+	if orderExecs, _, _, err = engine.MatchLimitOrders(); err != nil {
+		t.Errorf("Error matching orders: %s", err)
+		return
+	}
+	if restoredExec := findOrderExec(orderExecs, restored.OrderID); restoredExec == nil || !restoredExec.Filled {
+		t.Errorf("Restored order should have been filled first, got %s", restoredExec)
+		return
+	}
+	if newerExec := findOrderExec(orderExecs, newerID.OrderID); newerExec != nil {
+		t.Errorf("Newer order should not have been filled, got %s", newerExec)
+		return
+	}
+	return
+}
+
+// limitEngineNoCross checks that orders whose prices don't cross are not matched
+func limitEngineNoCross(t *testing.T, engine match.LimitEngine) {
+	var err error
+
+	_, buyer := testPubkey(t)
+	_, seller := testPubkey(t)
+	if _, err = engine.PlaceLimitOrder(testLimitOrder(buyer, match.Buy, 1000, 2000)); err != nil {
+		t.Errorf("Error placing buy order: %s", err)
+		return
+	}
+	if _, err = engine.PlaceLimitOrder(testLimitOrder(seller, match.Sell, 1000, 1000)); err != nil {
+		t.Errorf("Error placing sell order: %s", err)
+		return
+	}
+
+	var orderExecs []*match.OrderExecution
+	var settlementExecs []*match.SettlementExecution
+	if orderExecs, settlementExecs, _, err = engine.MatchLimitOrders(); err != nil {
+		t.Errorf("Error matching orders: %s", err)
+		return
+	}
+	if len(orderExecs) != 0 || len(settlementExecs) != 0 {
+		t.Errorf("Orders that don't cross should not match, got %d order and %d settlement executions", len(orderExecs), len(settlementExecs))
+		return
+	}
+	return
+}
+
+// limitEnginePartialFill checks that a small sell partially fills a bigger buy, and that only what
+// is left of the buy is given back when it's cancelled
+func limitEnginePartialFill(t *testing.T, engine match.LimitEngine) {
+	var err error
+
+	_, buyer := testPubkey(t)
+	_, seller := testPubkey(t)
+	buyOrder := testLimitOrder(buyer, match.Buy, 1000, 1000)
+	sellOrder := testLimitOrder(seller, match.Sell, 400, 400)
+
+	var buyID *match.LimitOrderIDPair
+	if buyID, err = engine.PlaceLimitOrder(buyOrder); err != nil {
+		t.Errorf("Error placing buy order: %s", err)
+		return
+	}
+	var sellID *match.LimitOrderIDPair
+	if sellID, err = engine.PlaceLimitOrder(sellOrder); err != nil {
+		t.Errorf("Error placing sell order: %s", err)
+		return
+	}
+
+	var orderExecs []*match.OrderExecution
+	var settlementExecs []*match.SettlementExecution
+	if orderExecs, settlementExecs, _, err = engine.MatchLimitOrders(); err != nil {
+		t.Errorf("Error matching orders: %s", err)
+		return
+	}
+	if len(settlementExecs) == 0 {
+		t.Errorf("Matching crossing orders should settle something")
+		return
+	}
+
+	var sellExec *match.OrderExecution
+	if sellExec = findOrderExec(orderExecs, sellID.OrderID); sellExec == nil || !sellExec.Filled {
+		t.Errorf("Sell order should have been filled, got %s", sellExec)
+		return
+	}
+	var buyExec *match.OrderExecution
+	if buyExec = findOrderExec(orderExecs, buyID.OrderID); buyExec == nil || buyExec.Filled {
+		t.Errorf("Buy order should have been partially filled, got %s", buyExec)
+		return
+	}
+	if buyExec.NewAmountHave != 600 || buyExec.NewAmountWant != 600 {
+		t.Errorf("Buy order should have 600 left to trade for 600, has %d for %d", buyExec.NewAmountHave, buyExec.NewAmountWant)
+		return
+	}
+
+	// Nothing is left to match
+	if orderExecs, _, _, err = engine.MatchLimitOrders(); err != nil {
+		t.Errorf("Error matching orders a second time: %s", err)
+		return
+	}
+	if len(orderExecs) != 0 {
+		t.Errorf("Orders should only be matched once, got %d more order executions", len(orderExecs))
+		return
+	}
+
+	var cancelSettlement *match.SettlementExecution
+	if _, cancelSettlement, err = engine.CancelLimitOrder(buyID.OrderID); err != nil {
+		t.Errorf("Error cancelling partially filled buy order: %s", err)
+		return
+	}
+	if err = checkCancelRefund(cancelSettlement, buyID.OrderID, buyOrder, 600); err != nil {
+		t.Errorf("Wrong refund for partially filled order: %s", err)
+		return
+	}
+
+	if _, _, err = engine.CancelLimitOrder(sellID.OrderID); err == nil {
+		t.Errorf("Cancelling a filled order should fail")
+		return
+	}
+	return
+}
+
+// limitEngineCancelRefund checks that cancelling gives back the whole order to the right account,
+// and that an order can't be cancelled twice
+func limitEngineCancelRefund(t *testing.T, engine match.LimitEngine) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	buyOrder := testLimitOrder(pubkey, match.Buy, 1000, 2000)
+	buyOrder.SubAccount = 3
+	sellOrder := testLimitOrder(pubkey, match.Sell, 500, 5000)
+
+	for _, order := range []*match.LimitOrder{buyOrder, sellOrder} {
+		var orderID *match.LimitOrderIDPair
+		if orderID, err = engine.PlaceLimitOrder(order); err != nil {
+			t.Errorf("Error placing %s order: %s", order.Side, err)
+			return
+		}
+
+		var cancelled *match.CancelledOrder
+		var cancelSettlement *match.SettlementExecution
+		if cancelled, cancelSettlement, err = engine.CancelLimitOrder(orderID.OrderID); err != nil {
+			t.Errorf("Error cancelling %s order: %s", order.Side, err)
+			return
+		}
+		if cancelled == nil || *cancelled.OrderID != *orderID.OrderID {
+			t.Errorf("Cancelled order should be %x, got %v", orderID.OrderID[:], cancelled)
+			return
+		}
+		if err = checkCancelRefund(cancelSettlement, orderID.OrderID, order, order.AmountHave); err != nil {
+			t.Errorf("Wrong refund for cancelled order: %s", err)
+			return
+		}
+
+		if _, _, err = engine.CancelLimitOrder(orderID.OrderID); err == nil {
+			t.Errorf("Cancelling a %s order twice should fail", order.Side)
+			return
+		}
+	}
+
+	unknownID := new(match.OrderID)
+	unknownID[0] = 0xff
+	if _, _, err = engine.CancelLimitOrder(unknownID); err == nil {
+		t.Errorf("Cancelling an order that was never placed should fail")
+		return
+	}
+	return
+}
+
+// limitEngineCancelSwap checks that swap orders, which don't hold a balance, aren't refunded
+func limitEngineCancelSwap(t *testing.T, engine match.LimitEngine) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	order := testLimitOrder(pubkey, match.Buy, 1000, 2000)
+	order.Swap = true
+
+	var orderID *match.LimitOrderIDPair
+	if orderID, err = engine.PlaceLimitOrder(order); err != nil {
+		t.Errorf("Error placing swap order: %s", err)
+		return
+	}
+
+	var cancelSettlement *match.SettlementExecution
+	if _, cancelSettlement, err = engine.CancelLimitOrder(orderID.OrderID); err != nil {
+		t.Errorf("Error cancelling swap order: %s", err)
+		return
+	}
+	if cancelSettlement != nil {
+		t.Errorf("Cancelling a swap order should not give anything back, got %s", cancelSettlement)
+		return
+	}
+	return
+}
+
+// limitEngineConcurrent checks that orders placed and cancelled at the same time all get their own
+// ID and are all refunded
+func limitEngineConcurrent(t *testing.T, engine match.LimitEngine) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	order := testLimitOrder(pubkey, match.Buy, 1000, 2000)
+
+	orderIDs := make([]*match.OrderID, concurrentCalls)
+	if err = runConcurrently(func(i int) (err error) {
+		var orderID *match.LimitOrderIDPair
+		if orderID, err = engine.PlaceLimitOrder(testLimitOrder(order.Pubkey, order.Side, order.AmountHave, order.AmountWant)); err != nil {
+			return
+		}
+		orderIDs[i] = orderID.OrderID
+		return
+	}); err != nil {
+		t.Errorf("Error placing orders concurrently: %s", err)
+		return
+	}
+
+	seen := make(map[match.OrderID]bool)
+	for _, orderID := range orderIDs {
+		if seen[*orderID] {
+			t.Errorf("Orders placed at the same time should not have the same ID %x", orderID[:])
+			return
+		}
+		seen[*orderID] = true
+	}
+
+	var refundMtx sync.Mutex
+	var refunded uint64
+	if err = runConcurrently(func(i int) (err error) {
+		var cancelSettlement *match.SettlementExecution
+		if _, cancelSettlement, err = engine.CancelLimitOrder(orderIDs[i]); err != nil {
+			return
+		}
+		if err = checkCancelRefund(cancelSettlement, orderIDs[i], order, order.AmountHave); err != nil {
+			return
+		}
+		refundMtx.Lock()
+		refunded += cancelSettlement.Amount
+		refundMtx.Unlock()
+		return
+	}); err != nil {
+		t.Errorf("Error cancelling orders concurrently: %s", err)
+		return
+	}
+	if refunded != order.AmountHave*concurrentCalls {
+		t.Errorf("Expected %d to be refunded in total, got %d", order.AmountHave*concurrentCalls, refunded)
+		return
+	}
+	return
+}
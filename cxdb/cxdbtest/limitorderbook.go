@@ -0,0 +1,582 @@
+package cxdbtest
+
+import (
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/opencx/match"
+)
+
+// LimitOrderbookConstructor creates a limit orderbook for a pair. It's called once for every
+// scenario, and the orderbook it returns should not have any orders in it.
+type LimitOrderbookConstructor func(pair *match.Pair) (book match.LimitOrderbook, err error)
+
+// RunLimitOrderbookTests runs every limit orderbook scenario against the orderbooks that create makes
+func RunLimitOrderbookTests(t *testing.T, create LimitOrderbookConstructor) {
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, book match.LimitOrderbook)
+	}{
+		{"PlaceAndGet", limitOrderbookPlaceAndGet},
+		{"OrdersForPubkey", limitOrderbookOrdersForPubkey},
+		{"PartialFill", limitOrderbookPartialFill},
+		{"Cancel", limitOrderbookCancel},
+		{"CalculatePrice", limitOrderbookCalculatePrice},
+		{"Concurrent", limitOrderbookConcurrent},
+		{"ArchiveFilled", limitOrderbookArchiveFilled},
+		{"ArchiveCancelled", limitOrderbookArchiveCancelled},
+		{"ArchiveForPubkey", limitOrderbookArchiveForPubkey},
+		{"PruneArchive", limitOrderbookPruneArchive},
+	}
+	for _, scenario := range scenarios {
+		run := scenario.run
+		t.Run(scenario.name, func(t *testing.T) {
+			var err error
+			var book match.LimitOrderbook
+			if book, err = create(&testPair); err != nil {
+				t.Fatalf("Error creating limit orderbook: %s", err)
+			}
+			run(t, book)
+		})
+	}
+}
+
+// testOrderID creates a random order ID
+func testOrderID(t *testing.T) (orderID *match.OrderID) {
+	orderID = new(match.OrderID)
+	if _, err := rand.Read(orderID[:]); err != nil {
+		t.Fatalf("Error creating random order ID: %s", err)
+	}
+	return
+}
+
+// testLimitIDPair creates a limit order with an ID, like an engine would after placing it
+func testLimitIDPair(t *testing.T, pubkey [33]byte, side match.Side, amountHave uint64, amountWant uint64) (limitIDPair *match.LimitOrderIDPair) {
+	limitIDPair = &match.LimitOrderIDPair{
+		OrderID:   testOrderID(t),
+		Order:     testLimitOrder(pubkey, side, amountHave, amountWant),
+		Price:     float64(amountWant) / float64(amountHave),
+		Timestamp: time.Now(),
+	}
+	return
+}
+
+// checkLimitOrder checks that an order from the book is the same as the one that was placed
+func checkLimitOrder(actual *match.LimitOrderIDPair, expected *match.LimitOrderIDPair) (err error) {
+	if *actual.OrderID != *expected.OrderID || actual.Price != expected.Price {
+		err = fmt.Errorf("Expected order %x at %f, got order %x at %f", expected.OrderID[:], expected.Price, actual.OrderID[:], actual.Price)
+		return
+	}
+	if actual.Order.Pubkey != expected.Order.Pubkey || actual.Order.SubAccount != expected.Order.SubAccount || actual.Order.Side != expected.Order.Side || actual.Order.Swap != expected.Order.Swap {
+		err = fmt.Errorf("Order %x should be a %s order from %x sub-account %d, got a %s order from %x sub-account %d", expected.OrderID[:], expected.Order.Side, expected.Order.Pubkey, expected.Order.SubAccount, actual.Order.Side, actual.Order.Pubkey, actual.Order.SubAccount)
+		return
+	}
+	if actual.Order.AmountHave != expected.Order.AmountHave || actual.Order.AmountWant != expected.Order.AmountWant {
+		err = fmt.Errorf("Order %x should have %d for %d, got %d for %d", expected.OrderID[:], expected.Order.AmountHave, expected.Order.AmountWant, actual.Order.AmountHave, actual.Order.AmountWant)
+		return
+	}
+	return
+}
+
+// countLimitOrders counts the orders in a map of price to orders
+func countLimitOrders(orders map[float64][]*match.LimitOrderIDPair) (count int) {
+	for _, priceLevel := range orders {
+		count += len(priceLevel)
+	}
+	return
+}
+
+// limitOrderbookPlaceAndGet checks that placed orders can be gotten back by ID, and are in the book
+// at their price
+func limitOrderbookPlaceAndGet(t *testing.T, book match.LimitOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	buyOrder := testLimitIDPair(t, pubkey, match.Buy, 1000, 2000)
+	buyOrder.Order.SubAccount = 2
+	sellOrder := testLimitIDPair(t, pubkey, match.Sell, 1000, 500)
+	for _, order := range []*match.LimitOrderIDPair{buyOrder, sellOrder} {
+		if err = book.UpdateBookPlace(order); err != nil {
+			t.Errorf("Error placing %s order in book: %s", order.Order.Side, err)
+			return
+		}
+	}
+
+	for _, order := range []*match.LimitOrderIDPair{buyOrder, sellOrder} {
+		var bookOrder *match.LimitOrderIDPair
+		if bookOrder, err = book.GetOrder(order.OrderID); err != nil {
+			t.Errorf("Error getting %s order from book: %s", order.Order.Side, err)
+			return
+		}
+		if err = checkLimitOrder(bookOrder, order); err != nil {
+			t.Errorf("Wrong order from GetOrder: %s", err)
+			return
+		}
+	}
+
+	var view map[float64][]*match.LimitOrderIDPair
+	if view, err = book.ViewLimitOrderBook(); err != nil {
+		t.Errorf("Error viewing orderbook: %s", err)
+		return
+	}
+	if countLimitOrders(view) != 2 || len(view[buyOrder.Price]) != 1 || len(view[sellOrder.Price]) != 1 {
+		t.Errorf("Orderbook should have one order at %f and one at %f, got %d orders", buyOrder.Price, sellOrder.Price, countLimitOrders(view))
+		return
+	}
+	if err = checkLimitOrder(view[buyOrder.Price][0], buyOrder); err != nil {
+		t.Errorf("Wrong order from ViewLimitOrderBook: %s", err)
+		return
+	}
+
+	if _, err = book.GetOrder(testOrderID(t)); err == nil {
+		t.Errorf("Getting an order that was never placed should fail")
+		return
+	}
+	return
+}
+
+// limitOrderbookOrdersForPubkey checks that orders can be gotten by pubkey and sub-account
+func limitOrderbookOrdersForPubkey(t *testing.T, book match.LimitOrderbook) {
+	var err error
+
+	pubkey, pubkeyBytes := testPubkey(t)
+	_, otherPubkeyBytes := testPubkey(t)
+	mainOrder := testLimitIDPair(t, pubkeyBytes, match.Buy, 1000, 2000)
+	subOrder := testLimitIDPair(t, pubkeyBytes, match.Buy, 1000, 2000)
+	subOrder.Order.SubAccount = 1
+	otherOrder := testLimitIDPair(t, otherPubkeyBytes, match.Buy, 1000, 2000)
+	for _, order := range []*match.LimitOrderIDPair{mainOrder, subOrder, otherOrder} {
+		if err = book.UpdateBookPlace(order); err != nil {
+			t.Errorf("Error placing order in book: %s", err)
+			return
+		}
+	}
+
+	var orders map[float64][]*match.LimitOrderIDPair
+	if orders, err = book.GetOrdersForPubkey(pubkey, nil); err != nil {
+		t.Errorf("Error getting orders for pubkey: %s", err)
+		return
+	}
+	if countLimitOrders(orders) != 2 {
+		t.Errorf("Pubkey should have 2 orders across its sub-accounts, got %d", countLimitOrders(orders))
+		return
+	}
+
+	subAccount := uint32(1)
+	if orders, err = book.GetOrdersForPubkey(pubkey, &subAccount); err != nil {
+		t.Errorf("Error getting orders for sub-account: %s", err)
+		return
+	}
+	if countLimitOrders(orders) != 1 || len(orders[subOrder.Price]) != 1 {
+		t.Errorf("Sub-account should have 1 order, got %d", countLimitOrders(orders))
+		return
+	}
+	if err = checkLimitOrder(orders[subOrder.Price][0], subOrder); err != nil {
+		t.Errorf("Wrong order for sub-account: %s", err)
+		return
+	}
+	return
+}
+
+// limitOrderbookPartialFill checks that executions update what's left of an order, and remove it
+// once it's filled
+func limitOrderbookPartialFill(t *testing.T, book match.LimitOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	order := testLimitIDPair(t, pubkey, match.Buy, 1000, 2000)
+	if err = book.UpdateBookPlace(order); err != nil {
+		t.Errorf("Error placing order in book: %s", err)
+		return
+	}
+
+	partialExec := &match.OrderExecution{
+		OrderID:       *order.OrderID,
+		NewAmountHave: 600,
+		NewAmountWant: 1200,
+	}
+	if err = book.UpdateBookExec(partialExec); err != nil {
+		t.Errorf("Error updating book with partial fill: %s", err)
+		return
+	}
+
+	var bookOrder *match.LimitOrderIDPair
+	if bookOrder, err = book.GetOrder(order.OrderID); err != nil {
+		t.Errorf("Error getting partially filled order: %s", err)
+		return
+	}
+	if bookOrder.Order.AmountHave != 600 || bookOrder.Order.AmountWant != 1200 {
+		t.Errorf("Partially filled order should have 600 for 1200 left, has %d for %d", bookOrder.Order.AmountHave, bookOrder.Order.AmountWant)
+		return
+	}
+
+	fillExec := &match.OrderExecution{
+		OrderID: *order.OrderID,
+		Filled:  true,
+	}
+	if err = book.UpdateBookExec(fillExec); err != nil {
+		t.Errorf("Error updating book with fill: %s", err)
+		return
+	}
+	if _, err = book.GetOrder(order.OrderID); err == nil {
+		t.Errorf("Filled order should not be in the book")
+		return
+	}
+	return
+}
+
+// limitOrderbookCancel checks that cancelled orders are removed, and can't be cancelled twice
+func limitOrderbookCancel(t *testing.T, book match.LimitOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	order := testLimitIDPair(t, pubkey, match.Sell, 1000, 500)
+	otherOrder := testLimitIDPair(t, pubkey, match.Sell, 1000, 500)
+	for _, placed := range []*match.LimitOrderIDPair{order, otherOrder} {
+		if err = book.UpdateBookPlace(placed); err != nil {
+			t.Errorf("Error placing order in book: %s", err)
+			return
+		}
+	}
+
+	cancel := &match.CancelledOrder{OrderID: order.OrderID}
+	if err = book.UpdateBookCancel(cancel); err != nil {
+		t.Errorf("Error cancelling order: %s", err)
+		return
+	}
+	if _, err = book.GetOrder(order.OrderID); err == nil {
+		t.Errorf("Cancelled order should not be in the book")
+		return
+	}
+	if _, err = book.GetOrder(otherOrder.OrderID); err != nil {
+		t.Errorf("Cancelling one order should leave the other one in the book: %s", err)
+		return
+	}
+	if err = book.UpdateBookCancel(cancel); err == nil {
+		t.Errorf("Cancelling an order twice should fail")
+		return
+	}
+	return
+}
+
+// limitOrderbookCalculatePrice checks that the price is the midpoint between the highest sell and
+// the lowest buy
+func limitOrderbookCalculatePrice(t *testing.T, book match.LimitOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	orders := []*match.LimitOrderIDPair{
+		testLimitIDPair(t, pubkey, match.Buy, 1000, 1000),
+		testLimitIDPair(t, pubkey, match.Buy, 1000, 2000),
+		testLimitIDPair(t, pubkey, match.Sell, 1000, 3000),
+		testLimitIDPair(t, pubkey, match.Sell, 1000, 4000),
+	}
+	for _, order := range orders {
+		if err = book.UpdateBookPlace(order); err != nil {
+			t.Errorf("Error placing order in book: %s", err)
+			return
+		}
+	}
+
+	var price float64
+	if price, err = book.CalculatePrice(); err != nil {
+		t.Errorf("Error calculating price: %s", err)
+		return
+	}
+	if price != 2.5 {
+		t.Errorf("Price should be halfway between the lowest buy of 1 and the highest sell of 4, got %f", price)
+		return
+	}
+	return
+}
+
+// limitOrderbookConcurrent checks that orders placed in the book at the same time are all kept
+func limitOrderbookConcurrent(t *testing.T, book match.LimitOrderbook) {
+	var err error
+
+	pubkey, pubkeyBytes := testPubkey(t)
+	orders := make([]*match.LimitOrderIDPair, concurrentCalls)
+	for i := range orders {
+		orders[i] = testLimitIDPair(t, pubkeyBytes, match.Buy, 1000, 2000)
+	}
+	if err = runConcurrently(func(i int) (err error) {
+		err = book.UpdateBookPlace(orders[i])
+		return
+	}); err != nil {
+		t.Errorf("Error placing orders concurrently: %s", err)
+		return
+	}
+
+	var bookOrders map[float64][]*match.LimitOrderIDPair
+	if bookOrders, err = book.GetOrdersForPubkey(pubkey, nil); err != nil {
+		t.Errorf("Error getting orders for pubkey: %s", err)
+		return
+	}
+	if countLimitOrders(bookOrders) != concurrentCalls {
+		t.Errorf("Expected %d orders placed concurrently, got %d", concurrentCalls, countLimitOrders(bookOrders))
+		return
+	}
+	return
+}
+
+// checkFills checks that the fills of an archived order took the amounts expected, in order
+func checkFills(fills []*match.OrderFill, expectedWant []uint64, expectedHave []uint64) (err error) {
+	if len(fills) != len(expectedWant) {
+		err = fmt.Errorf("Expected %d fills, got %d", len(expectedWant), len(fills))
+		return
+	}
+	for i, fill := range fills {
+		if fill.AmountWant != expectedWant[i] || fill.AmountHave != expectedHave[i] {
+			err = fmt.Errorf("Fill %d should be %d for %d, got %d for %d", i, expectedHave[i], expectedWant[i], fill.AmountHave, fill.AmountWant)
+			return
+		}
+		if fill.Time.IsZero() {
+			err = fmt.Errorf("Fill %d has no time", i)
+			return
+		}
+	}
+	return
+}
+
+// checkArchivedLimitOrder checks that an archived order is the order that was placed, with the
+// status it should have
+func checkArchivedLimitOrder(archived *match.ArchivedLimitOrder, placed *match.LimitOrderIDPair, status match.OrderStatus) (err error) {
+	if err = checkLimitOrder(archived.Order, placed); err != nil {
+		err = fmt.Errorf("Archived order should be the order as it was placed: %s", err)
+		return
+	}
+	if archived.Status != status {
+		err = fmt.Errorf("Order %x should be archived as %s, was archived as %s", placed.OrderID[:], status, archived.Status)
+		return
+	}
+	if archived.ClosedAt.IsZero() {
+		err = fmt.Errorf("Order %x was archived without the time it was closed", placed.OrderID[:])
+		return
+	}
+	return
+}
+
+// limitOrderbookArchiveFilled checks that filled orders are archived as they were placed, along
+// with every fill
+func limitOrderbookArchiveFilled(t *testing.T, book match.LimitOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	order := testLimitIDPair(t, pubkey, match.Buy, 1000, 2000)
+	if err = book.UpdateBookPlace(order); err != nil {
+		t.Errorf("Error placing order in book: %s", err)
+		return
+	}
+
+	if _, err = book.GetArchivedOrder(order.OrderID); err == nil {
+		t.Errorf("Orders in the book should not be in the archive")
+		return
+	}
+
+	execs := []*match.OrderExecution{
+		{OrderID: *order.OrderID, NewAmountHave: 600, NewAmountWant: 1200},
+		{OrderID: *order.OrderID, Filled: true},
+	}
+	for _, exec := range execs {
+		if err = book.UpdateBookExec(exec); err != nil {
+			t.Errorf("Error updating book with execution: %s", err)
+			return
+		}
+	}
+
+	var archived *match.ArchivedLimitOrder
+	if archived, err = book.GetArchivedOrder(order.OrderID); err != nil {
+		t.Errorf("Error getting filled order from archive: %s", err)
+		return
+	}
+	if err = checkArchivedLimitOrder(archived, order, match.OrderFilled); err != nil {
+		t.Errorf("Wrong filled order: %s", err)
+		return
+	}
+	if err = checkFills(archived.Fills, []uint64{800, 1200}, []uint64{400, 600}); err != nil {
+		t.Errorf("Wrong fills for filled order: %s", err)
+		return
+	}
+
+	if _, err = book.GetArchivedOrder(testOrderID(t)); err == nil {
+		t.Errorf("Getting an order that was never archived should fail")
+		return
+	}
+	return
+}
+
+// limitOrderbookArchiveCancelled checks that cancelled orders are archived, as partially filled if
+// they had been
+func limitOrderbookArchiveCancelled(t *testing.T, book match.LimitOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	cancelledOrder := testLimitIDPair(t, pubkey, match.Sell, 1000, 500)
+	partialOrder := testLimitIDPair(t, pubkey, match.Sell, 1000, 500)
+	for _, order := range []*match.LimitOrderIDPair{cancelledOrder, partialOrder} {
+		if err = book.UpdateBookPlace(order); err != nil {
+			t.Errorf("Error placing order in book: %s", err)
+			return
+		}
+	}
+
+	partialExec := &match.OrderExecution{
+		OrderID:       *partialOrder.OrderID,
+		NewAmountHave: 250,
+		NewAmountWant: 125,
+	}
+	if err = book.UpdateBookExec(partialExec); err != nil {
+		t.Errorf("Error updating book with partial fill: %s", err)
+		return
+	}
+
+	for _, order := range []*match.LimitOrderIDPair{cancelledOrder, partialOrder} {
+		if err = book.UpdateBookCancel(&match.CancelledOrder{OrderID: order.OrderID}); err != nil {
+			t.Errorf("Error cancelling order: %s", err)
+			return
+		}
+	}
+
+	var archived *match.ArchivedLimitOrder
+	if archived, err = book.GetArchivedOrder(cancelledOrder.OrderID); err != nil {
+		t.Errorf("Error getting cancelled order from archive: %s", err)
+		return
+	}
+	if err = checkArchivedLimitOrder(archived, cancelledOrder, match.OrderCancelled); err != nil {
+		t.Errorf("Wrong cancelled order: %s", err)
+		return
+	}
+	if len(archived.Fills) != 0 {
+		t.Errorf("Cancelled order should have no fills, has %d", len(archived.Fills))
+		return
+	}
+
+	if archived, err = book.GetArchivedOrder(partialOrder.OrderID); err != nil {
+		t.Errorf("Error getting partially filled order from archive: %s", err)
+		return
+	}
+	if err = checkArchivedLimitOrder(archived, partialOrder, match.OrderPartiallyFilledCancelled); err != nil {
+		t.Errorf("Wrong partially filled order: %s", err)
+		return
+	}
+	if err = checkFills(archived.Fills, []uint64{375}, []uint64{750}); err != nil {
+		t.Errorf("Wrong fills for partially filled order: %s", err)
+		return
+	}
+	return
+}
+
+// limitOrderbookArchiveForPubkey checks that archived orders can be gotten by pubkey and
+// sub-account, in the order they were closed
+func limitOrderbookArchiveForPubkey(t *testing.T, book match.LimitOrderbook) {
+	var err error
+
+	pubkey, pubkeyBytes := testPubkey(t)
+	_, otherPubkeyBytes := testPubkey(t)
+	firstOrder := testLimitIDPair(t, pubkeyBytes, match.Buy, 1000, 2000)
+	secondOrder := testLimitIDPair(t, pubkeyBytes, match.Buy, 1000, 2000)
+	secondOrder.Order.SubAccount = 1
+	otherOrder := testLimitIDPair(t, otherPubkeyBytes, match.Buy, 1000, 2000)
+	restingOrder := testLimitIDPair(t, pubkeyBytes, match.Buy, 1000, 2000)
+	for _, order := range []*match.LimitOrderIDPair{firstOrder, secondOrder, otherOrder, restingOrder} {
+		if err = book.UpdateBookPlace(order); err != nil {
+			t.Errorf("Error placing order in book: %s", err)
+			return
+		}
+	}
+
+	for _, order := range []*match.LimitOrderIDPair{firstOrder, secondOrder, otherOrder} {
+		if err = book.UpdateBookCancel(&match.CancelledOrder{OrderID: order.OrderID}); err != nil {
+			t.Errorf("Error cancelling order: %s", err)
+			return
+		}
+		// make sure the orders are closed at different times
+		time.Sleep(time.Millisecond)
+	}
+
+	var archived []*match.ArchivedLimitOrder
+	if archived, err = book.GetArchivedOrdersForPubkey(pubkey, nil); err != nil {
+		t.Errorf("Error getting archived orders for pubkey: %s", err)
+		return
+	}
+	if len(archived) != 2 {
+		t.Errorf("Pubkey should have 2 archived orders across its sub-accounts, got %d", len(archived))
+		return
+	}
+	if *archived[0].Order.OrderID != *firstOrder.OrderID || *archived[1].Order.OrderID != *secondOrder.OrderID {
+		t.Errorf("Archived orders should be in the order they were closed")
+		return
+	}
+
+	subAccount := uint32(1)
+	if archived, err = book.GetArchivedOrdersForPubkey(pubkey, &subAccount); err != nil {
+		t.Errorf("Error getting archived orders for sub-account: %s", err)
+		return
+	}
+	if len(archived) != 1 {
+		t.Errorf("Sub-account should have 1 archived order, got %d", len(archived))
+		return
+	}
+	if err = checkArchivedLimitOrder(archived[0], secondOrder, match.OrderCancelled); err != nil {
+		t.Errorf("Wrong archived order for sub-account: %s", err)
+		return
+	}
+	return
+}
+
+// limitOrderbookPruneArchive checks that pruning only deletes the orders closed before the cutoff
+func limitOrderbookPruneArchive(t *testing.T, book match.LimitOrderbook) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	oldOrder := testLimitIDPair(t, pubkey, match.Buy, 1000, 2000)
+	newOrder := testLimitIDPair(t, pubkey, match.Buy, 1000, 2000)
+	for _, order := range []*match.LimitOrderIDPair{oldOrder, newOrder} {
+		if err = book.UpdateBookPlace(order); err != nil {
+			t.Errorf("Error placing order in book: %s", err)
+			return
+		}
+	}
+
+	if err = book.UpdateBookExec(&match.OrderExecution{OrderID: *oldOrder.OrderID, Filled: true}); err != nil {
+		t.Errorf("Error filling order: %s", err)
+		return
+	}
+	time.Sleep(time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond)
+	if err = book.UpdateBookCancel(&match.CancelledOrder{OrderID: newOrder.OrderID}); err != nil {
+		t.Errorf("Error cancelling order: %s", err)
+		return
+	}
+
+	var pruned uint64
+	if pruned, err = book.PruneArchive(cutoff); err != nil {
+		t.Errorf("Error pruning archive: %s", err)
+		return
+	}
+	if pruned != 1 {
+		t.Errorf("Pruning should delete the 1 order closed before the cutoff, deleted %d", pruned)
+		return
+	}
+	if _, err = book.GetArchivedOrder(oldOrder.OrderID); err == nil {
+		t.Errorf("Order closed before the cutoff should be pruned")
+		return
+	}
+	if _, err = book.GetArchivedOrder(newOrder.OrderID); err != nil {
+		t.Errorf("Order closed after the cutoff should still be archived: %s", err)
+		return
+	}
+
+	if pruned, err = book.PruneArchive(cutoff); err != nil {
+		t.Errorf("Error pruning archive again: %s", err)
+		return
+	}
+	if pruned != 0 {
+		t.Errorf("Pruning again with the same cutoff should not delete anything, deleted %d", pruned)
+		return
+	}
+	return
+}
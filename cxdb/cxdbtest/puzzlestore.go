@@ -0,0 +1,154 @@
+package cxdbtest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// PuzzleStoreConstructor creates a puzzle store for a pair. It's called once for every scenario,
+// and the store it returns should not have any puzzles in it.
+type PuzzleStoreConstructor func(pair *match.Pair) (store cxdb.PuzzleStore, err error)
+
+// puzzleTime is how long the test puzzles take to solve, it's small so they're quick to make
+const puzzleTime = uint64(100)
+
+// RunPuzzleStoreTests runs every puzzle store scenario against the stores that create makes
+func RunPuzzleStoreTests(t *testing.T, create PuzzleStoreConstructor) {
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, store cxdb.PuzzleStore)
+	}{
+		{"ViewByAuction", puzzleStoreViewByAuction},
+		{"AuctionIDs", puzzleStoreAuctionIDs},
+	}
+	for _, scenario := range scenarios {
+		run := scenario.run
+		t.Run(scenario.name, func(t *testing.T) {
+			var err error
+			var store cxdb.PuzzleStore
+			if store, err = create(&testPair); err != nil {
+				t.Fatalf("Error creating puzzle store: %s", err)
+			}
+			run(t, store)
+		})
+	}
+}
+
+// testEncryptedOrder encrypts an order for the given auction
+func testEncryptedOrder(t *testing.T, auctionID match.AuctionID, nonce uint16) (encrypted *match.EncryptedAuctionOrder) {
+	var err error
+	_, pubkey := testPubkey(t)
+	if encrypted, err = testAuctionOrder(pubkey, match.Buy, 1000, 2000, auctionID, nonce).TurnIntoEncryptedOrder(puzzleTime); err != nil {
+		t.Fatalf("Error encrypting test order: %s", err)
+	}
+	return
+}
+
+// puzzleStoreAuctionIDs checks that every auction with puzzles is listed once
+func puzzleStoreAuctionIDs(t *testing.T, store cxdb.PuzzleStore) {
+	var err error
+
+	var auctionIDs []*match.AuctionID
+	if auctionIDs, err = store.ViewAuctionIDs(); err != nil {
+		t.Errorf("Error viewing auction IDs of an empty store: %s", err)
+		return
+	}
+	if len(auctionIDs) != 0 {
+		t.Errorf("Expected no auction IDs in an empty store, got %d", len(auctionIDs))
+		return
+	}
+
+	expected := map[match.AuctionID]bool{
+		testAuctionID(0x01): true,
+		testAuctionID(0x02): true,
+	}
+	var nonce uint16
+	for auctionID := range expected {
+		for i := 0; i < 2; i++ {
+			if err = store.PlaceAuctionPuzzle(testEncryptedOrder(t, auctionID, nonce)); err != nil {
+				t.Errorf("Error placing puzzle: %s", err)
+				return
+			}
+			nonce++
+		}
+	}
+
+	if auctionIDs, err = store.ViewAuctionIDs(); err != nil {
+		t.Errorf("Error viewing auction IDs: %s", err)
+		return
+	}
+	if len(auctionIDs) != len(expected) {
+		t.Errorf("Expected %d auction IDs, got %d", len(expected), len(auctionIDs))
+		return
+	}
+	for _, auctionID := range auctionIDs {
+		if !expected[*auctionID] {
+			t.Errorf("Auction %x should not be listed", auctionID[:])
+			return
+		}
+	}
+	return
+}
+
+// puzzleStoreViewByAuction checks that viewing the puzzles for an auction gets the ones placed for
+// that auction, and only those
+func puzzleStoreViewByAuction(t *testing.T, store cxdb.PuzzleStore) {
+	var err error
+
+	auctionID := testAuctionID(0x01)
+	otherAuctionID := testAuctionID(0x02)
+	emptyAuctionID := testAuctionID(0x03)
+	puzzles := []*match.EncryptedAuctionOrder{
+		testEncryptedOrder(t, auctionID, 0),
+		testEncryptedOrder(t, auctionID, 1),
+		testEncryptedOrder(t, otherAuctionID, 2),
+	}
+	for _, puzzle := range puzzles {
+		if err = store.PlaceAuctionPuzzle(puzzle); err != nil {
+			t.Errorf("Error placing puzzle: %s", err)
+			return
+		}
+	}
+
+	var book []*match.EncryptedAuctionOrder
+	if book, err = store.ViewAuctionPuzzleBook(&auctionID); err != nil {
+		t.Errorf("Error viewing puzzle book: %s", err)
+		return
+	}
+	if len(book) != 2 {
+		t.Errorf("Expected 2 puzzles for the auction, got %d", len(book))
+		return
+	}
+	for _, puzzle := range book {
+		if puzzle.IntendedAuction != auctionID {
+			t.Errorf("Puzzle for auction %x should not be in the book for auction %x", puzzle.IntendedAuction, auctionID)
+			return
+		}
+		if !bytes.Equal(puzzle.OrderCiphertext, puzzles[0].OrderCiphertext) && !bytes.Equal(puzzle.OrderCiphertext, puzzles[1].OrderCiphertext) {
+			t.Errorf("Puzzle in the book should be one of the ones placed for the auction")
+			return
+		}
+	}
+
+	if book, err = store.ViewAuctionPuzzleBook(&otherAuctionID); err != nil {
+		t.Errorf("Error viewing other puzzle book: %s", err)
+		return
+	}
+	if len(book) != 1 || !bytes.Equal(book[0].OrderCiphertext, puzzles[2].OrderCiphertext) {
+		t.Errorf("Expected the 1 puzzle placed for the other auction, got %d", len(book))
+		return
+	}
+
+	if book, err = store.ViewAuctionPuzzleBook(&emptyAuctionID); err != nil {
+		t.Errorf("Viewing an auction without puzzles should not fail: %s", err)
+		return
+	}
+	if len(book) != 0 {
+		t.Errorf("Expected no puzzles for an auction nothing was placed in, got %d", len(book))
+		return
+	}
+	return
+}
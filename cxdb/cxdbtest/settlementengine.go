@@ -0,0 +1,183 @@
+package cxdbtest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/match"
+)
+
+// SettlementEngineConstructor creates a settlement engine for a coin. It's called once for every
+// scenario, and nobody should have a balance in the engine it returns.
+type SettlementEngineConstructor func(coin *coinparam.Params) (engine match.SettlementEngine, err error)
+
+// RunSettlementEngineTests runs every settlement engine scenario against the engines that create makes
+func RunSettlementEngineTests(t *testing.T, create SettlementEngineConstructor) {
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, engine match.SettlementEngine)
+	}{
+		{"DebitCredit", settlementEngineDebitCredit},
+		{"InsufficientBalance", settlementEngineInsufficientBalance},
+		{"SubAccounts", settlementEngineSubAccounts},
+		{"Concurrent", settlementEngineConcurrent},
+	}
+	for _, scenario := range scenarios {
+		run := scenario.run
+		t.Run(scenario.name, func(t *testing.T) {
+			var err error
+			var engine match.SettlementEngine
+			if engine, err = create(testCoin); err != nil {
+				t.Fatalf("Error creating settlement engine: %s", err)
+			}
+			run(t, engine)
+		})
+	}
+}
+
+// testSettlement creates a settlement execution for the test asset
+func testSettlement(pubkey [33]byte, subAccount uint32, amount uint64, setType match.SettleType) (setExec *match.SettlementExecution) {
+	setExec = &match.SettlementExecution{
+		Pubkey:     pubkey,
+		SubAccount: subAccount,
+		Amount:     amount,
+		Asset:      testAsset,
+		Type:       setType,
+		Reason:     match.ReasonDeposit,
+	}
+	return
+}
+
+// applySettlement applies a settlement execution and checks the new balance
+func applySettlement(engine match.SettlementEngine, setExec *match.SettlementExecution, expectedBal uint64) (err error) {
+	var setRes *match.SettlementResult
+	if setRes, err = engine.ApplySettlementExecution(setExec); err != nil {
+		err = fmt.Errorf("Error applying %s: %s", setExec, err)
+		return
+	}
+	if setRes.NewBal != expectedBal {
+		err = fmt.Errorf("Balance after %s should be %d, got %d", setExec, expectedBal, setRes.NewBal)
+		return
+	}
+	return
+}
+
+// checkValid checks that CheckValid says a settlement execution is valid or not
+func checkValid(engine match.SettlementEngine, setExec *match.SettlementExecution, expected bool) (err error) {
+	var valid bool
+	if valid, err = engine.CheckValid(setExec); err != nil {
+		err = fmt.Errorf("Error checking %s: %s", setExec, err)
+		return
+	}
+	if valid != expected {
+		err = fmt.Errorf("CheckValid for %s should be %t, got %t", setExec, expected, valid)
+		return
+	}
+	return
+}
+
+// settlementEngineDebitCredit checks that debits add to the balance and credits take from it
+func settlementEngineDebitCredit(t *testing.T, engine match.SettlementEngine) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	if err = checkValid(engine, testSettlement(pubkey, 0, 1000, match.Debit), true); err != nil {
+		t.Errorf("Debit should always be valid: %s", err)
+		return
+	}
+	if err = applySettlement(engine, testSettlement(pubkey, 0, 1000, match.Debit), 1000); err != nil {
+		t.Errorf("Error debiting: %s", err)
+		return
+	}
+	if err = applySettlement(engine, testSettlement(pubkey, 0, 400, match.Credit), 600); err != nil {
+		t.Errorf("Error crediting: %s", err)
+		return
+	}
+	if err = checkValid(engine, testSettlement(pubkey, 0, 600, match.Credit), true); err != nil {
+		t.Errorf("Credit of the whole balance should be valid: %s", err)
+		return
+	}
+	if err = checkValid(engine, testSettlement(pubkey, 0, 601, match.Credit), false); err != nil {
+		t.Errorf("Credit of more than the balance should not be valid: %s", err)
+		return
+	}
+	return
+}
+
+// settlementEngineInsufficientBalance checks that a credit bigger than the balance is rejected and
+// leaves the balance alone
+func settlementEngineInsufficientBalance(t *testing.T, engine match.SettlementEngine) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	if _, err = engine.ApplySettlementExecution(testSettlement(pubkey, 0, 1, match.Credit)); err == nil {
+		t.Errorf("Credit for an account with no balance should fail")
+		return
+	}
+
+	if err = applySettlement(engine, testSettlement(pubkey, 0, 500, match.Debit), 500); err != nil {
+		t.Errorf("Error debiting: %s", err)
+		return
+	}
+	if _, err = engine.ApplySettlementExecution(testSettlement(pubkey, 0, 501, match.Credit)); err == nil {
+		t.Errorf("Credit of more than the balance should fail")
+		return
+	}
+
+	// The failed credit shouldn't have taken anything, so the whole balance is still there
+	if err = applySettlement(engine, testSettlement(pubkey, 0, 500, match.Credit), 0); err != nil {
+		t.Errorf("Error crediting the whole balance after a failed credit: %s", err)
+		return
+	}
+	return
+}
+
+// settlementEngineSubAccounts checks that each sub-account of a pubkey has its own balance
+func settlementEngineSubAccounts(t *testing.T, engine match.SettlementEngine) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	if err = applySettlement(engine, testSettlement(pubkey, 1, 1000, match.Debit), 1000); err != nil {
+		t.Errorf("Error debiting sub-account 1: %s", err)
+		return
+	}
+	if err = checkValid(engine, testSettlement(pubkey, 0, 100, match.Credit), false); err != nil {
+		t.Errorf("Sub-account 0 should not have sub-account 1's balance: %s", err)
+		return
+	}
+	if _, err = engine.ApplySettlementExecution(testSettlement(pubkey, 0, 100, match.Credit)); err == nil {
+		t.Errorf("Credit from sub-account 0 should fail when only sub-account 1 has a balance")
+		return
+	}
+	if err = applySettlement(engine, testSettlement(pubkey, 1, 1000, match.Credit), 0); err != nil {
+		t.Errorf("Error crediting sub-account 1: %s", err)
+		return
+	}
+	return
+}
+
+// settlementEngineConcurrent checks that debits applied at the same time are all counted
+func settlementEngineConcurrent(t *testing.T, engine match.SettlementEngine) {
+	var err error
+
+	_, pubkey := testPubkey(t)
+	if err = runConcurrently(func(i int) (err error) {
+		_, err = engine.ApplySettlementExecution(testSettlement(pubkey, 0, 10, match.Debit))
+		return
+	}); err != nil {
+		t.Errorf("Error debiting concurrently: %s", err)
+		return
+	}
+
+	total := uint64(10 * concurrentCalls)
+	if err = checkValid(engine, testSettlement(pubkey, 0, total+1, match.Credit), false); err != nil {
+		t.Errorf("Balance should be exactly %d after concurrent debits: %s", total, err)
+		return
+	}
+	if err = applySettlement(engine, testSettlement(pubkey, 0, total, match.Credit), 0); err != nil {
+		t.Errorf("Balance should be exactly %d after concurrent debits: %s", total, err)
+		return
+	}
+	return
+}
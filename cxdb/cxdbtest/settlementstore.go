@@ -0,0 +1,149 @@
+package cxdbtest
+
+import (
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// SettlementStoreConstructor creates a settlement store for a coin. It's called once for every
+// scenario, and nobody should have a balance in the store it returns.
+type SettlementStoreConstructor func(coin *coinparam.Params) (store cxdb.SettlementStore, err error)
+
+// RunSettlementStoreTests runs every settlement store scenario against the stores that create makes
+func RunSettlementStoreTests(t *testing.T, create SettlementStoreConstructor) {
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, store cxdb.SettlementStore)
+	}{
+		{"SubAccounts", settlementStoreSubAccounts},
+		{"AccountBalances", settlementStoreAccountBalances},
+	}
+	for _, scenario := range scenarios {
+		run := scenario.run
+		t.Run(scenario.name, func(t *testing.T) {
+			var err error
+			var store cxdb.SettlementStore
+			if store, err = create(testCoin); err != nil {
+				t.Fatalf("Error creating settlement store: %s", err)
+			}
+			run(t, store)
+		})
+	}
+}
+
+// testSettlementResult creates a settlement result for the test asset, like a settlement engine
+// would after applying an execution
+func testSettlementResult(pubkey [33]byte, subAccount uint32, balance uint64, held uint64) (setRes *match.SettlementResult) {
+	setRes = &match.SettlementResult{
+		NewBal:         balance,
+		NewHeld:        held,
+		SuccessfulExec: testSettlement(pubkey, subAccount, balance, match.Debit),
+	}
+	return
+}
+
+// settlementStoreSubAccounts checks that balances are kept for each sub-account, and added
+// together when no sub-account is given
+func settlementStoreSubAccounts(t *testing.T, store cxdb.SettlementStore) {
+	var err error
+
+	pubkey, pubkeyBytes := testPubkey(t)
+	if err = store.UpdateBalances([]*match.SettlementResult{
+		testSettlementResult(pubkeyBytes, 0, 1000, 100),
+		testSettlementResult(pubkeyBytes, 2, 500, 50),
+	}); err != nil {
+		t.Errorf("Error updating balances: %s", err)
+		return
+	}
+
+	subAccount := uint32(2)
+	var balance uint64
+	if balance, err = store.GetBalance(pubkey, &subAccount); err != nil {
+		t.Errorf("Error getting sub-account balance: %s", err)
+		return
+	}
+	var held uint64
+	if held, err = store.GetHeldBalance(pubkey, &subAccount); err != nil {
+		t.Errorf("Error getting sub-account held balance: %s", err)
+		return
+	}
+	if balance != 500 || held != 50 {
+		t.Errorf("Sub-account should have 500 available and 50 held, has %d and %d", balance, held)
+		return
+	}
+
+	if balance, err = store.GetBalance(pubkey, nil); err != nil {
+		t.Errorf("Error getting balance of every sub-account: %s", err)
+		return
+	}
+	if held, err = store.GetHeldBalance(pubkey, nil); err != nil {
+		t.Errorf("Error getting held balance of every sub-account: %s", err)
+		return
+	}
+	if balance != 1500 || held != 150 {
+		t.Errorf("Every sub-account together should have 1500 available and 150 held, has %d and %d", balance, held)
+		return
+	}
+
+	var total uint64
+	if total, err = store.GetTotalBalance(); err != nil {
+		t.Errorf("Error getting total balance: %s", err)
+		return
+	}
+	if total != 1650 {
+		t.Errorf("Total balance should be 1650, got %d", total)
+		return
+	}
+	return
+}
+
+// settlementStoreAccountBalances checks that every sub-account is listed with its own available and
+// held balance, and that updating a balance replaces it
+func settlementStoreAccountBalances(t *testing.T, store cxdb.SettlementStore) {
+	var err error
+
+	_, first := testPubkey(t)
+	_, second := testPubkey(t)
+	expected := map[match.Account]*match.AccountBalance{
+		match.Account{Pubkey: first, SubAccount: 0}:  {Balance: 10, Held: 1},
+		match.Account{Pubkey: first, SubAccount: 1}:  {Balance: 20, Held: 2},
+		match.Account{Pubkey: second, SubAccount: 0}: {Balance: 30, Held: 3},
+	}
+	if err = store.UpdateBalances([]*match.SettlementResult{
+		testSettlementResult(first, 0, 10, 1),
+		testSettlementResult(first, 1, 5, 0),
+		testSettlementResult(second, 0, 30, 3),
+	}); err != nil {
+		t.Errorf("Error updating balances: %s", err)
+		return
+	}
+	if err = store.UpdateBalances([]*match.SettlementResult{testSettlementResult(first, 1, 20, 2)}); err != nil {
+		t.Errorf("Error replacing balance: %s", err)
+		return
+	}
+
+	var balances []*match.AccountBalance
+	if balances, err = store.GetAccountBalances(); err != nil {
+		t.Errorf("Error getting account balances: %s", err)
+		return
+	}
+	if len(balances) != len(expected) {
+		t.Errorf("Expected %d account balances, got %d", len(expected), len(balances))
+		return
+	}
+	for _, bal := range balances {
+		expectedBal, ok := expected[bal.Account]
+		if !ok {
+			t.Errorf("Account %s should not have a balance", bal.Account)
+			return
+		}
+		if bal.Balance != expectedBal.Balance || bal.Held != expectedBal.Held {
+			t.Errorf("Account %s should have %d available and %d held, has %d and %d", bal.Account, expectedBal.Balance, expectedBal.Held, bal.Balance, bal.Held)
+			return
+		}
+	}
+	return
+}
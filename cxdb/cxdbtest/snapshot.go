@@ -0,0 +1,453 @@
+package cxdbtest
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+	"github.com/mit-dci/opencx/match"
+)
+
+// SnapshotStoresConstructor creates every store a snapshot is taken from or restored into, for the
+// pairs and coins. It's called once for every scenario and every side of it, and the stores it
+// returns should be empty.
+type SnapshotStoresConstructor func(pairList []*match.Pair, coinList []*coinparam.Params) (stores *cxdbsnapshot.Stores, err error)
+
+// RunSnapshotTests runs every snapshot scenario, taking snapshots of the stores that from makes and
+// restoring them into the stores that to makes. Passing one backend as from and another as to
+// checks that snapshots move between them.
+func RunSnapshotTests(t *testing.T, from SnapshotStoresConstructor, to SnapshotStoresConstructor) {
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, from *cxdbsnapshot.Stores, to *cxdbsnapshot.Stores)
+	}{
+		{"Empty", snapshotEmpty},
+		{"RoundTrip", snapshotFilled},
+		{"RestoredEngines", snapshotRestoredEngines},
+		{"LedgerBalances", snapshotLedgerBalances},
+		{"MissingLedger", snapshotMissingLedger},
+	}
+	pairList := []*match.Pair{&testPair}
+	coinList := []*coinparam.Params{testCoin}
+	for _, scenario := range scenarios {
+		run := scenario.run
+		t.Run(scenario.name, func(t *testing.T) {
+			var err error
+			var fromStores *cxdbsnapshot.Stores
+			if fromStores, err = from(pairList, coinList); err != nil {
+				t.Fatalf("Error creating stores to snapshot: %s", err)
+			}
+			var toStores *cxdbsnapshot.Stores
+			if toStores, err = to(pairList, coinList); err != nil {
+				t.Fatalf("Error creating stores to restore into: %s", err)
+			}
+			run(t, fromStores, toStores)
+		})
+	}
+}
+
+// snapshotEmpty checks that a snapshot of empty stores restores
+func snapshotEmpty(t *testing.T, from *cxdbsnapshot.Stores, to *cxdbsnapshot.Stores) {
+	snapshotRoundTrip(t, from, to, false)
+	return
+}
+
+// snapshotFilled checks that a snapshot of stores with everything in them restores the same
+func snapshotFilled(t *testing.T, from *cxdbsnapshot.Stores, to *cxdbsnapshot.Stores) {
+	fillSnapshotStores(t, from)
+	snapshotRoundTrip(t, from, to, true)
+	return
+}
+
+// snapshotRestoredEngines checks that the engines keep working on what was restored into them. A
+// restored order can be cancelled, and a restored balance can be spent.
+func snapshotRestoredEngines(t *testing.T, from *cxdbsnapshot.Stores, to *cxdbsnapshot.Stores) {
+	var err error
+
+	fillSnapshotStores(t, from)
+	var snap *cxdbsnapshot.Snapshot
+	if snap, err = cxdbsnapshot.Take(from); err != nil {
+		t.Fatalf("Error taking snapshot: %s", err)
+	}
+	if err = cxdbsnapshot.Restore(to, snap); err != nil {
+		t.Fatalf("Error restoring snapshot: %s", err)
+	}
+
+	if ledgerStore, ok := to.LedgerStores[testCoin]; ok {
+		var mismatches []*match.LedgerMismatch
+		if mismatches, err = ledgerStore.CheckConsistency(); err != nil {
+			t.Errorf("Error checking restored ledger: %s", err)
+			return
+		}
+		if len(mismatches) != 0 {
+			t.Errorf("Restored ledger should match the restored balances, got %d mismatches", len(mismatches))
+			return
+		}
+	}
+
+	order := snap.Markets[0].LimitOrders[0]
+	var cancelSettlement *match.SettlementExecution
+	if _, cancelSettlement, err = to.LimitEngines[testPair].CancelLimitOrder(order.OrderID); err != nil {
+		t.Errorf("Error cancelling restored order: %s", err)
+		return
+	}
+	if cancelSettlement.Amount != order.Order.AmountHave {
+		t.Errorf("Cancelling restored order should give back %d, gave back %d", order.Order.AmountHave, cancelSettlement.Amount)
+		return
+	}
+
+	balance := snap.Assets[0].Balances[0]
+	var valid bool
+	if valid, err = to.SettlementEngines[testCoin].CheckValid(testSettlement(balance.Account.Pubkey, balance.Account.SubAccount, balance.Balance, match.Credit)); err != nil {
+		t.Errorf("Error checking restored balance: %s", err)
+		return
+	}
+	if !valid {
+		t.Errorf("Restored balance of %d should be in the settlement engine", balance.Balance)
+		return
+	}
+	return
+}
+
+// snapshotMissingLedger checks that a snapshot with a ledger can't be restored into stores without
+// ledger stores, and that a restore that lost the ledger doesn't verify
+func snapshotMissingLedger(t *testing.T, from *cxdbsnapshot.Stores, to *cxdbsnapshot.Stores) {
+	var err error
+
+	fillSnapshotStores(t, from)
+	var snap *cxdbsnapshot.Snapshot
+	if snap, err = cxdbsnapshot.Take(from); err != nil {
+		t.Fatalf("Error taking snapshot: %s", err)
+	}
+	if len(snap.Assets[0].Ledger) == 0 {
+		t.Fatalf("Snapshot of filled stores should have a ledger")
+	}
+
+	ledgerStores := to.LedgerStores
+	to.LedgerStores = nil
+	if err = cxdbsnapshot.Restore(to, snap); err == nil {
+		t.Fatalf("Restoring a ledger into stores without ledger stores should fail")
+	}
+
+	// the failed restore didn't restore anything, so the stores can still be restored into
+	to.LedgerStores = ledgerStores
+	if err = cxdbsnapshot.Restore(to, snap); err != nil {
+		t.Fatalf("Error restoring snapshot: %s", err)
+	}
+	if err = to.LedgerStores[testCoin].ReplaceLedger(snap.Assets[0].Ledger[:1]); err != nil {
+		t.Fatalf("Error replacing ledger: %s", err)
+	}
+	if err = cxdbsnapshot.Verify(to, snap); err == nil {
+		t.Fatalf("Verifying stores that lost part of the ledger should fail")
+	}
+	return
+}
+
+// snapshotLedgerBalances checks that stores without settlement stores, like the auction server's,
+// get their balances from the ledger, and that they restore into the settlement engines. This
+// needs a ledger, so it only runs if the stores snapshotted from keep one.
+func snapshotLedgerBalances(t *testing.T, from *cxdbsnapshot.Stores, to *cxdbsnapshot.Stores) {
+	var err error
+
+	if from.LedgerStores == nil {
+		return
+	}
+
+	fillSnapshotStores(t, from)
+	from.SettlementStores = nil
+	to.SettlementStores = nil
+
+	var snap *cxdbsnapshot.Snapshot
+	if snap, err = cxdbsnapshot.Take(from); err != nil {
+		t.Fatalf("Error taking snapshot: %s", err)
+	}
+	balances := snap.Assets[0].Balances
+	if len(balances) != 1 || balances[0].Balance != 5000 || balances[0].Held != 0 || balances[0].Account.SubAccount != 1 {
+		t.Errorf("Expected one balance of 5000 with nothing held from the ledger, got %d balances", len(balances))
+		return
+	}
+
+	if err = cxdbsnapshot.Restore(to, snap); err != nil {
+		t.Fatalf("Error restoring snapshot: %s", err)
+	}
+
+	var valid bool
+	if valid, err = to.SettlementEngines[testCoin].CheckValid(testSettlement(balances[0].Account.Pubkey, 1, 5000, match.Credit)); err != nil {
+		t.Errorf("Error checking restored balance: %s", err)
+		return
+	}
+	if !valid {
+		t.Errorf("Balance of 5000 from the ledger should be restored into the settlement engine")
+		return
+	}
+	return
+}
+
+// fillSnapshotStores puts an open limit order, a partially filled and cancelled limit order, an
+// auction with a puzzle and an order, a rejected auction order, a balance with some of it held,
+// and a pending, credited, and swept deposit into the stores
+func fillSnapshotStores(t *testing.T, stores *cxdbsnapshot.Stores) {
+	var err error
+
+	pubkey, pubkeyBytes := testPubkey(t)
+
+	var loid *match.LimitOrderIDPair
+	if loid, err = stores.LimitEngines[testPair].PlaceLimitOrder(&match.LimitOrder{
+		Pubkey:      pubkeyBytes,
+		SubAccount:  1,
+		Side:        match.Buy,
+		TradingPair: testPair,
+		AmountHave:  1000,
+		AmountWant:  2000,
+	}); err != nil {
+		t.Fatalf("Error placing limit order: %s", err)
+	}
+	if err = stores.LimitOrderbooks[testPair].UpdateBookPlace(loid); err != nil {
+		t.Fatalf("Error placing limit order in orderbook: %s", err)
+	}
+
+	cancelledOrder := testLimitIDPair(t, pubkeyBytes, match.Sell, 1000, 500)
+	if err = stores.LimitOrderbooks[testPair].UpdateBookPlace(cancelledOrder); err != nil {
+		t.Fatalf("Error placing cancelled limit order in orderbook: %s", err)
+	}
+	if err = stores.LimitOrderbooks[testPair].UpdateBookExec(&match.OrderExecution{
+		OrderID:       *cancelledOrder.OrderID,
+		NewAmountHave: 600,
+		NewAmountWant: 300,
+	}); err != nil {
+		t.Fatalf("Error partially filling cancelled limit order: %s", err)
+	}
+	if err = stores.LimitOrderbooks[testPair].UpdateBookCancel(&match.CancelledOrder{OrderID: cancelledOrder.OrderID}); err != nil {
+		t.Fatalf("Error cancelling limit order: %s", err)
+	}
+
+	auctionID := match.AuctionID{0x01}
+	auctionOrder := &match.AuctionOrder{
+		Pubkey:      pubkeyBytes,
+		Side:        match.Sell,
+		TradingPair: testPair,
+		AmountHave:  300,
+		AmountWant:  600,
+		AuctionID:   auctionID,
+	}
+	var puzzle *match.EncryptedAuctionOrder
+	if puzzle, err = auctionOrder.TurnIntoEncryptedOrder(100); err != nil {
+		t.Fatalf("Error encrypting auction order: %s", err)
+	}
+	if err = stores.PuzzleStores[testPair].PlaceAuctionPuzzle(puzzle); err != nil {
+		t.Fatalf("Error placing puzzle: %s", err)
+	}
+	var aoid *match.AuctionOrderIDPair
+	if aoid, err = stores.AuctionEngines[testPair].PlaceAuctionOrder(auctionOrder, &auctionID); err != nil {
+		t.Fatalf("Error placing auction order: %s", err)
+	}
+	if err = stores.AuctionOrderbooks[testPair].UpdateBookPlace(aoid); err != nil {
+		t.Fatalf("Error placing auction order in orderbook: %s", err)
+	}
+	if err = stores.AuctionOrderbooks[testPair].UpdateBookReject(testAuctionIDPair(t, pubkeyBytes, match.Buy, 200, 100, auctionID)); err != nil {
+		t.Fatalf("Error rejecting auction order: %s", err)
+	}
+
+	var setRes *match.SettlementResult
+	if setRes, err = stores.SettlementEngines[testCoin].ApplySettlementExecution(testSettlement(pubkeyBytes, 1, 5000, match.Debit)); err != nil {
+		t.Fatalf("Error applying settlement: %s", err)
+	}
+	setRes.NewHeld = 1000
+	if err = stores.SettlementStores[testCoin].UpdateBalances([]*match.SettlementResult{setRes}); err != nil {
+		t.Fatalf("Error updating balances: %s", err)
+	}
+
+	depositStore := stores.DepositStores[testCoin]
+	if _, err = depositStore.GetDepositIndex(pubkey); err != nil {
+		t.Fatalf("Error getting deposit index: %s", err)
+	}
+	if err = depositStore.RegisterUser(pubkey, "testaddress"); err != nil {
+		t.Fatalf("Error registering user: %s", err)
+	}
+	var deposits []match.Deposit
+	for i, confirmations := range []uint64{1, 1, 100} {
+		deposits = append(deposits, match.Deposit{
+			Pubkey:              pubkey,
+			Address:             "testaddress",
+			Amount:              uint64(100 * (i + 1)),
+			Txid:                "testtxid",
+			Vout:                uint32(i),
+			CoinType:            testCoin,
+			BlockHeightReceived: 10,
+			BlockHash:           "testblock",
+			Confirmations:       confirmations,
+		})
+	}
+	if _, err = depositStore.UpdateDeposits(deposits, 20); err != nil {
+		t.Fatalf("Error updating deposits: %s", err)
+	}
+	if err = depositStore.MarkDepositsSwept([]*match.Deposit{&deposits[0]}); err != nil {
+		t.Fatalf("Error marking deposit swept: %s", err)
+	}
+	return
+}
+
+// checkSameSnapshot checks that two snapshots are of the same state. The time the snapshots were
+// taken is ignored, order times are compared to the second since sql keeps them to the second, and
+// auction orders are compared serialized since an empty signature can come back nil. If the expected
+// snapshot has a ledger the actual one has to have the same ledger.
+func checkSameSnapshot(t *testing.T, expected *cxdbsnapshot.Snapshot, actual *cxdbsnapshot.Snapshot) {
+	if len(actual.Markets) != len(expected.Markets) || len(actual.Assets) != len(expected.Assets) {
+		t.Fatalf("Expected %d markets and %d assets, got %d and %d", len(expected.Markets), len(expected.Assets), len(actual.Markets), len(actual.Assets))
+	}
+	for i, market := range expected.Markets {
+		actualMarket := actual.Markets[i]
+		if actualMarket.Pair != market.Pair || len(actualMarket.LimitOrders) != len(market.LimitOrders) {
+			t.Fatalf("Expected %d limit orders for %s, got %d for %s", len(market.LimitOrders), market.Pair.String(), len(actualMarket.LimitOrders), actualMarket.Pair.String())
+		}
+		for j, order := range market.LimitOrders {
+			actualOrder := actualMarket.LimitOrders[j]
+			if *actualOrder.OrderID != *order.OrderID || *actualOrder.Order != *order.Order || actualOrder.Price != order.Price || !actualOrder.Timestamp.Truncate(time.Second).Equal(order.Timestamp.Truncate(time.Second)) {
+				t.Fatalf("Limit order %x was not restored the same", order.OrderID[:])
+			}
+		}
+		if len(actualMarket.Auctions) != len(market.Auctions) {
+			t.Fatalf("Expected %d auctions for %s, got %d", len(market.Auctions), market.Pair.String(), len(actualMarket.Auctions))
+		}
+		for j, auction := range market.Auctions {
+			actualAuction := actualMarket.Auctions[j]
+			if actualAuction.AuctionID != auction.AuctionID || !reflect.DeepEqual(actualAuction.Puzzles, auction.Puzzles) || len(actualAuction.Orders) != len(auction.Orders) {
+				t.Fatalf("Auction %x was not restored the same", auction.AuctionID[:])
+			}
+			for k, order := range auction.Orders {
+				actualOrder := actualAuction.Orders[k]
+				if actualOrder.OrderID != order.OrderID || actualOrder.Price != order.Price || !bytes.Equal(actualOrder.Order.Serialize(), order.Order.Serialize()) {
+					t.Fatalf("Auction order %x was not restored the same", order.OrderID[:])
+				}
+			}
+		}
+		if len(actualMarket.ArchivedLimitOrders) != len(market.ArchivedLimitOrders) || len(actualMarket.ArchivedAuctionOrders) != len(market.ArchivedAuctionOrders) {
+			t.Fatalf("Expected %d archived limit orders and %d archived auction orders for %s, got %d and %d", len(market.ArchivedLimitOrders), len(market.ArchivedAuctionOrders), market.Pair.String(), len(actualMarket.ArchivedLimitOrders), len(actualMarket.ArchivedAuctionOrders))
+		}
+		for j, archived := range market.ArchivedLimitOrders {
+			actualArchived := actualMarket.ArchivedLimitOrders[j]
+			order, actualOrder := archived.Order, actualArchived.Order
+			if *actualOrder.OrderID != *order.OrderID || *actualOrder.Order != *order.Order || actualOrder.Price != order.Price || !actualOrder.Timestamp.Truncate(time.Second).Equal(order.Timestamp.Truncate(time.Second)) {
+				t.Fatalf("Archived limit order %x was not restored the same", order.OrderID[:])
+			}
+			if actualArchived.Status != archived.Status || !actualArchived.ClosedAt.Equal(archived.ClosedAt) || !sameFills(actualArchived.Fills, archived.Fills) {
+				t.Fatalf("Archived limit order %x was not restored with the same status and fills", order.OrderID[:])
+			}
+		}
+		for j, archived := range market.ArchivedAuctionOrders {
+			actualArchived := actualMarket.ArchivedAuctionOrders[j]
+			order, actualOrder := archived.Order, actualArchived.Order
+			if actualOrder.OrderID != order.OrderID || actualOrder.Price != order.Price || !bytes.Equal(actualOrder.Order.Serialize(), order.Order.Serialize()) {
+				t.Fatalf("Archived auction order %x was not restored the same", order.OrderID[:])
+			}
+			if actualArchived.Status != archived.Status || !actualArchived.ClosedAt.Equal(archived.ClosedAt) || !sameFills(actualArchived.Fills, archived.Fills) {
+				t.Fatalf("Archived auction order %x was not restored with the same status and fills", order.OrderID[:])
+			}
+		}
+	}
+
+	// the ledgers are compared on their own, the rest of the assets have to be exactly the same
+	var expectedAssets []cxdbsnapshot.AssetSnapshot
+	var actualAssets []cxdbsnapshot.AssetSnapshot
+	for i, asset := range expected.Assets {
+		actualAsset := actual.Assets[i]
+		if len(asset.Ledger) != 0 && !sameLedger(actualAsset.Ledger, asset.Ledger) {
+			t.Fatalf("Ledger for %s was not restored the same", asset.Coin)
+		}
+		expectedAssets = append(expectedAssets, *asset)
+		expectedAssets[i].Ledger = nil
+		actualAssets = append(actualAssets, *actualAsset)
+		actualAssets[i].Ledger = nil
+	}
+	if !reflect.DeepEqual(actualAssets, expectedAssets) {
+		t.Fatalf("Balances and deposits were not restored the same")
+	}
+	return
+}
+
+// sameFills returns true if the fills are the same. Fill times are kept to the nanosecond.
+func sameFills(actual []*match.OrderFill, expected []*match.OrderFill) (same bool) {
+	if len(actual) != len(expected) {
+		return
+	}
+	for i, fill := range expected {
+		if actual[i].AmountWant != fill.AmountWant || actual[i].AmountHave != fill.AmountHave || !actual[i].Time.Equal(fill.Time) {
+			return
+		}
+	}
+	same = true
+	return
+}
+
+// sameLedger returns true if the ledgers have the same entries, with the same IDs
+func sameLedger(actual []*match.LedgerEntry, expected []*match.LedgerEntry) (same bool) {
+	if len(actual) != len(expected) {
+		return
+	}
+	for i, entry := range expected {
+		actualEntry := *actual[i]
+		if !actualEntry.Time.Equal(entry.Time) {
+			return
+		}
+		actualEntry.Time = entry.Time
+		if actualEntry != *entry {
+			return
+		}
+	}
+	same = true
+	return
+}
+
+// snapshotRoundTrip takes a snapshot of from, writes and reads it as an archive, restores it into
+// to, and checks that a snapshot of to is the same and that Verify agrees. If from was filled,
+// restoring again has to fail, since to is no longer empty, and verifying against different
+// balances has to fail.
+func snapshotRoundTrip(t *testing.T, from *cxdbsnapshot.Stores, to *cxdbsnapshot.Stores, filled bool) {
+	var err error
+
+	var snap *cxdbsnapshot.Snapshot
+	if snap, err = cxdbsnapshot.Take(from); err != nil {
+		t.Fatalf("Error taking snapshot: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err = cxdbsnapshot.WriteArchive(&buf, snap); err != nil {
+		t.Fatalf("Error writing archive: %s", err)
+	}
+	var readSnap *cxdbsnapshot.Snapshot
+	if readSnap, err = cxdbsnapshot.ReadArchive(&buf); err != nil {
+		t.Fatalf("Error reading archive: %s", err)
+	}
+	checkSameSnapshot(t, snap, readSnap)
+
+	if err = cxdbsnapshot.Restore(to, readSnap); err != nil {
+		t.Fatalf("Error restoring snapshot: %s", err)
+	}
+
+	var restoredSnap *cxdbsnapshot.Snapshot
+	if restoredSnap, err = cxdbsnapshot.Take(to); err != nil {
+		t.Fatalf("Error taking snapshot of restored stores: %s", err)
+	}
+	checkSameSnapshot(t, snap, restoredSnap)
+	if err = cxdbsnapshot.Verify(to, readSnap); err != nil {
+		t.Fatalf("Error verifying restored stores: %s", err)
+	}
+
+	if !filled {
+		return
+	}
+
+	// a restore that lost the balances should not verify
+	missingBalances := *readSnap.Assets[0]
+	missingBalances.Balances = nil
+	if err = cxdbsnapshot.Verify(to, &cxdbsnapshot.Snapshot{Markets: readSnap.Markets, Assets: []*cxdbsnapshot.AssetSnapshot{&missingBalances}}); err == nil {
+		t.Fatalf("Verifying stores against a snapshot with different balances should fail")
+	}
+	if err = cxdbsnapshot.Restore(to, readSnap); err == nil {
+		t.Fatalf("Restoring into stores that aren't empty should fail")
+	}
+	return
+}
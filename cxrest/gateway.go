@@ -0,0 +1,272 @@
+package cxrest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/mit-dci/opencx/logging"
+)
+
+const (
+	// SignatureHeader is the header authenticated calls can put their signature in, encoded in
+	// base64. It sets the Signature field of the args, so it doesn't have to be in the body.
+	SignatureHeader = "X-Opencx-Signature"
+
+	// OpenAPIPath is where the OpenAPI document for the gateway is served
+	OpenAPIPath = "/openapi.json"
+
+	// methodPrefix is what the path of every method starts with, followed by the receiver and
+	// method names
+	methodPrefix = "/v1/"
+)
+
+var (
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	bytesType = reflect.TypeOf([]byte(nil))
+)
+
+// Gateway serves the methods of RPC receivers as REST endpoints. Every method that net/rpc would
+// register is served at POST /v1/<receiver>/<method>, taking the args as a JSON body and
+// returning the reply as JSON.
+type Gateway struct {
+	title   string
+	methods map[string]*restMethod
+	// paths in the order they are documented
+	paths []string
+
+	listener   net.Listener
+	httpServer *http.Server
+}
+
+// restMethod is an RPC method that the gateway calls
+type restMethod struct {
+	name      string
+	receiver  reflect.Value
+	method    reflect.Method
+	argType   reflect.Type
+	replyType reflect.Type
+}
+
+// AdminReceiver is a receiver with methods that only the admin should call, like sweeping or taking
+// a snapshot. The gateway doesn't serve those methods, so they can only be called over the RPC.
+type AdminReceiver interface {
+	AdminMethods() (methods []string)
+}
+
+// errorReply is what is returned when a call fails
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+// NewGateway creates a gateway for the methods of each receiver, like the *cxrpc.OpencxRPC or
+// *cxauctionrpc.OpencxAuctionRPC that would be registered with net/rpc. The title is used for the
+// OpenAPI document. Admin methods of a receiver that is an AdminReceiver are not served.
+func NewGateway(title string, receivers ...interface{}) (gateway *Gateway, err error) {
+	gateway = &Gateway{
+		title:   title,
+		methods: make(map[string]*restMethod),
+	}
+
+	for _, receiver := range receivers {
+		rcvrValue := reflect.ValueOf(receiver)
+		rcvrType := rcvrValue.Type()
+		rcvrName := reflect.Indirect(rcvrValue).Type().Name()
+		if rcvrName == "" {
+			err = fmt.Errorf("Receiver of type %s has no name for NewGateway", rcvrType.String())
+			return
+		}
+
+		adminMethods := make(map[string]bool)
+		if adminRcvr, ok := receiver.(AdminReceiver); ok {
+			for _, name := range adminRcvr.AdminMethods() {
+				adminMethods[name] = true
+			}
+		}
+
+		var registered bool
+		for i := 0; i < rcvrType.NumMethod(); i++ {
+			method := rcvrType.Method(i)
+			if !isRPCMethod(method) || adminMethods[method.Name] {
+				continue
+			}
+
+			path := methodPrefix + rcvrName + "/" + method.Name
+			gateway.methods[path] = &restMethod{
+				name:      rcvrName + "." + method.Name,
+				receiver:  rcvrValue,
+				method:    method,
+				argType:   method.Type.In(1),
+				replyType: method.Type.In(2).Elem(),
+			}
+			gateway.paths = append(gateway.paths, path)
+			registered = true
+		}
+
+		if !registered {
+			err = fmt.Errorf("Receiver %s has no RPC methods for NewGateway", rcvrName)
+			return
+		}
+	}
+	sort.Strings(gateway.paths)
+
+	return
+}
+
+// isRPCMethod returns whether or not net/rpc would register the method: it has to be exported,
+// take args and a pointer to the reply, and return an error.
+func isRPCMethod(method reflect.Method) (ok bool) {
+	if method.PkgPath != "" {
+		return
+	}
+	mtype := method.Type
+	if mtype.NumIn() != 3 || mtype.NumOut() != 1 {
+		return
+	}
+	if mtype.In(2).Kind() != reflect.Ptr || mtype.Out(0) != errorType {
+		return
+	}
+	ok = true
+	return
+}
+
+// ServeHTTP serves the OpenAPI document and every method
+func (gateway *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == OpenAPIPath {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Use GET for %s", OpenAPIPath))
+			return
+		}
+		writeJSON(w, http.StatusOK, gateway.OpenAPI())
+		return
+	}
+
+	var method *restMethod
+	var ok bool
+	if method, ok = gateway.methods[r.URL.Path]; !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("No method at %s", r.URL.Path))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Use POST for %s", method.name))
+		return
+	}
+
+	var reply interface{}
+	var err error
+	if reply, err = method.call(r); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, reply)
+	return
+}
+
+// call decodes the args from the request, and calls the method with them
+func (method *restMethod) call(r *http.Request) (reply interface{}, err error) {
+	argType := method.argType
+	if argType.Kind() == reflect.Ptr {
+		argType = argType.Elem()
+	}
+	args := reflect.New(argType)
+
+	// an empty body is the zero args, for methods that don't need any
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(args.Interface()); err != nil && err != io.EOF {
+		err = fmt.Errorf("Error decoding args for %s: %s", method.name, err)
+		return
+	}
+	err = nil
+
+	if sigHeader := r.Header.Get(SignatureHeader); sigHeader != "" {
+		var sig []byte
+		if sig, err = base64.StdEncoding.DecodeString(sigHeader); err != nil {
+			err = fmt.Errorf("Error decoding %s header for %s: %s", SignatureHeader, method.name, err)
+			return
+		}
+
+		sigField := args.Elem().FieldByName("Signature")
+		if !sigField.IsValid() || sigField.Type() != bytesType {
+			err = fmt.Errorf("%s does not take a signature", method.name)
+			return
+		}
+		sigField.SetBytes(sig)
+	}
+
+	if method.argType.Kind() != reflect.Ptr {
+		args = args.Elem()
+	}
+
+	replyValue := reflect.New(method.replyType)
+	returned := method.method.Func.Call([]reflect.Value{method.receiver, args, replyValue})
+	if callErr := returned[0].Interface(); callErr != nil {
+		err = callErr.(error)
+		return
+	}
+
+	reply = replyValue.Interface()
+	return
+}
+
+// writeJSON writes the value as the JSON body of the response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	var body []byte
+	var err error
+	if body, err = json.Marshal(value); err != nil {
+		status = http.StatusInternalServerError
+		body, _ = json.Marshal(&errorReply{Error: fmt.Sprintf("Error encoding reply: %s", err)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write(body); err != nil {
+		logging.Debugf("Error writing REST response: %s", err)
+	}
+	return
+}
+
+// writeError writes the error as the JSON body of the response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &errorReply{Error: err.Error()})
+	return
+}
+
+// Listen serves the gateway on host and port until Stop is called
+func (gateway *Gateway) Listen(host string, port uint16) (err error) {
+	serverAddr := net.JoinHostPort(host, fmt.Sprintf("%d", port))
+	if gateway.listener, err = net.Listen("tcp", serverAddr); err != nil {
+		err = fmt.Errorf("Error listening for REST gateway: %s", err)
+		return
+	}
+	logging.Infof("Running REST gateway on %s\n", gateway.listener.Addr().String())
+
+	gateway.httpServer = &http.Server{Handler: gateway}
+	go func() {
+		if serveErr := gateway.httpServer.Serve(gateway.listener); serveErr != nil && serveErr != http.ErrServerClosed {
+			logging.Errorf("Error serving REST gateway: %s", serveErr)
+		}
+	}()
+	return
+}
+
+// Stop stops serving the gateway
+func (gateway *Gateway) Stop() (err error) {
+	if gateway.httpServer == nil {
+		err = fmt.Errorf("Error, cannot stop a REST gateway that isn't listening")
+		return
+	}
+	logging.Infof("Stopping REST gateway")
+	if err = gateway.httpServer.Close(); err != nil {
+		err = fmt.Errorf("Error closing REST gateway: %s", err)
+		return
+	}
+	return
+}
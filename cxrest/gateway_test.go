@@ -0,0 +1,382 @@
+package cxrest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/opencx/cxauctionrpc"
+	"github.com/mit-dci/opencx/cxdb/cxdbmemory"
+	"github.com/mit-dci/opencx/cxrpc"
+	"github.com/mit-dci/opencx/cxserver"
+	"github.com/mit-dci/opencx/match"
+)
+
+// TestRPC is a receiver with methods like the RPC receivers
+type TestRPC struct{}
+
+// EchoArgs holds the args for Echo
+type EchoArgs struct {
+	Message   string
+	Side      match.Side
+	Signature []byte
+}
+
+// EchoReply holds the reply for Echo
+type EchoReply struct {
+	Message   string
+	Side      match.Side
+	Signature []byte
+}
+
+// Echo replies with the args
+func (tr *TestRPC) Echo(args EchoArgs, reply *EchoReply) (err error) {
+	reply.Message = args.Message
+	reply.Side = args.Side
+	reply.Signature = args.Signature
+	return
+}
+
+// FailArgs holds the args for Fail
+type FailArgs struct{}
+
+// FailReply holds the reply for Fail
+type FailReply struct{}
+
+// Fail always returns an error
+func (tr *TestRPC) Fail(args *FailArgs, reply *FailReply) (err error) {
+	err = fmt.Errorf("Fail always fails")
+	return
+}
+
+// AdminRPC is a receiver with an admin method
+type AdminRPC struct {
+	TestRPC
+}
+
+// Secret is an admin method
+func (ar *AdminRPC) Secret(args EchoArgs, reply *EchoReply) (err error) {
+	reply.Message = "secret"
+	return
+}
+
+// AdminMethods returns the admin methods of AdminRPC
+func (ar *AdminRPC) AdminMethods() (methods []string) {
+	methods = []string{"Secret"}
+	return
+}
+
+// postJSON posts the body to the path on the server, and decodes the reply into reply
+func postJSON(server *httptest.Server, path string, body string, header http.Header, reply interface{}) (status int, err error) {
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodPost, server.URL+path, bytes.NewBufferString(body)); err != nil {
+		return
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	var resp *http.Response
+	if resp, err = server.Client().Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	status = resp.StatusCode
+	if err = json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		err = fmt.Errorf("Error decoding reply: %s", err)
+		return
+	}
+	return
+}
+
+func TestGatewayCall(t *testing.T) {
+	var err error
+
+	var gateway *Gateway
+	if gateway, err = NewGateway("test", &TestRPC{}); err != nil {
+		t.Errorf("Error creating gateway: %s", err)
+		return
+	}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	// the signature in the header should be used instead of the one in the body
+	sig := []byte{0x01, 0x02, 0x03}
+	header := http.Header{}
+	header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(sig))
+
+	reply := new(EchoReply)
+	var status int
+	if status, err = postJSON(server, "/v1/TestRPC/Echo", `{"Message": "hi", "Side": "buy", "Signature": "BAU="}`, header, reply); err != nil {
+		t.Errorf("Error calling Echo: %s", err)
+		return
+	}
+	if status != http.StatusOK {
+		t.Errorf("Echo should return %d, got %d", http.StatusOK, status)
+		return
+	}
+	if reply.Message != "hi" || reply.Side != match.Buy || !bytes.Equal(reply.Signature, sig) {
+		t.Errorf("Echo reply does not match args: %+v", reply)
+		return
+	}
+
+	// an empty body is the zero args
+	if status, err = postJSON(server, "/v1/TestRPC/Echo", "", nil, reply); err != nil {
+		t.Errorf("Error calling Echo with no body: %s", err)
+		return
+	}
+	if status != http.StatusOK || reply.Message != "" {
+		t.Errorf("Echo with no body should return an empty message, got %d and %q", status, reply.Message)
+		return
+	}
+
+	return
+}
+
+func TestGatewayErrors(t *testing.T) {
+	var err error
+
+	var gateway *Gateway
+	if gateway, err = NewGateway("test", &TestRPC{}); err != nil {
+		t.Errorf("Error creating gateway: %s", err)
+		return
+	}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		header http.Header
+		status int
+	}{
+		{name: "unknown method", path: "/v1/TestRPC/Nothing", body: "{}", status: http.StatusNotFound},
+		{name: "bad json", path: "/v1/TestRPC/Echo", body: "{", status: http.StatusBadRequest},
+		{name: "unknown field", path: "/v1/TestRPC/Echo", body: `{"Nothing": 1}`, status: http.StatusBadRequest},
+		{name: "bad signature", path: "/v1/TestRPC/Echo", body: "{}", header: http.Header{SignatureHeader: []string{"!!"}}, status: http.StatusBadRequest},
+		{name: "no signature field", path: "/v1/TestRPC/Fail", body: "{}", header: http.Header{SignatureHeader: []string{"AQID"}}, status: http.StatusBadRequest},
+		{name: "method error", path: "/v1/TestRPC/Fail", body: "{}", status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		reply := new(errorReply)
+		var status int
+		if status, err = postJSON(server, test.path, test.body, test.header, reply); err != nil {
+			t.Errorf("Error calling for %s: %s", test.name, err)
+			return
+		}
+		if status != test.status || reply.Error == "" {
+			t.Errorf("%s should return %d with an error, got %d and %q", test.name, test.status, status, reply.Error)
+			return
+		}
+	}
+
+	var resp *http.Response
+	if resp, err = server.Client().Get(server.URL + "/v1/TestRPC/Echo"); err != nil {
+		t.Errorf("Error getting Echo: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET for a method should return %d, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+		return
+	}
+
+	return
+}
+
+func TestGatewayAdminMethods(t *testing.T) {
+	var err error
+
+	var gateway *Gateway
+	if gateway, err = NewGateway("test", &AdminRPC{}); err != nil {
+		t.Errorf("Error creating gateway: %s", err)
+		return
+	}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	reply := new(errorReply)
+	var status int
+	if status, err = postJSON(server, "/v1/AdminRPC/Secret", "{}", nil, reply); err != nil {
+		t.Errorf("Error calling Secret: %s", err)
+		return
+	}
+	if status != http.StatusNotFound {
+		t.Errorf("Admin method should return %d, got %d", http.StatusNotFound, status)
+		return
+	}
+
+	if _, ok := gateway.OpenAPI().Paths["/v1/AdminRPC/Secret"]; ok {
+		t.Errorf("Admin method should not be in the OpenAPI document")
+		return
+	}
+
+	echoReply := new(EchoReply)
+	if status, err = postJSON(server, "/v1/AdminRPC/Echo", `{"Message": "hi"}`, nil, echoReply); err != nil {
+		t.Errorf("Error calling Echo: %s", err)
+		return
+	}
+	if status != http.StatusOK || echoReply.Message != "hi" {
+		t.Errorf("Echo should still be served, got %d and %q", status, echoReply.Message)
+		return
+	}
+
+	// none of the admin methods of the exchange RPC should be served
+	if gateway, err = NewGateway("opencxd", &cxrpc.OpencxRPC{}); err != nil {
+		t.Errorf("Error creating gateway: %s", err)
+		return
+	}
+	for _, name := range (&cxrpc.OpencxRPC{}).AdminMethods() {
+		if _, ok := gateway.methods["/v1/OpencxRPC/"+name]; ok {
+			t.Errorf("Admin method %s should not be served", name)
+			return
+		}
+	}
+
+	return
+}
+
+func TestGatewayViewOrderBook(t *testing.T) {
+	var err error
+
+	pair := &match.Pair{AssetWant: match.BTCTest, AssetHave: match.LTCTest}
+	var book match.LimitOrderbook
+	if book, err = cxdbmemory.CreateLimitOrderbook(pair); err != nil {
+		t.Errorf("Error creating orderbook: %s", err)
+		return
+	}
+	books := map[match.Pair]match.LimitOrderbook{*pair: book}
+
+	var ocxServer *cxserver.OpencxServer
+	if ocxServer, err = cxserver.InitServer(nil, nil, books, nil, nil, ""); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+
+	orderID := &match.OrderID{0x01}
+	if err = book.UpdateBookPlace(&match.LimitOrderIDPair{
+		OrderID: orderID,
+		Price:   0.5,
+		Order:   &match.LimitOrder{Side: match.Sell, TradingPair: *pair, AmountHave: 1000, AmountWant: 500},
+	}); err != nil {
+		t.Errorf("Error placing order: %s", err)
+		return
+	}
+
+	var gateway *Gateway
+	if gateway, err = NewGateway("opencxd", &cxrpc.OpencxRPC{Server: ocxServer}); err != nil {
+		t.Errorf("Error creating gateway: %s", err)
+		return
+	}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	var argBytes []byte
+	if argBytes, err = json.Marshal(&cxrpc.ViewOrderBookArgs{TradingPair: pair}); err != nil {
+		t.Errorf("Error marshalling args: %s", err)
+		return
+	}
+
+	reply := new(cxrpc.ViewOrderBookReply)
+	var status int
+	if status, err = postJSON(server, "/v1/OpencxRPC/ViewOrderBook", string(argBytes), nil, reply); err != nil {
+		t.Errorf("Error calling ViewOrderBook: %s", err)
+		return
+	}
+	if status != http.StatusOK {
+		t.Errorf("ViewOrderBook should return %d, got %d", http.StatusOK, status)
+		return
+	}
+
+	orders := reply.Orderbook[0.5]
+	if len(orders) != 1 || *orders[0].OrderID != *orderID || orders[0].Order.Side != match.Sell || orders[0].Order.AmountHave != 1000 {
+		t.Errorf("ViewOrderBook should return the order at price 0.5, got %+v", reply.Orderbook)
+		return
+	}
+
+	return
+}
+
+func TestGatewayOpenAPI(t *testing.T) {
+	var err error
+
+	receivers := []interface{}{&cxrpc.OpencxRPC{}, &cxauctionrpc.OpencxAuctionRPC{}}
+	var gateway *Gateway
+	if gateway, err = NewGateway("test", receivers...); err != nil {
+		t.Errorf("Error creating gateway: %s", err)
+		return
+	}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	var resp *http.Response
+	if resp, err = server.Client().Get(server.URL + OpenAPIPath); err != nil {
+		t.Errorf("Error getting OpenAPI document: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	doc := new(Document)
+	if err = json.NewDecoder(resp.Body).Decode(doc); err != nil {
+		t.Errorf("Error decoding OpenAPI document: %s", err)
+		return
+	}
+
+	// every RPC method should have a path, except for admin methods
+	for _, receiver := range receivers {
+		adminMethods := make(map[string]bool)
+		if adminRcvr, ok := receiver.(AdminReceiver); ok {
+			for _, name := range adminRcvr.AdminMethods() {
+				adminMethods[name] = true
+			}
+		}
+
+		rcvrType := reflect.TypeOf(receiver)
+		for i := 0; i < rcvrType.NumMethod(); i++ {
+			method := rcvrType.Method(i)
+			if !isRPCMethod(method) {
+				continue
+			}
+			path := methodPrefix + rcvrType.Elem().Name() + "/" + method.Name
+			item, ok := doc.Paths[path]
+			if adminMethods[method.Name] {
+				if ok {
+					t.Errorf("OpenAPI document should not have admin method %s", path)
+					return
+				}
+				continue
+			}
+			if !ok || item.Post == nil {
+				t.Errorf("OpenAPI document has no operation for %s", path)
+				return
+			}
+		}
+	}
+
+	getBalance := doc.Paths["/v1/OpencxRPC/GetBalance"].Post
+	if len(getBalance.Parameters) != 1 || getBalance.Parameters[0].Name != SignatureHeader {
+		t.Errorf("GetBalance should take the signature header, got %+v", getBalance.Parameters)
+		return
+	}
+
+	// the schemas that are referred to should be there
+	limitOrder, ok := doc.Components.Schemas["match.LimitOrder"]
+	if !ok {
+		t.Errorf("OpenAPI document should have a schema for match.LimitOrder")
+		return
+	}
+	if side, ok := limitOrder.Properties["side"]; !ok || side.Type != "string" || len(side.Enum) != 2 {
+		t.Errorf("LimitOrder side should be buy or sell, got %+v", side)
+		return
+	}
+
+	return
+}
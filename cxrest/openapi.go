@@ -0,0 +1,276 @@
+package cxrest
+
+import (
+	"encoding"
+	"math/big"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencx/match"
+)
+
+const (
+	openAPIVersion = "3.0.3"
+	gatewayVersion = "1.0.0"
+	jsonMediaType  = "application/json"
+	errorSchema    = "Error"
+)
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// knownSchemas are the schemas for types that aren't marshalled the way their fields look
+var knownSchemas = map[reflect.Type]*Schema{
+	reflect.TypeOf(time.Time{}):             &Schema{Type: "string", Format: "date-time"},
+	reflect.TypeOf(big.Int{}):               &Schema{Type: "integer"},
+	reflect.TypeOf(match.Side(false)):       &Schema{Type: "string", Enum: []string{"buy", "sell"}},
+	reflect.TypeOf(match.SettleType(false)): &Schema{Type: "string", Enum: []string{"debit", "credit"}},
+}
+
+// Document is an OpenAPI document describing every method of a gateway
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       *Info                `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components *Components          `json:"components"`
+}
+
+// Info is the title and version of the API
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// PathItem is the operations for a path
+type PathItem struct {
+	Get  *Operation `json:"get,omitempty"`
+	Post *Operation `json:"post,omitempty"`
+}
+
+// Operation is a method, with the header, body, and responses it takes and returns
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+// Parameter is a header an operation takes
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody is the body an operation takes
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+// Response is what an operation returns for a status
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+// MediaType is the schema of a body
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components holds the schema for each named type, so they can be referred to
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas"`
+}
+
+// Schema is the JSON schema of a type. An empty schema is any value.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// OpenAPI returns the OpenAPI document for the gateway
+func (gateway *Gateway) OpenAPI() (doc *Document) {
+	schemas := map[string]*Schema{
+		errorSchema: &Schema{
+			Type:       "object",
+			Properties: map[string]*Schema{"error": &Schema{Type: "string"}},
+		},
+	}
+	errorResponse := &Response{
+		Description: "The args could not be decoded, or the method returned an error",
+		Content:     jsonContent(refSchema(errorSchema)),
+	}
+
+	doc = &Document{
+		OpenAPI: openAPIVersion,
+		Info: &Info{
+			Title:   gateway.title,
+			Version: gatewayVersion,
+		},
+		Paths: map[string]*PathItem{
+			OpenAPIPath: &PathItem{
+				Get: &Operation{
+					OperationID: "OpenAPI",
+					Responses: map[string]*Response{
+						"200": &Response{Description: "This document"},
+					},
+				},
+			},
+		},
+		Components: &Components{Schemas: schemas},
+	}
+
+	for _, path := range gateway.paths {
+		method := gateway.methods[path]
+		argType := method.argType
+		if argType.Kind() == reflect.Ptr {
+			argType = argType.Elem()
+		}
+
+		operation := &Operation{
+			OperationID: method.name,
+			RequestBody: &RequestBody{
+				Content: jsonContent(schemaFor(argType, schemas)),
+			},
+			Responses: map[string]*Response{
+				"200": &Response{
+					Description: "The reply",
+					Content:     jsonContent(schemaFor(method.replyType, schemas)),
+				},
+				"400": errorResponse,
+			},
+		}
+
+		if sigField, ok := argType.FieldByName("Signature"); ok && argType.Kind() == reflect.Struct && sigField.Type == bytesType {
+			operation.Parameters = append(operation.Parameters, &Parameter{
+				Name:        SignatureHeader,
+				In:          "header",
+				Description: "The signature for the call, in base64. Sets the Signature in the body.",
+				Schema:      &Schema{Type: "string", Format: "byte"},
+			})
+		}
+
+		doc.Paths[path] = &PathItem{Post: operation}
+	}
+
+	return
+}
+
+// jsonContent returns the content for a JSON body with the schema
+func jsonContent(schema *Schema) (content map[string]*MediaType) {
+	content = map[string]*MediaType{jsonMediaType: &MediaType{Schema: schema}}
+	return
+}
+
+// refSchema returns a schema that refers to the named schema in the components
+func refSchema(name string) (schema *Schema) {
+	schema = &Schema{Ref: "#/components/schemas/" + name}
+	return
+}
+
+// schemaFor returns the schema for how a type is marshalled to JSON. Named structs are added to
+// schemas and referred to, so types that contain themselves are fine.
+func schemaFor(t reflect.Type, schemas map[string]*Schema) (schema *Schema) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var ok bool
+	if schema, ok = knownSchemas[t]; ok {
+		return
+	}
+	if t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		schema = &Schema{Type: "string"}
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		schema = &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		schema = &Schema{Type: "integer", Format: "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		schema = &Schema{Type: "integer", Format: "int32"}
+	case reflect.Float32:
+		schema = &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		schema = &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		schema = &Schema{Type: "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			schema = &Schema{Type: "string", Format: "byte"}
+			return
+		}
+		schema = &Schema{Type: "array", Items: schemaFor(t.Elem(), schemas)}
+	case reflect.Array:
+		length := t.Len()
+		schema = &Schema{Type: "array", Items: schemaFor(t.Elem(), schemas), MinItems: &length, MaxItems: &length}
+	case reflect.Map:
+		schema = &Schema{Type: "object", AdditionalProperties: schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			schema = structSchema(t, schemas)
+			return
+		}
+		name := t.String()
+		if _, ok = schemas[name]; !ok {
+			// add it before filling it in, in case it contains itself
+			schemas[name] = &Schema{}
+			*schemas[name] = *structSchema(t, schemas)
+		}
+		schema = refSchema(name)
+	default:
+		// interfaces can be anything
+		schema = &Schema{}
+	}
+	return
+}
+
+// structSchema returns the schema for the exported fields of a struct, the way encoding/json
+// names them
+func structSchema(t reflect.Type, schemas map[string]*Schema) (schema *Schema) {
+	schema = &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		// embedded structs without a name have their fields put in this one
+		if field.Anonymous && name == "" {
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() == reflect.Struct {
+				for propName, prop := range structSchema(fieldType, schemas).Properties {
+					schema.Properties[propName] = prop
+				}
+				continue
+			}
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = schemaFor(field.Type, schemas)
+	}
+	return
+}
@@ -0,0 +1,383 @@
+package cxrpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	util "github.com/mit-dci/opencx/chainutils"
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+	"github.com/mit-dci/opencx/cxserver"
+	"github.com/mit-dci/opencx/match"
+	"golang.org/x/crypto/sha3"
+)
+
+// AdminMethods returns the names of the RPC methods that only the admin can call. They aren't
+// served by the REST gateway, since they should only be called over the RPC.
+func (cl *OpencxRPC) AdminMethods() (methods []string) {
+	methods = []string{"Sweep", "GetReserves", "CheckLedger", "Reconcile", "ResumeWithdrawals", "Snapshot", "RecordRefill"}
+	return
+}
+
+// appendAdminNonce appends the nonce of an admin command to what gets signed for it
+func appendAdminNonce(buf []byte, nonce uint64) (newBuf []byte) {
+	var nonceBytes [8]byte
+	binary.BigEndian.PutUint64(nonceBytes[:], nonce)
+	newBuf = append(buf, nonceBytes[:]...)
+	return
+}
+
+// verifyAdminSignature recovers the pubkey that signed e and makes sure it is the admin pubkey, then
+// makes sure the nonce signed with the command hasn't been used, so the command can't be replayed
+func (cl *OpencxRPC) verifyAdminSignature(sig []byte, e []byte, nonce uint64) (err error) {
+	var pubkey *koblitz.PublicKey
+	if pubkey, _, err = koblitz.RecoverCompact(koblitz.S256(), sig, e); err != nil {
+		err = fmt.Errorf("Error, invalid signature for admin command: %s", err)
+		return
+	}
+
+	if !cl.Server.IsAdmin(pubkey) {
+		err = fmt.Errorf("Error, pubkey %x is not allowed to call admin commands", pubkey.SerializeCompressed())
+		return
+	}
+
+	if err = cl.Server.UseAdminNonce(nonce); err != nil {
+		err = fmt.Errorf("Error using nonce for admin command: %s", err)
+		return
+	}
+	return
+}
+
+// SweepArgs holds the args for Sweep
+type SweepArgs struct {
+	Asset       string
+	Destination string
+	FeeRate     uint64
+	// Nonce has to be more than the nonce of every admin command before it
+	Nonce     uint64
+	Signature []byte
+}
+
+// Serialize serializes everything in the args except the signature, which is what gets signed
+func (sa *SweepArgs) Serialize() (buf []byte) {
+	buf = append(buf, []byte("opencx-sweep")...)
+	buf = append(buf, []byte(sa.Asset)...)
+	buf = append(buf, []byte(sa.Destination)...)
+	var feeRateBytes [8]byte
+	binary.BigEndian.PutUint64(feeRateBytes[:], sa.FeeRate)
+	buf = append(buf, feeRateBytes[:]...)
+	buf = appendAdminNonce(buf, sa.Nonce)
+	return
+}
+
+// SweepReply holds the reply for Sweep
+type SweepReply struct {
+	Sweep *cxserver.UnsignedSweep
+}
+
+// Sweep is the RPC Interface for Sweep. This is an admin command.
+func (cl *OpencxRPC) Sweep(args SweepArgs, reply *SweepReply) (err error) {
+
+	// e = h("opencx-sweep" + asset + destination + feerate + nonce)
+	sha3 := sha3.New256()
+	sha3.Write(args.Serialize())
+	e := sha3.Sum(nil)
+
+	if err = cl.verifyAdminSignature(args.Signature, e, args.Nonce); err != nil {
+		err = fmt.Errorf("Error verifying signature for Sweep RPC command: %s", err)
+		return
+	}
+
+	var param *coinparam.Params
+	if param, err = util.GetParamFromName(args.Asset); err != nil {
+		err = fmt.Errorf("Error getting param from name for asset: %s", err)
+		return
+	}
+
+	if reply.Sweep, err = cl.Server.BuildSweep(param, args.Destination, args.FeeRate); err != nil {
+		err = fmt.Errorf("Error building sweep for Sweep RPC command: %s", err)
+		return
+	}
+
+	return
+}
+
+// GetReservesArgs holds the args for GetReserves
+type GetReservesArgs struct {
+	// Nonce has to be more than the nonce of every admin command before it
+	Nonce     uint64
+	Signature []byte
+}
+
+// Serialize returns what gets signed for GetReserves. The only argument is the nonce, so it's a fixed
+// string and the nonce.
+func (gra *GetReservesArgs) Serialize() (buf []byte) {
+	buf = appendAdminNonce([]byte("opencx-getreserves"), gra.Nonce)
+	return
+}
+
+// GetReservesReply holds the reply for GetReserves
+type GetReservesReply struct {
+	Reserves []*cxserver.ReserveReport
+	Sweeps   []*cxserver.HotColdSweep
+}
+
+// GetReserves is the RPC Interface for GetReserves. This is an admin command.
+func (cl *OpencxRPC) GetReserves(args GetReservesArgs, reply *GetReservesReply) (err error) {
+
+	// e = h("opencx-getreserves" + nonce)
+	sha3 := sha3.New256()
+	sha3.Write(args.Serialize())
+	e := sha3.Sum(nil)
+
+	if err = cl.verifyAdminSignature(args.Signature, e, args.Nonce); err != nil {
+		err = fmt.Errorf("Error verifying signature for GetReserves RPC command: %s", err)
+		return
+	}
+
+	if reply.Reserves, err = cl.Server.GetReserves(); err != nil {
+		err = fmt.Errorf("Error getting reserves for GetReserves RPC command: %s", err)
+		return
+	}
+	reply.Sweeps = cl.Server.GetHotColdSweeps()
+
+	return
+}
+
+// CheckLedgerArgs holds the args for CheckLedger
+type CheckLedgerArgs struct {
+	// Nonce has to be more than the nonce of every admin command before it
+	Nonce     uint64
+	Signature []byte
+}
+
+// Serialize returns what gets signed for CheckLedger. The only argument is the nonce, so it's a fixed
+// string and the nonce.
+func (cla *CheckLedgerArgs) Serialize() (buf []byte) {
+	buf = appendAdminNonce([]byte("opencx-checkledger"), cla.Nonce)
+	return
+}
+
+// CheckLedgerReply holds the reply for CheckLedger
+type CheckLedgerReply struct {
+	Mismatches []*match.LedgerMismatch
+}
+
+// CheckLedger is the RPC Interface for CheckLedger. This is an admin command.
+func (cl *OpencxRPC) CheckLedger(args CheckLedgerArgs, reply *CheckLedgerReply) (err error) {
+
+	// e = h("opencx-checkledger" + nonce)
+	sha3 := sha3.New256()
+	sha3.Write(args.Serialize())
+	e := sha3.Sum(nil)
+
+	if err = cl.verifyAdminSignature(args.Signature, e, args.Nonce); err != nil {
+		err = fmt.Errorf("Error verifying signature for CheckLedger RPC command: %s", err)
+		return
+	}
+
+	if reply.Mismatches, err = cl.Server.CheckLedgerConsistency(); err != nil {
+		err = fmt.Errorf("Error checking ledger for CheckLedger RPC command: %s", err)
+		return
+	}
+
+	return
+}
+
+// ReconcileArgs holds the args for Reconcile
+type ReconcileArgs struct {
+	// Nonce has to be more than the nonce of every admin command before it
+	Nonce     uint64
+	Signature []byte
+}
+
+// Serialize returns what gets signed for Reconcile. The only argument is the nonce, so it's a fixed
+// string and the nonce.
+func (ra *ReconcileArgs) Serialize() (buf []byte) {
+	buf = appendAdminNonce([]byte("opencx-reconcile"), ra.Nonce)
+	return
+}
+
+// ReconcileReply holds the reply for Reconcile
+type ReconcileReply struct {
+	// Reports is the reports from reconciling just now
+	Reports []*cxserver.ReconciliationReport
+	// History is every report, including the ones from just now
+	History []*cxserver.ReconciliationReport
+}
+
+// Reconcile is the RPC Interface for Reconcile. This is an admin command.
+func (cl *OpencxRPC) Reconcile(args ReconcileArgs, reply *ReconcileReply) (err error) {
+
+	// e = h("opencx-reconcile" + nonce)
+	sha3 := sha3.New256()
+	sha3.Write(args.Serialize())
+	e := sha3.Sum(nil)
+
+	if err = cl.verifyAdminSignature(args.Signature, e, args.Nonce); err != nil {
+		err = fmt.Errorf("Error verifying signature for Reconcile RPC command: %s", err)
+		return
+	}
+
+	if reply.Reports, err = cl.Server.Reconcile(); err != nil {
+		err = fmt.Errorf("Error reconciling for Reconcile RPC command: %s", err)
+		return
+	}
+	reply.History = cl.Server.GetReconciliationReports()
+
+	return
+}
+
+// ResumeWithdrawalsArgs holds the args for ResumeWithdrawals
+type ResumeWithdrawalsArgs struct {
+	Asset string
+	// Nonce has to be more than the nonce of every admin command before it
+	Nonce     uint64
+	Signature []byte
+}
+
+// Serialize serializes everything in the args except the signature, which is what gets signed
+func (rwa *ResumeWithdrawalsArgs) Serialize() (buf []byte) {
+	buf = append(buf, []byte("opencx-resumewithdrawals")...)
+	buf = append(buf, []byte(rwa.Asset)...)
+	buf = appendAdminNonce(buf, rwa.Nonce)
+	return
+}
+
+// ResumeWithdrawalsReply holds the reply for ResumeWithdrawals
+type ResumeWithdrawalsReply struct {
+	// empty
+}
+
+// ResumeWithdrawals is the RPC Interface for ResumeWithdrawals. This is an admin command.
+func (cl *OpencxRPC) ResumeWithdrawals(args ResumeWithdrawalsArgs, reply *ResumeWithdrawalsReply) (err error) {
+
+	// e = h("opencx-resumewithdrawals" + asset + nonce)
+	sha3 := sha3.New256()
+	sha3.Write(args.Serialize())
+	e := sha3.Sum(nil)
+
+	if err = cl.verifyAdminSignature(args.Signature, e, args.Nonce); err != nil {
+		err = fmt.Errorf("Error verifying signature for ResumeWithdrawals RPC command: %s", err)
+		return
+	}
+
+	var param *coinparam.Params
+	if param, err = util.GetParamFromName(args.Asset); err != nil {
+		err = fmt.Errorf("Error getting param from name for asset: %s", err)
+		return
+	}
+
+	if err = cl.Server.ResumeWithdrawals(param); err != nil {
+		err = fmt.Errorf("Error resuming withdrawals for ResumeWithdrawals RPC command: %s", err)
+		return
+	}
+
+	return
+}
+
+// SnapshotArgs holds the args for Snapshot
+type SnapshotArgs struct {
+	// Nonce has to be more than the nonce of every admin command before it
+	Nonce     uint64
+	Signature []byte
+}
+
+// Serialize returns what gets signed for Snapshot. The only argument is the nonce, so it's a fixed
+// string and the nonce.
+func (sa *SnapshotArgs) Serialize() (buf []byte) {
+	buf = appendAdminNonce([]byte("opencx-snapshot"), sa.Nonce)
+	return
+}
+
+// SnapshotReply holds the reply for Snapshot
+type SnapshotReply struct {
+	Archive []byte
+}
+
+// Snapshot is the RPC Interface for Snapshot. The reply is a snapshot archive that cxbackup or
+// opencxd can restore from. This is an admin command.
+func (cl *OpencxRPC) Snapshot(args SnapshotArgs, reply *SnapshotReply) (err error) {
+
+	// e = h("opencx-snapshot" + nonce)
+	sha3 := sha3.New256()
+	sha3.Write(args.Serialize())
+	e := sha3.Sum(nil)
+
+	if err = cl.verifyAdminSignature(args.Signature, e, args.Nonce); err != nil {
+		err = fmt.Errorf("Error verifying signature for Snapshot RPC command: %s", err)
+		return
+	}
+
+	var snap *cxdbsnapshot.Snapshot
+	if snap, err = cl.Server.TakeSnapshot(); err != nil {
+		err = fmt.Errorf("Error taking snapshot for Snapshot RPC command: %s", err)
+		return
+	}
+
+	var archiveBuf bytes.Buffer
+	if err = cxdbsnapshot.WriteArchive(&archiveBuf, snap); err != nil {
+		err = fmt.Errorf("Error writing archive for Snapshot RPC command: %s", err)
+		return
+	}
+	reply.Archive = archiveBuf.Bytes()
+
+	return
+}
+
+// RecordRefillArgs holds the args for RecordRefill
+type RecordRefillArgs struct {
+	Asset  string
+	Txid   string
+	Amount uint64
+	// Nonce has to be more than the nonce of every admin command before it
+	Nonce     uint64
+	Signature []byte
+}
+
+// Serialize serializes everything in the args except the signature, which is what gets signed
+func (rra *RecordRefillArgs) Serialize() (buf []byte) {
+	buf = append(buf, []byte("opencx-recordrefill")...)
+	buf = append(buf, []byte(rra.Asset)...)
+	buf = append(buf, []byte(rra.Txid)...)
+	var amountBytes [8]byte
+	binary.BigEndian.PutUint64(amountBytes[:], rra.Amount)
+	buf = append(buf, amountBytes[:]...)
+	buf = appendAdminNonce(buf, rra.Nonce)
+	return
+}
+
+// RecordRefillReply holds the reply for RecordRefill
+type RecordRefillReply struct {
+	// empty
+}
+
+// RecordRefill is the RPC Interface for RecordRefill. It records a refill of the hot wallet from
+// cold storage, so the refilled amount comes off the cold balance. This is an admin command.
+func (cl *OpencxRPC) RecordRefill(args RecordRefillArgs, reply *RecordRefillReply) (err error) {
+
+	// e = h("opencx-recordrefill" + asset + txid + amount + nonce)
+	sha3 := sha3.New256()
+	sha3.Write(args.Serialize())
+	e := sha3.Sum(nil)
+
+	if err = cl.verifyAdminSignature(args.Signature, e, args.Nonce); err != nil {
+		err = fmt.Errorf("Error verifying signature for RecordRefill RPC command: %s", err)
+		return
+	}
+
+	var param *coinparam.Params
+	if param, err = util.GetParamFromName(args.Asset); err != nil {
+		err = fmt.Errorf("Error getting param from name for asset: %s", err)
+		return
+	}
+
+	if err = cl.Server.RecordColdRefill(param, args.Txid, args.Amount); err != nil {
+		err = fmt.Errorf("Error recording refill for RecordRefill RPC command: %s", err)
+		return
+	}
+
+	return
+}
@@ -1,24 +1,34 @@
 package cxrpc
 
 import (
+	"encoding/binary"
 	"fmt"
+	"time"
 
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/lit/crypto/koblitz"
 	util "github.com/mit-dci/opencx/chainutils"
+	"github.com/mit-dci/opencx/crypto/liabilities"
+	"github.com/mit-dci/opencx/cxserver"
 	"github.com/mit-dci/opencx/match"
 	"golang.org/x/crypto/sha3"
 )
 
-// GetBalanceArgs hold the arguments for GetBalance
+// GetBalanceArgs hold the arguments for GetBalance. If SubAccount is nil, the balance is the sum
+// of every sub-account.
 type GetBalanceArgs struct {
-	Asset     string
-	Signature []byte
+	Asset      string
+	SubAccount *uint32
+	Signature  []byte
 }
 
-// GetBalanceReply holds the reply for GetBalance
+// GetBalanceReply holds the reply for GetBalance. Total is the available balance plus the balance
+// in orders, and Lag is how far behind the balance may be.
 type GetBalanceReply struct {
-	Amount uint64
+	Total     uint64
+	Available uint64
+	InOrders  uint64
+	Lag       cxserver.ProjectionLag
 }
 
 // GetBalance is the RPC Interface for GetBalance
@@ -41,10 +51,12 @@ func (cl *OpencxRPC) GetBalance(args GetBalanceArgs, reply *GetBalanceReply) (er
 		return
 	}
 
-	if reply.Amount, err = cl.Server.GetBalance(pubkey, param); err != nil {
+	reply.Lag = cl.Server.ProjectionLag()
+	if reply.Available, reply.InOrders, err = cl.Server.GetBalance(pubkey, param, args.SubAccount); err != nil {
 		err = fmt.Errorf("Error getting balance for pubkey in GetBalance RPC command: %s", err)
 		return
 	}
+	reply.Total = reply.Available + reply.InOrders
 
 	return
 }
@@ -88,6 +100,79 @@ func (cl *OpencxRPC) GetDepositAddress(args GetDepositAddressArgs, reply *GetDep
 	return
 }
 
+// GetDepositsArgs hold the arguments for GetDeposits
+type GetDepositsArgs struct {
+	Asset     string
+	Signature []byte
+}
+
+// DepositStatus is what we show users about a single deposit
+type DepositStatus struct {
+	Txid                  string
+	Amount                uint64
+	BlockHeightReceived   uint64
+	Confirmations         uint64
+	ConfirmationsRequired uint64
+}
+
+// GetDepositsReply holds the reply for GetDeposits
+type GetDepositsReply struct {
+	Pending []DepositStatus
+	History []DepositStatus
+}
+
+// GetDeposits is the RPC Interface for GetDeposits
+func (cl *OpencxRPC) GetDeposits(args GetDepositsArgs, reply *GetDepositsReply) (err error) {
+
+	// e = h(asset)
+	sha3 := sha3.New256()
+	sha3.Write([]byte(args.Asset))
+	e := sha3.Sum(nil)
+
+	var pubkey *koblitz.PublicKey
+	if pubkey, _, err = koblitz.RecoverCompact(koblitz.S256(), args.Signature, e); err != nil {
+		err = fmt.Errorf("Error, invalid signature with GetDeposits RPC command: %s", err)
+		return
+	}
+
+	var param *coinparam.Params
+	if param, err = util.GetParamFromName(args.Asset); err != nil {
+		err = fmt.Errorf("Error getting param from name for asset: %s", err)
+		return
+	}
+
+	var pending []*match.Deposit
+	var history []*match.Deposit
+	if pending, history, err = cl.Server.GetDeposits(pubkey, param); err != nil {
+		err = fmt.Errorf("Error getting deposits from server for GetDeposits RPC: %s", err)
+		return
+	}
+
+	height := cl.Server.GetChainHeight(param)
+	for _, deposit := range pending {
+		status := DepositStatus{
+			Txid:                  deposit.Txid,
+			Amount:                deposit.Amount,
+			BlockHeightReceived:   deposit.BlockHeightReceived,
+			Confirmations:         deposit.ConfirmationsAt(height),
+			ConfirmationsRequired: deposit.Confirmations,
+		}
+		reply.Pending = append(reply.Pending, status)
+	}
+
+	for _, deposit := range history {
+		reply.History = append(reply.History, DepositStatus{
+			Txid:                  deposit.Txid,
+			Amount:                deposit.Amount,
+			BlockHeightReceived:   deposit.BlockHeightReceived,
+			Confirmations:         deposit.Confirmations,
+			ConfirmationsRequired: deposit.Confirmations,
+		})
+	}
+
+	return
+}
+
 // WithdrawArgs holds the args for Withdraw
 type WithdrawArgs struct {
 	Withdrawal *match.Withdrawal
@@ -138,3 +223,157 @@ func (cl *OpencxRPC) Withdraw(args WithdrawArgs, reply *WithdrawReply) (err erro
 
 	return
 }
+
+// TransferArgs holds the args for Transfer
+type TransferArgs struct {
+	Transfer  *match.Transfer
+	Signature []byte
+}
+
+// TransferReply holds the reply for Transfer
+type TransferReply struct {
+	// empty
+}
+
+// Transfer is the RPC Interface for Transfer. The transfer has to be signed by the account it's
+// from.
+func (cl *OpencxRPC) Transfer(args TransferArgs, reply *TransferReply) (err error) {
+
+	if args.Transfer == nil {
+		err = fmt.Errorf("Error, no transfer given to Transfer RPC command")
+		return
+	}
+
+	// e = h(transfer)
+	sha3 := sha3.New256()
+	sha3.Write(args.Transfer.Serialize())
+	e := sha3.Sum(nil)
+
+	var pubkey *koblitz.PublicKey
+	if pubkey, _, err = koblitz.RecoverCompact(koblitz.S256(), args.Signature, e); err != nil {
+		err = fmt.Errorf("Error, invalid signature with Transfer RPC command: %s", err)
+		return
+	}
+
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+	if pubkeyBytes != args.Transfer.From {
+		err = fmt.Errorf("Error, transfer must be signed by the account it is from")
+		return
+	}
+
+	if err = cl.Server.Transfer(args.Transfer); err != nil {
+		err = fmt.Errorf("Error with transfer command: %s", err)
+		return
+	}
+
+	return
+}
+
+// GetAccountStatementArgs holds the args for GetAccountStatement. From and To are unix times.
+type GetAccountStatementArgs struct {
+	Asset     string
+	From      int64
+	To        int64
+	Signature []byte
+}
+
+// Serialize serializes everything in the args except the signature, which is what gets signed
+func (gasa *GetAccountStatementArgs) Serialize() (buf []byte) {
+	buf = append(buf, []byte(gasa.Asset)...)
+	var timeBytes [8]byte
+	binary.BigEndian.PutUint64(timeBytes[:], uint64(gasa.From))
+	buf = append(buf, timeBytes[:]...)
+	binary.BigEndian.PutUint64(timeBytes[:], uint64(gasa.To))
+	buf = append(buf, timeBytes[:]...)
+	return
+}
+
+// GetAccountStatementReply holds the reply for GetAccountStatement
+type GetAccountStatementReply struct {
+	Statement *match.AccountStatement
+}
+
+// GetAccountStatement is the RPC Interface for GetAccountStatement
+func (cl *OpencxRPC) GetAccountStatement(args GetAccountStatementArgs, reply *GetAccountStatementReply) (err error) {
+
+	// e = h(asset + from + to)
+	sha3 := sha3.New256()
+	sha3.Write(args.Serialize())
+	e := sha3.Sum(nil)
+
+	var pubkey *koblitz.PublicKey
+	if pubkey, _, err = koblitz.RecoverCompact(koblitz.S256(), args.Signature, e); err != nil {
+		err = fmt.Errorf("Error, invalid signature with GetAccountStatement RPC command: %s", err)
+		return
+	}
+
+	var param *coinparam.Params
+	if param, err = util.GetParamFromName(args.Asset); err != nil {
+		err = fmt.Errorf("Error getting param from name for asset: %s", err)
+		return
+	}
+
+	if reply.Statement, err = cl.Server.GetAccountStatement(pubkey, param, time.Unix(args.From, 0), time.Unix(args.To, 0)); err != nil {
+		err = fmt.Errorf("Error getting account statement from server for GetAccountStatement RPC: %s", err)
+		return
+	}
+
+	return
+}
+
+// GetLiabilityProofArgs holds the args for GetLiabilityProof
+type GetLiabilityProofArgs struct {
+	Asset     string
+	Signature []byte
+}
+
+// GetLiabilityProofReply holds the reply for GetLiabilityProof. The proof is for the latest snapshot.
+type GetLiabilityProofReply struct {
+	Proof    *liabilities.Proof
+	Snapshot *liabilities.Snapshot
+}
+
+// GetLiabilityProof is the RPC Interface for GetLiabilityProof
+func (cl *OpencxRPC) GetLiabilityProof(args GetLiabilityProofArgs, reply *GetLiabilityProofReply) (err error) {
+
+	// e = h(asset)
+	sha3 := sha3.New256()
+	sha3.Write([]byte(args.Asset))
+	e := sha3.Sum(nil)
+
+	var pubkey *koblitz.PublicKey
+	if pubkey, _, err = koblitz.RecoverCompact(koblitz.S256(), args.Signature, e); err != nil {
+		err = fmt.Errorf("Error, invalid signature with GetLiabilityProof RPC command: %s", err)
+		return
+	}
+
+	var param *coinparam.Params
+	if param, err = util.GetParamFromName(args.Asset); err != nil {
+		err = fmt.Errorf("Error getting param from name for asset: %s", err)
+		return
+	}
+
+	if reply.Proof, reply.Snapshot, err = cl.Server.GetLiabilityProof(pubkey, param); err != nil {
+		err = fmt.Errorf("Error getting liability proof from server for GetLiabilityProof RPC: %s", err)
+		return
+	}
+
+	return
+}
+
+// GetLiabilitySnapshotsArgs holds the args for GetLiabilitySnapshots
+type GetLiabilitySnapshotsArgs struct {
+	// empty
+}
+
+// GetLiabilitySnapshotsReply holds the reply for GetLiabilitySnapshots
+type GetLiabilitySnapshotsReply struct {
+	Snapshots []*liabilities.Snapshot
+}
+
+// GetLiabilitySnapshots gets every signed liability snapshot the exchange has published
+func (cl *OpencxRPC) GetLiabilitySnapshots(args GetLiabilitySnapshotsArgs, reply *GetLiabilitySnapshotsReply) (err error) {
+	reply.Snapshots = cl.Server.GetLiabilitySnapshots()
+	return
+}
@@ -5,6 +5,8 @@ import (
 	"net"
 	"strconv"
 
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxserver"
 	"github.com/mit-dci/opencx/logging"
 	"github.com/mit-dci/opencx/match"
 )
@@ -66,3 +68,25 @@ func (cl *OpencxRPC) WithdrawToLightningNode(args WithdrawToLightningNodeArgs, r
 
 	return
 }
+
+// GetSwapsArgs holds the args for the getswaps RPC command. The signature is of the getOrdersString.
+type GetSwapsArgs struct {
+	Signature []byte
+}
+
+// GetSwapsReply holds the reply for the getswaps RPC command
+type GetSwapsReply struct {
+	Swaps []*cxserver.PendingSwap
+}
+
+// GetSwaps gets the atomic swaps settling the swap orders of the pubkey which has signed the
+// getOrdersString. The user offers HTLCs locked with each swap's hash to pay for it.
+func (cl *OpencxRPC) GetSwaps(args GetSwapsArgs, reply *GetSwapsReply) (err error) {
+	var pubkey *koblitz.PublicKey
+	if pubkey, err = cl.Server.GetOrdersStringVerify(args.Signature); err != nil {
+		return
+	}
+
+	reply.Swaps = cl.Server.GetSwaps(pubkey)
+	return
+}
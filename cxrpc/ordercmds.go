@@ -1,9 +1,12 @@
 package cxrpc
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
 
 	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxserver"
 	"github.com/mit-dci/opencx/logging"
 	"github.com/mit-dci/opencx/match"
 	"golang.org/x/crypto/sha3"
@@ -78,14 +81,57 @@ type ViewOrderBookArgs struct {
 	TradingPair *match.Pair
 }
 
-// ViewOrderBookReply holds the reply for the vieworderbook command
+// ViewOrderBookReply holds the reply for the vieworderbook command. Lag is how far behind the
+// orderbook may be.
 type ViewOrderBookReply struct {
 	Orderbook map[float64][]*match.LimitOrderIDPair
+	Lag       cxserver.ProjectionLag
+}
+
+// viewOrderBookJSON is a ViewOrderBookReply with the prices as strings, since JSON object keys
+// can't be numbers
+type viewOrderBookJSON struct {
+	Orderbook map[string][]*match.LimitOrderIDPair
+	Lag       cxserver.ProjectionLag
+}
+
+// MarshalJSON marshals the reply with each price in the orderbook as a string
+func (r *ViewOrderBookReply) MarshalJSON() (b []byte, err error) {
+	jsonReply := &viewOrderBookJSON{
+		Orderbook: make(map[string][]*match.LimitOrderIDPair),
+		Lag:       r.Lag,
+	}
+	for pr, orders := range r.Orderbook {
+		jsonReply.Orderbook[strconv.FormatFloat(pr, 'f', -1, 64)] = orders
+	}
+	b, err = json.Marshal(jsonReply)
+	return
+}
+
+// UnmarshalJSON unmarshals a reply marshalled with MarshalJSON
+func (r *ViewOrderBookReply) UnmarshalJSON(b []byte) (err error) {
+	jsonReply := new(viewOrderBookJSON)
+	if err = json.Unmarshal(b, jsonReply); err != nil {
+		return
+	}
+
+	r.Orderbook = make(map[float64][]*match.LimitOrderIDPair)
+	r.Lag = jsonReply.Lag
+	var pr float64
+	for prString, orders := range jsonReply.Orderbook {
+		if pr, err = strconv.ParseFloat(prString, 64); err != nil {
+			err = fmt.Errorf("Error parsing price %s for ViewOrderBookReply: %s", prString, err)
+			return
+		}
+		r.Orderbook[pr] = orders
+	}
+	return
 }
 
 // ViewOrderBook handles the vieworderbook command
 func (cl *OpencxRPC) ViewOrderBook(args ViewOrderBookArgs, reply *ViewOrderBookReply) (err error) {
 
+	reply.Lag = cl.Server.ProjectionLag()
 	if reply.Orderbook, err = cl.Server.ViewOrderbook(args.TradingPair); err != nil {
 		err = fmt.Errorf("Error with server ViewOrderbook for ViewOrderbook RPC command: %s", err)
 		return
@@ -201,15 +247,19 @@ func (cl *OpencxRPC) GetPairs(args GetPairsArgs, reply *GetPairsReply) (err erro
 	return
 }
 
-// GetOrderArgs holds the args for the GetOrder command
+// GetOrderArgs holds the args for the GetOrder command. If IncludeHistory is set, orders that were
+// filled or cancelled are looked up in the order archive.
 type GetOrderArgs struct {
-	OrderID   string
-	Signature []byte
+	OrderID        string
+	Signature      []byte
+	IncludeHistory bool
 }
 
-// GetOrderReply holds the reply for the GetOrder command
+// GetOrderReply holds the reply for the GetOrder command. Order is set if the order is still in
+// the orderbook, and Archived is set if it was filled or cancelled.
 type GetOrderReply struct {
-	Order *match.LimitOrderIDPair
+	Order    *match.LimitOrderIDPair
+	Archived *match.ArchivedLimitOrder
 }
 
 // GetOrder gets an order based on orderID
@@ -232,19 +282,31 @@ func (cl *OpencxRPC) GetOrder(args GetOrderArgs, reply *GetOrderReply) (err erro
 		return
 	}
 
-	if reply.Order, err = cl.Server.GetOrder(unmarshalledOrderID); err != nil {
+	var order *match.LimitOrder
+	if reply.Order, err = cl.Server.GetOrder(unmarshalledOrderID); err == nil {
+		order = reply.Order.Order
+	} else if !args.IncludeHistory {
 		err = fmt.Errorf("Error getting order from server for GetOrder RPC command: %s", err)
 		return
+	} else {
+		reply.Order = nil
+		if reply.Archived, err = cl.Server.GetArchivedOrder(unmarshalledOrderID); err != nil {
+			err = fmt.Errorf("Error getting order from server or archive for GetOrder RPC command: %s", err)
+			return
+		}
+		order = reply.Archived.Order.Order
 	}
 
 	// try to parse the order pubkey into koblitz
 	var orderPubKey *koblitz.PublicKey
-	if orderPubKey, err = koblitz.ParsePubKey(reply.Order.Order.Pubkey[:], koblitz.S256()); err != nil {
+	if orderPubKey, err = koblitz.ParsePubKey(order.Pubkey[:], koblitz.S256()); err != nil {
 		err = fmt.Errorf("Public Key failed parsing check for GetOrder RPC command: %s", err)
 		return
 	}
 
 	if !sigPubKey.IsEqual(orderPubKey) {
+		reply.Order = nil
+		reply.Archived = nil
 		err = fmt.Errorf("Pubkey used with signature not equal to the one passed")
 		return
 	}
@@ -252,14 +314,22 @@ func (cl *OpencxRPC) GetOrder(args GetOrderArgs, reply *GetOrderReply) (err erro
 	return
 }
 
-// GetOrdersForPubkeyArgs holds the args for the GetOrdersForPubkey command
+// GetOrdersForPubkeyArgs holds the args for the GetOrdersForPubkey command. If SubAccount is nil,
+// orders from every sub-account are returned. If IncludeHistory is set, the orders that were
+// filled or cancelled are returned too.
 type GetOrdersForPubkeyArgs struct {
-	Signature []byte
+	SubAccount     *uint32
+	Signature      []byte
+	IncludeHistory bool
 }
 
-// GetOrdersForPubkeyReply holds the reply for the GetOrdersForPubkey command
+// GetOrdersForPubkeyReply holds the reply for the GetOrdersForPubkey command. Archived is the
+// orders that were filled or cancelled, in the order they were closed. Lag is how far behind the
+// orders may be.
 type GetOrdersForPubkeyReply struct {
-	Orders []*match.LimitOrderIDPair
+	Orders   []*match.LimitOrderIDPair
+	Archived []*match.ArchivedLimitOrder
+	Lag      cxserver.ProjectionLag
 }
 
 // GetOrdersForPubkey gets the orders for the pubkey which has signed the getOrdersString
@@ -269,9 +339,32 @@ func (cl *OpencxRPC) GetOrdersForPubkey(args GetOrdersForPubkeyArgs, reply *GetO
 		return
 	}
 
-	if reply.Orders, err = cl.Server.GetOrdersForPubkey(pubkey); err != nil {
+	reply.Lag = cl.Server.ProjectionLag()
+	if reply.Orders, err = cl.Server.GetOrdersForPubkey(pubkey, args.SubAccount); err != nil {
 		return
 	}
 
+	if args.IncludeHistory {
+		if reply.Archived, err = cl.Server.GetArchivedOrdersForPubkey(pubkey, args.SubAccount); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// GetOrdersStringArgs holds the args for the GetOrdersString command
+type GetOrdersStringArgs struct {
+	// empty
+}
+
+// GetOrdersStringReply holds the reply for the GetOrdersString command
+type GetOrdersStringReply struct {
+	GetOrdersString string
+}
+
+// GetOrdersString returns the string that a client signs to get their orders and swaps
+func (cl *OpencxRPC) GetOrdersString(args GetOrdersStringArgs, reply *GetOrdersStringReply) (err error) {
+	reply.GetOrdersString = cl.Server.GetOrdersString()
 	return
 }
@@ -0,0 +1,87 @@
+package cxserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+)
+
+// adminNonceFileName is the file in the opencx root directory that keeps the nonce of the last
+// admin command
+const adminNonceFileName = "adminnonce"
+
+// SetAdminPubkey sets the pubkey that is allowed to call admin commands, like sweeping deposits
+func (server *OpencxServer) SetAdminPubkey(pubkey *koblitz.PublicKey) {
+	server.adminMtx.Lock()
+	server.adminPubkey = pubkey
+	server.adminMtx.Unlock()
+	return
+}
+
+// IsAdmin returns true if the pubkey is allowed to call admin commands. If no admin pubkey is set,
+// nobody is.
+func (server *OpencxServer) IsAdmin(pubkey *koblitz.PublicKey) (isAdmin bool) {
+	server.adminMtx.Lock()
+	isAdmin = server.adminPubkey != nil && server.adminPubkey.IsEqual(pubkey)
+	server.adminMtx.Unlock()
+	return
+}
+
+// UseAdminNonce makes sure the nonce signed with an admin command is more than the nonce of every
+// admin command before it, so a signed command can't be replayed, then saves it as the last nonce.
+// This should be called before the command is run, so a command whose nonce couldn't be saved
+// isn't run.
+func (server *OpencxServer) UseAdminNonce(nonce uint64) (err error) {
+	server.adminMtx.Lock()
+	defer server.adminMtx.Unlock()
+
+	if nonce <= server.adminNonce {
+		err = fmt.Errorf("Admin command nonce %d must be more than the last nonce %d", nonce, server.adminNonce)
+		return
+	}
+
+	if server.OpencxRoot != "" {
+		// write the new nonce next to the old one and then replace it, so a crash can't leave
+		// the file without a nonce
+		tempFileName := filepath.Join(server.OpencxRoot, adminNonceFileName+".tmp")
+		if err = ioutil.WriteFile(tempFileName, []byte(strconv.FormatUint(nonce, 10)), 0600); err != nil {
+			err = fmt.Errorf("Error writing admin nonce file for UseAdminNonce: %s", err)
+			return
+		}
+		if err = os.Rename(tempFileName, filepath.Join(server.OpencxRoot, adminNonceFileName)); err != nil {
+			err = fmt.Errorf("Error replacing admin nonce file for UseAdminNonce: %s", err)
+			return
+		}
+	}
+
+	server.adminNonce = nonce
+	return
+}
+
+// LoadAdminNonce loads the nonce of the last admin command from the root directory, so admin
+// commands from before a restart can't be replayed.
+func (server *OpencxServer) LoadAdminNonce() (err error) {
+	var nonceBytes []byte
+	if nonceBytes, err = ioutil.ReadFile(filepath.Join(server.OpencxRoot, adminNonceFileName)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	var nonce uint64
+	if nonce, err = strconv.ParseUint(strings.TrimSpace(string(nonceBytes)), 10, 64); err != nil {
+		err = fmt.Errorf("Error parsing admin nonce file for LoadAdminNonce: %s", err)
+		return
+	}
+
+	server.adminMtx.Lock()
+	server.adminNonce = nonce
+	server.adminMtx.Unlock()
+	return
+}
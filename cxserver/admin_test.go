@@ -0,0 +1,60 @@
+package cxserver
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUseAdminNonce(t *testing.T) {
+	var err error
+
+	var rootDir string
+	if rootDir, err = ioutil.TempDir("", "admin"); err != nil {
+		t.Errorf("Error creating temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(rootDir)
+
+	var server *OpencxServer
+	if server, err = InitServer(nil, nil, nil, nil, nil, rootDir); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+
+	if err = server.UseAdminNonce(5); err != nil {
+		t.Errorf("Error using first admin nonce: %s", err)
+		return
+	}
+
+	// A signed command sent again has the same nonce, and an older one has a lower nonce
+	if err = server.UseAdminNonce(5); err == nil {
+		t.Errorf("Using the same admin nonce twice should fail")
+		return
+	}
+	if err = server.UseAdminNonce(4); err == nil {
+		t.Errorf("Using a lower admin nonce should fail")
+		return
+	}
+
+	// The nonce is still used after a restart
+	var restarted *OpencxServer
+	if restarted, err = InitServer(nil, nil, nil, nil, nil, rootDir); err != nil {
+		t.Errorf("Error initializing restarted server: %s", err)
+		return
+	}
+	if err = restarted.LoadAdminNonce(); err != nil {
+		t.Errorf("Error loading admin nonce: %s", err)
+		return
+	}
+	if err = restarted.UseAdminNonce(5); err == nil {
+		t.Errorf("Using an admin nonce from before a restart should fail")
+		return
+	}
+	if err = restarted.UseAdminNonce(6); err != nil {
+		t.Errorf("Error using admin nonce after restart: %s", err)
+		return
+	}
+
+	return
+}
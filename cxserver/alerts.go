@@ -0,0 +1,48 @@
+package cxserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/opencx/logging"
+)
+
+// maxAlerts is the number of alerts we keep around before dropping the oldest ones
+const maxAlerts = 1000
+
+// Alert is something that happened on the exchange that an operator needs to look at, like a
+// reorged deposit that could not be reversed.
+type Alert struct {
+	Time    time.Time
+	Message string
+}
+
+func (a *Alert) String() string {
+	return fmt.Sprintf("[%s] %s", a.Time.Format(time.RFC3339), a.Message)
+}
+
+// raiseAlert logs an alert and keeps it around so it can be fetched later
+func (server *OpencxServer) raiseAlert(format string, args ...interface{}) {
+	alert := &Alert{
+		Time:    time.Now(),
+		Message: fmt.Sprintf(format, args...),
+	}
+	logging.Errorf("ALERT: %s", alert.Message)
+
+	server.alertMtx.Lock()
+	server.alerts = append(server.alerts, alert)
+	if len(server.alerts) > maxAlerts {
+		server.alerts = server.alerts[len(server.alerts)-maxAlerts:]
+	}
+	server.alertMtx.Unlock()
+	return
+}
+
+// GetAlerts returns the alerts that have been raised, oldest first
+func (server *OpencxServer) GetAlerts() (alerts []*Alert) {
+	server.alertMtx.Lock()
+	alerts = make([]*Alert, len(server.alerts))
+	copy(alerts, server.alerts)
+	server.alertMtx.Unlock()
+	return
+}
@@ -6,29 +6,116 @@ import (
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
 )
 
-// GetBalance gets the balance for a specific public key and coin.
-func (server *OpencxServer) GetBalance(pubkey *koblitz.PublicKey, coin *coinparam.Params) (amount uint64, err error) {
+// GetBalance gets the balance for a specific public key and coin. The available balance is what can
+// be withdrawn or used to place orders, and inOrders is what is locked up in open orders. If the
+// sub-account is nil, this is the balance of every sub-account of the pubkey added together. This
+// doesn't wait on writes, so the balance may be behind by ProjectionLag.
+func (server *OpencxServer) GetBalance(pubkey *koblitz.PublicKey, coin *coinparam.Params, subAccount *uint32) (available uint64, inOrders uint64, err error) {
 
 	// First get the settlement store
-	// TODO: There should be two locks, one for critical things such as the matching and settlement
-	// engine, and another for just the stuff we view. (like the orderbooks and stores)
-	server.dbLock.Lock()
 	var currSettlementStore cxdb.SettlementStore
 	var ok bool
 	if currSettlementStore, ok = server.SettlementStores[coin]; !ok {
 		err = fmt.Errorf("Cannot find the settlement store for GetBalance")
-		server.dbLock.Unlock()
 		return
 	}
 
-	if amount, err = currSettlementStore.GetBalance(pubkey); err != nil {
+	if available, err = currSettlementStore.GetBalance(pubkey, subAccount); err != nil {
 		err = fmt.Errorf("Could not get balance for pubkey for GetBalance: %s", err)
-		server.dbLock.Unlock()
 		return
 	}
-	server.dbLock.Unlock()
 
+	if inOrders, err = currSettlementStore.GetHeldBalance(pubkey, subAccount); err != nil {
+		err = fmt.Errorf("Could not get held balance for pubkey for GetBalance: %s", err)
+		return
+	}
+
+	return
+}
+
+// heldAsset returns the asset that an order locks up while it is on the book. This is the same
+// asset that is credited when the order is placed.
+func heldAsset(order *match.LimitOrder) (asset match.Asset) {
+	if order.Side == match.Buy {
+		asset = order.TradingPair.AssetHave
+		return
+	}
+	asset = order.TradingPair.AssetWant
+	return
+}
+
+// getHeldBalances gets the amount of every asset that a sub-account of a pubkey has locked up in open
+// orders, by going through every orderbook. This assumes dbLock is held, or that it's being called
+// while applying a read update.
+func (server *OpencxServer) getHeldBalances(pubkey *koblitz.PublicKey, subAccount uint32) (held map[match.Asset]uint64, err error) {
+	held = make(map[match.Asset]uint64)
+	var currOrderMap map[float64][]*match.LimitOrderIDPair
+	for _, currOrderbook := range server.Orderbooks {
+		if currOrderMap, err = currOrderbook.GetOrdersForPubkey(pubkey, &subAccount); err != nil {
+			err = fmt.Errorf("Error getting orders for pubkey for getHeldBalances: %s", err)
+			return
+		}
+
+		for _, orders := range currOrderMap {
+			for _, order := range orders {
+				// swap orders are paid for over lightning, so they don't hold anything
+				if order.Order.Swap {
+					continue
+				}
+				held[heldAsset(order.Order)] += order.Order.AmountHave
+			}
+		}
+	}
+	return
+}
+
+// updateSettlementStores sets the held balance on each settlement result from the orderbooks, then
+// sends each result to the settlement store for its asset. This should be called after the
+// orderbooks are updated, so the held balances match the open orders. Writes should go through
+// queueReadUpdate instead, so the updates are applied in order.
+func (server *OpencxServer) updateSettlementStores(settlementResults []*match.SettlementResult) (err error) {
+	heldForAccount := make(map[match.Account]map[match.Asset]uint64)
+	resultsForCoin := make(map[*coinparam.Params][]*match.SettlementResult)
+	for _, setRes := range settlementResults {
+		account := setRes.SuccessfulExec.Account()
+		held, ok := heldForAccount[account]
+		if !ok {
+			var pubkey *koblitz.PublicKey
+			if pubkey, err = koblitz.ParsePubKey(account.Pubkey[:], koblitz.S256()); err != nil {
+				err = fmt.Errorf("Error parsing pubkey for updateSettlementStores: %s", err)
+				return
+			}
+			if held, err = server.getHeldBalances(pubkey, account.SubAccount); err != nil {
+				err = fmt.Errorf("Error getting held balances for updateSettlementStores: %s", err)
+				return
+			}
+			heldForAccount[account] = held
+		}
+		setRes.NewHeld = held[setRes.SuccessfulExec.Asset]
+
+		var coin *coinparam.Params
+		if coin, err = setRes.SuccessfulExec.Asset.CoinParamFromAsset(); err != nil {
+			err = fmt.Errorf("Error getting coin param from asset for updateSettlementStores: %s", err)
+			return
+		}
+		resultsForCoin[coin] = append(resultsForCoin[coin], setRes)
+	}
+
+	for coin, coinResults := range resultsForCoin {
+		var currSettleStore cxdb.SettlementStore
+		var ok bool
+		if currSettleStore, ok = server.SettlementStores[coin]; !ok {
+			err = fmt.Errorf("Could not find settlement store for cointype %s", coin.Name)
+			return
+		}
+
+		if err = currSettleStore.UpdateBalances(coinResults); err != nil {
+			err = fmt.Errorf("Error updating %s balances for updateSettlementStores: %s", coin.Name, err)
+			return
+		}
+	}
 	return
 }
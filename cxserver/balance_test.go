@@ -0,0 +1,371 @@
+package cxserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/cxdb/cxdbmemory"
+	"github.com/mit-dci/opencx/match"
+)
+
+// testPubkeyOrderbook is an orderbook that only knows which orders belong to which pubkey
+type testPubkeyOrderbook struct {
+	orders []*match.LimitOrderIDPair
+}
+
+func (tb *testPubkeyOrderbook) UpdateBookExec(orderExec *match.OrderExecution) (err error) {
+	return
+}
+
+func (tb *testPubkeyOrderbook) UpdateBookCancel(cancel *match.CancelledOrder) (err error) {
+	return
+}
+
+func (tb *testPubkeyOrderbook) UpdateBookPlace(limitIDPair *match.LimitOrderIDPair) (err error) {
+	tb.orders = append(tb.orders, limitIDPair)
+	return
+}
+
+func (tb *testPubkeyOrderbook) GetOrder(orderID *match.OrderID) (limOrder *match.LimitOrderIDPair, err error) {
+	err = fmt.Errorf("Not implemented")
+	return
+}
+
+func (tb *testPubkeyOrderbook) CalculatePrice() (price float64, err error) {
+	return
+}
+
+func (tb *testPubkeyOrderbook) GetOrdersForPubkey(pubkey *koblitz.PublicKey, subAccount *uint32) (orders map[float64][]*match.LimitOrderIDPair, err error) {
+	orders = make(map[float64][]*match.LimitOrderIDPair)
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+	for _, order := range tb.orders {
+		if order.Order.Pubkey == pubkeyBytes && (subAccount == nil || order.Order.SubAccount == *subAccount) {
+			orders[order.Price] = append(orders[order.Price], order)
+		}
+	}
+	return
+}
+
+func (tb *testPubkeyOrderbook) ViewLimitOrderBook() (book map[float64][]*match.LimitOrderIDPair, err error) {
+	return
+}
+
+func (tb *testPubkeyOrderbook) GetArchivedOrder(orderID *match.OrderID) (archived *match.ArchivedLimitOrder, err error) {
+	err = fmt.Errorf("Not implemented")
+	return
+}
+
+func (tb *testPubkeyOrderbook) GetArchivedOrdersForPubkey(pubkey *koblitz.PublicKey, subAccount *uint32) (archived []*match.ArchivedLimitOrder, err error) {
+	return
+}
+
+func (tb *testPubkeyOrderbook) ViewArchive() (archived []*match.ArchivedLimitOrder, err error) {
+	return
+}
+
+func (tb *testPubkeyOrderbook) RestoreArchivedOrder(archived *match.ArchivedLimitOrder) (err error) {
+	err = fmt.Errorf("Not implemented")
+	return
+}
+
+func (tb *testPubkeyOrderbook) PruneArchive(before time.Time) (pruned uint64, err error) {
+	return
+}
+
+// testResultSettlementStore is a settlement store that keeps the last result for each account
+type testResultSettlementStore struct {
+	results map[match.Account]*match.SettlementResult
+}
+
+func (ts *testResultSettlementStore) UpdateBalances(settlementResults []*match.SettlementResult) (err error) {
+	for _, setRes := range settlementResults {
+		ts.results[setRes.SuccessfulExec.Account()] = setRes
+	}
+	return
+}
+
+func (ts *testResultSettlementStore) GetBalance(pubkey *koblitz.PublicKey, subAccount *uint32) (balance uint64, err error) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+	for account, setRes := range ts.results {
+		if account.Pubkey == pubkeyBytes && (subAccount == nil || account.SubAccount == *subAccount) {
+			balance += setRes.NewBal
+		}
+	}
+	return
+}
+
+func (ts *testResultSettlementStore) GetHeldBalance(pubkey *koblitz.PublicKey, subAccount *uint32) (held uint64, err error) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+	for account, setRes := range ts.results {
+		if account.Pubkey == pubkeyBytes && (subAccount == nil || account.SubAccount == *subAccount) {
+			held += setRes.NewHeld
+		}
+	}
+	return
+}
+
+func (ts *testResultSettlementStore) GetTotalBalance() (total uint64, err error) {
+	for _, setRes := range ts.results {
+		total += setRes.NewBal + setRes.NewHeld
+	}
+	return
+}
+
+func (ts *testResultSettlementStore) GetAllBalances() (balances map[[33]byte]uint64, err error) {
+	balances = make(map[[33]byte]uint64)
+	for account, setRes := range ts.results {
+		balances[account.Pubkey] += setRes.NewBal + setRes.NewHeld
+	}
+	return
+}
+
+func (ts *testResultSettlementStore) GetAccountBalances() (balances []*match.AccountBalance, err error) {
+	for account, setRes := range ts.results {
+		balances = append(balances, &match.AccountBalance{Account: account, Balance: setRes.NewBal, Held: setRes.NewHeld})
+	}
+	return
+}
+
+func TestHeldBalancesFollowOpenOrders(t *testing.T) {
+	var err error
+
+	btcStore := &testResultSettlementStore{results: make(map[match.Account]*match.SettlementResult)}
+	ltcStore := &testResultSettlementStore{results: make(map[match.Account]*match.SettlementResult)}
+	setStores := map[*coinparam.Params]cxdb.SettlementStore{
+		&coinparam.TestNet3Params:         btcStore,
+		&coinparam.LiteCoinTestNet4Params: ltcStore,
+	}
+
+	pair := match.Pair{AssetWant: match.BTCTest, AssetHave: match.LTCTest}
+	book := &testPubkeyOrderbook{}
+	books := map[match.Pair]match.LimitOrderbook{pair: book}
+
+	var server *OpencxServer
+	if server, err = InitServer(nil, nil, books, nil, setStores, ""); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating user key: %s", err)
+		return
+	}
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], privkey.PubKey().SerializeCompressed())
+
+	// A buy order locks up what the buyer has, and a sell order locks up what the seller has
+	book.UpdateBookPlace(&match.LimitOrderIDPair{
+		Price: 2,
+		Order: &match.LimitOrder{Pubkey: pubkeyBytes, Side: match.Buy, TradingPair: pair, AmountHave: 1000, AmountWant: 2000},
+	})
+	book.UpdateBookPlace(&match.LimitOrderIDPair{
+		Price: 3,
+		Order: &match.LimitOrder{Pubkey: pubkeyBytes, Side: match.Sell, TradingPair: pair, AmountHave: 300, AmountWant: 900},
+	})
+
+	// Results for two different assets should go to two different settlement stores
+	settlementResults := []*match.SettlementResult{
+		{
+			NewBal:         5000,
+			SuccessfulExec: &match.SettlementExecution{Pubkey: pubkeyBytes, Asset: match.LTCTest, Amount: 1000, Type: match.Credit},
+		},
+		{
+			NewBal:         700,
+			SuccessfulExec: &match.SettlementExecution{Pubkey: pubkeyBytes, Asset: match.BTCTest, Amount: 300, Type: match.Credit},
+		},
+	}
+
+	server.dbLock.Lock()
+	err = server.updateSettlementStores(settlementResults)
+	server.dbLock.Unlock()
+	if err != nil {
+		t.Errorf("Error updating settlement stores: %s", err)
+		return
+	}
+
+	var available, inOrders uint64
+	if available, inOrders, err = server.GetBalance(privkey.PubKey(), &coinparam.LiteCoinTestNet4Params, nil); err != nil {
+		t.Errorf("Error getting ltc balance: %s", err)
+		return
+	}
+	if available != 5000 || inOrders != 1000 {
+		t.Errorf("LTC should have 5000 available and 1000 in orders, got %d and %d", available, inOrders)
+		return
+	}
+
+	if available, inOrders, err = server.GetBalance(privkey.PubKey(), &coinparam.TestNet3Params, nil); err != nil {
+		t.Errorf("Error getting btc balance: %s", err)
+		return
+	}
+	if available != 700 || inOrders != 300 {
+		t.Errorf("BTC should have 700 available and 300 in orders, got %d and %d", available, inOrders)
+		return
+	}
+
+	return
+}
+
+// applyTestUpdate queues an update the way the order methods do, and waits for it to be applied
+func applyTestUpdate(server *OpencxServer, update *readUpdate) (err error) {
+	server.dbLock.Lock()
+	err = server.queueReadUpdate(update)
+	server.dbLock.Unlock()
+	if err != nil {
+		return
+	}
+	server.waitForProjection()
+	return
+}
+
+// balanceResult is the settlement result for a new balance of an asset
+func balanceResult(pubkey [33]byte, asset match.Asset, newBal uint64) (setRes *match.SettlementResult) {
+	setRes = &match.SettlementResult{
+		NewBal:         newBal,
+		SuccessfulExec: &match.SettlementExecution{Pubkey: pubkey, Asset: asset, Type: match.Debit},
+	}
+	return
+}
+
+func TestHeldBalanceFillsAndCancel(t *testing.T) {
+	var err error
+
+	pair := match.Pair{AssetWant: match.BTCReg, AssetHave: match.LTCReg}
+	btc := &coinparam.RegressionNetParams
+	ltc := &coinparam.LiteRegNetParams
+
+	var setStores map[*coinparam.Params]cxdb.SettlementStore
+	if setStores, err = cxdbmemory.CreateSettlementStoreMap([]*coinparam.Params{btc, ltc}); err != nil {
+		t.Errorf("Error creating settlement stores: %s", err)
+		return
+	}
+	var books map[match.Pair]match.LimitOrderbook
+	if books, err = cxdbmemory.CreateLimitOrderbookMap([]*match.Pair{&pair}); err != nil {
+		t.Errorf("Error creating orderbooks: %s", err)
+		return
+	}
+
+	var server *OpencxServer
+	if server, err = InitServer(nil, nil, books, nil, setStores, ""); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+	server.StartProjection()
+
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating user key: %s", err)
+		return
+	}
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], privkey.PubKey().SerializeCompressed())
+
+	checkBalance := func(coin *coinparam.Params, available uint64, inOrders uint64) (ok bool) {
+		var gotAvailable, gotInOrders uint64
+		if gotAvailable, gotInOrders, err = server.GetBalance(privkey.PubKey(), coin, nil); err != nil {
+			t.Errorf("Error getting %s balance: %s", coin.Name, err)
+			return
+		}
+		if gotAvailable != available || gotInOrders != inOrders {
+			t.Errorf("%s should have %d available and %d in orders, got %d and %d", coin.Name, available, inOrders, gotAvailable, gotInOrders)
+			return
+		}
+		ok = true
+		return
+	}
+
+	// Placing a buy order holds the ltc it pays with
+	buyID := &match.OrderID{0x01}
+	if err = applyTestUpdate(server, &readUpdate{
+		pair: pair,
+		placed: &match.LimitOrderIDPair{
+			Price:   1,
+			OrderID: buyID,
+			Order:   &match.LimitOrder{Pubkey: pubkeyBytes, Side: match.Buy, TradingPair: pair, AmountHave: 2000, AmountWant: 2000},
+		},
+		settlementResults: []*match.SettlementResult{balanceResult(pubkeyBytes, match.LTCReg, 3000)},
+	}); err != nil {
+		t.Errorf("Error placing order: %s", err)
+		return
+	}
+	if !checkBalance(ltc, 3000, 2000) {
+		return
+	}
+
+	// A partial fill releases what was paid out of the hold, and the rest of the order stays held
+	if err = applyTestUpdate(server, &readUpdate{
+		pair:  pair,
+		execs: []*match.OrderExecution{{OrderID: *buyID, NewAmountHave: 1500, NewAmountWant: 1500}},
+		settlementResults: []*match.SettlementResult{
+			balanceResult(pubkeyBytes, match.LTCReg, 3000),
+			balanceResult(pubkeyBytes, match.BTCReg, 500),
+		},
+	}); err != nil {
+		t.Errorf("Error partially filling order: %s", err)
+		return
+	}
+	if !checkBalance(ltc, 3000, 1500) {
+		return
+	}
+	if !checkBalance(btc, 500, 0) {
+		return
+	}
+
+	// A full fill releases the whole hold
+	if err = applyTestUpdate(server, &readUpdate{
+		pair:  pair,
+		execs: []*match.OrderExecution{{OrderID: *buyID, Filled: true}},
+		settlementResults: []*match.SettlementResult{
+			balanceResult(pubkeyBytes, match.LTCReg, 3000),
+			balanceResult(pubkeyBytes, match.BTCReg, 2000),
+		},
+	}); err != nil {
+		t.Errorf("Error filling order: %s", err)
+		return
+	}
+	if !checkBalance(ltc, 3000, 0) {
+		return
+	}
+	if !checkBalance(btc, 2000, 0) {
+		return
+	}
+
+	// Cancelling moves the hold back to the available balance
+	cancelID := &match.OrderID{0x02}
+	if err = applyTestUpdate(server, &readUpdate{
+		pair: pair,
+		placed: &match.LimitOrderIDPair{
+			Price:   1,
+			OrderID: cancelID,
+			Order:   &match.LimitOrder{Pubkey: pubkeyBytes, Side: match.Buy, TradingPair: pair, AmountHave: 1000, AmountWant: 1000},
+		},
+		settlementResults: []*match.SettlementResult{balanceResult(pubkeyBytes, match.LTCReg, 2000)},
+	}); err != nil {
+		t.Errorf("Error placing order to cancel: %s", err)
+		return
+	}
+	if !checkBalance(ltc, 2000, 1000) {
+		return
+	}
+
+	if err = applyTestUpdate(server, &readUpdate{
+		pair:              pair,
+		cancelled:         &match.CancelledOrder{OrderID: cancelID},
+		settlementResults: []*match.SettlementResult{balanceResult(pubkeyBytes, match.LTCReg, 3000)},
+	}); err != nil {
+		t.Errorf("Error cancelling order: %s", err)
+		return
+	}
+	if !checkBalance(ltc, 3000, 0) {
+		return
+	}
+
+	return
+}
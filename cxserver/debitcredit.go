@@ -5,14 +5,13 @@ import (
 
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/lit/crypto/koblitz"
-	"github.com/mit-dci/opencx/cxdb"
 	"github.com/mit-dci/opencx/match"
 )
 
 // DebitUser adds to the balance of the pubkey by issuing a settlement exec and bringing it through
-// all of the required data stores.
+// all of the required data stores. The reason and reference are written to the ledger.
 // DebitUser acquires dbLock so it can just be called.
-func (server *OpencxServer) DebitUser(pubkey *koblitz.PublicKey, amount uint64, param *coinparam.Params) (err error) {
+func (server *OpencxServer) DebitUser(pubkey *koblitz.PublicKey, amount uint64, param *coinparam.Params, reason match.LedgerReason, reference string) (err error) {
 
 	var assetToDebit match.Asset
 	if assetToDebit, err = match.AssetFromCoinParam(param); err != nil {
@@ -23,16 +22,9 @@ func (server *OpencxServer) DebitUser(pubkey *koblitz.PublicKey, amount uint64,
 	// Lock!
 	server.dbLock.Lock()
 
-	// Get the settle store and the settle engine for the coin
-	var currSettleStore cxdb.SettlementStore
-	var ok bool
-	if currSettleStore, ok = server.SettlementStores[param]; !ok {
-		err = fmt.Errorf("Could not find settlement store for cointype %s", param.Name)
-		server.dbLock.Unlock()
-		return
-	}
-
+	// Get the settle engine for the coin
 	var currSettleEngine match.SettlementEngine
+	var ok bool
 	if currSettleEngine, ok = server.SettlementEngines[param]; !ok {
 		err = fmt.Errorf("Could not find settlement engine for cointype %s", param.Name)
 		server.dbLock.Unlock()
@@ -40,9 +32,11 @@ func (server *OpencxServer) DebitUser(pubkey *koblitz.PublicKey, amount uint64,
 	}
 
 	setExecForPush := &match.SettlementExecution{
-		Type:   match.Debit,
-		Asset:  assetToDebit,
-		Amount: amount,
+		Type:      match.Debit,
+		Asset:     assetToDebit,
+		Amount:    amount,
+		Reason:    reason,
+		Reference: reference,
 	}
 	copy(setExecForPush.Pubkey[:], pubkey.SerializeCompressed())
 
@@ -69,7 +63,7 @@ func (server *OpencxServer) DebitUser(pubkey *koblitz.PublicKey, amount uint64,
 
 	settlementResults = append(settlementResults, setRes)
 
-	if err = currSettleStore.UpdateBalances(settlementResults); err != nil {
+	if err = server.queueReadUpdate(&readUpdate{settlementResults: settlementResults}); err != nil {
 		err = fmt.Errorf("Error updating balances for DebitUser: %s", err)
 		server.dbLock.Unlock()
 		return
@@ -80,9 +74,9 @@ func (server *OpencxServer) DebitUser(pubkey *koblitz.PublicKey, amount uint64,
 }
 
 // CreditUser subtracts the balance of the pubkey by issuing a settlement exec and bringing it through
-// all of the required data stores.
+// all of the required data stores. The reason and reference are written to the ledger.
 // CreditUser acquires dbLock so it can just be called.
-func (server *OpencxServer) CreditUser(pubkey *koblitz.PublicKey, amount uint64, param *coinparam.Params) (err error) {
+func (server *OpencxServer) CreditUser(pubkey *koblitz.PublicKey, amount uint64, param *coinparam.Params, reason match.LedgerReason, reference string) (err error) {
 
 	var assetToCredit match.Asset
 	if assetToCredit, err = match.AssetFromCoinParam(param); err != nil {
@@ -93,16 +87,9 @@ func (server *OpencxServer) CreditUser(pubkey *koblitz.PublicKey, amount uint64,
 	// Lock!
 	server.dbLock.Lock()
 
-	// Get the settle store and the settle engine for the coin
-	var currSettleStore cxdb.SettlementStore
-	var ok bool
-	if currSettleStore, ok = server.SettlementStores[param]; !ok {
-		err = fmt.Errorf("Could not find settlement store for cointype %s", param.Name)
-		server.dbLock.Unlock()
-		return
-	}
-
+	// Get the settle engine for the coin
 	var currSettleEngine match.SettlementEngine
+	var ok bool
 	if currSettleEngine, ok = server.SettlementEngines[param]; !ok {
 		err = fmt.Errorf("Could not find settlement engine for cointype %s", param.Name)
 		server.dbLock.Unlock()
@@ -110,9 +97,11 @@ func (server *OpencxServer) CreditUser(pubkey *koblitz.PublicKey, amount uint64,
 	}
 
 	setExecForPush := &match.SettlementExecution{
-		Type:   match.Credit,
-		Asset:  assetToCredit,
-		Amount: amount,
+		Type:      match.Credit,
+		Asset:     assetToCredit,
+		Amount:    amount,
+		Reason:    reason,
+		Reference: reference,
 	}
 	copy(setExecForPush.Pubkey[:], pubkey.SerializeCompressed())
 
@@ -138,7 +127,7 @@ func (server *OpencxServer) CreditUser(pubkey *koblitz.PublicKey, amount uint64,
 	}
 	settlementResults = append(settlementResults, setRes)
 
-	if err = currSettleStore.UpdateBalances(settlementResults); err != nil {
+	if err = server.queueReadUpdate(&readUpdate{settlementResults: settlementResults}); err != nil {
 		err = fmt.Errorf("Error updating balances for CreditUser: %s", err)
 		server.dbLock.Unlock()
 		return
@@ -6,6 +6,7 @@ import (
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
 )
 
 // RegisterUser gives the user a balance of 0, and gives them deposit addresses. This acquires locks
@@ -42,7 +43,7 @@ func (server *OpencxServer) RegisterUser(pubkey *koblitz.PublicKey) (err error)
 			return
 		}
 
-		if err = server.DebitUser(pubkey, 0, param); err != nil {
+		if err = server.DebitUser(pubkey, 0, param, match.ReasonDeposit, "register"); err != nil {
 			err = fmt.Errorf("Error giving user a balance of zero for RegisterUser: %s", err)
 			return
 		}
@@ -74,3 +75,31 @@ func (server *OpencxServer) GetDepositAddress(pubkey *koblitz.PublicKey, coin *c
 
 	return
 }
+
+// GetDeposits gets the pending deposits and the credited deposit history for the pubkey and coin
+func (server *OpencxServer) GetDeposits(pubkey *koblitz.PublicKey, coin *coinparam.Params) (pending []*match.Deposit, history []*match.Deposit, err error) {
+
+	server.dbLock.Lock()
+	var currDepositStore cxdb.DepositStore
+	var ok bool
+	if currDepositStore, ok = server.DepositStores[coin]; !ok {
+		err = fmt.Errorf("Could not find DepositStore for %s for GetDeposits", coin.Name)
+		server.dbLock.Unlock()
+		return
+	}
+
+	if pending, err = currDepositStore.GetPendingDeposits(pubkey); err != nil {
+		err = fmt.Errorf("Error getting pending deposits from store for GetDeposits: %s", err)
+		server.dbLock.Unlock()
+		return
+	}
+
+	if history, err = currDepositStore.GetDepositHistory(pubkey); err != nil {
+		err = fmt.Errorf("Error getting deposit history from store for GetDeposits: %s", err)
+		server.dbLock.Unlock()
+		return
+	}
+	server.dbLock.Unlock()
+
+	return
+}
@@ -36,6 +36,38 @@ func (server *OpencxServer) GetPushHandler() (hFunc func(event eventbus.Event) e
 	return
 }
 
+// GetSwapHTLCHandler gets the handler func to look for HTLCs that users offer us for their side of a
+// swap. Once a user has offered everything they pay, we claim it, which completes the swap.
+func (server *OpencxServer) GetSwapHTLCHandler() (hFunc func(event eventbus.Event) eventbus.EventHandleResult) {
+	hFunc = func(event eventbus.Event) (res eventbus.EventHandleResult) {
+		// We know this is a channel state update event
+		ee, ok := event.(qln.ChannelStateUpdateEvent)
+		if !ok {
+			logging.Errorf("Wrong type of event, why are you making this the handler for that?")
+			// Still don't know if this is the right thing to return when we have an error
+			return eventbus.EHANDLE_CANCEL
+		}
+
+		if ee.State == nil || ee.State.Failed {
+			return eventbus.EHANDLE_OK
+		}
+
+		var err error
+		for _, htlc := range ee.State.HTLCs {
+			if !htlc.Incoming || htlc.Clearing || htlc.Cleared {
+				continue
+			}
+			if err = server.ingestSwapHTLC(htlc.RHash, &ee.TheirPub, ee.CoinType, ee.ChanIdx, htlc.Idx, uint64(htlc.Amt), htlc.Locktime); err != nil {
+				logging.Errorf("ingesting swap HTLC error: %s", err)
+				return eventbus.EHANDLE_CANCEL
+			}
+		}
+
+		return eventbus.EHANDLE_OK
+	}
+	return
+}
+
 // GetOPConfirmHandler gets the handler func to pass in an amount to the updatebalance function
 func (server *OpencxServer) GetOPConfirmHandler() (hFunc func(event eventbus.Event) eventbus.EventHandleResult) {
 	hFunc = func(event eventbus.Event) (res eventbus.EventHandleResult) {
@@ -112,8 +144,18 @@ func (server *OpencxServer) ChainHookHeightHandler(incomingBlockHeight chan int3
 // CallIngest calls the ingest function. This is so we can make a bunch of different handlers that call this depending on which way they use channels.
 func (server *OpencxServer) CallIngest(blockHeight int32, block *wire.MsgBlock, coinType *coinparam.Params) {
 	// logging.Debugf("Ingesting %d transactions at height %d\n", len(block.Transactions), blockHeight)
-	if err := server.ingestTransactionListAndHeight(block.Transactions, uint64(blockHeight), coinType); err != nil {
+	// Before we ingest anything, make sure this block doesn't orphan any blocks we've already ingested
+	if orphanedHashes := server.recordBlockAndFindOrphans(uint64(blockHeight), block, coinType); len(orphanedHashes) > 0 {
+		if err := server.rollbackOrphanedDeposits(orphanedHashes, coinType); err != nil {
+			logging.Errorf("Error rolling back orphaned %s deposits: %s\n", coinType.Name, err)
+		}
+	}
+	if err := server.ingestTransactionListAndHeight(block.Transactions, uint64(blockHeight), block.Header.BlockHash().String(), coinType); err != nil {
 		logging.Infof("something went horribly wrong with %s\n", coinType.Name)
 		logging.Errorf("Here's what went horribly wrong: %s\n", err)
 	}
+	// Take back our side of any swaps on this coin that have timed out
+	if err := server.expireSwaps(coinType.HDCoinType, blockHeight); err != nil {
+		logging.Errorf("Error expiring %s swaps: %s\n", coinType.Name, err)
+	}
 }
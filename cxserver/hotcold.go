@@ -0,0 +1,418 @@
+package cxserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/portxo"
+	"github.com/mit-dci/lit/wire"
+	util "github.com/mit-dci/opencx/chainutils"
+	"github.com/mit-dci/opencx/logging"
+)
+
+// hotColdHistoryFileName is the file in the opencx root directory that hot to cold sweeps are
+// appended to, one JSON record per line
+const hotColdHistoryFileName = "hotcoldsweeps.json"
+
+// HotWalletPolicy is how much of a coin we are willing to keep in the hot wallet. When the hot
+// wallet goes over the ceiling, the excess is swept to the cold destination, leaving the hot wallet
+// halfway between the floor and the ceiling. When the hot wallet is at or below the floor, an
+// operator has to refill it from cold storage.
+type HotWalletPolicy struct {
+	Ceiling         uint64
+	Floor           uint64
+	ColdDestination string
+}
+
+// HotColdSweep is a record of a sweep from the hot wallet to cold storage, or of a refill from cold
+// storage back into the hot wallet
+type HotColdSweep struct {
+	Coin        string
+	Txid        string
+	Amount      uint64
+	Destination string
+	// HotBalance is the hot wallet balance before the sweep
+	HotBalance uint64
+	Time       time.Time
+	// Refill is true if this moved Amount from cold storage into the hot wallet
+	Refill bool
+}
+
+// ReserveReport is how much of a coin the exchange holds, in the hot wallet and in cold storage,
+// compared to how much it owes its users.
+type ReserveReport struct {
+	Coin       string
+	HotBalance uint64
+	// ColdBalance is everything swept to cold storage less what was refilled from it, plus deposits
+	// to watch-only addresses that have not been swept yet, since the hot wallet can't spend those
+	// either
+	ColdBalance uint64
+	Liabilities uint64
+}
+
+// SetHotWalletPolicy sets the hot wallet ceiling, floor and cold destination for a coin
+func (server *OpencxServer) SetHotWalletPolicy(coinType *coinparam.Params, policy *HotWalletPolicy) (err error) {
+	if policy.Floor >= policy.Ceiling {
+		err = fmt.Errorf("Hot wallet floor %d must be less than the ceiling %d", policy.Floor, policy.Ceiling)
+		return
+	}
+
+	if _, err = util.ScriptFromAddress(policy.ColdDestination, coinType); err != nil {
+		err = fmt.Errorf("Invalid cold destination for SetHotWalletPolicy: %s", err)
+		return
+	}
+
+	server.hotColdMtx.Lock()
+	server.hotWalletPolicies[coinType] = policy
+	server.hotColdMtx.Unlock()
+	return
+}
+
+// hotWalletAction decides what to do with a hot wallet balance given the policy. If the balance is
+// over the ceiling, sweepAmount is how much should go to cold storage. If the balance is at or below
+// the floor, needsRefill is true.
+func hotWalletAction(balance uint64, policy *HotWalletPolicy) (sweepAmount uint64, needsRefill bool) {
+	if balance > policy.Ceiling {
+		target := policy.Floor + (policy.Ceiling-policy.Floor)/2
+		sweepAmount = balance - target
+		return
+	}
+	needsRefill = balance <= policy.Floor
+	return
+}
+
+// StartHotWalletMonitor checks every hot wallet that has a policy against that policy, once every
+// interval, until the server goes away.
+func (server *OpencxServer) StartHotWalletMonitor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			server.checkHotWallets()
+		}
+	}()
+	return
+}
+
+// checkHotWallets sweeps hot wallets over their ceiling and raises an alert for hot wallets at or
+// below their floor. Alerts are only raised once each time a wallet drops to the floor.
+func (server *OpencxServer) checkHotWallets() {
+	server.hotColdMtx.Lock()
+	policies := make(map[*coinparam.Params]*HotWalletPolicy)
+	for coinType, policy := range server.hotWalletPolicies {
+		policies[coinType] = policy
+	}
+	server.hotColdMtx.Unlock()
+
+	for coinType, policy := range policies {
+		var err error
+		var balance uint64
+		if balance, err = server.getHotBalance(coinType); err != nil {
+			logging.Errorf("Error getting %s hot wallet balance: %s", coinType.Name, err)
+			continue
+		}
+
+		sweepAmount, needsRefill := hotWalletAction(balance, policy)
+
+		server.hotColdMtx.Lock()
+		alreadyAlerted := server.refillAlerted[coinType]
+		server.refillAlerted[coinType] = needsRefill
+		server.hotColdMtx.Unlock()
+
+		if needsRefill && !alreadyAlerted {
+			server.raiseAlert("%s hot wallet balance %d is at or below the floor of %d, refill it from cold storage and record the refill", coinType.Name, balance, policy.Floor)
+		}
+
+		if sweepAmount > 0 {
+			if err = server.sweepHotToCold(coinType, policy.ColdDestination, sweepAmount, balance); err != nil {
+				server.raiseAlert("Could not sweep %d %s from the hot wallet to cold storage: %s", sweepAmount, coinType.Name, err)
+			}
+		}
+	}
+	return
+}
+
+// getHotBalance gets the total value of the utxos in the hot wallet for a coin
+func (server *OpencxServer) getHotBalance(coinType *coinparam.Params) (balance uint64, err error) {
+	server.walletMtx.Lock()
+	wallet, found := server.WalletMap[coinType]
+	server.walletMtx.Unlock()
+	if !found {
+		err = fmt.Errorf("Could not find wallet for %s", coinType.Name)
+		return
+	}
+
+	var utxos []*portxo.PorTxo
+	if utxos, err = wallet.UtxoDump(); err != nil {
+		err = fmt.Errorf("Error getting utxos for getHotBalance: %s", err)
+		return
+	}
+
+	for _, utxo := range utxos {
+		balance += uint64(utxo.Value)
+	}
+	return
+}
+
+// sweepWallet is the part of a wallet that sweeps use to send to cold storage
+type sweepWallet interface {
+	// Fee is the fee rate, per byte
+	Fee() int64
+	// PickUtxos picks utxos that cover the amount and the fee, and returns how much is left over for
+	// change
+	PickUtxos(amtWanted, outputByteSize, feePerByte int64, ow bool) (portxo.TxoSliceByBip69, int64, error)
+	// NewChangeOut makes an output that pays the amount back to the wallet
+	NewChangeOut(amt int64) (*wire.TxOut, error)
+	// BuildAndSign builds a transaction spending the utxos to the outputs
+	BuildAndSign(utxos []*portxo.PorTxo, txos []*wire.TxOut, nlt uint32) (*wire.MsgTx, error)
+	// NewOutgoingTx broadcasts the transaction
+	NewOutgoingTx(tx *wire.MsgTx) error
+}
+
+// sweepHotToCold sends amount from the hot wallet to the cold destination, and records the sweep
+func (server *OpencxServer) sweepHotToCold(coinType *coinparam.Params, destination string, amount uint64, hotBalance uint64) (err error) {
+	server.walletMtx.Lock()
+	wallet, found := server.WalletMap[coinType]
+	server.walletMtx.Unlock()
+	if !found {
+		err = fmt.Errorf("Could not find wallet for %s", coinType.Name)
+		return
+	}
+
+	err = server.sweepFromWallet(wallet, coinType, destination, amount, hotBalance)
+	return
+}
+
+// sweepFromWallet sends amount from the wallet to the cold destination, and records the sweep. The
+// cold output is exactly the amount, the fee comes out of the change.
+func (server *OpencxServer) sweepFromWallet(wallet sweepWallet, coinType *coinparam.Params, destination string, amount uint64, hotBalance uint64) (err error) {
+	var destScript []byte
+	if destScript, err = util.ScriptFromAddress(destination, coinType); err != nil {
+		err = fmt.Errorf("Error decoding cold destination for sweepFromWallet: %s", err)
+		return
+	}
+
+	// PickUtxos picks enough for the amount and the fee, so the overshoot left for change already
+	// has the fee taken out of it
+	var utxoSlice portxo.TxoSliceByBip69
+	var overshoot int64
+	if utxoSlice, overshoot, err = wallet.PickUtxos(int64(amount), int64(len(destScript)), wallet.Fee(), false); err != nil {
+		err = fmt.Errorf("Error picking utxos for sweepFromWallet: %s", err)
+		return
+	}
+
+	var changeOut *wire.TxOut
+	if changeOut, err = wallet.NewChangeOut(overshoot); err != nil {
+		err = fmt.Errorf("Error creating change output for sweepFromWallet: %s", err)
+		return
+	}
+
+	coldOut := wire.NewTxOut(int64(amount), destScript)
+
+	var sweepTx *wire.MsgTx
+	if sweepTx, err = wallet.BuildAndSign(utxoSlice, []*wire.TxOut{changeOut, coldOut}, 0); err != nil {
+		err = fmt.Errorf("Error building sweep tx for sweepFromWallet: %s", err)
+		return
+	}
+
+	if err = wallet.NewOutgoingTx(sweepTx); err != nil {
+		err = fmt.Errorf("Error sending sweep tx for sweepFromWallet: %s", err)
+		return
+	}
+
+	sweep := &HotColdSweep{
+		Coin:        coinType.Name,
+		Txid:        sweepTx.TxHash().String(),
+		Amount:      amount,
+		Destination: destination,
+		HotBalance:  hotBalance,
+		Time:        time.Now(),
+	}
+	logging.Infof("Swept %d %s from the hot wallet to %s in %s", amount, coinType.Name, destination, sweep.Txid)
+
+	if err = server.recordHotColdSweep(sweep); err != nil {
+		err = fmt.Errorf("Sweep %s was sent but could not be recorded: %s", sweep.Txid, err)
+		return
+	}
+	return
+}
+
+// recordHotColdSweep keeps the sweep in memory and appends it to the history file, if the server has
+// a root directory
+func (server *OpencxServer) recordHotColdSweep(sweep *HotColdSweep) (err error) {
+	server.hotColdMtx.Lock()
+	server.hotColdSweeps = append(server.hotColdSweeps, sweep)
+	server.hotColdMtx.Unlock()
+
+	if server.OpencxRoot == "" {
+		return
+	}
+
+	var sweepBytes []byte
+	if sweepBytes, err = json.Marshal(sweep); err != nil {
+		err = fmt.Errorf("Error marshalling sweep for recordHotColdSweep: %s", err)
+		return
+	}
+
+	var historyFile *os.File
+	if historyFile, err = os.OpenFile(filepath.Join(server.OpencxRoot, hotColdHistoryFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+		err = fmt.Errorf("Error opening sweep history for recordHotColdSweep: %s", err)
+		return
+	}
+	defer historyFile.Close()
+
+	if _, err = historyFile.Write(append(sweepBytes, '\n')); err != nil {
+		err = fmt.Errorf("Error writing sweep history for recordHotColdSweep: %s", err)
+		return
+	}
+	return
+}
+
+// LoadHotColdSweeps loads the sweep history from the root directory, so cold totals survive a restart
+func (server *OpencxServer) LoadHotColdSweeps() (err error) {
+	var historyFile *os.File
+	if historyFile, err = os.Open(filepath.Join(server.OpencxRoot, hotColdHistoryFileName)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer historyFile.Close()
+
+	var sweeps []*HotColdSweep
+	scanner := bufio.NewScanner(historyFile)
+	for scanner.Scan() {
+		sweep := new(HotColdSweep)
+		if err = json.Unmarshal(scanner.Bytes(), sweep); err != nil {
+			err = fmt.Errorf("Error parsing sweep history for LoadHotColdSweeps: %s", err)
+			return
+		}
+		sweeps = append(sweeps, sweep)
+	}
+	if err = scanner.Err(); err != nil {
+		err = fmt.Errorf("Error reading sweep history for LoadHotColdSweeps: %s", err)
+		return
+	}
+
+	server.hotColdMtx.Lock()
+	server.hotColdSweeps = sweeps
+	server.hotColdMtx.Unlock()
+	return
+}
+
+// RecordColdRefill records that amount was sent from cold storage to the hot wallet in txid, so it
+// comes off the cold balance. Refills are made by an operator, the exchange can't spend cold funds.
+func (server *OpencxServer) RecordColdRefill(coinType *coinparam.Params, txid string, amount uint64) (err error) {
+	if amount == 0 {
+		err = fmt.Errorf("Refill amount for RecordColdRefill must be more than zero")
+		return
+	}
+
+	swept := server.coldSweptBalance(coinType)
+	if amount > swept {
+		err = fmt.Errorf("Refill of %d %s is more than the %d swept to cold storage", amount, coinType.Name, swept)
+		return
+	}
+
+	refill := &HotColdSweep{
+		Coin:   coinType.Name,
+		Txid:   txid,
+		Amount: amount,
+		Time:   time.Now(),
+		Refill: true,
+	}
+	logging.Infof("Refilled %d %s from cold storage to the hot wallet in %s", amount, coinType.Name, txid)
+
+	if err = server.recordHotColdSweep(refill); err != nil {
+		err = fmt.Errorf("Error recording refill for RecordColdRefill: %s", err)
+		return
+	}
+	return
+}
+
+// coldSweptBalance is how much of a coin is in cold storage from hot wallet sweeps, which is
+// everything swept there less everything refilled from it
+func (server *OpencxServer) coldSweptBalance(coinType *coinparam.Params) (balance uint64) {
+	var swept, refilled uint64
+	for _, sweep := range server.GetHotColdSweeps() {
+		if sweep.Coin != coinType.Name {
+			continue
+		}
+		if sweep.Refill {
+			refilled += sweep.Amount
+		} else {
+			swept += sweep.Amount
+		}
+	}
+
+	if refilled < swept {
+		balance = swept - refilled
+	}
+	return
+}
+
+// GetHotColdSweeps returns every sweep from the hot wallet to cold storage and every refill back,
+// oldest first
+func (server *OpencxServer) GetHotColdSweeps() (sweeps []*HotColdSweep) {
+	server.hotColdMtx.Lock()
+	sweeps = make([]*HotColdSweep, len(server.hotColdSweeps))
+	copy(sweeps, server.hotColdSweeps)
+	server.hotColdMtx.Unlock()
+	return
+}
+
+// GetReserves reports the hot and cold totals for every coin with a settlement store, against the
+// total of all user balances for that coin.
+func (server *OpencxServer) GetReserves() (reports []*ReserveReport, err error) {
+	server.dbLock.Lock()
+	coins := make([]*coinparam.Params, 0, len(server.SettlementStores))
+	for coinType := range server.SettlementStores {
+		coins = append(coins, coinType)
+	}
+	server.dbLock.Unlock()
+
+	for _, coinType := range coins {
+		report := &ReserveReport{
+			Coin:        coinType.Name,
+			ColdBalance: server.coldSweptBalance(coinType),
+		}
+
+		// not every coin has a hot wallet running
+		var hotErr error
+		if report.HotBalance, hotErr = server.getHotBalance(coinType); hotErr != nil {
+			logging.Warnf("No hot balance for %s reserves: %s", coinType.Name, hotErr)
+		}
+
+		server.dbLock.Lock()
+		server.waitForProjection()
+		if report.Liabilities, err = server.SettlementStores[coinType].GetTotalBalance(); err != nil {
+			err = fmt.Errorf("Error getting total %s balance for GetReserves: %s", coinType.Name, err)
+			server.dbLock.Unlock()
+			return
+		}
+
+		var unswept uint64
+		if unswept, err = server.unsweptDepositTotal(coinType); err != nil {
+			err = fmt.Errorf("Error getting unswept deposits for GetReserves: %s", err)
+			server.dbLock.Unlock()
+			return
+		}
+		report.ColdBalance += unswept
+		server.dbLock.Unlock()
+
+		reports = append(reports, report)
+	}
+	return
+}
+
+// hasDepositXpub returns true if deposits for the coin go to watch-only addresses
+func (server *OpencxServer) hasDepositXpub(coinType *coinparam.Params) (hasXpub bool) {
+	server.walletMtx.Lock()
+	_, hasXpub = server.depositXpubs[coinType]
+	server.walletMtx.Unlock()
+	return
+}
@@ -0,0 +1,359 @@
+package cxserver
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/lit/portxo"
+	"github.com/mit-dci/lit/wire"
+	util "github.com/mit-dci/opencx/chainutils"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// testTotalSettlementStore is a settlement store that only knows the total of all balances
+type testTotalSettlementStore struct {
+	total uint64
+}
+
+func (ts *testTotalSettlementStore) UpdateBalances(settlementExecs []*match.SettlementResult) (err error) {
+	return
+}
+
+func (ts *testTotalSettlementStore) GetBalance(pubkey *koblitz.PublicKey, subAccount *uint32) (balance uint64, err error) {
+	return
+}
+
+func (ts *testTotalSettlementStore) GetHeldBalance(pubkey *koblitz.PublicKey, subAccount *uint32) (held uint64, err error) {
+	return
+}
+
+func (ts *testTotalSettlementStore) GetTotalBalance() (total uint64, err error) {
+	total = ts.total
+	return
+}
+
+func (ts *testTotalSettlementStore) GetAllBalances() (balances map[[33]byte]uint64, err error) {
+	return
+}
+
+func (ts *testTotalSettlementStore) GetAccountBalances() (balances []*match.AccountBalance, err error) {
+	return
+}
+
+// testSweepWallet is a wallet with one utxo that keeps the last transaction it sent
+type testSweepWallet struct {
+	utxoValue int64
+	feeRate   int64
+	sent      *wire.MsgTx
+}
+
+// testSweepTxSize is the size the test wallet charges the fee for
+const testSweepTxSize = int64(200)
+
+func (tw *testSweepWallet) Fee() int64 {
+	return tw.feeRate
+}
+
+func (tw *testSweepWallet) PickUtxos(amtWanted, outputByteSize, feePerByte int64, ow bool) (portxo.TxoSliceByBip69, int64, error) {
+	overshoot := tw.utxoValue - amtWanted - feePerByte*testSweepTxSize
+	return portxo.TxoSliceByBip69{&portxo.PorTxo{Value: tw.utxoValue}}, overshoot, nil
+}
+
+func (tw *testSweepWallet) NewChangeOut(amt int64) (*wire.TxOut, error) {
+	return wire.NewTxOut(amt, []byte{0x00}), nil
+}
+
+func (tw *testSweepWallet) BuildAndSign(utxos []*portxo.PorTxo, txos []*wire.TxOut, nlt uint32) (*wire.MsgTx, error) {
+	tx := wire.NewMsgTx()
+	for _, txo := range txos {
+		tx.AddTxOut(txo)
+	}
+	return tx, nil
+}
+
+func (tw *testSweepWallet) NewOutgoingTx(tx *wire.MsgTx) error {
+	tw.sent = tx
+	return nil
+}
+
+func TestSweepColdOutput(t *testing.T) {
+	var err error
+
+	coin := &coinparam.RegressionNetParams
+	server, _, _ := createTestXpubServer(t, coin)
+
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating cold key: %s", err)
+		return
+	}
+	var coldAddr string
+	if coldAddr, err = server.GetAddrForCoin(coin, privkey.PubKey()); err != nil {
+		t.Errorf("Error getting cold address: %s", err)
+		return
+	}
+
+	wallet := &testSweepWallet{utxoValue: 1000000, feeRate: 80}
+	amount := uint64(600000)
+	if err = server.sweepFromWallet(wallet, coin, coldAddr, amount, 1000000); err != nil {
+		t.Errorf("Error sweeping: %s", err)
+		return
+	}
+	if wallet.sent == nil || len(wallet.sent.TxOut) != 2 {
+		t.Errorf("Expected a sweep tx with a change and a cold output")
+		return
+	}
+
+	// The cold output gets the whole amount and the fee only comes out of the change, once
+	changeOut, coldOut := wallet.sent.TxOut[0], wallet.sent.TxOut[1]
+	if coldOut.Value != int64(amount) {
+		t.Errorf("Cold output should be the sweep amount %d, got %d", amount, coldOut.Value)
+		return
+	}
+	if fee := wallet.utxoValue - changeOut.Value - coldOut.Value; fee != wallet.feeRate*testSweepTxSize {
+		t.Errorf("Sweep should pay the fee of %d once, paid %d", wallet.feeRate*testSweepTxSize, fee)
+		return
+	}
+
+	sweeps := server.GetHotColdSweeps()
+	if len(sweeps) != 1 || sweeps[0].Amount != amount {
+		t.Errorf("Expected one recorded sweep of %d", amount)
+		return
+	}
+
+	return
+}
+
+func TestHotWalletAction(t *testing.T) {
+	policy := &HotWalletPolicy{
+		Ceiling: 1000,
+		Floor:   200,
+	}
+
+	var tests = []struct {
+		balance     uint64
+		sweepAmount uint64
+		needsRefill bool
+	}{
+		// over the ceiling, sweep down to the middle
+		{1500, 900, false},
+		{1001, 401, false},
+		// between the floor and the ceiling, nothing to do
+		{1000, 0, false},
+		{500, 0, false},
+		// at or below the floor, refill
+		{200, 0, true},
+		{0, 0, true},
+	}
+
+	for _, test := range tests {
+		sweepAmount, needsRefill := hotWalletAction(test.balance, policy)
+		if sweepAmount != test.sweepAmount || needsRefill != test.needsRefill {
+			t.Errorf("Balance %d should sweep %d and refill %t, got sweep %d and refill %t", test.balance, test.sweepAmount, test.needsRefill, sweepAmount, needsRefill)
+			return
+		}
+	}
+
+	return
+}
+
+func TestSetHotWalletPolicy(t *testing.T) {
+	var err error
+
+	coin := &coinparam.RegressionNetParams
+	server, _, _ := createTestXpubServer(t, coin)
+
+	var coldAddr string
+	if coldAddr, err = util.AddressFromPKH([20]byte{}, util.P2WPKHAddress, coin); err != nil {
+		t.Errorf("Error encoding cold address: %s", err)
+		return
+	}
+
+	if err = server.SetHotWalletPolicy(coin, &HotWalletPolicy{Ceiling: 100, Floor: 100, ColdDestination: coldAddr}); err == nil {
+		t.Errorf("Setting a policy with the floor at the ceiling should fail")
+		return
+	}
+
+	if err = server.SetHotWalletPolicy(coin, &HotWalletPolicy{Ceiling: 100, Floor: 10, ColdDestination: "notanaddress"}); err == nil {
+		t.Errorf("Setting a policy with an invalid cold destination should fail")
+		return
+	}
+
+	if err = server.SetHotWalletPolicy(coin, &HotWalletPolicy{Ceiling: 100, Floor: 10, ColdDestination: coldAddr}); err != nil {
+		t.Errorf("Error setting valid hot wallet policy: %s", err)
+		return
+	}
+
+	return
+}
+
+func TestGetReservesWithSweepHistory(t *testing.T) {
+	var err error
+
+	coin := &coinparam.RegressionNetParams
+	server, store, _ := createTestXpubServer(t, coin)
+	server.SettlementStores = map[*coinparam.Params]cxdb.SettlementStore{coin: &testTotalSettlementStore{total: 500000}}
+
+	var rootDir string
+	if rootDir, err = ioutil.TempDir("", "hotcold"); err != nil {
+		t.Errorf("Error creating temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(rootDir)
+	server.OpencxRoot = rootDir
+
+	// one deposit to a watch-only address that hasn't been swept yet
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating user key: %s", err)
+		return
+	}
+	var addr string
+	if addr, err = server.GetAddrForCoin(coin, privkey.PubKey()); err != nil {
+		t.Errorf("Error getting address for coin: %s", err)
+		return
+	}
+	deposit := match.Deposit{
+		Pubkey:              privkey.PubKey(),
+		Address:             addr,
+		Amount:              100000,
+		Txid:                testSweepTxid,
+		CoinType:            coin,
+		BlockHeightReceived: 100,
+		Confirmations:       6,
+	}
+	if _, err = store.UpdateDeposits([]match.Deposit{deposit}, 106); err != nil {
+		t.Errorf("Error updating deposits: %s", err)
+		return
+	}
+
+	// and one sweep from the hot wallet
+	sweep := &HotColdSweep{
+		Coin:        coin.Name,
+		Txid:        testSweepTxid,
+		Amount:      250000,
+		Destination: addr,
+		HotBalance:  400000,
+		Time:        time.Now(),
+	}
+	if err = server.recordHotColdSweep(sweep); err != nil {
+		t.Errorf("Error recording sweep: %s", err)
+		return
+	}
+
+	var reports []*ReserveReport
+	if reports, err = server.GetReserves(); err != nil {
+		t.Errorf("Error getting reserves: %s", err)
+		return
+	}
+	if len(reports) != 1 {
+		t.Errorf("Expected 1 reserve report, got %d", len(reports))
+		return
+	}
+	if reports[0].ColdBalance != sweep.Amount+deposit.Amount || reports[0].Liabilities != 500000 || reports[0].HotBalance != 0 {
+		t.Errorf("Reserve report should have cold %d and liabilities 500000 with no hot wallet, got hot %d, cold %d, liabilities %d", sweep.Amount+deposit.Amount, reports[0].HotBalance, reports[0].ColdBalance, reports[0].Liabilities)
+		return
+	}
+
+	// The sweep history should survive a restart
+	var restarted *OpencxServer
+	if restarted, err = InitServer(nil, nil, nil, nil, nil, rootDir); err != nil {
+		t.Errorf("Error initializing restarted server: %s", err)
+		return
+	}
+	if err = restarted.LoadHotColdSweeps(); err != nil {
+		t.Errorf("Error loading sweep history: %s", err)
+		return
+	}
+	sweeps := restarted.GetHotColdSweeps()
+	if len(sweeps) != 1 || sweeps[0].Txid != sweep.Txid || sweeps[0].Amount != sweep.Amount {
+		t.Errorf("Expected the recorded sweep to be loaded, got %d sweeps", len(sweeps))
+		return
+	}
+
+	return
+}
+
+func TestColdRefillComesOffColdBalance(t *testing.T) {
+	var err error
+
+	var rootDir string
+	if rootDir, err = ioutil.TempDir("", "hotcold"); err != nil {
+		t.Errorf("Error creating temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(rootDir)
+
+	coin := &coinparam.RegressionNetParams
+	settleStores := map[*coinparam.Params]cxdb.SettlementStore{coin: &testTotalSettlementStore{total: 1000}}
+
+	var server *OpencxServer
+	if server, err = InitServer(nil, nil, nil, nil, settleStores, rootDir); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+	server.SetLedgerStores(map[*coinparam.Params]cxdb.LedgerStore{coin: &testMismatchLedgerStore{}})
+
+	sweep := &HotColdSweep{
+		Coin:   coin.Name,
+		Txid:   testSweepTxid,
+		Amount: 800,
+		Time:   time.Now(),
+	}
+	if err = server.recordHotColdSweep(sweep); err != nil {
+		t.Errorf("Error recording sweep: %s", err)
+		return
+	}
+
+	if err = server.RecordColdRefill(coin, testSweepTxid, 900); err == nil {
+		t.Errorf("Refilling more than was swept to cold storage should fail")
+		return
+	}
+	if err = server.RecordColdRefill(coin, testSweepTxid, 300); err != nil {
+		t.Errorf("Error recording refill: %s", err)
+		return
+	}
+
+	// The refilled coins are in the hot wallet now, so they should only be counted there
+	var reports []*ReserveReport
+	if reports, err = server.GetReserves(); err != nil {
+		t.Errorf("Error getting reserves: %s", err)
+		return
+	}
+	if len(reports) != 1 || reports[0].ColdBalance != 500 {
+		t.Errorf("Expected 1 reserve report with cold 500 after the refill, got %d reports", len(reports))
+		return
+	}
+
+	var report *ReconciliationReport
+	if report, err = server.reconcileCoin(coin, 500); err != nil {
+		t.Errorf("Error reconciling: %s", err)
+		return
+	}
+	if report.ColdBalance != 500 || report.Shortfall != 0 {
+		t.Errorf("Expected cold 500 and no shortfall after the refill, got %s", report)
+		return
+	}
+
+	// The refill should survive a restart
+	var restarted *OpencxServer
+	if restarted, err = InitServer(nil, nil, nil, nil, nil, rootDir); err != nil {
+		t.Errorf("Error initializing restarted server: %s", err)
+		return
+	}
+	if err = restarted.LoadHotColdSweeps(); err != nil {
+		t.Errorf("Error loading sweep history: %s", err)
+		return
+	}
+	if balance := restarted.coldSweptBalance(coin); balance != 500 {
+		t.Errorf("Expected cold balance of 500 after restart, got %d", balance)
+		return
+	}
+
+	return
+}
@@ -6,8 +6,6 @@ import (
 	"github.com/mit-dci/lit/crypto/koblitz"
 	"github.com/mit-dci/lit/qln"
 
-	"github.com/mit-dci/lit/btcutil"
-
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/lit/wire"
 	util "github.com/mit-dci/opencx/chainutils"
@@ -16,8 +14,8 @@ import (
 	"github.com/mit-dci/opencx/match"
 )
 
-// IngestTransactionListAndHeight processes a transaction list and corresponding height
-func (server *OpencxServer) ingestTransactionListAndHeight(txList []*wire.MsgTx, height uint64, coinType *coinparam.Params) (err error) {
+// IngestTransactionListAndHeight processes a transaction list and corresponding height and block hash
+func (server *OpencxServer) ingestTransactionListAndHeight(txList []*wire.MsgTx, height uint64, blockHash string, coinType *coinparam.Params) (err error) {
 	// get list of addresses we own
 	// check the sender, amounts, receiver of all the transactions
 	// check if the receiver is us
@@ -43,37 +41,9 @@ func (server *OpencxServer) ingestTransactionListAndHeight(txList []*wire.MsgTx,
 	server.dbLock.Unlock()
 
 	var deposits []match.Deposit
-
-	for _, tx := range txList {
-		for _, output := range tx.TxOut {
-
-			// figure out if it's the right script type
-			scriptType, data := util.ScriptType(output.PkScript)
-			if scriptType == "P2PKH" {
-				// It's P2PKH, let's get the address
-				var addr *btcutil.AddressPubKeyHash
-				if addr, err = btcutil.NewAddressPubKeyHash(data, coinType); err != nil {
-					err = fmt.Errorf("Error deciding p2pkh while ingesting txs: %s", err)
-					return
-				}
-
-				if pubkey, found := addressesWeOwn[addr.String()]; found {
-					newDeposit := match.Deposit{
-						Pubkey:              pubkey,
-						Address:             addr.String(),
-						Amount:              uint64(output.Value),
-						Txid:                tx.TxHash().String(),
-						CoinType:            coinType,
-						BlockHeightReceived: height,
-						Confirmations:       6,
-					}
-
-					logging.Infof("Received deposit for %d %s", newDeposit.Amount, newDeposit.CoinType.Name)
-					logging.Infof("%s\n", newDeposit.String())
-					deposits = append(deposits, newDeposit)
-				}
-			}
-		}
+	if deposits, err = findDeposits(txList, height, blockHash, coinType, addressesWeOwn); err != nil {
+		err = fmt.Errorf("Error finding deposits for ingestTransactionListAndHeight: %s", err)
+		return
 	}
 
 	if err = server.updateDepositsAtHeight(deposits, height, coinType); err != nil {
@@ -81,6 +51,11 @@ func (server *OpencxServer) ingestTransactionListAndHeight(txList []*wire.MsgTx,
 		return
 	}
 
+	if err = server.markSweptDeposits(txList, coinType); err != nil {
+		err = fmt.Errorf("Error marking swept deposits for ingestTransactionListAndHeight: %s", err)
+		return
+	}
+
 	logging.Debugf("Finished ingesting %s block at height %d", coinType.Name, height)
 	if height%10000 == 0 {
 		logging.Infof("Finished ingesting %s block at height %d\n", coinType.Name, height)
@@ -88,6 +63,45 @@ func (server *OpencxServer) ingestTransactionListAndHeight(txList []*wire.MsgTx,
 	return
 }
 
+// findDeposits goes through every output of every transaction, and returns a deposit for each output
+// paying to one of the addresses we own. P2PKH, P2WPKH, and P2SH (for P2SH-P2WPKH) outputs are all
+// recognized.
+func findDeposits(txList []*wire.MsgTx, height uint64, blockHash string, coinType *coinparam.Params, addressesWeOwn map[string]*koblitz.PublicKey) (deposits []match.Deposit, err error) {
+	for _, tx := range txList {
+		for vout, output := range tx.TxOut {
+
+			// figure out the address, if it's a script type we give out addresses for
+			var addr string
+			if addr, err = util.AddressFromScript(output.PkScript, coinType); err != nil {
+				err = fmt.Errorf("Error decoding output address while ingesting txs: %s", err)
+				return
+			}
+			if addr == "" {
+				continue
+			}
+
+			if pubkey, found := addressesWeOwn[addr]; found {
+				newDeposit := match.Deposit{
+					Pubkey:              pubkey,
+					Address:             addr,
+					Amount:              uint64(output.Value),
+					Txid:                tx.TxHash().String(),
+					Vout:                uint32(vout),
+					CoinType:            coinType,
+					BlockHeightReceived: height,
+					BlockHash:           blockHash,
+					Confirmations:       6,
+				}
+
+				logging.Infof("Received deposit for %d %s", newDeposit.Amount, newDeposit.CoinType.Name)
+				logging.Infof("%s\n", newDeposit.String())
+				deposits = append(deposits, newDeposit)
+			}
+		}
+	}
+	return
+}
+
 // ingestChannelPush changes the user's balance to reflect that a push on a channel happened
 func (server *OpencxServer) ingestChannelPush(pushAmt uint64, pubkey *koblitz.PublicKey, coinType uint32) (err error) {
 
@@ -98,7 +112,7 @@ func (server *OpencxServer) ingestChannelPush(pushAmt uint64, pubkey *koblitz.Pu
 		return
 	}
 
-	if err = server.DebitUser(pubkey, pushAmt, param); err != nil {
+	if err = server.DebitUser(pubkey, pushAmt, param, match.ReasonDeposit, "lightning push"); err != nil {
 		err = fmt.Errorf("Error debiting user for ingestChannelPush: %s", err)
 		return
 	}
@@ -116,7 +130,7 @@ func (server *OpencxServer) ingestChannelConfirm(state *qln.StatCom, pubkey *kob
 		return
 	}
 
-	if err = server.DebitUser(pubkey, uint64(state.MyAmt), param); err != nil {
+	if err = server.DebitUser(pubkey, uint64(state.MyAmt), param, match.ReasonDeposit, "lightning channel"); err != nil {
 		err = fmt.Errorf("Error debiting user for ingestChannelConfirm: %s", err)
 		return
 	}
@@ -139,13 +153,6 @@ func (server *OpencxServer) updateDepositsAtHeight(deposits []match.Deposit, hei
 		return
 	}
 
-	var currSettleStore cxdb.SettlementStore
-	if currSettleStore, ok = server.SettlementStores[coinType]; !ok {
-		err = fmt.Errorf("Could not find settlement store for cointype %s", coinType.Name)
-		server.dbLock.Unlock()
-		return
-	}
-
 	var currSettleEngine match.SettlementEngine
 	if currSettleEngine, ok = server.SettlementEngines[coinType]; !ok {
 		err = fmt.Errorf("Could not find settlement engine for cointype %s", coinType.Name)
@@ -185,7 +192,7 @@ func (server *OpencxServer) updateDepositsAtHeight(deposits []match.Deposit, hei
 		}
 	}
 
-	if err = currSettleStore.UpdateBalances(settlementResults); err != nil {
+	if err = server.queueReadUpdate(&readUpdate{settlementResults: settlementResults}); err != nil {
 		err = fmt.Errorf("Error updating balances for updateDepositsAtHeight: %s", err)
 		server.dbLock.Unlock()
 		return
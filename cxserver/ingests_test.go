@@ -0,0 +1,120 @@
+package cxserver
+
+import (
+	"testing"
+
+	"github.com/mit-dci/lit/btcutil"
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/lit/wire"
+	util "github.com/mit-dci/opencx/chainutils"
+	"github.com/mit-dci/opencx/match"
+)
+
+// testPKH creates a new pubkey and the hash of it for tests
+func testPKH(t *testing.T) (pubkey *koblitz.PublicKey, pkh [20]byte) {
+	var err error
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Fatalf("Error creating private key for test: %s", err)
+	}
+	pubkey = privkey.PubKey()
+	copy(pkh[:], btcutil.Hash160(pubkey.SerializeCompressed()))
+	return
+}
+
+// p2pkhScript, p2wpkhScript, and p2shScript build output scripts by hand
+func p2pkhScript(pkh [20]byte) (script []byte) {
+	script = append([]byte{0x76, 0xa9, 0x14}, pkh[:]...)
+	script = append(script, 0x88, 0xac)
+	return
+}
+
+func p2wpkhScript(pkh [20]byte) (script []byte) {
+	script = append([]byte{0x00, 0x14}, pkh[:]...)
+	return
+}
+
+func p2shScript(redeemScript []byte) (script []byte) {
+	script = append([]byte{0xa9, 0x14}, btcutil.Hash160(redeemScript)...)
+	script = append(script, 0x87)
+	return
+}
+
+func TestFindDepositsAllAddressTypes(t *testing.T) {
+	var err error
+
+	coin := &coinparam.RegressionNetParams
+	addressesWeOwn := make(map[string]*koblitz.PublicKey)
+
+	// one user for each type of address
+	legacyPub, legacyPKH := testPKH(t)
+	segwitPub, segwitPKH := testPKH(t)
+	wrappedPub, wrappedPKH := testPKH(t)
+	_, strangerPKH := testPKH(t)
+
+	var addr string
+	if addr, err = util.AddressFromPKH(legacyPKH, util.P2PKHAddress, coin); err != nil {
+		t.Errorf("Error creating P2PKH address: %s", err)
+		return
+	}
+	addressesWeOwn[addr] = legacyPub
+	if addr, err = util.AddressFromPKH(segwitPKH, util.P2WPKHAddress, coin); err != nil {
+		t.Errorf("Error creating P2WPKH address: %s", err)
+		return
+	}
+	addressesWeOwn[addr] = segwitPub
+	if addr, err = util.AddressFromPKH(wrappedPKH, util.P2SHP2WPKHAddress, coin); err != nil {
+		t.Errorf("Error creating P2SH-P2WPKH address: %s", err)
+		return
+	}
+	addressesWeOwn[addr] = wrappedPub
+
+	tx := wire.NewMsgTx()
+	tx.AddTxOut(wire.NewTxOut(1000, p2pkhScript(legacyPKH)))
+	tx.AddTxOut(wire.NewTxOut(2000, p2wpkhScript(segwitPKH)))
+	tx.AddTxOut(wire.NewTxOut(3000, p2shScript(util.P2SHP2WPKHRedeemScript(wrappedPKH))))
+	// these should all be ignored
+	tx.AddTxOut(wire.NewTxOut(4000, p2wpkhScript(strangerPKH)))
+	tx.AddTxOut(wire.NewTxOut(5000, append([]byte{0x00, 0x20}, make([]byte, 32)...)))
+	tx.AddTxOut(wire.NewTxOut(6000, []byte{0x6a}))
+
+	block := wire.NewMsgBlock(&wire.BlockHeader{})
+	block.AddTransaction(tx)
+
+	var deposits []match.Deposit
+	if deposits, err = findDeposits(block.Transactions, 100, block.Header.BlockHash().String(), coin, addressesWeOwn); err != nil {
+		t.Errorf("Error finding deposits for TestFindDepositsAllAddressTypes: %s", err)
+		return
+	}
+
+	if len(deposits) != 3 {
+		t.Errorf("Expected 3 deposits, got %d", len(deposits))
+		return
+	}
+
+	expected := []struct {
+		pubkey *koblitz.PublicKey
+		amount uint64
+	}{
+		{legacyPub, 1000},
+		{segwitPub, 2000},
+		{wrappedPub, 3000},
+	}
+	for i, exp := range expected {
+		if !deposits[i].Pubkey.IsEqual(exp.pubkey) {
+			t.Errorf("Deposit %d credited to wrong pubkey %x", i, deposits[i].Pubkey.SerializeCompressed())
+			return
+		}
+		if deposits[i].Amount != exp.amount {
+			t.Errorf("Deposit %d should have amount %d but had %d", i, exp.amount, deposits[i].Amount)
+			return
+		}
+		if deposits[i].BlockHash != block.Header.BlockHash().String() {
+			t.Errorf("Deposit %d has block hash %s, expected %s", i, deposits[i].BlockHash, block.Header.BlockHash().String())
+			return
+		}
+	}
+
+	return
+}
@@ -3,32 +3,123 @@ package cxserver
 import (
 	"fmt"
 
-	"github.com/mit-dci/lit/btcutil/base58"
+	"github.com/mit-dci/lit/btcutil"
+	"github.com/mit-dci/lit/btcutil/hdkeychain"
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/lit/crypto/koblitz"
+	util "github.com/mit-dci/opencx/chainutils"
+	"github.com/mit-dci/opencx/cxdb"
 )
 
-// GetAddrForCoin gets an address based on a wallet and pubkey
+// GetAddrForCoin gets an address based on a wallet and pubkey. The type of address depends on what
+// deposit address type is set for the coin, and is P2PKH by default. If a deposit xpub is set for
+// the coin, the address is derived from the xpub instead of the hot wallet.
 func (server *OpencxServer) GetAddrForCoin(coinType *coinparam.Params, pubkey *koblitz.PublicKey) (addr string, err error) {
 	server.walletMtx.Lock()
+	addrType := server.depositAddrTypes[coinType]
+	xpub, watchOnly := server.depositXpubs[coinType]
 	wallet, found := server.WalletMap[coinType]
-	if !found {
-		err = fmt.Errorf("Could not find wallet to create address for")
-		server.walletMtx.Unlock()
+	server.walletMtx.Unlock()
+
+	// Create a new address
+	var addrBytes [20]byte
+	if watchOnly {
+		if addrBytes, err = server.deriveDepositPKH(xpub, coinType, pubkey); err != nil {
+			err = fmt.Errorf("Error deriving deposit address from xpub for GetAddrForCoin: %s", err)
+			return
+		}
+	} else {
+		if !found {
+			err = fmt.Errorf("Could not find wallet to create address for")
+			return
+		}
+		if addrBytes, err = wallet.NewAdr160(); err != nil {
+			return
+		}
+	}
+
+	// encode it to store in own db
+	if addr, err = util.AddressFromPKH(addrBytes, addrType, coinType); err != nil {
+		err = fmt.Errorf("Error encoding %s address for GetAddrForCoin: %s", addrType.String(), err)
 		return
 	}
+
+	return
+}
+
+// SetDepositAddressType sets the type of address that will be given out for deposits of a coin.
+// Addresses that were already given out are not changed.
+func (server *OpencxServer) SetDepositAddressType(coinType *coinparam.Params, addrType util.AddressType) {
+	server.walletMtx.Lock()
+	server.depositAddrTypes[coinType] = addrType
 	server.walletMtx.Unlock()
+	return
+}
 
-	pubKeyHashAddrID := wallet.Param.PubKeyHashAddrID
+// SetDepositXpub makes the server derive deposit addresses for a coin from an extended public key,
+// so the keys that control deposits can be kept offline. Deposits to these addresses have to be
+// swept with BuildSweep and signed offline.
+func (server *OpencxServer) SetDepositXpub(coinType *coinparam.Params, xpubStr string) (err error) {
+	var xpub *hdkeychain.ExtendedKey
+	if xpub, err = hdkeychain.NewKeyFromString(xpubStr); err != nil {
+		err = fmt.Errorf("Error parsing xpub for SetDepositXpub: %s", err)
+		return
+	}
 
-	// Create a new address
-	var addrBytes [20]byte
-	if addrBytes, err = wallet.NewAdr160(); err != nil {
+	if xpub.IsPrivate() {
+		err = fmt.Errorf("Error, deposit key for %s is private, only give the server the extended public key", coinType.Name)
 		return
 	}
 
-	// encode it to store in own db
-	addr = base58.CheckEncode(addrBytes[:], pubKeyHashAddrID)
+	server.walletMtx.Lock()
+	server.depositXpubs[coinType] = xpub
+	server.walletMtx.Unlock()
+	return
+}
+
+// deriveDepositPKH gets the pubkey hash of the deposit key for a user. Deposit keys are on the
+// external chain of the xpub, at the user's index in the deposit store: xpub/0/index
+func (server *OpencxServer) deriveDepositPKH(xpub *hdkeychain.ExtendedKey, coinType *coinparam.Params, pubkey *koblitz.PublicKey) (pkh [20]byte, err error) {
+	var currDepositStore cxdb.DepositStore
+	var ok bool
+	if currDepositStore, ok = server.DepositStores[coinType]; !ok {
+		err = fmt.Errorf("Could not find deposit store for %s for deriveDepositPKH", coinType.Name)
+		return
+	}
+
+	var index uint32
+	if index, err = currDepositStore.GetDepositIndex(pubkey); err != nil {
+		err = fmt.Errorf("Error getting deposit index for deriveDepositPKH: %s", err)
+		return
+	}
+
+	if pkh, err = depositPKHAtIndex(xpub, index); err != nil {
+		err = fmt.Errorf("Error deriving deposit key for deriveDepositPKH: %s", err)
+		return
+	}
+	return
+}
+
+// depositPKHAtIndex derives the pubkey hash at xpub/0/index
+func depositPKHAtIndex(xpub *hdkeychain.ExtendedKey, index uint32) (pkh [20]byte, err error) {
+	var external *hdkeychain.ExtendedKey
+	if external, err = xpub.Child(0); err != nil {
+		err = fmt.Errorf("Error deriving external chain: %s", err)
+		return
+	}
+
+	var child *hdkeychain.ExtendedKey
+	if child, err = external.Child(index); err != nil {
+		err = fmt.Errorf("Error deriving child %d: %s", index, err)
+		return
+	}
+
+	var childPub *koblitz.PublicKey
+	if childPub, err = child.ECPubKey(); err != nil {
+		err = fmt.Errorf("Error getting pubkey for child %d: %s", index, err)
+		return
+	}
 
+	copy(pkh[:], btcutil.Hash160(childPub.SerializeCompressed()))
 	return
 }
@@ -5,11 +5,17 @@ import (
 
 	"github.com/mit-dci/lit/btcutil/hdkeychain"
 	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
 )
 
 // SetupServerKeys just loads a private key from a file wallet
 func (server *OpencxServer) SetupServerKeys(privkey *[32]byte) (err error) {
 
+	// the key itself is what we sign published things with
+	server.privKeyMtx.Lock()
+	server.identityKey, _ = koblitz.PrivKeyFromBytes(koblitz.S256(), privkey[:])
+	server.privKeyMtx.Unlock()
+
 	// for all settlement engines that we have, make keys
 	for param, _ := range server.SettlementEngines {
 		if err = server.SetupSingleKey(privkey, param); err != nil {
@@ -0,0 +1,66 @@
+package cxserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// SetLedgerStores sets the ledger stores that account statements and consistency checks are read
+// from
+func (server *OpencxServer) SetLedgerStores(ledgerStores map[*coinparam.Params]cxdb.LedgerStore) {
+	server.dbLock.Lock()
+	server.LedgerStores = ledgerStores
+	server.dbLock.Unlock()
+	return
+}
+
+// GetAccountStatement gets every ledger entry for a pubkey and coin from the from time up to the to
+// time, with the balance before and after.
+func (server *OpencxServer) GetAccountStatement(pubkey *koblitz.PublicKey, coin *coinparam.Params, from time.Time, to time.Time) (statement *match.AccountStatement, err error) {
+
+	server.dbLock.Lock()
+	var currLedgerStore cxdb.LedgerStore
+	var ok bool
+	if currLedgerStore, ok = server.LedgerStores[coin]; !ok {
+		err = fmt.Errorf("Cannot find the ledger store for GetAccountStatement")
+		server.dbLock.Unlock()
+		return
+	}
+
+	if statement, err = currLedgerStore.GetAccountStatement(pubkey, from, to); err != nil {
+		err = fmt.Errorf("Could not get account statement for GetAccountStatement: %s", err)
+		server.dbLock.Unlock()
+		return
+	}
+	server.dbLock.Unlock()
+
+	return
+}
+
+// CheckLedgerConsistency recomputes the balances of every coin from the ledger, and raises an alert
+// for every balance that doesn't match.
+func (server *OpencxServer) CheckLedgerConsistency() (mismatches []*match.LedgerMismatch, err error) {
+
+	server.dbLock.Lock()
+	var currMismatches []*match.LedgerMismatch
+	for coin, currLedgerStore := range server.LedgerStores {
+		if currMismatches, err = currLedgerStore.CheckConsistency(); err != nil {
+			err = fmt.Errorf("Error checking %s ledger consistency for CheckLedgerConsistency: %s", coin.Name, err)
+			server.dbLock.Unlock()
+			return
+		}
+		mismatches = append(mismatches, currMismatches...)
+	}
+	server.dbLock.Unlock()
+
+	for _, mismatch := range mismatches {
+		server.raiseAlert("Ledger mismatch: %s", mismatch)
+	}
+
+	return
+}
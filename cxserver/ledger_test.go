@@ -0,0 +1,85 @@
+package cxserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// testMismatchLedgerStore is a ledger store that always finds the same mismatches, and has the same
+// fee balance
+type testMismatchLedgerStore struct {
+	mismatches []*match.LedgerMismatch
+	fees       uint64
+}
+
+func (tl *testMismatchLedgerStore) GetAccountStatement(pubkey *koblitz.PublicKey, from time.Time, to time.Time) (statement *match.AccountStatement, err error) {
+	statement = &match.AccountStatement{From: from, To: to}
+	return
+}
+
+func (tl *testMismatchLedgerStore) CheckConsistency() (mismatches []*match.LedgerMismatch, err error) {
+	mismatches = tl.mismatches
+	return
+}
+
+func (tl *testMismatchLedgerStore) GetFeeBalance() (fees uint64, err error) {
+	fees = tl.fees
+	return
+}
+
+func (tl *testMismatchLedgerStore) GetTransferNonces() (nonces map[[33]byte]uint64, err error) {
+	return
+}
+
+func (tl *testMismatchLedgerStore) GetLedger() (entries []*match.LedgerEntry, err error) {
+	return
+}
+
+func (tl *testMismatchLedgerStore) ReplaceLedger(entries []*match.LedgerEntry) (err error) {
+	return
+}
+
+func TestCheckLedgerConsistencyRaisesAlerts(t *testing.T) {
+	var err error
+
+	var server *OpencxServer
+	if server, err = InitServer(nil, nil, nil, nil, nil, ""); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+
+	mismatch := &match.LedgerMismatch{Account: "testaccount", Asset: match.BTCTest, Balance: 10, LedgerBalance: 5}
+	server.SetLedgerStores(map[*coinparam.Params]cxdb.LedgerStore{
+		&coinparam.TestNet3Params:         &testMismatchLedgerStore{mismatches: []*match.LedgerMismatch{mismatch}},
+		&coinparam.LiteCoinTestNet4Params: &testMismatchLedgerStore{},
+	})
+
+	var mismatches []*match.LedgerMismatch
+	if mismatches, err = server.CheckLedgerConsistency(); err != nil {
+		t.Errorf("Error checking ledger consistency: %s", err)
+		return
+	}
+	if len(mismatches) != 1 || mismatches[0] != mismatch {
+		t.Errorf("Expected the one mismatch from the btc ledger, got %d mismatches", len(mismatches))
+		return
+	}
+
+	alerts := server.GetAlerts()
+	if len(alerts) != 1 || !strings.Contains(alerts[0].Message, "testaccount") {
+		t.Errorf("Expected one alert for the mismatched account, got %d alerts", len(alerts))
+		return
+	}
+
+	if _, err = server.GetAccountStatement(nil, &coinparam.RegressionNetParams, time.Now(), time.Now()); err == nil {
+		t.Errorf("Getting a statement for a coin without a ledger store should fail")
+		return
+	}
+
+	return
+}
@@ -0,0 +1,202 @@
+package cxserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/crypto/liabilities"
+	"github.com/mit-dci/opencx/logging"
+	"github.com/mit-dci/opencx/match"
+)
+
+// liabilitySnapshotFileName is the file in the opencx root directory that published liability
+// snapshots are appended to, one JSON record per line
+const liabilitySnapshotFileName = "liabilitysnapshots.json"
+
+// StartLiabilitySnapshots takes a liability snapshot right away, and then once every interval,
+// until the server goes away.
+func (server *OpencxServer) StartLiabilitySnapshots(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for {
+			if _, err := server.TakeLiabilitySnapshot(); err != nil {
+				logging.Errorf("Error taking liability snapshot: %s", err)
+			}
+			<-ticker.C
+		}
+	}()
+	return
+}
+
+// TakeLiabilitySnapshot builds a merkle sum tree over every user's balance for every asset with a
+// settlement store, then signs and publishes the roots. Proofs are given out from the latest
+// snapshot.
+func (server *OpencxServer) TakeLiabilitySnapshot() (snapshot *liabilities.Snapshot, err error) {
+
+	server.privKeyMtx.Lock()
+	identityKey := server.identityKey
+	server.privKeyMtx.Unlock()
+	if identityKey == nil {
+		err = fmt.Errorf("Server keys must be set up before taking a liability snapshot")
+		return
+	}
+
+	server.dbLock.Lock()
+	server.waitForProjection()
+	var trees []*liabilities.Tree
+	var balances map[[33]byte]uint64
+	var currTree *liabilities.Tree
+	for coinType, currSettleStore := range server.SettlementStores {
+		var asset match.Asset
+		if asset, err = match.AssetFromCoinParam(coinType); err != nil {
+			err = fmt.Errorf("Error getting asset from coin param for TakeLiabilitySnapshot: %s", err)
+			server.dbLock.Unlock()
+			return
+		}
+
+		if balances, err = currSettleStore.GetAllBalances(); err != nil {
+			err = fmt.Errorf("Error getting %s balances for TakeLiabilitySnapshot: %s", coinType.Name, err)
+			server.dbLock.Unlock()
+			return
+		}
+
+		if currTree, err = liabilities.NewTree(asset, balances); err != nil {
+			err = fmt.Errorf("Error building %s tree for TakeLiabilitySnapshot: %s", coinType.Name, err)
+			server.dbLock.Unlock()
+			return
+		}
+		trees = append(trees, currTree)
+	}
+	server.dbLock.Unlock()
+
+	server.liabilityMtx.Lock()
+	snapshot = liabilities.NewSnapshot(uint64(len(server.liabilitySnapshots)+1), time.Now(), trees)
+	if err = snapshot.Sign(identityKey); err != nil {
+		err = fmt.Errorf("Error signing snapshot for TakeLiabilitySnapshot: %s", err)
+		server.liabilityMtx.Unlock()
+		return
+	}
+
+	if err = server.recordLiabilitySnapshot(snapshot); err != nil {
+		err = fmt.Errorf("Error recording snapshot for TakeLiabilitySnapshot: %s", err)
+		server.liabilityMtx.Unlock()
+		return
+	}
+
+	server.liabilitySnapshots = append(server.liabilitySnapshots, snapshot)
+	server.liabilityTrees = make(map[match.Asset]*liabilities.Tree)
+	for _, tree := range trees {
+		server.liabilityTrees[tree.Asset] = tree
+	}
+	server.liabilityMtx.Unlock()
+
+	logging.Infof("Published liability snapshot %d", snapshot.ID)
+	return
+}
+
+// recordLiabilitySnapshot appends the snapshot to the snapshot file, if the server has a root
+// directory. This assumes liabilityMtx is held.
+func (server *OpencxServer) recordLiabilitySnapshot(snapshot *liabilities.Snapshot) (err error) {
+	if server.OpencxRoot == "" {
+		return
+	}
+
+	var snapshotBytes []byte
+	if snapshotBytes, err = json.Marshal(snapshot); err != nil {
+		err = fmt.Errorf("Error marshalling snapshot for recordLiabilitySnapshot: %s", err)
+		return
+	}
+
+	var snapshotFile *os.File
+	if snapshotFile, err = os.OpenFile(filepath.Join(server.OpencxRoot, liabilitySnapshotFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+		err = fmt.Errorf("Error opening snapshot file for recordLiabilitySnapshot: %s", err)
+		return
+	}
+	defer snapshotFile.Close()
+
+	if _, err = snapshotFile.Write(append(snapshotBytes, '\n')); err != nil {
+		err = fmt.Errorf("Error writing snapshot file for recordLiabilitySnapshot: %s", err)
+		return
+	}
+	return
+}
+
+// LoadLiabilitySnapshots loads the published snapshots from the root directory, so snapshot IDs keep
+// going up after a restart. The trees aren't saved, so there are no proofs until the next snapshot.
+func (server *OpencxServer) LoadLiabilitySnapshots() (err error) {
+	var snapshotFile *os.File
+	if snapshotFile, err = os.Open(filepath.Join(server.OpencxRoot, liabilitySnapshotFileName)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer snapshotFile.Close()
+
+	var snapshots []*liabilities.Snapshot
+	scanner := bufio.NewScanner(snapshotFile)
+	for scanner.Scan() {
+		snapshot := new(liabilities.Snapshot)
+		if err = json.Unmarshal(scanner.Bytes(), snapshot); err != nil {
+			err = fmt.Errorf("Error parsing snapshot file for LoadLiabilitySnapshots: %s", err)
+			return
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	if err = scanner.Err(); err != nil {
+		err = fmt.Errorf("Error reading snapshot file for LoadLiabilitySnapshots: %s", err)
+		return
+	}
+
+	server.liabilityMtx.Lock()
+	server.liabilitySnapshots = snapshots
+	server.liabilityMtx.Unlock()
+	return
+}
+
+// GetLiabilitySnapshots returns every published liability snapshot, oldest first
+func (server *OpencxServer) GetLiabilitySnapshots() (snapshots []*liabilities.Snapshot) {
+	server.liabilityMtx.Lock()
+	snapshots = make([]*liabilities.Snapshot, len(server.liabilitySnapshots))
+	copy(snapshots, server.liabilitySnapshots)
+	server.liabilityMtx.Unlock()
+	return
+}
+
+// GetLiabilityProof gets a proof that the pubkey's balance of a coin is included in the latest
+// liability snapshot, along with that snapshot.
+func (server *OpencxServer) GetLiabilityProof(pubkey *koblitz.PublicKey, coinType *coinparam.Params) (proof *liabilities.Proof, snapshot *liabilities.Snapshot, err error) {
+
+	var asset match.Asset
+	if asset, err = match.AssetFromCoinParam(coinType); err != nil {
+		err = fmt.Errorf("Error getting asset from coin param for GetLiabilityProof: %s", err)
+		return
+	}
+
+	server.liabilityMtx.Lock()
+	var tree *liabilities.Tree
+	var ok bool
+	if tree, ok = server.liabilityTrees[asset]; !ok || len(server.liabilitySnapshots) == 0 {
+		err = fmt.Errorf("No liability snapshot has been taken for %s yet", coinType.Name)
+		server.liabilityMtx.Unlock()
+		return
+	}
+	snapshot = server.liabilitySnapshots[len(server.liabilitySnapshots)-1]
+
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+	if proof, err = tree.Prove(pubkeyBytes); err != nil {
+		err = fmt.Errorf("Error proving balance for GetLiabilityProof: %s", err)
+		server.liabilityMtx.Unlock()
+		return
+	}
+	server.liabilityMtx.Unlock()
+
+	return
+}
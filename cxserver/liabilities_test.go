@@ -0,0 +1,137 @@
+package cxserver
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/crypto/liabilities"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+func TestLiabilitySnapshotProof(t *testing.T) {
+	var err error
+
+	var rootDir string
+	if rootDir, err = ioutil.TempDir("", "liabilities"); err != nil {
+		t.Errorf("Error creating temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(rootDir)
+
+	btcStore := &testResultSettlementStore{results: make(map[match.Account]*match.SettlementResult)}
+	setStores := map[*coinparam.Params]cxdb.SettlementStore{&coinparam.TestNet3Params: btcStore}
+
+	var server *OpencxServer
+	if server, err = InitServer(nil, nil, nil, nil, setStores, rootDir); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+
+	if _, err = server.TakeLiabilitySnapshot(); err == nil {
+		t.Errorf("Taking a snapshot without server keys should fail")
+		return
+	}
+
+	var exchangeKey [32]byte
+	exchangeKey[0] = 1
+	if err = server.SetupServerKeys(&exchangeKey); err != nil {
+		t.Errorf("Error setting up server keys: %s", err)
+		return
+	}
+
+	// three users with a mix of available and held balances
+	var privkeys []*koblitz.PrivateKey
+	for i := uint64(1); i <= 3; i++ {
+		var privkey *koblitz.PrivateKey
+		if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+			t.Errorf("Error creating user key: %s", err)
+			return
+		}
+		privkeys = append(privkeys, privkey)
+
+		setRes := &match.SettlementResult{
+			NewBal:         i * 1000,
+			NewHeld:        i * 10,
+			SuccessfulExec: &match.SettlementExecution{Asset: match.BTCTest},
+		}
+		copy(setRes.SuccessfulExec.Pubkey[:], privkey.PubKey().SerializeCompressed())
+		if err = btcStore.UpdateBalances([]*match.SettlementResult{setRes}); err != nil {
+			t.Errorf("Error updating balances: %s", err)
+			return
+		}
+	}
+
+	var snapshot *liabilities.Snapshot
+	if snapshot, err = server.TakeLiabilitySnapshot(); err != nil {
+		t.Errorf("Error taking liability snapshot: %s", err)
+		return
+	}
+
+	var root liabilities.Node
+	if root, err = snapshot.RootForAsset(match.BTCTest); err != nil {
+		t.Errorf("Error getting btc root: %s", err)
+		return
+	}
+	if root.Sum != 6060 {
+		t.Errorf("Liabilities should be 6060, got %d", root.Sum)
+		return
+	}
+
+	var signer *koblitz.PublicKey
+	if signer, err = snapshot.Signer(); err != nil {
+		t.Errorf("Error recovering snapshot signer: %s", err)
+		return
+	}
+	identityKey, _ := koblitz.PrivKeyFromBytes(koblitz.S256(), exchangeKey[:])
+	if !signer.IsEqual(identityKey.PubKey()) {
+		t.Errorf("Snapshot should be signed by the exchange key")
+		return
+	}
+
+	for i, privkey := range privkeys {
+		var proof *liabilities.Proof
+		var proofSnapshot *liabilities.Snapshot
+		if proof, proofSnapshot, err = server.GetLiabilityProof(privkey.PubKey(), &coinparam.TestNet3Params); err != nil {
+			t.Errorf("Error getting liability proof: %s", err)
+			return
+		}
+		if proofSnapshot.ID != snapshot.ID {
+			t.Errorf("Proof should be from the latest snapshot %d, got %d", snapshot.ID, proofSnapshot.ID)
+			return
+		}
+		if expected := uint64(i+1) * 1010; proof.Leaf.Balance != expected {
+			t.Errorf("Proof should include available and held balance %d, got %d", expected, proof.Leaf.Balance)
+			return
+		}
+		if err = proof.Verify(root); err != nil {
+			t.Errorf("Error verifying liability proof: %s", err)
+			return
+		}
+	}
+
+	// The snapshot should be published so a restarted server keeps counting up
+	var restarted *OpencxServer
+	if restarted, err = InitServer(nil, nil, nil, nil, nil, rootDir); err != nil {
+		t.Errorf("Error initializing restarted server: %s", err)
+		return
+	}
+	if err = restarted.LoadLiabilitySnapshots(); err != nil {
+		t.Errorf("Error loading liability snapshots: %s", err)
+		return
+	}
+	snapshots := restarted.GetLiabilitySnapshots()
+	if len(snapshots) != 1 || snapshots[0].ID != snapshot.ID {
+		t.Errorf("Expected the published snapshot to be loaded, got %d snapshots", len(snapshots))
+		return
+	}
+	if signer, err = snapshots[0].Signer(); err != nil || !signer.IsEqual(identityKey.PubKey()) {
+		t.Errorf("Loaded snapshot should still be signed by the exchange key")
+		return
+	}
+
+	return
+}
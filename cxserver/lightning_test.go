@@ -0,0 +1,364 @@
+package cxserver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/fastsha256"
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/consts"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/cxdb/cxdbmemory"
+	"github.com/mit-dci/opencx/match"
+)
+
+// testHTLC is an HTLC that the test lightning backend offered, or that was offered to it
+type testHTLC struct {
+	chanIdx  uint32
+	amount   uint32
+	rHash    [32]byte
+	locktime uint32
+	incoming bool
+	claimed  bool
+	refunded bool
+}
+
+// testLightningBackend is an in-process lightning backend that keeps its peers, channels, and
+// wallets in memory
+type testLightningBackend struct {
+	peers     map[[33]byte]uint32
+	connected map[uint32]bool
+	channels  map[uint32]*LightningChannel
+	wallets   map[uint32]int64
+	heights   map[uint32]int32
+	fee       int64
+	htlcs     []*testHTLC
+	nextIdx   uint32
+}
+
+func newTestLightningBackend(fee int64) (backend *testLightningBackend) {
+	backend = &testLightningBackend{
+		peers:     make(map[[33]byte]uint32),
+		connected: make(map[uint32]bool),
+		channels:  make(map[uint32]*LightningChannel),
+		wallets:   make(map[uint32]int64),
+		heights:   make(map[uint32]int32),
+		fee:       fee,
+		nextIdx:   1,
+	}
+	return
+}
+
+// addPeer adds a connected peer for pubkey
+func (tl *testLightningBackend) addPeer(pubkey *koblitz.PublicKey, peerIdx uint32) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+	tl.peers[pubkeyBytes] = peerIdx
+	tl.connected[peerIdx] = true
+}
+
+// addChannel adds an open channel, as if it was funded before
+func (tl *testLightningBackend) addChannel(peerIdx uint32, coinType uint32, myAmt int64, theirAmt int64) (channel *LightningChannel) {
+	channel = &LightningChannel{
+		Idx:      tl.nextIdx,
+		PeerIdx:  peerIdx,
+		CoinType: coinType,
+		MyAmt:    myAmt,
+		TheirAmt: theirAmt,
+		Txid:     fmt.Sprintf("%064x", tl.nextIdx),
+	}
+	tl.channels[channel.Idx] = channel
+	tl.nextIdx++
+	return
+}
+
+// receiveHTLC adds an HTLC that the peer offered us over a channel
+func (tl *testLightningBackend) receiveHTLC(chanIdx uint32, amount uint32, rHash [32]byte, locktime uint32) (htlc *testHTLC) {
+	tl.channels[chanIdx].TheirAmt -= int64(amount)
+	htlc = &testHTLC{chanIdx: chanIdx, amount: amount, rHash: rHash, locktime: locktime, incoming: true}
+	tl.htlcs = append(tl.htlcs, htlc)
+	return
+}
+
+// offeredHTLCs returns the HTLCs we offered
+func (tl *testLightningBackend) offeredHTLCs() (htlcs []*testHTLC) {
+	for _, htlc := range tl.htlcs {
+		if !htlc.incoming {
+			htlcs = append(htlcs, htlc)
+		}
+	}
+	return
+}
+
+func (tl *testLightningBackend) GetPeerIdx(pubkey *koblitz.PublicKey) (peerIdx uint32, err error) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+	var ok bool
+	if peerIdx, ok = tl.peers[pubkeyBytes]; !ok {
+		err = fmt.Errorf("No peer for pubkey %x", pubkeyBytes)
+		return
+	}
+	return
+}
+
+func (tl *testLightningBackend) ConnectedToPeer(peerIdx uint32) (connected bool) {
+	connected = tl.connected[peerIdx]
+	return
+}
+
+func (tl *testLightningBackend) ListChannels() (channels []*LightningChannel, err error) {
+	for _, channel := range tl.channels {
+		channels = append(channels, channel)
+	}
+	return
+}
+
+func (tl *testLightningBackend) GetChannel(chanIdx uint32) (channel *LightningChannel, err error) {
+	var ok bool
+	if channel, ok = tl.channels[chanIdx]; !ok {
+		err = fmt.Errorf("No channel with index %d", chanIdx)
+		return
+	}
+	return
+}
+
+func (tl *testLightningBackend) Fee(coinType uint32) (fee int64, err error) {
+	fee = tl.fee
+	return
+}
+
+func (tl *testLightningBackend) WalletBalance(coinType uint32) (balance int64, err error) {
+	balance = tl.wallets[coinType]
+	return
+}
+
+func (tl *testLightningBackend) FundChannel(peerIdx uint32, coinType uint32, capacity int64, initSend int64) (chanIdx uint32, err error) {
+	if !tl.connected[peerIdx] {
+		err = fmt.Errorf("Not connected to peer %d", peerIdx)
+		return
+	}
+	if tl.wallets[coinType] < capacity {
+		err = fmt.Errorf("Not enough in the %d wallet to fund a channel of %d", coinType, capacity)
+		return
+	}
+	tl.wallets[coinType] -= capacity
+	chanIdx = tl.addChannel(peerIdx, coinType, capacity-initSend, initSend).Idx
+	return
+}
+
+func (tl *testLightningBackend) DualFundChannel(peerIdx uint32, coinType uint32, ourAmount int64, theirAmount int64) (chanIdx uint32, err error) {
+	if !tl.connected[peerIdx] {
+		err = fmt.Errorf("Not connected to peer %d", peerIdx)
+		return
+	}
+	if tl.wallets[coinType] < ourAmount {
+		err = fmt.Errorf("Not enough in the %d wallet to dual fund a channel with %d", coinType, ourAmount)
+		return
+	}
+	tl.wallets[coinType] -= ourAmount
+	chanIdx = tl.addChannel(peerIdx, coinType, ourAmount, theirAmount).Idx
+	return
+}
+
+func (tl *testLightningBackend) PushChannel(chanIdx uint32, amount uint32) (err error) {
+	var channel *LightningChannel
+	if channel, err = tl.GetChannel(chanIdx); err != nil {
+		return
+	}
+	if channel.MyAmt-int64(amount) < consts.MinOutput {
+		err = fmt.Errorf("Can't push %d, only %d in channel %d", amount, channel.MyAmt, chanIdx)
+		return
+	}
+	channel.MyAmt -= int64(amount)
+	channel.TheirAmt += int64(amount)
+	return
+}
+
+func (tl *testLightningBackend) OfferHTLC(chanIdx uint32, amount uint32, rHash [32]byte, locktime uint32) (err error) {
+	var channel *LightningChannel
+	if channel, err = tl.GetChannel(chanIdx); err != nil {
+		return
+	}
+	if channel.MyAmt-int64(amount) < consts.MinOutput {
+		err = fmt.Errorf("Can't offer HTLC of %d, only %d in channel %d", amount, channel.MyAmt, chanIdx)
+		return
+	}
+	// the amount isn't either side's until the HTLC is cleared
+	channel.MyAmt -= int64(amount)
+	tl.htlcs = append(tl.htlcs, &testHTLC{chanIdx: chanIdx, amount: amount, rHash: rHash, locktime: locktime})
+	return
+}
+
+func (tl *testLightningBackend) ClaimHTLC(preimage [16]byte) (err error) {
+	rHash := fastsha256.Sum256(preimage[:])
+	var claimed bool
+	for _, htlc := range tl.htlcs {
+		if htlc.incoming && htlc.rHash == rHash && !htlc.claimed {
+			htlc.claimed = true
+			tl.channels[htlc.chanIdx].MyAmt += int64(htlc.amount)
+			claimed = true
+		}
+	}
+	if !claimed {
+		err = fmt.Errorf("No HTLCs to claim with hash %x", rHash)
+		return
+	}
+	return
+}
+
+func (tl *testLightningBackend) CurrentHeight(coinType uint32) (height int32, err error) {
+	height = tl.heights[coinType]
+	return
+}
+
+func (tl *testLightningBackend) ClaimHTLCTimeouts(coinType uint32, height int32) (err error) {
+	for _, htlc := range tl.htlcs {
+		channel := tl.channels[htlc.chanIdx]
+		if !htlc.incoming && !htlc.claimed && !htlc.refunded && channel.CoinType == coinType && int32(htlc.locktime) <= height {
+			htlc.refunded = true
+			channel.MyAmt += int64(htlc.amount)
+		}
+	}
+	return
+}
+
+// createLightningTestServer creates a server with memory settlement engines for each coin and the
+// test lightning backend
+func createLightningTestServer(coins []*coinparam.Params, backend LightningBackend) (server *OpencxServer, err error) {
+	var setEngines map[*coinparam.Params]match.SettlementEngine
+	if setEngines, err = cxdbmemory.CreateSettlementEngineMap(coins); err != nil {
+		err = fmt.Errorf("Error creating settlement engine map: %s", err)
+		return
+	}
+
+	settleStores := make(map[*coinparam.Params]cxdb.SettlementStore)
+	for _, coin := range coins {
+		settleStores[coin] = &testResultSettlementStore{results: make(map[match.Account]*match.SettlementResult)}
+	}
+
+	if server, err = InitServer(setEngines, nil, nil, nil, settleStores, ""); err != nil {
+		err = fmt.Errorf("Error initializing server: %s", err)
+		return
+	}
+	server.SetLightningBackend(backend)
+	return
+}
+
+func TestIngestChannelPush(t *testing.T) {
+	var err error
+
+	coin := &coinparam.RegressionNetParams
+	backend := newTestLightningBackend(1)
+	var server *OpencxServer
+	if server, err = createLightningTestServer([]*coinparam.Params{coin}, backend); err != nil {
+		t.Errorf("Error creating server: %s", err)
+		return
+	}
+
+	var user *koblitz.PrivateKey
+	if user, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key: %s", err)
+		return
+	}
+
+	if err = server.ingestChannelPush(5000, user.PubKey(), coin.HDCoinType); err != nil {
+		t.Errorf("Error ingesting channel push: %s", err)
+		return
+	}
+	if err = server.ingestChannelPush(2500, user.PubKey(), coin.HDCoinType); err != nil {
+		t.Errorf("Error ingesting second channel push: %s", err)
+		return
+	}
+
+	var available uint64
+	if available, _, err = server.GetBalance(user.PubKey(), coin, nil); err != nil {
+		t.Errorf("Error getting balance: %s", err)
+		return
+	}
+	if available != 7500 {
+		t.Errorf("Expected a balance of 7500 after two pushes, got %d", available)
+		return
+	}
+
+	// Pushes of coins the exchange doesn't know about shouldn't be credited to anyone
+	if err = server.ingestChannelPush(5000, user.PubKey(), 12345); err == nil {
+		t.Errorf("Ingesting a push of an unknown coin should fail")
+		return
+	}
+
+	return
+}
+
+func TestWithdrawLightning(t *testing.T) {
+	var err error
+
+	coin := &coinparam.RegressionNetParams
+	backend := newTestLightningBackend(1)
+	backend.wallets[coin.HDCoinType] = 10000000
+	var server *OpencxServer
+	if server, err = createLightningTestServer([]*coinparam.Params{coin}, backend); err != nil {
+		t.Errorf("Error creating server: %s", err)
+		return
+	}
+
+	var user, stranger *koblitz.PrivateKey
+	if user, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key: %s", err)
+		return
+	}
+	if stranger, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key: %s", err)
+		return
+	}
+	backend.addPeer(user.PubKey(), 1)
+
+	if err = server.DebitUser(user.PubKey(), 2000000, coin, match.ReasonDeposit, "deposit"); err != nil {
+		t.Errorf("Error debiting user: %s", err)
+		return
+	}
+	if err = server.DebitUser(stranger.PubKey(), 2000000, coin, match.ReasonDeposit, "deposit"); err != nil {
+		t.Errorf("Error debiting user: %s", err)
+		return
+	}
+
+	var txid string
+	if txid, err = server.WithdrawLightning(user.PubKey(), 1500000, coin); err != nil {
+		t.Errorf("Error withdrawing over lightning: %s", err)
+		return
+	}
+
+	var channels []*LightningChannel
+	if channels, err = server.GetChannelsByPeerParam(user.PubKey(), coin); err != nil {
+		t.Errorf("Error getting channels: %s", err)
+		return
+	}
+	if len(channels) != 1 || channels[0].Txid != txid || channels[0].TheirAmt != 1500000 {
+		t.Errorf("Expected one channel funded with 1500000 on their side and txid %s", txid)
+		return
+	}
+
+	var available uint64
+	if available, _, err = server.GetBalance(user.PubKey(), coin, nil); err != nil || available != 500000 {
+		t.Errorf("Expected 500000 left after withdrawing, got %d, err %v", available, err)
+		return
+	}
+
+	// The fee is 1 per byte, so anything less than the min output plus 1000 is too small
+	if _, err = server.WithdrawLightning(user.PubKey(), consts.MinOutput, coin); err == nil {
+		t.Errorf("Withdrawing less than the minimum output should fail")
+		return
+	}
+
+	// We aren't peers with the stranger, so they can't withdraw and keep their balance
+	if _, err = server.WithdrawLightning(stranger.PubKey(), 1500000, coin); err == nil {
+		t.Errorf("Withdrawing without being a peer should fail")
+		return
+	}
+	if available, _, err = server.GetBalance(stranger.PubKey(), coin, nil); err != nil || available != 2000000 {
+		t.Errorf("Failed withdrawal should not change balance, got %d, err %v", available, err)
+		return
+	}
+
+	return
+}
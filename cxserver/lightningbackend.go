@@ -0,0 +1,53 @@
+package cxserver
+
+import (
+	"github.com/mit-dci/lit/crypto/koblitz"
+)
+
+// LightningChannel is a channel between the exchange and a peer
+type LightningChannel struct {
+	Idx      uint32
+	PeerIdx  uint32
+	CoinType uint32
+	// MyAmt is what the exchange can spend in the channel and TheirAmt is what the peer can
+	// spend, neither counts HTLCs that haven't been cleared
+	MyAmt    int64
+	TheirAmt int64
+	// Txid is the hash of the funding outpoint
+	Txid string
+}
+
+// LightningBackend is everything the server needs from lightning to take deposits by push, withdraw
+// into channels, and settle swaps. LitNodeBackend talks to a lit node.
+type LightningBackend interface {
+	// GetPeerIdx gets the index of the peer whose identity key is pubkey
+	GetPeerIdx(pubkey *koblitz.PublicKey) (peerIdx uint32, err error)
+	// ConnectedToPeer returns true if we're connected to the peer right now
+	ConnectedToPeer(peerIdx uint32) (connected bool)
+	// ListChannels returns every channel we have, with every peer
+	ListChannels() (channels []*LightningChannel, err error)
+	// GetChannel returns a channel by its index
+	GetChannel(chanIdx uint32) (channel *LightningChannel, err error)
+	// Fee returns the fee rate, per byte, of the wallet for a coin
+	Fee(coinType uint32) (fee int64, err error)
+	// WalletBalance returns how much is in the wallet for a coin, outside of channels
+	WalletBalance(coinType uint32) (balance int64, err error)
+	// FundChannel funds a channel with a peer out of our wallet, sending initSend to them when the
+	// channel opens
+	FundChannel(peerIdx uint32, coinType uint32, capacity int64, initSend int64) (chanIdx uint32, err error)
+	// DualFundChannel funds a channel with a peer where both of us put in funds
+	DualFundChannel(peerIdx uint32, coinType uint32, ourAmount int64, theirAmount int64) (chanIdx uint32, err error)
+	// PushChannel sends amount to the peer over a channel
+	PushChannel(chanIdx uint32, amount uint32) (err error)
+	// OfferHTLC offers the peer amount over a channel, which they can claim with the preimage of
+	// rHash before locktime
+	OfferHTLC(chanIdx uint32, amount uint32, rHash [32]byte, locktime uint32) (err error)
+	// ClaimHTLC claims every HTLC offered to us that is locked with the hash of preimage
+	ClaimHTLC(preimage [16]byte) (err error)
+	// CurrentHeight returns the height of the chain for a coin, which is what HTLC locktimes are
+	// compared to
+	CurrentHeight(coinType uint32) (height int32, err error)
+	// ClaimHTLCTimeouts takes back every HTLC we offered on a coin whose locktime is at or below
+	// height
+	ClaimHTLCTimeouts(coinType uint32, height int32) (err error)
+}
@@ -0,0 +1,204 @@
+package cxserver
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/portxo"
+	"github.com/mit-dci/lit/qln"
+)
+
+// LitNodeBackend is a LightningBackend that uses a lit node
+type LitNodeBackend struct {
+	node *qln.LitNode
+}
+
+// NewLitNodeBackend creates a lightning backend that uses a lit node
+func NewLitNodeBackend(node *qln.LitNode) (backend *LitNodeBackend) {
+	backend = &LitNodeBackend{node: node}
+	return
+}
+
+// channelFromQchan turns a lit channel into a LightningChannel
+func channelFromQchan(qchan *qln.Qchan) (channel *LightningChannel) {
+	myAmt, theirAmt := qchan.GetChannelBalances()
+	channel = &LightningChannel{
+		Idx:      qchan.Idx(),
+		PeerIdx:  qchan.Peer(),
+		CoinType: qchan.Coin(),
+		MyAmt:    myAmt,
+		TheirAmt: theirAmt,
+		Txid:     qchan.Op.Hash.String(),
+	}
+	return
+}
+
+// GetPeerIdx gets the index of the peer whose identity key is pubkey
+func (lb *LitNodeBackend) GetPeerIdx(pubkey *koblitz.PublicKey) (peerIdx uint32, err error) {
+	var pubkey33 [33]byte
+	copy(pubkey33[:], pubkey.SerializeCompressed())
+	litAddr := lnutil.LitAdrFromPubkey(pubkey33)
+
+	// until this is removed, this is good for our purposes
+	if peerIdx, err = lb.node.FindPeerIndexByAddress(litAddr); err != nil {
+		err = fmt.Errorf("Error finding peer index for GetPeerIdx: %s", err)
+		return
+	}
+	return
+}
+
+// ConnectedToPeer returns true if the lit node is connected to the peer
+func (lb *LitNodeBackend) ConnectedToPeer(peerIdx uint32) (connected bool) {
+	connected = lb.node.ConnectedToPeer(peerIdx)
+	return
+}
+
+// ListChannels returns every channel the lit node has
+func (lb *LitNodeBackend) ListChannels() (channels []*LightningChannel, err error) {
+	var qchans []*qln.Qchan
+	if qchans, err = lb.node.GetAllQchans(); err != nil {
+		err = fmt.Errorf("Error getting channels for ListChannels: %s", err)
+		return
+	}
+
+	for _, qchan := range qchans {
+		channels = append(channels, channelFromQchan(qchan))
+	}
+	return
+}
+
+// GetChannel returns a channel from the lit node by its index
+func (lb *LitNodeBackend) GetChannel(chanIdx uint32) (channel *LightningChannel, err error) {
+	var qchan *qln.Qchan
+	if qchan, err = lb.node.GetQchanByIdx(chanIdx); err != nil {
+		err = fmt.Errorf("Error getting channel by index for GetChannel: %s", err)
+		return
+	}
+	channel = channelFromQchan(qchan)
+	return
+}
+
+// subWallet gets the lit node's wallet for a coin
+func (lb *LitNodeBackend) subWallet(coinType uint32) (wallet qln.UWallet, err error) {
+	var ok bool
+	if wallet, ok = lb.node.SubWallet[coinType]; !ok {
+		err = fmt.Errorf("No wallet of the %d type connected", coinType)
+		return
+	}
+	return
+}
+
+// Fee returns the fee rate of the lit node's wallet for a coin
+func (lb *LitNodeBackend) Fee(coinType uint32) (fee int64, err error) {
+	var wallet qln.UWallet
+	if wallet, err = lb.subWallet(coinType); err != nil {
+		return
+	}
+	fee = wallet.Fee()
+	return
+}
+
+// WalletBalance adds up the utxos in the lit node's wallet for a coin
+func (lb *LitNodeBackend) WalletBalance(coinType uint32) (balance int64, err error) {
+	var wallet qln.UWallet
+	if wallet, err = lb.subWallet(coinType); err != nil {
+		return
+	}
+
+	var allUtxos []*portxo.PorTxo
+	if allUtxos, err = wallet.UtxoDump(); err != nil {
+		err = fmt.Errorf("Error dumping utxos for WalletBalance: %s", err)
+		return
+	}
+
+	for _, utxo := range allUtxos {
+		balance += utxo.Value
+	}
+	return
+}
+
+// FundChannel funds a channel with a peer out of the lit node's wallet
+func (lb *LitNodeBackend) FundChannel(peerIdx uint32, coinType uint32, capacity int64, initSend int64) (chanIdx uint32, err error) {
+	// we don't have any data to send
+	if chanIdx, err = lb.node.FundChannel(peerIdx, coinType, capacity, initSend, [32]byte{}); err != nil {
+		err = fmt.Errorf("Error funding channel for FundChannel: %s", err)
+		return
+	}
+	return
+}
+
+// DualFundChannel funds a channel with a peer where both sides put in funds
+func (lb *LitNodeBackend) DualFundChannel(peerIdx uint32, coinType uint32, ourAmount int64, theirAmount int64) (chanIdx uint32, err error) {
+	var result *qln.DualFundingResult
+	if result, err = lb.node.DualFundChannel(peerIdx, coinType, ourAmount, theirAmount); err != nil {
+		err = fmt.Errorf("Error dual funding channel for DualFundChannel: %s", err)
+		return
+	}
+
+	if result.Error || !result.Accepted {
+		err = fmt.Errorf("Error creating a dual funding channel. reason: %d. accepted: %t", result.DeclineReason, result.Accepted)
+		return
+	}
+
+	chanIdx = result.ChannelId
+	return
+}
+
+// PushChannel sends amount to the peer over a channel
+func (lb *LitNodeBackend) PushChannel(chanIdx uint32, amount uint32) (err error) {
+	var qchan *qln.Qchan
+	if qchan, err = lb.node.GetQchanByIdx(chanIdx); err != nil {
+		err = fmt.Errorf("Error getting channel by index for PushChannel: %s", err)
+		return
+	}
+
+	if err = lb.node.PushChannel(qchan, amount, [32]byte{}); err != nil {
+		err = fmt.Errorf("Error pushing over channel for PushChannel: %s", err)
+		return
+	}
+	return
+}
+
+// OfferHTLC offers the peer amount over a channel, locked with rHash until locktime
+func (lb *LitNodeBackend) OfferHTLC(chanIdx uint32, amount uint32, rHash [32]byte, locktime uint32) (err error) {
+	var qchan *qln.Qchan
+	if qchan, err = lb.node.GetQchanByIdx(chanIdx); err != nil {
+		err = fmt.Errorf("Error getting channel by index for OfferHTLC: %s", err)
+		return
+	}
+
+	if err = lb.node.OfferHTLC(qchan, amount, rHash, locktime, [32]byte{}); err != nil {
+		err = fmt.Errorf("Error offering HTLC for OfferHTLC: %s", err)
+		return
+	}
+	return
+}
+
+// ClaimHTLC claims every HTLC offered to the lit node that is locked with the hash of preimage
+func (lb *LitNodeBackend) ClaimHTLC(preimage [16]byte) (err error) {
+	if _, err = lb.node.ClaimHTLC(preimage); err != nil {
+		err = fmt.Errorf("Error claiming HTLC for ClaimHTLC: %s", err)
+		return
+	}
+	return
+}
+
+// CurrentHeight returns the height of the lit node's wallet for a coin
+func (lb *LitNodeBackend) CurrentHeight(coinType uint32) (height int32, err error) {
+	var wallet qln.UWallet
+	if wallet, err = lb.subWallet(coinType); err != nil {
+		return
+	}
+	height = wallet.CurrentHeight()
+	return
+}
+
+// ClaimHTLCTimeouts takes back every HTLC the lit node offered on a coin that has timed out at height
+func (lb *LitNodeBackend) ClaimHTLCTimeouts(coinType uint32, height int32) (err error) {
+	if _, err = lb.node.ClaimHTLCTimeouts(coinType, height); err != nil {
+		err = fmt.Errorf("Error claiming HTLC timeouts for ClaimHTLCTimeouts: %s", err)
+		return
+	}
+	return
+}
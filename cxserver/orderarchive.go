@@ -0,0 +1,88 @@
+package cxserver
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/logging"
+	"github.com/mit-dci/opencx/match"
+)
+
+// GetArchivedOrder gets an order that was filled or cancelled from the archive of whichever
+// orderbook has it
+func (server *OpencxServer) GetArchivedOrder(orderID *match.OrderID) (archived *match.ArchivedLimitOrder, err error) {
+	server.dbLock.Lock()
+	defer server.dbLock.Unlock()
+
+	// The orderbooks don't say whether an order isn't there or they couldn't look, so we check
+	// every one of them before giving up
+	for _, limBook := range server.Orderbooks {
+		if archived, err = limBook.GetArchivedOrder(orderID); err == nil && archived != nil {
+			return
+		}
+	}
+
+	archived = nil
+	err = fmt.Errorf("Could not find archived order with that order ID")
+	return
+}
+
+// GetArchivedOrdersForPubkey gets the orders for a pubkey that were filled or cancelled, in the
+// order they were closed. If the sub-account is not nil, only orders from that sub-account are
+// returned.
+func (server *OpencxServer) GetArchivedOrdersForPubkey(pubkey *koblitz.PublicKey, subAccount *uint32) (archived []*match.ArchivedLimitOrder, err error) {
+	server.dbLock.Lock()
+	for pair, limBook := range server.Orderbooks {
+		var bookArchived []*match.ArchivedLimitOrder
+		if bookArchived, err = limBook.GetArchivedOrdersForPubkey(pubkey, subAccount); err != nil {
+			err = fmt.Errorf("Error getting archived orders for %s for GetArchivedOrdersForPubkey: %s", pair.String(), err)
+			server.dbLock.Unlock()
+			return
+		}
+		archived = append(archived, bookArchived...)
+	}
+	server.dbLock.Unlock()
+
+	sort.SliceStable(archived, func(i, j int) bool {
+		return archived[i].ClosedAt.Before(archived[j].ClosedAt)
+	})
+	return
+}
+
+// PruneOrderArchive deletes the archived orders in every orderbook that were closed before the
+// cutoff, and returns how many were deleted.
+func (server *OpencxServer) PruneOrderArchive(before time.Time) (pruned uint64, err error) {
+	server.dbLock.Lock()
+	defer server.dbLock.Unlock()
+
+	for pair, limBook := range server.Orderbooks {
+		var bookPruned uint64
+		if bookPruned, err = limBook.PruneArchive(before); err != nil {
+			err = fmt.Errorf("Error pruning archive for %s for PruneOrderArchive: %s", pair.String(), err)
+			return
+		}
+		pruned += bookPruned
+	}
+	return
+}
+
+// StartArchivePruning prunes the orders that were closed more than retention ago from the archive
+// once every interval, until the server goes away.
+func (server *OpencxServer) StartArchivePruning(retention time.Duration, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			pruned, err := server.PruneOrderArchive(time.Now().Add(-retention))
+			if err != nil {
+				logging.Errorf("Error pruning order archive: %s", err)
+				continue
+			}
+			if pruned > 0 {
+				logging.Infof("Pruned %d orders from the order archive", pruned)
+			}
+		}
+	}()
+	return
+}
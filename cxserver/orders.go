@@ -5,15 +5,17 @@ import (
 
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/lit/crypto/koblitz"
-	"github.com/mit-dci/opencx/cxdb"
 	"github.com/mit-dci/opencx/match"
 )
 
 // GetOrder gets the order for the given id from the limit orderbook
 func (server *OpencxServer) GetOrder(orderID *match.OrderID) (order *match.LimitOrderIDPair, err error) {
 
-	// We just go through everything, checking the limit orderbook, seeing if we get a match
+	// We just go through everything, checking the limit orderbook, seeing if we get a match. This
+	// is used to check who owns an order before cancelling it, so it waits for the orderbooks to
+	// have every order.
 	server.dbLock.Lock()
+	server.waitForProjection()
 	for _, limBook := range server.Orderbooks {
 		if order, err = limBook.GetOrder(orderID); err != nil && order == nil {
 			err = fmt.Errorf("Error getting order from a limit orderbook: %s", err)
@@ -31,7 +33,8 @@ func (server *OpencxServer) GetOrder(orderID *match.OrderID) (order *match.Limit
 }
 
 // PlaceOrder places an order by first checking if we can credit the user, then calling the appropriate
-// database calls
+// database calls. Swap orders don't touch the user's balance, instead we check that they can pay over
+// lightning and start a swap for every fill.
 func (server *OpencxServer) PlaceOrder(order *match.LimitOrder) (orderID *match.OrderID, err error) {
 
 	var assetToCredit match.Asset
@@ -71,6 +74,16 @@ func (server *OpencxServer) PlaceOrder(order *match.LimitOrder) (orderID *match.
 
 	server.dbLock.Lock()
 
+	// The channels have to cover every open swap order, so the orderbooks have to have them all
+	if order.Swap {
+		server.waitForProjection()
+		if err = server.checkSwapChannels(order); err != nil {
+			err = fmt.Errorf("Error checking channels for swap order for PlaceOrder: %s", err)
+			server.dbLock.Unlock()
+			return
+		}
+	}
+
 	// first we need to get the settlement engine, limit engine, orderbook, and settlement store
 	var currSetEng match.SettlementEngine
 	var ok bool
@@ -87,41 +100,47 @@ func (server *OpencxServer) PlaceOrder(order *match.LimitOrder) (orderID *match.
 		return
 	}
 
-	var currOrderbook match.LimitOrderbook
-	if currOrderbook, ok = server.Orderbooks[order.TradingPair]; !ok {
+	if _, ok = server.Orderbooks[order.TradingPair]; !ok {
 		err = fmt.Errorf("Could not find orderbooks for trading pair for PlaceOrder")
 		server.dbLock.Unlock()
 		return
 	}
 
-	var currSetStore cxdb.SettlementStore
-	if currSetStore, ok = server.SettlementStores[param]; !ok {
+	if _, ok = server.SettlementStores[param]; !ok {
 		err = fmt.Errorf("Could not find settlement store for asset for PlaceOrder")
 		server.dbLock.Unlock()
 		return
 	}
 
+	// The order ID isn't known until the matching engine places it, so the ledger reference is the
+	// side and pair
 	orderCreditExec := &match.SettlementExecution{
-		Pubkey: order.Pubkey,
-		Type:   match.Credit,
-		Asset:  assetToCredit,
-		Amount: order.AmountHave,
+		Pubkey:     order.Pubkey,
+		SubAccount: order.SubAccount,
+		Type:       match.Credit,
+		Asset:      assetToCredit,
+		Amount:     order.AmountHave,
+		Reason:     match.ReasonOrder,
+		Reference:  fmt.Sprintf("%s %s", order.Side.String(), order.TradingPair.String()),
 	}
 	// Let's hope that since they're both [33]byte their value can just be copied over through assignment
 	// copy(orderCreditExec.Pubkey[:], order.Pubkey[:])
 
-	// Okay now that we have these, check the validity
+	// Okay now that we have these, check the validity. Swap orders are paid for over lightning, so
+	// there's nothing to check.
 	var valid bool
-	if valid, err = currSetEng.CheckValid(orderCreditExec); err != nil {
-		err = fmt.Errorf("Error checking valid settlement exec: %s", err)
-		server.dbLock.Unlock()
-		return
-	}
+	if !order.Swap {
+		if valid, err = currSetEng.CheckValid(orderCreditExec); err != nil {
+			err = fmt.Errorf("Error checking valid settlement exec: %s", err)
+			server.dbLock.Unlock()
+			return
+		}
 
-	if !valid {
-		err = fmt.Errorf("Error placing order, not enough balance or you are not allowed to place orders")
-		server.dbLock.Unlock()
-		return
+		if !valid {
+			err = fmt.Errorf("Error placing order, not enough balance or you are not allowed to place orders")
+			server.dbLock.Unlock()
+			return
+		}
 	}
 
 	// Now we do these two operations. !!! IMPORTANT: THESE TWO CALLS NEED TO BE ATOMIC !!!
@@ -136,13 +155,15 @@ func (server *OpencxServer) PlaceOrder(order *match.LimitOrder) (orderID *match.
 	// Long story short, distributed systems are hard.
 	var settlementResults []*match.SettlementResult
 	var setRes *match.SettlementResult
-	if setRes, err = currSetEng.ApplySettlementExecution(orderCreditExec); err != nil {
-		err = fmt.Errorf("Error applying settlement execution when placing order: %s", err)
-		server.dbLock.Unlock()
-		return
-	}
+	if !order.Swap {
+		if setRes, err = currSetEng.ApplySettlementExecution(orderCreditExec); err != nil {
+			err = fmt.Errorf("Error applying settlement execution when placing order: %s", err)
+			server.dbLock.Unlock()
+			return
+		}
 
-	settlementResults = append(settlementResults, setRes)
+		settlementResults = append(settlementResults, setRes)
+	}
 
 	var idRes *match.LimitOrderIDPair
 	if idRes, err = currMatchEng.PlaceLimitOrder(order); err != nil {
@@ -156,115 +177,77 @@ func (server *OpencxServer) PlaceOrder(order *match.LimitOrder) (orderID *match.
 
 	var orderExecs []*match.OrderExecution
 	var settlementExecs []*match.SettlementExecution
-	if orderExecs, settlementExecs, err = currMatchEng.MatchLimitOrders(); err != nil {
+	var swaps []*match.SwapInstruction
+	if orderExecs, settlementExecs, swaps, err = currMatchEng.MatchLimitOrders(); err != nil {
 		err = fmt.Errorf("Error matching orders for limit matching engine for PlaceOrder: %s", err)
 		server.dbLock.Unlock()
 		return
 	}
 
-	for _, setExec := range settlementExecs {
-
-		var thisCoin *coinparam.Params
-		if thisCoin, err = setExec.Asset.CoinParamFromAsset(); err != nil {
-			err = fmt.Errorf("Error getting coin param from asset to find correct engine: %s", err)
-			server.dbLock.Unlock()
-			return
-		}
-
-		var thisAssetEngine match.SettlementEngine
-		if thisAssetEngine, ok = server.SettlementEngines[thisCoin]; !ok {
-			err = fmt.Errorf("Could not find correct settlement engine for PlaceOrder")
-			server.dbLock.Unlock()
-			return
-		}
-
-		// We reuse valid.
-		if valid, err = thisAssetEngine.CheckValid(setExec); err != nil {
-			err = fmt.Errorf("Error checking valid settlement exec after match for PlaceOrder: %s", err)
-			server.dbLock.Unlock()
-			return
-		}
-
-		if !valid {
-			err = fmt.Errorf("Error with matching engine output settlement validity, exec: \n%s", setExec.String())
-			server.dbLock.Unlock()
-			return
-		}
-
-		// We reuse setRes.
-		if setRes, err = thisAssetEngine.ApplySettlementExecution(setExec); err != nil {
-			err = fmt.Errorf("Error applying settlement execution after match for PlaceOrder: %s", err)
-			server.dbLock.Unlock()
-			return
-		}
-		settlementResults = append(settlementResults, setRes)
-	}
-
-	// Now we don't worry any more. The matching engine and settlement engine have both responded.
-	// If we needed to we could rebuild the state.
-
-	// update orderbook
-	if err = currOrderbook.UpdateBookPlace(idRes); err != nil {
-		err = fmt.Errorf("Error placing order on orderbook for PlaceOrder: %s", err)
+	// Settle the whole match at once, so no trade is left settled for one asset but not the other
+	var matchResults []*match.SettlementResult
+	if matchResults, err = server.BatchSettlementEngine.ApplySettlementBatch(settlementExecs); err != nil {
+		err = fmt.Errorf("Error applying settlement executions after match for PlaceOrder: %s", err)
 		server.dbLock.Unlock()
 		return
 	}
+	settlementResults = append(settlementResults, matchResults...)
 
-	for _, orderExec := range orderExecs {
-		if err = currOrderbook.UpdateBookExec(orderExec); err != nil {
-			err = fmt.Errorf("Error updating orderbook execution for PlaceOrder: %s", err)
-			server.dbLock.Unlock()
-			return
-		}
-	}
+	// Now we don't worry any more. The matching engine and settlement engine have both responded.
+	// If we needed to we could rebuild the state.
 
-	// update what the client sees
-	if err = currSetStore.UpdateBalances(settlementResults); err != nil {
-		err = fmt.Errorf("Error updating balances with settlement results for PlaceOrder: %s", err)
+	// update the orderbook and balances, which is what the client sees
+	if err = server.queueReadUpdate(&readUpdate{
+		pair:              order.TradingPair,
+		placed:            idRes,
+		execs:             orderExecs,
+		settlementResults: settlementResults,
+	}); err != nil {
+		err = fmt.Errorf("Error updating orderbook and balances for PlaceOrder: %s", err)
 		server.dbLock.Unlock()
 		return
 	}
 
 	server.dbLock.Unlock()
 
+	// Fills for swap orders are settled over lightning, which doesn't need the database
+	server.startSwaps(swaps)
+
 	// Now we return thing
 	orderID = idRes.OrderID
 	return
 }
 
-// ViewOrderbook returns a view of the orderbook for the user
+// ViewOrderbook returns a view of the orderbook for the user. This doesn't wait on writes, so the
+// orderbook may be behind by ProjectionLag.
 func (server *OpencxServer) ViewOrderbook(pair *match.Pair) (book map[float64][]*match.LimitOrderIDPair, err error) {
 
-	server.dbLock.Lock()
 	var currOrderbook match.LimitOrderbook
 	var ok bool
 	if currOrderbook, ok = server.Orderbooks[*pair]; !ok {
 		err = fmt.Errorf("Could not find orderbooks for trading pair for ViewOrderbook")
-		server.dbLock.Unlock()
 		return
 	}
 
 	if book, err = currOrderbook.ViewLimitOrderBook(); err != nil {
 		err = fmt.Errorf("Error viewing limit orderbook for server for ViewOrderbook: %s", err)
-		server.dbLock.Unlock()
 		return
 	}
-	server.dbLock.Unlock()
 
 	return
 }
 
-// GetOrdersForPubkey returns orders for a specific pubkey and pair
-func (server *OpencxServer) GetOrdersForPubkey(pubkey *koblitz.PublicKey) (orders []*match.LimitOrderIDPair, err error) {
+// GetOrdersForPubkey returns orders for a specific pubkey and pair. If the sub-account is not nil,
+// only orders from that sub-account are returned. This doesn't wait on writes, so the orders may be
+// behind by ProjectionLag.
+func (server *OpencxServer) GetOrdersForPubkey(pubkey *koblitz.PublicKey, subAccount *uint32) (orders []*match.LimitOrderIDPair, err error) {
 
-	server.dbLock.Lock()
 	var currOrderMap map[float64][]*match.LimitOrderIDPair
 	for _, currOrderbook := range server.Orderbooks {
 		// get the orders in map form
 		// TODO: determine if the map return type of this API is really necessary
-		if currOrderMap, err = currOrderbook.GetOrdersForPubkey(pubkey); err != nil {
+		if currOrderMap, err = currOrderbook.GetOrdersForPubkey(pubkey, subAccount); err != nil {
 			err = fmt.Errorf("Error getting book orders for pubkey for server GetOrdersForPubkey: %s", err)
-			server.dbLock.Unlock()
 			return
 		}
 
@@ -273,7 +256,6 @@ func (server *OpencxServer) GetOrdersForPubkey(pubkey *koblitz.PublicKey) (order
 			orders = append(orders, returnedOrders...)
 		}
 	}
-	server.dbLock.Unlock()
 
 	return
 }
@@ -316,15 +298,13 @@ func (server *OpencxServer) CancelOrder(order *match.LimitOrderIDPair) (err erro
 		return
 	}
 
-	var currOrderbook match.LimitOrderbook
-	if currOrderbook, ok = server.Orderbooks[order.Order.TradingPair]; !ok {
+	if _, ok = server.Orderbooks[order.Order.TradingPair]; !ok {
 		err = fmt.Errorf("Could not find orderbooks for trading pair for CancelOrder")
 		server.dbLock.Unlock()
 		return
 	}
 
-	var currSetStore cxdb.SettlementStore
-	if currSetStore, ok = server.SettlementStores[param]; !ok {
+	if _, ok = server.SettlementStores[param]; !ok {
 		err = fmt.Errorf("Could not find settlement store for asset for CancelOrder")
 		server.dbLock.Unlock()
 		return
@@ -348,8 +328,11 @@ func (server *OpencxServer) CancelOrder(order *match.LimitOrderIDPair) (err erro
 		return
 	}
 
+	// swap orders don't hold anything, so there's nothing to give back
 	var settlementExecs []*match.SettlementExecution
-	settlementExecs = append(settlementExecs, cancelSettlement)
+	if cancelSettlement != nil {
+		settlementExecs = append(settlementExecs, cancelSettlement)
+	}
 	var settlementResults []*match.SettlementResult
 	var setRes *match.SettlementResult
 	var valid bool
@@ -378,16 +361,13 @@ func (server *OpencxServer) CancelOrder(order *match.LimitOrderIDPair) (err erro
 	// Now we don't worry any more. The matching engine and settlement engine have both responded.
 	// If we needed to we could rebuild the state.
 
-	// update orderbook
-	if err = currOrderbook.UpdateBookCancel(cancelled); err != nil {
-		err = fmt.Errorf("Error updating orderbook cancel for CancelOrder: %s", err)
-		server.dbLock.Unlock()
-		return
-	}
-
-	// update what the client sees
-	if err = currSetStore.UpdateBalances(settlementResults); err != nil {
-		err = fmt.Errorf("Error updating balances with settlement results for CancelOrder: %s", err)
+	// update the orderbook and balances, which is what the client sees
+	if err = server.queueReadUpdate(&readUpdate{
+		pair:              order.Order.TradingPair,
+		cancelled:         cancelled,
+		settlementResults: settlementResults,
+	}); err != nil {
+		err = fmt.Errorf("Error updating orderbook and balances for CancelOrder: %s", err)
 		server.dbLock.Unlock()
 		return
 	}
@@ -0,0 +1,197 @@
+package cxserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/opencx/match"
+)
+
+// ProjectionLag is how far behind the orderbooks and balances that reads are served from are. If
+// the projection isn't running, these are applied before every write returns, so there's no lag.
+type ProjectionLag struct {
+	// Pending is the number of updates that haven't been applied yet
+	Pending uint64
+	// Behind is how long the oldest update that hasn't been applied has been waiting
+	Behind time.Duration
+}
+
+// readUpdate is what a write changes in the orderbooks and settlement stores. The orderbook
+// changes are applied first, so the held balances for the settlement results match them.
+type readUpdate struct {
+	pair              match.Pair
+	placed            *match.LimitOrderIDPair
+	execs             []*match.OrderExecution
+	cancelled         *match.CancelledOrder
+	settlementResults []*match.SettlementResult
+	queued            time.Time
+}
+
+// StartProjection makes the orderbooks and settlement stores get updated by another goroutine,
+// in the order the writes happened, so reads from them don't wait on the matching engines. Reads
+// that need to see every write wait for the updates to be applied.
+func (server *OpencxServer) StartProjection() {
+	server.projectionMtx.Lock()
+	if server.projecting {
+		server.projectionMtx.Unlock()
+		return
+	}
+	server.projecting = true
+	server.projectionMtx.Unlock()
+
+	go server.applyReadUpdates()
+	return
+}
+
+// ProjectionLag returns how far behind the orderbooks and balances are. Anything read from them
+// after this is called is at least this up to date.
+func (server *OpencxServer) ProjectionLag() (lag ProjectionLag) {
+	server.projectionMtx.Lock()
+	lag.Pending = uint64(len(server.readUpdates))
+	if len(server.readUpdates) > 0 {
+		lag.Behind = time.Since(server.readUpdates[0].queued)
+	}
+	server.projectionMtx.Unlock()
+	return
+}
+
+// queueReadUpdate applies an update to the orderbooks and settlement stores, or queues it if the
+// projection is running. This assumes dbLock is held, so updates are queued in the order the
+// writes happened.
+func (server *OpencxServer) queueReadUpdate(update *readUpdate) (err error) {
+	server.projectionMtx.Lock()
+	if !server.projecting {
+		server.projectionMtx.Unlock()
+		if err = server.applyReadUpdate(update); err != nil {
+			err = fmt.Errorf("Error applying update for queueReadUpdate: %s", err)
+			return
+		}
+		return
+	}
+
+	update.queued = time.Now()
+	server.readUpdates = append(server.readUpdates, update)
+	server.projectionCond.Broadcast()
+	server.projectionMtx.Unlock()
+	return
+}
+
+// waitForProjection waits until every queued update has been applied. If dbLock is held, nothing
+// read from the orderbooks and settlement stores after this is behind.
+func (server *OpencxServer) waitForProjection() {
+	server.projectionMtx.Lock()
+	for len(server.readUpdates) > 0 {
+		server.projectionCond.Wait()
+	}
+	server.projectionMtx.Unlock()
+	return
+}
+
+// applyReadUpdates applies queued updates one at a time, forever. An update stays in the queue
+// until it's applied, so it counts towards the lag.
+func (server *OpencxServer) applyReadUpdates() {
+	for {
+		server.projectionMtx.Lock()
+		for len(server.readUpdates) == 0 {
+			server.projectionCond.Wait()
+		}
+		update := server.readUpdates[0]
+		server.projectionMtx.Unlock()
+
+		if err := server.applyReadUpdate(update); err != nil {
+			server.raiseAlert("Orderbooks or balances may be wrong, could not apply update: %s", err)
+		}
+
+		server.projectionMtx.Lock()
+		server.readUpdates[0] = nil
+		server.readUpdates = server.readUpdates[1:]
+		server.projectionCond.Broadcast()
+		server.projectionMtx.Unlock()
+	}
+}
+
+// applyReadUpdate updates the orderbook for the pair, then the settlement stores, then tells the
+// update handlers what changed
+func (server *OpencxServer) applyReadUpdate(update *readUpdate) (err error) {
+	handlers := server.getUpdateHandlers()
+	exchangeUpdate := &ExchangeUpdate{
+		Pair:     update.pair,
+		Balances: update.settlementResults,
+		Time:     time.Now(),
+	}
+
+	if update.placed != nil || len(update.execs) > 0 || update.cancelled != nil {
+		var currOrderbook match.LimitOrderbook
+		var ok bool
+		if currOrderbook, ok = server.Orderbooks[update.pair]; !ok {
+			err = fmt.Errorf("Could not find orderbook for pair %s for applyReadUpdate", update.pair.String())
+			return
+		}
+
+		if update.placed != nil {
+			if err = currOrderbook.UpdateBookPlace(update.placed); err != nil {
+				err = fmt.Errorf("Error placing order on orderbook for applyReadUpdate: %s", err)
+				return
+			}
+			exchangeUpdate.Orders = append(exchangeUpdate.Orders, &OrderUpdate{
+				Order:  update.placed,
+				Status: match.OrderOpen,
+				Taker:  true,
+			})
+		}
+
+		for _, orderExec := range update.execs {
+			// the order has to be looked up before the execution takes it out of the book
+			if len(handlers) > 0 {
+				var orderUpdate *OrderUpdate
+				if orderUpdate, err = execUpdate(currOrderbook, orderExec, exchangeUpdate.Time); err != nil {
+					err = fmt.Errorf("Error getting update for execution for applyReadUpdate: %s", err)
+					return
+				}
+				orderUpdate.Taker = update.placed != nil && update.placed.OrderID != nil && *update.placed.OrderID == orderExec.OrderID
+				exchangeUpdate.Orders = append(exchangeUpdate.Orders, orderUpdate)
+			}
+
+			if err = currOrderbook.UpdateBookExec(orderExec); err != nil {
+				err = fmt.Errorf("Error updating orderbook execution for applyReadUpdate: %s", err)
+				return
+			}
+		}
+
+		if update.cancelled != nil {
+			var cancelUpdate *OrderUpdate
+			if len(handlers) > 0 {
+				cancelUpdate = new(OrderUpdate)
+				if cancelUpdate.Order, err = currOrderbook.GetOrder(update.cancelled.OrderID); err != nil {
+					err = fmt.Errorf("Error getting cancelled order for applyReadUpdate: %s", err)
+					return
+				}
+			}
+
+			if err = currOrderbook.UpdateBookCancel(update.cancelled); err != nil {
+				err = fmt.Errorf("Error updating orderbook cancel for applyReadUpdate: %s", err)
+				return
+			}
+
+			if cancelUpdate != nil {
+				if err = cancelStatus(currOrderbook, cancelUpdate); err != nil {
+					err = fmt.Errorf("Error getting status of cancelled order for applyReadUpdate: %s", err)
+					return
+				}
+				exchangeUpdate.Orders = append(exchangeUpdate.Orders, cancelUpdate)
+			}
+		}
+	}
+
+	if len(update.settlementResults) > 0 {
+		if err = server.updateSettlementStores(update.settlementResults); err != nil {
+			err = fmt.Errorf("Error updating balances with settlement results for applyReadUpdate: %s", err)
+			return
+		}
+	}
+
+	for _, handler := range handlers {
+		handler(exchangeUpdate)
+	}
+	return
+}
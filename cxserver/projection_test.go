@@ -0,0 +1,124 @@
+package cxserver
+
+import (
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/match"
+)
+
+// testGatedOrderbook is an orderbook that waits for the gate before placing each order
+type testGatedOrderbook struct {
+	testPubkeyOrderbook
+	gate chan bool
+}
+
+func (tb *testGatedOrderbook) UpdateBookPlace(limitIDPair *match.LimitOrderIDPair) (err error) {
+	<-tb.gate
+	return tb.testPubkeyOrderbook.UpdateBookPlace(limitIDPair)
+}
+
+func TestProjectionLag(t *testing.T) {
+	var err error
+
+	ltcStore := &testResultSettlementStore{results: make(map[match.Account]*match.SettlementResult)}
+	setStores := map[*coinparam.Params]cxdb.SettlementStore{&coinparam.LiteCoinTestNet4Params: ltcStore}
+
+	pair := match.Pair{AssetWant: match.BTCTest, AssetHave: match.LTCTest}
+	book := &testGatedOrderbook{gate: make(chan bool)}
+	books := map[match.Pair]match.LimitOrderbook{pair: book}
+
+	var server *OpencxServer
+	if server, err = InitServer(nil, nil, books, nil, setStores, ""); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+	server.StartProjection()
+
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating user key: %s", err)
+		return
+	}
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], privkey.PubKey().SerializeCompressed())
+
+	server.dbLock.Lock()
+	err = server.queueReadUpdate(&readUpdate{
+		pair: pair,
+		placed: &match.LimitOrderIDPair{
+			Price: 2,
+			Order: &match.LimitOrder{Pubkey: pubkeyBytes, Side: match.Buy, TradingPair: pair, AmountHave: 1000, AmountWant: 2000},
+		},
+		settlementResults: []*match.SettlementResult{
+			{
+				NewBal:         4000,
+				SuccessfulExec: &match.SettlementExecution{Pubkey: pubkeyBytes, Asset: match.LTCTest, Amount: 1000, Type: match.Credit},
+			},
+		},
+	})
+	server.dbLock.Unlock()
+	if err != nil {
+		t.Errorf("Error queueing update: %s", err)
+		return
+	}
+
+	// The update can't be applied until the gate opens, so it should count towards the lag, and
+	// reads shouldn't wait for it
+	lag := server.ProjectionLag()
+	if lag.Pending != 1 {
+		t.Errorf("Should have 1 pending update, got %d", lag.Pending)
+		return
+	}
+
+	var orders []*match.LimitOrderIDPair
+	if orders, err = server.GetOrdersForPubkey(privkey.PubKey(), nil); err != nil {
+		t.Errorf("Error getting orders for pubkey: %s", err)
+		return
+	}
+	if len(orders) != 0 {
+		t.Errorf("Order should not be in the orderbook before the update is applied, got %d orders", len(orders))
+		return
+	}
+
+	var available, inOrders uint64
+	if available, inOrders, err = server.GetBalance(privkey.PubKey(), &coinparam.LiteCoinTestNet4Params, nil); err != nil {
+		t.Errorf("Error getting balance: %s", err)
+		return
+	}
+	if available != 0 || inOrders != 0 {
+		t.Errorf("Balance should not be updated before the update is applied, got %d available and %d in orders", available, inOrders)
+		return
+	}
+
+	book.gate <- true
+	server.waitForProjection()
+
+	if lag = server.ProjectionLag(); lag.Pending != 0 || lag.Behind != 0 {
+		t.Errorf("Should not have any lag after waiting, got %d pending and %s behind", lag.Pending, lag.Behind)
+		return
+	}
+
+	if orders, err = server.GetOrdersForPubkey(privkey.PubKey(), nil); err != nil {
+		t.Errorf("Error getting orders for pubkey: %s", err)
+		return
+	}
+	if len(orders) != 1 {
+		t.Errorf("Order should be in the orderbook after the update is applied, got %d orders", len(orders))
+		return
+	}
+
+	// The order was placed before the balance was updated, so it's held
+	if available, inOrders, err = server.GetBalance(privkey.PubKey(), &coinparam.LiteCoinTestNet4Params, nil); err != nil {
+		t.Errorf("Error getting balance: %s", err)
+		return
+	}
+	if available != 4000 || inOrders != 1000 {
+		t.Errorf("Should have 4000 available and 1000 in orders, got %d and %d", available, inOrders)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,344 @@
+package cxserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/logging"
+	"github.com/mit-dci/opencx/match"
+)
+
+// reconciliationFileName is the file in the opencx root directory that reconciliation reports are
+// appended to, one JSON record per line
+const reconciliationFileName = "reconciliations.json"
+
+// ReconciliationReport compares what the exchange holds of a coin with what it owes, at one point in
+// time.
+type ReconciliationReport struct {
+	Coin string
+	Time time.Time
+
+	// WalletBalance is the total of the utxos in the hot wallet
+	WalletBalance uint64
+	// ColdBalance is everything swept from the hot wallet to cold storage, less what was refilled
+	ColdBalance uint64
+	// PendingSweeps is credited deposits to watch-only addresses that have not been swept yet
+	PendingSweeps uint64
+
+	// UserBalances is every user's available and held balance
+	UserBalances uint64
+	// InFlightWithdrawals is withdrawals that have been taken out of user balances but have not
+	// been sent yet. The coins are still in the wallet's utxos, so they're still owed.
+	InFlightWithdrawals uint64
+	// FeeBalance is the fees the exchange has collected
+	FeeBalance uint64
+
+	// Shortfall is how much less the exchange holds than it owes, or zero
+	Shortfall uint64
+	// WithdrawalsHalted is true if withdrawals of the coin were halted after this report
+	WithdrawalsHalted bool
+	// Resumed is true if this is not a reconciliation, but an operator resuming withdrawals. It's
+	// recorded so the resume is kept across a restart.
+	Resumed bool
+}
+
+// Assets is everything the exchange holds of the coin
+func (rr *ReconciliationReport) Assets() (assets uint64) {
+	assets = rr.WalletBalance + rr.ColdBalance + rr.PendingSweeps
+	return
+}
+
+// Liabilities is everything the exchange owes of the coin, including to itself
+func (rr *ReconciliationReport) Liabilities() (liabilities uint64) {
+	liabilities = rr.UserBalances + rr.InFlightWithdrawals + rr.FeeBalance
+	return
+}
+
+func (rr *ReconciliationReport) String() string {
+	if rr.Resumed {
+		return fmt.Sprintf("%s at %s: withdrawals resumed", rr.Coin, rr.Time.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s at %s: assets %d (wallet %d, cold %d, pending sweeps %d), liabilities %d (users %d, in-flight withdrawals %d, fees %d), shortfall %d", rr.Coin, rr.Time.Format(time.RFC3339), rr.Assets(), rr.WalletBalance, rr.ColdBalance, rr.PendingSweeps, rr.Liabilities(), rr.UserBalances, rr.InFlightWithdrawals, rr.FeeBalance, rr.Shortfall)
+}
+
+// SetReconcileThreshold sets how big the shortfall for a coin can get before withdrawals of that coin
+// are halted
+func (server *OpencxServer) SetReconcileThreshold(coinType *coinparam.Params, threshold uint64) {
+	server.reconcileMtx.Lock()
+	server.reconcileThresholds[coinType] = threshold
+	server.reconcileMtx.Unlock()
+	return
+}
+
+// StartReconciliation reconciles every coin once every interval, until the server goes away.
+func (server *OpencxServer) StartReconciliation(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if _, err := server.Reconcile(); err != nil {
+				logging.Errorf("Error reconciling wallets: %s", err)
+			}
+		}
+	}()
+	return
+}
+
+// Reconcile compares the wallet of every coin that has one with the balances the exchange owes for
+// that coin. Every report is recorded, and withdrawals are halted for any coin whose shortfall is
+// over its threshold.
+func (server *OpencxServer) Reconcile() (reports []*ReconciliationReport, err error) {
+	server.dbLock.Lock()
+	coins := make([]*coinparam.Params, 0, len(server.SettlementStores))
+	for coinType := range server.SettlementStores {
+		coins = append(coins, coinType)
+	}
+	server.dbLock.Unlock()
+
+	for _, coinType := range coins {
+		// we can't reconcile coins we don't have a wallet for
+		var walletBalance uint64
+		var walletErr error
+		if walletBalance, walletErr = server.getHotBalance(coinType); walletErr != nil {
+			logging.Warnf("Not reconciling %s: %s", coinType.Name, walletErr)
+			continue
+		}
+
+		var report *ReconciliationReport
+		if report, err = server.reconcileCoin(coinType, walletBalance); err != nil {
+			err = fmt.Errorf("Error reconciling %s for Reconcile: %s", coinType.Name, err)
+			return
+		}
+		reports = append(reports, report)
+	}
+	return
+}
+
+// reconcileCoin builds and records the reconciliation report for a coin given the wallet balance,
+// halting withdrawals if the shortfall is over the threshold
+func (server *OpencxServer) reconcileCoin(coinType *coinparam.Params, walletBalance uint64) (report *ReconciliationReport, err error) {
+	report = &ReconciliationReport{
+		Coin:          coinType.Name,
+		Time:          time.Now(),
+		WalletBalance: walletBalance,
+	}
+
+	report.ColdBalance = server.coldSweptBalance(coinType)
+
+	server.dbLock.Lock()
+	server.waitForProjection()
+	var currSettleStore cxdb.SettlementStore
+	var ok bool
+	if currSettleStore, ok = server.SettlementStores[coinType]; !ok {
+		err = fmt.Errorf("Cannot find the settlement store for reconcileCoin")
+		server.dbLock.Unlock()
+		return
+	}
+
+	if report.UserBalances, err = currSettleStore.GetTotalBalance(); err != nil {
+		err = fmt.Errorf("Error getting total balance for reconcileCoin: %s", err)
+		server.dbLock.Unlock()
+		return
+	}
+
+	var currLedgerStore cxdb.LedgerStore
+	if currLedgerStore, ok = server.LedgerStores[coinType]; ok {
+		if report.FeeBalance, err = currLedgerStore.GetFeeBalance(); err != nil {
+			err = fmt.Errorf("Error getting fee balance for reconcileCoin: %s", err)
+			server.dbLock.Unlock()
+			return
+		}
+	}
+
+	if report.PendingSweeps, err = server.unsweptDepositTotal(coinType); err != nil {
+		err = fmt.Errorf("Error getting pending sweeps for reconcileCoin: %s", err)
+		server.dbLock.Unlock()
+		return
+	}
+	server.dbLock.Unlock()
+
+	server.reconcileMtx.Lock()
+	report.InFlightWithdrawals = server.inFlightWithdrawals[coinType]
+	if report.Liabilities() > report.Assets() {
+		report.Shortfall = report.Liabilities() - report.Assets()
+	}
+
+	threshold, hasThreshold := server.reconcileThresholds[coinType]
+	alreadyHalted := server.withdrawalsHalted[coinType]
+	if hasThreshold && report.Shortfall > threshold {
+		server.withdrawalsHalted[coinType] = true
+	}
+	report.WithdrawalsHalted = server.withdrawalsHalted[coinType]
+	server.reconcileMtx.Unlock()
+
+	if report.WithdrawalsHalted && !alreadyHalted {
+		server.raiseAlert("Halted %s withdrawals, shortfall of %d is over the threshold of %d: %s", coinType.Name, report.Shortfall, threshold, report)
+	} else if report.Shortfall > 0 {
+		logging.Warnf("Reconciliation shortfall: %s", report)
+	}
+
+	if err = server.recordReconciliationReport(report); err != nil {
+		err = fmt.Errorf("Error recording report for reconcileCoin: %s", err)
+		return
+	}
+	return
+}
+
+// unsweptDepositTotal gets the total of credited deposits to watch-only addresses that have not
+// been swept yet, which is zero if the coin's deposits go to the hot wallet. This assumes the db
+// lock is held.
+func (server *OpencxServer) unsweptDepositTotal(coinType *coinparam.Params) (total uint64, err error) {
+	var currDepositStore cxdb.DepositStore
+	var ok bool
+	if currDepositStore, ok = server.DepositStores[coinType]; !ok || !server.hasDepositXpub(coinType) {
+		return
+	}
+
+	var deposits []*match.Deposit
+	if deposits, err = currDepositStore.GetSweepableDeposits(); err != nil {
+		err = fmt.Errorf("Error getting unswept %s deposits: %s", coinType.Name, err)
+		return
+	}
+	for _, deposit := range deposits {
+		total += deposit.Amount
+	}
+	return
+}
+
+// recordReconciliationReport keeps the report in memory and appends it to the report file, if the
+// server has a root directory
+func (server *OpencxServer) recordReconciliationReport(report *ReconciliationReport) (err error) {
+	server.reconcileMtx.Lock()
+	server.reconciliationReports = append(server.reconciliationReports, report)
+	server.reconcileMtx.Unlock()
+
+	if server.OpencxRoot == "" {
+		return
+	}
+
+	var reportBytes []byte
+	if reportBytes, err = json.Marshal(report); err != nil {
+		err = fmt.Errorf("Error marshalling report for recordReconciliationReport: %s", err)
+		return
+	}
+
+	var reportFile *os.File
+	if reportFile, err = os.OpenFile(filepath.Join(server.OpencxRoot, reconciliationFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+		err = fmt.Errorf("Error opening report file for recordReconciliationReport: %s", err)
+		return
+	}
+	defer reportFile.Close()
+
+	if _, err = reportFile.Write(append(reportBytes, '\n')); err != nil {
+		err = fmt.Errorf("Error writing report file for recordReconciliationReport: %s", err)
+		return
+	}
+	return
+}
+
+// LoadReconciliationReports loads the reconciliation reports from the root directory. Withdrawals
+// that were halted stay halted across a restart, unless they were resumed after the halt.
+func (server *OpencxServer) LoadReconciliationReports() (err error) {
+	var reportFile *os.File
+	if reportFile, err = os.Open(filepath.Join(server.OpencxRoot, reconciliationFileName)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer reportFile.Close()
+
+	var reports []*ReconciliationReport
+	halted := make(map[string]bool)
+	scanner := bufio.NewScanner(reportFile)
+	for scanner.Scan() {
+		report := new(ReconciliationReport)
+		if err = json.Unmarshal(scanner.Bytes(), report); err != nil {
+			err = fmt.Errorf("Error parsing report file for LoadReconciliationReports: %s", err)
+			return
+		}
+		halted[report.Coin] = report.WithdrawalsHalted
+		reports = append(reports, report)
+	}
+	if err = scanner.Err(); err != nil {
+		err = fmt.Errorf("Error reading report file for LoadReconciliationReports: %s", err)
+		return
+	}
+
+	server.dbLock.Lock()
+	coins := make([]*coinparam.Params, 0, len(server.SettlementStores))
+	for coinType := range server.SettlementStores {
+		coins = append(coins, coinType)
+	}
+	server.dbLock.Unlock()
+
+	server.reconcileMtx.Lock()
+	server.reconciliationReports = reports
+	for _, coinType := range coins {
+		if halted[coinType.Name] {
+			server.withdrawalsHalted[coinType] = true
+		}
+	}
+	server.reconcileMtx.Unlock()
+	return
+}
+
+// GetReconciliationReports returns every reconciliation report, oldest first
+func (server *OpencxServer) GetReconciliationReports() (reports []*ReconciliationReport) {
+	server.reconcileMtx.Lock()
+	reports = make([]*ReconciliationReport, len(server.reconciliationReports))
+	copy(reports, server.reconciliationReports)
+	server.reconcileMtx.Unlock()
+	return
+}
+
+// WithdrawalsHalted returns true if withdrawals of the coin have been halted by reconciliation
+func (server *OpencxServer) WithdrawalsHalted(coinType *coinparam.Params) (halted bool) {
+	server.reconcileMtx.Lock()
+	halted = server.withdrawalsHalted[coinType]
+	server.reconcileMtx.Unlock()
+	return
+}
+
+// ResumeWithdrawals lets withdrawals of the coin go through again after they were halted. This
+// should only be done once an operator knows why there was a shortfall. The resume is recorded
+// with the reports so withdrawals aren't halted again when the reports are loaded after a restart.
+func (server *OpencxServer) ResumeWithdrawals(coinType *coinparam.Params) (err error) {
+	resume := &ReconciliationReport{
+		Coin:    coinType.Name,
+		Time:    time.Now(),
+		Resumed: true,
+	}
+	if err = server.recordReconciliationReport(resume); err != nil {
+		err = fmt.Errorf("Error recording resume for ResumeWithdrawals: %s", err)
+		return
+	}
+
+	server.reconcileMtx.Lock()
+	server.withdrawalsHalted[coinType] = false
+	server.reconcileMtx.Unlock()
+	logging.Infof("Resumed %s withdrawals", coinType.Name)
+	return
+}
+
+// addInFlightWithdrawal adds to the amount that has been taken out of balances but not sent yet
+func (server *OpencxServer) addInFlightWithdrawal(coinType *coinparam.Params, amount uint64) {
+	server.reconcileMtx.Lock()
+	server.inFlightWithdrawals[coinType] += amount
+	server.reconcileMtx.Unlock()
+	return
+}
+
+// removeInFlightWithdrawal removes a withdrawal from the in-flight amount once it has been sent, or
+// has failed
+func (server *OpencxServer) removeInFlightWithdrawal(coinType *coinparam.Params, amount uint64) {
+	server.reconcileMtx.Lock()
+	server.inFlightWithdrawals[coinType] -= amount
+	server.reconcileMtx.Unlock()
+	return
+}
@@ -0,0 +1,127 @@
+package cxserver
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/opencx/cxdb"
+)
+
+func TestReconcileHaltsWithdrawals(t *testing.T) {
+	var err error
+
+	var rootDir string
+	if rootDir, err = ioutil.TempDir("", "reconcile"); err != nil {
+		t.Errorf("Error creating temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(rootDir)
+
+	coin := &coinparam.RegressionNetParams
+	settleStores := map[*coinparam.Params]cxdb.SettlementStore{coin: &testTotalSettlementStore{total: 1000}}
+
+	var server *OpencxServer
+	if server, err = InitServer(nil, nil, nil, nil, settleStores, rootDir); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+	server.SetLedgerStores(map[*coinparam.Params]cxdb.LedgerStore{coin: &testMismatchLedgerStore{fees: 50}})
+	server.SetReconcileThreshold(coin, 100)
+
+	// The wallet covers the users and the fees
+	var report *ReconciliationReport
+	if report, err = server.reconcileCoin(coin, 1050); err != nil {
+		t.Errorf("Error reconciling: %s", err)
+		return
+	}
+	if report.Shortfall != 0 || report.WithdrawalsHalted || report.Liabilities() != 1050 {
+		t.Errorf("Expected no shortfall against liabilities of 1050, got %s", report)
+		return
+	}
+
+	// A small shortfall is under the threshold
+	if report, err = server.reconcileCoin(coin, 1000); err != nil {
+		t.Errorf("Error reconciling: %s", err)
+		return
+	}
+	if report.Shortfall != 50 || report.WithdrawalsHalted || server.WithdrawalsHalted(coin) {
+		t.Errorf("A shortfall of 50 should not halt withdrawals, got %s", report)
+		return
+	}
+
+	// A withdrawal that hasn't been sent yet is still owed, which puts us over the threshold
+	server.addInFlightWithdrawal(coin, 200)
+	if report, err = server.reconcileCoin(coin, 1050); err != nil {
+		t.Errorf("Error reconciling: %s", err)
+		return
+	}
+	server.removeInFlightWithdrawal(coin, 200)
+	if report.Shortfall != 200 || !report.WithdrawalsHalted || !server.WithdrawalsHalted(coin) {
+		t.Errorf("A shortfall of 200 should halt withdrawals, got %s", report)
+		return
+	}
+
+	alerts := server.GetAlerts()
+	if len(alerts) != 1 || !strings.Contains(alerts[0].Message, "Halted") {
+		t.Errorf("Expected one alert for halting withdrawals, got %d alerts", len(alerts))
+		return
+	}
+
+	if _, err = server.WithdrawCoins("", nil, 10, coin); err == nil || !strings.Contains(err.Error(), "halted") {
+		t.Errorf("Withdrawing while halted should fail because withdrawals are halted, got %v", err)
+		return
+	}
+
+	if reports := server.GetReconciliationReports(); len(reports) != 3 {
+		t.Errorf("Expected 3 reconciliation reports, got %d", len(reports))
+		return
+	}
+
+	// Reports and the halt should survive a restart
+	var restarted *OpencxServer
+	if restarted, err = InitServer(nil, nil, nil, nil, settleStores, rootDir); err != nil {
+		t.Errorf("Error initializing restarted server: %s", err)
+		return
+	}
+	if err = restarted.LoadReconciliationReports(); err != nil {
+		t.Errorf("Error loading reconciliation reports: %s", err)
+		return
+	}
+	if reports := restarted.GetReconciliationReports(); len(reports) != 3 || reports[2].Shortfall != 200 {
+		t.Errorf("Expected the 3 recorded reports to be loaded, got %d", len(reports))
+		return
+	}
+	if !restarted.WithdrawalsHalted(coin) {
+		t.Errorf("Withdrawals should still be halted after a restart")
+		return
+	}
+
+	if err = restarted.ResumeWithdrawals(coin); err != nil {
+		t.Errorf("Error resuming withdrawals: %s", err)
+		return
+	}
+	if restarted.WithdrawalsHalted(coin) {
+		t.Errorf("Withdrawals should not be halted after resuming")
+		return
+	}
+
+	// The resume should survive a restart too
+	var resumed *OpencxServer
+	if resumed, err = InitServer(nil, nil, nil, nil, settleStores, rootDir); err != nil {
+		t.Errorf("Error initializing resumed server: %s", err)
+		return
+	}
+	if err = resumed.LoadReconciliationReports(); err != nil {
+		t.Errorf("Error loading reconciliation reports after resuming: %s", err)
+		return
+	}
+	if resumed.WithdrawalsHalted(coin) {
+		t.Errorf("Withdrawals should not be halted again after resuming and restarting")
+		return
+	}
+
+	return
+}
@@ -0,0 +1,145 @@
+package cxserver
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/wire"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/logging"
+	"github.com/mit-dci/opencx/match"
+)
+
+// blockHashDepth is how many blocks back we remember hashes for. A reorg deeper than this will not
+// be detected.
+const blockHashDepth = 144
+
+// recordBlockAndFindOrphans records the hash of the block at height, and returns the hashes of any
+// blocks we had previously recorded that are no longer in the chain. A block is orphaned if we
+// had a different block at the same height, or if the new block's parent is not the block we had
+// recorded at the height below it.
+func (server *OpencxServer) recordBlockAndFindOrphans(height uint64, block *wire.MsgBlock, coinType *coinparam.Params) (orphanedHashes []string) {
+	blockHash := block.Header.BlockHash().String()
+	parentHash := block.Header.PrevBlock.String()
+
+	server.blockHashMtx.Lock()
+	var hashes map[uint64]string
+	var ok bool
+	if hashes, ok = server.blockHashes[coinType]; !ok {
+		hashes = make(map[uint64]string)
+		server.blockHashes[coinType] = hashes
+	}
+
+	// figure out where the fork starts, if there is one
+	forkHeight := height + 1
+	if oldHash, found := hashes[height]; found && oldHash != blockHash {
+		forkHeight = height
+	}
+	if height > 0 {
+		if oldParent, found := hashes[height-1]; found && oldParent != parentHash {
+			forkHeight = height - 1
+		}
+	}
+
+	// everything we have at or above the fork is orphaned
+	for h, hash := range hashes {
+		if h >= forkHeight {
+			orphanedHashes = append(orphanedHashes, hash)
+			delete(hashes, h)
+		}
+	}
+
+	hashes[height] = blockHash
+	if height > 0 && forkHeight == height-1 {
+		// we never saw the new parent, but we know its hash now
+		hashes[height-1] = parentHash
+	}
+
+	// prune what we don't need anymore
+	for h := range hashes {
+		if h+blockHashDepth < height {
+			delete(hashes, h)
+		}
+	}
+	server.blockHashMtx.Unlock()
+
+	if len(orphanedHashes) > 0 {
+		logging.Warnf("Reorg detected for %s at height %d, %d blocks orphaned", coinType.Name, forkHeight, len(orphanedHashes))
+	}
+	return
+}
+
+// GetChainHeight returns the height of the last block we ingested for a coin, or 0 if we haven't
+// ingested any blocks yet
+func (server *OpencxServer) GetChainHeight(coinType *coinparam.Params) (height uint64) {
+	server.blockHashMtx.Lock()
+	for h := range server.blockHashes[coinType] {
+		if h > height {
+			height = h
+		}
+	}
+	server.blockHashMtx.Unlock()
+	return
+}
+
+// rollbackOrphanedDeposits removes the deposits from orphaned blocks, and reverses any of those
+// deposits that were already credited to users. If a reversal can't be applied, for example because
+// the user already withdrew the funds, we raise an alert instead.
+func (server *OpencxServer) rollbackOrphanedDeposits(orphanedHashes []string, coinType *coinparam.Params) (err error) {
+	server.dbLock.Lock()
+	// First get the correct deposit store, settlement engine, and settlement store
+	var currDepositStore cxdb.DepositStore
+	var ok bool
+	if currDepositStore, ok = server.DepositStores[coinType]; !ok {
+		err = fmt.Errorf("Could not find deposit store for cointype %s", coinType.Name)
+		server.dbLock.Unlock()
+		return
+	}
+
+	var currSettleEngine match.SettlementEngine
+	if currSettleEngine, ok = server.SettlementEngines[coinType]; !ok {
+		err = fmt.Errorf("Could not find settlement engine for cointype %s", coinType.Name)
+		server.dbLock.Unlock()
+		return
+	}
+
+	var reorgExecs []*match.SettlementExecution
+	if reorgExecs, err = currDepositStore.RollbackDeposits(orphanedHashes); err != nil {
+		err = fmt.Errorf("Error rolling back deposits for rollbackOrphanedDeposits: %s", err)
+		server.dbLock.Unlock()
+		return
+	}
+
+	var settlementResults []*match.SettlementResult
+	for _, setExec := range reorgExecs {
+		// We always check validity first
+		var valid bool
+		if valid, err = currSettleEngine.CheckValid(setExec); err != nil {
+			err = fmt.Errorf("Error checking exec validity for rollbackOrphanedDeposits: %s", err)
+			server.dbLock.Unlock()
+			return
+		}
+
+		if !valid {
+			server.raiseAlert("Could not reverse reorged %s deposit of %d for pubkey %x, balance is too low", coinType.Name, setExec.Amount, setExec.Pubkey)
+			continue
+		}
+
+		var setRes *match.SettlementResult
+		if setRes, err = currSettleEngine.ApplySettlementExecution(setExec); err != nil {
+			err = fmt.Errorf("Error applying settlement exec for rollbackOrphanedDeposits: %s", err)
+			server.dbLock.Unlock()
+			return
+		}
+		logging.Infof("Reversed reorged %s deposit of %d for pubkey %x", coinType.Name, setExec.Amount, setExec.Pubkey)
+		settlementResults = append(settlementResults, setRes)
+	}
+
+	if err = server.queueReadUpdate(&readUpdate{settlementResults: settlementResults}); err != nil {
+		err = fmt.Errorf("Error updating balances for rollbackOrphanedDeposits: %s", err)
+		server.dbLock.Unlock()
+		return
+	}
+	server.dbLock.Unlock()
+	return
+}
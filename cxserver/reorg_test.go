@@ -0,0 +1,191 @@
+package cxserver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mit-dci/lit/btcutil/chaincfg/chainhash"
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/lit/wire"
+	util "github.com/mit-dci/opencx/chainutils"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/cxdb/cxdbmemory"
+	"github.com/mit-dci/opencx/match"
+)
+
+const (
+	// testReorgHeight is the height of the block with the deposit in it
+	testReorgHeight = uint64(100)
+	// testReorgAmount is how much the deposit is for
+	testReorgAmount = uint64(100000)
+)
+
+// testBlock makes a block on top of the parent with the transactions in it. The nonce makes
+// competing blocks with the same parent have different hashes.
+func testBlock(parent chainhash.Hash, nonce uint32, txs ...*wire.MsgTx) (block *wire.MsgBlock) {
+	block = wire.NewMsgBlock(&wire.BlockHeader{PrevBlock: parent, Nonce: nonce})
+	for _, tx := range txs {
+		block.AddTransaction(tx)
+	}
+	return
+}
+
+// creditTestDeposit creates a server with memory stores, ingests a block paying a deposit to a
+// user, then ingests enough blocks on top of it for the deposit to be credited. It returns the
+// block the deposit was in.
+func creditTestDeposit(t *testing.T, coin *coinparam.Params) (server *OpencxServer, pubkey *koblitz.PublicKey, depositBlock *wire.MsgBlock) {
+	var err error
+
+	var depositStore cxdb.DepositStore
+	if depositStore, err = cxdbmemory.CreateDepositStore(coin); err != nil {
+		t.Fatalf("Error creating deposit store: %s", err)
+	}
+	var setEngine match.SettlementEngine
+	if setEngine, err = cxdbmemory.CreateSettlementEngine(coin); err != nil {
+		t.Fatalf("Error creating settlement engine: %s", err)
+	}
+	var settleStore cxdb.SettlementStore
+	if settleStore, err = cxdbmemory.CreateSettlementStore(coin); err != nil {
+		t.Fatalf("Error creating settlement store: %s", err)
+	}
+
+	setEngines := map[*coinparam.Params]match.SettlementEngine{coin: setEngine}
+	depositStores := map[*coinparam.Params]cxdb.DepositStore{coin: depositStore}
+	settleStores := map[*coinparam.Params]cxdb.SettlementStore{coin: settleStore}
+	if server, err = InitServer(setEngines, nil, nil, depositStores, settleStores, ""); err != nil {
+		t.Fatalf("Error initializing server: %s", err)
+	}
+
+	var pkh [20]byte
+	pubkey, pkh = testPKH(t)
+	var addr string
+	if addr, err = util.AddressFromPKH(pkh, util.P2WPKHAddress, coin); err != nil {
+		t.Fatalf("Error creating deposit address: %s", err)
+	}
+	if err = depositStore.RegisterUser(pubkey, addr); err != nil {
+		t.Fatalf("Error registering user: %s", err)
+	}
+
+	depositTx := wire.NewMsgTx()
+	depositTx.AddTxOut(wire.NewTxOut(int64(testReorgAmount), p2wpkhScript(pkh)))
+	depositBlock = testBlock(chainhash.Hash{}, 0, depositTx)
+	server.CallIngest(int32(testReorgHeight), depositBlock, coin)
+
+	// the deposit is credited once it has enough confirmations
+	parent := depositBlock.Header.BlockHash()
+	for height := testReorgHeight + 1; height <= testReorgHeight+6; height++ {
+		block := testBlock(parent, 0)
+		server.CallIngest(int32(height), block, coin)
+		parent = block.Header.BlockHash()
+	}
+	server.waitForProjection()
+
+	var balance uint64
+	if balance, _, err = server.GetBalance(pubkey, coin, nil); err != nil {
+		t.Fatalf("Error getting balance: %s", err)
+	}
+	if balance != testReorgAmount {
+		t.Fatalf("Deposit of %d should have been credited, balance is %d", testReorgAmount, balance)
+	}
+	return
+}
+
+func TestReorgReversesCreditedDeposit(t *testing.T) {
+	var err error
+
+	coin := &coinparam.RegressionNetParams
+	server, pubkey, depositBlock := creditTestDeposit(t, coin)
+
+	// a competing block at the same height orphans the deposit's block, and everything on top of it
+	competing := testBlock(depositBlock.Header.PrevBlock, 1)
+	server.CallIngest(int32(testReorgHeight), competing, coin)
+	server.waitForProjection()
+
+	var balance uint64
+	if balance, _, err = server.GetBalance(pubkey, coin, nil); err != nil {
+		t.Errorf("Error getting balance: %s", err)
+		return
+	}
+	if balance != 0 {
+		t.Errorf("Reorged deposit should have been taken back out of the balance, balance is %d", balance)
+		return
+	}
+
+	var history []*match.Deposit
+	if history, err = server.DepositStores[coin].GetDepositHistory(pubkey); err != nil {
+		t.Errorf("Error getting deposit history: %s", err)
+		return
+	}
+	if len(history) != 0 {
+		t.Errorf("Reorged deposit should have been removed, still have %d deposits", len(history))
+		return
+	}
+
+	if height := server.GetChainHeight(coin); height != testReorgHeight {
+		t.Errorf("Chain height should be back at %d after the reorg, got %d", testReorgHeight, height)
+		return
+	}
+
+	if alerts := server.GetAlerts(); len(alerts) != 0 {
+		t.Errorf("Reversing a deposit the user still has should not raise an alert, got %d alerts", len(alerts))
+		return
+	}
+
+	return
+}
+
+func TestReorgAlertsWhenReversalOverdraws(t *testing.T) {
+	var err error
+
+	coin := &coinparam.RegressionNetParams
+	server, pubkey, depositBlock := creditTestDeposit(t, coin)
+
+	var asset match.Asset
+	if asset, err = match.AssetFromCoinParam(coin); err != nil {
+		t.Errorf("Error getting asset: %s", err)
+		return
+	}
+
+	// the user withdraws most of the deposit before the reorg
+	withdrawal := &match.SettlementExecution{
+		Amount:    testReorgAmount - 1000,
+		Asset:     asset,
+		Type:      match.Credit,
+		Reason:    match.ReasonWithdrawal,
+		Reference: "reorgwithdrawal",
+	}
+	copy(withdrawal.Pubkey[:], pubkey.SerializeCompressed())
+	var setRes *match.SettlementResult
+	if setRes, err = server.SettlementEngines[coin].ApplySettlementExecution(withdrawal); err != nil {
+		t.Errorf("Error applying withdrawal: %s", err)
+		return
+	}
+	if err = server.SettlementStores[coin].UpdateBalances([]*match.SettlementResult{setRes}); err != nil {
+		t.Errorf("Error updating balances for withdrawal: %s", err)
+		return
+	}
+
+	competing := testBlock(depositBlock.Header.PrevBlock, 1)
+	server.CallIngest(int32(testReorgHeight), competing, coin)
+	server.waitForProjection()
+
+	// the reversal can't be applied, so the balance is left alone and an operator is told
+	var balance uint64
+	if balance, _, err = server.GetBalance(pubkey, coin, nil); err != nil {
+		t.Errorf("Error getting balance: %s", err)
+		return
+	}
+	if balance != 1000 {
+		t.Errorf("Reversal that would overdraw should not be applied, expected balance 1000 but got %d", balance)
+		return
+	}
+
+	alerts := server.GetAlerts()
+	if len(alerts) != 1 || !strings.Contains(alerts[0].Message, "Could not reverse") {
+		t.Errorf("Expected one alert for the reversal that would overdraw, got %d alerts", len(alerts))
+		return
+	}
+
+	return
+}
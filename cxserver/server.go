@@ -17,6 +17,8 @@ import (
 	"github.com/mit-dci/lit/wallit"
 	"github.com/mit-dci/lit/wire"
 
+	util "github.com/mit-dci/opencx/chainutils"
+	"github.com/mit-dci/opencx/crypto/liabilities"
 	"github.com/mit-dci/opencx/cxdb"
 	"github.com/mit-dci/opencx/logging"
 	"github.com/mit-dci/opencx/match"
@@ -26,21 +28,46 @@ import (
 // The Server looks spookily like a node.
 type OpencxServer struct {
 	SettlementEngines map[*coinparam.Params]match.SettlementEngine
-	MatchingEngines   map[match.Pair]match.LimitEngine
-	Orderbooks        map[match.Pair]match.LimitOrderbook
-	DepositStores     map[*coinparam.Params]cxdb.DepositStore
-	SettlementStores  map[*coinparam.Params]cxdb.SettlementStore
-	dbLock            *sync.Mutex
+	// BatchSettlementEngine applies every settlement execution from a match at once
+	BatchSettlementEngine match.BatchSettlementEngine
+	MatchingEngines       map[match.Pair]match.LimitEngine
+	Orderbooks            map[match.Pair]match.LimitOrderbook
+	DepositStores         map[*coinparam.Params]cxdb.DepositStore
+	SettlementStores      map[*coinparam.Params]cxdb.SettlementStore
+	LedgerStores          map[*coinparam.Params]cxdb.LedgerStore
+	dbLock                *sync.Mutex
+
+	// updates to the orderbooks and settlement stores that haven't been applied yet, and whether
+	// or not they're applied by another goroutine
+	readUpdates    []*readUpdate
+	projecting     bool
+	projectionMtx  *sync.Mutex
+	projectionCond *sync.Cond
+
+	// handlers that are called with every update once it's applied
+	updateHandlers []UpdateHandler
+	updateMtx      *sync.Mutex
 
 	registrationString string
 	getOrdersString    string
 
 	ExchangeNode *qln.LitNode
+	// Lightning is what the server uses for channels, pushes and HTLCs. SetupLitNode makes this
+	// use ExchangeNode.
+	Lightning LightningBackend
 
 	BlockChanMap       map[int]chan *wire.MsgBlock
 	HeightEventChanMap map[int]chan lnutil.HeightEvent
 	ingestMutex        sync.Mutex
 
+	// recent block hashes for each coin, by height, so we can detect reorgs
+	blockHashes  map[*coinparam.Params]map[uint64]string
+	blockHashMtx *sync.Mutex
+
+	// alerts that an operator should look at
+	alerts   []*Alert
+	alertMtx *sync.Mutex
+
 	OpencxRoot string
 
 	// All you should need to add a new coin to the exchange is the correct coin params to connect
@@ -51,6 +78,53 @@ type OpencxServer struct {
 	walletMtx  *sync.Mutex
 	PrivKeyMap map[*coinparam.Params]*hdkeychain.ExtendedKey
 	privKeyMtx *sync.Mutex
+	// the key the exchange signs things it publishes with, guarded by the private key mutex
+	identityKey *koblitz.PrivateKey
+
+	// the type of deposit address we give out for each coin, guarded by the wallet mutex
+	depositAddrTypes map[*coinparam.Params]util.AddressType
+	// the xpubs we derive deposit addresses from, for coins whose deposits are kept offline. Also
+	// guarded by the wallet mutex
+	depositXpubs map[*coinparam.Params]*hdkeychain.ExtendedKey
+
+	// hot wallet policies for each coin, whether or not we've already asked for a refill, and the
+	// history of sweeps from the hot wallet to cold storage
+	hotWalletPolicies map[*coinparam.Params]*HotWalletPolicy
+	refillAlerted     map[*coinparam.Params]bool
+	hotColdSweeps     []*HotColdSweep
+	hotColdMtx        *sync.Mutex
+
+	// the merkle sum tree for each asset from the latest liability snapshot, and every published
+	// snapshot
+	liabilityTrees     map[match.Asset]*liabilities.Tree
+	liabilitySnapshots []*liabilities.Snapshot
+	liabilityMtx       *sync.Mutex
+
+	// how big the shortfall for each coin can get before withdrawals are halted, which coins have
+	// halted withdrawals, withdrawals taken out of balances that haven't been sent yet, and every
+	// reconciliation report
+	reconcileThresholds   map[*coinparam.Params]uint64
+	withdrawalsHalted     map[*coinparam.Params]bool
+	inFlightWithdrawals   map[*coinparam.Params]uint64
+	reconciliationReports []*ReconciliationReport
+	reconcileMtx          *sync.Mutex
+
+	// the most of each coin an account can transfer in a day, the last nonce used by each account,
+	// and every transfer between accounts, also indexed by sender
+	transferLimits map[*coinparam.Params]uint64
+	transferNonces map[[33]byte]uint64
+	transfers      []*TransferRecord
+	transfersFrom  map[[33]byte][]*TransferRecord
+	transferMtx    *sync.Mutex
+
+	// atomic swaps that settle fills for swap orders, by the hash they're locked with
+	swaps   map[[32]byte]*PendingSwap
+	swapMtx *sync.Mutex
+
+	// the pubkey that can call admin commands, and the nonce of the last admin command
+	adminPubkey *koblitz.PublicKey
+	adminNonce  uint64
+	adminMtx    *sync.Mutex
 
 	// default Capacity is the default capacity that we send back to people.
 	// remove this when we have some sense of how much money the exchange has and/or some fancy
@@ -60,25 +134,58 @@ type OpencxServer struct {
 
 // InitServer creates a new server
 func InitServer(setEngines map[*coinparam.Params]match.SettlementEngine, matchEngines map[match.Pair]match.LimitEngine, books map[match.Pair]match.LimitOrderbook, depositStores map[*coinparam.Params]cxdb.DepositStore, settleStores map[*coinparam.Params]cxdb.SettlementStore, rootDir string) (server *OpencxServer, err error) {
+	projectionMtx := new(sync.Mutex)
 	server = &OpencxServer{
 		SettlementEngines: setEngines,
 		MatchingEngines:   matchEngines,
 		Orderbooks:        books,
 		DepositStores:     depositStores,
 		SettlementStores:  settleStores,
+		LedgerStores:      make(map[*coinparam.Params]cxdb.LedgerStore),
 		dbLock:            new(sync.Mutex),
 		OpencxRoot:        rootDir,
 
+		projectionMtx:  projectionMtx,
+		projectionCond: sync.NewCond(projectionMtx),
+		updateMtx:      new(sync.Mutex),
+
 		registrationString: "opencx-register",
 		getOrdersString:    "opencx-getorders",
 		ingestMutex:        *new(sync.Mutex),
 		BlockChanMap:       make(map[int]chan *wire.MsgBlock),
 		HeightEventChanMap: make(map[int]chan lnutil.HeightEvent),
+		blockHashes:        make(map[*coinparam.Params]map[uint64]string),
+		blockHashMtx:       new(sync.Mutex),
+		alertMtx:           new(sync.Mutex),
 
 		HookMap:    make(map[*coinparam.Params]*uspv.ChainHook),
 		WalletMap:  make(map[*coinparam.Params]*wallit.Wallit),
 		PrivKeyMap: make(map[*coinparam.Params]*hdkeychain.ExtendedKey),
 
+		depositAddrTypes: make(map[*coinparam.Params]util.AddressType),
+		depositXpubs:     make(map[*coinparam.Params]*hdkeychain.ExtendedKey),
+		adminMtx:         new(sync.Mutex),
+
+		hotWalletPolicies: make(map[*coinparam.Params]*HotWalletPolicy),
+		refillAlerted:     make(map[*coinparam.Params]bool),
+		hotColdMtx:        new(sync.Mutex),
+
+		liabilityTrees: make(map[match.Asset]*liabilities.Tree),
+		liabilityMtx:   new(sync.Mutex),
+
+		reconcileThresholds: make(map[*coinparam.Params]uint64),
+		withdrawalsHalted:   make(map[*coinparam.Params]bool),
+		inFlightWithdrawals: make(map[*coinparam.Params]uint64),
+		reconcileMtx:        new(sync.Mutex),
+
+		transferLimits: make(map[*coinparam.Params]uint64),
+		transferNonces: make(map[[33]byte]uint64),
+		transfersFrom:  make(map[[33]byte][]*TransferRecord),
+		transferMtx:    new(sync.Mutex),
+
+		swaps:   make(map[[32]byte]*PendingSwap),
+		swapMtx: new(sync.Mutex),
+
 		hookMtx:    new(sync.Mutex),
 		walletMtx:  new(sync.Mutex),
 		privKeyMtx: new(sync.Mutex),
@@ -86,6 +193,28 @@ func InitServer(setEngines map[*coinparam.Params]match.SettlementEngine, matchEn
 		defaultCapacity: 1000000,
 	}
 
+	// By default settle batches by checking and applying on each settlement engine. Engines that
+	// keep balances should have a real batch engine set with SetBatchSettlementEngine.
+	if server.BatchSettlementEngine, err = match.NewCheckedBatchEngineFromCoins(setEngines); err != nil {
+		err = fmt.Errorf("Error creating batch settlement engine for InitServer: %s", err)
+		return
+	}
+
+	return
+}
+
+// SetBatchSettlementEngine sets the engine that applies the settlement executions from each match
+// together, so a trade is settled for every asset or none of them.
+func (server *OpencxServer) SetBatchSettlementEngine(batchEngine match.BatchSettlementEngine) {
+	server.dbLock.Lock()
+	server.BatchSettlementEngine = batchEngine
+	server.dbLock.Unlock()
+	return
+}
+
+// SetLightningBackend sets what the server uses for lightning, without needing a lit node
+func (server *OpencxServer) SetLightningBackend(backend LightningBackend) {
+	server.Lightning = backend
 	return
 }
 
@@ -0,0 +1,88 @@
+package cxserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mit-dci/opencx/cxdb/cxdbsnapshot"
+)
+
+// TakeSnapshot takes a consistent snapshot of the orderbooks, order archives, balances, ledger,
+// deposits, and transfers. The transfer lock and db lock are held the whole time, so nothing can be
+// written while the snapshot is taken, and the orderbooks and balances are caught up first.
+func (server *OpencxServer) TakeSnapshot() (snap *cxdbsnapshot.Snapshot, err error) {
+	// transfers take the transfer lock before the db lock, so we do too
+	server.transferMtx.Lock()
+	defer server.transferMtx.Unlock()
+	server.dbLock.Lock()
+	defer server.dbLock.Unlock()
+	server.waitForProjection()
+
+	stores := &cxdbsnapshot.Stores{
+		LimitEngines:      server.MatchingEngines,
+		LimitOrderbooks:   server.Orderbooks,
+		SettlementEngines: server.SettlementEngines,
+		SettlementStores:  server.SettlementStores,
+		DepositStores:     server.DepositStores,
+		LedgerStores:      server.LedgerStores,
+	}
+
+	if snap, err = cxdbsnapshot.Take(stores); err != nil {
+		err = fmt.Errorf("Error taking snapshot for TakeSnapshot: %s", err)
+		return
+	}
+	snap.Transfers = server.snapshotTransfers()
+
+	return
+}
+
+// SnapshotTransfers returns every transfer the server has loaded, oldest first, for a snapshot
+func (server *OpencxServer) SnapshotTransfers() (transfers []*cxdbsnapshot.TransferSnapshot) {
+	server.transferMtx.Lock()
+	transfers = server.snapshotTransfers()
+	server.transferMtx.Unlock()
+	return
+}
+
+// snapshotTransfers returns every transfer, oldest first. This assumes the transfer lock is held.
+func (server *OpencxServer) snapshotTransfers() (transfers []*cxdbsnapshot.TransferSnapshot) {
+	for _, record := range server.transfers {
+		transfers = append(transfers, &cxdbsnapshot.TransferSnapshot{
+			Transfer: record.Transfer,
+			Time:     record.Time,
+		})
+	}
+	return
+}
+
+// RestoreTransfers writes the transfers from a snapshot to the transfer file in the root directory,
+// so LoadTransfers loads them. Like the stores a snapshot is restored into, there can't be a
+// transfer file already.
+func (server *OpencxServer) RestoreTransfers(transfers []*cxdbsnapshot.TransferSnapshot) (err error) {
+	if server.OpencxRoot == "" {
+		err = fmt.Errorf("No root directory to restore transfers into")
+		return
+	}
+
+	server.transferMtx.Lock()
+	defer server.transferMtx.Unlock()
+
+	transferPath := filepath.Join(server.OpencxRoot, transferFileName)
+	if _, err = os.Stat(transferPath); err == nil {
+		err = fmt.Errorf("Transfer file %s already exists, can only restore transfers without one", transferPath)
+		return
+	} else if !os.IsNotExist(err) {
+		err = fmt.Errorf("Error checking for transfer file for RestoreTransfers: %s", err)
+		return
+	}
+	err = nil
+
+	for _, transfer := range transfers {
+		if err = server.recordTransfer(&TransferRecord{Transfer: transfer.Transfer, Time: transfer.Time}); err != nil {
+			err = fmt.Errorf("Error restoring transfer for RestoreTransfers: %s", err)
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,583 @@
+package cxserver
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/fastsha256"
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/consts"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/logging"
+	"github.com/mit-dci/opencx/match"
+)
+
+// swapFileName is the file in the opencx root directory that swaps are appended to every time they
+// change, one JSON record per line. The last record for a hash is the current one.
+const swapFileName = "swaps.json"
+
+// swapLocktimeDelta is how many blocks a user has to offer their side of a swap before we take our
+// HTLC back. Users should lock their HTLC for less than this, so they can still claim ours after we
+// claim theirs.
+const swapLocktimeDelta = 144
+
+// swapMinClaimBlocks is the fewest blocks a user's HTLC for a swap can have left before it times
+// out when we get it, so we have time to claim it on chain if they don't let us claim it in the
+// channel.
+const swapMinClaimBlocks = 6
+
+// swapClaimTime is how long before our HTLC for a swap times out that the user's has to time out.
+// We claim theirs before it times out, so this is how long they have left to claim ours with the
+// preimage.
+const swapClaimTime = time.Hour
+
+// SwapState is how far along a swap is
+type SwapState uint8
+
+const (
+	// SwapOffered means we've offered our HTLC and are waiting for the user to offer theirs
+	SwapOffered SwapState = iota
+	// SwapComplete means we've claimed the user's HTLC, which gives them the preimage to claim ours
+	SwapComplete
+	// SwapRefunded means the user didn't pay in time and we took our HTLC back
+	SwapRefunded
+)
+
+// String returns the string representation of a swap state
+func (ss SwapState) String() string {
+	switch ss {
+	case SwapOffered:
+		return "offered"
+	case SwapComplete:
+		return "complete"
+	case SwapRefunded:
+		return "refunded"
+	}
+	return "unknown"
+}
+
+// SwapHTLC is an HTLC that a user offered us for a swap, by channel and index in the channel
+type SwapHTLC struct {
+	ChanIdx uint32 `json:"chanidx"`
+	Idx     uint32 `json:"idx"`
+}
+
+// PendingSwap is an atomic swap that settles a fill for a swap order. We offer the user an HTLC
+// for what they receive, locked with the hash of a preimage only we know. The user offers us an
+// HTLC for what they pay, locked with the same hash. Claiming theirs reveals the preimage, which
+// they use to claim ours. If they don't pay before Locktime we take ours back.
+type PendingSwap struct {
+	Instruction *match.SwapInstruction `json:"instruction"`
+	RHash       [32]byte               `json:"rhash"`
+	// R is the preimage of RHash. It's kept so the swap can still be claimed after a restart.
+	R [16]byte `json:"r"`
+	// Locktime is the height on the chain of the asset the user receives that our HTLC times out at
+	Locktime uint32    `json:"locktime"`
+	State    SwapState `json:"state"`
+	// Received is how much the user has offered us in HTLCs locked with RHash
+	Received uint64     `json:"received"`
+	HTLCs    []SwapHTLC `json:"htlcs"`
+}
+
+// receivedHTLC returns true if we've already counted an HTLC towards this swap
+func (ps *PendingSwap) receivedHTLC(htlc SwapHTLC) (received bool) {
+	for _, swapHTLC := range ps.HTLCs {
+		if swapHTLC == htlc {
+			received = true
+			return
+		}
+	}
+	return
+}
+
+// checkSwapChannels makes sure that a swap order can be settled over lightning. We have to be
+// connected to the user, and they have to have enough in channels with us to pay for the order on
+// top of their other open swap orders and the swaps they haven't paid for yet. This assumes dbLock
+// is held and the projection has caught up, so every open order is in the orderbooks.
+func (server *OpencxServer) checkSwapChannels(order *match.LimitOrder) (err error) {
+
+	if server.Lightning == nil {
+		err = fmt.Errorf("No lightning backend set up, can't place swap orders")
+		return
+	}
+
+	var pubkey *koblitz.PublicKey
+	if pubkey, err = koblitz.ParsePubKey(order.Pubkey[:], koblitz.S256()); err != nil {
+		err = fmt.Errorf("Error parsing pubkey for checkSwapChannels: %s", err)
+		return
+	}
+
+	var peerIdx uint32
+	if peerIdx, err = server.GetPeerFromPubkey(pubkey); err != nil {
+		err = fmt.Errorf("You have to be connected to the exchange over lightning to place swap orders: %s", err)
+		return
+	}
+
+	if !server.Lightning.ConnectedToPeer(peerIdx) {
+		err = fmt.Errorf("Not connected to peer! Please connect to the exchange before placing swap orders")
+		return
+	}
+
+	var payParam *coinparam.Params
+	if payParam, err = heldAsset(order).CoinParamFromAsset(); err != nil {
+		err = fmt.Errorf("Error getting coin param for checkSwapChannels: %s", err)
+		return
+	}
+
+	var channels []*LightningChannel
+	if channels, err = server.Lightning.ListChannels(); err != nil {
+		err = fmt.Errorf("Error getting channels for checkSwapChannels: %s", err)
+		return
+	}
+
+	var theirCap uint64
+	for _, channel := range channels {
+		if channel.PeerIdx == peerIdx && channel.CoinType == payParam.HDCoinType && channel.TheirAmt-consts.MinOutput > 0 {
+			theirCap += uint64(channel.TheirAmt - consts.MinOutput)
+		}
+	}
+
+	var reserved uint64
+	if reserved, err = server.swapReserved(pubkey, heldAsset(order)); err != nil {
+		err = fmt.Errorf("Error getting reserved amount for checkSwapChannels: %s", err)
+		return
+	}
+
+	if theirCap < reserved || theirCap-reserved < order.AmountHave {
+		err = fmt.Errorf("You can only send %d %s over your channels with the exchange and %d of it is for your other swaps, not enough for a swap order of %d", theirCap, payParam.Name, reserved, order.AmountHave)
+		return
+	}
+	return
+}
+
+// swapReserved is how much of an asset a pubkey still has to pay over lightning, for its open swap
+// orders and for the swaps it hasn't finished paying for. This assumes dbLock is held.
+func (server *OpencxServer) swapReserved(pubkey *koblitz.PublicKey, asset match.Asset) (reserved uint64, err error) {
+	var currOrderMap map[float64][]*match.LimitOrderIDPair
+	for _, currOrderbook := range server.Orderbooks {
+		// channels aren't per sub-account, so this is every sub-account's orders
+		if currOrderMap, err = currOrderbook.GetOrdersForPubkey(pubkey, nil); err != nil {
+			err = fmt.Errorf("Error getting orders for pubkey for swapReserved: %s", err)
+			return
+		}
+
+		for _, orders := range currOrderMap {
+			for _, order := range orders {
+				if order.Order.Swap && heldAsset(order.Order) == asset {
+					reserved += order.Order.AmountHave
+				}
+			}
+		}
+	}
+
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	server.swapMtx.Lock()
+	for _, swap := range server.swaps {
+		if swap.State == SwapOffered && swap.Instruction.Pubkey == pubkeyBytes && swap.Instruction.PayAsset == asset && swap.Received < swap.Instruction.PayAmount {
+			reserved += swap.Instruction.PayAmount - swap.Received
+		}
+	}
+	server.swapMtx.Unlock()
+	return
+}
+
+// offerSwapHTLCs offers the user HTLCs for amount over a channel. An HTLC can't be for more than
+// fits in a uint32, so larger amounts are split over more than one.
+func (server *OpencxServer) offerSwapHTLCs(chanIdx uint32, amount uint64, swap *PendingSwap) (err error) {
+	for amount > 0 {
+		htlcAmount := amount
+		if htlcAmount > math.MaxUint32 {
+			htlcAmount = math.MaxUint32
+		}
+		if err = server.Lightning.OfferHTLC(chanIdx, uint32(htlcAmount), swap.RHash, swap.Locktime); err != nil {
+			err = fmt.Errorf("Error offering HTLC for offerSwapHTLCs: %s", err)
+			return
+		}
+		amount -= htlcAmount
+	}
+	return
+}
+
+// startSwaps creates a swap for each swap instruction from a match. The fills have already
+// happened, so a swap that can't be started is logged rather than returned.
+func (server *OpencxServer) startSwaps(instructions []*match.SwapInstruction) {
+	for _, instruction := range instructions {
+		if _, err := server.CreateSwap(instruction); err != nil {
+			logging.Errorf("Error creating swap for order %x: %s", instruction.OrderID, err)
+		}
+	}
+	return
+}
+
+// CreateSwap starts an atomic swap that settles a swap instruction from the matching engine. This
+// is the main functionality for non custodial exchange. We offer the user HTLCs for what they
+// receive, over their channels for that asset, and wait for them to offer us HTLCs with the same
+// hash for what they pay.
+func (server *OpencxServer) CreateSwap(instruction *match.SwapInstruction) (swap *PendingSwap, err error) {
+
+	if server.Lightning == nil {
+		err = fmt.Errorf("No lightning backend set up for swap")
+		return
+	}
+
+	var pubkey *koblitz.PublicKey
+	if pubkey, err = koblitz.ParsePubKey(instruction.Pubkey[:], koblitz.S256()); err != nil {
+		err = fmt.Errorf("Error parsing pubkey for swap: %s", err)
+		return
+	}
+
+	var receiveParam *coinparam.Params
+	if receiveParam, err = instruction.ReceiveAsset.CoinParamFromAsset(); err != nil {
+		err = fmt.Errorf("Error getting receive coin for swap: %s", err)
+		return
+	}
+
+	// get all the channels
+	var channels []*LightningChannel
+	if channels, err = server.Lightning.ListChannels(); err != nil {
+		err = fmt.Errorf("Error getting channels for swap: %s", err)
+		return
+	}
+
+	// TODO: do something else to manage peer stuff. We need an identity key to be
+	// associated with a channel somehow, but right now we're just using peers
+
+	// Get this pubkey's peer index.
+	var thisPeer uint32
+	if thisPeer, err = server.Lightning.GetPeerIdx(pubkey); err != nil {
+		err = fmt.Errorf("Error getting peer for swap: %s", err)
+		return
+	}
+
+	// This is what we're doing to say "does the pubkey match?", the pubkey that gives commands
+	// does not have to be the pubkey for the channel. There can be multiple channels, each with
+	// different channel pubkeys, that belong to the same user, so the identity key is what we use.
+	// Count only the coins we would be able to send.
+	var receiveChannels []*LightningChannel
+	for _, channel := range channels {
+		if channel.PeerIdx == thisPeer && channel.CoinType == receiveParam.HDCoinType && channel.MyAmt-consts.MinOutput > 0 {
+			receiveChannels = append(receiveChannels, channel)
+		}
+	}
+
+	// Let's sort the channels according to what we can send, lowest first
+	sort.Slice(receiveChannels, func(i, j int) bool {
+		return receiveChannels[i].MyAmt < receiveChannels[j].MyAmt
+	})
+
+	var height int32
+	if height, err = server.Lightning.CurrentHeight(receiveParam.HDCoinType); err != nil {
+		err = fmt.Errorf("Error getting height for swap: %s", err)
+		return
+	}
+
+	swap = &PendingSwap{
+		Instruction: instruction,
+		Locktime:    uint32(height) + swapLocktimeDelta,
+		State:       SwapOffered,
+	}
+	if _, err = rand.Read(swap.R[:]); err != nil {
+		err = fmt.Errorf("Error reading random bytes into preimage: %s", err)
+		return
+	}
+	swap.RHash = fastsha256.Sum256(swap.R[:])
+
+	// Keep track of the swap before offering anything, so we know the hash when their HTLC comes in
+	if err = server.recordSwap(swap); err != nil {
+		err = fmt.Errorf("Error recording swap: %s", err)
+		return
+	}
+
+	// Use the channels we have, saving the largest for last, and if we have anything left
+	// we'll then create a new channel and offer the rest over it.
+	amountRemaining := instruction.ReceiveAmount
+	for i := 0; amountRemaining > 0 && i < len(receiveChannels); i++ {
+		// send as much as we can, without bringing our output below the minoutput
+		avail := uint64(receiveChannels[i].MyAmt - consts.MinOutput)
+		if avail > amountRemaining {
+			avail = amountRemaining
+		}
+		if err = server.offerSwapHTLCs(receiveChannels[i].Idx, avail, swap); err != nil {
+			err = fmt.Errorf("Error offering HTLC for atomic swap: %s", err)
+			return
+		}
+		amountRemaining -= avail
+	}
+
+	// if we still have some left at this point, set up a funding transaction and
+	// offer just enough in an HTLC for this swap to work.
+	if amountRemaining > 0 {
+		var fee int64
+		if fee, err = server.Lightning.Fee(receiveParam.HDCoinType); err != nil {
+			err = fmt.Errorf("Error getting fee for final send: %s", err)
+			return
+		}
+		fee *= 1000
+
+		// we add the min output because when we send, we'll need some left on our side.
+		desiredChannelCapacity := uint64(consts.MinOutput) + amountRemaining + uint64(fee)
+		if desiredChannelCapacity < uint64(consts.MinChanCapacity) {
+			desiredChannelCapacity = uint64(consts.MinChanCapacity)
+		}
+
+		var newChanIdx uint32
+		if newChanIdx, err = server.Lightning.FundChannel(thisPeer, receiveParam.HDCoinType, int64(desiredChannelCapacity), 0); err != nil {
+			err = fmt.Errorf("Could not fund channel for final send: %s", err)
+			return
+		}
+
+		if err = server.offerSwapHTLCs(newChanIdx, amountRemaining, swap); err != nil {
+			err = fmt.Errorf("Error offering final send HTLC for atomic swap: %s", err)
+			return
+		}
+	}
+
+	logging.Infof("Offered %d %s for swap %x, waiting for %d %s", instruction.ReceiveAmount, instruction.ReceiveAsset, swap.RHash, instruction.PayAmount, instruction.PayAsset)
+	return
+}
+
+// ingestSwapHTLC counts an HTLC that a user offered us towards the swap locked with the same hash.
+// Once the user has offered everything they pay, we claim their HTLCs, which reveals the preimage
+// they need to claim ours. The locktime is when the user's HTLC times out, on the chain of the coin
+// they pay.
+func (server *OpencxServer) ingestSwapHTLC(rHash [32]byte, pubkey *koblitz.PublicKey, coinType uint32, chanIdx uint32, htlcIdx uint32, amount uint64, locktime uint32) (err error) {
+
+	server.swapMtx.Lock()
+	defer server.swapMtx.Unlock()
+
+	var swap *PendingSwap
+	var ok bool
+	if swap, ok = server.swaps[rHash]; !ok {
+		// not every HTLC is for a swap
+		return
+	}
+
+	if swap.State != SwapOffered {
+		return
+	}
+
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+	if pubkeyBytes != swap.Instruction.Pubkey {
+		err = fmt.Errorf("HTLC for swap %x offered by %x, not the user in the swap", rHash, pubkeyBytes)
+		return
+	}
+
+	var payParam *coinparam.Params
+	if payParam, err = swap.Instruction.PayAsset.CoinParamFromAsset(); err != nil {
+		err = fmt.Errorf("Error getting pay coin for ingestSwapHTLC: %s", err)
+		return
+	}
+
+	if payParam.HDCoinType != coinType {
+		err = fmt.Errorf("HTLC for swap %x is on coin %d, should be %s", rHash, coinType, payParam.Name)
+		return
+	}
+
+	htlc := SwapHTLC{ChanIdx: chanIdx, Idx: htlcIdx}
+	if swap.receivedHTLC(htlc) {
+		return
+	}
+
+	if err = server.checkSwapLocktime(swap, payParam, locktime); err != nil {
+		err = fmt.Errorf("HTLC for swap %x can't be accepted: %s", rHash, err)
+		return
+	}
+	swap.HTLCs = append(swap.HTLCs, htlc)
+	swap.Received += amount
+
+	if swap.Received >= swap.Instruction.PayAmount {
+		if err = server.Lightning.ClaimHTLC(swap.R); err != nil {
+			err = fmt.Errorf("Error claiming HTLC for ingestSwapHTLC: %s", err)
+			return
+		}
+		swap.State = SwapComplete
+		logging.Infof("Swap %x complete", rHash)
+	}
+
+	if err = server.writeSwap(swap); err != nil {
+		err = fmt.Errorf("Error writing swap for ingestSwapHTLC: %s", err)
+		return
+	}
+	return
+}
+
+// checkSwapLocktime makes sure an HTLC the user offered for a swap times out late enough that we can
+// claim it, and early enough before ours that they can claim ours once we do. Their HTLC is on a
+// different chain than ours, so the time each has left is compared using the block time of its chain.
+func (server *OpencxServer) checkSwapLocktime(swap *PendingSwap, payParam *coinparam.Params, locktime uint32) (err error) {
+	var receiveParam *coinparam.Params
+	if receiveParam, err = swap.Instruction.ReceiveAsset.CoinParamFromAsset(); err != nil {
+		err = fmt.Errorf("Error getting receive coin for checkSwapLocktime: %s", err)
+		return
+	}
+
+	var payHeight int32
+	if payHeight, err = server.Lightning.CurrentHeight(payParam.HDCoinType); err != nil {
+		err = fmt.Errorf("Error getting %s height for checkSwapLocktime: %s", payParam.Name, err)
+		return
+	}
+
+	var receiveHeight int32
+	if receiveHeight, err = server.Lightning.CurrentHeight(receiveParam.HDCoinType); err != nil {
+		err = fmt.Errorf("Error getting %s height for checkSwapLocktime: %s", receiveParam.Name, err)
+		return
+	}
+
+	if int64(locktime) < int64(payHeight)+swapMinClaimBlocks {
+		err = fmt.Errorf("It times out at height %d, it has to be at least %d blocks after the current height of %d", locktime, swapMinClaimBlocks, payHeight)
+		return
+	}
+
+	theirTimeLeft := time.Duration(int64(locktime)-int64(payHeight)) * payParam.TargetTimePerBlock
+	ourTimeLeft := time.Duration(int64(swap.Locktime)-int64(receiveHeight)) * receiveParam.TargetTimePerBlock
+	if theirTimeLeft+swapClaimTime > ourTimeLeft {
+		err = fmt.Errorf("It times out in about %s, it has to time out at least %s before ours, which times out in about %s", theirTimeLeft, swapClaimTime, ourTimeLeft)
+		return
+	}
+	return
+}
+
+// expireSwaps takes back our HTLCs for every swap on a coin that the user didn't pay for before
+// the locktime. This is called for every block.
+func (server *OpencxServer) expireSwaps(coinType uint32, height int32) (err error) {
+
+	if server.Lightning == nil {
+		return
+	}
+
+	server.swapMtx.Lock()
+	defer server.swapMtx.Unlock()
+
+	var expired []*PendingSwap
+	for _, swap := range server.swaps {
+		if swap.State != SwapOffered || uint32(height) < swap.Locktime {
+			continue
+		}
+
+		var receiveParam *coinparam.Params
+		if receiveParam, err = swap.Instruction.ReceiveAsset.CoinParamFromAsset(); err != nil {
+			err = fmt.Errorf("Error getting receive coin for expireSwaps: %s", err)
+			return
+		}
+		if receiveParam.HDCoinType == coinType {
+			expired = append(expired, swap)
+		}
+	}
+
+	if len(expired) == 0 {
+		return
+	}
+
+	if err = server.Lightning.ClaimHTLCTimeouts(coinType, height); err != nil {
+		err = fmt.Errorf("Error claiming HTLC timeouts for expireSwaps: %s", err)
+		return
+	}
+
+	for _, swap := range expired {
+		swap.State = SwapRefunded
+		logging.Infof("Swap %x timed out at height %d, took back our HTLC", swap.RHash, height)
+		if err = server.writeSwap(swap); err != nil {
+			err = fmt.Errorf("Error writing swap for expireSwaps: %s", err)
+			return
+		}
+	}
+	return
+}
+
+// recordSwap keeps a new swap in memory and appends it to the swap file
+func (server *OpencxServer) recordSwap(swap *PendingSwap) (err error) {
+	server.swapMtx.Lock()
+	server.swaps[swap.RHash] = swap
+	err = server.writeSwap(swap)
+	server.swapMtx.Unlock()
+	return
+}
+
+// writeSwap appends the current state of a swap to the swap file, if the server has a root
+// directory. This assumes the swap lock is held.
+func (server *OpencxServer) writeSwap(swap *PendingSwap) (err error) {
+	if server.OpencxRoot == "" {
+		return
+	}
+
+	var swapBytes []byte
+	if swapBytes, err = json.Marshal(swap); err != nil {
+		err = fmt.Errorf("Error marshalling swap for writeSwap: %s", err)
+		return
+	}
+
+	var swapFile *os.File
+	if swapFile, err = os.OpenFile(filepath.Join(server.OpencxRoot, swapFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+		err = fmt.Errorf("Error opening swap file for writeSwap: %s", err)
+		return
+	}
+	defer swapFile.Close()
+
+	if _, err = swapFile.Write(append(swapBytes, '\n')); err != nil {
+		err = fmt.Errorf("Error writing swap file for writeSwap: %s", err)
+		return
+	}
+	return
+}
+
+// LoadSwaps loads the swaps from the root directory, so swaps that were in progress before a
+// restart can still be claimed or refunded.
+func (server *OpencxServer) LoadSwaps() (err error) {
+	var swapFile *os.File
+	if swapFile, err = os.Open(filepath.Join(server.OpencxRoot, swapFileName)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer swapFile.Close()
+
+	swaps := make(map[[32]byte]*PendingSwap)
+	scanner := bufio.NewScanner(swapFile)
+	for scanner.Scan() {
+		swap := new(PendingSwap)
+		if err = json.Unmarshal(scanner.Bytes(), swap); err != nil {
+			err = fmt.Errorf("Error parsing swap file for LoadSwaps: %s", err)
+			return
+		}
+		swaps[swap.RHash] = swap
+	}
+	if err = scanner.Err(); err != nil {
+		err = fmt.Errorf("Error reading swap file for LoadSwaps: %s", err)
+		return
+	}
+
+	server.swapMtx.Lock()
+	server.swaps = swaps
+	server.swapMtx.Unlock()
+	return
+}
+
+// GetSwaps returns a copy of every swap for a pubkey. The preimage is left out, since the user
+// only gets it by paying.
+func (server *OpencxServer) GetSwaps(pubkey *koblitz.PublicKey) (swaps []*PendingSwap) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	server.swapMtx.Lock()
+	for _, swap := range server.swaps {
+		if swap.Instruction.Pubkey == pubkeyBytes {
+			swapCopy := *swap
+			swapCopy.R = [16]byte{}
+			swapCopy.HTLCs = append([]SwapHTLC(nil), swap.HTLCs...)
+			swaps = append(swaps, &swapCopy)
+		}
+	}
+	server.swapMtx.Unlock()
+	return
+}
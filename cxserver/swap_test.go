@@ -0,0 +1,381 @@
+package cxserver
+
+import (
+	"math"
+	"testing"
+
+	"github.com/btcsuite/fastsha256"
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/lit/qln"
+	"github.com/mit-dci/opencx/cxdb/cxdbmemory"
+	"github.com/mit-dci/opencx/match"
+)
+
+// createSwapTestServer creates a lightning test server for two coins and a user that's a peer of
+// the exchange, and returns a swap instruction where the user pays the first coin and receives the
+// second
+func createSwapTestServer(t *testing.T, backend *testLightningBackend) (server *OpencxServer, user *koblitz.PrivateKey, instruction *match.SwapInstruction) {
+	var err error
+
+	payCoin := &coinparam.RegressionNetParams
+	receiveCoin := &coinparam.LiteRegNetParams
+	backend.wallets[payCoin.HDCoinType] = 10000000
+	backend.wallets[receiveCoin.HDCoinType] = 10000000
+	if server, err = createLightningTestServer([]*coinparam.Params{payCoin, receiveCoin}, backend); err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+
+	if user, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Fatalf("Error creating private key: %s", err)
+	}
+	backend.addPeer(user.PubKey(), 1)
+
+	instruction = &match.SwapInstruction{
+		PayAmount:     200000,
+		ReceiveAmount: 300000,
+	}
+	copy(instruction.Pubkey[:], user.PubKey().SerializeCompressed())
+	instruction.OrderID[0] = 1
+	if instruction.PayAsset, err = match.AssetFromCoinParam(payCoin); err != nil {
+		t.Fatalf("Error getting asset from coin param: %s", err)
+	}
+	if instruction.ReceiveAsset, err = match.AssetFromCoinParam(receiveCoin); err != nil {
+		t.Fatalf("Error getting asset from coin param: %s", err)
+	}
+	return
+}
+
+// htlcEvent is the channel update lit sends when the user offers us an HTLC
+func htlcEvent(user *koblitz.PrivateKey, channel *LightningChannel, htlcs []qln.HTLC) (event qln.ChannelStateUpdateEvent) {
+	event = qln.ChannelStateUpdateEvent{
+		Action:   "sigrev",
+		ChanIdx:  channel.Idx,
+		State:    &qln.StatCom{HTLCs: htlcs},
+		TheirPub: *user.PubKey(),
+		CoinType: channel.CoinType,
+	}
+	return
+}
+
+func TestCreateSwap(t *testing.T) {
+	var err error
+
+	backend := newTestLightningBackend(1)
+	server, user, instruction := createSwapTestServer(t, backend)
+	receiveCoin := &coinparam.LiteRegNetParams
+	backend.heights[receiveCoin.HDCoinType] = 500
+
+	// With enough in an existing channel, we only offer an HTLC
+	receiveChannel := backend.addChannel(1, receiveCoin.HDCoinType, 1000000, 0)
+	var swap *PendingSwap
+	if swap, err = server.CreateSwap(instruction); err != nil {
+		t.Errorf("Error creating swap: %s", err)
+		return
+	}
+	offered := backend.offeredHTLCs()
+	if len(offered) != 1 || offered[0].chanIdx != receiveChannel.Idx || uint64(offered[0].amount) != instruction.ReceiveAmount {
+		t.Errorf("Expected one HTLC of %d on the existing channel, got %d HTLCs", instruction.ReceiveAmount, len(offered))
+		return
+	}
+	if offered[0].rHash != fastsha256.Sum256(swap.R[:]) || offered[0].locktime != 500+swapLocktimeDelta {
+		t.Errorf("HTLC should be locked with the swap hash until height %d, got locktime %d", 500+swapLocktimeDelta, offered[0].locktime)
+		return
+	}
+	if len(backend.channels) != 1 {
+		t.Errorf("No channels should be funded when existing channels have enough, have %d channels", len(backend.channels))
+		return
+	}
+
+	// The user can see the swap, but not the preimage
+	swaps := server.GetSwaps(user.PubKey())
+	if len(swaps) != 1 || swaps[0].RHash != swap.RHash || swaps[0].State != SwapOffered {
+		t.Errorf("Expected the user to see one offered swap, got %d swaps", len(swaps))
+		return
+	}
+	if swaps[0].R != [16]byte{} {
+		t.Errorf("The preimage should not be shown to the user before they pay")
+		return
+	}
+
+	// Without any channels, we fund one to offer the HTLC over
+	backend.channels = make(map[uint32]*LightningChannel)
+	backend.htlcs = nil
+	if _, err = server.CreateSwap(instruction); err != nil {
+		t.Errorf("Error creating swap without channels: %s", err)
+		return
+	}
+	offered = backend.offeredHTLCs()
+	if len(backend.channels) != 1 || len(offered) != 1 || uint64(offered[0].amount) != instruction.ReceiveAmount {
+		t.Errorf("Expected one new channel and one HTLC, got %d channels and %d HTLCs", len(backend.channels), len(offered))
+		return
+	}
+	if backend.channels[offered[0].chanIdx].CoinType != receiveCoin.HDCoinType {
+		t.Errorf("HTLC should be offered over a channel of the coin the user receives")
+		return
+	}
+
+	// An HTLC amount is a uint32, so more than that is offered over more than one HTLC
+	backend.channels = make(map[uint32]*LightningChannel)
+	backend.htlcs = nil
+	backend.addChannel(1, receiveCoin.HDCoinType, 2*math.MaxUint32, 0)
+	largeInstruction := *instruction
+	largeInstruction.ReceiveAmount = math.MaxUint32 + 1000
+	if _, err = server.CreateSwap(&largeInstruction); err != nil {
+		t.Errorf("Error creating swap for more than a uint32: %s", err)
+		return
+	}
+	offered = backend.offeredHTLCs()
+	if len(offered) != 2 || offered[0].amount != math.MaxUint32 || offered[1].amount != 1000 {
+		t.Errorf("Expected an HTLC of %d and one of 1000, got %d HTLCs", uint32(math.MaxUint32), len(offered))
+		return
+	}
+
+	// Users we aren't peers with can't swap
+	var stranger *koblitz.PrivateKey
+	if stranger, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key: %s", err)
+		return
+	}
+	copy(instruction.Pubkey[:], stranger.PubKey().SerializeCompressed())
+	if _, err = server.CreateSwap(instruction); err == nil {
+		t.Errorf("Swap with someone who isn't a peer should fail")
+		return
+	}
+
+	return
+}
+
+func TestSwapComplete(t *testing.T) {
+	var err error
+
+	backend := newTestLightningBackend(1)
+	server, user, instruction := createSwapTestServer(t, backend)
+	payCoin := &coinparam.RegressionNetParams
+	receiveCoin := &coinparam.LiteRegNetParams
+	backend.addChannel(1, receiveCoin.HDCoinType, 1000000, 0)
+	payChannel := backend.addChannel(1, payCoin.HDCoinType, 0, 1000000)
+
+	var swap *PendingSwap
+	if swap, err = server.CreateSwap(instruction); err != nil {
+		t.Errorf("Error creating swap: %s", err)
+		return
+	}
+
+	// The user pays part of it, which isn't enough to claim
+	handler := server.GetSwapHTLCHandler()
+	firstHTLC := qln.HTLC{Idx: 0, Incoming: true, Amt: 50000, RHash: swap.RHash, Locktime: 20}
+	first := backend.receiveHTLC(payChannel.Idx, 50000, swap.RHash, 20)
+	handler(htlcEvent(user, payChannel, []qln.HTLC{firstHTLC}))
+	// lit sends the whole state every time, the same HTLC shouldn't be counted twice
+	handler(htlcEvent(user, payChannel, []qln.HTLC{firstHTLC}))
+	if first.claimed || server.GetSwaps(user.PubKey())[0].State != SwapOffered {
+		t.Errorf("Swap should not be claimed until the user offers everything they pay")
+		return
+	}
+	if received := server.GetSwaps(user.PubKey())[0].Received; received != 50000 {
+		t.Errorf("Expected 50000 received for the swap, got %d", received)
+		return
+	}
+
+	// Someone else can't pay for the user's swap
+	var stranger *koblitz.PrivateKey
+	if stranger, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key: %s", err)
+		return
+	}
+	if err = server.ingestSwapHTLC(swap.RHash, stranger.PubKey(), payCoin.HDCoinType, payChannel.Idx, 5, 150000, 20); err == nil {
+		t.Errorf("HTLC from someone other than the swap user should not be accepted")
+		return
+	}
+
+	// Our HTLC times out in 144 litecoin blocks, which is 6 hours. The user's HTLC has to leave us
+	// time to claim it, and time out an hour before ours so they can claim ours.
+	if err = server.ingestSwapHTLC(swap.RHash, user.PubKey(), payCoin.HDCoinType, payChannel.Idx, 6, 150000, swapMinClaimBlocks-1); err == nil {
+		t.Errorf("HTLC that times out too soon for us to claim should not be accepted")
+		return
+	}
+	if err = server.ingestSwapHTLC(swap.RHash, user.PubKey(), payCoin.HDCoinType, payChannel.Idx, 7, 150000, 31); err == nil {
+		t.Errorf("HTLC that times out less than an hour before ours should not be accepted")
+		return
+	}
+	if received := server.GetSwaps(user.PubKey())[0].Received; received != 50000 {
+		t.Errorf("HTLCs that weren't accepted should not be counted, got %d received", received)
+		return
+	}
+
+	// The rest comes in, so we claim it and the swap is complete
+	secondHTLC := qln.HTLC{Idx: 1, Incoming: true, Amt: 150000, RHash: swap.RHash, Locktime: 20}
+	second := backend.receiveHTLC(payChannel.Idx, 150000, swap.RHash, 20)
+	handler(htlcEvent(user, payChannel, []qln.HTLC{firstHTLC, secondHTLC}))
+	if !first.claimed || !second.claimed {
+		t.Errorf("Both HTLCs from the user should be claimed")
+		return
+	}
+	if state := server.GetSwaps(user.PubKey())[0].State; state != SwapComplete {
+		t.Errorf("Swap should be complete, is %s", state.String())
+		return
+	}
+	if backend.channels[payChannel.Idx].MyAmt != int64(instruction.PayAmount) {
+		t.Errorf("Expected %d on our side of the pay channel, got %d", instruction.PayAmount, backend.channels[payChannel.Idx].MyAmt)
+		return
+	}
+
+	// A complete swap isn't refunded when the locktime passes
+	if err = server.expireSwaps(receiveCoin.HDCoinType, int32(swap.Locktime)); err != nil {
+		t.Errorf("Error expiring swaps: %s", err)
+		return
+	}
+	if state := server.GetSwaps(user.PubKey())[0].State; state != SwapComplete {
+		t.Errorf("Complete swap should stay complete, is %s", state.String())
+		return
+	}
+
+	return
+}
+
+func TestSwapRefund(t *testing.T) {
+	var err error
+
+	backend := newTestLightningBackend(1)
+	server, user, instruction := createSwapTestServer(t, backend)
+	payCoin := &coinparam.RegressionNetParams
+	receiveCoin := &coinparam.LiteRegNetParams
+	receiveChannel := backend.addChannel(1, receiveCoin.HDCoinType, 1000000, 0)
+	payChannel := backend.addChannel(1, payCoin.HDCoinType, 0, 1000000)
+
+	var swap *PendingSwap
+	if swap, err = server.CreateSwap(instruction); err != nil {
+		t.Errorf("Error creating swap: %s", err)
+		return
+	}
+
+	// Blocks on the other coin, or before the locktime, don't do anything
+	if err = server.expireSwaps(payCoin.HDCoinType, int32(swap.Locktime)); err != nil {
+		t.Errorf("Error expiring swaps: %s", err)
+		return
+	}
+	if err = server.expireSwaps(receiveCoin.HDCoinType, int32(swap.Locktime)-1); err != nil {
+		t.Errorf("Error expiring swaps: %s", err)
+		return
+	}
+	if state := server.GetSwaps(user.PubKey())[0].State; state != SwapOffered {
+		t.Errorf("Swap should still be offered before the locktime, is %s", state.String())
+		return
+	}
+
+	// The user never paid, so once the locktime passes we take our HTLC back
+	if err = server.expireSwaps(receiveCoin.HDCoinType, int32(swap.Locktime)); err != nil {
+		t.Errorf("Error expiring swaps: %s", err)
+		return
+	}
+	if state := server.GetSwaps(user.PubKey())[0].State; state != SwapRefunded {
+		t.Errorf("Swap should be refunded, is %s", state.String())
+		return
+	}
+	if offered := backend.offeredHTLCs(); !offered[0].refunded || backend.channels[receiveChannel.Idx].MyAmt != 1000000 {
+		t.Errorf("Our HTLC should be refunded, have %d in our side of the channel", backend.channels[receiveChannel.Idx].MyAmt)
+		return
+	}
+
+	// Paying after the swap is refunded doesn't get claimed
+	late := backend.receiveHTLC(payChannel.Idx, uint32(instruction.PayAmount), swap.RHash, 20)
+	if err = server.ingestSwapHTLC(swap.RHash, user.PubKey(), payCoin.HDCoinType, payChannel.Idx, 0, instruction.PayAmount, 20); err != nil {
+		t.Errorf("Error ingesting late HTLC: %s", err)
+		return
+	}
+	if late.claimed {
+		t.Errorf("HTLC for a refunded swap should not be claimed")
+		return
+	}
+
+	return
+}
+
+func TestCheckSwapChannels(t *testing.T) {
+	var err error
+
+	backend := newTestLightningBackend(1)
+	server, user, _ := createSwapTestServer(t, backend)
+	payCoin := &coinparam.RegressionNetParams
+	receiveCoin := &coinparam.LiteRegNetParams
+
+	// selling the pay coin means the order holds it
+	order := &match.LimitOrder{
+		Side:       match.Sell,
+		Swap:       true,
+		AmountHave: 200000,
+		AmountWant: 300000,
+	}
+	copy(order.Pubkey[:], user.PubKey().SerializeCompressed())
+	if order.TradingPair.AssetWant, err = match.AssetFromCoinParam(payCoin); err != nil {
+		t.Errorf("Error getting asset from coin param: %s", err)
+		return
+	}
+	if order.TradingPair.AssetHave, err = match.AssetFromCoinParam(receiveCoin); err != nil {
+		t.Errorf("Error getting asset from coin param: %s", err)
+		return
+	}
+
+	if err = server.checkSwapChannels(order); err == nil {
+		t.Errorf("Swap order without any channels should not be allowed")
+		return
+	}
+
+	backend.addChannel(1, payCoin.HDCoinType, 0, 1000000)
+	if err = server.checkSwapChannels(order); err != nil {
+		t.Errorf("Swap order with enough in a channel should be allowed: %s", err)
+		return
+	}
+
+	order.AmountHave = 1000000
+	if err = server.checkSwapChannels(order); err == nil {
+		t.Errorf("Swap order for more than the user can send should not be allowed")
+		return
+	}
+
+	// Open swap orders and unpaid swaps use up what the user can send
+	var book match.LimitOrderbook
+	if book, err = cxdbmemory.CreateLimitOrderbook(&order.TradingPair); err != nil {
+		t.Errorf("Error creating orderbook: %s", err)
+		return
+	}
+	server.Orderbooks = map[match.Pair]match.LimitOrderbook{order.TradingPair: book}
+	openOrder := *order
+	openOrder.AmountHave = 400000
+	if err = book.UpdateBookPlace(&match.LimitOrderIDPair{OrderID: &match.OrderID{0x01}, Price: 1, Order: &openOrder}); err != nil {
+		t.Errorf("Error placing open swap order: %s", err)
+		return
+	}
+	order.AmountHave = 500000
+	if err = server.checkSwapChannels(order); err != nil {
+		t.Errorf("Swap order with enough left after the open swap order should be allowed: %s", err)
+		return
+	}
+
+	unpaid := &PendingSwap{Instruction: &match.SwapInstruction{PayAsset: order.TradingPair.AssetWant, PayAmount: 300000}, State: SwapOffered, Received: 100000}
+	copy(unpaid.Instruction.Pubkey[:], user.PubKey().SerializeCompressed())
+	unpaid.RHash[0] = 1
+	if err = server.recordSwap(unpaid); err != nil {
+		t.Errorf("Error recording unpaid swap: %s", err)
+		return
+	}
+	if err = server.checkSwapChannels(order); err == nil {
+		t.Errorf("Swap order for more than is left after open swap orders and unpaid swaps should not be allowed")
+		return
+	}
+	order.AmountHave = 300000
+	if err = server.checkSwapChannels(order); err != nil {
+		t.Errorf("Swap order for what's left after open swap orders and unpaid swaps should be allowed: %s", err)
+		return
+	}
+
+	order.AmountHave = 200000
+	backend.connected[1] = false
+	if err = server.checkSwapChannels(order); err == nil {
+		t.Errorf("Swap order from a user we aren't connected to should not be allowed")
+		return
+	}
+
+	return
+}
@@ -0,0 +1,239 @@
+package cxserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/mit-dci/lit/btcutil/chaincfg/chainhash"
+	"github.com/mit-dci/lit/btcutil/hdkeychain"
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/wire"
+	util "github.com/mit-dci/opencx/chainutils"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/logging"
+	"github.com/mit-dci/opencx/match"
+)
+
+// Estimated virtual sizes for sweep transactions, used to calculate the fee
+const (
+	sweepTxOverheadVSize  = 11
+	sweepOutputVSize      = 43
+	p2pkhInputVSize       = 148
+	p2wpkhInputVSize      = 68
+	p2shP2wpkhInputVSize  = 91
+	sweepDerivationFormat = "0/%d"
+)
+
+// SweepInput is a deposit output being swept, with everything an offline signer needs to sign it
+type SweepInput struct {
+	Txid    string
+	Vout    uint32
+	Amount  uint64
+	Address string
+	// AddressType is P2PKH, P2WPKH or P2SH-P2WPKH, which tells the signer what kind of signature
+	// and redeem script the input needs
+	AddressType string
+	// DerivationPath is the path from the deposit xpub to the key that can spend this input
+	DerivationPath string
+}
+
+// UnsignedSweep is an unsigned transaction that sweeps deposits to cold storage. It is meant to be
+// like a PSBT, so an offline signer with the private key for the deposit xpub has everything it
+// needs to sign the transaction.
+type UnsignedSweep struct {
+	Coin string
+	Xpub string
+	// UnsignedTx is the hex serialized transaction, with empty signature scripts
+	UnsignedTx  string
+	Inputs      []SweepInput
+	Destination string
+	Amount      uint64
+	Fee         uint64
+}
+
+// BuildSweep builds an unsigned transaction that sends every credited, unswept deposit for a coin to
+// the destination address. The coin has to have a deposit xpub set, since those are the deposits
+// the hot wallet can't spend. Deposits are marked as swept once the sweep transaction is seen in a
+// block.
+func (server *OpencxServer) BuildSweep(coinType *coinparam.Params, destination string, feeRate uint64) (sweep *UnsignedSweep, err error) {
+
+	server.walletMtx.Lock()
+	xpub, watchOnly := server.depositXpubs[coinType]
+	server.walletMtx.Unlock()
+	if !watchOnly {
+		err = fmt.Errorf("No deposit xpub set for %s, deposits are already in the hot wallet", coinType.Name)
+		return
+	}
+
+	var destScript []byte
+	if destScript, err = util.ScriptFromAddress(destination, coinType); err != nil {
+		err = fmt.Errorf("Error decoding destination for BuildSweep: %s", err)
+		return
+	}
+
+	server.dbLock.Lock()
+	var currDepositStore cxdb.DepositStore
+	var ok bool
+	if currDepositStore, ok = server.DepositStores[coinType]; !ok {
+		err = fmt.Errorf("Could not find deposit store for %s for BuildSweep", coinType.Name)
+		server.dbLock.Unlock()
+		return
+	}
+
+	var deposits []*match.Deposit
+	if deposits, err = currDepositStore.GetSweepableDeposits(); err != nil {
+		err = fmt.Errorf("Error getting sweepable deposits for BuildSweep: %s", err)
+		server.dbLock.Unlock()
+		return
+	}
+
+	sweep = &UnsignedSweep{
+		Coin:        coinType.Name,
+		Xpub:        xpub.String(),
+		Destination: destination,
+	}
+	sweepTx := wire.NewMsgTx()
+	sweepTx.Version = 2
+	vsize := uint64(sweepTxOverheadVSize + sweepOutputVSize)
+	var total uint64
+	for _, deposit := range deposits {
+		var input SweepInput
+		var inputVSize uint64
+		if input, inputVSize, err = server.sweepInputForDeposit(currDepositStore, xpub, deposit); err != nil {
+			logging.Warnf("Not sweeping %s deposit %s:%d: %s", coinType.Name, deposit.Txid, deposit.Vout, err)
+			err = nil
+			continue
+		}
+
+		var prevHash *chainhash.Hash
+		if prevHash, err = chainhash.NewHashFromStr(deposit.Txid); err != nil {
+			err = fmt.Errorf("Error parsing deposit txid for BuildSweep: %s", err)
+			server.dbLock.Unlock()
+			return
+		}
+		sweepTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(prevHash, deposit.Vout), nil, nil))
+		sweep.Inputs = append(sweep.Inputs, input)
+		vsize += inputVSize
+		total += deposit.Amount
+	}
+	server.dbLock.Unlock()
+
+	if len(sweep.Inputs) == 0 {
+		err = fmt.Errorf("No %s deposits to sweep", coinType.Name)
+		return
+	}
+
+	sweep.Fee = vsize * feeRate
+	if total <= sweep.Fee {
+		err = fmt.Errorf("Sweep of %d is not enough to pay the fee of %d", total, sweep.Fee)
+		return
+	}
+	sweep.Amount = total - sweep.Fee
+	sweepTx.AddTxOut(wire.NewTxOut(int64(sweep.Amount), destScript))
+
+	var buf bytes.Buffer
+	if err = sweepTx.Serialize(&buf); err != nil {
+		err = fmt.Errorf("Error serializing sweep tx for BuildSweep: %s", err)
+		return
+	}
+	sweep.UnsignedTx = hex.EncodeToString(buf.Bytes())
+
+	logging.Infof("Built %s sweep of %d deposits for %d to %s", coinType.Name, len(sweep.Inputs), sweep.Amount, destination)
+	return
+}
+
+// sweepInputForDeposit figures out which key in the xpub the deposit was sent to, and what type of
+// address it was. Deposits to addresses that weren't derived from the xpub return an error.
+func (server *OpencxServer) sweepInputForDeposit(store cxdb.DepositStore, xpub *hdkeychain.ExtendedKey, deposit *match.Deposit) (input SweepInput, vsize uint64, err error) {
+	var index uint32
+	if index, err = store.GetDepositIndex(deposit.Pubkey); err != nil {
+		err = fmt.Errorf("Error getting deposit index: %s", err)
+		return
+	}
+
+	var pkh [20]byte
+	if pkh, err = depositPKHAtIndex(xpub, index); err != nil {
+		return
+	}
+
+	inputVSizes := map[util.AddressType]uint64{
+		util.P2PKHAddress:      p2pkhInputVSize,
+		util.P2WPKHAddress:     p2wpkhInputVSize,
+		util.P2SHP2WPKHAddress: p2shP2wpkhInputVSize,
+	}
+	for addrType, inputVSize := range inputVSizes {
+		var addr string
+		if addr, err = util.AddressFromPKH(pkh, addrType, deposit.CoinType); err != nil {
+			// not every coin supports every address type
+			err = nil
+			continue
+		}
+		if addr == deposit.Address {
+			input = SweepInput{
+				Txid:           deposit.Txid,
+				Vout:           deposit.Vout,
+				Amount:         deposit.Amount,
+				Address:        deposit.Address,
+				AddressType:    addrType.String(),
+				DerivationPath: fmt.Sprintf(sweepDerivationFormat, index),
+			}
+			vsize = inputVSize
+			return
+		}
+	}
+
+	err = fmt.Errorf("address %s was not derived from the deposit xpub", deposit.Address)
+	return
+}
+
+// markSweptDeposits marks deposits as swept if any of the transactions spend them
+func (server *OpencxServer) markSweptDeposits(txList []*wire.MsgTx, coinType *coinparam.Params) (err error) {
+	server.walletMtx.Lock()
+	_, watchOnly := server.depositXpubs[coinType]
+	server.walletMtx.Unlock()
+	if !watchOnly {
+		return
+	}
+
+	server.dbLock.Lock()
+	var currDepositStore cxdb.DepositStore
+	var ok bool
+	if currDepositStore, ok = server.DepositStores[coinType]; !ok {
+		err = fmt.Errorf("Could not find deposit store for %s for markSweptDeposits", coinType.Name)
+		server.dbLock.Unlock()
+		return
+	}
+
+	var deposits []*match.Deposit
+	if deposits, err = currDepositStore.GetSweepableDeposits(); err != nil {
+		err = fmt.Errorf("Error getting sweepable deposits for markSweptDeposits: %s", err)
+		server.dbLock.Unlock()
+		return
+	}
+
+	unswept := make(map[string]*match.Deposit)
+	for _, deposit := range deposits {
+		unswept[fmt.Sprintf("%s:%d", deposit.Txid, deposit.Vout)] = deposit
+	}
+
+	var swept []*match.Deposit
+	for _, tx := range txList {
+		for _, txin := range tx.TxIn {
+			if deposit, found := unswept[fmt.Sprintf("%s:%d", txin.PreviousOutPoint.Hash.String(), txin.PreviousOutPoint.Index)]; found {
+				swept = append(swept, deposit)
+			}
+		}
+	}
+
+	if len(swept) > 0 {
+		if err = currDepositStore.MarkDepositsSwept(swept); err != nil {
+			err = fmt.Errorf("Error marking deposits swept for markSweptDeposits: %s", err)
+			server.dbLock.Unlock()
+			return
+		}
+		logging.Infof("Marked %d %s deposits as swept", len(swept), coinType.Name)
+	}
+	server.dbLock.Unlock()
+	return
+}
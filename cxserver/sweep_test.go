@@ -0,0 +1,208 @@
+package cxserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/mit-dci/lit/btcutil"
+	"github.com/mit-dci/lit/btcutil/chaincfg/chainhash"
+	"github.com/mit-dci/lit/btcutil/hdkeychain"
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/lit/wire"
+	util "github.com/mit-dci/opencx/chainutils"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/cxdb/cxdbmemory"
+	"github.com/mit-dci/opencx/match"
+)
+
+var (
+	testSweepSeed = bytes.Repeat([]byte{0x42}, 32)
+	testSweepTxid = "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"
+)
+
+// createTestXpubServer creates a server with a memory deposit store for the coin, deriving deposit
+// addresses from the xpub of the returned master key
+func createTestXpubServer(t *testing.T, coin *coinparam.Params) (server *OpencxServer, store cxdb.DepositStore, master *hdkeychain.ExtendedKey) {
+	var err error
+	if store, err = cxdbmemory.CreateDepositStore(coin); err != nil {
+		t.Fatalf("Error creating deposit store: %s", err)
+	}
+
+	depositStores := map[*coinparam.Params]cxdb.DepositStore{coin: store}
+	if server, err = InitServer(nil, nil, nil, depositStores, nil, ""); err != nil {
+		t.Fatalf("Error initializing server: %s", err)
+	}
+
+	if master, err = hdkeychain.NewMaster(testSweepSeed, coin); err != nil {
+		t.Fatalf("Error creating master key: %s", err)
+	}
+
+	var xpub *hdkeychain.ExtendedKey
+	if xpub, err = master.Neuter(); err != nil {
+		t.Fatalf("Error neutering master key: %s", err)
+	}
+
+	if err = server.SetDepositXpub(coin, xpub.String()); err != nil {
+		t.Fatalf("Error setting deposit xpub: %s", err)
+	}
+	server.SetDepositAddressType(coin, util.P2WPKHAddress)
+	return
+}
+
+func TestSetDepositXpubRejectsPrivate(t *testing.T) {
+	var err error
+
+	coin := &coinparam.RegressionNetParams
+	server, _, master := createTestXpubServer(t, coin)
+	if err = server.SetDepositXpub(coin, master.String()); err == nil {
+		t.Errorf("Setting a private extended key as the deposit xpub should fail")
+		return
+	}
+
+	return
+}
+
+func TestXpubDepositAddressAndSweep(t *testing.T) {
+	var err error
+
+	coin := &coinparam.RegressionNetParams
+	server, store, master := createTestXpubServer(t, coin)
+
+	var privkey *koblitz.PrivateKey
+	if privkey, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating user key: %s", err)
+		return
+	}
+	userPub := privkey.PubKey()
+
+	var addr string
+	if addr, err = server.GetAddrForCoin(coin, userPub); err != nil {
+		t.Errorf("Error getting address for coin: %s", err)
+		return
+	}
+
+	// The first user should get the key at master/0/0, which the offline signer can derive
+	var child *hdkeychain.ExtendedKey
+	if child, err = master.Child(0); err != nil {
+		t.Errorf("Error deriving external chain: %s", err)
+		return
+	}
+	if child, err = child.Child(0); err != nil {
+		t.Errorf("Error deriving child: %s", err)
+		return
+	}
+	var childPub *koblitz.PublicKey
+	if childPub, err = child.ECPubKey(); err != nil {
+		t.Errorf("Error getting child pubkey: %s", err)
+		return
+	}
+	var expectedPKH [20]byte
+	copy(expectedPKH[:], btcutil.Hash160(childPub.SerializeCompressed()))
+	var expectedAddr string
+	if expectedAddr, err = util.AddressFromPKH(expectedPKH, util.P2WPKHAddress, coin); err != nil {
+		t.Errorf("Error encoding expected address: %s", err)
+		return
+	}
+	if addr != expectedAddr {
+		t.Errorf("Deposit address %s should have been %s", addr, expectedAddr)
+		return
+	}
+
+	// Asking again should give the same address since the index is kept in the deposit store
+	var sameAddr string
+	if sameAddr, err = server.GetAddrForCoin(coin, userPub); err != nil {
+		t.Errorf("Error getting address for coin again: %s", err)
+		return
+	}
+	if sameAddr != addr {
+		t.Errorf("Deposit address should be deterministic, got %s then %s", addr, sameAddr)
+		return
+	}
+
+	if err = store.RegisterUser(userPub, addr); err != nil {
+		t.Errorf("Error registering user: %s", err)
+		return
+	}
+
+	deposit := match.Deposit{
+		Pubkey:              userPub,
+		Address:             addr,
+		Amount:              100000,
+		Txid:                testSweepTxid,
+		Vout:                1,
+		CoinType:            coin,
+		BlockHeightReceived: 100,
+		Confirmations:       6,
+	}
+	if _, err = store.UpdateDeposits([]match.Deposit{deposit}, 106); err != nil {
+		t.Errorf("Error updating deposits: %s", err)
+		return
+	}
+
+	var destAddr string
+	if destAddr, err = util.AddressFromPKH([20]byte{}, util.P2PKHAddress, coin); err != nil {
+		t.Errorf("Error encoding destination address: %s", err)
+		return
+	}
+
+	var sweep *UnsignedSweep
+	if sweep, err = server.BuildSweep(coin, destAddr, 2); err != nil {
+		t.Errorf("Error building sweep: %s", err)
+		return
+	}
+
+	if len(sweep.Inputs) != 1 {
+		t.Errorf("Sweep should have 1 input, had %d", len(sweep.Inputs))
+		return
+	}
+	if sweep.Inputs[0].DerivationPath != "0/0" || sweep.Inputs[0].AddressType != util.P2WPKHAddress.String() {
+		t.Errorf("Sweep input should be P2WPKH at 0/0, was %s at %s", sweep.Inputs[0].AddressType, sweep.Inputs[0].DerivationPath)
+		return
+	}
+	expectedFee := uint64(2 * (sweepTxOverheadVSize + sweepOutputVSize + p2wpkhInputVSize))
+	if sweep.Fee != expectedFee || sweep.Amount != deposit.Amount-expectedFee {
+		t.Errorf("Sweep should have fee %d and amount %d, had fee %d and amount %d", expectedFee, deposit.Amount-expectedFee, sweep.Fee, sweep.Amount)
+		return
+	}
+
+	var txBytes []byte
+	if txBytes, err = hex.DecodeString(sweep.UnsignedTx); err != nil {
+		t.Errorf("Error decoding unsigned tx: %s", err)
+		return
+	}
+	sweepTx := wire.NewMsgTx()
+	if err = sweepTx.Deserialize(bytes.NewReader(txBytes)); err != nil {
+		t.Errorf("Error deserializing unsigned tx: %s", err)
+		return
+	}
+	if len(sweepTx.TxIn) != 1 || sweepTx.TxIn[0].PreviousOutPoint.Index != 1 || sweepTx.TxIn[0].PreviousOutPoint.Hash.String() != testSweepTxid {
+		t.Errorf("Unsigned tx should spend the deposit outpoint")
+		return
+	}
+	if len(sweepTx.TxOut) != 1 || uint64(sweepTx.TxOut[0].Value) != sweep.Amount {
+		t.Errorf("Unsigned tx should have one output for the sweep amount")
+		return
+	}
+
+	// Once a transaction spending the deposit is seen, it shouldn't be swept again
+	var prevHash *chainhash.Hash
+	if prevHash, err = chainhash.NewHashFromStr(testSweepTxid); err != nil {
+		t.Errorf("Error parsing txid: %s", err)
+		return
+	}
+	spendTx := wire.NewMsgTx()
+	spendTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(prevHash, 1), nil, nil))
+	if err = server.markSweptDeposits([]*wire.MsgTx{spendTx}, coin); err != nil {
+		t.Errorf("Error marking deposits swept: %s", err)
+		return
+	}
+
+	if _, err = server.BuildSweep(coin, destAddr, 2); err == nil {
+		t.Errorf("There should be nothing left to sweep")
+		return
+	}
+
+	return
+}
@@ -0,0 +1,260 @@
+package cxserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/match"
+)
+
+// transferFileName is the file in the opencx root directory that transfers are appended to, one
+// JSON record per line
+const transferFileName = "transfers.json"
+
+// transferLimitPeriod is how far back transfers count towards the daily limit
+const transferLimitPeriod = 24 * time.Hour
+
+// TransferRecord is a transfer between two accounts that was applied, and when it was applied
+type TransferRecord struct {
+	Transfer *match.Transfer
+	Time     time.Time
+}
+
+// SetTransferLimit sets the most of a coin that each account can transfer to other accounts in a day.
+// Without a limit, accounts can transfer as much as they have.
+func (server *OpencxServer) SetTransferLimit(coinType *coinparam.Params, limit uint64) {
+	server.transferMtx.Lock()
+	server.transferLimits[coinType] = limit
+	server.transferMtx.Unlock()
+	return
+}
+
+// Transfer moves an asset from one account on the exchange to another, without going on chain. The
+// credit to the sender and the debit to the receiver are applied as one batch. The transfer should
+// already be signed by the sender. Transfers between sub-accounts of the same pubkey are free and
+// don't count towards the daily limit.
+func (server *OpencxServer) Transfer(transfer *match.Transfer) (err error) {
+
+	if transfer.Amount == 0 {
+		err = fmt.Errorf("You can't transfer 0 %s", transfer.Asset)
+		return
+	}
+
+	if transfer.FromAccount() == transfer.ToAccount() {
+		err = fmt.Errorf("You can't transfer to yourself")
+		return
+	}
+
+	if _, err = koblitz.ParsePubKey(transfer.To[:], koblitz.S256()); err != nil {
+		err = fmt.Errorf("Error parsing pubkey to transfer to: %s", err)
+		return
+	}
+
+	var coinType *coinparam.Params
+	if coinType, err = transfer.Asset.CoinParamFromAsset(); err != nil {
+		err = fmt.Errorf("Error getting coin param from asset for Transfer: %s", err)
+		return
+	}
+
+	// Hold the transfer lock the whole time so two transfers from the same account can't both use
+	// the same nonce or both fit under the limit
+	server.transferMtx.Lock()
+	defer server.transferMtx.Unlock()
+
+	if lastNonce := server.transferNonces[transfer.From]; transfer.Nonce <= lastNonce {
+		err = fmt.Errorf("Transfer nonce %d must be more than the last nonce %d", transfer.Nonce, lastNonce)
+		return
+	}
+
+	now := time.Now()
+	if limit, ok := server.transferLimits[coinType]; ok && !transfer.Internal() {
+		transferred := server.transferredSince(transfer.From, transfer.Asset, now.Add(-transferLimitPeriod))
+		if transferred+transfer.Amount > limit {
+			err = fmt.Errorf("Transfer of %d %s would go over the daily limit of %d, %d has been transferred in the last day", transfer.Amount, transfer.Asset, limit, transferred)
+			return
+		}
+	}
+
+	setExecs := []*match.SettlementExecution{
+		&match.SettlementExecution{
+			Pubkey:     transfer.From,
+			SubAccount: transfer.FromSubAccount,
+			Type:       match.Credit,
+			Asset:      transfer.Asset,
+			Amount:     transfer.Amount,
+			Reason:     match.ReasonTransfer,
+			Reference:  transfer.SenderReference(),
+		},
+		&match.SettlementExecution{
+			Pubkey:     transfer.To,
+			SubAccount: transfer.ToSubAccount,
+			Type:       match.Debit,
+			Asset:      transfer.Asset,
+			Amount:     transfer.Amount,
+			Reason:     match.ReasonTransfer,
+			Reference:  transfer.FromAccount().String(),
+		},
+	}
+
+	server.dbLock.Lock()
+
+	// The nonce is in the ledger reference for the sender, so it's stored with the settlement. It's
+	// kept in memory as soon as the settlement is applied, before anything else can fail.
+	var settlementResults []*match.SettlementResult
+	if settlementResults, err = server.BatchSettlementEngine.ApplySettlementBatch(setExecs); err != nil {
+		err = fmt.Errorf("Error applying settlement executions for Transfer: %s", err)
+		server.dbLock.Unlock()
+		return
+	}
+	record := &TransferRecord{Transfer: transfer, Time: now}
+	server.addTransfer(record)
+
+	if err = server.queueReadUpdate(&readUpdate{settlementResults: settlementResults}); err != nil {
+		err = fmt.Errorf("Error updating balances for Transfer: %s", err)
+		server.dbLock.Unlock()
+		return
+	}
+
+	server.dbLock.Unlock()
+
+	if err = server.recordTransfer(record); err != nil {
+		err = fmt.Errorf("Error recording transfer: %s", err)
+		return
+	}
+
+	return
+}
+
+// transferredSince is how much of an asset a pubkey has transferred to other pubkeys since a time.
+// Transfers between its own sub-accounts don't count. The transfers from a pubkey are in the order
+// they were applied, so this only goes back as far as since. This assumes the transfer lock is held.
+func (server *OpencxServer) transferredSince(from [33]byte, asset match.Asset, since time.Time) (transferred uint64) {
+	records := server.transfersFrom[from]
+	for i := len(records) - 1; i >= 0 && records[i].Time.After(since); i-- {
+		if !records[i].Transfer.Internal() && records[i].Transfer.Asset == asset {
+			transferred += records[i].Transfer.Amount
+		}
+	}
+	return
+}
+
+// addTransfer keeps the transfer and its nonce in memory. This assumes the transfer lock is held.
+func (server *OpencxServer) addTransfer(record *TransferRecord) {
+	server.transfers = append(server.transfers, record)
+	server.transfersFrom[record.Transfer.From] = append(server.transfersFrom[record.Transfer.From], record)
+	if record.Transfer.Nonce > server.transferNonces[record.Transfer.From] {
+		server.transferNonces[record.Transfer.From] = record.Transfer.Nonce
+	}
+	return
+}
+
+// recordTransfer appends the transfer to the transfer file, if the server has a root directory.
+// This assumes the transfer lock is held.
+func (server *OpencxServer) recordTransfer(record *TransferRecord) (err error) {
+	if server.OpencxRoot == "" {
+		return
+	}
+
+	var recordBytes []byte
+	if recordBytes, err = json.Marshal(record); err != nil {
+		err = fmt.Errorf("Error marshalling transfer for recordTransfer: %s", err)
+		return
+	}
+
+	var transferFile *os.File
+	if transferFile, err = os.OpenFile(filepath.Join(server.OpencxRoot, transferFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+		err = fmt.Errorf("Error opening transfer file for recordTransfer: %s", err)
+		return
+	}
+	defer transferFile.Close()
+
+	if _, err = transferFile.Write(append(recordBytes, '\n')); err != nil {
+		err = fmt.Errorf("Error writing transfer file for recordTransfer: %s", err)
+		return
+	}
+	return
+}
+
+// LoadTransfers loads the transfers from the root directory, so limits still count transfers from
+// before a restart. The nonces are also read from the ledger, so a transfer that was settled but
+// didn't make it to the transfer file still can't be replayed. The ledger stores should be set
+// first.
+func (server *OpencxServer) LoadTransfers() (err error) {
+	var records []*TransferRecord
+	if records, err = server.readTransferFile(); err != nil {
+		err = fmt.Errorf("Error reading transfer file for LoadTransfers: %s", err)
+		return
+	}
+
+	server.transferMtx.Lock()
+	defer server.transferMtx.Unlock()
+
+	server.transfers = nil
+	server.transfersFrom = make(map[[33]byte][]*TransferRecord)
+	server.transferNonces = make(map[[33]byte]uint64)
+	for _, record := range records {
+		server.addTransfer(record)
+	}
+
+	for coin, currLedgerStore := range server.LedgerStores {
+		var ledgerNonces map[[33]byte]uint64
+		if ledgerNonces, err = currLedgerStore.GetTransferNonces(); err != nil {
+			err = fmt.Errorf("Error getting %s transfer nonces for LoadTransfers: %s", coin.Name, err)
+			return
+		}
+		for pubkey, nonce := range ledgerNonces {
+			if nonce > server.transferNonces[pubkey] {
+				server.transferNonces[pubkey] = nonce
+			}
+		}
+	}
+	return
+}
+
+// readTransferFile reads every transfer from the transfer file in the root directory, in the order
+// they were applied
+func (server *OpencxServer) readTransferFile() (records []*TransferRecord, err error) {
+	var transferFile *os.File
+	if transferFile, err = os.Open(filepath.Join(server.OpencxRoot, transferFileName)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer transferFile.Close()
+
+	scanner := bufio.NewScanner(transferFile)
+	for scanner.Scan() {
+		record := new(TransferRecord)
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+			err = fmt.Errorf("Error parsing transfer: %s", err)
+			return
+		}
+		records = append(records, record)
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	return
+}
+
+// GetTransfers returns every transfer to or from a pubkey, oldest first
+func (server *OpencxServer) GetTransfers(pubkey *koblitz.PublicKey) (records []*TransferRecord) {
+	var pubkeyBytes [33]byte
+	copy(pubkeyBytes[:], pubkey.SerializeCompressed())
+
+	server.transferMtx.Lock()
+	for _, record := range server.transfers {
+		if record.Transfer.From == pubkeyBytes || record.Transfer.To == pubkeyBytes {
+			records = append(records, record)
+		}
+	}
+	server.transferMtx.Unlock()
+	return
+}
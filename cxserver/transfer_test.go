@@ -0,0 +1,363 @@
+package cxserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/cxdb/cxdbkv"
+	"github.com/mit-dci/opencx/cxdb/cxdbmemory"
+	"github.com/mit-dci/opencx/match"
+)
+
+func TestTransfer(t *testing.T) {
+	var err error
+
+	var rootDir string
+	if rootDir, err = ioutil.TempDir("", "transfer"); err != nil {
+		t.Errorf("Error creating temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(rootDir)
+
+	coin := &coinparam.RegressionNetParams
+	var asset match.Asset
+	if asset, err = match.AssetFromCoinParam(coin); err != nil {
+		t.Errorf("Error getting asset from coin param: %s", err)
+		return
+	}
+
+	var setEngines map[*coinparam.Params]match.SettlementEngine
+	if setEngines, err = cxdbmemory.CreateSettlementEngineMap([]*coinparam.Params{coin}); err != nil {
+		t.Errorf("Error creating settlement engine map: %s", err)
+		return
+	}
+	var batchEngine match.BatchSettlementEngine
+	if batchEngine, err = cxdbmemory.CreateBatchSettlementEngine(setEngines); err != nil {
+		t.Errorf("Error creating batch settlement engine: %s", err)
+		return
+	}
+	settleStore := &testResultSettlementStore{results: make(map[match.Account]*match.SettlementResult)}
+	settleStores := map[*coinparam.Params]cxdb.SettlementStore{coin: settleStore}
+
+	var server *OpencxServer
+	if server, err = InitServer(setEngines, nil, nil, nil, settleStores, rootDir); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+	server.SetBatchSettlementEngine(batchEngine)
+	server.SetTransferLimit(coin, 1000)
+
+	var alice, bob *koblitz.PrivateKey
+	if alice, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key: %s", err)
+		return
+	}
+	if bob, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key: %s", err)
+		return
+	}
+
+	if err = server.DebitUser(alice.PubKey(), 2000, coin, match.ReasonDeposit, "deposit"); err != nil {
+		t.Errorf("Error debiting user: %s", err)
+		return
+	}
+
+	transfer := &match.Transfer{Asset: asset, Amount: 600, Nonce: 1}
+	copy(transfer.From[:], alice.PubKey().SerializeCompressed())
+	copy(transfer.To[:], bob.PubKey().SerializeCompressed())
+	if err = server.Transfer(transfer); err != nil {
+		t.Errorf("Error transferring: %s", err)
+		return
+	}
+
+	if settleStore.results[transfer.FromAccount()].NewBal != 1400 || settleStore.results[transfer.ToAccount()].NewBal != 600 {
+		t.Errorf("Expected balances of 1400 and 600 after the transfer, got %d and %d", settleStore.results[transfer.FromAccount()].NewBal, settleStore.results[transfer.ToAccount()].NewBal)
+		return
+	}
+
+	// The same signed transfer can't be applied twice
+	if err = server.Transfer(transfer); err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Errorf("Replaying a transfer should fail because of the nonce, got %v", err)
+		return
+	}
+
+	// 600 has already been transferred today, so another 600 is over the limit
+	overLimit := &match.Transfer{From: transfer.From, To: transfer.To, Asset: asset, Amount: 600, Nonce: 2}
+	if err = server.Transfer(overLimit); err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("Transfer over the daily limit should fail, got %v", err)
+		return
+	}
+
+	// bob can't transfer more than he has
+	overBalance := &match.Transfer{From: transfer.To, To: transfer.From, Asset: asset, Amount: 700, Nonce: 1}
+	if err = server.Transfer(overBalance); err == nil {
+		t.Errorf("Transfer of more than the balance should fail")
+		return
+	}
+	if settleStore.results[transfer.FromAccount()].NewBal != 1400 || settleStore.results[transfer.ToAccount()].NewBal != 600 {
+		t.Errorf("Failed transfers should not change balances")
+		return
+	}
+
+	if records := server.GetTransfers(bob.PubKey()); len(records) != 1 || records[0].Transfer.Amount != 600 {
+		t.Errorf("Expected one transfer of 600 for bob, got %d transfers", len(records))
+		return
+	}
+
+	// Nonces and limits should survive a restart
+	var restarted *OpencxServer
+	if restarted, err = InitServer(setEngines, nil, nil, nil, settleStores, rootDir); err != nil {
+		t.Errorf("Error initializing restarted server: %s", err)
+		return
+	}
+	restarted.SetBatchSettlementEngine(batchEngine)
+	restarted.SetTransferLimit(coin, 1000)
+	if err = restarted.LoadTransfers(); err != nil {
+		t.Errorf("Error loading transfers: %s", err)
+		return
+	}
+	if err = restarted.Transfer(transfer); err == nil {
+		t.Errorf("Replaying a transfer after a restart should fail")
+		return
+	}
+	if err = restarted.Transfer(overLimit); err == nil {
+		t.Errorf("Transfer over the daily limit should still fail after a restart")
+		return
+	}
+
+	underLimit := &match.Transfer{From: transfer.From, To: transfer.To, Asset: asset, Amount: 400, Nonce: 3}
+	if err = restarted.Transfer(underLimit); err != nil {
+		t.Errorf("Error transferring up to the limit after a restart: %s", err)
+		return
+	}
+
+	// A snapshot restored somewhere else keeps the history, nonces and limits too
+	var restoreDir string
+	if restoreDir, err = ioutil.TempDir("", "transferrestore"); err != nil {
+		t.Errorf("Error creating temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(restoreDir)
+
+	var restored *OpencxServer
+	if restored, err = InitServer(setEngines, nil, nil, nil, settleStores, restoreDir); err != nil {
+		t.Errorf("Error initializing restored server: %s", err)
+		return
+	}
+	restored.SetBatchSettlementEngine(batchEngine)
+	restored.SetTransferLimit(coin, 1000)
+	snapTransfers := restarted.SnapshotTransfers()
+	if err = restored.RestoreTransfers(snapTransfers); err != nil {
+		t.Errorf("Error restoring transfers: %s", err)
+		return
+	}
+	if err = restored.LoadTransfers(); err != nil {
+		t.Errorf("Error loading restored transfers: %s", err)
+		return
+	}
+	if records := restored.GetTransfers(bob.PubKey()); len(records) != 2 {
+		t.Errorf("Expected two restored transfers for bob, got %d", len(records))
+		return
+	}
+	if err = restored.Transfer(underLimit); err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Errorf("Replaying a transfer after restoring should fail because of the nonce, got %v", err)
+		return
+	}
+	if err = restored.Transfer(&match.Transfer{From: transfer.From, To: transfer.To, Asset: asset, Amount: 1, Nonce: 4}); err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("Transfer over the daily limit should still fail after restoring, got %v", err)
+		return
+	}
+	if err = restored.RestoreTransfers(snapTransfers); err == nil {
+		t.Errorf("Restoring transfers over a transfer file should fail")
+		return
+	}
+
+	return
+}
+
+func TestSubAccountTransfer(t *testing.T) {
+	var err error
+
+	coin := &coinparam.RegressionNetParams
+	var asset match.Asset
+	if asset, err = match.AssetFromCoinParam(coin); err != nil {
+		t.Errorf("Error getting asset from coin param: %s", err)
+		return
+	}
+
+	var setEngines map[*coinparam.Params]match.SettlementEngine
+	if setEngines, err = cxdbmemory.CreateSettlementEngineMap([]*coinparam.Params{coin}); err != nil {
+		t.Errorf("Error creating settlement engine map: %s", err)
+		return
+	}
+	var batchEngine match.BatchSettlementEngine
+	if batchEngine, err = cxdbmemory.CreateBatchSettlementEngine(setEngines); err != nil {
+		t.Errorf("Error creating batch settlement engine: %s", err)
+		return
+	}
+	settleStore := &testResultSettlementStore{results: make(map[match.Account]*match.SettlementResult)}
+	settleStores := map[*coinparam.Params]cxdb.SettlementStore{coin: settleStore}
+
+	var server *OpencxServer
+	if server, err = InitServer(setEngines, nil, nil, nil, settleStores, ""); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+	server.SetBatchSettlementEngine(batchEngine)
+	server.SetTransferLimit(coin, 100)
+
+	var alice *koblitz.PrivateKey
+	if alice, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key: %s", err)
+		return
+	}
+
+	if err = server.DebitUser(alice.PubKey(), 2000, coin, match.ReasonDeposit, "deposit"); err != nil {
+		t.Errorf("Error debiting user: %s", err)
+		return
+	}
+
+	// Moving funds between sub-accounts is more than the limit, but doesn't count towards it
+	transfer := &match.Transfer{ToSubAccount: 1, Asset: asset, Amount: 1500, Nonce: 1}
+	copy(transfer.From[:], alice.PubKey().SerializeCompressed())
+	transfer.To = transfer.From
+	if err = server.Transfer(transfer); err != nil {
+		t.Errorf("Error transferring between sub-accounts: %s", err)
+		return
+	}
+
+	var mainAccount, strategyAccount uint32 = 0, 1
+	var available uint64
+	if available, _, err = server.GetBalance(alice.PubKey(), coin, &mainAccount); err != nil || available != 500 {
+		t.Errorf("Expected 500 in the main account, got %d, err %v", available, err)
+		return
+	}
+	if available, _, err = server.GetBalance(alice.PubKey(), coin, &strategyAccount); err != nil || available != 1500 {
+		t.Errorf("Expected 1500 in sub-account 1, got %d, err %v", available, err)
+		return
+	}
+	if available, _, err = server.GetBalance(alice.PubKey(), coin, nil); err != nil || available != 2000 {
+		t.Errorf("Expected 2000 across all sub-accounts, got %d, err %v", available, err)
+		return
+	}
+
+	// Each sub-account can only spend its own balance
+	overBalance := &match.Transfer{From: transfer.From, To: transfer.To, FromSubAccount: 0, ToSubAccount: 1, Asset: asset, Amount: 600, Nonce: 2}
+	if err = server.Transfer(overBalance); err == nil {
+		t.Errorf("Transfer of more than the sub-account balance should fail")
+		return
+	}
+
+	sameAccount := &match.Transfer{From: transfer.From, To: transfer.To, FromSubAccount: 1, ToSubAccount: 1, Asset: asset, Amount: 100, Nonce: 3}
+	if err = server.Transfer(sameAccount); err == nil {
+		t.Errorf("Transfer from a sub-account to itself should fail")
+		return
+	}
+
+	return
+}
+
+func TestTransferNonceStoredWithSettlement(t *testing.T) {
+	var err error
+
+	var rootDir string
+	if rootDir, err = ioutil.TempDir("", "transfernonce"); err != nil {
+		t.Errorf("Error creating temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(rootDir)
+
+	coin := &coinparam.RegressionNetParams
+	coins := []*coinparam.Params{coin}
+	var asset match.Asset
+	if asset, err = match.AssetFromCoinParam(coin); err != nil {
+		t.Errorf("Error getting asset from coin param: %s", err)
+		return
+	}
+
+	var db *cxdbkv.DB
+	if db, err = cxdbkv.OpenDB(filepath.Join(rootDir, "opencx.db")); err != nil {
+		t.Errorf("Error opening db: %s", err)
+		return
+	}
+	defer db.Close()
+
+	var setEngines map[*coinparam.Params]match.SettlementEngine
+	if setEngines, err = cxdbkv.CreateSettlementEngineMap(db, coins); err != nil {
+		t.Errorf("Error creating settlement engine map: %s", err)
+		return
+	}
+	var batchEngine match.BatchSettlementEngine
+	if batchEngine, err = cxdbkv.CreateBatchSettlementEngine(db, coins); err != nil {
+		t.Errorf("Error creating batch settlement engine: %s", err)
+		return
+	}
+	var ledgerStores map[*coinparam.Params]cxdb.LedgerStore
+	if ledgerStores, err = cxdbkv.CreateLedgerStoreMap(db, coins); err != nil {
+		t.Errorf("Error creating ledger store map: %s", err)
+		return
+	}
+	settleStores := map[*coinparam.Params]cxdb.SettlementStore{coin: &testResultSettlementStore{results: make(map[match.Account]*match.SettlementResult)}}
+
+	var server *OpencxServer
+	if server, err = InitServer(setEngines, nil, nil, nil, settleStores, rootDir); err != nil {
+		t.Errorf("Error initializing server: %s", err)
+		return
+	}
+	server.SetBatchSettlementEngine(batchEngine)
+	server.SetLedgerStores(ledgerStores)
+
+	var alice, bob *koblitz.PrivateKey
+	if alice, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key: %s", err)
+		return
+	}
+	if bob, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key: %s", err)
+		return
+	}
+
+	if err = server.DebitUser(alice.PubKey(), 2000, coin, match.ReasonDeposit, "deposit"); err != nil {
+		t.Errorf("Error debiting user: %s", err)
+		return
+	}
+
+	transfer := &match.Transfer{Asset: asset, Amount: 600, Nonce: 7}
+	copy(transfer.From[:], alice.PubKey().SerializeCompressed())
+	copy(transfer.To[:], bob.PubKey().SerializeCompressed())
+	if err = server.Transfer(transfer); err != nil {
+		t.Errorf("Error transferring: %s", err)
+		return
+	}
+
+	// If the server stops after the transfer is settled but before it's written to the transfer
+	// file, the nonce is still in the ledger
+	if err = os.Remove(filepath.Join(rootDir, transferFileName)); err != nil {
+		t.Errorf("Error removing transfer file: %s", err)
+		return
+	}
+
+	var restarted *OpencxServer
+	if restarted, err = InitServer(setEngines, nil, nil, nil, settleStores, rootDir); err != nil {
+		t.Errorf("Error initializing restarted server: %s", err)
+		return
+	}
+	restarted.SetBatchSettlementEngine(batchEngine)
+	restarted.SetLedgerStores(ledgerStores)
+	if err = restarted.LoadTransfers(); err != nil {
+		t.Errorf("Error loading transfers: %s", err)
+		return
+	}
+	if err = restarted.Transfer(transfer); err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Errorf("Replaying a transfer whose nonce is only in the ledger should fail, got %v", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,81 @@
+package cxserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/opencx/match"
+)
+
+// OrderUpdate is a change to an order: it was placed, filled, or taken out of the orderbook
+type OrderUpdate struct {
+	// Order is the order as it was before the update
+	Order  *match.LimitOrderIDPair
+	Status match.OrderStatus
+	// Fill is set if the update is an execution of the order
+	Fill *match.OrderFill
+	// Taker is whether or not the order was the one being placed when it was updated
+	Taker bool
+}
+
+// ExchangeUpdate is everything that changed in the orderbooks and balances for one write, in the
+// order the changes were applied
+type ExchangeUpdate struct {
+	Pair     match.Pair
+	Orders   []*OrderUpdate
+	Balances []*match.SettlementResult
+	Time     time.Time
+}
+
+// UpdateHandler is called with every update once it has been applied to the orderbooks and
+// settlement stores. Handlers are called one at a time in the order the writes happened, from the
+// goroutine applying them, so they should not block or call the server.
+type UpdateHandler func(update *ExchangeUpdate)
+
+// RegisterUpdateHandler makes the handler get called with every update applied after this
+func (server *OpencxServer) RegisterUpdateHandler(handler UpdateHandler) {
+	server.updateMtx.Lock()
+	server.updateHandlers = append(server.updateHandlers, handler)
+	server.updateMtx.Unlock()
+	return
+}
+
+// getUpdateHandlers returns the registered handlers
+func (server *OpencxServer) getUpdateHandlers() (handlers []UpdateHandler) {
+	server.updateMtx.Lock()
+	handlers = make([]UpdateHandler, len(server.updateHandlers))
+	copy(handlers, server.updateHandlers)
+	server.updateMtx.Unlock()
+	return
+}
+
+// execUpdate returns the update for an order execution. This has to be called before the
+// execution is applied to the orderbook, so the order still has what it had left.
+func execUpdate(book match.LimitOrderbook, orderExec *match.OrderExecution, fillTime time.Time) (orderUpdate *OrderUpdate, err error) {
+	var order *match.LimitOrderIDPair
+	if order, err = book.GetOrder(&orderExec.OrderID); err != nil {
+		err = fmt.Errorf("Error getting order for execUpdate: %s", err)
+		return
+	}
+
+	orderUpdate = &OrderUpdate{
+		Order:  order,
+		Status: match.OrderPartiallyFilled,
+		Fill:   match.NewOrderFill(order.Order.AmountWant, order.Order.AmountHave, orderExec, fillTime),
+	}
+	if orderExec.Filled {
+		orderUpdate.Status = match.OrderFilled
+	}
+	return
+}
+
+// cancelStatus sets the status of the update for a cancelled order, once it has been archived
+func cancelStatus(book match.LimitOrderbook, orderUpdate *OrderUpdate) (err error) {
+	var archived *match.ArchivedLimitOrder
+	if archived, err = book.GetArchivedOrder(orderUpdate.Order.OrderID); err != nil {
+		err = fmt.Errorf("Error getting archived order for cancelStatus: %s", err)
+		return
+	}
+	orderUpdate.Status = archived.Status
+	return
+}
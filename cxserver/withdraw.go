@@ -5,11 +5,8 @@ import (
 	"fmt"
 
 	"github.com/mit-dci/lit/consts"
-	"github.com/mit-dci/lit/lnp2p"
-	"github.com/mit-dci/lit/qln"
 	"github.com/mit-dci/opencx/logging"
-
-	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/opencx/match"
 
 	"github.com/mit-dci/lit/coinparam"
 	"github.com/mit-dci/lit/crypto/koblitz"
@@ -34,6 +31,11 @@ func (server *OpencxServer) WithdrawCoins(address string, pubkey *koblitz.Public
 		return
 	}
 
+	if server.WithdrawalsHalted(params) {
+		err = fmt.Errorf("Withdrawals of %s are halted until the exchange's wallet is reconciled", params.Name)
+		return
+	}
+
 	// Create the function, basically make sure the wallet stuff is alright
 	var withdrawFunction func(string, *koblitz.PublicKey, uint64) (string, error)
 	if withdrawFunction, err = server.withdrawFromChain(params); err != nil {
@@ -58,6 +60,11 @@ func (server *OpencxServer) WithdrawLightning(pubkey *koblitz.PublicKey, amount
 		return
 	}
 
+	if server.WithdrawalsHalted(params) {
+		err = fmt.Errorf("Withdrawals of %s are halted until the exchange's wallet is reconciled", params.Name)
+		return
+	}
+
 	// Create the function, basically make sure the wallet stuff is alright
 	var withdrawFunction func(*koblitz.PublicKey, int64) (string, error)
 	if withdrawFunction, err = server.withdrawFromLightning(params); err != nil {
@@ -91,11 +98,15 @@ func (server *OpencxServer) withdrawFromChain(params *coinparam.Params) (withdra
 		}
 
 		// clearing settlement layer
-		if err = server.CreditUser(pubkey, amount, params); err != nil {
+		if err = server.CreditUser(pubkey, amount, params, match.ReasonWithdrawal, address); err != nil {
 			err = fmt.Errorf("Error while crediting user for CreateChannel: %s\n", err)
 			return
 		}
 
+		// the coins are still in the wallet until the transaction is sent
+		server.addInFlightWithdrawal(params, amount)
+		defer server.removeInFlightWithdrawal(params, amount)
+
 		// Decoding given address
 		var addr btcutil.Address
 		if addr, err = btcutil.DecodeAddress(address, params); err != nil {
@@ -149,9 +160,14 @@ func (server *OpencxServer) withdrawFromChain(params *coinparam.Params) (withdra
 	return
 }
 
-// withdrawFromChain returns a function that we'll then call from the vtc stuff -- this is a closure that's also a method for server, don't worry about it lol
+// withdrawFromLightning returns a function that we'll then call from the vtc stuff -- this is a closure that's also a method for server, don't worry about it lol
 func (server *OpencxServer) withdrawFromLightning(params *coinparam.Params) (withdrawFunction func(*koblitz.PublicKey, int64) (string, error), err error) {
 
+	if server.Lightning == nil {
+		err = fmt.Errorf("No lightning backend set up, can't withdraw over lightning")
+		return
+	}
+
 	withdrawFunction = func(pubkey *koblitz.PublicKey, amount int64) (txid string, err error) {
 
 		if amount <= 0 {
@@ -159,10 +175,15 @@ func (server *OpencxServer) withdrawFromLightning(params *coinparam.Params) (wit
 			return
 		}
 
-		// calculate fee, do this using subwallet because the funding will all be done through lit
-		// TODO: figure out if there is redundancy with server.WalletMap and server.ExchangeNode.SubWallet and
+		// calculate fee, do this using the lightning wallet because the funding will all be done through lit
+		// TODO: figure out if there is redundancy with server.WalletMap and the lightning wallets and
 		// if that redundancy is necessary. It might be
-		fee := server.ExchangeNode.SubWallet[params.HDCoinType].Fee() * 1000
+		var fee int64
+		if fee, err = server.Lightning.Fee(params.HDCoinType); err != nil {
+			err = fmt.Errorf("Error getting fee for lightning withdrawal: %s", err)
+			return
+		}
+		fee *= 1000
 		if amount < consts.MinOutput+fee {
 			err = fmt.Errorf("You can't withdraw any less than %d %s", consts.MinOutput+fee, params.Name)
 			return
@@ -177,7 +198,7 @@ func (server *OpencxServer) withdrawFromLightning(params *coinparam.Params) (wit
 		logging.Infof("Checking if connected to peer")
 
 		// if we already have a channel and we can, we should push
-		if !server.ExchangeNode.ConnectedToPeer(peerIdx) {
+		if !server.Lightning.ConnectedToPeer(peerIdx) {
 			err = fmt.Errorf("Not connected to peer! Please connect to the exchange. We don't know how to connect to you")
 			return
 		}
@@ -193,33 +214,34 @@ func (server *OpencxServer) withdrawFromLightning(params *coinparam.Params) (wit
 		// TODO: this should only happen when we get a proof that the other person actually took the withdraw / updated the state. We don't have a guarantee that they will always accept
 
 		// clearing settlement layer
-		if err = server.CreditUser(pubkey, uint64(amount), params); err != nil {
+		if err = server.CreditUser(pubkey, uint64(amount), params, match.ReasonWithdrawal, "lightning channel"); err != nil {
 			err = fmt.Errorf("Error while crediting user for CreateChannel: %s\n", err)
 			return
 		}
 
-		// check if any of the channels are of the correct param and have enough capacity (-[min+fee])
+		// the coins are still in the wallet until the channel is funded
+		server.addInFlightWithdrawal(params, uint64(amount))
+		defer server.removeInFlightWithdrawal(params, uint64(amount))
 
-		// make data but we don't really want any
-		noData := new([32]byte)
+		// check if any of the channels are of the correct param and have enough capacity (-[min+fee])
 
 		logging.Infof("Trying to fund channel")
-		// retrieve chanIdx because we need it for qchan for outpoint hash, if that's not useful anymore just make this chanIdx => _
+		// retrieve chanIdx because we need it for the channel's outpoint hash, if that's not useful anymore just make this chanIdx => _
 		var chanIdx uint32
-		if chanIdx, err = server.ExchangeNode.FundChannel(peerIdx, params.HDCoinType, ccap, amount, *noData); err != nil {
+		if chanIdx, err = server.Lightning.FundChannel(peerIdx, params.HDCoinType, ccap, amount); err != nil {
 			return
 		}
 
-		logging.Infof("Getting qchanidx")
-		// get qchan so we can get the outpoint hash
-		var qchan *qln.Qchan
-		if qchan, err = server.ExchangeNode.GetQchanByIdx(chanIdx); err != nil {
+		logging.Infof("Getting channel")
+		// get the channel so we can get the outpoint hash
+		var channel *LightningChannel
+		if channel, err = server.Lightning.GetChannel(chanIdx); err != nil {
 			return
 		}
 
 		logging.Infof("We're pretty much done with this withdraw")
 		// get outpoint hash because that's useful information to return
-		txid = qchan.Op.Hash.String()
+		txid = channel.Txid
 
 		return
 	}
@@ -229,20 +251,20 @@ func (server *OpencxServer) withdrawFromLightning(params *coinparam.Params) (wit
 // GetPeerFromPubkey gets a peer index from a pubkey.
 func (server *OpencxServer) GetPeerFromPubkey(pubkey *koblitz.PublicKey) (peerIdx uint32, err error) {
 
-	var pubkey33 [33]byte
-	copy(pubkey33[:], pubkey.SerializeCompressed())
-	litAddr := lnutil.LitAdrFromPubkey(pubkey33)
+	if server.Lightning == nil {
+		err = fmt.Errorf("No lightning backend set up, can't find peer")
+		return
+	}
 
-	// until this is removed, this is good for our purposes
-	if peerIdx, err = server.ExchangeNode.FindPeerIndexByAddress(litAddr); err != nil {
+	if peerIdx, err = server.Lightning.GetPeerIdx(pubkey); err != nil {
 		return
 	}
 
 	return
 }
 
-// GetQchansByPeerParam gets channel indexes for a param and pubkey / peer
-func (server *OpencxServer) GetQchansByPeerParam(pubkey *koblitz.PublicKey, param *coinparam.Params) (qchans []*qln.Qchan, err error) {
+// GetChannelsByPeerParam gets the channels we have with a pubkey / peer for a param
+func (server *OpencxServer) GetChannelsByPeerParam(pubkey *koblitz.PublicKey, param *coinparam.Params) (channels []*LightningChannel, err error) {
 
 	// get the peer idx
 	var peerIdx uint32
@@ -250,35 +272,16 @@ func (server *OpencxServer) GetQchansByPeerParam(pubkey *koblitz.PublicKey, para
 		return
 	}
 
-	// get the peer
-	var peer *lnp2p.Peer
-	if peer = server.ExchangeNode.PeerMan.GetPeerByIdx(int32(peerIdx)); err != nil {
-		return
-	}
-
-	// lock this so we can be in peace
-	server.ExchangeNode.PeerMapMtx.Lock()
-	// get the remote peer from the qchan
-	var remotePeer *qln.RemotePeer
-	var found bool
-	if remotePeer, found = server.ExchangeNode.PeerMap[peer]; !found {
-		err = fmt.Errorf("Could not find remote peer that peer manager is tracking, there's something wrong with the lit node")
-		// unlock because we have to before we return or else we deadlock
-		server.ExchangeNode.PeerMapMtx.Unlock()
-		return
-	}
-	server.ExchangeNode.PeerMapMtx.Unlock()
-
-	// populate qchans just to be safe -- this might not be necessary and makes this function very inefficient
-	if err = server.ExchangeNode.PopulateQchanMap(remotePeer); err != nil {
+	var allChannels []*LightningChannel
+	if allChannels, err = server.Lightning.ListChannels(); err != nil {
 		return
 	}
 
-	// get qchans from peer
-	for _, qchan := range remotePeer.QCs {
-		// if this is the same coin then return the idx
-		if qchan.Coin() == param.HDCoinType {
-			qchans = append(qchans, qchan)
+	// get channels with the peer
+	for _, channel := range allChannels {
+		// if this is the same coin then return the channel
+		if channel.PeerIdx == peerIdx && channel.CoinType == param.HDCoinType {
+			channels = append(channels, channel)
 		}
 	}
 
@@ -0,0 +1,179 @@
+package cxws
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mit-dci/opencx/match"
+)
+
+const (
+	// OpAuth authenticates the session with a signature of the challenge, so it can subscribe to
+	// private channels. The args are AuthArgs.
+	OpAuth = "auth"
+	// OpSubscribe subscribes to a channel. Public channels need a pair.
+	OpSubscribe = "subscribe"
+	// OpUnsubscribe unsubscribes from a channel
+	OpUnsubscribe = "unsubscribe"
+	// OpPlaceOrder places an order. The args are cxrpc.SubmitOrderArgs, and the reply is
+	// cxrpc.SubmitOrderReply.
+	OpPlaceOrder = "placeorder"
+	// OpCancelOrder cancels an order. The args are cxrpc.CancelOrderArgs.
+	OpCancelOrder = "cancelorder"
+)
+
+const (
+	// ChannelBook is the public channel for the orders in the orderbook for a pair
+	ChannelBook = "book"
+	// ChannelTrades is the public channel for the trades for a pair
+	ChannelTrades = "trades"
+	// ChannelTicker is the public channel for the last trade and best prices for a pair
+	ChannelTicker = "ticker"
+	// ChannelFills is the private channel for the fills of the session's orders
+	ChannelFills = "fills"
+	// ChannelOrders is the private channel for the status of the session's orders
+	ChannelOrders = "orders"
+	// ChannelBalances is the private channel for the session's balances
+	ChannelBalances = "balances"
+)
+
+const (
+	// MessageChallenge is sent when a session starts, with the Challenge to sign for OpAuth
+	MessageChallenge = "challenge"
+	// MessageReply is sent when a request succeeds, with the ID of the request
+	MessageReply = "reply"
+	// MessageError is sent when a request fails, with the ID of the request
+	MessageError = "error"
+	// MessageSnapshot is sent when the book channel is subscribed to, with the whole Book
+	MessageSnapshot = "snapshot"
+	// MessageUpdate is sent for every change to a channel that is subscribed to
+	MessageUpdate = "update"
+)
+
+// publicChannels are the channels that any session can subscribe to, for a pair
+var publicChannels = map[string]bool{
+	ChannelBook:   true,
+	ChannelTrades: true,
+	ChannelTicker: true,
+}
+
+// privateChannels are the channels that only authenticated sessions can subscribe to, for every
+// pair
+var privateChannels = map[string]bool{
+	ChannelFills:    true,
+	ChannelOrders:   true,
+	ChannelBalances: true,
+}
+
+// Request is a message from a client. Pairs are written like the ocx client takes them, for
+// example "regtest/litereg".
+type Request struct {
+	// ID is sent back with the reply or error for the request
+	ID      uint64          `json:"id"`
+	Op      string          `json:"op"`
+	Channel string          `json:"channel,omitempty"`
+	Pair    string          `json:"pair,omitempty"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// Message is a message to a client
+type Message struct {
+	Type    string      `json:"type"`
+	ID      uint64      `json:"id,omitempty"`
+	Channel string      `json:"channel,omitempty"`
+	Pair    string      `json:"pair,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// Challenge is the data of the challenge message. AuthString followed by the challenge is what
+// has to be signed to authenticate.
+type Challenge struct {
+	Challenge string `json:"challenge"`
+}
+
+// AuthArgs holds the args for OpAuth
+type AuthArgs struct {
+	// Signature is a compact signature of the sha3-256 of AuthString followed by the challenge,
+	// so the pubkey can be recovered
+	Signature []byte `json:"signature"`
+}
+
+// AuthReply is the data of the reply to OpAuth
+type AuthReply struct {
+	Pubkey [33]byte `json:"pubkey"`
+}
+
+// BookOrder is an order in the orderbook with what it has left. Orders with nothing left have
+// been filled or cancelled, and are no longer in the orderbook.
+type BookOrder struct {
+	OrderID    *match.OrderID `json:"orderid"`
+	Side       match.Side     `json:"side"`
+	Price      float64        `json:"price"`
+	AmountWant uint64         `json:"amountwant"`
+	AmountHave uint64         `json:"amounthave"`
+}
+
+// Book is the data of the book channel: every order in the orderbook for the snapshot, and the
+// orders that changed for an update. Each order is sent with what it has left after the update,
+// so applying an update that the snapshot already has does nothing.
+type Book struct {
+	Orders []*BookOrder `json:"orders"`
+}
+
+// Trade is the data of the trades channel. The order, side, price and amounts are the maker's.
+type Trade struct {
+	OrderID    *match.OrderID `json:"orderid"`
+	Side       match.Side     `json:"side"`
+	Price      float64        `json:"price"`
+	AmountWant uint64         `json:"amountwant"`
+	AmountHave uint64         `json:"amounthave"`
+	Time       time.Time      `json:"time"`
+}
+
+// Ticker is the data of the ticker channel. Prices are like the orderbook's: the best buy price is
+// the price of the buy order that would match first, which is the lowest, and the best sell price
+// is the highest. A price is 0 if there isn't one.
+type Ticker struct {
+	LastPrice     float64   `json:"lastprice"`
+	BestBuyPrice  float64   `json:"bestbuyprice"`
+	BestSellPrice float64   `json:"bestsellprice"`
+	Time          time.Time `json:"time"`
+}
+
+// Fill is the data of the fills channel
+type Fill struct {
+	OrderID    *match.OrderID `json:"orderid"`
+	Pair       string         `json:"pair"`
+	Side       match.Side     `json:"side"`
+	Price      float64        `json:"price"`
+	AmountWant uint64         `json:"amountwant"`
+	AmountHave uint64         `json:"amounthave"`
+	Taker      bool           `json:"taker"`
+	Time       time.Time      `json:"time"`
+}
+
+// OrderState is the data of the orders channel, with what the order has left
+type OrderState struct {
+	OrderID    *match.OrderID    `json:"orderid"`
+	Pair       string            `json:"pair"`
+	Side       match.Side        `json:"side"`
+	Price      float64           `json:"price"`
+	Status     match.OrderStatus `json:"status"`
+	AmountWant uint64            `json:"amountwant"`
+	AmountHave uint64            `json:"amounthave"`
+}
+
+// Balance is the data of the balances channel
+type Balance struct {
+	Asset      string `json:"asset"`
+	SubAccount uint32 `json:"subaccount"`
+	Available  uint64 `json:"available"`
+	InOrders   uint64 `json:"inorders"`
+}
+
+// pairString returns the pair the way requests have it
+func pairString(pair match.Pair) (pairStr string) {
+	pairStr = pair.AssetWant.String() + "/" + pair.AssetHave.String()
+	return
+}
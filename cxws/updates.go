@@ -0,0 +1,193 @@
+package cxws
+
+import (
+	"time"
+
+	"github.com/mit-dci/opencx/cxserver"
+	"github.com/mit-dci/opencx/logging"
+	"github.com/mit-dci/opencx/match"
+)
+
+// handleUpdate sends an update from the server to the sessions that are subscribed to what
+// changed. This is called by the server, so it only queues messages and never blocks.
+func (wss *WebSocketServer) handleUpdate(update *cxserver.ExchangeUpdate) {
+	pairStr := pairString(update.Pair)
+
+	book := &Book{}
+	var trades []*Trade
+	fills := make(map[[33]byte][]*Fill)
+	orders := make(map[[33]byte][]*OrderState)
+	for _, orderUpdate := range update.Orders {
+		limitIDPair := orderUpdate.Order
+		amountWant, amountHave := remainingAmounts(orderUpdate)
+		pubkey := limitIDPair.Order.Pubkey
+
+		book.Orders = append(book.Orders, &BookOrder{
+			OrderID:    limitIDPair.OrderID,
+			Side:       limitIDPair.Order.Side,
+			Price:      limitIDPair.Price,
+			AmountWant: amountWant,
+			AmountHave: amountHave,
+		})
+		orders[pubkey] = append(orders[pubkey], &OrderState{
+			OrderID:    limitIDPair.OrderID,
+			Pair:       pairStr,
+			Side:       limitIDPair.Order.Side,
+			Price:      limitIDPair.Price,
+			Status:     orderUpdate.Status,
+			AmountWant: amountWant,
+			AmountHave: amountHave,
+		})
+
+		if orderUpdate.Fill == nil {
+			continue
+		}
+		fills[pubkey] = append(fills[pubkey], &Fill{
+			OrderID:    limitIDPair.OrderID,
+			Pair:       pairStr,
+			Side:       limitIDPair.Order.Side,
+			Price:      limitIDPair.Price,
+			AmountWant: orderUpdate.Fill.AmountWant,
+			AmountHave: orderUpdate.Fill.AmountHave,
+			Taker:      orderUpdate.Taker,
+			Time:       orderUpdate.Fill.Time,
+		})
+		// each trade has a maker and a taker, so only the maker's side is a trade
+		if !orderUpdate.Taker {
+			trades = append(trades, &Trade{
+				OrderID:    limitIDPair.OrderID,
+				Side:       limitIDPair.Order.Side,
+				Price:      limitIDPair.Price,
+				AmountWant: orderUpdate.Fill.AmountWant,
+				AmountHave: orderUpdate.Fill.AmountHave,
+				Time:       orderUpdate.Fill.Time,
+			})
+		}
+	}
+
+	balances := make(map[[33]byte][]*Balance)
+	for _, setRes := range update.Balances {
+		if setRes == nil || setRes.SuccessfulExec == nil {
+			continue
+		}
+		pubkey := setRes.SuccessfulExec.Pubkey
+		balances[pubkey] = append(balances[pubkey], &Balance{
+			Asset:      setRes.SuccessfulExec.Asset.String(),
+			SubAccount: setRes.SuccessfulExec.SubAccount,
+			Available:  setRes.NewBal,
+			InOrders:   setRes.NewHeld,
+		})
+	}
+
+	wss.mtx.Lock()
+	if len(trades) > 0 {
+		wss.lastPrices[update.Pair] = trades[len(trades)-1].Price
+	}
+	if len(update.Orders) > 0 {
+		wss.dirtyTickers[update.Pair] = true
+		wss.wakeTickers()
+	}
+
+	for sess := range wss.sessions {
+		if len(book.Orders) > 0 && sess.subs[subscription{channel: ChannelBook, pair: update.Pair}] {
+			sess.queue(&Message{Type: MessageUpdate, Channel: ChannelBook, Pair: pairStr, Data: book})
+		}
+		if sess.subs[subscription{channel: ChannelTrades, pair: update.Pair}] {
+			for _, trade := range trades {
+				sess.queue(&Message{Type: MessageUpdate, Channel: ChannelTrades, Pair: pairStr, Data: trade})
+			}
+		}
+
+		if !sess.authed {
+			continue
+		}
+		if sess.subs[subscription{channel: ChannelFills}] {
+			for _, fill := range fills[sess.pubkey] {
+				sess.queue(&Message{Type: MessageUpdate, Channel: ChannelFills, Data: fill})
+			}
+		}
+		if sess.subs[subscription{channel: ChannelOrders}] {
+			for _, order := range orders[sess.pubkey] {
+				sess.queue(&Message{Type: MessageUpdate, Channel: ChannelOrders, Data: order})
+			}
+		}
+		if sess.subs[subscription{channel: ChannelBalances}] {
+			for _, balance := range balances[sess.pubkey] {
+				sess.queue(&Message{Type: MessageUpdate, Channel: ChannelBalances, Data: balance})
+			}
+		}
+	}
+	wss.mtx.Unlock()
+	return
+}
+
+// remainingAmounts returns what an order has left after an update
+func remainingAmounts(orderUpdate *cxserver.OrderUpdate) (amountWant uint64, amountHave uint64) {
+	switch {
+	case orderUpdate.Fill != nil:
+		amountWant = orderUpdate.Order.Order.AmountWant - orderUpdate.Fill.AmountWant
+		amountHave = orderUpdate.Order.Order.AmountHave - orderUpdate.Fill.AmountHave
+	case orderUpdate.Status == match.OrderOpen || orderUpdate.Status == match.OrderPartiallyFilled:
+		amountWant = orderUpdate.Order.Order.AmountWant
+		amountHave = orderUpdate.Order.Order.AmountHave
+	}
+	return
+}
+
+// wakeTickers makes the tickers get updated. This assumes mtx is held.
+func (wss *WebSocketServer) wakeTickers() {
+	select {
+	case wss.tickerWake <- true:
+	default:
+	}
+	return
+}
+
+// updateTickers sends the tickers for the pairs that changed until the server is stopped. The
+// best prices come from the orderbooks, so this is done here rather than in handleUpdate.
+func (wss *WebSocketServer) updateTickers() {
+	for {
+		select {
+		case <-wss.tickerWake:
+		case <-wss.quit:
+			return
+		}
+
+		wss.mtx.Lock()
+		pairs := wss.dirtyTickers
+		wss.dirtyTickers = make(map[match.Pair]bool)
+		wss.mtx.Unlock()
+
+		for pair := range pairs {
+			ticker := &Ticker{Time: time.Now()}
+
+			var book map[float64][]*match.LimitOrderIDPair
+			var err error
+			if book, err = wss.Server.ViewOrderbook(&pair); err != nil {
+				logging.Errorf("Error viewing orderbook for websocket ticker: %s", err)
+				continue
+			}
+			for price, orders := range book {
+				for _, order := range orders {
+					if order.Order.Side == match.Buy && (ticker.BestBuyPrice == 0 || price < ticker.BestBuyPrice) {
+						ticker.BestBuyPrice = price
+					}
+					if order.Order.Side == match.Sell && price > ticker.BestSellPrice {
+						ticker.BestSellPrice = price
+					}
+				}
+			}
+
+			pairStr := pairString(pair)
+			tickerSub := subscription{channel: ChannelTicker, pair: pair}
+			wss.mtx.Lock()
+			ticker.LastPrice = wss.lastPrices[pair]
+			for sess := range wss.sessions {
+				if sess.subs[tickerSub] {
+					sess.queue(&Message{Type: MessageUpdate, Channel: ChannelTicker, Pair: pairStr, Data: ticker})
+				}
+			}
+			wss.mtx.Unlock()
+		}
+	}
+}
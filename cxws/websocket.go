@@ -0,0 +1,394 @@
+package cxws
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxrpc"
+	"github.com/mit-dci/opencx/cxserver"
+	"github.com/mit-dci/opencx/logging"
+	"github.com/mit-dci/opencx/match"
+	"golang.org/x/crypto/sha3"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// AuthString is signed along with the challenge to authenticate, so the signature can't be
+	// used for anything else
+	AuthString = "opencx-wsauth:"
+
+	// challengeSize is the number of random bytes in a challenge
+	challengeSize = 32
+	// sendBuffer is how many messages can be waiting to be sent to a session before it's closed
+	// for being too slow
+	sendBuffer = 256
+)
+
+// WebSocketServer serves market data and trading for an OpencxServer over websockets. Orders are
+// placed and cancelled through the same code as the RPC server, and updates are pushed to the
+// sessions that subscribe to them as the orderbooks and balances are updated.
+type WebSocketServer struct {
+	Server *cxserver.OpencxServer
+
+	rpc      *cxrpc.OpencxRPC
+	wsServer websocket.Server
+
+	// sessions, their subscriptions, and what the tickers are made from are guarded by mtx
+	sessions     map[*session]bool
+	lastPrices   map[match.Pair]float64
+	dirtyTickers map[match.Pair]bool
+	mtx          *sync.Mutex
+
+	tickerWake chan bool
+	quit       chan bool
+	stopOnce   sync.Once
+
+	listener   net.Listener
+	httpServer *http.Server
+}
+
+// session is a websocket connection
+type session struct {
+	conn *websocket.Conn
+	send chan *Message
+	// done is closed when the session should stop
+	done      chan bool
+	closeOnce sync.Once
+	challenge string
+
+	// these are guarded by the server's mtx
+	authed bool
+	pubkey [33]byte
+	subs   map[subscription]bool
+}
+
+// subscription is a channel a session is subscribed to. Private channels have no pair.
+type subscription struct {
+	channel string
+	pair    match.Pair
+}
+
+// NewWebSocketServer creates a websocket server for the OpencxServer, and registers it for the
+// server's updates
+func NewWebSocketServer(server *cxserver.OpencxServer) (wss *WebSocketServer) {
+	wss = &WebSocketServer{
+		Server:       server,
+		rpc:          &cxrpc.OpencxRPC{Server: server},
+		sessions:     make(map[*session]bool),
+		lastPrices:   make(map[match.Pair]float64),
+		dirtyTickers: make(map[match.Pair]bool),
+		mtx:          new(sync.Mutex),
+		tickerWake:   make(chan bool, 1),
+		quit:         make(chan bool),
+	}
+	// Browsers authenticate with a signature rather than cookies, so there's no need to check
+	// the origin
+	wss.wsServer = websocket.Server{Handler: wss.serveSession}
+
+	server.RegisterUpdateHandler(wss.handleUpdate)
+	go wss.updateTickers()
+	return
+}
+
+// ServeHTTP upgrades the request to a websocket and serves the session
+func (wss *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wss.wsServer.ServeHTTP(w, r)
+	return
+}
+
+// serveSession sends the challenge, then handles requests until the connection is closed
+func (wss *WebSocketServer) serveSession(conn *websocket.Conn) {
+	challengeBytes := make([]byte, challengeSize)
+	if _, err := rand.Read(challengeBytes); err != nil {
+		logging.Errorf("Error creating challenge for websocket session: %s", err)
+		return
+	}
+
+	sess := &session{
+		conn:      conn,
+		send:      make(chan *Message, sendBuffer),
+		done:      make(chan bool),
+		challenge: hex.EncodeToString(challengeBytes),
+		subs:      make(map[subscription]bool),
+	}
+
+	wss.mtx.Lock()
+	wss.sessions[sess] = true
+	wss.mtx.Unlock()
+
+	writerDone := make(chan bool)
+	go func() {
+		sess.writeMessages()
+		close(writerDone)
+	}()
+
+	sess.queue(&Message{Type: MessageChallenge, Data: &Challenge{Challenge: sess.challenge}})
+
+	for {
+		req := new(Request)
+		if err := websocket.JSON.Receive(conn, req); err != nil {
+			logging.Debugf("Websocket session done: %s", err)
+			break
+		}
+
+		var data interface{}
+		var err error
+		if data, err = wss.handleRequest(sess, req); err != nil {
+			sess.queue(&Message{Type: MessageError, ID: req.ID, Error: err.Error()})
+			continue
+		}
+		sess.queue(&Message{Type: MessageReply, ID: req.ID, Data: data})
+	}
+
+	wss.mtx.Lock()
+	delete(wss.sessions, sess)
+	wss.mtx.Unlock()
+	sess.close()
+	<-writerDone
+	return
+}
+
+// writeMessages sends the queued messages until the session is done, then closes the connection
+func (sess *session) writeMessages() {
+	for {
+		select {
+		case msg := <-sess.send:
+			if err := websocket.JSON.Send(sess.conn, msg); err != nil {
+				logging.Debugf("Error sending websocket message: %s", err)
+				sess.close()
+			}
+		case <-sess.done:
+			if err := sess.conn.Close(); err != nil {
+				logging.Debugf("Error closing websocket session: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// queue queues a message to be sent without blocking. If the session is too far behind, it's
+// closed instead.
+func (sess *session) queue(msg *Message) {
+	select {
+	case sess.send <- msg:
+	default:
+		logging.Warnf("Closing websocket session that is too slow to send to")
+		sess.close()
+	}
+	return
+}
+
+// close makes the session stop
+func (sess *session) close() {
+	sess.closeOnce.Do(func() { close(sess.done) })
+	return
+}
+
+// handleRequest does what a request asks, and returns the data for the reply
+func (wss *WebSocketServer) handleRequest(sess *session, req *Request) (data interface{}, err error) {
+	switch req.Op {
+	case OpAuth:
+		args := new(AuthArgs)
+		if err = decodeArgs(req, args); err != nil {
+			return
+		}
+		if data, err = wss.auth(sess, args); err != nil {
+			err = fmt.Errorf("Error authenticating: %s", err)
+			return
+		}
+	case OpSubscribe:
+		if err = wss.subscribe(sess, req); err != nil {
+			err = fmt.Errorf("Error subscribing: %s", err)
+			return
+		}
+	case OpUnsubscribe:
+		var sub subscription
+		if sub, err = wss.parseSubscription(req); err != nil {
+			err = fmt.Errorf("Error unsubscribing: %s", err)
+			return
+		}
+		wss.mtx.Lock()
+		delete(sess.subs, sub)
+		wss.mtx.Unlock()
+	case OpPlaceOrder:
+		args := new(cxrpc.SubmitOrderArgs)
+		if err = decodeArgs(req, args); err != nil {
+			return
+		}
+		if args.Order == nil {
+			err = fmt.Errorf("Error placing order: no order")
+			return
+		}
+		reply := new(cxrpc.SubmitOrderReply)
+		if err = wss.rpc.SubmitOrder(*args, reply); err != nil {
+			return
+		}
+		data = reply
+	case OpCancelOrder:
+		args := new(cxrpc.CancelOrderArgs)
+		if err = decodeArgs(req, args); err != nil {
+			return
+		}
+		reply := new(cxrpc.CancelOrderReply)
+		if err = wss.rpc.CancelOrder(*args, reply); err != nil {
+			return
+		}
+		data = reply
+	default:
+		err = fmt.Errorf("Unknown op %q", req.Op)
+	}
+	return
+}
+
+// decodeArgs decodes the args of a request
+func decodeArgs(req *Request, args interface{}) (err error) {
+	if len(req.Args) == 0 {
+		err = fmt.Errorf("No args for %s", req.Op)
+		return
+	}
+	if err = json.Unmarshal(req.Args, args); err != nil {
+		err = fmt.Errorf("Error decoding args for %s: %s", req.Op, err)
+		return
+	}
+	return
+}
+
+// auth authenticates the session as the pubkey that signed the challenge
+func (wss *WebSocketServer) auth(sess *session, args *AuthArgs) (reply *AuthReply, err error) {
+	sha3 := sha3.New256()
+	sha3.Write([]byte(AuthString + sess.challenge))
+	e := sha3.Sum(nil)
+
+	var pubkey *koblitz.PublicKey
+	if pubkey, _, err = koblitz.RecoverCompact(koblitz.S256(), args.Signature, e); err != nil {
+		err = fmt.Errorf("Invalid signature: %s", err)
+		return
+	}
+
+	reply = new(AuthReply)
+	copy(reply.Pubkey[:], pubkey.SerializeCompressed())
+
+	wss.mtx.Lock()
+	sess.authed = true
+	sess.pubkey = reply.Pubkey
+	wss.mtx.Unlock()
+	return
+}
+
+// parseSubscription returns the subscription a request is for
+func (wss *WebSocketServer) parseSubscription(req *Request) (sub subscription, err error) {
+	sub.channel = req.Channel
+	if privateChannels[req.Channel] {
+		return
+	}
+	if !publicChannels[req.Channel] {
+		err = fmt.Errorf("Unknown channel %q", req.Channel)
+		return
+	}
+
+	if req.Pair == "" {
+		err = fmt.Errorf("The %s channel needs a pair", req.Channel)
+		return
+	}
+	if err = sub.pair.FromString(req.Pair); err != nil {
+		err = fmt.Errorf("Error parsing pair %q: %s", req.Pair, err)
+		return
+	}
+	if _, ok := wss.Server.Orderbooks[sub.pair]; !ok {
+		err = fmt.Errorf("No orderbook for pair %s", req.Pair)
+		return
+	}
+	return
+}
+
+// subscribe subscribes the session to a channel. Subscribing to a book sends the snapshot of the
+// book before any of the updates.
+func (wss *WebSocketServer) subscribe(sess *session, req *Request) (err error) {
+	var sub subscription
+	if sub, err = wss.parseSubscription(req); err != nil {
+		return
+	}
+
+	wss.mtx.Lock()
+	if privateChannels[sub.channel] && !sess.authed {
+		err = fmt.Errorf("The %s channel needs the session to be authenticated", sub.channel)
+		wss.mtx.Unlock()
+		return
+	}
+
+	// The snapshot is taken while holding mtx so no update can be sent between it and the
+	// subscription. Updates that were applied before the snapshot may still be sent after it.
+	if sub.channel == ChannelBook {
+		var book map[float64][]*match.LimitOrderIDPair
+		if book, err = wss.Server.ViewOrderbook(&sub.pair); err != nil {
+			wss.mtx.Unlock()
+			return
+		}
+
+		snapshot := &Book{Orders: []*BookOrder{}}
+		for _, orders := range book {
+			for _, order := range orders {
+				snapshot.Orders = append(snapshot.Orders, &BookOrder{
+					OrderID:    order.OrderID,
+					Side:       order.Order.Side,
+					Price:      order.Price,
+					AmountWant: order.Order.AmountWant,
+					AmountHave: order.Order.AmountHave,
+				})
+			}
+		}
+		sess.queue(&Message{Type: MessageSnapshot, Channel: sub.channel, Pair: req.Pair, Data: snapshot})
+	}
+	sess.subs[sub] = true
+
+	if sub.channel == ChannelTicker {
+		wss.dirtyTickers[sub.pair] = true
+		wss.wakeTickers()
+	}
+	wss.mtx.Unlock()
+	return
+}
+
+// Listen serves websockets on host and port until Stop is called
+func (wss *WebSocketServer) Listen(host string, port uint16) (err error) {
+	serverAddr := net.JoinHostPort(host, fmt.Sprintf("%d", port))
+	if wss.listener, err = net.Listen("tcp", serverAddr); err != nil {
+		err = fmt.Errorf("Error listening for websocket server: %s", err)
+		return
+	}
+	logging.Infof("Running websocket server on %s\n", wss.listener.Addr().String())
+
+	wss.httpServer = &http.Server{Handler: wss}
+	go func() {
+		if serveErr := wss.httpServer.Serve(wss.listener); serveErr != nil && serveErr != http.ErrServerClosed {
+			logging.Errorf("Error serving websocket server: %s", serveErr)
+		}
+	}()
+	return
+}
+
+// Stop stops serving websockets and closes every session
+func (wss *WebSocketServer) Stop() (err error) {
+	logging.Infof("Stopping websocket server")
+	wss.stopOnce.Do(func() { close(wss.quit) })
+
+	if wss.httpServer != nil {
+		if err = wss.httpServer.Close(); err != nil {
+			err = fmt.Errorf("Error closing websocket server: %s", err)
+			return
+		}
+	}
+
+	wss.mtx.Lock()
+	for sess := range wss.sessions {
+		sess.close()
+	}
+	wss.mtx.Unlock()
+	return
+}
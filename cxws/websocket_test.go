@@ -0,0 +1,395 @@
+package cxws
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/lit/coinparam"
+	"github.com/mit-dci/lit/crypto/koblitz"
+	"github.com/mit-dci/opencx/cxdb"
+	"github.com/mit-dci/opencx/cxdb/cxdbmemory"
+	"github.com/mit-dci/opencx/cxrpc"
+	"github.com/mit-dci/opencx/cxserver"
+	"github.com/mit-dci/opencx/match"
+	"golang.org/x/crypto/sha3"
+	"golang.org/x/net/websocket"
+)
+
+// testTimeout is how long to wait for a message before failing
+const testTimeout = 5 * time.Second
+
+// testMessage is a message with the data left to be decoded
+type testMessage struct {
+	Type    string          `json:"type"`
+	ID      uint64          `json:"id"`
+	Channel string          `json:"channel"`
+	Pair    string          `json:"pair"`
+	Data    json.RawMessage `json:"data"`
+	Error   string          `json:"error"`
+}
+
+// testClient is a websocket session for tests
+type testClient struct {
+	conn      *websocket.Conn
+	challenge string
+	nextID    uint64
+}
+
+// createTestServer creates a server with memory engines and stores for one pair, and funds the
+// seller and buyer so they can trade it
+func createTestServer(seller *koblitz.PrivateKey, buyer *koblitz.PrivateKey) (server *cxserver.OpencxServer, pair *match.Pair, err error) {
+	coins := []*coinparam.Params{&coinparam.RegressionNetParams, &coinparam.LiteRegNetParams}
+	pair = new(match.Pair)
+	if pair.AssetWant, err = match.AssetFromCoinParam(coins[0]); err != nil {
+		return
+	}
+	if pair.AssetHave, err = match.AssetFromCoinParam(coins[1]); err != nil {
+		return
+	}
+	pairs := []*match.Pair{pair}
+
+	var setEngines map[*coinparam.Params]match.SettlementEngine
+	if setEngines, err = cxdbmemory.CreateSettlementEngineMap(coins); err != nil {
+		return
+	}
+	var batchEngine match.BatchSettlementEngine
+	if batchEngine, err = cxdbmemory.CreateBatchSettlementEngine(setEngines); err != nil {
+		return
+	}
+	var limEngines map[match.Pair]match.LimitEngine
+	if limEngines, err = cxdbmemory.CreateLimitEngineMap(pairs); err != nil {
+		return
+	}
+	var books map[match.Pair]match.LimitOrderbook
+	if books, err = cxdbmemory.CreateLimitOrderbookMap(pairs); err != nil {
+		return
+	}
+	var setStores map[*coinparam.Params]cxdb.SettlementStore
+	if setStores, err = cxdbmemory.CreateSettlementStoreMap(coins); err != nil {
+		return
+	}
+
+	if server, err = cxserver.InitServer(setEngines, limEngines, books, nil, setStores, ""); err != nil {
+		return
+	}
+	server.SetBatchSettlementEngine(batchEngine)
+	server.StartProjection()
+
+	// fills are settled from balances as well as from what was held when the order was placed,
+	// so both of them need both assets
+	for _, privkey := range []*koblitz.PrivateKey{seller, buyer} {
+		for _, coin := range coins {
+			if err = server.DebitUser(privkey.PubKey(), 10000, coin, match.ReasonDeposit, "deposit"); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// dialTestClient opens a session and reads the challenge
+func dialTestClient(server *httptest.Server) (client *testClient, err error) {
+	client = new(testClient)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	if client.conn, err = websocket.Dial(wsURL, "", server.URL); err != nil {
+		err = fmt.Errorf("Error dialing websocket: %s", err)
+		return
+	}
+
+	var msg *testMessage
+	if msg, err = client.readUntil(func(msg *testMessage) bool { return msg.Type == MessageChallenge }); err != nil {
+		return
+	}
+	challenge := new(Challenge)
+	if err = json.Unmarshal(msg.Data, challenge); err != nil {
+		return
+	}
+	client.challenge = challenge.Challenge
+	return
+}
+
+// readUntil reads messages until one matches, skipping the rest
+func (client *testClient) readUntil(matches func(msg *testMessage) bool) (msg *testMessage, err error) {
+	if err = client.conn.SetReadDeadline(time.Now().Add(testTimeout)); err != nil {
+		return
+	}
+	for {
+		msg = new(testMessage)
+		if err = websocket.JSON.Receive(client.conn, msg); err != nil {
+			err = fmt.Errorf("Error waiting for message: %s", err)
+			return
+		}
+		if matches(msg) {
+			return
+		}
+	}
+}
+
+// request sends a request and waits for its reply, which is decoded into reply if it's not nil
+func (client *testClient) request(op string, channel string, pair string, args interface{}, reply interface{}) (err error) {
+	client.nextID++
+	req := &Request{ID: client.nextID, Op: op, Channel: channel, Pair: pair}
+	if args != nil {
+		if req.Args, err = json.Marshal(args); err != nil {
+			return
+		}
+	}
+	if err = websocket.JSON.Send(client.conn, req); err != nil {
+		return
+	}
+
+	var msg *testMessage
+	if msg, err = client.readUntil(func(msg *testMessage) bool {
+		return (msg.Type == MessageReply || msg.Type == MessageError) && msg.ID == req.ID
+	}); err != nil {
+		return
+	}
+	if msg.Type == MessageError {
+		err = fmt.Errorf("%s", msg.Error)
+		return
+	}
+	if reply != nil {
+		err = json.Unmarshal(msg.Data, reply)
+	}
+	return
+}
+
+// placeOrder signs and places an order
+func (client *testClient) placeOrder(privkey *koblitz.PrivateKey, order *match.LimitOrder) (orderID string, err error) {
+	copy(order.Pubkey[:], privkey.PubKey().SerializeCompressed())
+
+	var orderBytes []byte
+	if orderBytes, err = order.Serialize(); err != nil {
+		return
+	}
+	sha3 := sha3.New256()
+	sha3.Write(orderBytes)
+	args := &cxrpc.SubmitOrderArgs{Order: order}
+	if args.Signature, err = koblitz.SignCompact(koblitz.S256(), privkey, sha3.Sum(nil), false); err != nil {
+		return
+	}
+
+	reply := new(cxrpc.SubmitOrderReply)
+	if err = client.request(OpPlaceOrder, "", "", args, reply); err != nil {
+		return
+	}
+	var idText []byte
+	if idText, err = reply.OrderID.MarshalText(); err != nil {
+		return
+	}
+	orderID = string(idText)
+	return
+}
+
+// authenticate signs the challenge
+func (client *testClient) authenticate(privkey *koblitz.PrivateKey) (err error) {
+	sha3 := sha3.New256()
+	sha3.Write([]byte(AuthString + client.challenge))
+	args := new(AuthArgs)
+	if args.Signature, err = koblitz.SignCompact(koblitz.S256(), privkey, sha3.Sum(nil), false); err != nil {
+		return
+	}
+
+	reply := new(AuthReply)
+	if err = client.request(OpAuth, "", "", args, reply); err != nil {
+		return
+	}
+	if hex.EncodeToString(reply.Pubkey[:]) != hex.EncodeToString(privkey.PubKey().SerializeCompressed()) {
+		err = fmt.Errorf("Authenticated as the wrong pubkey")
+		return
+	}
+	return
+}
+
+func TestWebSocketTrading(t *testing.T) {
+	var err error
+
+	var seller, buyer *koblitz.PrivateKey
+	if seller, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key: %s", err)
+		return
+	}
+	if buyer, err = koblitz.NewPrivateKey(koblitz.S256()); err != nil {
+		t.Errorf("Error creating private key: %s", err)
+		return
+	}
+
+	var ocxServer *cxserver.OpencxServer
+	var pair *match.Pair
+	if ocxServer, pair, err = createTestServer(seller, buyer); err != nil {
+		t.Errorf("Error creating server: %s", err)
+		return
+	}
+	pairStr := pairString(*pair)
+
+	wss := NewWebSocketServer(ocxServer)
+	defer wss.Stop()
+	server := httptest.NewServer(wss)
+	defer server.Close()
+
+	var public, sellerClient, buyerClient *testClient
+	if public, err = dialTestClient(server); err != nil {
+		t.Errorf("Error dialing public client: %s", err)
+		return
+	}
+	if sellerClient, err = dialTestClient(server); err != nil {
+		t.Errorf("Error dialing seller client: %s", err)
+		return
+	}
+	if buyerClient, err = dialTestClient(server); err != nil {
+		t.Errorf("Error dialing buyer client: %s", err)
+		return
+	}
+
+	// private channels need the session to be authenticated
+	if err = public.request(OpSubscribe, ChannelFills, "", nil, nil); err == nil {
+		t.Errorf("Subscribing to fills without authenticating should fail")
+		return
+	}
+	if err = public.request(OpSubscribe, ChannelBook, "regtest/nothing", nil, nil); err == nil {
+		t.Errorf("Subscribing to a book for an unknown pair should fail")
+		return
+	}
+	for _, channel := range []string{ChannelBook, ChannelTrades, ChannelTicker} {
+		if err = public.request(OpSubscribe, channel, pairStr, nil, nil); err != nil {
+			t.Errorf("Error subscribing to %s: %s", channel, err)
+			return
+		}
+	}
+
+	if err = sellerClient.authenticate(seller); err != nil {
+		t.Errorf("Error authenticating seller: %s", err)
+		return
+	}
+	for _, channel := range []string{ChannelFills, ChannelOrders, ChannelBalances} {
+		if err = sellerClient.request(OpSubscribe, channel, "", nil, nil); err != nil {
+			t.Errorf("Error subscribing to %s: %s", channel, err)
+			return
+		}
+	}
+
+	var sellID, buyID string
+	if sellID, err = sellerClient.placeOrder(seller, &match.LimitOrder{Side: match.Sell, TradingPair: *pair, AmountHave: 400, AmountWant: 400}); err != nil {
+		t.Errorf("Error placing sell order: %s", err)
+		return
+	}
+	if buyID, err = buyerClient.placeOrder(buyer, &match.LimitOrder{Side: match.Buy, TradingPair: *pair, AmountHave: 1000, AmountWant: 1000}); err != nil {
+		t.Errorf("Error placing buy order: %s", err)
+		return
+	}
+
+	// the sell order should be filled completely by the buy order
+	var msg *testMessage
+	if msg, err = sellerClient.readUntil(func(msg *testMessage) bool { return msg.Channel == ChannelFills }); err != nil {
+		t.Errorf("Error waiting for fill: %s", err)
+		return
+	}
+	fill := new(Fill)
+	if err = json.Unmarshal(msg.Data, fill); err != nil {
+		t.Errorf("Error decoding fill: %s", err)
+		return
+	}
+	if fill.Taker || fill.AmountHave != 400 || fill.AmountWant != 400 || fill.Pair != pairStr {
+		t.Errorf("Seller should have a maker fill of 400, got %+v", fill)
+		return
+	}
+
+	if _, err = sellerClient.readUntil(func(msg *testMessage) bool {
+		state := new(OrderState)
+		return msg.Channel == ChannelOrders && json.Unmarshal(msg.Data, state) == nil && state.Status == match.OrderFilled
+	}); err != nil {
+		t.Errorf("Error waiting for the sell order to be filled: %s", err)
+		return
+	}
+
+	// the seller gets the asset the buyer had
+	if _, err = sellerClient.readUntil(func(msg *testMessage) bool {
+		balance := new(Balance)
+		return msg.Channel == ChannelBalances && json.Unmarshal(msg.Data, balance) == nil && balance.Asset == pair.AssetHave.String() && balance.Available == 10400
+	}); err != nil {
+		t.Errorf("Error waiting for the seller's balance: %s", err)
+		return
+	}
+
+	if msg, err = public.readUntil(func(msg *testMessage) bool { return msg.Channel == ChannelTrades }); err != nil {
+		t.Errorf("Error waiting for trade: %s", err)
+		return
+	}
+	trade := new(Trade)
+	if err = json.Unmarshal(msg.Data, trade); err != nil {
+		t.Errorf("Error decoding trade: %s", err)
+		return
+	}
+	if trade.Side != match.Sell || trade.Price != 1 || trade.AmountHave != 400 {
+		t.Errorf("Trade should be the sell order's fill of 400 at 1, got %+v", trade)
+		return
+	}
+
+	if _, err = public.readUntil(func(msg *testMessage) bool {
+		ticker := new(Ticker)
+		return msg.Channel == ChannelTicker && json.Unmarshal(msg.Data, ticker) == nil && ticker.LastPrice == 1 && ticker.BestBuyPrice == 1 && ticker.BestSellPrice == 0
+	}); err != nil {
+		t.Errorf("Error waiting for ticker with the trade and the rest of the buy order: %s", err)
+		return
+	}
+
+	// the rest of the buy order should leave the book once it's cancelled
+	sha3 := sha3.New256()
+	sha3.Write([]byte(buyID))
+	cancelArgs := &cxrpc.CancelOrderArgs{OrderID: buyID}
+	if cancelArgs.Signature, err = koblitz.SignCompact(koblitz.S256(), buyer, sha3.Sum(nil), false); err != nil {
+		t.Errorf("Error signing cancel: %s", err)
+		return
+	}
+	if err = buyerClient.request(OpCancelOrder, "", "", cancelArgs, nil); err != nil {
+		t.Errorf("Error cancelling buy order: %s", err)
+		return
+	}
+
+	if _, err = public.readUntil(func(msg *testMessage) bool {
+		book := new(Book)
+		if msg.Channel != ChannelBook || msg.Type != MessageUpdate || json.Unmarshal(msg.Data, book) != nil {
+			return false
+		}
+		for _, order := range book.Orders {
+			if idText, _ := order.OrderID.MarshalText(); string(idText) == buyID && order.AmountHave == 0 {
+				return true
+			}
+		}
+		return false
+	}); err != nil {
+		t.Errorf("Error waiting for the buy order to leave the book: %s", err)
+		return
+	}
+
+	// a new book subscription should get a snapshot without either order
+	var watcher *testClient
+	if watcher, err = dialTestClient(server); err != nil {
+		t.Errorf("Error dialing watcher client: %s", err)
+		return
+	}
+	if err = websocket.JSON.Send(watcher.conn, &Request{ID: 1, Op: OpSubscribe, Channel: ChannelBook, Pair: pairStr}); err != nil {
+		t.Errorf("Error subscribing to book: %s", err)
+		return
+	}
+	if msg, err = watcher.readUntil(func(msg *testMessage) bool { return msg.Type == MessageSnapshot }); err != nil {
+		t.Errorf("Error waiting for snapshot: %s", err)
+		return
+	}
+	snapshot := new(Book)
+	if err = json.Unmarshal(msg.Data, snapshot); err != nil {
+		t.Errorf("Error decoding snapshot: %s", err)
+		return
+	}
+	if len(snapshot.Orders) != 0 {
+		t.Errorf("Book should be empty after %s is filled and %s is cancelled, got %d orders", sellID, buyID, len(snapshot.Orders))
+		return
+	}
+
+	return
+}
@@ -16,15 +16,17 @@ require (
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/jackpal/gateway v1.0.6 // indirect
 	github.com/jessevdk/go-flags v1.4.1-0.20181221193153-c0795c8afcf4
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-colorable v0.1.6 // indirect
 	github.com/mattn/go-runewidth v0.0.9 // indirect
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/minio/highwayhash v1.0.0
 	github.com/mit-dci/lit v0.0.0-20200512190823-511d703a128d
 	github.com/mit-dci/zksigma v0.0.0-20190313133734-a6a19e83b9cc
 	github.com/olekukonko/tablewriter v0.0.4
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
-	golang.org/x/net v0.0.0-20200506145744-7e3656a0809f // indirect
-	golang.org/x/sys v0.0.0-20200511232937-7e40ca221e25 // indirect
+	golang.org/x/net v0.0.0-20200506145744-7e3656a0809f
 	golang.org/x/text v0.3.2
 	google.golang.org/appengine v1.6.6 // indirect
 )
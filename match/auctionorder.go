@@ -2,6 +2,7 @@ package match
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 
@@ -124,14 +125,18 @@ func (a *AuctionOrder) GenerateOrderFill(orderID *OrderID, execPrice float64) (o
 		Filled:        true,
 	}
 	debitSetExec := SettlementExecution{
-		Amount: amountToDebit,
-		Asset:  debitAsset,
-		Type:   Debit,
+		Amount:    amountToDebit,
+		Asset:     debitAsset,
+		Type:      Debit,
+		Reason:    ReasonFill,
+		Reference: hex.EncodeToString(a.AuctionID[:]),
 	}
 	creditSetExec := SettlementExecution{
-		Amount: a.AmountHave,
-		Asset:  creditAsset,
-		Type:   Credit,
+		Amount:    a.AmountHave,
+		Asset:     creditAsset,
+		Type:      Credit,
+		Reason:    ReasonFill,
+		Reference: hex.EncodeToString(a.AuctionID[:]),
 	}
 
 	copy(debitSetExec.Pubkey[:], a.Pubkey[:])
@@ -187,14 +192,18 @@ func (a *AuctionOrder) GenerateExecutionFromPrice(orderID *OrderID, execPrice fl
 		}
 
 		debitSetExec := SettlementExecution{
-			Amount: amountToFill,
-			Asset:  debitAsset,
-			Type:   Debit,
+			Amount:    amountToFill,
+			Asset:     debitAsset,
+			Type:      Debit,
+			Reason:    ReasonFill,
+			Reference: hex.EncodeToString(a.AuctionID[:]),
 		}
 		creditSetExec := SettlementExecution{
-			Amount: amountWantToFill,
-			Asset:  creditAsset,
-			Type:   Credit,
+			Amount:    amountWantToFill,
+			Asset:     creditAsset,
+			Type:      Credit,
+			Reason:    ReasonFill,
+			Reference: hex.EncodeToString(a.AuctionID[:]),
 		}
 
 		copy(debitSetExec.Pubkey[:], a.Pubkey[:])
@@ -2,6 +2,7 @@ package match
 
 import (
 	"crypto/rand"
+	"encoding/hex"
 	mathrand "math/rand"
 	"testing"
 
@@ -37,6 +38,9 @@ var (
 		Nonce: [2]byte{0xff, 0x12},
 	}
 
+	// auction order fills reference the auction they were in
+	origFillReference = hex.EncodeToString(origOrder.AuctionID[:])
+
 	origOrderFullExec = &OrderExecution{
 		OrderID: OrderID([32]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}),
 		// these are just some random numbers because they should not matter since the order is filled
@@ -45,14 +49,18 @@ var (
 		Filled:        true,
 	}
 	origOrderFullDebit = &SettlementExecution{
-		Amount: 100000000,
-		Asset:  BTC,
-		Type:   Debit,
+		Amount:    100000000,
+		Asset:     BTC,
+		Type:      Debit,
+		Reason:    ReasonFill,
+		Reference: origFillReference,
 	}
 	origOrderFullCredit = &SettlementExecution{
-		Amount: 100000000,
-		Asset:  VTC,
-		Type:   Credit,
+		Amount:    100000000,
+		Asset:     VTC,
+		Type:      Credit,
+		Reason:    ReasonFill,
+		Reference: origFillReference,
 	}
 
 	origOrderDoubleExec = &OrderExecution{
@@ -63,14 +71,18 @@ var (
 		Filled:        true,
 	}
 	origOrderDoubleCredit = &SettlementExecution{
-		Amount: 100000000,
-		Asset:  VTC,
-		Type:   Credit,
+		Amount:    100000000,
+		Asset:     VTC,
+		Type:      Credit,
+		Reason:    ReasonFill,
+		Reference: origFillReference,
 	}
 	origOrderDoubleDebit = &SettlementExecution{
-		Amount: 200000000,
-		Asset:  BTC,
-		Type:   Debit,
+		Amount:    200000000,
+		Asset:     BTC,
+		Type:      Debit,
+		Reason:    ReasonFill,
+		Reference: origFillReference,
 	}
 )
 
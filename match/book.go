@@ -1,6 +1,8 @@
 package match
 
 import (
+	"time"
+
 	"github.com/mit-dci/lit/crypto/koblitz"
 )
 
@@ -8,10 +10,13 @@ import (
 // The difference between the order book and the matching engine is that the matching engine is what processes orders and generates executions, whereas the limit orderbook does not.
 // The order book takes in executions, and allows read access to the state of the orderbook.
 // This can only be updated using the outputs of the matching engine.
+// Orders that are filled or cancelled are moved to an archive, along with their fills, so what
+// happened to them can still be looked up until the archive is pruned.
 type LimitOrderbook interface {
-	// UpdateBookExec takes in an order execution and updates the orderbook.
+	// UpdateBookExec takes in an order execution and updates the orderbook. The execution is kept
+	// as a fill, and filled orders are archived.
 	UpdateBookExec(orderExec *OrderExecution) (err error)
-	// UpdateBookCancel takes in an order cancellation and updates the orderbook.
+	// UpdateBookCancel takes in an order cancellation, and archives the order.
 	UpdateBookCancel(cancel *CancelledOrder) (err error)
 	// UpdateBookPlace takes in an order, ID, timestamp, and adds the order to the orderbook.
 	UpdateBookPlace(limitIDPair *LimitOrderIDPair) (err error)
@@ -19,20 +24,42 @@ type LimitOrderbook interface {
 	GetOrder(orderID *OrderID) (limOrder *LimitOrderIDPair, err error)
 	// CalculatePrice takes in a pair and returns the calculated price based on the orderbook.
 	CalculatePrice() (price float64, err error)
-	// GetOrdersForPubkey gets orders for a specific pubkey.
-	GetOrdersForPubkey(pubkey *koblitz.PublicKey) (orders map[float64][]*LimitOrderIDPair, err error)
+	// GetOrdersForPubkey gets orders for a specific pubkey. If the sub-account is not nil, only
+	// orders from that sub-account are returned.
+	GetOrdersForPubkey(pubkey *koblitz.PublicKey, subAccount *uint32) (orders map[float64][]*LimitOrderIDPair, err error)
 	// ViewLimitOrderbook takes in a trading pair and returns the orderbook as a map
 	ViewLimitOrderBook() (book map[float64][]*LimitOrderIDPair, err error)
+	// GetArchivedOrder gets an order that is no longer in the orderbook
+	GetArchivedOrder(orderID *OrderID) (archived *ArchivedLimitOrder, err error)
+	// GetArchivedOrdersForPubkey gets the orders for a pubkey that are no longer in the orderbook,
+	// in the order they were closed. If the sub-account is not nil, only orders from that
+	// sub-account are returned.
+	GetArchivedOrdersForPubkey(pubkey *koblitz.PublicKey, subAccount *uint32) (archived []*ArchivedLimitOrder, err error)
+	// ViewArchive gets every order that is no longer in the orderbook, in the order they were
+	// closed.
+	ViewArchive() (archived []*ArchivedLimitOrder, err error)
+	// RestoreArchivedOrder puts an order into the archive as it was archived, for restoring a
+	// snapshot.
+	RestoreArchivedOrder(archived *ArchivedLimitOrder) (err error)
+	// PruneArchive deletes the archived orders that were closed before the cutoff, and returns how
+	// many were deleted.
+	PruneArchive(before time.Time) (pruned uint64, err error)
 }
 
 // AuctionOrderbook is the interface for an auction order book.
 // The difference between the order book and the matching engine is that the matching engine is what processes orders and generates executions, whereas the limit orderbook does not.
 // The order book takes in executions, and allows read access to the state of the orderbook.
+// Orders that are filled, cancelled, or rejected are moved to an archive like they are for the limit
+// orderbook.
 type AuctionOrderbook interface {
-	// UpdateBookExec takes in an order execution and updates the orderbook.
+	// UpdateBookExec takes in an order execution and updates the orderbook. The execution is kept
+	// as a fill, and filled orders are archived.
 	UpdateBookExec(orderExec *OrderExecution) (err error)
-	// UpdateBookCancel takes in an order cancellation and updates the orderbook.
+	// UpdateBookCancel takes in an order cancellation, and archives the order.
 	UpdateBookCancel(cancel *CancelledOrder) (err error)
+	// UpdateBookReject archives an order as rejected. The order doesn't have to be in the
+	// orderbook, since orders can be rejected before they're placed.
+	UpdateBookReject(auctionIDPair *AuctionOrderIDPair) (err error)
 	// UpdateBookPlace takes in an order, ID, auction ID and adds the order to the orderbook.
 	UpdateBookPlace(auctionIDPair *AuctionOrderIDPair) (err error)
 	// GetOrder gets an order from an OrderID
@@ -44,4 +71,18 @@ type AuctionOrderbook interface {
 	GetOrdersForPubkey(pubkey *koblitz.PublicKey) (orders map[float64][]*AuctionOrderIDPair, err error)
 	// ViewAuctionOrderBook takes in a trading pair and returns the orderbook as a map
 	ViewAuctionOrderBook() (book map[float64][]*AuctionOrderIDPair, err error)
+	// GetArchivedOrder gets an order that is no longer in the orderbook
+	GetArchivedOrder(orderID *OrderID) (archived *ArchivedAuctionOrder, err error)
+	// GetArchivedOrdersForPubkey gets the orders for a pubkey that are no longer in the orderbook,
+	// in the order they were closed.
+	GetArchivedOrdersForPubkey(pubkey *koblitz.PublicKey) (archived []*ArchivedAuctionOrder, err error)
+	// ViewArchive gets every order that is no longer in the orderbook, in the order they were
+	// closed.
+	ViewArchive() (archived []*ArchivedAuctionOrder, err error)
+	// RestoreArchivedOrder puts an order into the archive as it was archived, for restoring a
+	// snapshot.
+	RestoreArchivedOrder(archived *ArchivedAuctionOrder) (err error)
+	// PruneArchive deletes the archived orders that were closed before the cutoff, and returns how
+	// many were deleted.
+	PruneArchive(before time.Time) (pruned uint64, err error)
 }
@@ -14,14 +14,35 @@ type Deposit struct {
 	Address             string
 	Amount              uint64
 	Txid                string
+	Vout                uint32
 	CoinType            *coinparam.Params
 	BlockHeightReceived uint64
-	Confirmations       uint64
+	// BlockHash is the hash of the block the deposit was received in, so we can tell if it was
+	// reorged out
+	BlockHash string
+	// Confirmations is how many blocks have to be mined on top of the block the deposit was received
+	// in before it gets credited
+	Confirmations uint64
+}
+
+// CreditHeight returns the height the deposit gets credited at
+func (d *Deposit) CreditHeight() (height uint64) {
+	height = d.BlockHeightReceived + d.Confirmations
+	return
+}
+
+// ConfirmationsAt returns how many confirmations the deposit has at a height, counted the same way
+// as Confirmations, so the deposit is credited once it has Confirmations of them.
+func (d *Deposit) ConfirmationsAt(height uint64) (confirmations uint64) {
+	if height > d.BlockHeightReceived {
+		confirmations = height - d.BlockHeightReceived
+	}
+	return
 }
 
 func (d *Deposit) String() string {
-	return fmt.Sprintf("Deposit: {\n\tPubkey: %x\n\tAddress: %s\n\tAmount: %d\n\tTxid: %s\n\tCoinType: %s\n\tBlockHeightReceived: %d\n\tConfirmations: %d\n}",
-		d.Pubkey.SerializeCompressed(), d.Address, d.Amount, d.Txid, d.CoinType.Name, d.BlockHeightReceived, d.Confirmations)
+	return fmt.Sprintf("Deposit: {\n\tPubkey: %x\n\tAddress: %s\n\tAmount: %d\n\tTxid: %s\n\tVout: %d\n\tCoinType: %s\n\tBlockHeightReceived: %d\n\tBlockHash: %s\n\tConfirmations: %d\n}",
+		d.Pubkey.SerializeCompressed(), d.Address, d.Amount, d.Txid, d.Vout, d.CoinType.Name, d.BlockHeightReceived, d.BlockHash, d.Confirmations)
 }
 
 // LightningDeposit is a struct that represents a deposit made with lightning
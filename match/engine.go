@@ -5,8 +5,15 @@ package match
 // One of these should be made for every pair.
 type LimitEngine interface {
 	PlaceLimitOrder(order *LimitOrder) (idRes *LimitOrderIDPair, err error)
+	// CancelLimitOrder cancels an order. Swap orders don't hold a balance, so the cancel settlement
+	// for them is nil.
 	CancelLimitOrder(id *OrderID) (cancelled *CancelledOrder, cancelSettlement *SettlementExecution, err error)
-	MatchLimitOrders() (orderExecs []*OrderExecution, settlementExecs []*SettlementExecution, err error)
+	// MatchLimitOrders matches orders. Fills for swap orders are returned as swap instructions
+	// instead of settlement executions.
+	MatchLimitOrders() (orderExecs []*OrderExecution, settlementExecs []*SettlementExecution, swaps []*SwapInstruction, err error)
+	// RestoreLimitOrder puts an order back into the engine with the ID and timestamp it was placed
+	// with, so restoring a snapshot keeps price/time priority. Nothing is taken from any balance.
+	RestoreLimitOrder(loid *LimitOrderIDPair) (err error)
 }
 
 // The AuctionEngine is the interface for the internal matching engine. This should be the lowest level
@@ -22,10 +29,18 @@ type AuctionEngine interface {
 // certain asset.
 // One of these should be made for every asset.
 type SettlementEngine interface {
-	// ApplySettlementExecution is a method that applies a settlement execution.
-	// TODO: switch this over to have setExec []*SettlementExecution as the param
-	// and setRes []*SettlementResult as the return value
+	// ApplySettlementExecution is a method that applies a settlement execution. To apply more than
+	// one execution at once, use a BatchSettlementEngine.
 	ApplySettlementExecution(setExec *SettlementExecution) (setRes *SettlementResult, err error)
 	// CheckValid is a method that returns true if the settlement execution would be valid.
 	CheckValid(setExec *SettlementExecution) (valid bool, err error)
 }
+
+// BatchSettlementEngine is an interface for something that applies settlement executions for every
+// asset at once. Either every execution in a batch is applied, or none of them are, so a trade can't
+// be left half settled.
+type BatchSettlementEngine interface {
+	// ApplySettlementBatch applies every settlement execution in order, or returns an error and
+	// applies none of them if any execution can't be applied, like a credit bigger than the balance.
+	ApplySettlementBatch(setExecs []*SettlementExecution) (setRes []*SettlementResult, err error)
+}
@@ -0,0 +1,88 @@
+package match
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// LedgerReason is why a balance changed. Every settlement execution that gets applied is written to
+// the ledger with a reason.
+type LedgerReason string
+
+const (
+	// ReasonDeposit is for deposits on chain or through lightning
+	ReasonDeposit LedgerReason = "deposit"
+	// ReasonDepositReorg is for deposits that are reversed because their block was reorged out
+	ReasonDepositReorg LedgerReason = "reorg"
+	// ReasonWithdrawal is for withdrawals on chain or through lightning
+	ReasonWithdrawal LedgerReason = "withdrawal"
+	// ReasonOrder is for the amount taken out of a balance when an order is placed
+	ReasonOrder LedgerReason = "order"
+	// ReasonFill is for an order being filled
+	ReasonFill LedgerReason = "fill"
+	// ReasonFee is for exchange fees
+	ReasonFee LedgerReason = "fee"
+	// ReasonCancelRefund is for the amount given back when an order is cancelled
+	ReasonCancelRefund LedgerReason = "cancel"
+	// ReasonTransfer is for transfers between two accounts on the exchange
+	ReasonTransfer LedgerReason = "transfer"
+	// ReasonRestore is for balances put back when restoring a snapshot of the exchange
+	ReasonRestore LedgerReason = "restore"
+)
+
+// ExchangeAccountPrefix is put before the reason to make the exchange's side of each entry
+const ExchangeAccountPrefix = "exchange-"
+
+// CounterAccount is the exchange account that takes the other side of every ledger entry with this
+// reason, so the ledger for each asset always sums to zero.
+func (lr LedgerReason) CounterAccount() (account string) {
+	account = ExchangeAccountPrefix + string(lr)
+	return
+}
+
+// LedgerEntry is one side of a settlement execution written to the ledger. The Account is the hex
+// encoded pubkey for users, or a CounterAccount for the exchange.
+type LedgerEntry struct {
+	ID        uint64       `json:"id"`
+	Time      time.Time    `json:"time"`
+	Account   string       `json:"account"`
+	Asset     Asset        `json:"asset"`
+	Amount    uint64       `json:"amount"`
+	Type      SettleType   `json:"settletype"`
+	Reason    LedgerReason `json:"reason"`
+	Reference string       `json:"reference"`
+}
+
+// String returns the string representation of a ledger entry
+func (le *LedgerEntry) String() string {
+	// this will pass because all of the fields are marshallable
+	jsonRepresentation, _ := json.Marshal(le)
+	return string(jsonRepresentation)
+}
+
+// AccountStatement is every ledger entry for a user and asset between two times, with the balance
+// before the first entry and after the last one.
+type AccountStatement struct {
+	Pubkey         [33]byte       `json:"pubkey"`
+	Asset          Asset          `json:"asset"`
+	From           time.Time      `json:"from"`
+	To             time.Time      `json:"to"`
+	OpeningBalance uint64         `json:"openingbalance"`
+	ClosingBalance uint64         `json:"closingbalance"`
+	Entries        []*LedgerEntry `json:"entries"`
+}
+
+// LedgerMismatch is an account whose balance does not match the balance recomputed from the
+// ledger.
+type LedgerMismatch struct {
+	Account       string `json:"account"`
+	Asset         Asset  `json:"asset"`
+	Balance       int64  `json:"balance"`
+	LedgerBalance int64  `json:"ledgerbalance"`
+}
+
+// String returns the string representation of a ledger mismatch
+func (lm *LedgerMismatch) String() string {
+	return fmt.Sprintf("%s account %s has balance %d but the ledger says %d", lm.Asset, lm.Account, lm.Balance, lm.LedgerBalance)
+}
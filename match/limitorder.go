@@ -3,6 +3,7 @@ package match
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 )
 
@@ -11,9 +12,14 @@ import (
 
 // LimitOrder represents a limit order, implementing the order interface
 type LimitOrder struct {
-	Pubkey      [33]byte `json:"pubkey"`
-	Side        Side     `json:"side"`
-	TradingPair Pair     `json:"pair"`
+	Pubkey [33]byte `json:"pubkey"`
+	// SubAccount is the sub-account of the pubkey that the order is placed from and settled to
+	SubAccount uint32 `json:"subaccount"`
+	// Swap is true if the order is settled by an atomic swap over the user's lightning channels
+	// rather than by changing balances on the exchange
+	Swap        bool `json:"swap"`
+	Side        Side `json:"side"`
+	TradingPair Pair `json:"pair"`
 	// amount of assetHave the user would like to trade
 	AmountHave uint64 `json:"amounthave"`
 	// amount of assetWant the user wants for their assetHave
@@ -88,18 +94,24 @@ func (l *LimitOrder) GenerateOrderFill(orderID *OrderID, execPrice float64) (ord
 		Filled:        true,
 	}
 	debitSetExec := SettlementExecution{
-		Amount: amountToDebit,
-		Asset:  debitAsset,
-		Type:   Debit,
+		Amount:    amountToDebit,
+		Asset:     debitAsset,
+		Type:      Debit,
+		Reason:    ReasonFill,
+		Reference: hex.EncodeToString(orderID[:]),
 	}
 	creditSetExec := SettlementExecution{
-		Amount: l.AmountHave,
-		Asset:  creditAsset,
-		Type:   Credit,
+		Amount:    l.AmountHave,
+		Asset:     creditAsset,
+		Type:      Credit,
+		Reason:    ReasonFill,
+		Reference: hex.EncodeToString(orderID[:]),
 	}
 
 	copy(debitSetExec.Pubkey[:], l.Pubkey[:])
 	copy(creditSetExec.Pubkey[:], l.Pubkey[:])
+	debitSetExec.SubAccount = l.SubAccount
+	creditSetExec.SubAccount = l.SubAccount
 
 	setExecs = append(setExecs, &debitSetExec)
 	setExecs = append(setExecs, &creditSetExec)
@@ -172,19 +184,25 @@ func (l *LimitOrder) GenerateExecutionFromPrice(orderID *OrderID, execPrice floa
 		// }
 
 		debitSetExec := SettlementExecution{
-			Amount: amountToFill,
-			Asset:  debitAsset,
-			Type:   Debit,
+			Amount:    amountToFill,
+			Asset:     debitAsset,
+			Type:      Debit,
+			Reason:    ReasonFill,
+			Reference: hex.EncodeToString(orderID[:]),
 		}
 
 		creditSetExec := SettlementExecution{
-			Amount: amountWantToFill,
-			Asset:  creditAsset,
-			Type:   Credit,
+			Amount:    amountWantToFill,
+			Asset:     creditAsset,
+			Type:      Credit,
+			Reason:    ReasonFill,
+			Reference: hex.EncodeToString(orderID[:]),
 		}
 
 		copy(debitSetExec.Pubkey[:], l.Pubkey[:])
 		copy(creditSetExec.Pubkey[:], l.Pubkey[:])
+		debitSetExec.SubAccount = l.SubAccount
+		creditSetExec.SubAccount = l.SubAccount
 
 		setExecs = append(setExecs, &debitSetExec)
 		setExecs = append(setExecs, &creditSetExec)
@@ -0,0 +1,89 @@
+package match
+
+import (
+	"time"
+)
+
+// OrderStatus is what happened to an order that is no longer resting in an orderbook, or where an
+// order that is still resting is at
+type OrderStatus string
+
+const (
+	// OrderOpen is for orders that are resting in the orderbook and haven't been filled at all
+	OrderOpen OrderStatus = "open"
+	// OrderPartiallyFilled is for orders that are resting in the orderbook after being partially
+	// filled
+	OrderPartiallyFilled OrderStatus = "partiallyfilled"
+	// OrderFilled is for orders that were filled completely
+	OrderFilled OrderStatus = "filled"
+	// OrderPartiallyFilledCancelled is for orders that were partially filled, then cancelled
+	OrderPartiallyFilledCancelled OrderStatus = "partiallyfilledcancelled"
+	// OrderCancelled is for orders that were cancelled before any of them was filled
+	OrderCancelled OrderStatus = "cancelled"
+	// OrderRejected is for orders that were taken out without being filled or cancelled, like
+	// auction orders that turn out to be invalid once their puzzle is solved
+	OrderRejected OrderStatus = "rejected"
+)
+
+// CancelStatus returns the status of an order that is cancelled after the fills
+func CancelStatus(fills []*OrderFill) (status OrderStatus) {
+	if len(fills) == 0 {
+		status = OrderCancelled
+		return
+	}
+	status = OrderPartiallyFilledCancelled
+	return
+}
+
+// OrderFill is one execution of an order, with how much of the order's AmountWant and AmountHave
+// the execution took
+type OrderFill struct {
+	AmountWant uint64    `json:"amountwant"`
+	AmountHave uint64    `json:"amounthave"`
+	Time       time.Time `json:"time"`
+}
+
+// NewOrderFill creates the fill for an execution of an order that had amountWant and amountHave
+// left before the execution. Filled executions take everything that was left.
+func NewOrderFill(amountWant uint64, amountHave uint64, orderExec *OrderExecution, fillTime time.Time) (fill *OrderFill) {
+	fill = &OrderFill{
+		AmountWant: amountWant - orderExec.NewAmountWant,
+		AmountHave: amountHave - orderExec.NewAmountHave,
+		Time:       fillTime,
+	}
+	if orderExec.Filled {
+		fill.AmountWant = amountWant
+		fill.AmountHave = amountHave
+	}
+	return
+}
+
+// FilledAmounts adds up how much of an order's AmountWant and AmountHave the fills took, which is
+// how much more the order was placed with than it has left
+func FilledAmounts(fills []*OrderFill) (amountWant uint64, amountHave uint64) {
+	for _, fill := range fills {
+		amountWant += fill.AmountWant
+		amountHave += fill.AmountHave
+	}
+	return
+}
+
+// ArchivedLimitOrder is a limit order that is no longer in the orderbook, along with what happened
+// to it
+type ArchivedLimitOrder struct {
+	// Order is the order as it was placed, before any fills
+	Order    *LimitOrderIDPair `json:"order"`
+	Status   OrderStatus       `json:"status"`
+	Fills    []*OrderFill      `json:"fills"`
+	ClosedAt time.Time         `json:"closedat"`
+}
+
+// ArchivedAuctionOrder is an auction order that is no longer in the orderbook, along with what
+// happened to it
+type ArchivedAuctionOrder struct {
+	// Order is the order as it was placed, before any fills
+	Order    *AuctionOrderIDPair `json:"order"`
+	Status   OrderStatus         `json:"status"`
+	Fills    []*OrderFill        `json:"fills"`
+	ClosedAt time.Time           `json:"closedat"`
+}
@@ -11,7 +11,44 @@ import (
 // MatchPrioritizedOrders matches separated buy and sell orders that are properly sorted in price-time priority.
 // These are the orders that should match.
 // This should never return a list of order executions containing the same ID for more than one execution
-func MatchPrioritizedOrders(buyOrders []*LimitOrderIDPair, sellOrders []*LimitOrderIDPair) (orderExecs []*OrderExecution, settlementExecs []*SettlementExecution, err error) {
+// Fills for swap orders are returned as swap instructions instead of settlement executions.
+// Swap orders are only matched with other swap orders. A swap might never be paid for, so if a swap
+// order filled an order that settles on the exchange, that order's owner would get a balance for a
+// payment that might not happen.
+func MatchPrioritizedOrders(buyOrders []*LimitOrderIDPair, sellOrders []*LimitOrderIDPair) (orderExecs []*OrderExecution, settlementExecs []*SettlementExecution, swaps []*SwapInstruction, err error) {
+	buyOrders, buySwapOrders := splitSwapOrders(buyOrders)
+	sellOrders, sellSwapOrders := splitSwapOrders(sellOrders)
+
+	if orderExecs, settlementExecs, _, err = matchPrioritizedOrders(buyOrders, sellOrders); err != nil {
+		err = fmt.Errorf("Error matching orders for MatchPrioritizedOrders: %s", err)
+		return
+	}
+
+	// swap orders only fill other swap orders, so there are no settlement executions for them
+	var swapOrderExecs []*OrderExecution
+	if swapOrderExecs, _, swaps, err = matchPrioritizedOrders(buySwapOrders, sellSwapOrders); err != nil {
+		err = fmt.Errorf("Error matching swap orders for MatchPrioritizedOrders: %s", err)
+		return
+	}
+	orderExecs = append(orderExecs, swapOrderExecs...)
+	return
+}
+
+// splitSwapOrders splits prioritized orders into the orders that settle on the exchange and the swap
+// orders, keeping the priority order of each
+func splitSwapOrders(orders []*LimitOrderIDPair) (balanceOrders []*LimitOrderIDPair, swapOrders []*LimitOrderIDPair) {
+	for _, order := range orders {
+		if order.Order.Swap {
+			swapOrders = append(swapOrders, order)
+			continue
+		}
+		balanceOrders = append(balanceOrders, order)
+	}
+	return
+}
+
+// matchPrioritizedOrders matches buy and sell orders that are sorted in price-time priority
+func matchPrioritizedOrders(buyOrders []*LimitOrderIDPair, sellOrders []*LimitOrderIDPair) (orderExecs []*OrderExecution, settlementExecs []*SettlementExecution, swaps []*SwapInstruction, err error) {
 	// Lists should be in priority order starting at 0
 	for len(buyOrders) > 0 && len(sellOrders) > 0 && buyOrders[0].Price <= sellOrders[0].Price {
 		// Ahh whatever we can be a little inefficient space-wise, just add em all to the list
@@ -41,7 +78,8 @@ func MatchPrioritizedOrders(buyOrders []*LimitOrderIDPair, sellOrders []*LimitOr
 		var prSellExec OrderExecution
 		var prBuyExec OrderExecution
 		var prelimSettlementExecs []*SettlementExecution
-		if prBuyExec, prSellExec, prelimSettlementExecs, err = MatchTwoOpposite(buyOrders[0], sellOrders[0]); err != nil {
+		var prelimSwaps []*SwapInstruction
+		if prBuyExec, prSellExec, prelimSettlementExecs, prelimSwaps, err = MatchTwoOpposite(buyOrders[0], sellOrders[0]); err != nil {
 			err = fmt.Errorf("Error matching orders")
 			return
 		}
@@ -54,17 +92,23 @@ func MatchPrioritizedOrders(buyOrders []*LimitOrderIDPair, sellOrders []*LimitOr
 		sellOrders[0].Order.AmountHave = prSellExec.NewAmountHave
 		sellOrders[0].Order.AmountWant = prSellExec.NewAmountWant
 
+		// Filled orders are done, so add their result and move on to the next order.
+		if prSellExec.Filled {
+			sellOrders = sellOrders[1:]
+			orderExecs = append(orderExecs, &prSellExec)
+		}
+		if prBuyExec.Filled {
+			buyOrders = buyOrders[1:]
+			orderExecs = append(orderExecs, &prBuyExec)
+		}
+
+		// A partially filled order stays at the front and may be matched again. If we will be done,
+		// make sure to add its result too, or what's left of it would never be updated.
 		if len(buyOrders) == 0 || len(sellOrders) == 0 || buyOrders[0].Price > sellOrders[0].Price {
-			// If we will be done, make sure to add the result
-			orderExecs = append(orderExecs, []*OrderExecution{&prBuyExec, &prSellExec}...)
-		} else {
-			// If we're gonna keep going, then only add if we're filled.
-			if prSellExec.Filled {
-				sellOrders = sellOrders[1:]
+			if !prSellExec.Filled {
 				orderExecs = append(orderExecs, &prSellExec)
 			}
-			if prBuyExec.Filled {
-				buyOrders = buyOrders[1:]
+			if !prBuyExec.Filled {
 				orderExecs = append(orderExecs, &prBuyExec)
 			}
 		}
@@ -72,6 +116,7 @@ func MatchPrioritizedOrders(buyOrders []*LimitOrderIDPair, sellOrders []*LimitOr
 		// we keep all of the settlements no matter what because the rates may be
 		// changing (due to time priority)
 		settlementExecs = append(settlementExecs, prelimSettlementExecs...)
+		swaps = append(swaps, prelimSwaps...)
 	}
 	return
 }
@@ -86,7 +131,8 @@ func MatchPrioritizedOrders(buyOrders []*LimitOrderIDPair, sellOrders []*LimitOr
 // }
 
 // MatchTwo matches a buy order order with the sell order supplied as an argument, giving this order priority.
-func MatchTwoOpposite(buyLp *LimitOrderIDPair, sellLp *LimitOrderIDPair) (buyExec OrderExecution, sellExec OrderExecution, settlementExecs []*SettlementExecution, err error) {
+// If either order is a swap order, its fill is returned as a swap instruction.
+func MatchTwoOpposite(buyLp *LimitOrderIDPair, sellLp *LimitOrderIDPair) (buyExec OrderExecution, sellExec OrderExecution, settlementExecs []*SettlementExecution, swaps []*SwapInstruction, err error) {
 
 	if buyLp.Order.Side != Buy || sellLp.Order.Side != Sell {
 		err = fmt.Errorf("Invalid input, buy LimitOrderIDPair was not buy or sell LimitOrderIDPair was not sell")
@@ -118,8 +164,8 @@ func MatchTwoOpposite(buyLp *LimitOrderIDPair, sellLp *LimitOrderIDPair) (buyExe
 			}
 
 			// append to the settlement execs, we have all we need, let's exit
-			settlementExecs = append(settlementExecs, sellSetExecs...)
-			settlementExecs = append(settlementExecs, buySetExecs...)
+			settlementExecs, swaps = appendFill(settlementExecs, swaps, sellLp, sellSetExecs)
+			settlementExecs, swaps = appendFill(settlementExecs, swaps, buyLp, buySetExecs)
 
 			// We are done. Quit early
 			return
@@ -140,8 +186,8 @@ func MatchTwoOpposite(buyLp *LimitOrderIDPair, sellLp *LimitOrderIDPair) (buyExe
 		}
 
 		// append to the settlement execs, we have all we need, let's exit
-		settlementExecs = append(settlementExecs, sellSetExecs...)
-		settlementExecs = append(settlementExecs, buySetExecs...)
+		settlementExecs, swaps = appendFill(settlementExecs, swaps, sellLp, sellSetExecs)
+		settlementExecs, swaps = appendFill(settlementExecs, swaps, buyLp, buySetExecs)
 
 		// We are done. Quit early
 		return
@@ -162,8 +208,8 @@ func MatchTwoOpposite(buyLp *LimitOrderIDPair, sellLp *LimitOrderIDPair) (buyExe
 		}
 
 		// append to the settlement execs, we have all we need, let's exit
-		settlementExecs = append(settlementExecs, sellSetExecs...)
-		settlementExecs = append(settlementExecs, buySetExecs...)
+		settlementExecs, swaps = appendFill(settlementExecs, swaps, sellLp, sellSetExecs)
+		settlementExecs, swaps = appendFill(settlementExecs, swaps, buyLp, buySetExecs)
 
 		// We are done. Quit early
 		return
@@ -182,8 +228,8 @@ func MatchTwoOpposite(buyLp *LimitOrderIDPair, sellLp *LimitOrderIDPair) (buyExe
 	}
 
 	// append to the settlement execs, we have all we need, let's exit
-	settlementExecs = append(settlementExecs, sellSetExecs...)
-	settlementExecs = append(settlementExecs, buySetExecs...)
+	settlementExecs, swaps = appendFill(settlementExecs, swaps, sellLp, sellSetExecs)
+	settlementExecs, swaps = appendFill(settlementExecs, swaps, buyLp, buySetExecs)
 
 	// We are done. Quit early
 	return
@@ -0,0 +1,69 @@
+package match
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMatchPrioritizedOrdersPartialFill makes sure an order that is only partially filled when
+// matching stops still gets an execution, so whatever keeps the orderbook knows what's left of it.
+func TestMatchPrioritizedOrdersPartialFill(t *testing.T) {
+	var err error
+
+	pair := Pair{AssetWant: BTCReg, AssetHave: LTCReg}
+	buyOrder := &LimitOrder{
+		Side:        Buy,
+		TradingPair: pair,
+		AmountHave:  1000,
+		AmountWant:  1000,
+	}
+	buyOrder.Pubkey[0] = 0x02
+	sellOrder := &LimitOrder{
+		Side:        Sell,
+		TradingPair: pair,
+		AmountHave:  400,
+		AmountWant:  400,
+	}
+	sellOrder.Pubkey[0] = 0x03
+
+	buyID := &OrderID{0x01}
+	sellID := &OrderID{0x02}
+	now := time.Now()
+	buyLp := &LimitOrderIDPair{Timestamp: now, Price: 1, OrderID: buyID, Order: buyOrder}
+	sellLp := &LimitOrderIDPair{Timestamp: now.Add(-time.Second), Price: 1, OrderID: sellID, Order: sellOrder}
+
+	var orderExecs []*OrderExecution
+	if orderExecs, _, _, err = MatchPrioritizedOrders([]*LimitOrderIDPair{buyLp}, []*LimitOrderIDPair{sellLp}); err != nil {
+		t.Errorf("Error matching orders: %s", err)
+		return
+	}
+
+	if len(orderExecs) != 2 {
+		t.Errorf("Expected an execution for the filled sell and the partially filled buy, got %d", len(orderExecs))
+		return
+	}
+
+	var buyExec *OrderExecution
+	var sellExec *OrderExecution
+	for _, orderExec := range orderExecs {
+		switch orderExec.OrderID {
+		case *buyID:
+			buyExec = orderExec
+		case *sellID:
+			sellExec = orderExec
+		}
+	}
+	if sellExec == nil || !sellExec.Filled {
+		t.Errorf("Sell order should have been filled")
+		return
+	}
+	if buyExec == nil || buyExec.Filled {
+		t.Errorf("Buy order should have an execution and not be filled")
+		return
+	}
+	if buyExec.NewAmountHave != 600 || buyExec.NewAmountWant != 600 {
+		t.Errorf("Buy order should have 600 for 600 left, has %d for %d", buyExec.NewAmountHave, buyExec.NewAmountWant)
+		return
+	}
+	return
+}
@@ -0,0 +1,133 @@
+package match
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/lit/coinparam"
+)
+
+// checkedBatchEngine is a batch settlement engine made out of one settlement engine per asset
+type checkedBatchEngine struct {
+	engines map[Asset]SettlementEngine
+}
+
+// undoReferencePrefix is put before the reference of an execution that is reversed because a later
+// execution in its batch couldn't be applied
+const undoReferencePrefix = "undo:"
+
+// NewCheckedBatchEngine creates a batch settlement engine out of one settlement engine per asset.
+// Every execution is checked before any are applied, along with the most each account is credited
+// at any point in the batch, so two credits that each fit in a balance but not together are
+// rejected. If an apply still fails, the executions already applied are reversed. The applies and
+// reversals are separate, so engines that keep balances should still have their own batch engine,
+// which applies a batch in one transaction.
+func NewCheckedBatchEngine(engines map[Asset]SettlementEngine) (batchEngine BatchSettlementEngine) {
+	batchEngine = &checkedBatchEngine{engines: engines}
+	return
+}
+
+// NewCheckedBatchEngineFromCoins creates a checked batch settlement engine out of a map of coin to
+// settlement engine, which is how servers keep their settlement engines.
+func NewCheckedBatchEngineFromCoins(setEngines map[*coinparam.Params]SettlementEngine) (batchEngine BatchSettlementEngine, err error) {
+	engines := make(map[Asset]SettlementEngine)
+	for coin, setEngine := range setEngines {
+		var asset Asset
+		if asset, err = AssetFromCoinParam(coin); err != nil {
+			err = fmt.Errorf("Error getting asset from coin param for NewCheckedBatchEngineFromCoins: %s", err)
+			return
+		}
+		engines[asset] = setEngine
+	}
+	batchEngine = NewCheckedBatchEngine(engines)
+	return
+}
+
+// ApplySettlementBatch checks every settlement execution, and then applies them if they are all valid.
+// If one fails to apply, the ones before it are reversed, so none of the batch is applied.
+func (cb *checkedBatchEngine) ApplySettlementBatch(setExecs []*SettlementExecution) (setRes []*SettlementResult, err error) {
+	// the net amount each account has been credited so far in the batch, and the most it ever is
+	type assetAccount struct {
+		asset   Asset
+		account Account
+	}
+	netCredits := make(map[assetAccount]int64)
+	maxCredits := make(map[assetAccount]*SettlementExecution)
+
+	for _, setExec := range setExecs {
+		var currEngine SettlementEngine
+		var ok bool
+		if currEngine, ok = cb.engines[setExec.Asset]; !ok {
+			err = fmt.Errorf("No settlement engine for %s", setExec.Asset)
+			return
+		}
+
+		var valid bool
+		if valid, err = currEngine.CheckValid(setExec); err != nil {
+			err = fmt.Errorf("Error checking settlement exec for ApplySettlementBatch: %s", err)
+			return
+		}
+
+		if !valid {
+			err = fmt.Errorf("Invalid settlement exec in batch, rejecting the whole batch: %s", setExec)
+			return
+		}
+
+		key := assetAccount{asset: setExec.Asset, account: setExec.Account()}
+		if setExec.Type == Credit {
+			netCredits[key] += int64(setExec.Amount)
+		} else {
+			netCredits[key] -= int64(setExec.Amount)
+		}
+		if maxCredit, ok := maxCredits[key]; netCredits[key] > 0 && (!ok || uint64(netCredits[key]) > maxCredit.Amount) {
+			combined := *setExec
+			combined.Type = Credit
+			combined.Amount = uint64(netCredits[key])
+			maxCredits[key] = &combined
+		}
+	}
+
+	// a credit that's valid on its own might not be once the credits before it are taken out
+	for _, maxCredit := range maxCredits {
+		var valid bool
+		if valid, err = cb.engines[maxCredit.Asset].CheckValid(maxCredit); err != nil {
+			err = fmt.Errorf("Error checking combined credits for ApplySettlementBatch: %s", err)
+			return
+		}
+		if !valid {
+			err = fmt.Errorf("Credits of %d %s to %s in batch are more than the balance, rejecting the whole batch", maxCredit.Amount, maxCredit.Asset, maxCredit.Account())
+			return
+		}
+	}
+
+	for i, setExec := range setExecs {
+		var currRes *SettlementResult
+		if currRes, err = cb.engines[setExec.Asset].ApplySettlementExecution(setExec); err != nil {
+			err = fmt.Errorf("Error applying settlement exec for ApplySettlementBatch: %s", err)
+			if undoErr := cb.undo(setExecs[:i]); undoErr != nil {
+				err = fmt.Errorf("%s, and error reversing the executions applied before it: %s", err, undoErr)
+			}
+			setRes = nil
+			return
+		}
+		setRes = append(setRes, currRes)
+	}
+	return
+}
+
+// undo reverses applied settlement executions, last first, by applying the opposite execution for
+// each of them
+func (cb *checkedBatchEngine) undo(applied []*SettlementExecution) (err error) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		reversal := *applied[i]
+		reversal.Type = Debit
+		if applied[i].Type == Debit {
+			reversal.Type = Credit
+		}
+		reversal.Reference = undoReferencePrefix + applied[i].Reference
+		if _, err = cb.engines[reversal.Asset].ApplySettlementExecution(&reversal); err != nil {
+			err = fmt.Errorf("Error reversing %s: %s", applied[i], err)
+			return
+		}
+	}
+	return
+}
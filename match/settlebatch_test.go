@@ -0,0 +1,81 @@
+package match
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testBalanceEngine is a settlement engine that keeps balances in a map, and fails to apply
+// anything to the account in failOn
+type testBalanceEngine struct {
+	balances map[Account]uint64
+	failOn   *Account
+}
+
+func (te *testBalanceEngine) ApplySettlementExecution(setExec *SettlementExecution) (setRes *SettlementResult, err error) {
+	if te.failOn != nil && *te.failOn == setExec.Account() {
+		err = fmt.Errorf("Account %s can't be settled", setExec.Account())
+		return
+	}
+	curBal := te.balances[setExec.Account()]
+	if setExec.Type == Credit {
+		if setExec.Amount > curBal {
+			err = fmt.Errorf("Credit of %d is more than the balance of %d", setExec.Amount, curBal)
+			return
+		}
+		te.balances[setExec.Account()] = curBal - setExec.Amount
+	} else {
+		te.balances[setExec.Account()] = curBal + setExec.Amount
+	}
+	setRes = &SettlementResult{NewBal: te.balances[setExec.Account()], SuccessfulExec: setExec}
+	return
+}
+
+func (te *testBalanceEngine) CheckValid(setExec *SettlementExecution) (valid bool, err error) {
+	valid = setExec.Type == Debit || setExec.Amount <= te.balances[setExec.Account()]
+	return
+}
+
+func TestCheckedBatchAllOrNothing(t *testing.T) {
+	var err error
+
+	alice := Account{Pubkey: [33]byte{0x02, 0x01}}
+	bob := Account{Pubkey: [33]byte{0x02, 0x02}}
+	btcEngine := &testBalanceEngine{balances: map[Account]uint64{alice: 1000}}
+	ltcEngine := &testBalanceEngine{balances: map[Account]uint64{bob: 1000}}
+	batchEngine := NewCheckedBatchEngine(map[Asset]SettlementEngine{BTCReg: btcEngine, LTCReg: ltcEngine})
+
+	// each credit fits in alice's balance, but both together don't
+	overdraw := []*SettlementExecution{
+		{Pubkey: alice.Pubkey, Amount: 600, Asset: BTCReg, Type: Credit, Reason: ReasonTransfer},
+		{Pubkey: bob.Pubkey, Amount: 600, Asset: BTCReg, Type: Debit, Reason: ReasonTransfer},
+		{Pubkey: alice.Pubkey, Amount: 600, Asset: BTCReg, Type: Credit, Reason: ReasonTransfer},
+	}
+	if _, err = batchEngine.ApplySettlementBatch(overdraw); err == nil {
+		t.Errorf("Two credits that overdraw the balance together should be rejected")
+		return
+	}
+	if btcEngine.balances[alice] != 1000 || btcEngine.balances[bob] != 0 {
+		t.Errorf("Rejected batch should not change any balance, alice has %d and bob has %d", btcEngine.balances[alice], btcEngine.balances[bob])
+		return
+	}
+
+	// the btc side is applied before the ltc side fails, so it has to be reversed
+	ltcEngine.failOn = &bob
+	trade := []*SettlementExecution{
+		{Pubkey: alice.Pubkey, Amount: 400, Asset: BTCReg, Type: Credit, Reason: ReasonFill},
+		{Pubkey: bob.Pubkey, Amount: 400, Asset: BTCReg, Type: Debit, Reason: ReasonFill},
+		{Pubkey: bob.Pubkey, Amount: 400, Asset: LTCReg, Type: Credit, Reason: ReasonFill},
+		{Pubkey: alice.Pubkey, Amount: 400, Asset: LTCReg, Type: Debit, Reason: ReasonFill},
+	}
+	if _, err = batchEngine.ApplySettlementBatch(trade); err == nil {
+		t.Errorf("Batch with an execution that fails to apply should fail")
+		return
+	}
+	if btcEngine.balances[alice] != 1000 || btcEngine.balances[bob] != 0 || ltcEngine.balances[bob] != 1000 || ltcEngine.balances[alice] != 0 {
+		t.Errorf("Executions applied before the failure should be reversed")
+		return
+	}
+
+	return
+}
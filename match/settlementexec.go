@@ -2,18 +2,84 @@ package match
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
 )
 
+// Account is a pubkey and one of its sub-accounts. Every sub-account has its own balances and
+// orders. Sub-account 0 is the pubkey's main account, which is what deposits go to and withdrawals
+// come out of.
+type Account struct {
+	Pubkey     [33]byte `json:"pubkey"`
+	SubAccount uint32   `json:"subaccount"`
+}
+
+// String returns the account as it's written to the ledger, which is the hex pubkey for the main
+// account and the hex pubkey and sub-account separated by a slash for the others.
+func (a Account) String() string {
+	if a.SubAccount == 0 {
+		return fmt.Sprintf("%x", a.Pubkey)
+	}
+	return fmt.Sprintf("%x/%d", a.Pubkey, a.SubAccount)
+}
+
+// ParseAccount parses an account the way it's written to the ledger by String
+func ParseAccount(accountString string) (account Account, err error) {
+	pubkeyHex := accountString
+	if slash := strings.Index(accountString, "/"); slash != -1 {
+		pubkeyHex = accountString[:slash]
+		var subAccount uint64
+		if subAccount, err = strconv.ParseUint(accountString[slash+1:], 10, 32); err != nil {
+			err = fmt.Errorf("Error parsing sub-account of %s: %s", accountString, err)
+			return
+		}
+		account.SubAccount = uint32(subAccount)
+	}
+
+	var pubkeyBytes []byte
+	if pubkeyBytes, err = hex.DecodeString(pubkeyHex); err != nil {
+		err = fmt.Errorf("Error parsing pubkey of %s: %s", accountString, err)
+		return
+	}
+	if len(pubkeyBytes) != len(account.Pubkey) {
+		err = fmt.Errorf("Pubkey of %s is %d bytes, not %d", accountString, len(pubkeyBytes), len(account.Pubkey))
+		return
+	}
+	copy(account.Pubkey[:], pubkeyBytes)
+	return
+}
+
+// AccountBalance is the available and held balance of one account for one asset
+type AccountBalance struct {
+	Account Account `json:"account"`
+	Balance uint64  `json:"balance"`
+	Held    uint64  `json:"held"`
+}
+
 // TODO: replace with this once ready
 // SettlementExecution is the "settlement part" of an execution.
 // It defines the operations that should be done to the settlement engine.
 type SettlementExecution struct {
 	Pubkey [33]byte `json:"pubkey"`
-	Amount uint64   `json:"amount"`
-	Asset  Asset    `json:"asset"`
+	// SubAccount is the sub-account of the pubkey whose balance changes
+	SubAccount uint32 `json:"subaccount"`
+	Amount     uint64 `json:"amount"`
+	Asset      Asset  `json:"asset"`
 	// SettleType is a type that determines whether or not this is a debit or credit
 	Type SettleType `json:"settletype"`
+	// Reason and Reference say why this execution happened, so it can be written to the ledger.
+	// They don't change what the execution does, so Equal ignores them.
+	Reason    LedgerReason `json:"reason"`
+	Reference string       `json:"reference"`
+}
+
+// Account returns the account whose balance the settlement execution changes
+func (se *SettlementExecution) Account() (account Account) {
+	account = Account{Pubkey: se.Pubkey, SubAccount: se.SubAccount}
+	return
 }
 
 // String returns a string representation of the SettlementExecution
@@ -28,6 +94,9 @@ func (se *SettlementExecution) Equal(otherExec *SettlementExecution) bool {
 	if !bytes.Equal(se.Pubkey[:], otherExec.Pubkey[:]) {
 		return false
 	}
+	if se.SubAccount != otherExec.SubAccount {
+		return false
+	}
 	if se.Amount != otherExec.Amount {
 		return false
 	}
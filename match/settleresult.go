@@ -2,9 +2,11 @@ package match
 
 import "encoding/json"
 
-// SettlementResult is the settlement exec and the new balance
+// SettlementResult is the settlement exec and the new balance. NewBal is the available balance, and
+// NewHeld is the amount of the asset that is locked up in open orders.
 type SettlementResult struct {
 	NewBal         uint64               `json:"newbal"`
+	NewHeld        uint64               `json:"newheld"`
 	SuccessfulExec *SettlementExecution `json:"successfulexec"`
 }
 
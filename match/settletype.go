@@ -26,6 +26,12 @@ func (st *SettleType) String() string {
 	return creditString
 }
 
+// MarshalJSON implements the JSON marshalling interface, so a settle type is marshalled the same
+// way it is unmarshalled
+func (st SettleType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(st.String())
+}
+
 func (st *SettleType) UnmarshalJSON(b []byte) (err error) {
 	var str string
 	if err = json.Unmarshal(b, &str); err != nil {
@@ -27,8 +27,14 @@ func (s Side) String() string {
 	return sellString
 }
 
+// MarshalJSON implements the JSON marshalling interface, so a side is marshalled the same way it is
+// unmarshalled
+func (s Side) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
 // UnmarshalJSON implements the JSON unmarshalling interface
-func (s Side) UnmarshalJSON(b []byte) (err error) {
+func (s *Side) UnmarshalJSON(b []byte) (err error) {
 	var str string
 	if err = json.Unmarshal(b, &str); err != nil {
 		return
@@ -38,24 +44,24 @@ func (s Side) UnmarshalJSON(b []byte) (err error) {
 		err = fmt.Errorf("Cannot unmarshal side json, not buy or sell")
 		return
 	case buyString:
-		s = Buy
+		*s = Buy
 	case sellString:
-		s = Sell
+		*s = Sell
 	}
 	return
 }
 
 // FromString takes a string and, if valid, sets the Side to the
 // correct value based on the string
-func (s Side) FromString(str string) (err error) {
+func (s *Side) FromString(str string) (err error) {
 	switch strings.ToLower(str) {
 	default:
 		err = fmt.Errorf("Cannot get side from string, not buy or sell")
 		return
 	case buyString:
-		s = Buy
+		*s = Buy
 	case sellString:
-		s = Sell
+		*s = Sell
 	}
 	return
 }
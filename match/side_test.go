@@ -194,3 +194,30 @@ func TestSideUnmarshalBinaryManyWrongValue(t *testing.T) {
 
 	return
 }
+
+// TestSideFromString tests that FromString sets the side it's called on
+func TestSideFromString(t *testing.T) {
+	var err error
+	side := Sell
+	if err = side.FromString(buyString); err != nil {
+		t.Errorf("Error getting buy side from string: %s", err)
+		return
+	}
+	if side != Buy {
+		t.Errorf("Side from string %s should be buy, got %s", buyString, side)
+		return
+	}
+	if err = side.FromString(sellString); err != nil {
+		t.Errorf("Error getting sell side from string: %s", err)
+		return
+	}
+	if side != Sell {
+		t.Errorf("Side from string %s should be sell, got %s", sellString, side)
+		return
+	}
+	if err = side.FromString("neither"); err == nil {
+		t.Errorf("Getting side from an invalid string should fail")
+		return
+	}
+	return
+}
@@ -0,0 +1,60 @@
+package match
+
+import (
+	"encoding/json"
+)
+
+// SwapInstruction is what the matching engine gives back instead of settlement executions when a
+// swap order is filled. The balance of a swap user never changes on the exchange, the fill is
+// settled by an atomic swap over the user's lightning channels: the user pays PayAmount of
+// PayAsset and receives ReceiveAmount of ReceiveAsset.
+type SwapInstruction struct {
+	Pubkey [33]byte `json:"pubkey"`
+	// SubAccount is the sub-account of the pubkey the order was placed from
+	SubAccount    uint32  `json:"subaccount"`
+	OrderID       OrderID `json:"orderid"`
+	PayAsset      Asset   `json:"payasset"`
+	PayAmount     uint64  `json:"payamount"`
+	ReceiveAsset  Asset   `json:"receiveasset"`
+	ReceiveAmount uint64  `json:"receiveamount"`
+}
+
+// String returns a string representation of the SwapInstruction
+func (si *SwapInstruction) String() string {
+	// We are ignoring this error because we know the struct is marshallable, since all of the fields are.
+	jsonRepresentation, _ := json.Marshal(si)
+	return string(jsonRepresentation)
+}
+
+// SwapInstructionFromFill turns the settlement executions for a fill into a swap instruction. The
+// debit is what the user receives and the credit is what the user pays.
+func SwapInstructionFromFill(orderID *OrderID, setExecs []*SettlementExecution) (swap *SwapInstruction) {
+	swap = &SwapInstruction{
+		OrderID: *orderID,
+	}
+	for _, setExec := range setExecs {
+		swap.Pubkey = setExec.Pubkey
+		swap.SubAccount = setExec.SubAccount
+		if setExec.Type == Debit {
+			swap.ReceiveAsset = setExec.Asset
+			swap.ReceiveAmount += setExec.Amount
+		} else {
+			swap.PayAsset = setExec.Asset
+			swap.PayAmount += setExec.Amount
+		}
+	}
+	return
+}
+
+// appendFill adds the settlement executions for a fill of an order to settlementExecs, or a swap
+// instruction to swaps if the order is a swap order.
+func appendFill(settlementExecs []*SettlementExecution, swaps []*SwapInstruction, lp *LimitOrderIDPair, setExecs []*SettlementExecution) (newSettlementExecs []*SettlementExecution, newSwaps []*SwapInstruction) {
+	newSettlementExecs = settlementExecs
+	newSwaps = swaps
+	if !lp.Order.Swap {
+		newSettlementExecs = append(newSettlementExecs, setExecs...)
+		return
+	}
+	newSwaps = append(newSwaps, SwapInstructionFromFill(lp.OrderID, setExecs))
+	return
+}
@@ -0,0 +1,86 @@
+package match
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchSwapOrder(t *testing.T) {
+	var err error
+
+	pair := Pair{AssetWant: BTCReg, AssetHave: LTCReg}
+	buyOrder := &LimitOrder{
+		Side:        Buy,
+		TradingPair: pair,
+		AmountHave:  100000,
+		AmountWant:  100000,
+	}
+	buyOrder.Pubkey[0] = 0x02
+	sellOrder := &LimitOrder{
+		Side:        Sell,
+		Swap:        true,
+		SubAccount:  3,
+		TradingPair: pair,
+		AmountHave:  100000,
+		AmountWant:  100000,
+	}
+	sellOrder.Pubkey[0] = 0x03
+
+	buyID := &OrderID{0x01}
+	sellID := &OrderID{0x02}
+	now := time.Now()
+	buyLp := &LimitOrderIDPair{Timestamp: now, Price: 1, OrderID: buyID, Order: buyOrder}
+	sellLp := &LimitOrderIDPair{Timestamp: now.Add(-time.Second), Price: 1, OrderID: sellID, Order: sellOrder}
+
+	var orderExecs []*OrderExecution
+	var settlementExecs []*SettlementExecution
+	var swaps []*SwapInstruction
+	if orderExecs, settlementExecs, swaps, err = MatchPrioritizedOrders([]*LimitOrderIDPair{buyLp}, []*LimitOrderIDPair{sellLp}); err != nil {
+		t.Errorf("Error matching orders: %s", err)
+		return
+	}
+
+	// A swap order doesn't fill an order that settles on the exchange
+	if len(orderExecs) != 0 || len(settlementExecs) != 0 || len(swaps) != 0 {
+		t.Errorf("Swap order should not match a balance order, got %d order executions, %d settlement executions, and %d swaps", len(orderExecs), len(settlementExecs), len(swaps))
+		return
+	}
+
+	buyOrder.Swap = true
+	if orderExecs, settlementExecs, swaps, err = MatchPrioritizedOrders([]*LimitOrderIDPair{buyLp}, []*LimitOrderIDPair{sellLp}); err != nil {
+		t.Errorf("Error matching orders: %s", err)
+		return
+	}
+
+	if len(orderExecs) != 2 {
+		t.Errorf("Both orders should be executed, got %d order executions", len(orderExecs))
+		return
+	}
+
+	// neither order changes balances
+	if len(settlementExecs) != 0 {
+		t.Errorf("Expected no settlement executions for swap orders, got %d", len(settlementExecs))
+		return
+	}
+
+	if len(swaps) != 2 {
+		t.Errorf("Expected a swap instruction for each order, got %d", len(swaps))
+		return
+	}
+	var swap *SwapInstruction
+	for _, currSwap := range swaps {
+		if currSwap.OrderID == *sellID {
+			swap = currSwap
+		}
+	}
+	if swap == nil || swap.Pubkey != sellOrder.Pubkey || swap.SubAccount != sellOrder.SubAccount {
+		t.Errorf("Expected a swap instruction for the sell order")
+		return
+	}
+	if swap.PayAsset != BTCReg || swap.PayAmount != 100000 || swap.ReceiveAsset != LTCReg || swap.ReceiveAmount != 100000 {
+		t.Errorf("Swap instruction should pay 100000 %s and receive 100000 %s, got %s", BTCReg, LTCReg, swap.String())
+		return
+	}
+
+	return
+}
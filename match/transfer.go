@@ -0,0 +1,100 @@
+package match
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// transferNonceSeparator separates the account a transfer went to from the transfer's nonce in the
+// ledger reference for the sender
+const transferNonceSeparator = " nonce "
+
+// Transfer is a signed transfer of an asset from one account on the exchange to another. The nonce
+// has to be bigger than the nonce of the last transfer from the same account, so a signed transfer
+// can't be replayed. A transfer between two sub-accounts of the same pubkey moves funds between
+// the desk's own strategies.
+type Transfer struct {
+	From           [33]byte `json:"from"`
+	FromSubAccount uint32   `json:"fromsubaccount"`
+	To             [33]byte `json:"to"`
+	ToSubAccount   uint32   `json:"tosubaccount"`
+	Asset          Asset    `json:"asset"`
+	Amount         uint64   `json:"amount"`
+	Nonce          uint64   `json:"nonce"`
+}
+
+// FromAccount returns the account the transfer is from
+func (t *Transfer) FromAccount() (account Account) {
+	account = Account{Pubkey: t.From, SubAccount: t.FromSubAccount}
+	return
+}
+
+// ToAccount returns the account the transfer is to
+func (t *Transfer) ToAccount() (account Account) {
+	account = Account{Pubkey: t.To, SubAccount: t.ToSubAccount}
+	return
+}
+
+// Internal returns true if the transfer is between two sub-accounts of the same pubkey
+func (t *Transfer) Internal() (internal bool) {
+	internal = t.From == t.To
+	return
+}
+
+// SenderReference returns the ledger reference for the sender's side of the transfer, which is the
+// account it went to and the nonce. The nonce is written to the ledger in the same batch that moves
+// the funds, so it's stored if and only if the transfer is.
+func (t *Transfer) SenderReference() (reference string) {
+	reference = fmt.Sprintf("%s%s%d", t.ToAccount().String(), transferNonceSeparator, t.Nonce)
+	return
+}
+
+// TransferNonceFromReference returns the nonce in the ledger reference for the sender's side of a
+// transfer, or false if the reference doesn't have one.
+func TransferNonceFromReference(reference string) (nonce uint64, ok bool) {
+	sep := strings.LastIndex(reference, transferNonceSeparator)
+	if sep == -1 {
+		return
+	}
+	var err error
+	if nonce, err = strconv.ParseUint(reference[sep+len(transferNonceSeparator):], 10, 64); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// Serialize serializes the transfer, this is what gets signed
+func (t *Transfer) Serialize() (buf []byte) {
+	// From [33 bytes]
+	// FromSubAccount [4 bytes]
+	// To [33 bytes]
+	// ToSubAccount [4 bytes]
+	// Asset [1 byte]
+	// Amount [8 bytes]
+	// Nonce [8 bytes]
+	var subAccountBytes [4]byte
+	buf = append(buf, t.From[:]...)
+	binary.BigEndian.PutUint32(subAccountBytes[:], t.FromSubAccount)
+	buf = append(buf, subAccountBytes[:]...)
+	buf = append(buf, t.To[:]...)
+	binary.BigEndian.PutUint32(subAccountBytes[:], t.ToSubAccount)
+	buf = append(buf, subAccountBytes[:]...)
+	buf = append(buf, byte(t.Asset))
+	var intBytes [8]byte
+	binary.BigEndian.PutUint64(intBytes[:], t.Amount)
+	buf = append(buf, intBytes[:]...)
+	binary.BigEndian.PutUint64(intBytes[:], t.Nonce)
+	buf = append(buf, intBytes[:]...)
+	return
+}
+
+// String returns the string representation of a transfer
+func (t *Transfer) String() string {
+	// this will pass because all of the fields are marshallable
+	jsonRepresentation, _ := json.Marshal(t)
+	return string(jsonRepresentation)
+}